@@ -101,6 +101,7 @@ type TxDesc struct {
 type TxPool struct {
 	// The following variables must only be used atomically.
 	lastUpdated   int64 // last time pool was updated
+	minRelayTxFee int64 // effective minimum relay fee in DUO/kB, at least Policy.MinRelayTxFee
 	mtx           sync.RWMutex
 	cfg           Config
 	pool          map[chainhash.Hash]*TxDesc
@@ -224,6 +225,14 @@ func (mp *TxPool) MaybeAcceptTransaction(
 	return hashes, txD, e
 }
 
+// MinRelayTxFee returns the minimum transaction fee in DUO/kB the pool currently requires before it considers a
+// transaction to have a non-zero fee. Wallets can use it as the lowest fee rate that will be relayed.
+//
+// This function is safe for concurrent access.
+func (mp *TxPool) MinRelayTxFee() amt.Amount {
+	return amt.Amount(atomic.LoadInt64(&mp.minRelayTxFee))
+}
+
 // MiningDescs returns a slice of mining descriptors for all the transactions in the pool. This is part of the mining.
 // TxSource interface implementation and is safe for concurrent access as required by the interface contract.
 func (mp *TxPool) MiningDescs() []*mining.TxDesc {
@@ -393,6 +402,19 @@ func (mp *TxPool) RemoveTransaction(tx *util.Tx, removeRedeemers bool) {
 	mp.mtx.Unlock()
 }
 
+// SetMinRelayTxFee changes the minimum transaction fee in DUO/kB the pool requires, for example to raise it while the
+// pool is congested. It can't be lowered below the configured Policy.MinRelayTxFee, so setting zero restores it. It
+// applies to the transactions processed after it is changed.
+//
+// This function is safe for concurrent access.
+func (mp *TxPool) SetMinRelayTxFee(fee amt.Amount) {
+	if fee < mp.cfg.Policy.MinRelayTxFee {
+		fee = mp.cfg.Policy.MinRelayTxFee
+	}
+	atomic.StoreInt64(&mp.minRelayTxFee, int64(fee))
+	D.Ln("minimum relay fee set to", fee)
+}
+
 // TxDescs returns a slice of descriptors for all the transactions in the pool. The descriptors are to be treated as
 // read only. This function is safe for concurrent access.
 func (mp *TxPool) TxDescs() []*TxDesc {
@@ -652,7 +674,7 @@ func (mp *TxPool) maybeAcceptTransaction(
 			tx,
 			nextBlockHeight,
 			medianTimePast,
-			mp.cfg.Policy.MinRelayTxFee,
+			mp.MinRelayTxFee(),
 			mp.cfg.Policy.MaxTxVersion,
 		)
 		if e != nil {
@@ -793,7 +815,7 @@ func (mp *TxPool) maybeAcceptTransaction(
 	serializedSize := GetTxVirtualSize(tx)
 	minFee := calcMinRequiredTxRelayFee(
 		serializedSize,
-		mp.cfg.Policy.MinRelayTxFee,
+		mp.MinRelayTxFee(),
 	)
 	if serializedSize >= (DefaultBlockPrioritySize-1000) && txFee < minFee {
 		str := fmt.Sprintf(
@@ -1031,6 +1053,7 @@ func (mp *TxPool) removeTransaction(tx *util.Tx, removeRedeemers bool) {
 func New(cfg *Config) *TxPool {
 	return &TxPool{
 		cfg:            *cfg,
+		minRelayTxFee:  int64(cfg.Policy.MinRelayTxFee),
 		pool:           make(map[chainhash.Hash]*TxDesc),
 		orphans:        make(map[chainhash.Hash]*orphanTx),
 		orphansByPrev:  make(map[wire.OutPoint]map[chainhash.Hash]*util.Tx),
@@ -832,3 +832,39 @@ func TestCheckSpend(t *testing.T) {
 		t.Fatalf("Unexpeced spend found in pool: %v", spend)
 	}
 }
+
+// TestSetMinRelayTxFee ensures the minimum relay fee can be raised at runtime but not lowered below the configured
+// policy, and that transactions are checked against the raised fee.
+func TestSetMinRelayTxFee(t *testing.T) {
+	t.Parallel()
+	harness, outputs, e := newPoolHarness(&chaincfg.MainNetParams)
+	if e != nil {
+		t.Fatalf("unable to create test pool: %v", e)
+	}
+	policyFee := harness.txPool.cfg.Policy.MinRelayTxFee
+	if fee := harness.txPool.MinRelayTxFee(); fee != policyFee {
+		t.Fatalf("initial minimum relay fee is %v, want %v", fee, policyFee)
+	}
+	harness.txPool.SetMinRelayTxFee(policyFee / 2)
+	if fee := harness.txPool.MinRelayTxFee(); fee != policyFee {
+		t.Fatalf("minimum relay fee lowered to %v, below the policy %v", fee, policyFee)
+	}
+	tx, e := harness.CreateSignedTx(outputs, 1)
+	if e != nil {
+		t.Fatalf("unable to create signed tx: %v", e)
+	}
+	// Raised high enough, the output of the transaction is dust.
+	highFee := amount2.Amount(1e15)
+	harness.txPool.SetMinRelayTxFee(highFee)
+	if fee := harness.txPool.MinRelayTxFee(); fee != highFee {
+		t.Fatalf("minimum relay fee is %v, want %v", fee, highFee)
+	}
+	if _, e = harness.txPool.ProcessTransaction(nil, tx, false, false, 0); e == nil {
+		t.Fatal("ProcessTransaction: accepted a transaction below the raised minimum relay fee")
+	}
+	// Setting zero restores the policy fee and the transaction is accepted.
+	harness.txPool.SetMinRelayTxFee(0)
+	if _, e = harness.txPool.ProcessTransaction(nil, tx, false, false, 0); e != nil {
+		t.Fatalf("ProcessTransaction: failed to accept tx: %v", e)
+	}
+}
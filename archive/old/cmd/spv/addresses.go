@@ -0,0 +1,117 @@
+package spv
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	
+	"github.com/p9c/pod/pkg/addrmgr"
+	"github.com/p9c/pod/pkg/connmgr"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// addressBackoff is how long to wait before asking the address manager for an address again after it ran out of
+// usable ones.
+type addressBackoff struct {
+	mtx   sync.Mutex
+	delay time.Duration
+	until time.Time
+}
+
+// newAddress returns an address from the address manager to make an outbound connection to. When the address manager
+// has no usable address, OnAddressExhaustion is called so more can be found, and further attempts wait out a backoff
+// that doubles each time, up to MaxAddressExhaustionBackoff, so the connection manager doesn't spin.
+func (s *ChainService) newAddress() (net.Addr, error) {
+	if e := s.waitAddressBackoff(); e != nil {
+		return nil, e
+	}
+	for tries := 0; tries < 100; tries++ {
+		addr := s.addrManager.GetAddress()
+		if addr == nil {
+			break
+		}
+		// Address will not be invalid, local or unroutable because addrmanager rejects those on addition. Just check
+		// that we don't already have an address in the same group so that we are not connecting to the same network
+		// segment, or autonomous system, at the expense of others.
+		key := s.groupKey(addr.NetAddress())
+		if s.OutboundGroupCount(key) != 0 {
+			continue
+		}
+		// only allow recent nodes (10mins) after we failed 30 times
+		if tries < 30 && time.Since(addr.LastAttempt()) < 10*time.Minute {
+			continue
+		}
+		// allow nondefault ports after 50 failed tries.
+		if tries < 50 && fmt.Sprintf("%d", addr.NetAddress().Port) !=
+			s.chainParams.DefaultPort {
+			continue
+		}
+		s.addrBackoff.mtx.Lock()
+		s.addrBackoff.delay = 0
+		s.addrBackoff.mtx.Unlock()
+		addrString := addrmgr.NetAddressKey(addr.NetAddress())
+		return s.addrStringToNetAddr(addrString)
+	}
+	s.addressExhausted()
+	return nil, ErrNoValidAddress
+}
+
+// waitAddressBackoff blocks until the backoff after the address manager last ran out of addresses has passed.
+func (s *ChainService) waitAddressBackoff() error {
+	s.addrBackoff.mtx.Lock()
+	wait := time.Until(s.addrBackoff.until)
+	s.addrBackoff.mtx.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-s.quit.Wait():
+		return ErrShuttingDown
+	}
+}
+
+// addressExhausted counts the address manager running out of addresses, lengthens the backoff before it is asked
+// again and lets the application know so it can find more addresses.
+func (s *ChainService) addressExhausted() {
+	count := atomic.AddUint64(&s.addrExhaustions, 1)
+	s.addrBackoff.mtx.Lock()
+	if s.addrBackoff.delay == 0 {
+		s.addrBackoff.delay = AddressExhaustionBackoff
+	} else if s.addrBackoff.delay *= 2; s.addrBackoff.delay > MaxAddressExhaustionBackoff {
+		s.addrBackoff.delay = MaxAddressExhaustionBackoff
+	}
+	delay := s.addrBackoff.delay
+	s.addrBackoff.until = time.Now().Add(delay)
+	s.addrBackoff.mtx.Unlock()
+	D.F("no valid connect address (%d times), trying again in %v", count, delay)
+	if s.onAddressExhaustion != nil {
+		go s.onAddressExhaustion()
+	}
+}
+
+// AddressExhaustions returns the number of times the address manager has run out of addresses to make outbound
+// connections to. It is safe for concurrent access.
+func (s *ChainService) AddressExhaustions() uint64 {
+	return atomic.LoadUint64(&s.addrExhaustions)
+}
+
+// SeedFromDNS adds the peers found by querying the DNS seeds of the chain to the address manager. It can be called from
+// Config.OnAddressExhaustion to find more addresses when the address manager runs out.
+func (s *ChainService) SeedFromDNS() {
+	connmgr.SeedFromDNS(
+		&s.chainParams, RequiredServices,
+		s.nameResolver, func(addrs []*wire.NetAddress) {
+			// The seeders are not peers, so rather than crediting every address to the first one, and crowding them
+			// all into the new buckets of its group, each address is attributed to itself.
+			sourced := make([]addrmgr.SourcedAddress, len(addrs))
+			for i, na := range addrs {
+				sourced[i] = addrmgr.SourcedAddress{Addr: na}
+			}
+			s.addrManager.AddSourcedAddresses(sourced)
+		},
+	)
+}
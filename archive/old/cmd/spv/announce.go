@@ -0,0 +1,139 @@
+package spv
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+	
+	"github.com/p9c/pod/pkg/amt"
+)
+
+// announcementLimiter holds back the transaction announcements queued to a peer past Config.PeerAnnouncementLimit in
+// an interval, and releases them in the order they were queued as later intervals allow.
+type announcementLimiter struct {
+	mtx sync.Mutex
+	// windowStart is when the current interval started, and sent is the number of announcements passed on to the send
+	// queue of the peer in it.
+	windowStart time.Time
+	sent        int
+	held        list.List
+	// releasing is set while a release of the held announcements is scheduled.
+	releasing bool
+	dropped   uint64
+}
+
+// advance starts a new interval if the current one is over by now.
+func (a *announcementLimiter) advance(now time.Time, interval time.Duration) {
+	if now.Sub(a.windowStart) >= interval {
+		a.windowStart, a.sent = now, 0
+	}
+}
+
+// announcementInterval returns the interval that Config.PeerAnnouncementLimit applies to.
+func (s *ChainService) announcementInterval() time.Duration {
+	if s.peerAnnouncementInterval > 0 {
+		return s.peerAnnouncementInterval
+	}
+	return time.Second
+}
+
+// limitAnnouncement passes the announcement on to the send queue of the peer if the limit of the current interval
+// allows it and no announcements are held before it, and holds it otherwise. When Config.PeerAnnouncementQueueSize
+// announcements are already held, it is dropped and counted.
+func (sp *ServerPeer) limitAnnouncement(m queuedMsg) {
+	limit, interval := sp.server.peerAnnouncementLimit, sp.server.announcementInterval()
+	a := &sp.announcements
+	a.mtx.Lock()
+	now := time.Now()
+	a.advance(now, interval)
+	if a.held.Len() == 0 && a.sent < limit {
+		a.sent++
+		a.mtx.Unlock()
+		sp.queueMsg(m)
+		return
+	}
+	if size := sp.server.peerAnnouncementQueueSize; size > 0 && a.held.Len() >= size {
+		a.dropped++
+		a.mtx.Unlock()
+		atomic.AddUint64(&sp.server.droppedAnnounces, 1)
+		D.F("%d transaction announcements to %s are held -- dropping a new one", size, sp)
+		signalQueued(m.doneChan)
+		return
+	}
+	a.held.PushBack(m)
+	schedule := !a.releasing
+	a.releasing = true
+	wait := a.windowStart.Add(interval).Sub(now)
+	a.mtx.Unlock()
+	if schedule {
+		time.AfterFunc(wait, sp.releaseAnnouncements)
+	}
+}
+
+// releaseAnnouncements passes as many of the held announcements on to the send queue of the peer as the limit of the
+// current interval allows, and schedules another release at the end of the interval if some are left.
+func (sp *ServerPeer) releaseAnnouncements() {
+	limit, interval := sp.server.peerAnnouncementLimit, sp.server.announcementInterval()
+	a := &sp.announcements
+	a.mtx.Lock()
+	now := time.Now()
+	a.advance(now, interval)
+	var release []queuedMsg
+	for a.held.Len() > 0 && a.sent < limit {
+		release = append(release, a.held.Remove(a.held.Front()).(queuedMsg))
+		a.sent++
+	}
+	again := a.held.Len() > 0
+	a.releasing = again
+	wait := a.windowStart.Add(interval).Sub(now)
+	a.mtx.Unlock()
+	for _, m := range release {
+		sp.queueMsg(m)
+	}
+	if again {
+		time.AfterFunc(wait, sp.releaseAnnouncements)
+	}
+}
+
+// dropHeldAnnouncementsBelow drops the held transaction announcements paying less than feeFilter per kB, and returns
+// how many were dropped.
+func (sp *ServerPeer) dropHeldAnnouncementsBelow(feeFilter amt.Amount) (dropped int) {
+	a := &sp.announcements
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for e := a.held.Front(); e != nil; {
+		next := e.Next()
+		if m := e.Value.(queuedMsg); m.feeRate > 0 && m.feeRate < feeFilter {
+			a.held.Remove(e)
+			signalQueued(m.doneChan)
+			dropped++
+		}
+		e = next
+	}
+	return dropped
+}
+
+// AnnouncementQueueDepth returns the number of transaction announcements to the peer held back by
+// Config.PeerAnnouncementLimit.
+func (sp *ServerPeer) AnnouncementQueueDepth() int {
+	a := &sp.announcements
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.held.Len()
+}
+
+// DroppedAnnouncements returns the number of transaction announcements to the peer that were dropped because
+// Config.PeerAnnouncementQueueSize of them were already held.
+func (sp *ServerPeer) DroppedAnnouncements() uint64 {
+	a := &sp.announcements
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.dropped
+}
+
+// DroppedAnnouncements returns the number of transaction announcements to all peers that were dropped because
+// Config.PeerAnnouncementQueueSize of them were already held for the peer. It is safe for concurrent access.
+func (s *ChainService) DroppedAnnouncements() uint64 {
+	return atomic.LoadUint64(&s.droppedAnnounces)
+}
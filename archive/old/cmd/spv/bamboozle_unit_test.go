@@ -13,6 +13,7 @@ import (
 	"github.com/p9c/pod/pkg/gcs"
 	"github.com/p9c/pod/pkg/gcs/builder"
 	"github.com/p9c/pod/pkg/walletdb"
+	_ "github.com/p9c/pod/pkg/walletdb/bdb"
 )
 
 func decodeHashNoError(str string) *chainhash.Hash {
@@ -94,7 +95,7 @@ var (
 	}
 	// For the purpose of the cfheader mismatch test, we actually only need to have the scripts of each transaction
 	// present.
-	block = &wire.Block{
+	testBlock = &wire.Block{
 		Transactions: []*wire.MsgTx{
 			{
 				TxOut: []*wire.TxOut{
@@ -119,7 +120,7 @@ var (
 			},
 		},
 	}
-	correctFilter, _ = builder.BuildBasicFilter(block, nil)
+	correctFilter, _ = builder.BuildBasicFilter(testBlock, nil)
 	fakeFilter1, _   = gcs.FromBytes(
 		2, builder.DefaultP, builder.DefaultM, []byte{
 			0x30, 0x43, 0x02, 0x1f, 0x4d, 0x23, 0x81, 0xdc,
@@ -330,7 +331,7 @@ var (
 	resolveCFHTestCases = []*resolveCFHTestCase{
 		{
 			name:  "all bad 1",
-			block: block,
+			block: testBlock,
 			peerFilters: map[string]*gcs.Filter{
 				"a": fakeFilter1,
 				"b": fakeFilter1,
@@ -340,7 +341,7 @@ var (
 		},
 		{
 			name:  "all bad 2",
-			block: block,
+			block: testBlock,
 			peerFilters: map[string]*gcs.Filter{
 				"a": fakeFilter2,
 				"b": fakeFilter2,
@@ -350,7 +351,7 @@ var (
 		},
 		{
 			name:  "all bad 3",
-			block: block,
+			block: testBlock,
 			peerFilters: map[string]*gcs.Filter{
 				"a": fakeFilter2,
 				"b": fakeFilter2,
@@ -360,7 +361,7 @@ var (
 		},
 		{
 			name:  "all bad 4",
-			block: block,
+			block: testBlock,
 			peerFilters: map[string]*gcs.Filter{
 				"a": fakeFilter1,
 				"b": fakeFilter2,
@@ -370,7 +371,7 @@ var (
 		},
 		{
 			name:  "all bad 5",
-			block: block,
+			block: testBlock,
 			peerFilters: map[string]*gcs.Filter{
 				"a": fakeFilter2,
 				"b": fakeFilter1,
@@ -380,7 +381,7 @@ var (
 		},
 		{
 			name:  "one good",
-			block: block,
+			block: testBlock,
 			peerFilters: map[string]*gcs.Filter{
 				"a": correctFilter,
 				"b": fakeFilter1,
@@ -391,7 +392,7 @@ var (
 		},
 		{
 			name:  "all good",
-			block: block,
+			block: testBlock,
 			peerFilters: map[string]*gcs.Filter{
 				"a": correctFilter,
 				"b": correctFilter,
@@ -551,7 +552,7 @@ func TestResolveCFHeadersMismatch(t *testing.T) {
 		t.Run(
 			testCase.name, func(t *testing.T) {
 				badPeers, e := resolveCFHeaderMismatch(
-					block, wire.GCSFilterRegular, testCase.peerFilters,
+					testBlock, wire.GCSFilterRegular, testCase.peerFilters,
 				)
 				if e != nil {
 					t.Fatalf(
@@ -0,0 +1,79 @@
+package spv
+
+import (
+	"sort"
+	"time"
+)
+
+// The subsystems that ban peers, recorded as the Source of their BanEntry.
+const (
+	// BanSourceCaller is the source of bans made through BanPeer by users of the ChainService.
+	BanSourceCaller = "caller"
+	// BanSourceFilterHeaders is the source of bans for serving filter headers that don't match the other peers'.
+	BanSourceFilterHeaders = "filterheaders"
+	// BanSourceGenesis is the source of bans for answering for a genesis block other than ours.
+	BanSourceGenesis = "genesis"
+	// BanSourceHeaderSync is the source of bans for serving block headers that break the rules of header sync.
+	BanSourceHeaderSync = "headersync"
+	// BanSourceProtocol is the source of bans for sending messages that break the protocol, such as an invalid fee
+	// filter, an addr message without addresses or transaction announcements to a client that asked for none.
+	BanSourceProtocol = "protocol"
+	// BanSourceNotFound is the source of bans for answering requests for the blocks a peer announced with notfound.
+	BanSourceNotFound = "notfound"
+	// BanSourceRequests is the source of bans for failing to deliver the blocks and filters requested from a peer.
+	BanSourceRequests = "requests"
+)
+
+// BanEntry is the record of a banned host, kept until the ban expires.
+type BanEntry struct {
+	Host   string
+	Reason string
+	// Source is the subsystem that banned the host, one of the BanSource constants.
+	Source string
+	// BanScore is the ban score of the peer when it was banned.
+	BanScore uint32
+	BannedAt time.Time
+	Until    time.Time
+}
+
+type (
+	// banPeerMsg asks the peer handler to ban a peer.
+	banPeerMsg struct {
+		peer   *ServerPeer
+		source string
+		reason string
+	}
+	getBanListMsg struct {
+		reply chan []BanEntry
+	}
+)
+
+// BanList returns the hosts that are currently banned, the oldest ban first.
+func (s *ChainService) BanList() []BanEntry {
+	replyChan := make(chan []BanEntry)
+	select {
+	case s.query <- getBanListMsg{reply: replyChan}:
+		return <-replyChan
+	case <-s.quit.Wait():
+		return nil
+	}
+}
+
+// banList returns copies of the bans in state that haven't expired yet, the oldest ban first.
+func (state *peerState) banList(now time.Time) []BanEntry {
+	bans := make([]BanEntry, 0, len(state.banned))
+	for _, ban := range state.banned {
+		if now.Before(ban.Until) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(
+		bans, func(i, j int) bool {
+			if !bans[i].BannedAt.Equal(bans[j].BannedAt) {
+				return bans[i].BannedAt.Before(bans[j].BannedAt)
+			}
+			return bans[i].Host < bans[j].Host
+		},
+	)
+	return bans
+}
@@ -83,6 +83,22 @@ func (b *batchSpendReporter) ProcessBlock(
 	}
 }
 
+// ResumeRequests adds the requests that resume a checkpointed scan, whose initial outputs are already known, to the
+// watchlist, and returns the rest of the requests, which need the block at their birth height to find their outputs.
+func (b *batchSpendReporter) ResumeRequests(reqs []*GetUtxoRequest) (fresh []*GetUtxoRequest) {
+	var resumed []*GetUtxoRequest
+	for _, req := range reqs {
+		if req.initialOutput == nil {
+			fresh = append(fresh, req)
+			continue
+		}
+		resumed = append(resumed, req)
+		b.initialTxns[req.Input.OutPoint] = &SpendReport{Output: req.initialOutput}
+	}
+	b.addNewRequests(resumed)
+	return fresh
+}
+
 // addNewRequests adds a set of new GetUtxoRequests to the spend reporter's state. This method immediately adds the
 // request's outpoints to the reporter's watchlist.
 func (b *batchSpendReporter) addNewRequests(reqs []*GetUtxoRequest) {
@@ -0,0 +1,53 @@
+package spv
+
+import (
+	"sync"
+	
+	"github.com/p9c/pod/pkg/block"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// blockFetchKey identifies a block fetch. Fetches that are limited by the block slots are kept apart from those that
+// aren't, as a limited fetch holds its slot while it fetches the previous block unlimited, which would never finish if
+// it waited on a limited fetch of that block that is waiting for a slot.
+type blockFetchKey struct {
+	inv     wire.InvVect
+	limited bool
+}
+
+// blockFetch is a block fetch in progress, whose result is delivered to every caller waiting on it once done is
+// closed.
+type blockFetch struct {
+	done  chan struct{}
+	block *block.Block
+	e     error
+}
+
+// blockFetches coalesces concurrent fetches of the same block, so that only one of them downloads it.
+type blockFetches struct {
+	mtx     sync.Mutex
+	fetches map[blockFetchKey]*blockFetch
+}
+
+// do returns the block fetched by fetch. If a fetch of the block is already in progress it waits for that one and
+// returns its result instead, which is fetched with the query options its caller gave.
+func (f *blockFetches) do(key blockFetchKey, fetch func() (*block.Block, error)) (*block.Block, error) {
+	f.mtx.Lock()
+	if running, ok := f.fetches[key]; ok {
+		f.mtx.Unlock()
+		<-running.done
+		return running.block, running.e
+	}
+	if f.fetches == nil {
+		f.fetches = make(map[blockFetchKey]*blockFetch)
+	}
+	running := &blockFetch{done: make(chan struct{})}
+	f.fetches[key] = running
+	f.mtx.Unlock()
+	running.block, running.e = fetch()
+	f.mtx.Lock()
+	delete(f.fetches, key)
+	f.mtx.Unlock()
+	close(running.done)
+	return running.block, running.e
+}
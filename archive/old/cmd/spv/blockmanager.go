@@ -15,6 +15,8 @@ import (
 	
 	"github.com/p9c/pod/pkg/util/qu"
 	
+	"github.com/p9c/pod/cmd/spv/cache/lru"
+	"github.com/p9c/pod/cmd/spv/filterdb"
 	"github.com/p9c/pod/cmd/spv/headerfs"
 	"github.com/p9c/pod/cmd/spv/headerlist"
 	"github.com/p9c/pod/pkg/blockchain"
@@ -43,21 +45,28 @@ const (
 	numMaxMemHeaders = 10000
 )
 
-// // filterTypes is a map of filter types to synchronize to a lookup
-// // function for the service's store for that filter type.
-// filterTypes = map[wire.FilterType]filterStoreLookup{
-// 	wire.GCSFilterRegular: func(
-// 		s *ChainService) *headerfs.FilterHeaderStore {
-// 		return s.RegFilterHeaders
-// 	},
-// }
+// filterTypes is a map of the filter types that can be synchronized to the header store and filter database types used
+// to persist them.
+var filterTypes = map[wire.FilterType]filterStoreTypes{
+	wire.GCSFilterRegular: {
+		header: headerfs.RegularFilter,
+		db:     filterdb.RegularFilter,
+	},
+	wire.GCSFilterExtended: {
+		header: headerfs.ExtendedFilter,
+		db:     filterdb.ExtendedFilter,
+	},
+}
 
 // zeroHash is the zero value hash (all zeros). It is defined as a convenience.
 var zeroHash chainhash.Hash
 
 type (
-	// filterStoreLookup
-	filterStoreLookup func(*ChainService) *headerfs.FilterHeaderStore
+	// filterStoreTypes are the header store and filter database types that a wire.FilterType is stored as.
+	filterStoreTypes struct {
+		header headerfs.HeaderType
+		db     filterdb.FilterType
+	}
 	// newPeerMsg signifies a newly connected peer to the block handler.
 	newPeerMsg struct {
 		peer *ServerPeer
@@ -87,14 +96,16 @@ type (
 	blockManager struct {
 		started  int32
 		shutdown int32
+		// headerCacheHits and headerCacheLookups count the header messages that held only recently validated headers
+		// and all the header messages looked up in validatedHeaders. They must only be used atomically.
+		headerCacheHits    uint64
+		headerCacheLookups uint64
 		// blkHeaderProgressLogger is a progress logger that we'll use to update the number of blocker headers we've
 		// processed in the past 10 seconds within the log.
 		blkHeaderProgressLogger *headerProgressLogger
 		// fltrHeaderProgessLogger is a process logger similar to the one above, but we'll use it to update the progress
 		// of the set of filter headers that we've verified in the past 10 seconds.
 		fltrHeaderProgessLogger *headerProgressLogger
-		// genesisHeader is the filter header of the genesis block.
-		genesisHeader chainhash.Hash
 		// headerTip will be set to the current block header tip at all times. Callers MUST hold the lock below each
 		// time they read/write from this field.
 		headerTip uint32
@@ -139,6 +150,19 @@ type (
 		minRetargetTimespan int64 // target timespan / adjustment factor
 		maxRetargetTimespan int64 // target timespan * adjustment factor
 		blocksPerRetarget   int32 // target timespan / target time per block
+		// requests tracks the block and filter requests peers haven't delivered yet.
+		requests *requestTracker
+		// validatedHeaders holds the heights of the headers that were recently validated by their hashes, so that
+		// headers announced again by other peers aren't validated again.
+		validatedHeaders *lru.Cache
+		// syncRate is the recent rate block and filter headers were downloaded at, for EstimatedTimeRemaining.
+		syncRate syncRate
+		// checkingFilterAgreement is set while peers are asked for the filter header at the tip before a sync peer is
+		// chosen, and filterAgreement holds the peers that agreed on it at filterAgreementHeight until startSync uses
+		// them. They are only used by the blockHandler goroutine.
+		checkingFilterAgreement bool
+		filterAgreement         map[string]struct{}
+		filterAgreementHeight   uint32
 	}
 )
 
@@ -167,17 +191,18 @@ func newBlockManager(s *ChainService) (*blockManager, error) {
 		blocksPerRetarget:   int32(targetTimespan / targetTimePerBlock),
 		minRetargetTimespan: targetTimespan / adjustmentFactor,
 		maxRetargetTimespan: targetTimespan * adjustmentFactor,
+		requests:            newRequestTracker(),
+		validatedHeaders:    lru.NewCache(uint64(s.headerCacheSize)),
 	}
 	// Next we'll create the two signals that goroutines will use to wait on a particular header chain height before
 	// starting their normal duties.
 	bm.newHeadersSignal = sync.NewCond(&bm.newHeadersMtx)
 	bm.newFilterHeadersSignal = sync.NewCond(&bm.newFilterHeadersMtx)
-	// We fetch the genesis header to use for verifying the first received interval.
-	genesisHeader, e := s.RegFilterHeaders.FetchHeaderByHeight(0)
-	if e != nil {
+	// The headers written since the last checkpoint of the header stores are dropped if the service didn't stop
+	// cleanly after writing them.
+	if e := s.resumeFromCheckpoint(); e != nil {
 		return nil, e
 	}
-	bm.genesisHeader = *genesisHeader
 	// Initialize the next checkpoint based on the current height.
 	header, height, e := s.BlockHeaders.ChainTip()
 	if e != nil {
@@ -347,10 +372,10 @@ func (b *blockManager) cfHandler() {
 		b.wg.Done()
 	}()
 	var (
-		// allCFCheckpoints is a map from our peers to the list of filter checkpoints they respond to us with. We'll
-		// attempt to get filter checkpoints immediately up to the latest block checkpoint we've got stored to avoid
-		// doing unnecessary fetches as the block headers are catching up.
-		allCFCheckpoints map[string][]*chainhash.Hash
+		// allCFCheckpoints maps each filter type to a map from our peers to the list of filter checkpoints they respond
+		// to us with. We'll attempt to get filter checkpoints immediately up to the latest block checkpoint we've got
+		// stored to avoid doing unnecessary fetches as the block headers are catching up.
+		allCFCheckpoints = make(map[wire.FilterType]map[string][]*chainhash.Hash)
 		// lastCp will point to the latest block checkpoint we have for the active chain, if any.
 		lastCp chaincfg.Checkpoint
 		// blockCheckpoints is the list of block checkpoints for the active chain.
@@ -399,84 +424,87 @@ waitForHeaders:
 		b.filterHeaderTip, b.filterHeaderTipHash,
 		lastHeight, lastHeader.BlockHash(),
 	)
-	fType := wire.GCSFilterRegular
-	store := b.server.RegFilterHeaders
-	I.Ln("starting cfheaders sync for filter_type=", fType)
-	// If we have less than a full checkpoint's worth of blocks, such as on simnet, we don't really need to request
-	// checkpoints as we'll get 0 from all peers. We can go on and just request the cfheaders.
-	var goodCheckpoints []*chainhash.Hash
-	for len(goodCheckpoints) == 0 && lastHeight >= wire.CFCheckptInterval {
-		// Quit if requested.
-		select {
-		case <-b.quit.Wait():
-			return
-		default:
-		}
-		// If the height now exceeds the height at which we fetched the checkpoints last time, we must query our peers
-		// again.
-		if minCheckpointHeight(allCFCheckpoints) < lastHeight {
-			// Start by getting the filter checkpoints up to the height of our block header chain. If we have a chain
-			// checkpoint that is past this height, we use that instead. We do this so we don't have to fetch all filter
-			// checkpoints each time our block header chain advances.
-			// TODO(halseth): fetch filter checkpoints up to the best block of the connected peers.
-			bestHeight := lastHeight
-			bestHash := lastHash
-			if bestHeight < uint32(lastCp.Height) {
-				bestHeight = uint32(lastCp.Height)
-				bestHash = *lastCp.Hash
+	// Each filter type has its own header chain, so we'll sync them one after the other, starting with the regular
+	// filters that the rest of the block manager tracks.
+	for _, fType := range b.server.syncFilterTypes {
+		store := b.server.filterHeaders[fType]
+		I.Ln("starting cfheaders sync for filter_type=", fType)
+		// If we have less than a full checkpoint's worth of blocks, such as on simnet, we don't really need to request
+		// checkpoints as we'll get 0 from all peers. We can go on and just request the cfheaders.
+		var goodCheckpoints []*chainhash.Hash
+		for len(goodCheckpoints) == 0 && lastHeight >= wire.CFCheckptInterval {
+			// Quit if requested.
+			select {
+			case <-b.quit.Wait():
+				return
+			default:
 			}
-			D.F(
-				"getting filter checkpoints up to height=%v, hash=%v",
-				bestHeight, bestHash,
+			// If the height now exceeds the height at which we fetched the checkpoints last time, we must query our peers
+			// again.
+			if minCheckpointHeight(allCFCheckpoints[fType]) < lastHeight {
+				// Start by getting the filter checkpoints up to the height of our block header chain. If we have a chain
+				// checkpoint that is past this height, we use that instead. We do this so we don't have to fetch all filter
+				// checkpoints each time our block header chain advances.
+				// TODO(halseth): fetch filter checkpoints up to the best block of the connected peers.
+				bestHeight := lastHeight
+				bestHash := lastHash
+				if bestHeight < uint32(lastCp.Height) {
+					bestHeight = uint32(lastCp.Height)
+					bestHash = *lastCp.Hash
+				}
+				D.F(
+					"getting filter checkpoints up to height=%v, hash=%v",
+					bestHeight, bestHash,
+				)
+				allCFCheckpoints[fType] = b.getCheckpts(&bestHash, fType)
+				if len(allCFCheckpoints[fType]) == 0 {
+					W.F(
+						"unable to fetch set of candidate checkpoints, trying again...",
+					)
+					select {
+					case <-time.After(QueryTimeout):
+					case <-b.quit.Wait():
+						return
+					}
+					continue
+				}
+			}
+			// Cap the received checkpoints at the current height, as we can only verify checkpoints up to the height we
+			// have block headers for.
+			checkpoints := make(map[string][]*chainhash.Hash)
+			for p, cps := range allCFCheckpoints[fType] {
+				for i, cp := range cps {
+					height := uint32(i+1) * wire.CFCheckptInterval
+					if height > lastHeight {
+						break
+					}
+					checkpoints[p] = append(checkpoints[p], cp)
+				}
+			}
+			// See if we can detect which checkpoint list is correct. If not, we will cycle again.
+			goodCheckpoints, e = b.resolveConflict(
+				checkpoints, store, fType,
 			)
-			allCFCheckpoints = b.getCheckpts(&bestHash, fType)
-			if len(allCFCheckpoints) == 0 {
-				W.F(
-					"unable to fetch set of candidate checkpoints, trying again...",
+			if e != nil {
+				D.F(
+					"got error attempting to determine correct cfheader"+
+						" checkpoints: %v, trying again",
+					e,
 				)
+			}
+			if len(goodCheckpoints) == 0 {
 				select {
 				case <-time.After(QueryTimeout):
 				case <-b.quit.Wait():
 					return
 				}
-				continue
-			}
-		}
-		// Cap the received checkpoints at the current height, as we can only verify checkpoints up to the height we
-		// have block headers for.
-		checkpoints := make(map[string][]*chainhash.Hash)
-		for p, cps := range allCFCheckpoints {
-			for i, cp := range cps {
-				height := uint32(i+1) * wire.CFCheckptInterval
-				if height > lastHeight {
-					break
-				}
-				checkpoints[p] = append(checkpoints[p], cp)
 			}
 		}
-		// See if we can detect which checkpoint list is correct. If not, we will cycle again.
-		goodCheckpoints, e = b.resolveConflict(
-			checkpoints, store, fType,
+		// Get all the headers up to the last known good checkpoint.
+		b.getCheckpointedCFHeaders(
+			goodCheckpoints, store, fType,
 		)
-		if e != nil {
-			D.F(
-				"got error attempting to determine correct cfheader"+
-					" checkpoints: %v, trying again",
-				e,
-			)
-		}
-		if len(goodCheckpoints) == 0 {
-			select {
-			case <-time.After(QueryTimeout):
-			case <-b.quit.Wait():
-				return
-			}
-		}
 	}
-	// Get all the headers up to the last known good checkpoint.
-	b.getCheckpointedCFHeaders(
-		goodCheckpoints, store, fType,
-	)
 	// Now we check the headers again. If the block headers are not yet current, then we go back to the loop waiting for
 	// them to finish.
 	if !b.BlockHeadersSynced() {
@@ -516,14 +544,16 @@ waitForHeaders:
 		}
 		b.newHeadersSignal.L.Unlock()
 		// At this point, we know that there're a set of new filter headers to fetch, so we'll grab them now.
-		if e = b.getUncheckpointedCFHeaders(
-			store, fType,
-		); E.Chk(e) {
-			D.F("couldn't get uncheckpointed headers for %v: %v", fType, e)
-			select {
-			case <-time.After(QueryTimeout):
-			case <-b.quit.Wait():
-				return
+		for _, fType := range b.server.syncFilterTypes {
+			if e = b.getUncheckpointedCFHeaders(
+				b.server.filterHeaders[fType], fType,
+			); E.Chk(e) {
+				D.F("couldn't get uncheckpointed headers for %v: %v", fType, e)
+				select {
+				case <-time.After(QueryTimeout):
+				case <-b.quit.Wait():
+					return
+				}
 			}
 		}
 		// Quit if requested.
@@ -617,7 +647,7 @@ func (b *blockManager) getUncheckpointedCFHeaders(
 				)
 				sp := b.server.PeerByAddr(peer)
 				if sp != nil {
-					b.server.BanPeer(sp)
+					b.server.BanPeerFor(sp, BanSourceFilterHeaders, "invalid filter headers")
 					sp.Disconnect()
 				}
 				delete(headers, peer)
@@ -658,6 +688,16 @@ func (b *blockManager) getCheckpointedCFHeaders(
 		)
 	}
 	initialFilterHeader := curHeader
+	// Each filter type has its own genesis filter header, which serves as the previous checkpoint of the first interval.
+	genesisHeader, e := store.FetchHeaderByHeight(0)
+	if e != nil {
+		panic(
+			fmt.Sprintf(
+				"failed getting genesis header from filter "+
+					"store: %v", e,
+			),
+		)
+	}
 	I.F(
 		"fetching set of checkpointed cfheaders filters from height=%v, hash=%v",
 		curHeight, curHeader,
@@ -741,7 +781,7 @@ func (b *blockManager) getCheckpointedCFHeaders(
 			}
 			// Use either the genesis header or the previous checkpoint index as the previous checkpoint when verifying
 			// that the filter headers in the response match up.
-			prevCheckpoint := &b.genesisHeader
+			prevCheckpoint := genesisHeader
 			if checkPointIndex > 0 {
 				prevCheckpoint = checkpoints[checkPointIndex-1]
 			}
@@ -789,9 +829,24 @@ func (b *blockManager) getCheckpointedCFHeaders(
 			// TODO(roasbeef): can eventually special case handle this at the top
 			if bytes.Equal(curHeader[:], initialFilterHeader[:]) {
 				// So we'll set the prev header to our best known header, and seek within the header range a bit so we
-				// don't write any duplicate headers.
-				r.PrevFilterHeader = *curHeader
+				// don't write any duplicate headers. The skipped headers must lead to our best known header, which is
+				// how a start anchor the rest of the chain was never downloaded for gets checked against the
+				// checkpoints.
 				offset := curHeight + 1 - startHeight
+				prevHeader := r.PrevFilterHeader
+				for _, hash := range r.FilterHashes[:offset] {
+					prevHeader = chainhash.DoubleHashH(
+						append(hash[:], prevHeader[:]...),
+					)
+				}
+				if prevHeader != *curHeader {
+					W.F(
+						"cfheaders from peer %s don't lead to our filter header %v at height %v",
+						sp.Addr(), curHeader, curHeight,
+					)
+					return false
+				}
+				r.PrevFilterHeader = *curHeader
 				r.FilterHashes = r.FilterHashes[offset:]
 				D.F(
 					"using offset %d for initial filter header range (new prev_hash=%v)",
@@ -834,6 +889,7 @@ func (b *blockManager) getCheckpointedCFHeaders(
 		},
 		// Same quit channel we're watching.
 		b.quit,
+		b.server.filterQueryOptions()...,
 	)
 }
 
@@ -901,6 +957,11 @@ func (b *blockManager) writeCFHeadersMsg(
 	if e != nil {
 		return nil, e
 	}
+	// Subscribers and the filter header tip only follow the regular filter header chain, so for any other filter type
+	// we're done.
+	if store != b.server.RegFilterHeaders {
+		return &lastHeader, nil
+	}
 	// Notify subscribers, and also update the filter header progress logger at the same time.
 	msgType := connectBasic
 	for i, header := range matchingBlockHeaders {
@@ -919,6 +980,9 @@ func (b *blockManager) writeCFHeadersMsg(
 	// We'll also set the new header tip and notify any peers that the tip has changed as well. Unlike the set of
 	// notifications above, this is for sub-system that only need to know the height has changed rather than know each
 	// new header that's been added to the tip.
+	if lastHeight > b.filterHeaderTip {
+		b.syncRate.add(time.Now(), uint64(lastHeight-b.filterHeaderTip))
+	}
 	b.filterHeaderTip = lastHeight
 	b.filterHeaderTipHash = lastHash
 	b.newFilterHeadersSignal.Broadcast()
@@ -1040,7 +1104,7 @@ func (b *blockManager) resolveConflict(
 				I.F("banning peer=%v for invalid filter headers", peer)
 				sp := b.server.PeerByAddr(peer)
 				if sp != nil {
-					b.server.BanPeer(sp)
+					b.server.BanPeerFor(sp, BanSourceFilterHeaders, "invalid filter headers")
 					sp.Disconnect()
 				}
 				delete(headers, peer)
@@ -1054,7 +1118,7 @@ func (b *blockManager) resolveConflict(
 		if _, ok := headers[peer]; !ok {
 			sp := b.server.PeerByAddr(peer)
 			if sp != nil {
-				b.server.BanPeer(sp)
+				b.server.BanPeerFor(sp, BanSourceFilterHeaders, "no filter header checkpoints")
 				sp.Disconnect()
 			}
 			delete(checkpoints, peer)
@@ -1158,6 +1222,36 @@ func resolveCFHeaderMismatch(
 				}
 			}
 		}
+	case wire.GCSFilterExtended:
+		// The extended filter commits to every txid and every non-coinbase input script in the block, all of which we
+		// can check against the block itself.
+	extPeerVerification:
+		for peerAddr, filter := range filtersFromPeers {
+			for i, tx := range block.Transactions {
+				txHash := tx.TxHash()
+				items := [][]byte{txHash[:]}
+				if i != 0 {
+					for _, txIn := range tx.TxIn {
+						if len(txIn.SignatureScript) != 0 {
+							items = append(items, txIn.SignatureScript)
+						}
+					}
+				}
+				for _, item := range items {
+					match, e := filter.Match(filterKey, item)
+					if e != nil {
+						// If we're unable to query this filter, then we'll skip this peer all together.
+						continue extPeerVerification
+					}
+					if match {
+						continue
+					}
+					// If this filter doesn't match, then we'll mark this peer as bad and move on to the next peer.
+					badPeers[peerAddr] = struct{}{}
+					continue extPeerVerification
+				}
+			}
+		}
 	default:
 		return nil, fmt.Errorf("unknown filter: %v", fType)
 	}
@@ -1213,6 +1307,7 @@ func (b *blockManager) getCFHeadersForAllPeers(
 				}
 			}
 		},
+		b.server.filterQueryOptions()...,
 	)
 	return headers
 }
@@ -1257,6 +1352,7 @@ func (b *blockManager) fetchFilterFromAllPeers(
 			default:
 			}
 		},
+		b.server.filterQueryOptions()...,
 	)
 	return filterResponses
 }
@@ -1283,6 +1379,7 @@ func (b *blockManager) getCheckpts(
 				}
 			}
 		},
+		b.server.filterQueryOptions()...,
 	)
 	return checkpoints
 }
@@ -1329,8 +1426,9 @@ func checkCFCheckptSanity(
 				return i, nil
 			}
 		}
+		// Headers below the height the store was started from aren't stored so they can't be compared.
 		ckptHeight := uint32((i + 1) * wire.CFCheckptInterval)
-		if ckptHeight <= storeTip {
+		if ckptHeight <= storeTip && ckptHeight >= headerStore.StartHeight() {
 			header, e := headerStore.FetchHeaderByHeight(
 				ckptHeight,
 			)
@@ -1359,10 +1457,14 @@ func checkCFCheckptSanity(
 // This is important because the block manager controls which blocks are needed and how the fetching should proceed.
 func (b *blockManager) blockHandler() {
 	candidatePeers := list.New()
+	requestSweep := time.NewTicker(requestSweepInterval)
+	defer requestSweep.Stop()
 out:
 	for {
 		// Now check peer messages and quit channels.
 		select {
+		case <-requestSweep.C:
+			b.handleStalledRequests()
 		case m := <-b.peerChan:
 			switch msg := m.(type) {
 			case *newPeerMsg:
@@ -1373,6 +1475,10 @@ out:
 				b.handleHeadersMsg(msg)
 			case *donePeerMsg:
 				b.handleDonePeerMsg(candidatePeers, msg.peer)
+			case *resetMsg:
+				msg.reply <- b.handleResetMsg(candidatePeers, msg.height)
+			case *filterAgreementMsg:
+				b.handleFilterAgreementMsg(candidatePeers, msg)
 			default:
 				W.F(
 					"invalid message type in block handler: %Ter", msg,
@@ -1461,11 +1567,27 @@ func (b *blockManager) startSync(peers *list.List) {
 		E.Ln("failed to get hash and height for the latest block:", e)
 		return
 	}
+	// When filter header agreement is required, only the peers that agree with the majority on the filter header at
+	// the tip are considered. Asking the peers takes a while, so it's done away from the block handler, which comes
+	// back here once they have agreed.
+	var agreed map[string]struct{}
+	if b.server.filterHeaderAgreementPeers > 0 {
+		if b.filterAgreement == nil || b.filterAgreementHeight != bestHeight {
+			b.startFilterHeaderAgreement(bestHeight)
+			return
+		}
+		agreed, b.filterAgreement = b.filterAgreement, nil
+	}
 	var bestPeer *ServerPeer
 	var enext *list.Element
 	for e := peers.Front(); e != nil; e = enext {
 		enext = e.Next()
 		sp := e.Value.(*ServerPeer)
+		if agreed != nil {
+			if _, ok := agreed[sp.Addr()]; !ok {
+				continue
+			}
+		}
 		// Remove sync candidate peers that are no longer candidates due to passing their latest known block.
 		//
 		// NOTE: The < is intentional as opposed to <=. While technically the peer doesn't have a later block when it's
@@ -1475,15 +1597,9 @@ func (b *blockManager) startSync(peers *list.List) {
 			peers.Remove(e)
 			continue
 		}
-		var lastping int64
-		if bestPeer == nil || sp.LastBlock() > bestPeer.LastBlock() {
-			lp := sp.LastPingMicros()
-			// prefer the peer with the lowest ping, only update if it is lower than the less up to date one (or if
-			// equal in block, ping becomes the criteria)
-			if lp < lastping {
-				bestPeer = sp
-				lastping = lp
-			}
+		// The advertised heights are only trusted between peers that have delivered the same header work.
+		if betterSyncPeer(sp, bestPeer) {
+			bestPeer = sp
 		}
 	}
 	// Start syncing from the best peer if one was selected.
@@ -1696,6 +1812,21 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 	if numHeaders == 0 {
 		return
 	}
+	// Once the headers are synced, headers that were already validated are only announced again by other peers, which
+	// are then known to have them.
+	if height, ok := b.headersValidated(msg.Headers); ok && b.BlockHeadersSynced() {
+		hmsg.peer.UpdateLastBlockHeight(height)
+		hmsg.peer.headerWork.add(b.validatedHeaderHeights(msg.Headers)...)
+		return
+	}
+	// Once the headers are synced, the headers of a peer that was sent sendheaders announce its new blocks as an inv
+	// would, and its last announced block is updated the same way.
+	announcement := hmsg.peer.SentSendHeaders() && b.BlockHeadersSynced()
+	if announcement {
+		announced := msg.Headers[numHeaders-1].BlockHash()
+		hmsg.peer.UpdateLastAnnouncedBlock(&announced)
+		hmsg.peer.AddKnownInventory(wire.NewInvVect(wire.InvTypeBlock, &announced))
+	}
 	// For checking to make sure blocks aren't too far in the future as of the time we receive the headers message.
 	maxTimestamp := b.server.timeSource.AdjustedTime().
 		Add(maxTimeOffset)
@@ -1735,14 +1866,16 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 		prevHash := prevNode.Header.BlockHash()
 		var e error
 		if prevHash.IsEqual(&blockHeader.PrevBlock) {
-			e = b.checkHeaderSanity(
-				blockHeader, maxTimestamp, false,
-				prevNode.Height+1,
-			)
-			if e != nil {
-				W.F("header doesn't pass sanity check: %s -- disconnecting peer", e)
-				hmsg.peer.Disconnect()
-				return
+			if !b.assumeValid(prevNode.Height + 1) {
+				e = b.checkHeaderSanity(
+					blockHeader, maxTimestamp, false,
+					prevNode.Height+1,
+				)
+				if e != nil {
+					W.F("header doesn't pass sanity check: %s -- disconnecting peer", e)
+					hmsg.peer.Disconnect()
+					return
+				}
 			}
 			node.Height = prevNode.Height + 1
 			finalHeight = node.Height
@@ -1790,6 +1923,13 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 				&blockHeader.PrevBlock,
 			)
 			if e != nil {
+				// A peer announcing with headers only sends the newest ones, so when it is further ahead than that
+				// they don't connect, and the headers in between are requested once before the peer is disconnected.
+				if announcement {
+					if b.requestAnnouncedHeaders(hmsg.peer, msg.Headers[numHeaders-1].BlockHash()) {
+						return
+					}
+				}
 				W.F(
 					"received block header that does not properly connect to the chain from peer %s (%s) "+
 						"-- disconnecting", hmsg.peer.Addr(), e,
@@ -1808,6 +1948,17 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 				hmsg.peer.Disconnect()
 				return
 			}
+			// A branch from below the anchor the chain was started from forks off a chain we never saw, and contradicts
+			// the ancestry we were told to trust, so the peer is banned.
+			if backHeight < b.server.startHeight {
+				E.F(
+					"attempt at a reorg below the start height %d -- banning peer %s",
+					b.server.startHeight, hmsg.peer,
+				)
+				b.server.BanPeerFor(hmsg.peer, BanSourceHeaderSync, "reorg below the start height")
+				hmsg.peer.Disconnect()
+				return
+			}
 			// Chk the sanity of the new branch. If any of the blocks don't pass sanity checks, disconnect the peer.
 			// We also keep track of the work represented by these headers so we can compare it to the work in the known
 			// good chain.
@@ -1903,6 +2054,7 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 				)
 				// Should we panic here?
 			}
+			hmsg.peer.headerWork.add(hdrs)
 			b.headerList.ResetHeaderState(
 				headerlist.Node{
 					Header: *backHead,
@@ -1956,6 +2108,8 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 		if e != nil {
 			panic(fmt.Sprintf("unable to write block header: %v", e))
 		}
+		b.markHeadersValidated(headerWriteBatch...)
+		hmsg.peer.headerWork.add(headerWriteBatch...)
 	}
 	// When this header is a checkpoint, find the next checkpoint.
 	if receivedCheckpoint {
@@ -1979,24 +2133,58 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 	// Since we have a new set of headers written to disk, we'll send out a new signal to notify any waiting sub-systems
 	// that they can now maybe proceed do to us extending the header chain.
 	b.newHeadersMtx.Lock()
+	if uint32(finalHeight) > b.headerTip {
+		b.syncRate.add(time.Now(), uint64(uint32(finalHeight)-b.headerTip))
+	}
 	b.headerTip = uint32(finalHeight)
 	b.headerTipHash = *finalHash
 	b.newHeadersMtx.Unlock()
 	b.newHeadersSignal.Broadcast()
 }
 
+// requestAnnouncedHeaders sends a getheaders message to the peer for the headers up to an announced header that doesn't
+// connect to the chain, and returns whether it was sent. It isn't sent twice in a row for the same header, so that a
+// peer announcing headers that never connect is disconnected.
+func (b *blockManager) requestAnnouncedHeaders(sp *ServerPeer, announced chainhash.Hash) bool {
+	if b.lastRequested == announced {
+		return false
+	}
+	locator, e := b.server.BlockHeaders.LatestBlockLocator()
+	if e != nil {
+		E.Ln("unable to get the block locator:", e)
+		return false
+	}
+	if e = sp.PushGetHeadersMsg(locator, &announced); e != nil {
+		W.F("failed to send getheaders message to peer %s: %s", sp.Addr(), e)
+		return false
+	}
+	b.lastRequested = announced
+	return true
+}
+
+// assumeValid returns whether the header at the height is accepted without checking its sanity, as it is at or below
+// the last checkpoint while Config.AssumeValidBelowCheckpoint is set.
+func (b *blockManager) assumeValid(height int32) bool {
+	if !b.server.assumeValidBelowCheckpoint {
+		return false
+	}
+	checkpoints := b.server.chainParams.Checkpoints
+	return len(checkpoints) > 0 && height <= checkpoints[len(checkpoints)-1].Height
+}
+
 // checkHeaderSanity checks the PoW, and timestamp of a block header.
 func (b *blockManager) checkHeaderSanity(
 	blockHeader *wire.BlockHeader,
 	maxTimestamp time.Time, reorgAttempt bool, height int32,
 ) (e error) {
-	diff, e := b.calcNextRequiredDifficulty(
-		blockHeader.Timestamp, reorgAttempt,
-	)
-	if e != nil {
-		return e
+	// The bits of the headers whose difficulty can't be worked out after an anchor are kept.
+	if !b.anchoredDifficultyUnknown(height) {
+		var diff uint32
+		if diff, e = b.calcNextRequiredDifficulty(blockHeader.Timestamp, reorgAttempt); e != nil {
+			return e
+		}
+		blockHeader.Bits = diff
 	}
-	blockHeader.Bits = diff
 	stubBlock := block.NewBlock(
 		&wire.Block{
 			Header: *blockHeader,
@@ -2019,6 +2207,18 @@ func (b *blockManager) checkHeaderSanity(
 	return nil
 }
 
+// anchoredDifficultyUnknown returns whether the difficulty of the header at the height can't be worked out because the
+// chain was started from an anchor inside the retarget window before it. The anchor's difficulty holds up to the first
+// retarget after it, and from there until the next retarget, whose window of headers is the first one wholly stored.
+func (b *blockManager) anchoredDifficultyUnknown(height int32) bool {
+	start := int32(b.server.startHeight)
+	if start == 0 || start%b.blocksPerRetarget == 0 {
+		return false
+	}
+	firstRetarget := (start/b.blocksPerRetarget + 1) * b.blocksPerRetarget
+	return height >= firstRetarget && height < firstRetarget+b.blocksPerRetarget
+}
+
 // calcNextRequiredDifficulty calculates the required difficulty for the
 // block after the passed previous block node based on the difficulty
 // retarget rules.
@@ -2125,6 +2325,7 @@ func (b *blockManager) findPrevTestNetDifficulty(hList headerlist.Chain) (uint32
 	iterNode := &startNode.Header
 	iterHeight := startNode.Height
 	for iterNode != nil && iterHeight%b.blocksPerRetarget != 0 &&
+		uint32(iterHeight) > b.server.startHeight &&
 		iterNode.Bits == b.server.chainParams.PowLimitBits {
 		// Get the previous block node. This function is used over simply accessing iterNode.parent directly as it will
 		// dynamically create previous block nodes as needed. This helps allow only the pieces of the chain that are
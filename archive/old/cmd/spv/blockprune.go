@@ -0,0 +1,72 @@
+package spv
+
+import (
+	"sync"
+	
+	"github.com/p9c/pod/cmd/spv/cache"
+)
+
+// rescanPositions holds the height of the block each running rescan is at, below which it needs no more blocks unless
+// it rewinds.
+type rescanPositions struct {
+	mtx     sync.Mutex
+	heights map[*rescanOptions]int32
+}
+
+// set records the height the rescan is at.
+func (p *rescanPositions) set(ro *rescanOptions, height int32) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.heights == nil {
+		p.heights = make(map[*rescanOptions]int32)
+	}
+	p.heights[ro] = height
+}
+
+// remove forgets the rescan once it is done.
+func (p *rescanPositions) remove(ro *rescanOptions) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.heights, ro)
+}
+
+// lowest returns the lowest height a running rescan is at, and false when no rescan is running.
+func (p *rescanPositions) lowest() (lowest int32, ok bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, height := range p.heights {
+		if !ok || height < lowest {
+			lowest, ok = height, true
+		}
+	}
+	return lowest, ok
+}
+
+// PruneBlockCache removes the blocks below height from the block cache, other than those at or above the block a
+// running rescan is at, and returns how many were removed.
+func (s *ChainService) PruneBlockCache(height int32) int {
+	if lowest, ok := s.rescanPositions.lowest(); ok && lowest < height {
+		height = lowest
+	}
+	return s.BlockCache.RemoveFunc(
+		func(_ interface{}, value cache.Value) bool {
+			b, ok := value.(*cache.CacheableBlock)
+			return ok && b.Height() < height
+		},
+	)
+}
+
+// pruneBlockCache removes the blocks more than Config.BlockCachePruneDepth blocks below the best header from the block
+// cache, when it is set.
+func (s *ChainService) pruneBlockCache() {
+	if s.blockCachePruneDepth == 0 {
+		return
+	}
+	_, tip, e := s.BlockHeaders.ChainTip()
+	if E.Chk(e) || tip <= s.blockCachePruneDepth {
+		return
+	}
+	if pruned := s.PruneBlockCache(int32(tip - s.blockCachePruneDepth)); pruned > 0 {
+		T.F("pruned %d blocks more than %d below the best header from the block cache", pruned, s.blockCachePruneDepth)
+	}
+}
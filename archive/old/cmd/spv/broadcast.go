@@ -0,0 +1,258 @@
+package spv
+
+import (
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/gcs/builder"
+	"github.com/p9c/pod/pkg/txscript"
+	"github.com/p9c/pod/pkg/util/qu"
+	"github.com/p9c/pod/pkg/waddrmgr"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// BroadcastTrackDepth is the number of confirmations after which a transaction is confirmed deeply enough for
+// TrackBroadcast to stop tracking it.
+var BroadcastTrackDepth = uint32(6)
+
+// BroadcastState is how far a tracked transaction has got from being broadcast to being mined.
+type BroadcastState int
+
+const (
+	// BroadcastPending is the state of a transaction that no peer is known to have and that isn't mined.
+	BroadcastPending BroadcastState = iota
+	// BroadcastSeen is the state of a transaction that peers asked for or announced, but that isn't mined.
+	BroadcastSeen
+	// BroadcastConfirmed is the state of a transaction in a block on the main chain.
+	BroadcastConfirmed
+)
+
+// BroadcastStatus is an update on a transaction tracked with TrackBroadcast.
+type BroadcastStatus struct {
+	State BroadcastState
+	// Peers is the number of peers that asked for the transaction after it was sent or announced it.
+	Peers int
+	// Block is the block the transaction was mined in when it is confirmed.
+	Block *waddrmgr.BlockStamp
+	// Confirmations is the number of blocks from the one the transaction was mined in to the tip, counting both.
+	Confirmations uint32
+}
+
+// broadcastTracker holds the peers that have been seen to have a tracked transaction.
+type broadcastTracker struct {
+	txHash chainhash.Hash
+	// tx is the transaction once it is sent with SendTransaction, and peers is the set of addresses of the peers that
+	// have it, both guarded by the ChainService's mtxBroadcasts.
+	tx    *wire.MsgTx
+	peers map[string]struct{}
+	// seen is signalled when a peer is added to peers.
+	seen chan struct{}
+	quit qu.C
+}
+
+// TrackBroadcast sends updates on the given transaction as peers ask for it or announce it, and as it is mined and
+// confirmed, starting with its state when called and then every time it changes. Tracking stops, and the channel is
+// closed, when the transaction has BroadcastTrackDepth confirmations, when the returned function is called, or when
+// the ChainService stops. The channel must be read from until it is closed or tracking is cancelled.
+//
+// A transaction mined in the last BroadcastTrackDepth blocks before tracking starts is found and reported as confirmed
+// in the first update. Once the transaction is sent with SendTransaction while it is tracked, blocks are only fetched
+// to look for it when their filter matches its outputs, and until then every block looked through is fetched.
+//
+// The peers of an spv client don't usually announce transactions to it, so peers are mostly counted as they ask for
+// the transaction after SendTransaction announces it.
+func (s *ChainService) TrackBroadcast(txHash *chainhash.Hash) (<-chan BroadcastStatus, func()) {
+	t := &broadcastTracker{
+		txHash: *txHash,
+		peers:  make(map[string]struct{}),
+		seen:   make(chan struct{}, 1),
+		quit:   qu.T(),
+	}
+	s.mtxBroadcasts.Lock()
+	if s.broadcastTrackers == nil {
+		s.broadcastTrackers = make(map[chainhash.Hash]map[*broadcastTracker]struct{})
+	}
+	if s.broadcastTrackers[t.txHash] == nil {
+		s.broadcastTrackers[t.txHash] = make(map[*broadcastTracker]struct{})
+	}
+	s.broadcastTrackers[t.txHash][t] = struct{}{}
+	s.mtxBroadcasts.Unlock()
+	updates := make(chan BroadcastStatus)
+	go s.broadcastTrackerHandler(t, updates)
+	return updates, t.quit.Q
+}
+
+// noteBroadcastTx gives the trackers of the transaction, if it is being tracked, its outputs to match block filters
+// against.
+func (s *ChainService) noteBroadcastTx(tx *wire.MsgTx) {
+	txHash := tx.TxHash()
+	s.mtxBroadcasts.Lock()
+	defer s.mtxBroadcasts.Unlock()
+	for t := range s.broadcastTrackers[txHash] {
+		t.tx = tx
+	}
+}
+
+// noteBroadcastPeer records that the peer has the transaction, if it is being tracked.
+func (s *ChainService) noteBroadcastPeer(txHash *chainhash.Hash, sp *ServerPeer) {
+	s.mtxBroadcasts.Lock()
+	defer s.mtxBroadcasts.Unlock()
+	for t := range s.broadcastTrackers[*txHash] {
+		if _, ok := t.peers[sp.Addr()]; ok {
+			continue
+		}
+		t.peers[sp.Addr()] = struct{}{}
+		select {
+		case t.seen <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// broadcastTrackerHandler follows the transaction of the tracker through block connections and disconnections and
+// sends its status on updates whenever it changes. It must be run as a goroutine.
+func (s *ChainService) broadcastTrackerHandler(t *broadcastTracker, updates chan<- BroadcastStatus) {
+	defer close(updates)
+	defer func() {
+		s.mtxBroadcasts.Lock()
+		delete(s.broadcastTrackers[t.txHash], t)
+		if len(s.broadcastTrackers[t.txHash]) == 0 {
+			delete(s.broadcastTrackers, t.txHash)
+		}
+		s.mtxBroadcasts.Unlock()
+	}()
+	var tipHeight uint32
+	if e := s.blockManager.SynchronizeFilterHeaders(
+		func(filterHeaderTip uint32) (e error) {
+			tipHeight = filterHeaderTip
+			return nil
+		},
+	); E.Chk(e) {
+		return
+	}
+	status := BroadcastStatus{State: BroadcastPending}
+	// The transaction may have been mined before tracking started, so the blocks it could be in without being confirmed
+	// deeply enough are looked through first.
+	for height := tipHeight; height > 0 && tipHeight-height < BroadcastTrackDepth; height-- {
+		header, e := s.BlockHeaders.FetchHeaderByHeight(height)
+		if e != nil || header == nil {
+			break
+		}
+		if blockHash := header.BlockHash(); s.trackerBlockHasTx(t, blockHash) {
+			status.State = BroadcastConfirmed
+			status.Block = &waddrmgr.BlockStamp{Height: int32(height), Hash: blockHash}
+			status.Confirmations = tipHeight - height + 1
+			break
+		}
+	}
+	connected := make(chan wire.BlockHeader)
+	disconnected := make(chan wire.BlockHeader)
+	subscription, e := s.subscribeBlockMsg(tipHeight, connected, disconnected, t.quit)
+	if E.Chk(e) {
+		return
+	}
+	defer s.unsubscribeBlockMsgs(subscription)
+	send := func() bool {
+		select {
+		case updates <- status:
+			return true
+		case <-t.quit.Wait():
+		case <-s.quit.Wait():
+		}
+		return false
+	}
+	if !send() || status.Confirmations >= BroadcastTrackDepth {
+		return
+	}
+	for {
+		select {
+		case <-t.seen:
+			s.mtxBroadcasts.Lock()
+			status.Peers = len(t.peers)
+			s.mtxBroadcasts.Unlock()
+			if status.State == BroadcastPending {
+				status.State = BroadcastSeen
+			}
+		case header := <-connected:
+			tipHeight++
+			if status.Block == nil {
+				blockHash := header.BlockHash()
+				if !s.trackerBlockHasTx(t, blockHash) {
+					continue
+				}
+				status.State = BroadcastConfirmed
+				status.Block = &waddrmgr.BlockStamp{Height: int32(tipHeight), Hash: blockHash}
+			}
+			status.Confirmations = tipHeight - uint32(status.Block.Height) + 1
+		case header := <-disconnected:
+			tipHeight--
+			if status.Block == nil {
+				continue
+			}
+			if header.BlockHash() == status.Block.Hash {
+				// The block the transaction was mined in is no longer on the main chain.
+				status.Block, status.Confirmations, status.State = nil, 0, BroadcastPending
+				if status.Peers > 0 {
+					status.State = BroadcastSeen
+				}
+			} else {
+				status.Confirmations--
+			}
+		case <-t.quit.Wait():
+			return
+		case <-s.quit.Wait():
+			return
+		}
+		if !send() || status.Confirmations >= BroadcastTrackDepth {
+			return
+		}
+	}
+}
+
+// trackerBlockHasTx returns whether the block contains the transaction of the tracker.
+func (s *ChainService) trackerBlockHasTx(t *broadcastTracker, blockHash chainhash.Hash) bool {
+	s.mtxBroadcasts.Lock()
+	tx := t.tx
+	s.mtxBroadcasts.Unlock()
+	return s.blockHasTx(blockHash, &t.txHash, tx)
+}
+
+// blockHasTx returns whether the block contains the transaction with the hash. When the transaction is given, the
+// block is only fetched, if it isn't cached, when its regular filter matches the output scripts of the transaction or
+// the filter can't be had.
+func (s *ChainService) blockHasTx(blockHash chainhash.Hash, txHash *chainhash.Hash, tx *wire.MsgTx) bool {
+	// The outputs left out of filters, the empty ones and OP_RETURN data pushes, can't be matched against them.
+	var scripts [][]byte
+	if tx != nil {
+		for _, txOut := range tx.TxOut {
+			if len(txOut.PkScript) == 0 ||
+				txOut.PkScript[0] == txscript.OP_RETURN && txscript.IsPushOnlyScript(txOut.PkScript[1:]) {
+				continue
+			}
+			scripts = append(scripts, txOut.PkScript)
+		}
+	}
+	if len(scripts) != 0 {
+		filter, e := s.GetCFilter(blockHash, wire.GCSFilterRegular)
+		if e == nil && filter != nil {
+			if filter.N() == 0 {
+				return false
+			}
+			matched, e := filter.MatchAny(builder.DeriveKey(&blockHash), scripts)
+			if e == nil && !matched {
+				return false
+			}
+		} else {
+			D.F("couldn't get filter of block %v to look for broadcast transaction %v: %v", blockHash, txHash, e)
+		}
+	}
+	b, e := s.GetBlock(blockHash)
+	if e != nil {
+		W.F("couldn't fetch block %v to look for broadcast transaction %v: %v", blockHash, txHash, e)
+		return false
+	}
+	for _, tx := range b.Transactions() {
+		if tx.Hash().IsEqual(txHash) {
+			return true
+		}
+	}
+	return false
+}
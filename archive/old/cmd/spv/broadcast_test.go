@@ -0,0 +1,206 @@
+package spv
+
+import (
+	"testing"
+	"time"
+	
+	"github.com/p9c/pod/cmd/spv/cache"
+	"github.com/p9c/pod/cmd/spv/cache/lru"
+	"github.com/p9c/pod/cmd/spv/filterdb"
+	"github.com/p9c/pod/cmd/spv/headerfs"
+	"github.com/p9c/pod/pkg/block"
+	"github.com/p9c/pod/pkg/chaincfg"
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/gcs"
+	"github.com/p9c/pod/pkg/gcs/builder"
+	"github.com/p9c/pod/pkg/peer"
+	"github.com/p9c/pod/pkg/txscript"
+	"github.com/p9c/pod/pkg/util/qu"
+	"github.com/p9c/pod/pkg/walletdb"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// TestTrackBroadcast follows a transaction as a peer asks for it, it is mined, the block is disconnected and mined
+// again, and ensures tracking stops once it is confirmed deeply enough.
+func TestTrackBroadcast(t *testing.T) {
+	oldDepth := BroadcastTrackDepth
+	defer func() {
+		BroadcastTrackDepth = oldDepth
+	}()
+	BroadcastTrackDepth = 2
+	s := &ChainService{
+		BlockHeaders:     newMockBlockHeaderStore(),
+		BlockCache:       lru.NewCache(1 << 20),
+		blockManager:     &blockManager{filterHeaderTip: 10},
+		blockSubscribers: make(map[*blockSubscription]struct{}),
+		quit:             qu.T(),
+	}
+	tx := &wire.MsgTx{LockTime: 1}
+	txHash := tx.TxHash()
+	// newBlock returns the header of a new block holding the given transactions, which GetBlock finds in the cache.
+	var nonce uint32
+	newBlock := func(txs ...*wire.MsgTx) *wire.BlockHeader {
+		nonce++
+		msgBlock := &wire.Block{Header: wire.BlockHeader{Nonce: nonce}, Transactions: txs}
+		header := &msgBlock.Header
+		s.BlockHeaders.(*mockBlockHeaderStore).headers[header.BlockHash()] = *header
+		blockHash := header.BlockHash()
+		e := s.BlockCache.Put(
+			*wire.NewInvVect(wire.InvTypeBlock, &blockHash), &cache.CacheableBlock{Block: block.NewBlock(msgBlock)},
+		)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return header
+	}
+	updates, cancel := s.TrackBroadcast(&txHash)
+	defer cancel()
+	expect := func(state BroadcastState, peers int, height int32, confirmations uint32) {
+		select {
+		case status, ok := <-updates:
+			if !ok {
+				t.Fatal("tracking stopped early")
+			}
+			if status.State != state || status.Peers != peers || status.Confirmations != confirmations ||
+				(status.Block == nil) != (height == 0) || status.Block != nil && status.Block.Height != height {
+				t.Fatalf(
+					"got status %+v at block %v, want state %v with %d peers at height %d with %d confirmations",
+					status, status.Block, state, peers, height, confirmations,
+				)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for status")
+		}
+	}
+	connect := func(header *wire.BlockHeader) {
+		s.sendSubscribedMsg(&blockMessage{msgType: connectBasic, header: header})
+	}
+	expect(BroadcastPending, 0, 0, 0)
+	p, e := peer.NewOutboundPeer(&peer.Config{ChainParams: &chaincfg.SimNetParams}, "1.2.3.4:11047")
+	if e != nil {
+		t.Fatal(e)
+	}
+	sp := &ServerPeer{Peer: p}
+	s.noteBroadcastPeer(&txHash, sp)
+	expect(BroadcastSeen, 1, 0, 0)
+	// The same peer again and a block without the transaction change nothing, while the block with it confirms it.
+	s.noteBroadcastPeer(&txHash, sp)
+	other := chainhash.Hash{1}
+	s.noteBroadcastPeer(&other, sp)
+	connect(newBlock(&wire.MsgTx{LockTime: 2}))
+	mined := newBlock(tx)
+	connect(mined)
+	expect(BroadcastConfirmed, 1, 12, 1)
+	s.sendSubscribedMsg(&blockMessage{msgType: disconnect, header: mined})
+	expect(BroadcastSeen, 1, 0, 0)
+	connect(mined)
+	expect(BroadcastConfirmed, 1, 12, 1)
+	connect(newBlock())
+	expect(BroadcastConfirmed, 1, 12, 2)
+	select {
+	case _, ok := <-updates:
+		if ok {
+			t.Fatal("status sent after the transaction was confirmed deeply enough")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tracking didn't stop after the transaction was confirmed deeply enough")
+	}
+	s.mtxBroadcasts.Lock()
+	defer s.mtxBroadcasts.Unlock()
+	if len(s.broadcastTrackers) != 0 {
+		t.Fatalf("%d transactions still tracked", len(s.broadcastTrackers))
+	}
+}
+
+// TestTrackBroadcastMined tracks a transaction mined before tracking started and checks that it is found confirmed in
+// the first update, and that once the transaction is sent, blocks whose filters don't match it aren't searched for it.
+func TestTrackBroadcastMined(t *testing.T) {
+	oldDepth := BroadcastTrackDepth
+	defer func() {
+		BroadcastTrackDepth = oldDepth
+	}()
+	BroadcastTrackDepth = 3
+	db, e := walletdb.Create("bdb", t.TempDir()+"/filters.db")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+	filterDB, e := filterdb.New(db, chaincfg.SimNetParams)
+	if e != nil {
+		t.Fatal(e)
+	}
+	s := &ChainService{
+		FilterDB:         filterDB,
+		BlockHeaders:     newMockBlockHeaderStore(),
+		BlockCache:       lru.NewCache(1 << 20),
+		FilterCache:      lru.NewCache(1 << 20),
+		filterHeaders:    map[wire.FilterType]*headerfs.FilterHeaderStore{wire.GCSFilterRegular: nil},
+		blockManager:     &blockManager{filterHeaderTip: 10},
+		blockSubscribers: make(map[*blockSubscription]struct{}),
+		quit:             qu.T(),
+	}
+	tx := &wire.MsgTx{TxOut: []*wire.TxOut{{PkScript: []byte{txscript.OP_TRUE}}}}
+	// addBlock stores a block at the height holding the transaction, with a filter that matches the given scripts.
+	addBlock := func(height uint32, scripts ...[]byte) {
+		msgBlock := &wire.Block{Header: wire.BlockHeader{Nonce: height}, Transactions: []*wire.MsgTx{tx}}
+		blockHash := msgBlock.BlockHash()
+		e := s.BlockHeaders.WriteHeaders(headerfs.BlockHeader{BlockHeader: &msgBlock.Header, Height: height})
+		if e != nil {
+			t.Fatal(e)
+		}
+		e = s.BlockCache.Put(
+			*wire.NewInvVect(wire.InvTypeBlock, &blockHash), &cache.CacheableBlock{Block: block.NewBlock(msgBlock)},
+		)
+		if e != nil {
+			t.Fatal(e)
+		}
+		filter, e := gcs.BuildGCSFilter(builder.DefaultP, builder.DefaultM, builder.DeriveKey(&blockHash), scripts)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if e = s.FilterDB.PutFilter(&blockHash, filter, filterdb.RegularFilter); e != nil {
+			t.Fatal(e)
+		}
+	}
+	// Only the filter of the block at height 9 matches, so the transaction is only found in the block at the tip while
+	// its outputs aren't known.
+	addBlock(10, []byte{txscript.OP_FALSE})
+	addBlock(9, []byte{txscript.OP_TRUE})
+	txHash := tx.TxHash()
+	updates, cancel := s.TrackBroadcast(&txHash)
+	defer cancel()
+	select {
+	case status := <-updates:
+		if status.State != BroadcastConfirmed || status.Block == nil || status.Block.Height != 10 ||
+			status.Confirmations != 1 {
+			t.Fatalf("got status %+v at block %v, want confirmed at height 10 with 1 confirmation", status, status.Block)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for status")
+	}
+	s.mtxBroadcasts.Lock()
+	if len(s.broadcastTrackers[txHash]) != 1 {
+		t.Fatalf("%d trackers of the transaction, want 1", len(s.broadcastTrackers[txHash]))
+	}
+	for tracker := range s.broadcastTrackers[txHash] {
+		if tracker.tx != nil {
+			t.Fatal("tracker has the transaction before it was sent")
+		}
+	}
+	s.mtxBroadcasts.Unlock()
+	s.noteBroadcastTx(tx)
+	s.mtxBroadcasts.Lock()
+	for tracker := range s.broadcastTrackers[txHash] {
+		if tracker.tx != tx {
+			t.Fatal("tracker didn't get the transaction when it was sent")
+		}
+	}
+	s.mtxBroadcasts.Unlock()
+	tip, e := s.BlockHeaders.FetchHeaderByHeight(10)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if s.blockHasTx(tip.BlockHash(), &txHash, tx) {
+		t.Fatal("block whose filter doesn't match the transaction was searched for it")
+	}
+}
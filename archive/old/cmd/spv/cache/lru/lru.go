@@ -149,6 +149,38 @@ func (c *Cache) Get(key interface{}) (cache.Value, error) {
 	return el.Value.(*entry).value, nil
 }
 
+// RemoveFunc removes every element for which remove returns true, and returns
+// how many were removed. The cache is locked while remove is called, so it
+// must not call the cache.
+func (c *Cache) RemoveFunc(remove func(key interface{}, value cache.Value) bool) (removed int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		ce := el.Value.(*entry)
+		if remove(ce.key, ce.value) {
+			// The size was determined when the element was inserted, so it
+			// can't fail here.
+			es, _ := ce.value.Size()
+			c.size -= es
+			c.ll.Remove(el)
+			delete(c.cache, ce.key)
+			removed++
+		}
+		el = next
+	}
+	return removed
+}
+
+// Purge removes every element from the cache.
+func (c *Cache) Purge() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.ll.Init()
+	c.cache = make(elementMap)
+	c.size = 0
+}
+
 // Len returns number of elements in the cache.
 func (c *Cache) Len() int {
 	c.mtx.RLock()
@@ -303,6 +303,35 @@ func TestReplacingElementValueBiggerSize(t *testing.T) {
 	assertEqual(t, one, 3, "")
 }
 
+// TestRemoveFunc checks that only the elements chosen are removed, and that
+// their space is freed for new elements.
+func TestRemoveFunc(t *testing.T) {
+	t.Parallel()
+	c := NewCache(5)
+	for i := 0; i < 5; i++ {
+		if e := c.Put(i, &sizeable{value: i, size: 1}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	removed := c.RemoveFunc(func(key interface{}, _ cache.Value) bool {
+		return key.(int)%2 == 0
+	})
+	assertEqual(t, removed, 3, "")
+	assertEqual(t, c.Len(), 2, "")
+	for i := 0; i < 5; i++ {
+		_, e := c.Get(i)
+		assertEqual(t, e == cache.ErrElementNotFound, i%2 == 0, fmt.Sprintf("element %d kept wrongly", i))
+	}
+	// The space of the removed elements is free, so nothing more is evicted.
+	for i := 5; i < 8; i++ {
+		if e := c.Put(i, &sizeable{value: i, size: 1}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	assertEqual(t, c.Len(), 5, "")
+	assertEqual(t, getSizeableValue(c.Get(1)), 1, "")
+}
+
 // TestConcurrencySimple is a very simple test that checks concurrent access to
 // the lru cache. When running the test, "-race" option should be passed to
 // "go test" command.
@@ -0,0 +1,63 @@
+package spv
+
+import (
+	"math/big"
+	"sync"
+	
+	"github.com/p9c/pod/cmd/spv/headerfs"
+	"github.com/p9c/pod/pkg/blockchain"
+)
+
+// headerWork is the proof of work of the valid block headers a peer has delivered. The work of a header is only counted
+// when it is higher than every header counted before it, so that a peer can't raise its work by sending the same
+// headers again.
+type headerWork struct {
+	mtx    sync.Mutex
+	work   big.Int
+	height uint32
+}
+
+// add counts the work of the headers above the highest header counted so far.
+func (w *headerWork) add(headers ...headerfs.BlockHeader) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for _, header := range headers {
+		if header.Height <= w.height {
+			continue
+		}
+		w.work.Add(&w.work, blockchain.CalcWork(header.Bits, int32(header.Height), header.Version))
+		w.height = header.Height
+	}
+}
+
+// get returns a copy of the counted work.
+func (w *headerWork) get() *big.Int {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return new(big.Int).Set(&w.work)
+}
+
+// HeaderWork returns the cumulative proof of work of the block headers the peer has delivered that were validated and
+// extended the header chain. Unlike the height a peer advertises, it can't be inflated without doing the work, and the
+// sync peer is chosen by it.
+func (sp *ServerPeer) HeaderWork() *big.Int {
+	return sp.headerWork.get()
+}
+
+// betterSyncPeer returns whether the sync candidate sp is preferred to best: it has delivered more header work, or as
+// much work and a higher advertised height, or the same height and a lower ping.
+func betterSyncPeer(sp, best *ServerPeer) bool {
+	if best == nil {
+		return true
+	}
+	switch sp.HeaderWork().Cmp(best.HeaderWork()) {
+	case 1:
+		return true
+	case -1:
+		return false
+	}
+	if sp.LastBlock() != best.LastBlock() {
+		return sp.LastBlock() > best.LastBlock()
+	}
+	return sp.LastPingMicros() < best.LastPingMicros()
+}
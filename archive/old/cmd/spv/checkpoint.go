@@ -0,0 +1,149 @@
+package spv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+	
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/waddrmgr"
+	"github.com/p9c/pod/pkg/walletdb"
+)
+
+var (
+	// headerCheckpointBucket is the top level bucket the checkpoint of the verified tip is stored in.
+	headerCheckpointBucket = []byte("header-checkpoint")
+	// verifiedTipKey is the key of the height and hash of the verified tip in the headerCheckpointBucket.
+	verifiedTipKey = []byte("verified-tip")
+)
+
+// Checkpoint flushes the block header store and every filter header store to disk, then records the verified tip, the
+// highest block that the headers of every synced filter type have been written for. It can be called at any time, and
+// is called by Stop and every HeaderCheckpointInterval while the ChainService runs. When the service is created the
+// header stores are rolled back to the verified tip if they went past it without being checkpointed, as they do when
+// the service didn't stop cleanly.
+func (s *ChainService) Checkpoint() (e error) {
+	if e = s.BlockHeaders.Sync(); E.Chk(e) {
+		return e
+	}
+	for _, fType := range s.syncFilterTypes {
+		if e = s.filterHeaders[fType].Sync(); E.Chk(e) {
+			return e
+		}
+	}
+	tip, e := s.verifiedTip()
+	if E.Chk(e) {
+		return e
+	}
+	var v [4 + chainhash.HashSize]byte
+	binary.BigEndian.PutUint32(v[:4], uint32(tip.Height))
+	copy(v[4:], tip.Hash[:])
+	e = walletdb.Update(
+		s.db, func(tx walletdb.ReadWriteTx) (e error) {
+			bucket := tx.ReadWriteBucket(headerCheckpointBucket)
+			if bucket == nil {
+				if bucket, e = tx.CreateTopLevelBucket(headerCheckpointBucket); e != nil {
+					return e
+				}
+			}
+			return bucket.Put(verifiedTipKey, v[:])
+		},
+	)
+	if E.Chk(e) {
+		return e
+	}
+	D.F("checkpointed header stores at height %d (%s)", tip.Height, tip.Hash)
+	return nil
+}
+
+// verifiedTip returns the highest block that the headers of every synced filter type have been written for.
+func (s *ChainService) verifiedTip() (tip *waddrmgr.BlockStamp, e error) {
+	_, tipHeight, e := s.BlockHeaders.ChainTip()
+	if e != nil {
+		return nil, e
+	}
+	for _, fType := range s.syncFilterTypes {
+		var filterHeight uint32
+		if _, filterHeight, e = s.filterHeaders[fType].ChainTip(); e != nil {
+			return nil, e
+		}
+		if filterHeight < tipHeight {
+			tipHeight = filterHeight
+		}
+	}
+	header, e := s.BlockHeaders.FetchHeaderByHeight(tipHeight)
+	if e != nil {
+		return nil, e
+	}
+	return &waddrmgr.BlockStamp{Height: int32(tipHeight), Hash: header.BlockHash()}, nil
+}
+
+// resumeFromCheckpoint compares the header stores with the verified tip recorded by the last Checkpoint when the
+// service is created. Stop checkpoints the stores, so if they went past the verified tip the service didn't stop
+// cleanly, and the headers written since the checkpoint may not have reached the disk intact. The stores are rolled
+// back to the verified tip, and the headers after it synced again. A checkpoint of a block the stores no longer hold,
+// as after a reset or a reorganization below it, is left to be replaced by the next one.
+func (s *ChainService) resumeFromCheckpoint() (e error) {
+	checkpoint, e := s.LastCheckpoint()
+	if e != nil || checkpoint == nil {
+		return e
+	}
+	tip, e := s.verifiedTip()
+	if e != nil {
+		return e
+	}
+	if *tip == *checkpoint {
+		return nil
+	}
+	header, e := s.BlockHeaders.FetchHeaderByHeight(uint32(checkpoint.Height))
+	if e != nil || header.BlockHash() != checkpoint.Hash || tip.Height < checkpoint.Height {
+		D.F("checkpoint at height %d (%s) is not in the header chain any more", checkpoint.Height, checkpoint.Hash)
+		return nil
+	}
+	W.F(
+		"header stores went past the checkpoint at height %d without being checkpointed again, rolling them back to it",
+		checkpoint.Height,
+	)
+	_, e = s.rollBackToHeight(uint32(checkpoint.Height))
+	return e
+}
+
+// LastCheckpoint returns the verified tip recorded by the last Checkpoint, or nil if there hasn't been one.
+func (s *ChainService) LastCheckpoint() (tip *waddrmgr.BlockStamp, e error) {
+	e = walletdb.View(
+		s.db, func(tx walletdb.ReadTx) (e error) {
+			bucket := tx.ReadBucket(headerCheckpointBucket)
+			if bucket == nil {
+				return nil
+			}
+			v := bucket.Get(verifiedTipKey)
+			if v == nil {
+				return nil
+			}
+			if len(v) != 4+chainhash.HashSize {
+				return fmt.Errorf("verified tip checkpoint of %d bytes is malformed", len(v))
+			}
+			tip = &waddrmgr.BlockStamp{Height: int32(binary.BigEndian.Uint32(v[:4]))}
+			copy(tip.Hash[:], v[4:])
+			return nil
+		},
+	)
+	return
+}
+
+// checkpointHandler checkpoints the header stores every HeaderCheckpointInterval until the ChainService quits. It must
+// be run as a goroutine.
+func (s *ChainService) checkpointHandler() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(HeaderCheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if e := s.Checkpoint(); E.Chk(e) {
+			}
+		case <-s.quit.Wait():
+			return
+		}
+	}
+}
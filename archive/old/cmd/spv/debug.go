@@ -0,0 +1,109 @@
+package spv
+
+import (
+	"runtime"
+	"sync/atomic"
+
+	"github.com/p9c/pod/pkg/util/qu"
+)
+
+// MaxDebugStackSize is the maximum number of bytes of goroutine stack traces that Debug will collect when full stacks
+// are requested.
+var MaxDebugStackSize = 1 << 20
+
+type (
+	// DebugInfo is a snapshot of the state of a ChainService that is intended to help diagnose a stalled client.
+	DebugInfo struct {
+		// Goroutines is the number of goroutines currently running in the process.
+		Goroutines int
+		// Peers is the number of currently connected peers.
+		Peers int32
+		// SyncPeer is the address of the current sync peer, or empty if there is none.
+		SyncPeer string
+		// BlockHeight is the height of the block header chain tip.
+		BlockHeight uint32
+		// FilterHeight is the height of the regular filter header chain tip.
+		FilterHeight uint32
+		// HeadersSynced is true if the block manager believes its block headers are synced with its peers.
+		HeadersSynced bool
+		// Current is true if both block headers and filter headers are believed to be current.
+		Current bool
+		// BlockCacheLen is the number of blocks held in the block cache.
+		BlockCacheLen int
+		// FilterCacheLen is the number of filters held in the filter cache.
+		FilterCacheLen int
+		// PendingQueries is the number of network queries that have not yet completed.
+		PendingQueries int32
+		// HeaderCacheHitRate is the fraction of the header messages received that held only recently validated
+		// headers, which were ignored.
+		HeaderCacheHitRate float64
+		// Stacks holds the stack traces of all goroutines, truncated to MaxDebugStackSize. It is only populated when
+		// the FullStacks option is passed to Debug.
+		Stacks string
+	}
+	// debugOptions are the options that can be passed to Debug.
+	debugOptions struct {
+		fullStacks bool
+		cancel     qu.C
+	}
+	// DebugOption is a functional option argument to Debug.
+	DebugOption func(*debugOptions)
+)
+
+// FullStacks is a debug option that requests the stack traces of all goroutines be included in the DebugInfo. This
+// stops the world while the stacks are collected so it should not be used routinely.
+func FullStacks() DebugOption {
+	return func(do *debugOptions) {
+		do.fullStacks = true
+	}
+}
+
+// DebugCancel is a debug option that allows the caller to abandon waiting on the peer handler for the peer count. If
+// the channel is closed before the peer handler answers, Peers is reported as zero.
+func DebugCancel(cancel qu.C) DebugOption {
+	return func(do *debugOptions) {
+		do.cancel = cancel
+	}
+}
+
+// Debug returns a snapshot of the ChainService's internal state which can be used by operators to diagnose a stuck
+// client. Full goroutine stack dumps are only collected if the FullStacks option is passed.
+func (s *ChainService) Debug(options ...DebugOption) DebugInfo {
+	do := &debugOptions{}
+	for _, option := range options {
+		option(do)
+	}
+	info := DebugInfo{
+		Goroutines:     runtime.NumGoroutine(),
+		BlockCacheLen:  s.BlockCache.Len(),
+		FilterCacheLen: s.FilterCache.Len(),
+		PendingQueries: atomic.LoadInt32(&s.pendingQueries),
+	}
+	if _, height, e := s.BlockHeaders.ChainTip(); !E.Chk(e) {
+		info.BlockHeight = height
+	}
+	if _, height, e := s.RegFilterHeaders.ChainTip(); !E.Chk(e) {
+		info.FilterHeight = height
+	}
+	info.HeaderCacheHitRate, _ = s.HeaderCacheHitRate()
+	if sp := s.blockManager.SyncPeer(); sp != nil {
+		info.SyncPeer = sp.Addr()
+	}
+	info.HeadersSynced = s.blockManager.BlockHeadersSynced()
+	info.Current = info.HeadersSynced && info.BlockHeight == info.FilterHeight
+	replyChan := make(chan int32, 1)
+	select {
+	case s.query <- getConnCountMsg{reply: replyChan}:
+		select {
+		case info.Peers = <-replyChan:
+		case <-do.cancel.Wait():
+		}
+	case <-do.cancel.Wait():
+	case <-s.quit.Wait():
+	}
+	if do.fullStacks {
+		buf := make([]byte, MaxDebugStackSize)
+		info.Stacks = string(buf[:runtime.Stack(buf, true)])
+	}
+	return info
+}
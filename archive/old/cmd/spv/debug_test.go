@@ -0,0 +1,64 @@
+package spv
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	
+	"github.com/p9c/pod/pkg/blockchain"
+	"github.com/p9c/pod/pkg/chaincfg"
+	"github.com/p9c/pod/pkg/util/qu"
+	"github.com/p9c/pod/pkg/wire"
+	
+	"github.com/p9c/pod/cmd/spv/cache/lru"
+	"github.com/p9c/pod/cmd/spv/headerfs"
+)
+
+// TestDebug checks the snapshot Debug takes of a service whose block headers are a block ahead of its filter headers,
+// that stacks are only collected with FullStacks, and that DebugCancel stops it waiting for the peer count.
+func TestDebug(t *testing.T) {
+	// Without checkpoints a recent tip is enough for the headers to be synced.
+	params := chaincfg.MainNetParams
+	params.Checkpoints = nil
+	s := newTestChainService(t, params)
+	s.BlockCache, s.FilterCache = lru.NewCache(1000), lru.NewCache(1000)
+	s.timeSource = blockchain.NewMedianTime()
+	s.query = make(chan interface{})
+	tip := wire.BlockHeader{PrevBlock: *params.GenesisHash, Timestamp: time.Unix(time.Now().Unix(), 0)}
+	e := s.BlockHeaders.WriteHeaders(headerfs.BlockHeader{BlockHeader: &tip, Height: 1})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if s.blockManager, e = newBlockManager(s); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.BlockCache.Put("block", validatedHeader(1)); e != nil {
+		t.Fatal(e)
+	}
+	atomic.StoreInt32(&s.pendingQueries, 2)
+	// Stand in for the peer handler, answering the peer count.
+	go func() {
+		msg := <-s.query
+		msg.(getConnCountMsg).reply <- 3
+	}()
+	info := s.Debug()
+	if info.Peers != 3 || info.BlockHeight != 1 || info.FilterHeight != 0 || !info.HeadersSynced || info.Current ||
+		info.BlockCacheLen != 1 || info.FilterCacheLen != 0 || info.PendingQueries != 2 || info.SyncPeer != "" ||
+		info.Goroutines == 0 {
+		t.Fatalf("unexpected debug info %+v", info)
+	}
+	if info.Stacks != "" {
+		t.Fatal("stacks collected without FullStacks")
+	}
+	// Nothing answers the peer count now.
+	cancel := qu.T()
+	cancel.Q()
+	info = s.Debug(FullStacks(), DebugCancel(cancel))
+	if info.Peers != 0 {
+		t.Fatalf("%d peers reported without an answer from the peer handler", info.Peers)
+	}
+	if !strings.Contains(info.Stacks, "TestDebug") {
+		t.Fatal("stacks collected with FullStacks don't include the test's goroutine")
+	}
+}
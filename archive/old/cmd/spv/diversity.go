@@ -0,0 +1,67 @@
+package spv
+
+import (
+	"fmt"
+	
+	"github.com/p9c/pod/pkg/addrmgr"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// groupKey returns the key of the group the outbound peers at the address are counted in: its autonomous system when
+// Config.AddressASN is set and knows the address, and otherwise its addrmgr.GroupKey.
+func (s *ChainService) groupKey(na *wire.NetAddress) string {
+	if s.addressASN != nil {
+		if asn, ok := s.addressASN(na.IP); ok {
+			return fmt.Sprintf("AS%d", asn)
+		}
+	}
+	return addrmgr.GroupKey(na)
+}
+
+// checkPeerDiversity counts the network groups the connected peers are from. When there are fewer than
+// Config.MinPeerDiversity, which could mean the client is being eclipsed, OnLowPeerDiversity is called, once each time
+// the count drops that low. If DiversifyPeers is set, a peer from the group with the most peers is also disconnected so
+// that the connection manager replaces it with a peer from a group that isn't in use. It is invoked from the
+// peerHandler goroutine.
+func (s *ChainService) checkPeerDiversity(state *peerState) {
+	if s.minPeerDiversity == 0 || state.Count() == 0 {
+		return
+	}
+	var groups int
+	var commonest string
+	for key, count := range state.outboundGroups {
+		if count <= 0 {
+			continue
+		}
+		groups++
+		if commonest == "" || count > state.outboundGroups[commonest] {
+			commonest = key
+		}
+	}
+	if groups >= s.minPeerDiversity {
+		s.lowPeerDiversity = false
+		return
+	}
+	if !s.lowPeerDiversity {
+		s.lowPeerDiversity = true
+		W.F(
+			"%d connected peers are from only %d network groups, fewer than %d",
+			state.Count(), groups, s.minPeerDiversity,
+		)
+		if s.onLowPeerDiversity != nil {
+			go s.onLowPeerDiversity(groups, state.Count())
+		}
+	}
+	// If every group has a single peer, more peers are needed rather than different ones.
+	if !s.diversifyPeers || state.outboundGroups[commonest] < 2 {
+		return
+	}
+	// Only the peers found by the connection manager are replaced, as persistent peers were asked for.
+	for _, sp := range state.outboundPeers {
+		if s.groupKey(sp.NA()) == commonest {
+			D.Ln("disconnecting", sp, "to make room for a peer from another network group")
+			sp.Disconnect()
+			return
+		}
+	}
+}
@@ -5,6 +5,14 @@ import "errors"
 var (
 	// ErrGetUtxoCancelled signals that a GetUtxo request was cancelled.
 	ErrGetUtxoCancelled = errors.New("get utxo request cancelled")
+	// ErrNoValidAddress signals that the address manager has no usable address to make an outbound connection to.
+	ErrNoValidAddress = errors.New("no valid connect address")
+	// ErrRescanRunning signals that the chain state can't be reset while a rescan is running.
+	ErrRescanRunning = errors.New("rescan running")
+	// ErrResetRunning signals that a rescan can't start, or another reset run, while the chain state is being reset.
+	ErrResetRunning = errors.New("chain state reset running")
 	// ErrShuttingDown signals that neutrino received a shutdown request.
 	ErrShuttingDown = errors.New("neutrino shutting down")
+	// ErrTxNotInBlock signals that a transaction a merkle proof was asked for isn't in the block.
+	ErrTxNotInBlock = errors.New("transaction not in block")
 )
@@ -0,0 +1,109 @@
+package spv
+
+import (
+	"container/list"
+	
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// filterAgreementMsg carries the peers that agreed on the filter header at the height to the block handler, or nil if
+// they didn't.
+type filterAgreementMsg struct {
+	height uint32
+	agreed map[string]struct{}
+}
+
+// filterHeaderMajority returns the filter header that more than half of the peers answered with and the peers that
+// answered with another. If no header has a majority, ok is false.
+func filterHeaderMajority(headers map[string]chainhash.Hash) (majority chainhash.Hash, outliers []string, ok bool) {
+	counts := make(map[chainhash.Hash]int)
+	for _, header := range headers {
+		counts[header]++
+		if counts[header]*2 > len(headers) {
+			majority, ok = header, true
+		}
+	}
+	if !ok {
+		return majority, nil, false
+	}
+	for addr, header := range headers {
+		if header != majority {
+			outliers = append(outliers, addr)
+		}
+	}
+	return majority, outliers, true
+}
+
+// checkFilterHeaderAgreement asks every peer for the regular filter header of the block at the given height, the tip
+// of the block headers, and returns the peers that answered with the header most of them agree on. Peers that answered
+// with another header are disconnected. Nil is returned if fewer than Config.FilterHeaderAgreementPeers answered or
+// no header has a majority, in which case no sync peer should be chosen yet.
+func (b *blockManager) checkFilterHeaderAgreement(height uint32) map[string]struct{} {
+	responses := b.getCFHeadersForAllPeers(height, wire.GCSFilterRegular)
+	headers := make(map[string]chainhash.Hash, len(responses))
+	for addr, msg := range responses {
+		if len(msg.FilterHashes) != 1 {
+			continue
+		}
+		// header = dsha256(filterHash || prevHeader)
+		headers[addr] = chainhash.DoubleHashH(append(msg.FilterHashes[0][:], msg.PrevFilterHeader[:]...))
+	}
+	if len(headers) < b.server.filterHeaderAgreementPeers {
+		W.F(
+			"%d of %d peers needed answered for the filter header at height %d, not choosing a sync peer yet",
+			len(headers), b.server.filterHeaderAgreementPeers, height,
+		)
+		return nil
+	}
+	majority, outliers, ok := filterHeaderMajority(headers)
+	if !ok {
+		W.F("no majority of %d peers agrees on the filter header at height %d", len(headers), height)
+		return nil
+	}
+	if len(outliers) > 0 {
+		disconnect := make(map[string]struct{}, len(outliers))
+		for _, addr := range outliers {
+			disconnect[addr] = struct{}{}
+		}
+		for _, sp := range b.server.Peers() {
+			if _, ok := disconnect[sp.Addr()]; ok {
+				W.F("disconnecting peer %s, its filter header at height %d disagrees with %v", sp, height, majority)
+				sp.Disconnect()
+			}
+		}
+	}
+	agreed := make(map[string]struct{}, len(headers)-len(outliers))
+	for addr, header := range headers {
+		if header == majority {
+			agreed[addr] = struct{}{}
+		}
+	}
+	return agreed
+}
+
+// startFilterHeaderAgreement checks the filter header agreement of the peers at the height in another goroutine, unless
+// a check is running already, and sends the result to the block handler.
+func (b *blockManager) startFilterHeaderAgreement(height uint32) {
+	if b.checkingFilterAgreement {
+		return
+	}
+	b.checkingFilterAgreement = true
+	go func() {
+		agreed := b.checkFilterHeaderAgreement(height)
+		select {
+		case b.peerChan <- &filterAgreementMsg{height: height, agreed: agreed}:
+		case <-b.quit.Wait():
+		}
+	}()
+}
+
+// handleFilterAgreementMsg starts the sync from the peers that agreed on the filter header, if enough did.
+func (b *blockManager) handleFilterAgreementMsg(peers *list.List, msg *filterAgreementMsg) {
+	b.checkingFilterAgreement = false
+	if msg.agreed == nil {
+		return
+	}
+	b.filterAgreement, b.filterAgreementHeight = msg.agreed, msg.height
+	b.startSync(peers)
+}
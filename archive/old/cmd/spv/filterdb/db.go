@@ -16,6 +16,8 @@ var (
 	filterBucket = []byte("filter-store")
 	// regBucket is the bucket that stores the regular filters.
 	regBucket = []byte("regular")
+	// extBucket is the bucket that stores the extended filters.
+	extBucket = []byte("extended")
 )
 
 // FilterType is a enum-like type that represents the various filter types currently defined.
@@ -24,6 +26,9 @@ type FilterType uint8
 const (
 	// RegularFilter is the filter type of regular filters which contain outputs and pkScript data pushes.
 	RegularFilter FilterType = iota
+	// ExtendedFilter is the filter type of extended filters which contain transaction hashes and input signature
+	// scripts.
+	ExtendedFilter
 )
 
 var (
@@ -40,6 +45,19 @@ type FilterDatabase interface {
 	// FetchFilter attempts to fetch a filter with the given hash and type from persistent storage. In the case that a
 	// filter matching the target block hash cannot be found, then ErrFilterNotFound is to be returned.
 	FetchFilter(*chainhash.Hash, FilterType) (*gcs.Filter, error)
+	// PutFilters stores a batch of filters to persistent storage in a single transaction.
+	PutFilters([]*FilterData) error
+	// FetchFilters attempts to fetch the filters of the given type for a set of block hashes, in order, from persistent
+	// storage in a single transaction. If a filter can't be found, the filters before it are returned along with
+	// ErrFilterNotFound.
+	FetchFilters([]*chainhash.Hash, FilterType) ([]*gcs.Filter, error)
+}
+
+// FilterData holds a filter along with the hash of the block it is for and its type, for storing filters in batches.
+type FilterData struct {
+	Filter    *gcs.Filter
+	BlockHash *chainhash.Hash
+	Type      FilterType
 }
 
 // FilterStore is an implementation of the FilterDatabase interface which is backed by boltdb.
@@ -55,31 +73,46 @@ var _ FilterDatabase = (*FilterStore)(nil)
 func New(db walletdb.DB, params chaincfg.Params) (*FilterStore, error) {
 	e := walletdb.Update(
 		db, func(tx walletdb.ReadWriteTx) (e error) {
-			// As part of our initial setup, we'll try to create the top level filter bucket. If this already exists, then
-			// we can exit early.
-			filters, e := tx.CreateTopLevelBucket(filterBucket)
-			if e != nil {
-				return e
+			// As part of our initial setup, we'll try to create the top level filter bucket if it doesn't already exist.
+			filters := tx.ReadWriteBucket(filterBucket)
+			if filters == nil {
+				if filters, e = tx.CreateTopLevelBucket(filterBucket); e != nil {
+					return e
+				}
 			}
-			// If the main bucket doesn't already exist, then we'll need to create the sub-buckets, and also initialize them
-			// with the genesis filters.
+			// Any sub-bucket that doesn't already exist needs to be created and initialized with the genesis filter of
+			// its type. This also upgrades databases created before a filter type was supported.
 			genesisBlock := params.GenesisBlock
 			genesisHash := params.GenesisHash
-			// First we'll create the bucket for the regular filters.
-			regFilters, e := filters.CreateBucketIfNotExists(regBucket)
-			if e != nil {
-				return e
+			for bucketName, buildGenesis := range map[string]func() (*gcs.Filter, error){
+				string(regBucket): func() (*gcs.Filter, error) {
+					return builder.BuildBasicFilter(genesisBlock, nil)
+				},
+				string(extBucket): func() (*gcs.Filter, error) {
+					return builder.BuildExtFilter(genesisBlock)
+				},
+			} {
+				if filters.NestedReadWriteBucket([]byte(bucketName)) != nil {
+					continue
+				}
+				subBucket, e := filters.CreateBucket([]byte(bucketName))
+				if e != nil {
+					return e
+				}
+				// With the bucket created, we'll now construct the initial genesis filter and store it within the
+				// database.
+				genesisFilter, e := buildGenesis()
+				if e != nil {
+					return e
+				}
+				if e = putFilter(subBucket, genesisHash, genesisFilter); e != nil {
+					return e
+				}
 			}
-			// With the bucket created, we'll now construct the initial basic genesis filter and store it within the
-			// database.
-			basicFilter, e := builder.BuildBasicFilter(genesisBlock, nil)
-			if e != nil {
-				return e
-			}
-			return putFilter(regFilters, genesisHash, basicFilter)
+			return nil
 		},
 	)
-	if e != nil && e != walletdb.ErrBucketExists {
+	if e != nil {
 		return nil, e
 	}
 	return &FilterStore{
@@ -113,26 +146,74 @@ func (f *FilterStore) PutFilter(
 ) (e error) {
 	return walletdb.Update(
 		f.db, func(tx walletdb.ReadWriteTx) (e error) {
-			filters := tx.ReadWriteBucket(filterBucket)
-			var targetBucket walletdb.ReadWriteBucket
-			switch fType {
-			case RegularFilter:
-				targetBucket = filters.NestedReadWriteBucket(regBucket)
-			default:
-				return fmt.Errorf("unknown filter type: %v", fType)
-			}
-			if filter == nil {
-				return targetBucket.Put(hash[:], nil)
-			}
-			bytes, e := filter.NBytes()
+			targetBucket, e := writeBucket(tx, fType)
 			if e != nil {
 				return e
 			}
-			return targetBucket.Put(hash[:], bytes)
+			return putFilter(targetBucket, hash, filter)
+		},
+	)
+}
+
+// PutFilters stores a batch of filters to persistent storage in a single transaction.
+//
+// NOTE: This method is a part of the FilterDatabase interface.
+func (f *FilterStore) PutFilters(filters []*FilterData) (e error) {
+	return walletdb.Update(
+		f.db, func(tx walletdb.ReadWriteTx) (e error) {
+			for _, fd := range filters {
+				targetBucket, e := writeBucket(tx, fd.Type)
+				if e != nil {
+					return e
+				}
+				if e = putFilter(targetBucket, fd.BlockHash, fd.Filter); e != nil {
+					return e
+				}
+			}
+			return nil
 		},
 	)
 }
 
+// writeBucket returns the bucket the filters of the given type are stored in.
+func writeBucket(tx walletdb.ReadWriteTx, fType FilterType) (walletdb.ReadWriteBucket, error) {
+	filters := tx.ReadWriteBucket(filterBucket)
+	switch fType {
+	case RegularFilter:
+		return filters.NestedReadWriteBucket(regBucket), nil
+	case ExtendedFilter:
+		return filters.NestedReadWriteBucket(extBucket), nil
+	default:
+		return nil, fmt.Errorf("unknown filter type: %v", fType)
+	}
+}
+
+// readBucket returns the bucket the filters of the given type are read from.
+func readBucket(tx walletdb.ReadTx, fType FilterType) (walletdb.ReadBucket, error) {
+	filters := tx.ReadBucket(filterBucket)
+	switch fType {
+	case RegularFilter:
+		return filters.NestedReadBucket(regBucket), nil
+	case ExtendedFilter:
+		return filters.NestedReadBucket(extBucket), nil
+	default:
+		return nil, fmt.Errorf("unknown filter type")
+	}
+}
+
+// fetchFilter reads the filter for the given block hash from the bucket of its type. A filter stored as nil is
+// returned as nil without error.
+func fetchFilter(bucket walletdb.ReadBucket, blockHash *chainhash.Hash) (*gcs.Filter, error) {
+	filterBytes := bucket.Get(blockHash[:])
+	if filterBytes == nil {
+		return nil, ErrFilterNotFound
+	}
+	if len(filterBytes) == 0 {
+		return nil, nil
+	}
+	return gcs.FromNBytes(builder.DefaultP, builder.DefaultM, filterBytes)
+}
+
 // FetchFilter attempts to fetch a filter with the given hash and type from persistent storage.
 //
 // NOTE: This method is a part of the FilterDatabase interface.
@@ -143,33 +224,51 @@ func (f *FilterStore) FetchFilter(
 	var filter *gcs.Filter
 	e := walletdb.View(
 		f.db, func(tx walletdb.ReadTx) (e error) {
-			filters := tx.ReadBucket(filterBucket)
-			var targetBucket walletdb.ReadBucket
-			switch filterType {
-			case RegularFilter:
-				targetBucket = filters.NestedReadBucket(regBucket)
-			default:
-				return fmt.Errorf("unknown filter type")
-			}
-			filterBytes := targetBucket.Get(blockHash[:])
-			if filterBytes == nil {
-				return ErrFilterNotFound
-			}
-			if len(filterBytes) == 0 {
-				return nil
+			targetBucket, e := readBucket(tx, filterType)
+			if e != nil {
+				return e
 			}
-			dbFilter, e := gcs.FromNBytes(
-				builder.DefaultP, builder.DefaultM, filterBytes,
-			)
+			filter, e = fetchFilter(targetBucket, blockHash)
+			return e
+		},
+	)
+	if e != nil {
+		return nil, e
+	}
+	return filter, nil
+}
+
+// FetchFilters attempts to fetch the filters of the given type for a set of block hashes, in order, from persistent
+// storage in a single transaction. If a filter can't be found, the filters before it are returned along with
+// ErrFilterNotFound.
+//
+// NOTE: This method is a part of the FilterDatabase interface.
+func (f *FilterStore) FetchFilters(
+	blockHashes []*chainhash.Hash,
+	filterType FilterType,
+) ([]*gcs.Filter, error) {
+	filters := make([]*gcs.Filter, 0, len(blockHashes))
+	e := walletdb.View(
+		f.db, func(tx walletdb.ReadTx) (e error) {
+			targetBucket, e := readBucket(tx, filterType)
 			if e != nil {
 				return e
 			}
-			filter = dbFilter
+			for _, blockHash := range blockHashes {
+				var filter *gcs.Filter
+				if filter, e = fetchFilter(targetBucket, blockHash); e != nil {
+					return e
+				}
+				filters = append(filters, filter)
+			}
 			return nil
 		},
 	)
+	if e == ErrFilterNotFound {
+		return filters, e
+	}
 	if e != nil {
 		return nil, e
 	}
-	return filter, nil
+	return filters, nil
 }
@@ -57,7 +57,24 @@ func TestGenesisFilterCreation(t *testing.T) {
 	if regGenesisFilter == nil {
 		t.Fatalf("regular genesis filter is nil")
 	}
-	
+	// The extended filter should also be present, as it indexes the coinbase txid.
+	extGenesisFilter, e := dB.FetchFilter(genesisHash, ExtendedFilter)
+	if e != nil {
+		t.Fatalf("unable to fetch extended genesis filter: %v", e)
+	}
+	if extGenesisFilter == nil {
+		t.Fatalf("extended genesis filter is nil")
+	}
+	genesisBlock := chaincfg.SimNetParams.GenesisBlock
+	genesisBlockHash := genesisBlock.BlockHash()
+	coinbaseHash := genesisBlock.Transactions[0].TxHash()
+	match, e := extGenesisFilter.Match(builder.DeriveKey(&genesisBlockHash), coinbaseHash[:])
+	if e != nil {
+		t.Fatalf("unable to match extended genesis filter: %v", e)
+	}
+	if !match {
+		t.Fatalf("extended genesis filter doesn't match the coinbase txid")
+	}
 }
 func genRandFilter(numElements uint32) (filter *gcs.Filter, e error) {
 	elements := make([][]byte, numElements)
@@ -115,3 +132,58 @@ func TestFilterStorage(t *testing.T) {
 		t.Fatalf("regular filter doesn't match!")
 	}
 }
+
+func TestFilterBatchStorage(t *testing.T) {
+	var cleanUp func()
+	var dB FilterDatabase
+	var e error
+	if cleanUp, dB, e = createTestDatabase(); !E.Chk(e) {
+		defer cleanUp()
+	} else {
+		t.Fatalf("unable to create test db: %v", e)
+	}
+	// Store a batch of random filters, with a nil filter in the middle, against random block hashes.
+	batch := make([]*FilterData, 5)
+	hashes := make([]*chainhash.Hash, len(batch))
+	for i := range batch {
+		hashes[i] = &chainhash.Hash{}
+		if _, e = rand.Read(hashes[i][:]); E.Chk(e) {
+			t.Fatalf("unable to generate random hash: %v", e)
+		}
+		batch[i] = &FilterData{BlockHash: hashes[i], Type: RegularFilter}
+		if i == 2 {
+			continue
+		}
+		if batch[i].Filter, e = genRandFilter(uint32(10 * (i + 1))); e != nil {
+			t.Fatalf("unable to create random filter: %v", e)
+		}
+	}
+	if e = dB.PutFilters(batch); e != nil {
+		t.Fatalf("unable to store filters: %v", e)
+	}
+	filters, e := dB.FetchFilters(hashes, RegularFilter)
+	if e != nil {
+		t.Fatalf("unable to retrieve filters: %v", e)
+	}
+	if len(filters) != len(batch) {
+		t.Fatalf("got %d filters, want %d", len(filters), len(batch))
+	}
+	for i := range batch {
+		if !reflect.DeepEqual(batch[i].Filter, filters[i]) {
+			t.Fatalf("filter %d doesn't match!", i)
+		}
+	}
+	// The filters of other types weren't stored.
+	if _, e = dB.FetchFilters(hashes[:1], ExtendedFilter); e != ErrFilterNotFound {
+		t.Fatalf("got error %v for an extended filter, want %v", e, ErrFilterNotFound)
+	}
+	// The filters before one that is missing are still returned.
+	var missing chainhash.Hash
+	filters, e = dB.FetchFilters([]*chainhash.Hash{hashes[0], hashes[1], &missing, hashes[3]}, RegularFilter)
+	if e != ErrFilterNotFound {
+		t.Fatalf("got error %v for a missing filter, want %v", e, ErrFilterNotFound)
+	}
+	if len(filters) != 2 || !reflect.DeepEqual(batch[1].Filter, filters[1]) {
+		t.Fatalf("got %d filters before the missing one, want 2", len(filters))
+	}
+}
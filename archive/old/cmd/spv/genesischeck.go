@@ -0,0 +1,66 @@
+package spv
+
+import (
+	"time"
+	
+	"github.com/p9c/pod/pkg/chaincfg"
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/gcs/builder"
+	"github.com/p9c/pod/pkg/util/qu"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// genesisFilterHeader returns the regular filter header of the genesis block of the chain.
+func genesisFilterHeader(params *chaincfg.Params) (header chainhash.Hash, e error) {
+	filter, e := builder.BuildBasicFilter(params.GenesisBlock, nil)
+	if e != nil {
+		return header, e
+	}
+	return builder.MakeHeaderForFilter(filter, params.GenesisBlock.Header.PrevBlock)
+}
+
+// verifyGenesis asks the peer for the regular filter header of our genesis block before accepting it. A peer of
+// another fork that shares the network magic doesn't know the block, or answers with another filter header, so it
+// can't feed us headers and filters of a chain we don't follow. Peers that answer with another header are banned, and
+// peers that don't answer within GenesisCheckTimeout are disconnected.
+func (sp *ServerPeer) verifyGenesis() {
+	genesis := *sp.server.chainParams.GenesisHash
+	msgChan := make(chan spMsg)
+	subscription := spMsgSubscription{msgChan: msgChan, quitChan: qu.T()}
+	sp.subscribeRecvMsg(subscription)
+	defer func() {
+		sp.unsubscribeRecvMsgs(subscription)
+		subscription.quitChan.Q()
+	}()
+	sp.QueueMessage(wire.NewMsgGetCFHeaders(wire.GCSFilterRegular, 0, &genesis), nil)
+	timeout := time.NewTimer(GenesisCheckTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case m := <-msgChan:
+			msg, ok := m.msg.(*wire.MsgCFHeaders)
+			if !ok || msg.StopHash != genesis || msg.FilterType != wire.GCSFilterRegular {
+				continue
+			}
+			// header = dsha256(filterHash || prevHeader)
+			if len(msg.FilterHashes) != 1 || chainhash.DoubleHashH(
+				append(msg.FilterHashes[0][:], msg.PrevFilterHeader[:]...),
+			) != sp.server.genesisFilterHeader {
+				W.F("peer %s doesn't agree on the genesis block -- banning", sp)
+				sp.server.BanPeerFor(sp, BanSourceGenesis, "different genesis block")
+				sp.Disconnect()
+				return
+			}
+			sp.accept()
+			return
+		case <-timeout.C:
+			I.F("peer %s didn't confirm the genesis block in %v -- disconnecting", sp, GenesisCheckTimeout)
+			sp.Disconnect()
+			return
+		case <-sp.quit.Wait():
+			return
+		case <-sp.server.quit.Wait():
+			return
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package spv
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+	
+	"github.com/p9c/pod/pkg/chaincfg"
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/gcs/builder"
+	"github.com/p9c/pod/pkg/peer"
+	"github.com/p9c/pod/pkg/util/qu"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// pipeConn is one end of an in-memory connection between two peers.
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+	addr string
+}
+
+func (c pipeConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c pipeConn) RemoteAddr() net.Addr             { a, _ := net.ResolveTCPAddr("tcp", c.addr); return a }
+func (c pipeConn) SetDeadline(time.Time) error      { return nil }
+func (c pipeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c pipeConn) SetWriteDeadline(time.Time) error { return nil }
+
+// connectGenesisPeer returns a server peer of s connected to a remote peer that answers getcfheaders with the result
+// of answer, or not at all when answer returns nil.
+func connectGenesisPeer(t *testing.T, s *ChainService, answer func(*wire.MsgGetCFHeaders) *wire.MsgCFHeaders) (
+	*ServerPeer, *peer.Peer,
+) {
+	return connectCFHeadersPeer(t, s, "10.0.0.2:11047", answer)
+}
+
+// connectCFHeadersPeer is connectGenesisPeer with the server peer at the given address.
+func connectCFHeadersPeer(
+	t *testing.T, s *ChainService, addr string, answer func(*wire.MsgGetCFHeaders) *wire.MsgCFHeaders,
+) (*ServerPeer, *peer.Peer) {
+	return connectRemotePeer(
+		t, s, addr, peer.MessageListeners{
+			OnGetCFHeaders: func(p *peer.Peer, msg *wire.MsgGetCFHeaders) {
+				if resp := answer(msg); resp != nil {
+					p.QueueMessage(resp, nil)
+				}
+			},
+		},
+	)
+}
+
+// connectRemotePeer returns a server peer of s at the given address connected to a remote peer with the given
+// listeners.
+func connectRemotePeer(t *testing.T, s *ChainService, addr string, listeners peer.MessageListeners) (
+	*ServerPeer, *peer.Peer,
+) {
+	peer.AllowSelfConns = true
+	verack := make(chan struct{}, 2)
+	onVerAck := func(*peer.Peer, *wire.MsgVerAck) { verack <- struct{}{} }
+	listeners.OnVerAck = onVerAck
+	remote := peer.NewInboundPeer(
+		&peer.Config{
+			Listeners:       listeners,
+			ChainParams:     &s.chainParams,
+			Services:        wire.SFNodeCF,
+			TrickleInterval: time.Second * 10,
+		},
+	)
+	sp := newServerPeer(s, false)
+	local, e := peer.NewOutboundPeer(
+		&peer.Config{
+			Listeners:       peer.MessageListeners{OnVerAck: onVerAck, OnRead: sp.OnRead},
+			ChainParams:     &s.chainParams,
+			TrickleInterval: time.Second * 10,
+		}, addr,
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+	sp.Peer = local
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	remote.AssociateConnection(pipeConn{Reader: r1, WriteCloser: w2, addr: "10.0.0.1:11047"})
+	local.AssociateConnection(pipeConn{Reader: r2, WriteCloser: w1, addr: addr})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-verack:
+		case <-time.After(time.Second):
+			t.Fatal("verack timeout")
+		}
+	}
+	return sp, remote
+}
+
+// TestVerifyGenesis checks that a peer answering with our genesis filter header is accepted, that one answering with
+// another is banned, and that one that doesn't answer is disconnected.
+func TestVerifyGenesis(t *testing.T) {
+	s := &ChainService{
+		chainParams: chaincfg.SimNetParams,
+		newPeers:    make(chan *ServerPeer, 1),
+		banPeers:    make(chan banPeerMsg, 1),
+		quit:        qu.T(),
+	}
+	s.blockManager = &blockManager{peerChan: make(chan interface{}, 1), quit: qu.T()}
+	var e error
+	if s.genesisFilterHeader, e = genesisFilterHeader(&s.chainParams); e != nil {
+		t.Fatal(e)
+	}
+	filter, e := builder.BuildBasicFilter(s.chainParams.GenesisBlock, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	filterHash, e := builder.GetFilterHash(filter)
+	if e != nil {
+		t.Fatal(e)
+	}
+	answerWith := func(hash chainhash.Hash) func(*wire.MsgGetCFHeaders) *wire.MsgCFHeaders {
+		return func(msg *wire.MsgGetCFHeaders) *wire.MsgCFHeaders {
+			resp := wire.NewMsgCFHeaders()
+			resp.FilterType = msg.FilterType
+			resp.StopHash = msg.StopHash
+			if e := resp.AddCFHash(&hash); e != nil {
+				t.Error(e)
+			}
+			return resp
+		}
+	}
+	// The same genesis block.
+	sp, remote := connectGenesisPeer(t, s, answerWith(filterHash))
+	sp.verifyGenesis()
+	select {
+	case added := <-s.newPeers:
+		if added != sp {
+			t.Fatal("another peer was added")
+		}
+	default:
+		t.Fatal("peer with our genesis block wasn't added")
+	}
+	if len(s.blockManager.peerChan) != 1 {
+		t.Fatal("peer with our genesis block isn't a sync candidate")
+	}
+	<-s.blockManager.peerChan
+	remote.Disconnect()
+	sp.Disconnect()
+	// Another genesis block.
+	sp, remote = connectGenesisPeer(t, s, answerWith(chainhash.Hash{1}))
+	sp.verifyGenesis()
+	select {
+	case msg := <-s.banPeers:
+		if msg.peer != sp || msg.source != BanSourceGenesis {
+			t.Fatalf("banned %v from %s, want the peer from %s", msg.peer, msg.source, BanSourceGenesis)
+		}
+	default:
+		t.Fatal("peer with another genesis block wasn't banned")
+	}
+	if !isDisconnected(sp) {
+		t.Fatal("peer with another genesis block wasn't disconnected")
+	}
+	remote.Disconnect()
+	// No answer.
+	defer func(timeout time.Duration) { GenesisCheckTimeout = timeout }(GenesisCheckTimeout)
+	GenesisCheckTimeout = time.Millisecond * 100
+	sp, remote = connectGenesisPeer(t, s, func(*wire.MsgGetCFHeaders) *wire.MsgCFHeaders { return nil })
+	defer remote.Disconnect()
+	sp.verifyGenesis()
+	if !isDisconnected(sp) {
+		t.Fatal("peer that didn't answer wasn't disconnected")
+	}
+	if len(s.newPeers) != 0 || len(s.banPeers) != 0 {
+		t.Fatal("peer that didn't answer was added or banned")
+	}
+}
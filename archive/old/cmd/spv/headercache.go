@@ -0,0 +1,82 @@
+package spv
+
+import (
+	"sort"
+	"sync/atomic"
+	
+	"github.com/p9c/pod/cmd/spv/cache/lru"
+	"github.com/p9c/pod/cmd/spv/headerfs"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// validatedHeader is the height of a header the block manager has validated, as held in its cache of validated headers,
+// where each one takes up a single unit of the capacity.
+type validatedHeader int32
+
+// Size returns the size of the header in the cache.
+func (validatedHeader) Size() (rv uint64, e error) {
+	return 1, nil
+}
+
+// headersValidated returns whether all the headers were recently validated, and the height of the highest one if they
+// were. Once the headers are synced, new headers are announced by many peers at about the same time, and only the
+// first announcement has to be validated.
+func (b *blockManager) headersValidated(headers []*wire.BlockHeader) (height int32, ok bool) {
+	atomic.AddUint64(&b.headerCacheLookups, 1)
+	for _, header := range headers {
+		h, ok := b.validatedHeight(header)
+		if !ok {
+			return 0, false
+		}
+		if h > height {
+			height = h
+		}
+	}
+	atomic.AddUint64(&b.headerCacheHits, 1)
+	return height, true
+}
+
+// validatedHeight returns the height of a header if it was recently validated.
+func (b *blockManager) validatedHeight(header *wire.BlockHeader) (int32, bool) {
+	v, e := b.validatedHeaders.Get(header.BlockHash())
+	if e != nil {
+		return 0, false
+	}
+	return int32(v.(validatedHeader)), true
+}
+
+// validatedHeaderHeights pairs the recently validated headers among headers with their heights, in order of height.
+func (b *blockManager) validatedHeaderHeights(headers []*wire.BlockHeader) (validated []headerfs.BlockHeader) {
+	for _, header := range headers {
+		if h, ok := b.validatedHeight(header); ok {
+			validated = append(validated, headerfs.BlockHeader{BlockHeader: header, Height: uint32(h)})
+		}
+	}
+	sort.Slice(validated, func(i, j int) bool { return validated[i].Height < validated[j].Height })
+	return validated
+}
+
+// markHeadersValidated adds headers that were validated and written to the cache of validated headers.
+func (b *blockManager) markHeadersValidated(headers ...headerfs.BlockHeader) {
+	for _, header := range headers {
+		if e := b.validatedHeaders.Put(header.BlockHash(), validatedHeader(header.Height)); E.Chk(e) {
+		}
+	}
+}
+
+// forgetValidatedHeaders empties the cache of validated headers after the header chain is rolled back, as headers that
+// were rolled back have to be validated again if they are announced once more.
+func (b *blockManager) forgetValidatedHeaders() {
+	b.validatedHeaders = lru.NewCache(uint64(b.server.headerCacheSize))
+}
+
+// HeaderCacheHitRate returns the fraction of the header messages received that held only headers that were recently
+// validated, and the number of header messages it was worked out from.
+func (s *ChainService) HeaderCacheHitRate() (rate float64, messages uint64) {
+	hits := atomic.LoadUint64(&s.blockManager.headerCacheHits)
+	messages = atomic.LoadUint64(&s.blockManager.headerCacheLookups)
+	if messages == 0 {
+		return 0, 0
+	}
+	return float64(hits) / float64(messages), messages
+}
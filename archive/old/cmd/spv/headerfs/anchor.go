@@ -0,0 +1,109 @@
+package headerfs
+
+import (
+	"fmt"
+	
+	"github.com/p9c/pod/pkg/chaincfg"
+	"github.com/p9c/pod/pkg/walletdb"
+)
+
+// ErrAnchorMismatch is returned when a header store already holds a header at the height of the anchor it is opened
+// with, and that header is not the anchor.
+var ErrAnchorMismatch = fmt.Errorf("header store doesn't match anchor header")
+
+// ErrBelowAnchor is returned when a header between genesis and the anchor a store was started from is read, as the
+// flat file only holds empty headers there.
+var ErrBelowAnchor = fmt.Errorf("header is below the anchor of the header store")
+
+// StartHeight returns the height of the anchor header the store was started from, or zero if the store holds every
+// header from genesis.
+func (h *headerStore) StartHeight() uint32 {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	return h.startHeight
+}
+
+// checkAnchored returns ErrBelowAnchor if any of the heights from start up to and including end is between genesis and
+// the anchor the store was started from.
+func (h *headerStore) checkAnchored(start, end uint32) (e error) {
+	if h.startHeight > 1 && start < h.startHeight && end > 0 {
+		return fmt.Errorf("%w: height %d is below the anchor at %d", ErrBelowAnchor, start, h.startHeight)
+	}
+	return nil
+}
+
+// padTo extends the flat file with empty headers so that the next header appended is stored at the given height.
+func (h *headerStore) padTo(height uint32, headerSize int64) (e error) {
+	return h.file.Truncate(int64(height) * headerSize)
+}
+
+// NewBlockHeaderStoreFromAnchor creates a new block header store like NewBlockHeaderStore, which begins from a trusted
+// anchor header rather than genesis. If the store doesn't yet reach the anchor's height the anchor is written as its
+// new tip and the headers below it are never fetched. Otherwise the stored header at that height must be the anchor.
+func NewBlockHeaderStoreFromAnchor(
+	filePath string, db walletdb.DB,
+	netParams *chaincfg.Params, anchor BlockHeader,
+) (BlockHeaderStore, error) {
+	store, e := NewBlockHeaderStore(filePath, db, netParams)
+	if e != nil {
+		return nil, e
+	}
+	bhs := store.(*blockHeaderStore)
+	_, tipHeight, e := bhs.ChainTip()
+	if e != nil {
+		return nil, e
+	}
+	if tipHeight < anchor.Height {
+		if e = bhs.padTo(anchor.Height, 80); E.Chk(e) {
+			return nil, e
+		}
+		if e = bhs.WriteHeaders(anchor); E.Chk(e) {
+			return nil, e
+		}
+	} else {
+		header, e := bhs.FetchHeaderByHeight(anchor.Height)
+		if e != nil {
+			return nil, e
+		}
+		if header.BlockHash() != anchor.BlockHash() {
+			return nil, ErrAnchorMismatch
+		}
+	}
+	bhs.startHeight = anchor.Height
+	return bhs, nil
+}
+
+// NewFilterHeaderStoreFromAnchor creates a new filter header store like NewFilterHeaderStore, which begins from the
+// trusted filter header of an anchor block rather than genesis. The anchor must be at the same height as the one the
+// block header store was started from.
+func NewFilterHeaderStoreFromAnchor(
+	filePath string, db walletdb.DB,
+	filterType HeaderType, netParams *chaincfg.Params, anchor FilterHeader,
+) (*FilterHeaderStore, error) {
+	fhs, e := NewFilterHeaderStore(filePath, db, filterType, netParams)
+	if e != nil {
+		return nil, e
+	}
+	_, tipHeight, e := fhs.ChainTip()
+	if e != nil {
+		return nil, e
+	}
+	if tipHeight < anchor.Height {
+		if e = fhs.padTo(anchor.Height, 32); E.Chk(e) {
+			return nil, e
+		}
+		if e = fhs.WriteHeaders(anchor); E.Chk(e) {
+			return nil, e
+		}
+	} else {
+		header, e := fhs.FetchHeaderByHeight(anchor.Height)
+		if e != nil {
+			return nil, e
+		}
+		if *header != anchor.FilterHash {
+			return nil, ErrAnchorMismatch
+		}
+	}
+	fhs.startHeight = anchor.Height
+	return fhs, nil
+}
@@ -0,0 +1,92 @@
+package headerfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	
+	"github.com/p9c/pod/pkg/chaincfg"
+	"github.com/p9c/pod/pkg/walletdb"
+)
+
+// TestBlockHeaderStoreFromAnchor ensures a block header store started from an anchor header serves the headers after
+// it, builds locators that end at the anchor and refuses to reopen with a different anchor.
+func TestBlockHeaderStoreFromAnchor(t *testing.T) {
+	tempDir, e := ioutil.TempDir("", "anchor_test")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		if e := os.RemoveAll(tempDir); E.Chk(e) {
+		}
+	}()
+	db, e := walletdb.Create("bdb", filepath.Join(tempDir, "test.db"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		if e := db.Close(); E.Chk(e) {
+		}
+	}()
+	const anchorHeight = 500
+	blockHeaders := createTestBlockHeaderChain(600)
+	anchor := blockHeaders[anchorHeight-1]
+	store, e := NewBlockHeaderStoreFromAnchor(tempDir, db, &chaincfg.SimNetParams, anchor)
+	if e != nil {
+		t.Fatalf("unable to create anchored block header store: %v", e)
+	}
+	bhs := store.(*blockHeaderStore)
+	if bhs.StartHeight() != anchorHeight {
+		t.Fatalf("expected start height %v, got %v", anchorHeight, bhs.StartHeight())
+	}
+	if e = bhs.WriteHeaders(blockHeaders[anchorHeight:]...); e != nil {
+		t.Fatalf("unable to write headers after anchor: %v", e)
+	}
+	tip, tipHeight, e := bhs.ChainTip()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if tipHeight != 600 || tip.BlockHash() != blockHeaders[599].BlockHash() {
+		t.Fatalf("expected tip at height 600, got %v", tipHeight)
+	}
+	header, e := bhs.FetchHeaderByHeight(anchorHeight + 10)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if header.BlockHash() != blockHeaders[anchorHeight+9].BlockHash() {
+		t.Fatalf("header at height %v doesn't match", anchorHeight+10)
+	}
+	if e = bhs.CheckConnectivity(); e != nil {
+		t.Fatalf("anchored store isn't connected: %v", e)
+	}
+	// The empty headers between genesis and the anchor can't be read, while genesis can.
+	if _, e = bhs.FetchHeaderByHeight(anchorHeight - 1); !errors.Is(e, ErrBelowAnchor) {
+		t.Fatalf("expected ErrBelowAnchor reading below the anchor, got %v", e)
+	}
+	stopHash := blockHeaders[anchorHeight+4].BlockHash()
+	if _, _, e = bhs.FetchHeaderAncestors(10, &stopHash); !errors.Is(e, ErrBelowAnchor) {
+		t.Fatalf("expected ErrBelowAnchor reading a range crossing the anchor, got %v", e)
+	}
+	genesisHash := chaincfg.SimNetParams.GenesisBlock.Header.BlockHash()
+	if header, e = bhs.FetchHeaderByHeight(0); e != nil || header.BlockHash() != genesisHash {
+		t.Fatalf("unable to read genesis below the anchor: %v", e)
+	}
+	locator, e := bhs.LatestBlockLocator()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if *locator[len(locator)-1] != anchor.BlockHash() {
+		t.Fatalf("expected locator to end at the anchor, got %v", locator[len(locator)-1])
+	}
+	// Reopening with the same anchor succeeds, while a header that isn't the one stored at the anchor's height fails.
+	if _, e = NewBlockHeaderStoreFromAnchor(tempDir, db, &chaincfg.SimNetParams, anchor); e != nil {
+		t.Fatalf("unable to reopen anchored store: %v", e)
+	}
+	bogus := blockHeaders[anchorHeight]
+	bogus.Height = anchorHeight
+	if _, e = NewBlockHeaderStoreFromAnchor(tempDir, db, &chaincfg.SimNetParams, bogus); e != ErrAnchorMismatch {
+		t.Fatalf("expected ErrAnchorMismatch, got %v", e)
+	}
+}
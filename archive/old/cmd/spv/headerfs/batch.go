@@ -0,0 +1,202 @@
+package headerfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/walletdb"
+)
+
+// indexBatch holds the index writes of the header stores on a database that haven't been committed yet, so that the
+// writes of a short interval are committed in a single transaction. All the header stores on a database share one, as
+// the filter header tips refer to the entries of the block header index, and committing them together keeps the index
+// consistent. The headers themselves are appended to the flat files straight away, and a flat file that is ahead of
+// the index after an exit is truncated to the index tip when the store is opened again.
+type indexBatch struct {
+	mtx sync.Mutex
+	db  walletdb.DB
+	// interval is how long writes are held before they are committed, and zero if they are committed at once.
+	interval time.Duration
+	// maxHeaders is the number of buffered headers at which they are committed without waiting out the interval.
+	maxHeaders int
+	entries    map[chainhash.Hash]uint32
+	tips       map[HeaderType]chainhash.Hash
+	headers    int
+	timer      *time.Timer
+}
+
+// indexBatches holds the indexBatch of each database header stores are opened on.
+var indexBatches = struct {
+	sync.Mutex
+	m map[walletdb.DB]*indexBatch
+}{m: make(map[walletdb.DB]*indexBatch)}
+
+// batchFor returns the indexBatch of the header stores on db.
+func batchFor(db walletdb.DB) *indexBatch {
+	indexBatches.Lock()
+	defer indexBatches.Unlock()
+	b, ok := indexBatches.m[db]
+	if !ok {
+		b = &indexBatch{
+			db:      db,
+			entries: make(map[chainhash.Hash]uint32),
+			tips:    make(map[HeaderType]chainhash.Hash),
+		}
+		indexBatches.m[db] = b
+	}
+	return b
+}
+
+// BatchWrites makes the header stores on db hold the index writes of new headers for up to interval before committing
+// them, or until maxHeaders headers are held if that comes first, instead of committing each write at once. The
+// headers that are held are read back from the stores as if they were committed. Sync commits them straight away, and
+// CloseBatch should be called once the stores are no longer used, before the database is closed. An interval of zero
+// turns batching off.
+func BatchWrites(db walletdb.DB, interval time.Duration, maxHeaders int) (e error) {
+	b := batchFor(db)
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	// The writes held under the previous settings are committed first, so none wait out an interval that was changed.
+	b.interval, b.maxHeaders = interval, maxHeaders
+	return b.flush()
+}
+
+// CloseBatch commits the index writes held for the header stores on db and forgets the batch, so that nothing is kept
+// for the database once it is closed. Stores that are still used afterwards commit each write at once, and stores
+// opened on db again start a new batch with batching turned off.
+func CloseBatch(db walletdb.DB) (e error) {
+	indexBatches.Lock()
+	b, ok := indexBatches.m[db]
+	delete(indexBatches.m, db)
+	indexBatches.Unlock()
+	if !ok {
+		return nil
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.interval, b.maxHeaders = 0, 0
+	return b.flush()
+}
+
+// tipKey returns the key of the index bucket that holds the tip of the given header type.
+func tipKey(indexType HeaderType) ([]byte, error) {
+	switch indexType {
+	case Block:
+		return bitcoinTip, nil
+	case RegularFilter:
+		return regFilterTip, nil
+	case ExtendedFilter:
+		return extFilterTip, nil
+	default:
+		return nil, fmt.Errorf("unknown index type: %v", indexType)
+	}
+}
+
+// add holds the entries of a write of the given number of headers and the new tip of the index type, committing them
+// if the batch is full. It returns false without holding anything if batching is turned off.
+func (b *indexBatch) add(
+	indexType HeaderType, entries headerBatch, tip chainhash.Hash, headers int,
+) (held bool, e error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.interval == 0 {
+		return false, nil
+	}
+	for _, entry := range entries {
+		b.entries[entry.hash] = entry.height
+	}
+	b.tips[indexType] = tip
+	b.headers += headers
+	if b.maxHeaders > 0 && b.headers >= b.maxHeaders {
+		return true, b.flush()
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(
+			b.interval, func() {
+				b.mtx.Lock()
+				defer b.mtx.Unlock()
+				b.timer = nil
+				if e := b.flush(); E.Chk(e) {
+				}
+			},
+		)
+	}
+	return true, nil
+}
+
+// height returns the height of a header that is held, if it is.
+func (b *indexBatch) height(hash *chainhash.Hash) (height uint32, ok bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	height, ok = b.entries[*hash]
+	return
+}
+
+// tip returns the tip of the index type that is held, if there is one.
+func (b *indexBatch) tip(indexType HeaderType) (tip chainhash.Hash, ok bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	tip, ok = b.tips[indexType]
+	return
+}
+
+// commit commits the writes that are held.
+func (b *indexBatch) commit() (e error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.flush()
+}
+
+// flush commits the writes that are held in a single transaction. It must be called with the mutex held.
+func (b *indexBatch) flush() (e error) {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.entries) == 0 && len(b.tips) == 0 {
+		return nil
+	}
+	// As in addHeaders, the entries are sorted by their hash so they are written in order.
+	batch := make(headerBatch, 0, len(b.entries))
+	for hash, height := range b.entries {
+		batch = append(batch, headerEntry{hash: hash, height: height})
+	}
+	sort.Sort(batch)
+	e = walletdb.Update(
+		b.db, func(tx walletdb.ReadWriteTx) (e error) {
+			rootBucket := tx.ReadWriteBucket(indexBucket)
+			for _, entry := range batch {
+				var heightBytes [4]byte
+				binary.BigEndian.PutUint32(heightBytes[:], entry.height)
+				if e = rootBucket.Put(entry.hash[:], heightBytes[:]); e != nil {
+					return e
+				}
+			}
+			// The database holds on to the values until the transaction is committed, so each tip is copied out of the
+			// loop variable.
+			for indexType, tip := range b.tips {
+				key, e := tipKey(indexType)
+				if e != nil {
+					return e
+				}
+				tipHash := tip
+				if e = rootBucket.Put(key, tipHash[:]); e != nil {
+					return e
+				}
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		return e
+	}
+	T.Ln("committed", b.headers, "held headers to the header index")
+	b.entries = make(map[chainhash.Hash]uint32)
+	b.tips = make(map[HeaderType]chainhash.Hash)
+	b.headers = 0
+	return nil
+}
@@ -24,7 +24,7 @@ func (h *headerStore) readRaw(seekDist uint64) (rh []byte, e error) {
 	switch h.indexType {
 	case Block:
 		headerSize = 80
-	case RegularFilter:
+	case RegularFilter, ExtendedFilter:
 		headerSize = 32
 	default:
 		return nil, fmt.Errorf("unknown index type: %v", h.indexType)
@@ -49,12 +49,15 @@ func (h *blockHeaderStore) readHeaderRange(
 	startHeight uint32,
 	endHeight uint32,
 ) ([]wire.BlockHeader, error) {
+	if e := h.checkAnchored(startHeight, endHeight); e != nil {
+		return nil, e
+	}
 	// Based on the defined header type, we'll determine the number of bytes that we need to read past the sync point.
 	var headerSize uint32
 	switch h.indexType {
 	case Block:
 		headerSize = 80
-	case RegularFilter:
+	case RegularFilter, ExtendedFilter:
 		headerSize = 32
 	default:
 		return nil, fmt.Errorf("unknown index type: %v", h.indexType)
@@ -88,6 +91,9 @@ func (h *blockHeaderStore) readHeaderRange(
 // readHeader reads a full block header from the flat-file. The header read is determined by the hight value.
 func (h *blockHeaderStore) readHeader(height uint32) (wire.BlockHeader, error) {
 	var header wire.BlockHeader
+	if e := h.checkAnchored(height, height); e != nil {
+		return header, e
+	}
 	// Each header is 80 bytes, so using this information, we'll seek a distance to cover that height based on the size
 	// of block headers.
 	seekDistance := uint64(height) * 80
@@ -106,6 +112,9 @@ func (h *blockHeaderStore) readHeader(height uint32) (wire.BlockHeader, error) {
 
 // readHeader reads a single filter header at the specified height from the flat files on disk.
 func (f *FilterHeaderStore) readHeader(height uint32) (*chainhash.Hash, error) {
+	if e := f.checkAnchored(height, height); e != nil {
+		return nil, e
+	}
 	seekDistance := uint64(height) * 32
 	rawHeader, e := f.readRaw(seekDistance)
 	if e != nil {
@@ -20,11 +20,9 @@ var (
 	// regFilterTip is the key which tracks the "tip" of the regular compact filter header chain. The value of this key
 	// will be the current block hash of the best known chain that the headers for regular filter are synced to.
 	regFilterTip = []byte("regular")
-	// // extFilterTip is the key which tracks the "tip" of the extended
-	// // compact filter header chain. The value of this key will be the
-	// // current block hash of the best known chain that the headers for
-	// // extended filter are synced to.
-	// extFilterTip = []byte("ext")
+	// extFilterTip is the key which tracks the "tip" of the extended compact filter header chain. The value of this key
+	// will be the current block hash of the best known chain that the headers for extended filter are synced to.
+	extFilterTip = []byte("ext")
 )
 var (
 	// ErrHeightNotFound is returned when a specified height isn't found in a target index.
@@ -41,6 +39,8 @@ const (
 	Block HeaderType = iota
 	// RegularFilter is a header type that represents the basic filter header type for the filter header chain.
 	RegularFilter
+	// ExtendedFilter is a header type that represents the extended filter header type for the filter header chain.
+	ExtendedFilter
 )
 
 // headerIndex is an index stored within the database that allows for random access into the on-disk header file. This,
@@ -49,6 +49,7 @@ const (
 type headerIndex struct {
 	db        walletdb.DB
 	indexType HeaderType
+	batch     *indexBatch
 }
 
 // newHeaderIndex creates a new headerIndex given an already open database, and a particular header type.
@@ -67,6 +68,7 @@ func newHeaderIndex(db walletdb.DB, indexType HeaderType) (*headerIndex, error)
 	return &headerIndex{
 			db:        db,
 			indexType: indexType,
+			batch:     batchFor(db),
 		},
 		nil
 }
@@ -112,23 +114,28 @@ func (h *headerIndex) addHeaders(batch headerBatch) (e error) {
 	if len(batch) == 0 {
 		return nil
 	}
+	// The writes are held rather than committed when the header stores on the database batch their writes.
+	var tip headerEntry
+	for _, header := range batch {
+		if header.height >= tip.height {
+			tip = header
+		}
+	}
+	if held, e := h.batch.add(h.indexType, batch, tip.hash, len(batch)); held || e != nil {
+		return e
+	}
 	// In order to ensure optimal write performance, we'll ensure that the items are sorted by their hash before
 	// insertion into the database.
 	sort.Sort(batch)
 	return walletdb.Update(
 		h.db, func(tx walletdb.ReadWriteTx) (e error) {
 			rootBucket := tx.ReadWriteBucket(indexBucket)
-			var tipKey []byte
 			// Based on the specified index type of this instance of the index, we'll grab the key that tracks the tip of
 			// the chain so we can update the index once all the header entries have been updated. TODO(roasbeef): only need
 			// block tip?
-			switch h.indexType {
-			case Block:
-				tipKey = bitcoinTip
-			case RegularFilter:
-				tipKey = regFilterTip
-			default:
-				return fmt.Errorf("unknown index type: %v", h.indexType)
+			tipKey, e := tipKey(h.indexType)
+			if e != nil {
+				return e
 			}
 			var (
 				chainTipHash   chainhash.Hash
@@ -155,6 +162,9 @@ func (h *headerIndex) addHeaders(batch headerBatch) (e error) {
 // heightFromHash returns the height of the entry that matches the specified height. With this height, the caller is
 // then able to seek to the appropriate spot in the flat files in order to extract the true header.
 func (h *headerIndex) heightFromHash(hash *chainhash.Hash) (uint32, error) {
+	if height, ok := h.batch.height(hash); ok {
+		return height, nil
+	}
 	var height uint32
 	e := walletdb.View(
 		h.db, func(tx walletdb.ReadTx) (e error) {
@@ -176,6 +186,13 @@ func (h *headerIndex) heightFromHash(hash *chainhash.Hash) (uint32, error) {
 
 // chainTip returns the best hash and height that the index knows of.
 func (h *headerIndex) chainTip() (*chainhash.Hash, uint32, error) {
+	if tip, ok := h.batch.tip(h.indexType); ok {
+		height, e := h.heightFromHash(&tip)
+		if e != nil {
+			return nil, 0, ErrHeightNotFound
+		}
+		return &tip, height, nil
+	}
 	var (
 		tipHeight uint32
 		tipHash   *chainhash.Hash
@@ -183,16 +200,11 @@ func (h *headerIndex) chainTip() (*chainhash.Hash, uint32, error) {
 	e := walletdb.View(
 		h.db, func(tx walletdb.ReadTx) (e error) {
 			rootBucket := tx.ReadBucket(indexBucket)
-			var tipKey []byte
 			// Based on the specified index type of this instance of the index, we'll grab the particular key that tracks
 			// the chain tip.
-			switch h.indexType {
-			case Block:
-				tipKey = bitcoinTip
-			case RegularFilter:
-				tipKey = regFilterTip
-			default:
-				return fmt.Errorf("unknown chain tip index type: %v", h.indexType)
+			tipKey, e := tipKey(h.indexType)
+			if e != nil {
+				return e
 			}
 			// Now that we have the particular tip key for this header type, we'll fetch the hash for this tip, then using
 			// that we'll fetch the height that corresponds to that hash.
@@ -221,20 +233,19 @@ func (h *headerIndex) chainTip() (*chainhash.Hash, uint32, error) {
 // should point to the hash of the new chain tip. Optionally, if the entry is to be deleted as well, then the delete
 // flag should be set to true.
 func (h *headerIndex) truncateIndex(newTip *chainhash.Hash, delete bool) (e error) {
+	// Held writes are committed first, so that the tip being rolled back is the one in the database.
+	if e = h.batch.commit(); e != nil {
+		return e
+	}
 	return walletdb.Update(
 		h.db, func(tx walletdb.ReadWriteTx) (e error) {
 			rootBucket := tx.ReadWriteBucket(indexBucket)
-			var tipKey []byte
 			// Based on the specified index type of this instance of the
 			// index, we'll grab the key that tracks the tip of the chain
 			// we need to update.
-			switch h.indexType {
-			case Block:
-				tipKey = bitcoinTip
-			case RegularFilter:
-				tipKey = regFilterTip
-			default:
-				return fmt.Errorf("unknown index type: %v", h.indexType)
+			tipKey, e := tipKey(h.indexType)
+			if e != nil {
+				return e
 			}
 			// If the delete flag is set, then we'll also delete this entry from the database as the primary index (block
 			// headers) is being rolled back.
@@ -249,3 +260,12 @@ func (h *headerIndex) truncateIndex(newTip *chainhash.Hash, delete bool) (e erro
 		},
 	)
 }
+
+// setTip moves the tip of the index to newTip after the given number of headers were written past it. The headers of
+// filter header stores are indexed by the entries of the block headers, so only the tip is written.
+func (h *headerIndex) setTip(newTip *chainhash.Hash, headers int) (e error) {
+	if held, e := h.batch.add(h.indexType, nil, *newTip, headers); held || e != nil {
+		return e
+	}
+	return h.truncateIndex(newTip, false)
+}
@@ -0,0 +1,74 @@
+package headerfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/walletdb"
+)
+
+// PruneOrphanHeaders deletes the index entries of block headers that aren't on the chain ending at tipHash, which must
+// be the tip of the store. These are left behind by side chains that were rolled back or by an exit that truncated
+// the flat file but not the index. The number of headers pruned is returned.
+//
+// NOTE: Part of the BlockHeaderStore interface.
+func (h *blockHeaderStore) PruneOrphanHeaders(tipHash chainhash.Hash) (pruned int, e error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	chainTipHash, tipHeight, e := h.chainTip()
+	if e != nil {
+		return 0, e
+	}
+	if *chainTipHash != tipHash {
+		return 0, fmt.Errorf("%v is not the tip of the header store, %v is", tipHash, chainTipHash)
+	}
+	// The index is scanned in the database, so held writes are committed first.
+	if e = h.batch.commit(); e != nil {
+		return 0, e
+	}
+	var orphans [][]byte
+	e = walletdb.View(
+		h.db, func(tx walletdb.ReadTx) (e error) {
+			return tx.ReadBucket(indexBucket).ForEach(
+				func(k, v []byte) (e error) {
+					// Only the entries of headers map a hash to a height, the chain tips map a name to a hash.
+					if len(k) != chainhash.HashSize || len(v) != 4 {
+						return nil
+					}
+					height := binary.BigEndian.Uint32(v)
+					if height <= tipHeight {
+						header, e := h.readHeader(height)
+						if e != nil {
+							return e
+						}
+						if hash := header.BlockHash(); bytes.Equal(hash[:], k) {
+							return nil
+						}
+					}
+					orphans = append(orphans, append([]byte(nil), k...))
+					return nil
+				},
+			)
+		},
+	)
+	if e != nil || len(orphans) == 0 {
+		return 0, e
+	}
+	e = walletdb.Update(
+		h.db, func(tx walletdb.ReadWriteTx) (e error) {
+			rootBucket := tx.ReadWriteBucket(indexBucket)
+			for _, k := range orphans {
+				if e = rootBucket.Delete(k); e != nil {
+					return e
+				}
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		return 0, e
+	}
+	return len(orphans), nil
+}
@@ -7,10 +7,12 @@ import (
 	"github.com/p9c/pod/pkg/chaincfg"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	
 	"github.com/p9c/pod/pkg/blockchain"
 	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/gcs"
 	"github.com/p9c/pod/pkg/gcs/builder"
 	"github.com/p9c/pod/pkg/waddrmgr"
 	"github.com/p9c/pod/pkg/walletdb"
@@ -41,6 +43,11 @@ type BlockHeaderStore interface {
 	// case of re-org which disconnects the latest block header from the end of the main chain. The information about
 	// the new header tip after truncation is returned.
 	RollbackLastBlock() (*waddrmgr.BlockStamp, error)
+	// Sync commits the headers written to the BlockHeaderStore to durable storage.
+	Sync() error
+	// PruneOrphanHeaders removes the headers that aren't on the chain ending at tipHash, the tip of the
+	// BlockHeaderStore, and returns how many were removed.
+	PruneOrphanHeaders(tipHash chainhash.Hash) (int, error)
 }
 
 // headerBufPool is a pool of bytes.Buffer that will be re-used by the various headerStore implementations to batch
@@ -59,6 +66,9 @@ type headerStore struct {
 	mtx      sync.RWMutex
 	filePath string
 	file     *os.File
+	// startHeight is the height of the anchor header the store was started from. Headers between genesis and the anchor
+	// are not stored.
+	startHeight uint32
 	*headerIndex
 }
 
@@ -74,6 +84,8 @@ func newHeaderStore(
 		flatFileName = "block_headers.bin"
 	case RegularFilter:
 		flatFileName = "reg_filter_headers.bin"
+	case ExtendedFilter:
+		flatFileName = "ext_filter_headers.bin"
 	default:
 		return nil, fmt.Errorf("unrecognized filter type: %v", hType)
 	}
@@ -98,6 +110,17 @@ func newHeaderStore(
 		nil
 }
 
+// Sync commits the index writes held by BatchWrites and flushes the flat file of the headerStore to disk. The index is
+// kept in the database, which commits each write durably by itself.
+func (h *headerStore) Sync() (e error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if e = h.batch.commit(); e != nil {
+		return e
+	}
+	return h.file.Sync()
+}
+
 // blockHeaderStore is an implementation of the BlockHeaderStore interface, a fully fledged database for Bitcoin block
 // headers. The blockHeaderStore combines a flat file to store the block headers with a database instance for managing
 // the index into the set of flat files.
@@ -342,13 +365,14 @@ func (h *blockHeaderStore) blockLocatorFromHash(hash *chainhash.Hash) (
 		return locator, nil
 	}
 	decrement := uint32(1)
-	for height > 0 && len(locator) < wire.MaxBlockLocatorsPerMsg {
+	// The locator ends at the genesis hash, or at the anchor header if the store was started from one.
+	for height > h.startHeight && len(locator) < wire.MaxBlockLocatorsPerMsg {
 		// Decrement by 1 for the first 10 blocks, then double the jump until we get to the genesis hash
 		if len(locator) > 10 {
 			decrement *= 2
 		}
-		if decrement > height {
-			height = 0
+		if decrement > height-h.startHeight {
+			height = h.startHeight
 		} else {
 			height -= decrement
 		}
@@ -413,7 +437,7 @@ func (h *blockHeaderStore) CheckConnectivity() (e error) {
 			// We'll now cycle backwards, seeking backwards along the header file to ensure each header connects properly
 			// and the index entries are also accurate. To do this, we start from a height of one before our current tip.
 			var newHeader wire.BlockHeader
-			for height := tipHeight - 1; height > 0; height-- {
+			for height := tipHeight - 1; height > 0 && height >= h.startHeight; height-- {
 				// First, read the block header for this block height, and also compute the block hash for it.
 				newHeader, e = h.readHeader(height)
 				if e != nil {
@@ -506,25 +530,27 @@ func NewFilterHeaderStore(
 	// If the size of the file is zero, then this means that we haven't yet written the initial genesis header to disk,
 	// so we'll do so now.
 	if fileInfo.Size() == 0 {
-		var genesisFilterHash chainhash.Hash
+		var genesisFilter *gcs.Filter
 		switch filterType {
 		case RegularFilter:
-			basicFilter, e := builder.BuildBasicFilter(
+			genesisFilter, e = builder.BuildBasicFilter(
 				netParams.GenesisBlock, nil,
 			)
-			if e != nil {
-				return nil, e
-			}
-			genesisFilterHash, e = builder.MakeHeaderForFilter(
-				basicFilter,
-				netParams.GenesisBlock.Header.PrevBlock,
-			)
-			if e != nil {
-				return nil, e
-			}
+		case ExtendedFilter:
+			genesisFilter, e = builder.BuildExtFilter(netParams.GenesisBlock)
 		default:
 			return nil, fmt.Errorf("unknown filter type: %v", filterType)
 		}
+		if e != nil {
+			return nil, e
+		}
+		genesisFilterHash, e := builder.MakeHeaderForFilter(
+			genesisFilter,
+			netParams.GenesisBlock.Header.PrevBlock,
+		)
+		if e != nil {
+			return nil, e
+		}
 		genesisHeader := FilterHeader{
 			HeaderHash: *netParams.GenesisHash,
 			FilterHash: genesisFilterHash,
@@ -637,7 +663,7 @@ func (f *FilterHeaderStore) WriteHeaders(hdrs ...FilterHeader) (e error) {
 	// As the block headers should already be written, we only need to update the tip pointer for this particular header
 	// type.
 	newTip := hdrs[len(hdrs)-1].toIndexEntry().hash
-	return f.truncateIndex(&newTip, false)
+	return f.setTip(&newTip, len(hdrs))
 }
 
 // ChainTip returns the latest filter header and height known to the FilterHeaderStore.
@@ -691,3 +717,80 @@ func (f *FilterHeaderStore) RollbackLastBlock(newTip *chainhash.Hash) (
 		},
 		nil
 }
+
+// FilterType returns the type of the filters whose headers are held by the FilterHeaderStore.
+func (f *FilterHeaderStore) FilterType() HeaderType {
+	return f.indexType
+}
+
+// FilterHeaderStores holds a FilterHeaderStore for each of a set of filter types. The header chain of each filter type
+// has a tip of its own, so the types can be synced, queried and rolled back independently of each other.
+type FilterHeaderStores struct {
+	mtx    sync.RWMutex
+	stores map[HeaderType]*FilterHeaderStore
+}
+
+// NewFilterHeaderStores opens a FilterHeaderStore for each of the given filter types, creating them and writing their
+// genesis headers as necessary.
+func NewFilterHeaderStores(
+	filePath string, db walletdb.DB, netParams *chaincfg.Params,
+	filterTypes ...HeaderType,
+) (*FilterHeaderStores, error) {
+	f := &FilterHeaderStores{
+		stores: make(map[HeaderType]*FilterHeaderStore, len(filterTypes)),
+	}
+	for _, filterType := range filterTypes {
+		if _, ok := f.stores[filterType]; ok {
+			continue
+		}
+		store, e := NewFilterHeaderStore(filePath, db, filterType, netParams)
+		if e != nil {
+			return nil, e
+		}
+		f.stores[filterType] = store
+	}
+	return f, nil
+}
+
+// Add adds an already open store, such as one started from an anchor, replacing any store held for its filter type.
+func (f *FilterHeaderStores) Add(store *FilterHeaderStore) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.stores[store.FilterType()] = store
+}
+
+// Store returns the store of the given filter type. An error is returned if there is no store for the filter type.
+func (f *FilterHeaderStores) Store(filterType HeaderType) (*FilterHeaderStore, error) {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	store, ok := f.stores[filterType]
+	if !ok {
+		return nil, fmt.Errorf("no header store for filter type: %v", filterType)
+	}
+	return store, nil
+}
+
+// FilterTypes returns the filter types that there are stores for, in ascending order.
+func (f *FilterHeaderStores) FilterTypes() []HeaderType {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	filterTypes := make([]HeaderType, 0, len(f.stores))
+	for filterType := range f.stores {
+		filterTypes = append(filterTypes, filterType)
+	}
+	sort.Slice(
+		filterTypes, func(i, j int) bool {
+			return filterTypes[i] < filterTypes[j]
+		},
+	)
+	return filterTypes
+}
+
+// ChainTip returns the latest filter header and height of the header chain of the given filter type.
+func (f *FilterHeaderStores) ChainTip(filterType HeaderType) (*chainhash.Hash, uint32, error) {
+	store, e := f.Store(filterType)
+	if e != nil {
+		return nil, 0, e
+	}
+	return store.ChainTip()
+}
@@ -484,3 +484,315 @@ func TestBlockHeadersFetchHeaderAncestors(t *testing.T) {
 }
 
 // TODO(roasbeef): combined re-org scenarios
+
+// TestBlockHeaderStorePruneOrphanHeaders leaves index entries behind for headers that were truncated from the flat file
+// and for a side chain header, and ensures only those are pruned.
+func TestBlockHeaderStorePruneOrphanHeaders(t *testing.T) {
+	cleanUp, db, _, bhs, e := createTestBlockHeaderStore()
+	if cleanUp != nil {
+		defer cleanUp()
+	}
+	if e != nil {
+		t.Fatalf("unable to create new block header store: %v", e)
+	}
+	blockHeaders := createTestBlockHeaderChain(10)
+	if e = bhs.WriteHeaders(blockHeaders...); e != nil {
+		t.Fatalf("unable to write block headers: %v", e)
+	}
+	// Cut the last two headers from the flat file while leaving their index entries, as an exit part way through a
+	// roll back would.
+	for i := 0; i < 2; i++ {
+		if e = bhs.singleTruncate(); e != nil {
+			t.Fatalf("unable to truncate header file: %v", e)
+		}
+	}
+	tipHash := blockHeaders[7].BlockHash()
+	if e = bhs.truncateIndex(&tipHash, false); e != nil {
+		t.Fatalf("unable to truncate index: %v", e)
+	}
+	// Index a side chain header at a height where the main chain has a different one.
+	sideHeader := *blockHeaders[4].BlockHeader
+	sideHeader.Nonce++
+	sideHash := sideHeader.BlockHash()
+	e = walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			var height [4]byte
+			binary.BigEndian.PutUint32(height[:], 5)
+			return tx.ReadWriteBucket(indexBucket).Put(sideHash[:], height[:])
+		},
+	)
+	if e != nil {
+		t.Fatalf("unable to index side chain header: %v", e)
+	}
+	if _, e = bhs.PruneOrphanHeaders(blockHeaders[9].BlockHash()); e == nil {
+		t.Fatal("pruned from a hash that isn't the tip")
+	}
+	pruned, e := bhs.PruneOrphanHeaders(tipHash)
+	if e != nil {
+		t.Fatalf("unable to prune orphan headers: %v", e)
+	}
+	if pruned != 3 {
+		t.Fatalf("pruned %d headers, expected 3", pruned)
+	}
+	for _, hash := range []chainhash.Hash{sideHash, blockHeaders[8].BlockHash(), blockHeaders[9].BlockHash()} {
+		if _, e = bhs.heightFromHash(&hash); e == nil {
+			t.Fatalf("orphan header %v is still indexed", hash)
+		}
+	}
+	for _, header := range blockHeaders[:8] {
+		hash := header.BlockHash()
+		if height, e := bhs.heightFromHash(&hash); e != nil || height != header.Height {
+			t.Fatalf("main chain header at height %d is no longer indexed", header.Height)
+		}
+	}
+	if pruned, e = bhs.PruneOrphanHeaders(tipHash); e != nil || pruned != 0 {
+		t.Fatalf("second prune removed %d headers (%v), expected none", pruned, e)
+	}
+}
+
+// TestBatchWrites checks that block and filter headers written while writes are batched are read back before they
+// are committed to the index, and that they are committed by Sync, by filling the batch and once the interval passes.
+func TestBatchWrites(t *testing.T) {
+	tempDir := t.TempDir()
+	db, e := walletdb.Create("bdb", filepath.Join(tempDir, "test.db"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		if e := db.Close(); E.Chk(e) {
+		}
+	}()
+	store, e := NewBlockHeaderStore(tempDir, db, &chaincfg.MainNetParams)
+	if e != nil {
+		t.Fatal(e)
+	}
+	bhs := store.(*blockHeaderStore)
+	fhs, e := NewFilterHeaderStore(tempDir, db, RegularFilter, &chaincfg.MainNetParams)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = BatchWrites(db, time.Hour, 25); e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		if e := BatchWrites(db, 0, 0); E.Chk(e) {
+		}
+	}()
+	// Headers following the genesis block on the main network.
+	prev := chaincfg.MainNetParams.GenesisBlock.Header
+	var height uint32
+	write := func(n int) (last chainhash.Hash) {
+		for i := 0; i < n; i++ {
+			height++
+			header := wire.BlockHeader{PrevBlock: prev.BlockHash(), Timestamp: prev.Timestamp.Add(time.Minute)}
+			if e := bhs.WriteHeaders(BlockHeader{BlockHeader: &header, Height: height}); e != nil {
+				t.Fatal(e)
+			}
+			last = header.BlockHash()
+			filterHeader := FilterHeader{HeaderHash: last, FilterHash: sha256.Sum256(last[:]), Height: height}
+			if e := fhs.WriteHeaders(filterHeader); e != nil {
+				t.Fatal(e)
+			}
+			prev = header
+		}
+		return last
+	}
+	committed := func(hash chainhash.Hash) (found bool) {
+		if e := walletdb.View(
+			db, func(tx walletdb.ReadTx) (e error) {
+				found = tx.ReadBucket(indexBucket).Get(hash[:]) != nil
+				return nil
+			},
+		); e != nil {
+			t.Fatal(e)
+		}
+		return found
+	}
+	checkTips := func(stage string) {
+		_, blockTip, e := bhs.ChainTip()
+		if e != nil {
+			t.Fatal(e)
+		}
+		_, filterTip, e := fhs.ChainTip()
+		if e != nil {
+			t.Fatal(e)
+		}
+		if blockTip != height || filterTip != height {
+			t.Fatalf("%s: block tip %d and filter tip %d, want %d", stage, blockTip, filterTip, height)
+		}
+	}
+	// Headers that are held are read back, but aren't in the database yet.
+	last := write(10)
+	checkTips("held")
+	if _, h, e := bhs.FetchHeader(&last); e != nil || h != height {
+		t.Fatalf("held header fetched at height %d with error %v, want %d", h, e, height)
+	}
+	if committed(last) {
+		t.Fatal("held header committed before Sync")
+	}
+	if e = fhs.Sync(); e != nil {
+		t.Fatal(e)
+	}
+	if !committed(last) {
+		t.Fatal("held header not committed by Sync")
+	}
+	checkTips("synced")
+	// A block and a filter header each count towards filling the batch.
+	last = write(13)
+	if !committed(last) {
+		t.Fatal("headers not committed when the batch filled")
+	}
+	checkTips("filled")
+	// Otherwise the headers are committed once the interval passes.
+	if e = BatchWrites(db, time.Millisecond*10, 0); e != nil {
+		t.Fatal(e)
+	}
+	last = write(1)
+	deadline := time.Now().Add(time.Second)
+	for !committed(last) {
+		if time.Now().After(deadline) {
+			t.Fatal("headers not committed after the interval")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	checkTips("interval")
+}
+
+// TestCloseBatch checks that closing the batch of a database commits the held headers, stops its timer and forgets it,
+// and that the stores commit each write at once afterwards.
+func TestCloseBatch(t *testing.T) {
+	tempDir := t.TempDir()
+	db, e := walletdb.Create("bdb", filepath.Join(tempDir, "test.db"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		if e := db.Close(); E.Chk(e) {
+		}
+	}()
+	store, e := NewBlockHeaderStore(tempDir, db, &chaincfg.MainNetParams)
+	if e != nil {
+		t.Fatal(e)
+	}
+	bhs := store.(*blockHeaderStore)
+	if e = BatchWrites(db, time.Hour, 0); e != nil {
+		t.Fatal(e)
+	}
+	prev := chaincfg.MainNetParams.GenesisBlock.Header
+	write := func(height uint32) chainhash.Hash {
+		header := wire.BlockHeader{PrevBlock: prev.BlockHash(), Timestamp: prev.Timestamp.Add(time.Minute)}
+		if e := bhs.WriteHeaders(BlockHeader{BlockHeader: &header, Height: height}); e != nil {
+			t.Fatal(e)
+		}
+		prev = header
+		return header.BlockHash()
+	}
+	committed := func(hash chainhash.Hash) (found bool) {
+		if e := walletdb.View(
+			db, func(tx walletdb.ReadTx) (e error) {
+				found = tx.ReadBucket(indexBucket).Get(hash[:]) != nil
+				return nil
+			},
+		); e != nil {
+			t.Fatal(e)
+		}
+		return found
+	}
+	held := write(1)
+	batch := bhs.batch
+	if committed(held) || batch.timer == nil {
+		t.Fatal("header wasn't held")
+	}
+	if e = CloseBatch(db); e != nil {
+		t.Fatal(e)
+	}
+	if !committed(held) {
+		t.Fatal("held header not committed when the batch was closed")
+	}
+	indexBatches.Lock()
+	_, ok := indexBatches.m[db]
+	indexBatches.Unlock()
+	if ok || batch.timer != nil {
+		t.Fatal("closed batch is still kept or its timer still runs")
+	}
+	if last := write(2); !committed(last) {
+		t.Fatal("header written after the batch was closed wasn't committed at once")
+	}
+	if e = CloseBatch(db); e != nil {
+		t.Fatal(e)
+	}
+}
+
+// TestFilterHeaderStoresChainTip tests that the header chain of each filter type has a tip of its own.
+func TestFilterHeaderStoresChainTip(t *testing.T) {
+	tempDir, e := ioutil.TempDir("", "store_test")
+	if e != nil {
+		t.Fatalf("unable to create temp dir: %v", e)
+	}
+	defer func() {
+		if e := os.RemoveAll(tempDir); E.Chk(e) {
+		}
+	}()
+	db, e := walletdb.Create("bdb", filepath.Join(tempDir, "test.db"))
+	if e != nil {
+		t.Fatalf("unable to create db: %v", e)
+	}
+	defer func() {
+		if e := db.Close(); E.Chk(e) {
+		}
+	}()
+	stores, e := NewFilterHeaderStores(
+		tempDir, db, &chaincfg.SimNetParams, RegularFilter, ExtendedFilter,
+	)
+	if e != nil {
+		t.Fatalf("unable to create filter header stores: %v", e)
+	}
+	if filterTypes := stores.FilterTypes(); !reflect.DeepEqual(
+		filterTypes, []HeaderType{RegularFilter, ExtendedFilter},
+	) {
+		t.Fatalf("unexpected filter types: %v", filterTypes)
+	}
+	if _, _, e = stores.ChainTip(Block); e == nil {
+		t.Fatalf("expected an error for a filter type without a store")
+	}
+	// Only the regular filter headers are written, so the extended filter header chain has to stay at genesis.
+	headers := createTestFilterHeaderChain(10)
+	regStore, e := stores.Store(RegularFilter)
+	if e != nil {
+		t.Fatalf("unable to fetch regular filter store: %v", e)
+	}
+	if e := walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			rootBucket := tx.ReadWriteBucket(indexBucket)
+			// The genesis filter headers point at the genesis hash of the network, so it is indexed along with the
+			// headers.
+			var genesisHeight [4]byte
+			if e := rootBucket.Put(chaincfg.SimNetParams.GenesisHash[:], genesisHeight[:]); E.Chk(e) {
+				return e
+			}
+			for _, header := range headers {
+				var heightBytes [4]byte
+				binary.BigEndian.PutUint32(heightBytes[:], header.Height)
+				if e := rootBucket.Put(header.HeaderHash[:], heightBytes[:]); E.Chk(e) {
+					return e
+				}
+			}
+			return nil
+		},
+	); E.Chk(e) {
+		t.Fatalf("unable to pre-load block index: %v", e)
+	}
+	if e := regStore.WriteHeaders(headers...); E.Chk(e) {
+		t.Fatalf("unable to write filter headers: %v", e)
+	}
+	regTip, regHeight, e := stores.ChainTip(RegularFilter)
+	if e != nil {
+		t.Fatalf("unable to fetch regular filter tip: %v", e)
+	}
+	if regHeight != 10 || *regTip != headers[9].FilterHash {
+		t.Fatalf("regular filter tip mismatch: got %v at height %v", regTip, regHeight)
+	}
+	if _, extHeight, e := stores.ChainTip(ExtendedFilter); e != nil || extHeight != 0 {
+		t.Fatalf("extended filter tip should be at genesis: height %v, %v", extHeight, e)
+	}
+}
@@ -23,7 +23,7 @@ func (h *headerStore) singleTruncate() (e error) {
 	switch h.indexType {
 	case Block:
 		truncateLength = 80
-	case RegularFilter:
+	case RegularFilter, ExtendedFilter:
 		truncateLength = 32
 	default:
 		return fmt.Errorf("unknown index type: %v", h.indexType)
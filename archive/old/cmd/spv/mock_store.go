@@ -13,6 +13,8 @@ import (
 // mockBlockHeaderStore is an implementation of the BlockHeaderStore backed by a simple map.
 type mockBlockHeaderStore struct {
 	headers map[chainhash.Hash]wire.BlockHeader
+	// heights holds the headers written with WriteHeaders by their height.
+	heights map[uint32]wire.BlockHeader
 }
 
 // A compile-time check to ensure the mockBlockHeaderStore adheres to the BlockHeaderStore interface.
@@ -23,6 +25,7 @@ var _ headerfs.BlockHeaderStore = (*mockBlockHeaderStore)(nil)
 func newMockBlockHeaderStore() headerfs.BlockHeaderStore {
 	return &mockBlockHeaderStore{
 		headers: make(map[chainhash.Hash]wire.BlockHeader),
+		heights: make(map[uint32]wire.BlockHeader),
 	}
 }
 func (m *mockBlockHeaderStore) ChainTip() (
@@ -39,6 +42,9 @@ func (m *mockBlockHeaderStore) LatestBlockLocator() (
 func (m *mockBlockHeaderStore) FetchHeaderByHeight(height uint32) (
 	*wire.BlockHeader, error,
 ) {
+	if header, ok := m.heights[height]; ok {
+		return &header, nil
+	}
 	return nil, nil
 }
 func (m *mockBlockHeaderStore) FetchHeaderAncestors(
@@ -64,9 +70,14 @@ func (m *mockBlockHeaderStore) FetchHeader(h *chainhash.Hash) (
 	}
 	return nil, 0, fmt.Errorf("not found")
 }
+func (m *mockBlockHeaderStore) Sync() error { return nil }
+func (m *mockBlockHeaderStore) PruneOrphanHeaders(chainhash.Hash) (int, error) {
+	return 0, nil
+}
 func (m *mockBlockHeaderStore) WriteHeaders(headers ...headerfs.BlockHeader) (e error) {
 	for _, h := range headers {
 		m.headers[h.BlockHash()] = *h.BlockHeader
+		m.heights[h.Height] = *h.BlockHeader
 	}
 	return nil
 }
@@ -2,8 +2,8 @@ package spv
 
 import (
 	"errors"
+	"time"
 	
-	"github.com/p9c/pod/pkg/addrmgr"
 	"github.com/p9c/pod/pkg/connmgr"
 )
 
@@ -37,6 +37,15 @@ type (
 	forAllPeersMsg struct {
 		closure func(*ServerPeer)
 	}
+	setMaxPeersMsg struct {
+		maxPeers int
+		reply    chan struct{}
+	}
+	// permanenceChangeMsg tells the peer handler that the connection request of an outbound peer was promoted to
+	// permanent or demoted to transient.
+	permanenceChangeMsg struct {
+		connReq *connmgr.ConnReq
+	}
 )
 
 // TODO: General - abstract out more of blockmanager into queries. It'll make this way more maintainable and usable.
@@ -65,10 +74,17 @@ func (s *ChainService) handleQuery(state *peerState, querymsg interface{}) {
 			},
 		)
 		msg.reply <- peers
+	case getBanListMsg:
+		msg.reply <- state.banList(time.Now())
+	case setMaxPeersMsg:
+		s.handleSetMaxPeers(state, msg.maxPeers)
+		msg.reply <- struct{}{}
+	case permanenceChangeMsg:
+		s.handlePermanenceChange(state, msg.connReq)
 	case connectNodeMsg:
 		// TODO: duplicate oneshots?
 		// Limit max number of total peers.
-		if state.Count() >= MaxPeers {
+		if state.Count() >= s.maxPeers {
 			msg.reply <- errors.New("max peers reached")
 			return
 		}
@@ -91,6 +107,7 @@ func (s *ChainService) handleQuery(state *peerState, querymsg interface{}) {
 		go s.connManager.Connect(
 			&connmgr.ConnReq{
 				Addr:      netAddr,
+				Host:      msg.addr,
 				Permanent: msg.permanent,
 			},
 		)
@@ -100,7 +117,7 @@ func (s *ChainService) handleQuery(state *peerState, querymsg interface{}) {
 			state.persistentPeers, msg.cmp, func(sp *ServerPeer) {
 				// Keep group counts ok since we remove from
 				// the list now.
-				state.outboundGroups[addrmgr.GroupKey(sp.NA())]--
+				state.outboundGroups[s.groupKey(sp.NA())]--
 			},
 		)
 		if found {
@@ -129,7 +146,7 @@ func (s *ChainService) handleQuery(state *peerState, querymsg interface{}) {
 			state.outboundPeers, msg.cmp, func(sp *ServerPeer) {
 				// Keep group counts ok since we remove from
 				// the list now.
-				state.outboundGroups[addrmgr.GroupKey(sp.NA())]--
+				state.outboundGroups[s.groupKey(sp.NA())]--
 			},
 		)
 		if found {
@@ -139,7 +156,7 @@ func (s *ChainService) handleQuery(state *peerState, querymsg interface{}) {
 			for found {
 				found = disconnectPeer(
 					state.outboundPeers, msg.cmp, func(sp *ServerPeer) {
-						state.outboundGroups[addrmgr.GroupKey(sp.NA())]--
+						state.outboundGroups[s.groupKey(sp.NA())]--
 					},
 				)
 			}
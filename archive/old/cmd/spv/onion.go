@@ -0,0 +1,61 @@
+package spv
+
+import (
+	"bytes"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	
+	"golang.org/x/crypto/sha3"
+)
+
+// onionAddr is the address of a Tor hidden service. It can't be resolved to an IP address, so it is passed to the
+// Config.Dialer as it is for a proxy to connect to.
+type onionAddr struct {
+	addr string
+}
+
+// Network returns "onion".
+func (oa *onionAddr) Network() string {
+	return "onion"
+}
+
+// String returns the host and port of the onion address.
+func (oa *onionAddr) String() string {
+	return oa.addr
+}
+
+// isOnionHost returns whether the host is a Tor hidden service address.
+func isOnionHost(host string) bool {
+	return strings.HasSuffix(strings.ToLower(host), ".onion")
+}
+
+// checkOnionHost returns an error if the host isn't a valid version 2 or version 3 onion address. A version 2 address
+// is 16 base32 characters encoding the 10 byte hash of the service key, and a version 3 address is 56 base32
+// characters encoding the 32 byte service key, a 2 byte checksum and the version byte.
+func checkOnionHost(host string) error {
+	name := strings.ToUpper(strings.TrimSuffix(strings.ToLower(host), ".onion"))
+	if len(name) != 16 && len(name) != 56 {
+		return fmt.Errorf("onion address %s is neither 16 nor 56 characters long", host)
+	}
+	data, e := base32.StdEncoding.DecodeString(name)
+	if e != nil {
+		return fmt.Errorf("onion address %s is not base32: %w", host, e)
+	}
+	if len(data) == 10 {
+		return nil
+	}
+	// checksum = sha3-256(".onion checksum" || pubkey || version)[:2]
+	pubKey, checksum, version := data[:32], data[32:34], data[34]
+	if version != 3 {
+		return fmt.Errorf("onion address %s has version %d, want 3", host, version)
+	}
+	h := sha3.New256()
+	h.Write([]byte(".onion checksum"))
+	h.Write(pubKey)
+	h.Write([]byte{version})
+	if !bytes.Equal(h.Sum(nil)[:2], checksum) {
+		return fmt.Errorf("onion address %s has a bad checksum", host)
+	}
+	return nil
+}
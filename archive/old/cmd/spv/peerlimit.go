@@ -0,0 +1,49 @@
+package spv
+
+import (
+	"errors"
+	"sort"
+)
+
+// SetMaxPeers changes the most peers the client keeps connected while it is running. When it is lowered the newest
+// outbound peers are disconnected until no more than maxPeers remain, leaving the persistent peers connected. When it
+// is raised the connection manager is asked for connections up to the new target.
+func (s *ChainService) SetMaxPeers(maxPeers int) (e error) {
+	if maxPeers < 1 {
+		return errors.New("max peers must be at least 1")
+	}
+	reply := make(chan struct{})
+	select {
+	case s.query <- setMaxPeersMsg{maxPeers: maxPeers, reply: reply}:
+		<-reply
+		return nil
+	case <-s.quit.Wait():
+		return errors.New("chain service is shutting down")
+	}
+}
+
+// handleSetMaxPeers changes the most peers the client keeps connected, disconnecting the newest outbound peers above
+// the new limit. It is invoked from the peerHandler goroutine.
+func (s *ChainService) handleSetMaxPeers(state *peerState, maxPeers int) {
+	I.F("changing max peers from %d to %d", s.maxPeers, maxPeers)
+	s.maxPeers = maxPeers
+	if excess := state.Count() - maxPeers; excess > 0 {
+		ids := make([]int32, 0, len(state.outboundPeers))
+		for id := range state.outboundPeers {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+		if excess > len(ids) {
+			D.F("keeping %d persistent peers above max peers", excess-len(ids))
+			excess = len(ids)
+		}
+		for _, id := range ids[:excess] {
+			sp := state.outboundPeers[id]
+			D.Ln("disconnecting peer", sp, "above max peers")
+			sp.Disconnect()
+		}
+	}
+	if s.connManager != nil {
+		s.connManager.SetTargetOutbound(uint32(s.targetOutbound()))
+	}
+}
@@ -0,0 +1,140 @@
+package spv
+
+import (
+	"math/big"
+	"sort"
+	"time"
+)
+
+// The weights of the parts of the score BestPeers ranks peers by, which add up to one.
+const (
+	// scoreWeightHeight weighs the height the peer advertised against the best advertised height.
+	scoreWeightHeight = 0.2
+	// scoreWeightWork weighs the header work the peer delivered against the most any peer delivered.
+	scoreWeightWork = 0.2
+	// scoreWeightThroughput weighs the rate the peer sends data at against the fastest peer.
+	scoreWeightThroughput = 0.2
+	// scoreWeightLatency weighs the lowest ping of the peers against the ping of the peer.
+	scoreWeightLatency = 0.2
+	// scoreWeightBan weighs how far the ban score of the peer is from the ban threshold.
+	scoreWeightBan = 0.2
+)
+
+// PeerInfo describes a connected peer as it is ranked by BestPeers.
+type PeerInfo struct {
+	// Addr and ID identify the peer.
+	Addr string
+	ID   int32
+	// BanScore is the current ban score of the peer.
+	BanScore uint32
+	// HeaderWork is the proof of work of the valid headers the peer has delivered, as given by
+	// ServerPeer.HeaderWork.
+	HeaderWork *big.Int
+	// LastBlock is the height of the best block the peer has advertised.
+	LastBlock int32
+	// PingMicros is the round trip time of the last ping answered by the peer, in microseconds.
+	PingMicros int64
+	// BytesPerSecond is the average rate the peer has sent data at since it connected.
+	BytesPerSecond float64
+	// Score is the quality of the peer that BestPeers ranks by, from zero to one.
+	Score float64
+}
+
+// BestPeers returns up to n of the connected peers, best first. Peers are ranked by a score made of their advertised
+// height and delivered header work, which the sync peer is chosen by, their throughput and ping, each against the best
+// of the peers, and how far their ban score is from the ban threshold. Peers of the same score are ordered as the sync
+// peer is chosen: by header work, then height, then ping. All the peers are returned when n is not positive.
+func (s *ChainService) BestPeers(n int) []PeerInfo {
+	peers := rankPeers(peerInfos(s.Peers(), time.Now()), s.peerBanThreshold())
+	if n > 0 && len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// peerInfos returns the information of the peers at now. It is read once for each peer, as the ban score decays and
+// the other values change while the peers are connected.
+func peerInfos(peers []*ServerPeer, now time.Time) []PeerInfo {
+	infos := make([]PeerInfo, len(peers))
+	for i, sp := range peers {
+		infos[i] = PeerInfo{
+			Addr:       sp.Addr(),
+			ID:         sp.ID(),
+			BanScore:   sp.banScore.Int(),
+			HeaderWork: sp.HeaderWork(),
+			LastBlock:  sp.LastBlock(),
+			PingMicros: sp.LastPingMicros(),
+		}
+		if connected := now.Sub(sp.TimeConnected()); !sp.TimeConnected().IsZero() && connected > 0 {
+			infos[i].BytesPerSecond = float64(sp.BytesReceived()) / connected.Seconds()
+		}
+	}
+	return infos
+}
+
+// rankPeers scores the peers, with the ban threshold given, and returns them sorted best first as BestPeers orders
+// them.
+func rankPeers(infos []PeerInfo, banThreshold uint32) []PeerInfo {
+	var (
+		bestHeight int32
+		mostWork   = new(big.Int)
+		fastest    float64
+		lowestPing int64
+	)
+	for _, info := range infos {
+		if info.LastBlock > bestHeight {
+			bestHeight = info.LastBlock
+		}
+		if info.HeaderWork.Cmp(mostWork) > 0 {
+			mostWork = info.HeaderWork
+		}
+		if info.BytesPerSecond > fastest {
+			fastest = info.BytesPerSecond
+		}
+		if info.PingMicros > 0 && (lowestPing == 0 || info.PingMicros < lowestPing) {
+			lowestPing = info.PingMicros
+		}
+	}
+	for i := range infos {
+		info := &infos[i]
+		info.Score = 0
+		if bestHeight > 0 && info.LastBlock > 0 {
+			info.Score += scoreWeightHeight * float64(info.LastBlock) / float64(bestHeight)
+		}
+		if mostWork.Sign() > 0 {
+			work, _ := new(big.Rat).SetFrac(info.HeaderWork, mostWork).Float64()
+			info.Score += scoreWeightWork * work
+		}
+		if fastest > 0 {
+			info.Score += scoreWeightThroughput * info.BytesPerSecond / fastest
+		}
+		// A peer that hasn't answered a ping yet has no latency to credit it with.
+		if info.PingMicros > 0 {
+			info.Score += scoreWeightLatency * float64(lowestPing) / float64(info.PingMicros)
+		}
+		if info.BanScore < banThreshold {
+			info.Score += scoreWeightBan * float64(banThreshold-info.BanScore) / float64(banThreshold)
+		}
+	}
+	sort.SliceStable(
+		infos, func(i, j int) bool {
+			if infos[i].Score != infos[j].Score {
+				return infos[i].Score > infos[j].Score
+			}
+			return betterSyncPeerInfo(&infos[i], &infos[j])
+		},
+	)
+	return infos
+}
+
+// betterSyncPeerInfo returns true if the peer described by info would be chosen as the sync peer over the one described
+// by other, as betterSyncPeer chooses between connected peers.
+func betterSyncPeerInfo(info, other *PeerInfo) bool {
+	if c := info.HeaderWork.Cmp(other.HeaderWork); c != 0 {
+		return c > 0
+	}
+	if info.LastBlock != other.LastBlock {
+		return info.LastBlock > other.LastBlock
+	}
+	return info.PingMicros < other.PingMicros
+}
@@ -13,6 +13,7 @@ import (
 	
 	"github.com/p9c/pod/cmd/spv/cache"
 	"github.com/p9c/pod/cmd/spv/filterdb"
+	"github.com/p9c/pod/pkg/amt"
 	"github.com/p9c/pod/pkg/blockchain"
 	"github.com/p9c/pod/pkg/chainhash"
 	"github.com/p9c/pod/pkg/gcs"
@@ -52,11 +53,19 @@ type queryOptions struct {
 	// "normal" wallets, they'll almost never need to re-match a filter once it's been fetched unless they're doing
 	// something like a key import.
 	persistToDisk bool
+	// filterBatch, when it is set, collects the filters to persist to be written to disk together, rather than each one
+	// being written as it is found.
+	filterBatch *[]*filterdb.FilterData
+	// preferredPeer is the address of a peer that should be asked first, with other peers only used if it fails to
+	// answer or disconnects.
+	preferredPeer string
+	// feeRate is the fee per kB of the transaction a broadcast query announces, or zero if it isn't known.
+	feeRate amt.Amount
 }
 
 // filterCacheKey represents the key used for FilterCache of the ChainService.
 type filterCacheKey struct {
-	blockHash  *chainhash.Hash
+	blockHash  chainhash.Hash
 	filterType filterdb.FilterType
 }
 
@@ -113,6 +122,15 @@ func Encoding(encoding wire.MessageEncoding) QueryOption {
 	}
 }
 
+// FeeRate is a query option for SendTransaction giving the fee per kB the transaction pays, so that it is only
+// announced to the peers whose feefilter it passes. Peers that raise their fee filter above it before the announcement
+// is sent are not sent it. Without it the transaction is announced to every peer.
+func FeeRate(feePerKB amt.Amount) QueryOption {
+	return func(qo *queryOptions) {
+		qo.feeRate = feePerKB
+	}
+}
+
 // DoneChan allows the caller to pass a channel that will get closed when the
 // query is finished.
 func DoneChan(doneChan chan<- struct{}) QueryOption {
@@ -129,6 +147,22 @@ func PersistToDisk() QueryOption {
 	}
 }
 
+// batchFilters has the filters a query persists collected in the batch rather than written to disk.
+func batchFilters(batch *[]*filterdb.FilterData) QueryOption {
+	return func(qo *queryOptions) {
+		qo.filterBatch = batch
+	}
+}
+
+// PreferPeer is a query option that asks the peer with the given address first, falling back to other peers only if it
+// fails to answer or disconnects. This keeps a sequence of related queries on the same peer. It has no effect on queries
+// that are broadcast to all peers.
+func PreferPeer(addr string) QueryOption {
+	return func(qo *queryOptions) {
+		qo.preferredPeer = addr
+	}
+}
+
 // queryState is an atomically updated per-query state for each query in a batch.
 //
 // State transitions are:
@@ -188,6 +222,8 @@ func queryChainServiceBatch(
 // options takes functional options for executing the query.
 	options ...QueryOption,
 ) {
+	atomic.AddInt32(&s.pendingQueries, 1)
+	defer atomic.AddInt32(&s.pendingQueries, -1)
 	// Starting with the set of default options, we'll apply any specified functional options to the query.
 	qo := defaultQueryOptions()
 	qo.applyQueryOptions(options...)
@@ -205,6 +241,17 @@ func queryChainServiceBatch(
 	// currently working on.
 	peerStates := make(map[string]wire.Message)
 	var mtxPeerStates sync.RWMutex
+	// preferredFailed is set once the preferred peer, if any, has failed to answer a query, after which the other peers
+	// no longer defer to it.
+	var preferredFailed int32
+	deferToPreferred := func(sp *ServerPeer) bool {
+		if qo.preferredPeer == "" || sp.Addr() == qo.preferredPeer ||
+			atomic.LoadInt32(&preferredFailed) != 0 {
+			return false
+		}
+		preferred := s.PeerByAddr(qo.preferredPeer)
+		return preferred != nil && preferred.Connected()
+	}
 	peerGoroutine := func(
 		sp *ServerPeer, quit <-chan struct{},
 		matchSignal <-chan struct{},
@@ -231,7 +278,9 @@ func queryChainServiceBatch(
 			default:
 			}
 			handleQuery = -1
-			for i := firstUnfinished; i < len(queryMsgs); i++ {
+			// While the preferred peer is healthy, the other peers leave the queries to it.
+			deferring := deferToPreferred(sp)
+			for i := firstUnfinished; i < len(queryMsgs) && !deferring; i++ {
 				// If this query is finished and we're at firstUnfinished, update firstUnfinished.
 				if i == firstUnfinished &&
 					atomic.LoadUint32(&queryStates[i]) == uint32(queryAnswered) {
@@ -300,6 +349,10 @@ func queryChainServiceBatch(
 					&queryStates[handleQuery],
 					uint32(queryWaitSubmit),
 				)
+				// If the preferred peer failed, let the other peers take over.
+				if sp.Addr() == qo.preferredPeer {
+					atomic.StoreInt32(&preferredFailed, 1)
+				}
 				if !sp.Connected() {
 					return
 				}
@@ -402,6 +455,8 @@ func (s *ChainService) queryAllPeers(
 // options takes functional options for executing the query.
 	options ...QueryOption,
 ) {
+	atomic.AddInt32(&s.pendingQueries, 1)
+	defer atomic.AddInt32(&s.pendingQueries, -1)
 	// Starting with the set of default options, we'll apply any specified functional options to the query.
 	qo := defaultQueryOptions()
 	qo.numRetries = 1
@@ -429,10 +484,14 @@ func (s *ChainService) queryAllPeers(
 			defer sp.unsubscribeRecvMsgs(subscription)
 			for i := uint8(0); i < qo.numRetries; i++ {
 				timeout := time.After(qo.timeout)
-				sp.QueueMessageWithEncoding(
-					queryMsg,
-					nil, qo.encoding,
-				)
+				if _, announce := queryMsg.(*wire.MsgInv); announce || qo.feeRate > 0 {
+					sp.queueAnnouncement(queryMsg, qo.encoding, qo.feeRate)
+				} else {
+					sp.QueueMessageWithEncoding(
+						queryMsg,
+						nil, qo.encoding,
+					)
+				}
 				select {
 				case <-queryQuit.Wait():
 					return
@@ -505,11 +564,19 @@ func queryChainServicePeers(
 // options takes functional options for executing the query.
 	options ...QueryOption,
 ) {
+	atomic.AddInt32(&s.pendingQueries, 1)
+	defer atomic.AddInt32(&s.pendingQueries, -1)
 	// Starting with the set of default options, we'll apply any specified functional options to the query.
 	qo := defaultQueryOptions()
 	qo.applyQueryOptions(options...)
-	// We get an initial view of our peers, to be updated each time a peer query times out.
+	// We get an initial view of our peers, to be updated each time a peer query times out. If the caller prefers a
+	// peer and it's connected, we start with that one instead of the sync peer.
 	queryPeer := s.blockManager.SyncPeer()
+	if qo.preferredPeer != "" {
+		if preferred := s.PeerByAddr(qo.preferredPeer); preferred != nil && preferred.Connected() {
+			queryPeer = preferred
+		}
+	}
 	peerTries := make(map[string]uint8)
 	// This will be state used by the peer query goroutine.
 	queryQuit := qu.T()
@@ -522,17 +589,38 @@ func queryChainServicePeers(
 		msgChan:  msgChan,
 		quitChan: subQuit,
 	}
+	// Block and filter requests are tracked by the block manager, which tells us when the peer has stalled on the
+	// request instead of the peer timeout ticking, and keeps count of the peers that never deliver.
+	tracked := isTrackedRequest(queryMsg)
+	var request *outstandingRequest
+	var stalled <-chan struct{}
+	sendQuery := func(sp *ServerPeer) {
+		peerTries[sp.Addr()]++
+		sp.subscribeRecvMsg(subscription)
+		if tracked {
+			request = s.blockManager.requests.add(sp, qo.timeout)
+			stalled = request.stalled.Wait()
+		}
+		sp.QueueMessageWithEncoding(queryMsg, nil, qo.encoding)
+	}
 	// Loop for any messages sent to us via our subscription channel and check them for whether they satisfy the query.
 	// Break the loop if it's time to quit.
 	peerTimeout := time.NewTicker(qo.timeout)
 	timeout := time.After(qo.peerConnectTimeout)
 	if queryPeer != nil {
-		peerTries[queryPeer.Addr()]++
-		queryPeer.subscribeRecvMsg(subscription)
-		queryPeer.QueueMessageWithEncoding(queryMsg, nil, qo.encoding)
+		sendQuery(queryPeer)
 	}
 checkResponses:
 	for {
+		// next is set when the current peer has failed to answer the query, either by timing out or by stalling on a
+		// tracked request.
+		var next bool
+		// A tracked request tells us itself when the peer has stalled, so the ticker is only needed to look for a peer
+		// to ask when there is none yet.
+		peerTimeoutC := peerTimeout.C
+		if tracked && queryPeer != nil {
+			peerTimeoutC = nil
+		}
 		select {
 		case <-timeout:
 			// When we time out, we're done.
@@ -541,10 +629,14 @@ checkResponses:
 			}
 			break checkResponses
 		case <-queryQuit.Wait():
-			// Same when we get a quit signal.
+			// Same when we get a quit signal, which means the response was found.
 			if queryPeer != nil {
 				queryPeer.unsubscribeRecvMsgs(subscription)
 			}
+			if request != nil {
+				s.blockManager.requests.delivered(request)
+				request = nil
+			}
 			break checkResponses
 		case <-s.quit.Wait():
 			// Same when chain server's quit is signaled.
@@ -555,34 +647,60 @@ checkResponses:
 		// A message has arrived over the subscription channel, so we execute the checkResponses callback to see if this
 		// ends our query session.
 		case sm := <-msgChan:
-			// TODO: This will get stuck if checkResponse gets stuck. This is a caveat for callers that should be fixed
-			//  before exposing this function for public use.
-			checkResponse(sm.sp, sm.msg, queryQuit)
-		// The current peer we're querying has failed to answer the query. Time to select a new peer and query it.
-		case <-peerTimeout.C:
-			if queryPeer != nil {
-				queryPeer.unsubscribeRecvMsgs(subscription)
-			}
-			queryPeer = nil
-			for _, curPeer := range s.Peers() {
-				if curPeer != nil && curPeer.Connected() &&
-					peerTries[curPeer.Addr()] < qo.numRetries {
-					curPeer := curPeer
-					queryPeer = curPeer
-					// Found a peer we can query.
-					peerTries[queryPeer.Addr()]++
-					queryPeer.subscribeRecvMsg(subscription)
-					queryPeer.QueueMessageWithEncoding(
-						queryMsg, nil, qo.encoding,
-					)
-					break
+			// A peer that doesn't have what it was asked for answers notfound, and the next peer is asked right away
+			// instead of waiting for the request to time out.
+			if notFound, ok := sm.msg.(*wire.MsgNotFound); ok && sm.sp == queryPeer && notFoundFor(queryMsg, notFound) {
+				D.F("peer %s doesn't have %v -- asking another peer", sm.sp, notFound.InvList)
+				sm.sp.handleNotFound(notFound)
+				peerTries[sm.sp.Addr()] = qo.numRetries
+				if request != nil {
+					s.blockManager.requests.cancel(request)
+					request, stalled = nil, nil
 				}
+				next = true
+			} else {
+				// TODO: This will get stuck if checkResponse gets stuck. This is a caveat for callers that should be
+				//  fixed before exposing this function for public use.
+				checkResponse(sm.sp, sm.msg, queryQuit)
 			}
-			// If at this point, we don't yet have a query peer, then we'll exit now as all the peers are exhausted.
-			if queryPeer == nil {
-				break checkResponses
+		case <-peerTimeoutC:
+			next = true
+		case <-stalled:
+			request, stalled = nil, nil
+			next = true
+		}
+		if !next {
+			continue
+		}
+		// Time to select a new peer and query it.
+		if queryPeer != nil {
+			queryPeer.unsubscribeRecvMsgs(subscription)
+		}
+		queryPeer = nil
+		// The preferred peer, if any, is tried again before any other peer as long as it has retries left.
+		peers := s.Peers()
+		if qo.preferredPeer != "" {
+			if preferred := s.PeerByAddr(qo.preferredPeer); preferred != nil {
+				peers = append([]*ServerPeer{preferred}, peers...)
 			}
 		}
+		for _, curPeer := range peers {
+			if curPeer != nil && curPeer.Connected() &&
+				peerTries[curPeer.Addr()] < qo.numRetries {
+				// Found a peer we can query.
+				queryPeer = curPeer
+				sendQuery(queryPeer)
+				break
+			}
+		}
+		// If at this point, we don't yet have a query peer, then we'll exit now as all the peers are exhausted.
+		if queryPeer == nil {
+			break checkResponses
+		}
+	}
+	// A request still outstanding when the query ends some other way isn't counted against the peer.
+	if request != nil {
+		s.blockManager.requests.cancel(request)
 	}
 	// Close the subscription quit channel and the done channel, if any.
 	subQuit.Q()
@@ -592,13 +710,30 @@ checkResponses:
 	}
 }
 
+// notFoundFor returns true if the notfound message answers the query, which it does when the query is a getdata asking
+// for any of the inventory in it.
+func notFoundFor(query wire.Message, notFound *wire.MsgNotFound) bool {
+	getData, ok := query.(*wire.MsgGetData)
+	if !ok {
+		return false
+	}
+	for _, want := range getData.InvList {
+		for _, iv := range notFound.InvList {
+			if iv.Hash == want.Hash {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // getFilterFromCache returns a filter from ChainService's FilterCache if it
 // exists, returning nil and error if it doesn't.
 func (s *ChainService) getFilterFromCache(
 	blockHash *chainhash.Hash,
 	filterType filterdb.FilterType,
 ) (flt *gcs.Filter, e error) {
-	cacheKey := filterCacheKey{blockHash: blockHash, filterType: filterType}
+	cacheKey := filterCacheKey{blockHash: *blockHash, filterType: filterType}
 	var filterValue cache.Value
 	if filterValue, e = s.FilterCache.Get(cacheKey); E.Chk(e) {
 		return
@@ -611,26 +746,52 @@ func (s *ChainService) putFilterToCache(
 	blockHash *chainhash.Hash,
 	filterType filterdb.FilterType, filter *gcs.Filter,
 ) (e error) {
-	cacheKey := filterCacheKey{blockHash: blockHash, filterType: filterType}
+	cacheKey := filterCacheKey{blockHash: *blockHash, filterType: filterType}
 	return s.FilterCache.Put(cacheKey, &cache.CacheableFilter{Filter: filter})
 }
 
+// filterQueryOptions returns the options of the queries the block manager makes for filter headers, checkpoints and
+// filters, which give each peer Config.FilterRequestTimeout to answer if it is set.
+func (s *ChainService) filterQueryOptions() []QueryOption {
+	if s.filterQueryTimeout == 0 {
+		return nil
+	}
+	return []QueryOption{Timeout(s.filterQueryTimeout)}
+}
+
+// requestQueryOptions puts a configured request timeout in front of the caller's options, so that they can still
+// override it. With no timeout configured the options are left alone and peers get QueryTimeout as for any query.
+func requestQueryOptions(timeout time.Duration, options []QueryOption) []QueryOption {
+	if timeout == 0 {
+		return options
+	}
+	return append([]QueryOption{Timeout(timeout)}, options...)
+}
+
 // GetCFilter gets a cfilter from the database. Failing that, it requests the cfilter from the network and writes it to
-// the database. If extended is true, an extended filter will be queried for. Otherwise, we'll fetch the regular filter.
+// the database. Only filter types that the ChainService was configured to sync can be fetched.
 func (s *ChainService) GetCFilter(
 	blockHash chainhash.Hash,
 	filterType wire.FilterType, options ...QueryOption,
 ) (flt *gcs.Filter, e error) {
-	// The only supported filter atm is the regular filter, so we'll reject all other filters.
-	if filterType != wire.GCSFilterRegular {
-		return nil, fmt.Errorf("unknown filter type: %v", filterType)
-	}
-	// Only get one CFilter at a time to avoid redundancy from mutliple rescans running at once.
-	s.mtxCFilter.Lock()
-	defer s.mtxCFilter.Unlock()
-	// Based on if extended is true or not, we'll set up our set of querying, and db-write functions.
-	getHeader := s.RegFilterHeaders.FetchHeader
-	dbFilterType := filterdb.RegularFilter
+	// We can only verify filters of the types whose headers we sync, so we'll reject all other filters.
+	store, e := s.FilterHeaders(filterType)
+	if e != nil {
+		return nil, e
+	}
+	// Only get as many CFilters at a time as configured, by default one to avoid redundancy from mutliple rescans
+	// running at once.
+	if s.filterSlots != nil {
+		select {
+		case s.filterSlots <- struct{}{}:
+		case <-s.quit.Wait():
+			return nil, ErrShuttingDown
+		}
+		defer func() { <-s.filterSlots }()
+	}
+	// Based on the filter type, we'll set up our set of querying, and db-write functions.
+	getHeader := store.FetchHeader
+	dbFilterType := filterTypes[filterType].db
 	// First check the cache to see if we already have this filter. If so, then we can return it an exit early.
 	filter, e := s.getFilterFromCache(&blockHash, dbFilterType)
 	if e == nil && filter != nil {
@@ -712,7 +873,8 @@ func (s *ChainService) GetCFilter(
 			default:
 			}
 		},
-		options...,
+		// Peers have the configured filter request timeout to deliver unless the caller specified another.
+		requestQueryOptions(s.filterRequestTimeout, options)...,
 	)
 	if filter != nil {
 		// If we found a filter, put it in the cache and persistToDisk if the caller requested it.
@@ -722,7 +884,12 @@ func (s *ChainService) GetCFilter(
 		}
 		qo := defaultQueryOptions()
 		qo.applyQueryOptions(options...)
-		if qo.persistToDisk {
+		switch {
+		case qo.persistToDisk && qo.filterBatch != nil:
+			*qo.filterBatch = append(
+				*qo.filterBatch, &filterdb.FilterData{Filter: filter, BlockHash: &blockHash, Type: dbFilterType},
+			)
+		case qo.persistToDisk:
 			if e = s.FilterDB.PutFilter(&blockHash, filter, dbFilterType); E.Chk(e) {
 				return
 			}
@@ -737,6 +904,16 @@ func (s *ChainService) GetCFilter(
 func (s *ChainService) GetBlock(
 	blockHash chainhash.Hash,
 	options ...QueryOption,
+) (foundBlock *block.Block, e error) {
+	return s.getBlock(blockHash, true, options...)
+}
+
+// getBlock gets a block like GetBlock, waiting for one of the limited block fetches to be free first if limited is set.
+// The previous block needed to check a block from the network is fetched unlimited, as the fetch it is for holds a
+// slot already.
+func (s *ChainService) getBlock(
+	blockHash chainhash.Hash, limited bool,
+	options ...QueryOption,
 ) (foundBlock *block.Block, e error) {
 	// Fetch the corresponding block header from the database. If this isn't found then we don't have the header for
 	// this so we can't request it.
@@ -765,10 +942,31 @@ func (s *ChainService) GetBlock(
 	if e != nil && e != cache.ErrElementNotFound {
 		return
 	}
+	// Concurrent fetches of the block, such as those of rescans over the same range, share a single download.
+	return s.blockFetches.do(
+		blockFetchKey{inv: *inv, limited: limited}, func() (*block.Block, error) {
+			return s.fetchBlock(blockHash, height, inv, limited, options...)
+		},
+	)
+}
+
+// fetchBlock fetches a block from the network for getBlock and adds it to the block cache.
+func (s *ChainService) fetchBlock(
+	blockHash chainhash.Hash, height uint32, inv *wire.InvVect, limited bool,
+	options ...QueryOption,
+) (foundBlock *block.Block, e error) {
 	// Construct the appropriate getdata message to fetch the target block.
 	getData := wire.NewMsgGetData()
 	if e = getData.AddInvVect(inv); E.Chk(e) {
 	}
+	if limited && s.blockSlots != nil {
+		select {
+		case s.blockSlots <- struct{}{}:
+		case <-s.quit.Wait():
+			return nil, ErrShuttingDown
+		}
+		defer func() { <-s.blockSlots }()
+	}
 	// The block is only updated from the checkResponse function argument, which is
 	// always called single-threadedly. We don't check the block until after the
 	// query is finished, so we can just write to it naively.
@@ -795,7 +993,7 @@ func (s *ChainService) GetBlock(
 					blk.SetHeight(int32(height))
 				}
 				var pb *block.Block
-				if pb, e = sp.server.GetBlock(blk.WireBlock().Header.PrevBlock); E.Chk(e) {
+				if pb, e = sp.server.getBlock(blk.WireBlock().Header.PrevBlock, false); E.Chk(e) {
 					return
 				}
 				pbt := pb.WireBlock().Header.Timestamp
@@ -822,7 +1020,8 @@ func (s *ChainService) GetBlock(
 			default:
 			}
 		},
-		options...,
+		// Peers have the configured block request timeout to deliver unless the caller specified another.
+		requestQueryOptions(s.blockRequestTimeout, options)...,
 	)
 	if foundBlock == nil {
 		return nil, fmt.Errorf(
@@ -835,6 +1034,7 @@ func (s *ChainService) GetBlock(
 	if e != nil {
 		E.Ln("couldn't write block to cache:", e)
 	}
+	s.pruneBlockCache()
 	return foundBlock, nil
 }
 
@@ -857,8 +1057,9 @@ func (s *ChainService) SendTransaction(
 	if qo.encoding == wire.BaseEncoding {
 		invType = wire.InvTypeTx
 	}
-	// Create an inv.
+	// Create an inv, and let the trackers of the transaction match block filters against it.
 	txHash := tx.TxHash()
+	s.noteBroadcastTx(tx)
 	inv := wire.NewMsgInv()
 	if e = inv.AddInvVect(wire.NewInvVect(invType, &txHash)); E.Chk(e) {
 	}
@@ -873,6 +1074,7 @@ func (s *ChainService) SendTransaction(
 			case *wire.MsgGetData:
 				for _, vec := range response.InvList {
 					if vec.Hash == txHash {
+						s.noteBroadcastPeer(&txHash, sp)
 						sp.QueueMessageWithEncoding(
 							tx, nil, qo.encoding,
 						)
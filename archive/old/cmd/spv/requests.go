@@ -0,0 +1,131 @@
+package spv
+
+import (
+	"sync"
+	"time"
+	
+	"github.com/p9c/pod/pkg/util/qu"
+	
+	"github.com/p9c/pod/pkg/wire"
+)
+
+var (
+	// MaxUndeliveredRequests is the number of requests in a row a peer can fail to deliver before it is banned.
+	MaxUndeliveredRequests = uint32(5)
+	// requestSweepInterval is how often the block manager checks for requests that have been outstanding for too long.
+	requestSweepInterval = time.Millisecond * 250
+)
+
+type (
+	// outstandingRequest is a block or filter request sent to a peer that hasn't been delivered yet.
+	outstandingRequest struct {
+		peer     *ServerPeer
+		sent     time.Time
+		deadline time.Time
+		// stalled is closed if the peer doesn't deliver before the deadline, so the query can ask another peer.
+		stalled qu.C
+	}
+	// requestTracker keeps track of the block and filter requests that have been sent to peers and not yet delivered,
+	// and of the peers that keep failing to deliver them.
+	requestTracker struct {
+		mtx         sync.Mutex
+		outstanding map[*outstandingRequest]struct{}
+		// undelivered is the number of requests in a row each peer, by address, has failed to deliver.
+		undelivered map[string]uint32
+	}
+)
+
+// newRequestTracker returns an empty requestTracker.
+func newRequestTracker() *requestTracker {
+	return &requestTracker{
+		outstanding: make(map[*outstandingRequest]struct{}),
+		undelivered: make(map[string]uint32),
+	}
+}
+
+// isTrackedRequest returns true if the message is a request for a block or filter, which are the requests peers are
+// expected to deliver.
+func isTrackedRequest(msg wire.Message) bool {
+	switch m := msg.(type) {
+	case *wire.MsgGetData:
+		for _, iv := range m.InvList {
+			if iv.Type == wire.InvTypeBlock || iv.Type == wire.InvTypeWitnessBlock {
+				return true
+			}
+		}
+	case *wire.MsgGetCFilters:
+		return true
+	}
+	return false
+}
+
+// add records a request sent to a peer that must be delivered within the timeout.
+func (rt *requestTracker) add(sp *ServerPeer, timeout time.Duration) *outstandingRequest {
+	now := time.Now()
+	req := &outstandingRequest{
+		peer:     sp,
+		sent:     now,
+		deadline: now.Add(timeout),
+		stalled:  qu.T(),
+	}
+	rt.mtx.Lock()
+	rt.outstanding[req] = struct{}{}
+	rt.mtx.Unlock()
+	return req
+}
+
+// delivered records that the peer delivered the request, which clears its run of undelivered requests.
+func (rt *requestTracker) delivered(req *outstandingRequest) {
+	rt.mtx.Lock()
+	defer rt.mtx.Unlock()
+	if _, ok := rt.outstanding[req]; !ok {
+		return
+	}
+	delete(rt.outstanding, req)
+	delete(rt.undelivered, req.peer.Addr())
+}
+
+// cancel forgets a request that is no longer wanted, without counting it against the peer.
+func (rt *requestTracker) cancel(req *outstandingRequest) {
+	rt.mtx.Lock()
+	delete(rt.outstanding, req)
+	rt.mtx.Unlock()
+}
+
+// expire signals every request past its deadline as stalled and counts it against its peer. The peers that have now
+// failed to deliver MaxUndeliveredRequests requests in a row are returned.
+func (rt *requestTracker) expire(now time.Time) (chronic []*ServerPeer) {
+	rt.mtx.Lock()
+	defer rt.mtx.Unlock()
+	for req := range rt.outstanding {
+		if now.Before(req.deadline) {
+			continue
+		}
+		delete(rt.outstanding, req)
+		req.stalled.Q()
+		addr := req.peer.Addr()
+		rt.undelivered[addr]++
+		D.F(
+			"peer %s didn't deliver request sent %v ago (%d in a row)",
+			addr, now.Sub(req.sent), rt.undelivered[addr],
+		)
+		if rt.undelivered[addr] >= MaxUndeliveredRequests {
+			delete(rt.undelivered, addr)
+			chronic = append(chronic, req.peer)
+		}
+	}
+	return
+}
+
+// handleStalledRequests bans and disconnects the peers that keep failing to deliver the blocks and filters requested
+// from them. The queries waiting on stalled requests move on to other peers themselves.
+func (b *blockManager) handleStalledRequests() {
+	for _, sp := range b.requests.expire(time.Now()) {
+		W.F(
+			"peer %s failed to deliver %d requests in a row -- banning",
+			sp.Addr(), MaxUndeliveredRequests,
+		)
+		b.server.BanPeerFor(sp, BanSourceRequests, "undelivered requests")
+		sp.Disconnect()
+	}
+}
@@ -11,6 +11,7 @@ import (
 	
 	"github.com/p9c/pod/pkg/util/qu"
 	
+	"github.com/p9c/pod/cmd/spv/filterdb"
 	"github.com/p9c/pod/cmd/spv/headerfs"
 	"github.com/p9c/pod/pkg/btcjson"
 	"github.com/p9c/pod/pkg/chainhash"
@@ -26,6 +27,22 @@ import (
 // ErrRescanExit is an error returned to the caller in case the ongoing rescan exits.
 var ErrRescanExit = errors.New("rescan exited")
 
+// MatchReason is the set of reasons a transaction in a block was relevant to a rescan.
+type MatchReason uint8
+
+const (
+	// MatchSpend is set for a transaction that spends a watched input, as notified by OnRedeemingTx.
+	MatchSpend MatchReason = 1 << iota
+	// MatchReceive is set for a transaction that pays a watched address or script, as notified by OnRecvTx.
+	MatchReceive
+)
+
+// TxMatch is a transaction in a block that was relevant to a rescan, and the reasons it was.
+type TxMatch struct {
+	Tx      *util.Tx
+	Reasons MatchReason
+}
+
 // rescanOptions holds the set of functional parameters for Rescan.
 type rescanOptions struct {
 	chain        *ChainService
@@ -36,12 +53,25 @@ type rescanOptions struct {
 	endBlock     *waddrmgr.BlockStamp
 	watchAddrs   []btcaddr.Address
 	watchInputs  []InputWithScript
+	watchScripts [][]byte
 	watchList    [][]byte
 	txIdx        uint32
 	update       <-chan *updateOptions
 	quit         qu.C
+	// onBlockMatches is called with the relevant transactions of each filtered block and why they matched.
+	onBlockMatches func(height int32, header *wire.BlockHeader, matches []TxMatch)
+	// matchScratch holds the buffers reused to match the watch list against the filter of each block.
+	matchScratch gcs.MatchScratch
+	// prefetchedTo is the height up to which the stored filters of the blocks ahead were read into the filter cache.
+	prefetchedTo int32
+	// filterBatch holds the filters fetched from the network that are written to the filter database together, which
+	// is done when PersistToDisk is among the query options.
+	filterBatch []*filterdb.FilterData
 }
 
+// rescanFilterBatch is the number of filters a rescan reads from the filter database, or writes to it, at a time.
+const rescanFilterBatch = wire.MaxGetCFiltersReqRange
+
 // RescanOption is a functional option argument to any of the rescan and notification subscription methods. These are
 // always processed in order, with later options overriding earlier ones.
 type RescanOption func(ro *rescanOptions)
@@ -65,6 +95,15 @@ func NotificationHandlers(ntfn rpcclient.NotificationHandlers) RescanOption {
 	}
 }
 
+// OnFilteredBlockMatches specifies a handler that is called for each block along with OnFilteredBlockConnected, in the
+// same goroutine, with the relevant transactions of the block and the reasons each of them matched, so that they can be
+// told apart without checking them against the watch list again.
+func OnFilteredBlockMatches(f func(height int32, header *wire.BlockHeader, matches []TxMatch)) RescanOption {
+	return func(ro *rescanOptions) {
+		ro.onBlockMatches = f
+	}
+}
+
 // StartBlock specifies the start block. The hash is checked first; if there's no such hash (zero hash avoids lookup),
 // the height is checked next. If the height is 0 or the start block isn't specified, starts from the genesis block.
 // This block is assumed to already be known, and no notifications will be sent for this block. The rescan uses the
@@ -126,6 +165,18 @@ func WatchInputs(watchInputs ...InputWithScript) RescanOption {
 	}
 }
 
+// WatchScripts specifies raw output scripts to watch/filter for, for outputs
+// such as non-standard ones that don't map to an address. The scripts are
+// matched against the filters as they are, and each time a transaction pays to
+// one of them the outpoint is watched as with WatchInputs. Each call to this
+// function adds to the list of scripts being watched rather than replacing the
+// list.
+func WatchScripts(watchScripts ...[]byte) RescanOption {
+	return func(ro *rescanOptions) {
+		ro.watchScripts = append(ro.watchScripts, watchScripts...)
+	}
+}
+
 // TxIdx specifies a hint transaction index into the block in which the UTXO is
 // created (eg, coinbase is 0, next transaction is 1, etc.)
 func TxIdx(txIdx uint32) RescanOption {
@@ -177,6 +228,7 @@ func (s *ChainService) rescan(options ...RescanOption) (e error) {
 	for _, input := range ro.watchInputs {
 		ro.watchList = append(ro.watchList, input.PkScript)
 	}
+	ro.watchList = append(ro.watchList, ro.watchScripts...)
 	// Chk that we have either an end block or a quit channel.
 	if ro.endBlock != nil {
 		// If the end block hash is non-nil, then we'll query the database to find out the stop height.
@@ -214,6 +266,22 @@ func (s *ChainService) rescan(options ...RescanOption) (e error) {
 				" or valid end block",
 		)
 	}
+	// Wait for a free slot if the number of rescans running at once is limited.
+	release, e := s.acquireRescanSlot(ro.quit)
+	if e != nil {
+		return e
+	}
+	defer release()
+	// The chain state can't be reset under a running rescan.
+	rescanDone, e := s.beginRescan()
+	if e != nil {
+		return e
+	}
+	defer rescanDone()
+	defer func() {
+		if e := s.flushFilters(ro); E.Chk(e) {
+		}
+	}()
 	// Track our position in the chain.
 	var (
 		curHeader wire.BlockHeader
@@ -256,6 +324,9 @@ func (s *ChainService) rescan(options ...RescanOption) (e error) {
 			}
 		}
 	}
+	// The blocks from where the rescan is on are kept when the block cache is pruned.
+	s.rescanPositions.set(ro, curStamp.Height)
+	defer s.rescanPositions.remove(ro)
 	s.blockManager.newFilterHeadersMtx.RLock()
 	filterHeaderHeight := s.blockManager.filterHeaderTip
 	s.blockManager.newFilterHeadersMtx.RUnlock()
@@ -429,7 +500,7 @@ rescanLoop:
 				// from the network.
 				var blockFilter *gcs.Filter
 				queryOptions := NumRetries(0)
-				blockFilter, e = s.GetCFilter(curStamp.Hash, wire.GCSFilterRegular, queryOptions)
+				blockFilter, e = s.GetCFilter(curStamp.Hash, wire.GCSFilterRegular, ro.filterOptions(queryOptions)...)
 				switch {
 				// If the block index doesn't know about this block, then it's likely we're mid re-org so we'll accept
 				// this as we account for it below.
@@ -448,6 +519,10 @@ rescanLoop:
 				if e != nil {
 					return e
 				}
+				// Blocks come one at a time once the rescan is current, so there is nothing to batch the filter with.
+				if e = s.flushFilters(ro); E.Chk(e) {
+					return e
+				}
 				// We'll successfully fetched this current block, so we'll reset the retry timer back to nil.
 				blockReFetchTimer = nil
 			case header := <-blockDisconnected:
@@ -504,6 +579,11 @@ rescanLoop:
 						"subscribing to block notifications %s", curStamp.Height, curStamp.Hash,
 				)
 				current = true
+				if e = s.flushFilters(ro); E.Chk(e) {
+					return e
+				}
+				// A rescan following the tip no longer holds up the rescans waiting to scan the chain.
+				release()
 				// Ensure we cancel the old subscription if we're going back to scan for missed blocks.
 				if subscription != nil {
 					s.unsubscribeBlockMsgs(subscription)
@@ -540,10 +620,18 @@ rescanLoop:
 			if !scanning {
 				scanning = ro.startTime.Before(curHeader.Timestamp)
 			}
+			if scanning && len(ro.watchList) != 0 {
+				s.prefetchFilters(ro, curStamp.Height, bestBlock.Height)
+			}
 			e = s.notifyBlock(ro, curHeader, curStamp, scanning)
 			if e != nil {
 				return e
 			}
+			if len(ro.filterBatch) >= rescanFilterBatch {
+				if e = s.flushFilters(ro); E.Chk(e) {
+					return e
+				}
+			}
 		}
 	}
 }
@@ -554,9 +642,10 @@ func (s *ChainService) notifyBlock(
 	curHeader wire.BlockHeader, curStamp waddrmgr.BlockStamp,
 	scanning bool,
 ) (e error) {
+	s.rescanPositions.set(ro, curStamp.Height)
 	// Find relevant transactions based on watch list. If scanning is false, we can safely assume this block has no
 	// relevant transactions.
-	var relevantTxs []*util.Tx
+	var matches []TxMatch
 	if len(ro.watchList) != 0 && scanning {
 		// If we have a non-empty watch list, then we need to see if it matches the rescan's filters, so we get the
 		// basic filter from the DB or network.
@@ -565,18 +654,13 @@ func (s *ChainService) notifyBlock(
 			return e
 		}
 		if matched {
-			relevantTxs, e = s.extractBlockMatches(ro, &curStamp)
+			matches, e = s.extractBlockMatches(ro, &curStamp)
 			if e != nil {
 				return e
 			}
 		}
 	}
-	if ro.ntfn.OnFilteredBlockConnected != nil {
-		ro.ntfn.OnFilteredBlockConnected(
-			curStamp.Height, &curHeader,
-			relevantTxs,
-		)
-	}
+	ro.notifyFilteredBlock(curStamp.Height, &curHeader, matches)
 	if ro.ntfn.OnBlockConnected != nil {
 		ro.ntfn.OnBlockConnected(
 			&curStamp.Hash,
@@ -586,12 +670,29 @@ func (s *ChainService) notifyBlock(
 	return nil
 }
 
+// notifyFilteredBlock calls the handlers of filtered blocks with the relevant transactions of a block.
+func (ro *rescanOptions) notifyFilteredBlock(height int32, header *wire.BlockHeader, matches []TxMatch) {
+	if ro.ntfn.OnFilteredBlockConnected != nil {
+		var relevantTxs []*util.Tx
+		if matches != nil {
+			relevantTxs = make([]*util.Tx, len(matches))
+			for i := range matches {
+				relevantTxs[i] = matches[i].Tx
+			}
+		}
+		ro.ntfn.OnFilteredBlockConnected(height, header, relevantTxs)
+	}
+	if ro.onBlockMatches != nil {
+		ro.onBlockMatches(height, header, matches)
+	}
+}
+
 // extractBlockMatches fetches the target block from the network, and filters out any relevant transactions found within
-// the block.
+// the block along with the reasons they matched.
 func (s *ChainService) extractBlockMatches(
 	ro *rescanOptions,
 	curStamp *waddrmgr.BlockStamp,
-) ([]*util.Tx, error) {
+) ([]TxMatch, error) {
 	// We've matched. Now we actually get the block and cycle through the transactions to see which ones are relevant.
 	block, e := s.GetBlock(curStamp.Hash, ro.queryOptions...)
 	if e != nil {
@@ -609,35 +710,25 @@ func (s *ChainService) extractBlockMatches(
 		Hash:   block.Hash().String(),
 		Time:   blockHeader.Timestamp.Unix(),
 	}
-	relevantTxs := make([]*util.Tx, 0, len(block.Transactions()))
+	matches := make([]TxMatch, 0, len(block.Transactions()))
 	for txIdx, tx := range block.Transactions() {
 		txDetails := blockDetails
 		txDetails.Index = txIdx
-		var relevant bool
-		if ro.spendsWatchedInput(tx) {
-			relevant = true
-			if ro.ntfn.OnRedeemingTx != nil {
-				ro.ntfn.OnRedeemingTx(tx, &txDetails)
-			}
-		}
-		// Even though the transaction may already be known as relevant and there might
-		// not be a notification callback, we need to call paysWatchedAddr anyway as it
-		// updates the rescan options.
-		pays, e := ro.paysWatchedAddr(tx)
+		reasons, e := ro.matchTx(tx)
 		if e != nil {
 			return nil, e
 		}
-		if pays {
-			relevant = true
-			if ro.ntfn.OnRecvTx != nil {
-				ro.ntfn.OnRecvTx(tx, &txDetails)
-			}
+		if reasons&MatchSpend != 0 && ro.ntfn.OnRedeemingTx != nil {
+			ro.ntfn.OnRedeemingTx(tx, &txDetails)
 		}
-		if relevant {
-			relevantTxs = append(relevantTxs, tx)
+		if reasons&MatchReceive != 0 && ro.ntfn.OnRecvTx != nil {
+			ro.ntfn.OnRecvTx(tx, &txDetails)
+		}
+		if reasons != 0 {
+			matches = append(matches, TxMatch{Tx: tx, Reasons: reasons})
 		}
 	}
-	return relevantTxs, nil
+	return matches, nil
 }
 
 // notifyBlockWithFilter calls appropriate listeners based on the block filter.
@@ -649,9 +740,10 @@ func (s *ChainService) notifyBlockWithFilter(
 	curStamp *waddrmgr.BlockStamp,
 	filter *gcs.Filter,
 ) (e error) {
+	s.rescanPositions.set(ro, curStamp.Height)
 	// Based on what we find within the block or the filter, we'll be sending out a set of notifications with
 	// transactions that are relevant to the rescan.
-	var relevantTxs []*util.Tx
+	var matches []TxMatch
 	// If we actually have a filter, then we'll go ahead an attempt to match the items within the filter to ensure we
 	// create any relevant notifications.
 	if filter != nil {
@@ -660,18 +752,13 @@ func (s *ChainService) notifyBlockWithFilter(
 			return e
 		}
 		if matched {
-			relevantTxs, e = s.extractBlockMatches(ro, curStamp)
+			matches, e = s.extractBlockMatches(ro, curStamp)
 			if e != nil {
 				return e
 			}
 		}
 	}
-	if ro.ntfn.OnFilteredBlockConnected != nil {
-		ro.ntfn.OnFilteredBlockConnected(
-			curStamp.Height, curHeader,
-			relevantTxs,
-		)
-	}
+	ro.notifyFilteredBlock(curStamp.Height, curHeader, matches)
 	if ro.ntfn.OnBlockConnected != nil {
 		ro.ntfn.OnBlockConnected(
 			&curStamp.Hash,
@@ -691,7 +778,7 @@ func (s *ChainService) matchBlockFilter(
 	// Now that we have the filter as well as the block hash of the block used to construct the filter, we'll check to
 	// see if the block matches any items in our watch list.
 	key := builder.DeriveKey(blockHash)
-	matched, e := filter.MatchAny(key, ro.watchList)
+	matched, e := filter.MatchAnyWithScratch(key, ro.watchList, &ro.matchScratch)
 	if e != nil {
 		return false, e
 	}
@@ -706,7 +793,7 @@ func (s *ChainService) blockFilterMatches(
 ) (bool, error) {
 	// TODO(roasbeef): need to ENSURE always get filter
 	key := builder.DeriveKey(blockHash)
-	bFilter, e := s.GetCFilter(*blockHash, wire.GCSFilterRegular)
+	bFilter, e := s.GetCFilter(*blockHash, wire.GCSFilterRegular, ro.filterOptions()...)
 	if e != nil {
 		if e == headerfs.ErrHashNotFound {
 			// Block has been reorged out from under us.
@@ -719,7 +806,7 @@ func (s *ChainService) blockFilterMatches(
 	if bFilter != nil && bFilter.N() != 0 {
 		// We see if any relevant transactions match.
 		var matched bool
-		matched, e = bFilter.MatchAny(key, ro.watchList)
+		matched, e = bFilter.MatchAnyWithScratch(key, ro.watchList, &ro.matchScratch)
 		if matched || e != nil {
 			return matched, e
 		}
@@ -730,6 +817,69 @@ func (s *ChainService) blockFilterMatches(
 	return false, nil
 }
 
+// filterOptions returns the options of the filter queries of the rescan. Of the query options of the rescan only
+// PersistToDisk applies to them, and the filters it persists are collected in filterBatch to be written together.
+func (ro *rescanOptions) filterOptions(options ...QueryOption) []QueryOption {
+	qo := defaultQueryOptions()
+	qo.applyQueryOptions(ro.queryOptions...)
+	if qo.persistToDisk {
+		options = append(options, PersistToDisk(), batchFilters(&ro.filterBatch))
+	}
+	return options
+}
+
+// flushFilters writes the filters the rescan collected to persist to the filter database in one transaction.
+func (s *ChainService) flushFilters(ro *rescanOptions) (e error) {
+	if len(ro.filterBatch) == 0 {
+		return nil
+	}
+	e = s.FilterDB.PutFilters(ro.filterBatch)
+	ro.filterBatch = ro.filterBatch[:0]
+	return e
+}
+
+// prefetchFilters reads the stored filters of the blocks from the height up to rescanFilterBatch blocks ahead, and no
+// further than the best height, into the filter cache in one transaction, unless they were read already. The filters
+// are read up to the first block that has none stored, and the filters of the blocks from there are fetched on their
+// own as the rescan reaches them.
+func (s *ChainService) prefetchFilters(ro *rescanOptions, height, bestHeight int32) {
+	if height <= ro.prefetchedTo || s.FilterDB == nil {
+		return
+	}
+	endHeight := height + rescanFilterBatch - 1
+	if endHeight > bestHeight {
+		endHeight = bestHeight
+	}
+	ro.prefetchedTo = endHeight
+	stop, e := s.BlockHeaders.FetchHeaderByHeight(uint32(endHeight))
+	if E.Chk(e) {
+		return
+	}
+	stopHash := stop.BlockHash()
+	headers, _, e := s.BlockHeaders.FetchHeaderAncestors(uint32(endHeight-height), &stopHash)
+	if E.Chk(e) {
+		return
+	}
+	hashes := make([]*chainhash.Hash, len(headers))
+	for i := range headers {
+		blockHash := headers[i].BlockHash()
+		hashes[i] = &blockHash
+	}
+	filters, e := s.FilterDB.FetchFilters(hashes, filterdb.RegularFilter)
+	if e != nil && e != filterdb.ErrFilterNotFound {
+		E.Ln("couldn't read filters ahead of rescan:", e)
+		return
+	}
+	for i, filter := range filters {
+		if filter == nil {
+			continue
+		}
+		if e = s.putFilterToCache(hashes[i], filterdb.RegularFilter, filter); E.Chk(e) {
+			return
+		}
+	}
+}
+
 // hasFilterHeadersByHeight checks whether both the basic and extended filter headers for a particular height are known.
 func (s *ChainService) hasFilterHeadersByHeight(height uint32) bool {
 	_, regFetchErr := s.RegFilterHeaders.FetchHeaderByHeight(height)
@@ -743,6 +893,7 @@ func (ro *rescanOptions) updateFilter(
 ) (rewound bool, e error) {
 	ro.watchAddrs = append(ro.watchAddrs, update.addrs...)
 	ro.watchInputs = append(ro.watchInputs, update.inputs...)
+	ro.watchScripts = append(ro.watchScripts, update.scripts...)
 	for _, addr := range update.addrs {
 		script, e := txscript.PayToAddrScript(addr)
 		if e != nil {
@@ -753,6 +904,7 @@ func (ro *rescanOptions) updateFilter(
 	for _, input := range update.inputs {
 		ro.watchList = append(ro.watchList, input.PkScript)
 	}
+	ro.watchList = append(ro.watchList, update.scripts...)
 	for _, txid := range update.txIDs {
 		ro.watchList = append(ro.watchList, txid[:])
 	}
@@ -798,6 +950,24 @@ func (ro *rescanOptions) updateFilter(
 	return rewound, nil
 }
 
+// matchTx returns the reasons the transaction is relevant to the rescan, if any. Outputs paying to a watched address or
+// script are watched from then on.
+func (ro *rescanOptions) matchTx(tx *util.Tx) (reasons MatchReason, e error) {
+	if ro.spendsWatchedInput(tx) {
+		reasons |= MatchSpend
+	}
+	// Even though the transaction may already be known as relevant, we need to call paysWatchedAddr anyway as it
+	// updates the rescan options.
+	pays, e := ro.paysWatchedAddr(tx)
+	if e != nil {
+		return 0, e
+	}
+	if pays {
+		reasons |= MatchReceive
+	}
+	return reasons, nil
+}
+
 // spendsWatchedInput returns whether the transaction matches the filter by spending a watched input.
 func (ro *rescanOptions) spendsWatchedInput(tx *util.Tx) bool {
 	for _, in := range tx.MsgTx().TxIn {
@@ -810,44 +980,59 @@ func (ro *rescanOptions) spendsWatchedInput(tx *util.Tx) bool {
 	return false
 }
 
-// paysWatchedAddr returns whether the transaction matches the filter by having an output paying to a watched address.
-// If that is the case, this also updates the filter to watch the newly created output going forward.
+// paysWatchedAddr returns whether the transaction matches the filter by having an output paying to a watched address
+// or script. If that is the case, this also updates the filter to watch the newly created output going forward.
 func (ro *rescanOptions) paysWatchedAddr(tx *util.Tx) (bool, error) {
 	anyMatchingOutputs := false
-txOutLoop:
 	for outIdx, out := range tx.MsgTx().TxOut {
 		pkScript := out.PkScript
-		for _, addr := range ro.watchAddrs {
-			// We'll convert the address into its matching pkScript to in order to check for a match.
-			addrScript, e := txscript.PayToAddrScript(addr)
-			if e != nil {
-				return false, e
-			}
-			// If the script doesn't match, we'll move onto the next one.
-			if !bytes.Equal(pkScript, addrScript) {
-				continue
-			}
-			// At this state, we have a matching output so we'll mark this transaction as matching.
-			anyMatchingOutputs = true
-			// Update the filter by also watching this created outpoint for the event in the future that it's spent.
-			hash := tx.Hash()
-			outPoint := wire.OutPoint{
-				Hash:  *hash,
-				Index: uint32(outIdx),
-			}
-			ro.watchInputs = append(
-				ro.watchInputs, InputWithScript{
-					PkScript: pkScript,
-					OutPoint: outPoint,
-				},
-			)
-			ro.watchList = append(ro.watchList, pkScript)
-			continue txOutLoop
+		watched, e := ro.watchesScript(pkScript)
+		if e != nil {
+			return false, e
 		}
+		// If the script doesn't match, we'll move onto the next one.
+		if !watched {
+			continue
+		}
+		// At this state, we have a matching output so we'll mark this transaction as matching.
+		anyMatchingOutputs = true
+		// Update the filter by also watching this created outpoint for the event in the future that it's spent.
+		hash := tx.Hash()
+		outPoint := wire.OutPoint{
+			Hash:  *hash,
+			Index: uint32(outIdx),
+		}
+		ro.watchInputs = append(
+			ro.watchInputs, InputWithScript{
+				PkScript: pkScript,
+				OutPoint: outPoint,
+			},
+		)
+		ro.watchList = append(ro.watchList, pkScript)
 	}
 	return anyMatchingOutputs, nil
 }
 
+// watchesScript returns whether an output script is one of the watched scripts or pays to a watched address.
+func (ro *rescanOptions) watchesScript(pkScript []byte) (bool, error) {
+	for _, script := range ro.watchScripts {
+		if bytes.Equal(pkScript, script) {
+			return true, nil
+		}
+	}
+	for _, addr := range ro.watchAddrs {
+		// We'll convert the address into its matching pkScript to in order to check for a match.
+		addrScript, e := txscript.PayToAddrScript(addr)
+		if e != nil {
+			return false, e
+		}
+		if bytes.Equal(pkScript, addrScript) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // Rescan is an object that represents a long-running rescan/notification client with updateable filters. It's meant to
 // be close to a drop-in replacement for the btcd rescan and notification functionality used in wallets. It only
 // contains information about whether a goroutine is running.
@@ -862,6 +1047,31 @@ type Rescan struct {
 	wg         sync.WaitGroup
 }
 
+// acquireRescanSlot waits until fewer than Config.MaxConcurrentRescans rescans are running and takes a slot for another,
+// which the returned function frees the first time it is called. ErrRescanExit is returned if the rescan or the
+// ChainService quits while it waits.
+func (s *ChainService) acquireRescanSlot(quit qu.C) (release func(), e error) {
+	if s.rescanSlots == nil {
+		return func() {}, nil
+	}
+	atomic.AddInt32(&s.queuedRescans, 1)
+	defer atomic.AddInt32(&s.queuedRescans, -1)
+	select {
+	case s.rescanSlots <- struct{}{}:
+	case <-quit.Wait():
+		return nil, ErrRescanExit
+	case <-s.quit.Wait():
+		return nil, ErrRescanExit
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-s.rescanSlots }) }, nil
+}
+
+// QueuedRescans returns the number of rescans waiting for one of the Config.MaxConcurrentRescans slots to run in.
+func (s *ChainService) QueuedRescans() int {
+	return int(atomic.LoadInt32(&s.queuedRescans))
+}
+
 // NewRescan returns a rescan object that runs in another goroutine and has an updatable filter. It returns the
 // long-running rescan object, and a channel which returns any error on termination of the rescan process.
 func (s *ChainService) NewRescan(options ...RescanOption) *Rescan {
@@ -905,6 +1115,7 @@ func (r *Rescan) Start() <-chan error {
 type updateOptions struct {
 	addrs                    []btcaddr.Address
 	inputs                   []InputWithScript
+	scripts                  [][]byte
 	txIDs                    []chainhash.Hash
 	rewind                   uint32
 	disableDisconnectedNtfns bool
@@ -931,6 +1142,13 @@ func AddInputs(inputs ...InputWithScript) UpdateOption {
 	}
 }
 
+// AddScripts adds raw output scripts to watch to the filter.
+func AddScripts(scripts ...[]byte) UpdateOption {
+	return func(uo *updateOptions) {
+		uo.scripts = append(uo.scripts, scripts...)
+	}
+}
+
 // Rewind rewinds the rescan to the specified height (meaning, disconnects down to the block immediately after the
 // specified height) and restarts it from that point with the (possibly) newly expanded filter. Especially useful when
 // called in the same Update() as one of the previous three options.
@@ -1035,6 +1253,12 @@ func (s *ChainService) GetUtxo(options ...RescanOption) (*SpendReport, error) {
 	return report, nil
 }
 
+// ClearUtxoScanCheckpoints deletes the saved progress of interrupted GetUtxo scans, so that the next GetUtxo call for
+// any outpoint scans from its start block.
+func (s *ChainService) ClearUtxoScanCheckpoints() (e error) {
+	return s.utxoScanner.ClearCheckpoints()
+}
+
 // getReorgTip gets a block header from the chain service's cache. This is only required until the block subscription
 // API is factored out into its own package.
 //
@@ -1042,5 +1266,5 @@ func (s *ChainService) GetUtxo(options ...RescanOption) (*SpendReport, error) {
 func (s *ChainService) getReorgTip(hash chainhash.Hash) *wire.BlockHeader {
 	s.mtxReorgHeader.RLock()
 	defer s.mtxReorgHeader.RUnlock()
-	return s.reorgedBlockHeaders[hash]
+	return s.reorgedBlockHeaders[hash].header
 }
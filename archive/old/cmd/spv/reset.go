@@ -0,0 +1,138 @@
+package spv
+
+import (
+	"container/list"
+	
+	"github.com/p9c/pod/cmd/spv/headerlist"
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// resetMsg asks the block handler to reset the chain state to a height, and takes the result of the reset.
+type resetMsg struct {
+	height uint32
+	reply  chan error
+}
+
+// ResetChainState is a recovery path for corrupted stores and reorgs deeper than the client can follow. It stops the
+// header sync, rolls the block and filter header stores back to toHeight, or to the oldest header held if toHeight is
+// negative or lower, clears the block and filter caches and the reorg state, and starts syncing again from the new tip.
+// Disconnected notifications are sent for the blocks that are rolled back.
+//
+// ErrRescanRunning is returned while a rescan is running, and rescans can't start until the reset is done.
+func (s *ChainService) ResetChainState(toHeight int32) (e error) {
+	s.mtxReset.Lock()
+	switch {
+	case s.resetting:
+		e = ErrResetRunning
+	case s.rescansRunning > 0:
+		e = ErrRescanRunning
+	default:
+		s.resetting = true
+	}
+	s.mtxReset.Unlock()
+	if e != nil {
+		return e
+	}
+	defer func() {
+		s.mtxReset.Lock()
+		s.resetting = false
+		s.mtxReset.Unlock()
+	}()
+	var height uint32
+	if toHeight > 0 {
+		height = uint32(toHeight)
+	}
+	if start := s.RegFilterHeaders.StartHeight(); height < start {
+		height = start
+	}
+	reply := make(chan error, 1)
+	select {
+	case s.blockManager.peerChan <- &resetMsg{height: height, reply: reply}:
+	case <-s.quit.Wait():
+		return ErrShuttingDown
+	}
+	select {
+	case e = <-reply:
+		return e
+	case <-s.quit.Wait():
+		return ErrShuttingDown
+	}
+}
+
+// beginRescan counts a rescan as running until the returned function is called. ErrResetRunning is returned while the
+// chain state is being reset.
+func (s *ChainService) beginRescan() (done func(), e error) {
+	s.mtxReset.Lock()
+	defer s.mtxReset.Unlock()
+	if s.resetting {
+		return nil, ErrResetRunning
+	}
+	s.rescansRunning++
+	return func() {
+		s.mtxReset.Lock()
+		s.rescansRunning--
+		s.mtxReset.Unlock()
+	}, nil
+}
+
+// handleResetMsg rolls the chain state back to height and starts syncing from there. It is invoked from the
+// blockHandler goroutine, so no headers are taken from peers while it runs.
+func (b *blockManager) handleResetMsg(peers *list.List, height uint32) (e error) {
+	I.Ln("resetting the chain state to height", height)
+	// Forget the sync peer so that startSync picks one again, which asks it for the headers after the new tip.
+	b.syncPeerMutex.Lock()
+	b.syncPeer = nil
+	b.syncPeerMutex.Unlock()
+	b.lastRequested = chainhash.Hash{}
+	// The reorg headers are cleared first, as the rollback stores the headers the disconnected notifications need.
+	b.server.mtxReorgHeader.Lock()
+	b.server.reorgedBlockHeaders = make(map[chainhash.Hash]reorgHeader)
+	b.server.mtxReorgHeader.Unlock()
+	if b.server.BlockCache != nil {
+		b.server.BlockCache.Purge()
+	}
+	if b.server.FilterCache != nil {
+		b.server.FilterCache.Purge()
+	}
+	bs, e := b.server.rollBackToHeight(height)
+	if E.Chk(e) {
+		return e
+	}
+	header, _, e := b.server.BlockHeaders.FetchHeader(&bs.Hash)
+	if E.Chk(e) {
+		return e
+	}
+	b.headerList.ResetHeaderState(
+		headerlist.Node{
+			Header: *header,
+			Height: bs.Height,
+		},
+	)
+	b.nextCheckpoint = b.findNextHeaderCheckpoint(bs.Height)
+	b.newHeadersMtx.Lock()
+	b.headerTip = uint32(bs.Height)
+	b.headerTipHash = bs.Hash
+	b.newHeadersMtx.Unlock()
+	b.newHeadersSignal.Broadcast()
+	_, filterTip, e := b.server.RegFilterHeaders.ChainTip()
+	if E.Chk(e) {
+		return e
+	}
+	b.newFilterHeadersMtx.Lock()
+	if b.filterHeaderTip > filterTip {
+		var filterHeader *wire.BlockHeader
+		if filterHeader, e = b.server.BlockHeaders.FetchHeaderByHeight(filterTip); !E.Chk(e) {
+			b.filterHeaderTip = filterTip
+			b.filterHeaderTipHash = filterHeader.BlockHash()
+		}
+	}
+	b.newFilterHeadersMtx.Unlock()
+	b.syncRate.reset()
+	if e != nil {
+		return e
+	}
+	b.newFilterHeadersSignal.Broadcast()
+	b.startSync(peers)
+	return nil
+}
@@ -0,0 +1,166 @@
+package spv
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	
+	"github.com/p9c/pod/pkg/amt"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// SendQueuePolicy is what is done with a message queued to a peer whose send queue is full.
+type SendQueuePolicy uint8
+
+const (
+	// SendQueueDropOldest drops the oldest message waiting in the queue to make room for the new one.
+	SendQueueDropOldest SendQueuePolicy = iota
+	// SendQueueDisconnect drops the new message and disconnects the peer, which can't keep up.
+	SendQueueDisconnect
+)
+
+// queuedMsg is a message waiting in the send queue of a peer.
+type queuedMsg struct {
+	msg      wire.Message
+	encoding wire.MessageEncoding
+	doneChan chan<- struct{}
+	// feeRate is the fee per kB of the transaction the message announces, when it was queued with queueAnnouncement.
+	feeRate amt.Amount
+}
+
+// sendQueue holds the messages queued to a peer by the client, which are passed to the peer one at a time as the
+// previous one is sent so that the messages a peer that can't keep up is sent are held where they can be counted and
+// bounded.
+type sendQueue struct {
+	mtx  sync.Mutex
+	msgs list.List
+	// sending is set while a message was passed to the peer and not yet sent.
+	sending bool
+}
+
+// QueueMessage adds the message to the send queue of the peer. This function is safe for concurrent access.
+func (sp *ServerPeer) QueueMessage(msg wire.Message, doneChan chan<- struct{}) {
+	sp.QueueMessageWithEncoding(msg, doneChan, wire.BaseEncoding)
+}
+
+// QueueMessageWithEncoding adds the message to the send queue of the peer, to be encoded with the given wire encoding.
+// When the queue is already holding Config.PeerSendQueueSize messages, the oldest is dropped or the peer is
+// disconnected as Config.PeerSendQueuePolicy says, and the done channel of a dropped message is signalled as for a
+// message queued to a peer that is disconnected. This function is safe for concurrent access.
+func (sp *ServerPeer) QueueMessageWithEncoding(
+	msg wire.Message, doneChan chan<- struct{},
+	encoding wire.MessageEncoding,
+) {
+	sp.queueMsg(queuedMsg{msg: msg, encoding: encoding, doneChan: doneChan})
+}
+
+// queueAnnouncement queues the announcement of a transaction paying feeRate per kB to the peer, unless the peer asked
+// with a feefilter message not to be sent transactions paying less. Announcements left queued when the peer raises its
+// fee filter above their fee rate are dropped. A fee rate of zero means it isn't known, and the announcement is queued
+// whatever the fee filter. When Config.PeerAnnouncementLimit is set, announcements past the limit are held back.
+func (sp *ServerPeer) queueAnnouncement(msg wire.Message, encoding wire.MessageEncoding, feeRate amt.Amount) {
+	if feeFilter := amt.Amount(atomic.LoadInt64(&sp.feeFilter)); feeRate > 0 && feeRate < feeFilter {
+		T.F("not announcing a transaction paying %v per kB to %s, whose fee filter is %v", feeRate, sp, feeFilter)
+		return
+	}
+	m := queuedMsg{msg: msg, encoding: encoding, feeRate: feeRate}
+	if sp.server.peerAnnouncementLimit > 0 {
+		sp.limitAnnouncement(m)
+		return
+	}
+	sp.queueMsg(m)
+}
+
+// queueMsg adds the message to the send queue of the peer as QueueMessageWithEncoding describes.
+func (sp *ServerPeer) queueMsg(m queuedMsg) {
+	msg, doneChan, encoding := m.msg, m.doneChan, m.encoding
+	if !sp.Connected() {
+		sp.Peer.QueueMessageWithEncoding(msg, doneChan, encoding)
+		return
+	}
+	q := &sp.sendQueue
+	q.mtx.Lock()
+	if size := sp.server.peerSendQueueSize; size > 0 && q.msgs.Len() >= size {
+		if sp.server.peerSendQueuePolicy == SendQueueDisconnect {
+			q.mtx.Unlock()
+			W.F("peer %s can't keep up with %d queued messages -- disconnecting", sp, size)
+			signalQueued(doneChan)
+			sp.Disconnect()
+			return
+		}
+		D.F("send queue of peer %s is full -- dropping the oldest message", sp)
+		signalQueued(q.msgs.Remove(q.msgs.Front()).(queuedMsg).doneChan)
+	}
+	q.msgs.PushBack(m)
+	start := !q.sending
+	q.sending = true
+	q.mtx.Unlock()
+	if start {
+		go sp.sendQueueHandler()
+	}
+}
+
+// dropAnnouncementsBelow drops the queued and held transaction announcements paying less than feeFilter per kB, which
+// the peer no longer wants to be sent, and returns how many were dropped. An announcement already passed to the peer is
+// sent.
+func (sp *ServerPeer) dropAnnouncementsBelow(feeFilter amt.Amount) (dropped int) {
+	dropped = sp.dropHeldAnnouncementsBelow(feeFilter)
+	q := &sp.sendQueue
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for e := q.msgs.Front(); e != nil; {
+		next := e.Next()
+		if m := e.Value.(queuedMsg); m.feeRate > 0 && m.feeRate < feeFilter {
+			q.msgs.Remove(e)
+			signalQueued(m.doneChan)
+			dropped++
+		}
+		e = next
+	}
+	return dropped
+}
+
+// SendQueueDepth returns the number of messages queued to the peer by the client that weren't sent yet.
+func (sp *ServerPeer) SendQueueDepth() int {
+	q := &sp.sendQueue
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	depth := q.msgs.Len()
+	if q.sending {
+		depth++
+	}
+	return depth
+}
+
+// sendQueueHandler passes the queued messages to the peer one at a time, waiting for each to be sent, until the queue
+// is empty. Once the peer is gone the messages left are dropped.
+func (sp *ServerPeer) sendQueueHandler() {
+	q := &sp.sendQueue
+	done := make(chan struct{}, 1)
+	for {
+		q.mtx.Lock()
+		front := q.msgs.Front()
+		if front == nil {
+			q.sending = false
+			q.mtx.Unlock()
+			return
+		}
+		m := q.msgs.Remove(front).(queuedMsg)
+		q.mtx.Unlock()
+		sp.Peer.QueueMessageWithEncoding(m.msg, done, m.encoding)
+		select {
+		case <-done:
+		case <-sp.quit.Wait():
+		}
+		signalQueued(m.doneChan)
+	}
+}
+
+// signalQueued signals the done channel of a queued message, if it has one, without blocking the caller.
+func signalQueued(doneChan chan<- struct{}) {
+	if doneChan != nil {
+		go func() {
+			doneChan <- struct{}{}
+		}()
+	}
+}
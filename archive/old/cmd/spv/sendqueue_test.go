@@ -0,0 +1,146 @@
+package spv
+
+import (
+	"io"
+	"testing"
+	"time"
+	
+	"github.com/p9c/pod/pkg/amt"
+	"github.com/p9c/pod/pkg/chaincfg"
+	"github.com/p9c/pod/pkg/peer"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// stuckServerPeer returns a server peer of a chain service with the given send queue bounds, connected to a remote end
+// that never reads, so that nothing queued to it is sent.
+func stuckServerPeer(t *testing.T, size int, policy SendQueuePolicy) *ServerPeer {
+	s := &ChainService{
+		chainParams:         chaincfg.SimNetParams,
+		peerSendQueueSize:   size,
+		peerSendQueuePolicy: policy,
+	}
+	sp := newServerPeer(s, false)
+	p, e := peer.NewOutboundPeer(&peer.Config{ChainParams: &s.chainParams}, "10.0.0.2:11047")
+	if e != nil {
+		t.Fatal(e)
+	}
+	sp.Peer = p
+	r, _ := io.Pipe()
+	_, w := io.Pipe()
+	p.AssociateConnection(pipeConn{Reader: r, WriteCloser: w, addr: "10.0.0.1:11047"})
+	return sp
+}
+
+// queuePing queues a ping to the peer and returns the done channel it signals, waiting until the ping was passed on to
+// the peer when wait is set.
+func queuePing(t *testing.T, sp *ServerPeer, wait bool) chan struct{} {
+	done := make(chan struct{}, 1)
+	sp.QueueMessage(wire.NewMsgPing(0), done)
+	for deadline := time.Now().Add(time.Second); wait; time.Sleep(time.Millisecond) {
+		sp.sendQueue.mtx.Lock()
+		wait = sp.sendQueue.msgs.Len() != 0
+		sp.sendQueue.mtx.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatal("queued message wasn't passed on to the peer")
+		}
+	}
+	return done
+}
+
+// TestSendQueue checks that the send queue of a peer that doesn't keep up drops its oldest message or disconnects the
+// peer when it is full, by the policy, and signals the done channels of the dropped messages.
+func TestSendQueue(t *testing.T) {
+	sp := stuckServerPeer(t, 2, SendQueueDropOldest)
+	defer sp.quit.Q()
+	sent := queuePing(t, sp, true)
+	dropped := queuePing(t, sp, false)
+	queuePing(t, sp, false)
+	queuePing(t, sp, false)
+	if depth := sp.SendQueueDepth(); depth != 3 {
+		t.Fatalf("send queue depth is %d, want 3", depth)
+	}
+	select {
+	case <-dropped:
+	case <-time.After(time.Second):
+		t.Fatal("the done channel of the dropped message wasn't signalled")
+	}
+	select {
+	case <-sent:
+		t.Fatal("the done channel of the unsent message was signalled")
+	default:
+	}
+	if !sp.Connected() {
+		t.Fatal("peer was disconnected when its oldest message was dropped")
+	}
+	sp = stuckServerPeer(t, 1, SendQueueDisconnect)
+	defer sp.quit.Q()
+	queuePing(t, sp, true)
+	queuePing(t, sp, false)
+	dropped = queuePing(t, sp, false)
+	if sp.Connected() {
+		t.Fatal("peer with a full send queue wasn't disconnected")
+	}
+	select {
+	case <-dropped:
+	case <-time.After(time.Second):
+		t.Fatal("the done channel of the dropped message wasn't signalled")
+	}
+}
+
+// TestFeeFilterDropsAnnouncements checks that transaction announcements below the fee filter of a peer aren't queued,
+// and that those queued are dropped once the peer raises its fee filter above them.
+func TestFeeFilterDropsAnnouncements(t *testing.T) {
+	sp := stuckServerPeer(t, 0, SendQueueDropOldest)
+	defer sp.quit.Q()
+	queuePing(t, sp, true)
+	sp.OnFeeFilter(nil, wire.NewMsgFeeFilter(1000))
+	for _, feeRate := range []amt.Amount{500, 1000, 2000, 5000} {
+		sp.queueAnnouncement(wire.NewMsgInv(), wire.BaseEncoding, feeRate)
+	}
+	ping := queuePing(t, sp, false)
+	// The first ping is being sent, and the three announcements passing the filter and the second ping wait.
+	if depth := sp.SendQueueDepth(); depth != 5 {
+		t.Fatalf("send queue depth is %d, want 5", depth)
+	}
+	sp.OnFeeFilter(nil, wire.NewMsgFeeFilter(3000))
+	if depth := sp.SendQueueDepth(); depth != 3 {
+		t.Fatalf("send queue depth is %d after the fee filter was raised, want 3", depth)
+	}
+	select {
+	case <-ping:
+		t.Fatal("the ping was dropped along with the announcements")
+	default:
+	}
+}
+
+// TestAnnouncementLimit checks that transaction announcements past the limit of an interval are held and released in
+// later intervals, and that those past the bound of the held ones are dropped and counted.
+func TestAnnouncementLimit(t *testing.T) {
+	sp := stuckServerPeer(t, 0, SendQueueDropOldest)
+	defer sp.quit.Q()
+	sp.server.peerAnnouncementLimit = 2
+	sp.server.peerAnnouncementInterval = time.Millisecond * 200
+	sp.server.peerAnnouncementQueueSize = 3
+	queuePing(t, sp, true)
+	for i := 0; i < 6; i++ {
+		sp.queueAnnouncement(wire.NewMsgInv(), wire.BaseEncoding, 0)
+	}
+	// The ping is being sent, and two announcements wait behind it.
+	if depth, held := sp.SendQueueDepth(), sp.AnnouncementQueueDepth(); depth != 3 || held != 3 {
+		t.Fatalf("send queue depth is %d with %d announcements held, want 3 and 3", depth, held)
+	}
+	if dropped := sp.DroppedAnnouncements(); dropped != 1 || sp.server.DroppedAnnouncements() != 1 {
+		t.Fatalf("%d announcements were dropped, want 1", dropped)
+	}
+	// The held announcements are released two at a time as the intervals pass.
+	for _, want := range []int{1, 0} {
+		for deadline := time.Now().Add(time.Second); sp.AnnouncementQueueDepth() != want; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d announcements are held, want %d", sp.AnnouncementQueueDepth(), want)
+			}
+		}
+	}
+	if depth := sp.SendQueueDepth(); depth != 6 {
+		t.Fatalf("send queue depth is %d after the held announcements were released, want 6", depth)
+	}
+}
@@ -0,0 +1,169 @@
+package spv
+
+import (
+	"fmt"
+	
+	"github.com/p9c/pod/cmd/spv/filterdb"
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/gcs"
+	"github.com/p9c/pod/pkg/gcs/builder"
+	"github.com/p9c/pod/pkg/peer"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// blockHashRange returns the hashes of the blocks from startHeight up to and including the block with the stop hash,
+// which must not be more than maxResults blocks.
+func (s *ChainService) blockHashRange(
+	startHeight uint32, stopHash *chainhash.Hash,
+	maxResults uint32,
+) ([]chainhash.Hash, error) {
+	stopHeight, e := s.BlockHeaders.HeightFromHash(stopHash)
+	if e != nil {
+		return nil, e
+	}
+	if startHeight > stopHeight {
+		return nil, fmt.Errorf("start height %d is above stop height %d", startHeight, stopHeight)
+	}
+	if stopHeight-startHeight >= maxResults {
+		return nil, fmt.Errorf(
+			"range of %d blocks is more than the maximum of %d",
+			stopHeight-startHeight+1, maxResults,
+		)
+	}
+	headers, _, e := s.BlockHeaders.FetchHeaderAncestors(stopHeight-startHeight, stopHash)
+	if e != nil {
+		return nil, e
+	}
+	hashes := make([]chainhash.Hash, len(headers))
+	for i := range headers {
+		hashes[i] = headers[i].BlockHash()
+	}
+	return hashes, nil
+}
+
+// fetchStoredFilters reads the regular filters of the blocks from the filter database in one transaction, failing if
+// any of them isn't stored.
+func (s *ChainService) fetchStoredFilters(hashes []chainhash.Hash) ([]*gcs.Filter, error) {
+	hashPtrs := make([]*chainhash.Hash, len(hashes))
+	for i := range hashes {
+		hashPtrs[i] = &hashes[i]
+	}
+	filters, e := s.FilterDB.FetchFilters(hashPtrs, filterdb.RegularFilter)
+	if e != nil {
+		if e == filterdb.ErrFilterNotFound {
+			return nil, fmt.Errorf("no cfilter for %v", hashes[len(filters)])
+		}
+		return nil, e
+	}
+	for i, filter := range filters {
+		if filter == nil {
+			return nil, fmt.Errorf("no cfilter for %v", hashes[i])
+		}
+	}
+	return filters, nil
+}
+
+// OnGetCFilters is invoked when a peer receives a getcfilters bitcoin message. The filters are answered from those
+// stored in the filter database, so only the filters that were persisted can be served.
+func (sp *ServerPeer) OnGetCFilters(_ *peer.Peer, msg *wire.MsgGetCFilters) {
+	// Ignore getcfilters requests if not in sync.
+	if !sp.server.blockManager.IsFullySynced() {
+		return
+	}
+	if msg.FilterType != wire.GCSFilterRegular {
+		D.Ln("filter request for unknown filter:", msg.FilterType)
+		return
+	}
+	hashes, e := sp.server.blockHashRange(msg.StartHeight, &msg.StopHash, wire.MaxGetCFiltersReqRange)
+	if e != nil {
+		D.Ln("invalid getcfilters request:", e)
+		return
+	}
+	filters, e := sp.server.fetchStoredFilters(hashes)
+	if e != nil {
+		D.Ln("could not obtain cfilters:", e)
+		return
+	}
+	for i, filter := range filters {
+		filterBytes, e := filter.NBytes()
+		if E.Chk(e) {
+			return
+		}
+		sp.QueueMessage(wire.NewMsgCFilter(msg.FilterType, &hashes[i], filterBytes), nil)
+	}
+}
+
+// OnGetCFHeaders is invoked when a peer receives a getcfheaders bitcoin message. The previous filter header comes from
+// the filter header store, and the filter hashes from the filters stored in the filter database.
+func (sp *ServerPeer) OnGetCFHeaders(_ *peer.Peer, msg *wire.MsgGetCFHeaders) {
+	// Ignore getcfheaders requests if not in sync.
+	if !sp.server.blockManager.IsFullySynced() {
+		return
+	}
+	if msg.FilterType != wire.GCSFilterRegular {
+		D.Ln("filter request for unknown headers for filter:", msg.FilterType)
+		return
+	}
+	hashes, e := sp.server.blockHashRange(msg.StartHeight, &msg.StopHash, wire.MaxCFHeadersPerMsg)
+	if e != nil {
+		D.Ln("invalid getcfheaders request:", e)
+		return
+	}
+	headersMsg := wire.NewMsgCFHeaders()
+	headersMsg.FilterType = msg.FilterType
+	headersMsg.StopHash = msg.StopHash
+	// The genesis block has no previous filter header, which is left as the zero hash.
+	if msg.StartHeight > 0 {
+		prevHeader, e := sp.server.RegFilterHeaders.FetchHeaderByHeight(msg.StartHeight - 1)
+		if E.Chk(e) {
+			return
+		}
+		headersMsg.PrevFilterHeader = *prevHeader
+	}
+	filters, e := sp.server.fetchStoredFilters(hashes)
+	if e != nil {
+		D.Ln("could not obtain cfilters:", e)
+		return
+	}
+	for _, filter := range filters {
+		filterHash, e := builder.GetFilterHash(filter)
+		if E.Chk(e) {
+			return
+		}
+		if e = headersMsg.AddCFHash(&filterHash); E.Chk(e) {
+			return
+		}
+	}
+	sp.QueueMessage(headersMsg, nil)
+}
+
+// OnGetCFCheckpt is invoked when a peer receives a getcfcheckpt bitcoin message, which is answered from the filter
+// header store.
+func (sp *ServerPeer) OnGetCFCheckpt(_ *peer.Peer, msg *wire.MsgGetCFCheckpt) {
+	// Ignore getcfcheckpt requests if not in sync.
+	if !sp.server.blockManager.IsFullySynced() {
+		return
+	}
+	if msg.FilterType != wire.GCSFilterRegular {
+		D.Ln("filter request for unknown checkpoints for filter:", msg.FilterType)
+		return
+	}
+	stopHeight, e := sp.server.BlockHeaders.HeightFromHash(&msg.StopHash)
+	if e != nil {
+		D.Ln("invalid getcfcheckpt request:", e)
+		return
+	}
+	checkptMsg := wire.NewMsgCFCheckpt(
+		msg.FilterType, &msg.StopHash, int(stopHeight/wire.CFCheckptInterval),
+	)
+	for height := uint32(wire.CFCheckptInterval); height <= stopHeight; height += wire.CFCheckptInterval {
+		header, e := sp.server.RegFilterHeaders.FetchHeaderByHeight(height)
+		if E.Chk(e) {
+			return
+		}
+		if e = checkptMsg.AddCFHeader(header); E.Chk(e) {
+			return
+		}
+	}
+	sp.QueueMessage(checkptMsg, nil)
+}
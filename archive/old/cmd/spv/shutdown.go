@@ -0,0 +1,158 @@
+package spv
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	
+	"github.com/p9c/pod/cmd/spv/headerfs"
+)
+
+// StopWithTimeout shuts down the ChainService like Stop, but waits at most d for its goroutines to exit. Peers are
+// disconnected first, and then the connection manager, UTXO scanner, block manager and address manager are stopped in
+// that order. If the goroutines haven't exited by the deadline, the components peerHandler hasn't stopped are stopped in
+// the same order without waiting for them, the header stores aren't checkpointed, as a goroutine that is stuck could be
+// holding them, and an error naming the components that didn't stop and the goroutines still running is returned. A
+// timeout of zero waits for as long as it takes.
+func (s *ChainService) StopWithTimeout(d time.Duration) (e error) {
+	// Make sure this only happens once.
+	if atomic.AddInt32(&s.shutdown, 1) != 1 {
+		return nil
+	}
+	// Signal the remaining goroutines to quit.
+	s.quit.Q()
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+	var timeout <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-stopped:
+		// Nothing writes to the header stores any more, so what they hold is checkpointed as it is, and the writes they
+		// batch are committed and the batch let go of.
+		e = s.Checkpoint()
+		if closeErr := headerfs.CloseBatch(s.db); e == nil {
+			e = closeErr
+		}
+		return e
+	case <-timeout:
+	}
+	e = fmt.Errorf(
+		"chain service didn't stop within %v, %s; goroutines still running: %s", d, s.componentSummary(),
+		goroutineSummary(),
+	)
+	E.Ln(e)
+	// peerHandler may be stuck before it got to stopping the components, which aren't waited for here as they could be
+	// stuck themselves.
+	go s.stopComponents()
+	return e
+}
+
+// componentNames are the names of the components peerHandler starts, in the order stopComponents stops them.
+var componentNames = []string{"connection manager", "utxo scanner", "block manager", "address manager"}
+
+// stopComponents stops the connection manager, UTXO scanner, block manager and address manager in that order, once.
+// Components that haven't been created are skipped.
+func (s *ChainService) stopComponents() {
+	s.stopComponentsOnce.Do(
+		func() {
+			stops := []func() error{
+				func() (e error) {
+					if s.connManager != nil {
+						s.connManager.Stop()
+					}
+					return nil
+				},
+				func() (e error) {
+					if s.utxoScanner != nil {
+						e = s.utxoScanner.Stop()
+					}
+					return
+				},
+				func() (e error) {
+					if s.blockManager != nil {
+						e = s.blockManager.Stop()
+					}
+					return
+				},
+				func() (e error) {
+					if s.addrManager != nil {
+						e = s.addrManager.Stop()
+					}
+					return
+				},
+			}
+			for _, stop := range stops {
+				if e := stop(); e != nil {
+					D.Ln(e)
+				}
+				atomic.AddInt32(&s.stoppedComponents, 1)
+			}
+		},
+	)
+}
+
+// componentSummary lists the components that stopComponents has stopped and those it hasn't.
+func (s *ChainService) componentSummary() string {
+	n := int(atomic.LoadInt32(&s.stoppedComponents))
+	if n == len(componentNames) {
+		return "all components stopped"
+	}
+	if n == 0 {
+		return "no components stopped"
+	}
+	return fmt.Sprintf(
+		"stopped %s but not %s", strings.Join(componentNames[:n], ", "), strings.Join(componentNames[n:], ", "),
+	)
+}
+
+// stopWaiter is the function StopWithTimeout waits for the goroutines of the ChainService to exit in.
+const stopWaiter = "cmd/spv.(*ChainService).StopWithTimeout.func"
+
+// goroutineSummary counts the running goroutines by the first function of this module they are in, which for stuck
+// goroutines is usually the one that is waiting. The calling goroutine and the one StopWithTimeout waits in are left
+// out.
+func goroutineSummary() string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+	counts := make(map[string]int)
+	// The stack of the calling goroutine comes first.
+	for _, stack := range bytes.Split(buf, []byte("\n\n"))[1:] {
+		for _, line := range strings.Split(string(stack), "\n") {
+			if !strings.HasPrefix(line, "github.com/p9c/pod/") {
+				continue
+			}
+			// The function is followed by its arguments.
+			if i := strings.LastIndex(line, "("); i > 0 {
+				line = line[:i]
+			}
+			if f := strings.TrimPrefix(line, "github.com/p9c/pod/"); !strings.HasPrefix(f, stopWaiter) {
+				counts[f]++
+			}
+			break
+		}
+	}
+	funcs := make([]string, 0, len(counts))
+	for f, count := range counts {
+		funcs = append(funcs, fmt.Sprintf("%s x%d", f, count))
+	}
+	sort.Strings(funcs)
+	return strings.Join(funcs, ", ")
+}
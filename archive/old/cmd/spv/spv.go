@@ -1,10 +1,12 @@
 package spv
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"github.com/p9c/pod/pkg/amt"
+	"io"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -33,12 +35,101 @@ type (
 		// 32-bit systems.
 		bytesReceived    uint64 // Total bytes received from all peers since start.
 		bytesSent        uint64 // Total bytes sent by all peers since start.
+		addrExhaustions  uint64 // Number of times the address manager ran out of addresses.
+		droppedAnnounces uint64 // Number of transaction announcements dropped as too many were held for a peer.
 		started          int32
 		shutdown         int32
+		pendingQueries   int32 // Number of network queries in progress.
+		queuedRescans    int32 // Number of rescans waiting for a slot to run in.
 		FilterDB         filterdb.FilterDatabase
 		BlockHeaders     headerfs.BlockHeaderStore
 		RegFilterHeaders *headerfs.FilterHeaderStore
 		FilterCache      *lru.Cache
+		// db is the database the header indexes and the checkpoint of the verified tip are kept in.
+		db walletdb.DB
+		// syncFilterTypes is the ordered set of filter types being synced, always starting with the regular type.
+		syncFilterTypes []wire.FilterType
+		// filterHeaders holds the filter header store of each of the filter types being synced.
+		filterHeaders map[wire.FilterType]*headerfs.FilterHeaderStore
+		// startHeight is the height of the anchor header the header stores were started from, below which no blocks or
+		// filters are downloaded.
+		startHeight uint32
+		// filterRequestTimeout and blockRequestTimeout, if they are set, are how long a peer has to deliver a requested
+		// filter or block, and filterQueryTimeout how long it has to answer the filter queries of the block manager.
+		filterRequestTimeout time.Duration
+		blockRequestTimeout  time.Duration
+		filterQueryTimeout   time.Duration
+		// filterSlots and blockSlots hold a token for each filter or block being fetched from the network, when the
+		// fetches are limited.
+		filterSlots chan struct{}
+		blockSlots  chan struct{}
+		// banThreshold is the ban score above which a peer is banned.
+		banThreshold uint32
+		// blockFetches lets concurrent fetches of the same block share a single download.
+		blockFetches blockFetches
+		// serveFilters is set when compact filter requests from peers are answered.
+		serveFilters bool
+		// sendHeaders is set when peers are asked to announce new blocks with their headers.
+		sendHeaders bool
+		// peerSendQueueSize and peerSendQueuePolicy bound the messages waiting in the send queue of each peer.
+		peerSendQueueSize   int
+		peerSendQueuePolicy SendQueuePolicy
+		// peerAnnouncementLimit, peerAnnouncementInterval and peerAnnouncementQueueSize bound the rate of the
+		// transaction announcements sent to each peer.
+		peerAnnouncementLimit     int
+		peerAnnouncementInterval  time.Duration
+		peerAnnouncementQueueSize int
+		// assumeValidBelowCheckpoint is set when headers up to the last checkpoint are accepted unchecked.
+		assumeValidBelowCheckpoint bool
+		// onUnknownMessage is called with the messages peers send with commands the client doesn't support.
+		onUnknownMessage func(sp *ServerPeer, cmd string, payload []byte)
+		// blockCachePruneDepth is the depth below the best header past which blocks are pruned from the block cache,
+		// and rescanPositions holds the heights of the running rescans, whose blocks are kept.
+		blockCachePruneDepth uint32
+		rescanPositions      rescanPositions
+		// onAddressExhaustion is called when the address manager runs out of addresses for outbound connections.
+		onAddressExhaustion func()
+		// throughput holds the rates of the traffic with peers as of the last sample, which are passed to
+		// onThroughput each time they are sampled.
+		throughput   throughput
+		onThroughput func(recvBps, sendBps float64)
+		// addrBackoff delays asking the address manager for addresses again after it has run out.
+		addrBackoff addressBackoff
+		// minPeerDiversity is the fewest network groups the connected peers can be from before onLowPeerDiversity is
+		// called, or zero if peer diversity isn't checked.
+		minPeerDiversity   int
+		onLowPeerDiversity func(groups, peers int)
+		diversifyPeers     bool
+		// lowPeerDiversity is set while the connected peers are from too few network groups. It is only used by the
+		// peerHandler goroutine.
+		lowPeerDiversity bool
+		// addressASN returns the autonomous system an IP address is in, which groups the outbound peers in place of
+		// their network group when it is set.
+		addressASN func(ip net.IP) (uint32, bool)
+		// filterHeaderAgreementPeers is the number of peers that must agree on the filter header at the tip before a
+		// sync peer is chosen from among them, or zero if it isn't checked.
+		filterHeaderAgreementPeers int
+		// minAgreeingPeers is the fewest peers that must advertise a tip consistent with the block headers before the
+		// ChainService reports it is current, or zero if it isn't checked.
+		minAgreeingPeers int
+		// genesisFilterHeader is the regular filter header of the genesis block, which new peers must agree on.
+		genesisFilterHeader chainhash.Hash
+		// maxPeers is the most peers the client keeps connected. It is only used by the peerHandler goroutine once the
+		// ChainService is started.
+		maxPeers int
+		// headerCacheSize is the number of recently validated headers the block manager remembers.
+		headerCacheSize int
+		// rescanSlots holds a value for each rescan that is scanning up to the tip when Config.MaxConcurrentRescans is
+		// set, and is nil otherwise.
+		rescanSlots chan struct{}
+		// rescansRunning counts the rescans that are running and resetting is set while ResetChainState runs, so that
+		// neither starts while the other runs. Both are protected by mtxReset.
+		rescansRunning int
+		resetting      bool
+		mtxReset       sync.Mutex
+		// broadcastTrackers holds the trackers of the transactions being followed with TrackBroadcast.
+		broadcastTrackers map[chainhash.Hash]map[*broadcastTracker]struct{}
+		mtxBroadcasts     sync.Mutex
 		BlockCache       *lru.Cache
 		// queryPeers will be called to send messages to one or more peers, expecting a response.
 		queryPeers func(
@@ -60,7 +151,7 @@ type (
 		blockManager      *blockManager
 		newPeers          chan *ServerPeer
 		donePeers         chan *ServerPeer
-		banPeers          chan *ServerPeer
+		banPeers          chan banPeerMsg
 		query             chan interface{}
 		peerHeightsUpdate chan updatePeerHeightsMsg
 		wg                sync.WaitGroup
@@ -70,17 +161,21 @@ type (
 		blockSubscribers  map[*blockSubscription]struct{}
 		mtxSubscribers    sync.RWMutex
 		utxoScanner       *UtxoScanner
-		// TODO: Add a map for more granular exclusion?
-		mtxCFilter sync.Mutex
+		// stopComponentsOnce makes sure the components peerHandler starts are stopped once, by whichever of
+		// peerHandler and StopWithTimeout gets to it first, and stoppedComponents counts those stopped so far.
+		stopComponentsOnce sync.Once
+		stoppedComponents  int32
 		// These are only necessary until the block subscription logic is refactored out into its own package and we can
 		// have different message types sent in the notifications.
 		//
 		// TODO(aakselrod): Get rid of this when doing the refactoring above.
-		reorgedBlockHeaders map[chainhash.Hash]*wire.BlockHeader
+		reorgedBlockHeaders map[chainhash.Hash]reorgHeader
 		mtxReorgHeader      sync.RWMutex
 		userAgentName       string
 		userAgentVersion    string
 		nameResolver        func(string) ([]net.IP, error)
+		// proxyDialer is set when Config.Dialer is, which is needed to reach onion addresses.
+		proxyDialer         bool
 		dialer              func(net.Addr) (net.Conn, error)
 	}
 	// Config is a struct detailing the configuration of the chain service.
@@ -99,8 +194,22 @@ type (
 		ConnectPeers []string
 		// AddPeers is a slice of hosts that should be connected to on startup, and be maintained as persistent peers.
 		AddPeers []string
+		// ConnectionRetryInterval is the wait before the first retry of a connection to a persistent peer, which
+		// doubles with each failed retry up to MaxConnectionRetryInterval. If it is zero, the package's
+		// ConnectionRetryInterval is used.
+		ConnectionRetryInterval time.Duration
+		// MaxConnectionRetryInterval is the longest wait between retries of a connection to a persistent peer. If it is
+		// zero, the package's MaxConnectionRetryInterval is used.
+		MaxConnectionRetryInterval time.Duration
+		// ConnectionRetryJitter is the fraction, from 0 to 1, of each wait between retries of a connection to a
+		// persistent peer that is cut off at random, so that clients that lost the same peer don't reconnect in step.
+		// If it is zero, the package's ConnectionRetryJitter is used, and a negative value disables the jitter.
+		ConnectionRetryJitter float64
 		// Dialer is an optional function closure that will be used to establish outbound TCP connections. If specified,
 		// then the connection manager will use this in place of net.Dial for all outbound connection attempts.
+		//
+		// Peers at Tor onion addresses, including those given in ConnectPeers and AddPeers, are only connected to when
+		// it is set. They are passed to it unresolved, with the network "onion", for it to reach through a proxy.
 		Dialer func(addr net.Addr) (net.Conn, error)
 		// NameResolver is an optional function closure that will be used to lookup the IP of any host. If specified,
 		// then the address manager, along with regular outbound connection attempts will use this instead.
@@ -109,11 +218,152 @@ type (
 		FilterCacheSize uint64
 		// BlockCacheSize indicates the size (in bytes) of blocks the block cache will hold in memory at most.
 		BlockCacheSize uint64
+		// BlockCachePruneDepth removes the blocks more than this many blocks below the best header from the block cache
+		// each time a block is added to it, rather than only once they are the least recently used, other than the
+		// blocks a running rescan hasn't passed yet. The block cache is the only place the client keeps blocks, so this
+		// bounds how many old blocks fetched by rescans are held. PruneBlockCache prunes the cache on demand. Zero
+		// means blocks are only evicted to keep the cache within BlockCacheSize.
+		BlockCachePruneDepth uint32
+		// FilterTypes is the set of filter types whose headers will be synced and whose filters can be fetched with
+		// GetCFilter. Regular filters are always synced whether or not they are listed here.
+		FilterTypes []wire.FilterType
+		// TimeSource is an optional source of network adjusted time. If specified, it is used in place of a new median
+		// time source, which allows tests to control the time and operators to pin a trusted clock. Peer timestamps
+		// received in version messages are still added to it as samples.
+		TimeSource blockchain.MedianTimeSource
+		// StartHeight is the height from which block headers, filter headers, filters and blocks are downloaded. When
+		// it is above zero the client only knows the chain from StartHeader, which the caller must trust, and can't
+		// see any block beneath it. Peers presenting a chain that forks below it are banned. Unless StartHeight is at a
+		// difficulty retarget, the difficulty of the headers from the first retarget after it up to the next can't be
+		// worked out, and only their hashes are checked against the bits they claim.
+		StartHeight uint32
+		// StartHeader is the block header at StartHeight that the header chain is started from.
+		StartHeader *wire.BlockHeader
+		// StartFilterHeader is the regular filter header of the block at StartHeight.
+		StartFilterHeader *chainhash.Hash
+		// RequestTimeout is how long a peer has to deliver a requested block or filter before it is requested from
+		// another peer. Peers that fail to deliver MaxUndeliveredRequests requests in a row are banned. If it is zero,
+		// QueryTimeout is used, as for any other query.
+		RequestTimeout time.Duration
+		// FilterRequestTimeout is how long a peer has to deliver a requested filter or filter headers, and
+		// BlockRequestTimeout how long it has to deliver a requested block, so that the small filters can be given
+		// less time than the large blocks. Zero means RequestTimeout, except that the filter headers synced by the
+		// block manager wait QueryTimeout for each peer unless FilterRequestTimeout is set.
+		FilterRequestTimeout time.Duration
+		BlockRequestTimeout  time.Duration
+		// MaxConcurrentFilterQueries is the most filters that are fetched from the network at once. Zero means one at
+		// a time, so that rescans asking for the same filter don't fetch it twice.
+		MaxConcurrentFilterQueries int
+		// MaxConcurrentBlockQueries is the most blocks that are fetched from the network at once. Zero means there is
+		// no limit.
+		MaxConcurrentBlockQueries int
+		// BanThreshold is the ban score above which a misbehaving peer is banned and disconnected. Peers breaking the
+		// protocol get ProtocolViolationBanScore each time, which decays, so a higher threshold gives occasionally
+		// glitchy peers more grace. Zero means the package BanThreshold.
+		BanThreshold uint32
+		// ServeFilters enables answering the getcfilters, getcfheaders and getcfcheckpt requests of peers using the
+		// stored filters and filter headers, and advertises compact filter service. Only filters persisted to the
+		// filter database can be served. It can't be used with StartHeight.
+		ServeFilters bool
+		// AdvertiseServedOnly stops compact filter service, which is among the package Services, being advertised
+		// unless ServeFilters is set, so peers don't ask for filters that aren't served.
+		AdvertiseServedOnly bool
+		// OnAddressExhaustion is an optional callback that is called when the address manager has no usable address
+		// to make an outbound connection to, for example to re-seed it with ChainService.SeedFromDNS. Until it finds
+		// more, new addresses are asked for with a backoff starting at AddressExhaustionBackoff.
+		OnAddressExhaustion func()
+		// OnThroughput is an optional callback that is called every ThroughputSampleInterval with the bytes per second
+		// received from and sent to all peers since the last call, the same rates ChainService.Throughput returns. It
+		// is called from the sampling goroutine, so it shouldn't block.
+		OnThroughput func(recvBps, sendBps float64)
+		// MinPeerDiversity is the fewest network groups, as given by addrmgr.GroupKey or AddressASN, that the connected
+		// peers can be from before OnLowPeerDiversity is called. Peers from few groups could be controlled by one party
+		// trying to eclipse the client. Zero disables the check, which is done every PeerDiversityCheckInterval.
+		MinPeerDiversity int
+		// OnLowPeerDiversity is an optional callback that is called with the number of network groups and peers when
+		// the connected peers come from fewer than MinPeerDiversity groups.
+		OnLowPeerDiversity func(groups, peers int)
+		// DiversifyPeers disconnects a peer from the group with the most peers at each check while diversity is low,
+		// so that it is replaced with a peer from a group that isn't in use.
+		DiversifyPeers bool
+		// AddressASN is an optional function that returns the number of the autonomous system an IP address is in, and
+		// false if it isn't known. When it is set, outbound peers are grouped by autonomous system rather than by
+		// addrmgr.GroupKey, so new outbound addresses are chosen from systems no peer is connected in and one network
+		// operator can't host all the peers. Addresses it doesn't know fall back to their addrmgr.GroupKey. It must
+		// always return the same result for an address, as the peers in each group are counted as they come and go.
+		AddressASN func(ip net.IP) (uint32, bool)
+		// FilterHeaderAgreementPeers is the fewest peers that must answer for the regular filter header at the tip of
+		// the block headers before a sync peer is chosen. When it is set, the sync peer is only chosen from the peers
+		// that answered with the header most of them agree on, and peers that answered with another are disconnected,
+		// so a lone malicious peer can't become the sync peer. Zero disables the check.
+		FilterHeaderAgreementPeers int
+		// MinAgreeingPeers is the fewest distinct connected peers that must have advertised a tip consistent with the
+		// tip of the block headers, at its height and with its hash if they announced a block, before IsCurrent reports
+		// the ChainService is current, so that a single peer lying about the tip can't make a freshly started client
+		// trust it. The block manager carries on syncing from its peers meanwhile. Zero disables the check.
+		MinAgreeingPeers int
+		// MaxConcurrentRescans is the most rescans that scan the chain at once. Rescans started when that many are
+		// scanning wait until one of them finishes or catches up with the tip, from where following new blocks costs
+		// little, and ChainService.QueuedRescans tells how many are waiting. Zero means there is no limit.
+		MaxConcurrentRescans int
+		// MaxPeers is the most peers the client keeps connected. It can be changed while running with
+		// ChainService.SetMaxPeers. Zero means the package MaxPeers.
+		MaxPeers int
+		// HeaderWriteBatchInterval is how long the header stores hold the index writes of new headers before they are
+		// committed to the database in one transaction, which speeds up the initial sync. Held writes are committed by
+		// Checkpoint and Stop, and headers whose writes weren't committed are fetched again after a crash. Zero commits
+		// each write at once.
+		HeaderWriteBatchInterval time.Duration
+		// HeaderWriteBatchSize is the number of headers held at which they are committed without waiting out
+		// HeaderWriteBatchInterval. Zero means there is no such limit.
+		HeaderWriteBatchSize int
+		// HeaderCacheSize is the number of recently validated block headers remembered so that the same headers
+		// announced by more peers once the headers are synced are ignored without being validated again. Zero means
+		// DefaultHeaderCacheSize.
+		HeaderCacheSize int
+		// SendHeaders asks peers of a protocol version that supports it to announce new blocks with their headers rather
+		// than with inventory messages, which saves the round trip of requesting the headers of each new block once the
+		// headers are synced.
+		SendHeaders bool
+		// PeerSendQueueSize is the most messages queued to a peer that wait for earlier ones to be sent, so that a peer
+		// that can't keep up doesn't hold ever more of them. Zero means there is no limit.
+		PeerSendQueueSize int
+		// PeerSendQueuePolicy is what is done when a message is queued to a peer with PeerSendQueueSize messages
+		// waiting, which is to drop the oldest of them by default.
+		PeerSendQueuePolicy SendQueuePolicy
+		// PeerAnnouncementLimit is the most transaction announcements sent to a peer in each PeerAnnouncementInterval,
+		// so that broadcasting many transactions doesn't get the client banned for spamming. Announcements past the
+		// limit are held and sent in later intervals, and ServerPeer.AnnouncementQueueDepth tells how many are held.
+		// Zero means there is no limit.
+		PeerAnnouncementLimit int
+		// PeerAnnouncementInterval is the interval PeerAnnouncementLimit applies to. Zero means a second.
+		PeerAnnouncementInterval time.Duration
+		// PeerAnnouncementQueueSize is the most announcements held for a peer by PeerAnnouncementLimit. Further ones
+		// are dropped, and counted by ServerPeer.DroppedAnnouncements and ChainService.DroppedAnnouncements. Zero
+		// means there is no limit.
+		PeerAnnouncementQueueSize int
+		// AssumeValidBelowCheckpoint accepts the block headers up to the last checkpoint of the network after checking
+		// only that each one connects to the one before it, without checking their proof of work, difficulty or
+		// timestamps, which makes the sync up to the last checkpoint much faster. The headers are then only trusted
+		// because the hash of the header at each checkpoint has to match, so the hardcoded checkpoints must be trusted
+		// entirely, and headers a peer sent between two checkpoints are stored unchecked until the next checkpoint
+		// shows whether they were right, and rolled back if they weren't. Headers above the last checkpoint are fully
+		// validated, and it has no effect on a network without checkpoints.
+		AssumeValidBelowCheckpoint bool
+		// OnUnknownMessage is called from the input handler of a peer, and so must not block, with each message the peer
+		// sends whose command the client doesn't support, such as those of a newer protocol or a non-standard peer. Its
+		// checksum has been verified and its payload is passed as it was received. The peer stays connected unless the
+		// handler bans it with BanPeer. A message with a payload over wire.MaxUnknownPayload is discarded instead, and
+		// raises the ban score of the peer. When it is nil, a peer sending such a message can't be read from and is
+		// disconnected.
+		OnUnknownMessage func(sp *ServerPeer, cmd string, payload []byte)
 	}
 	// ServerPeer extends the peer to maintain state shared by the server and the blockmanager.
 	ServerPeer struct {
 		// The following variables must only be used atomically
 		feeFilter int64
+		// sentSendHeaders is set once the peer was asked to announce new blocks with their headers.
+		sentSendHeaders int32
 		*peer.Peer
 		connReq    *connmgr.ConnReq
 		server     *ChainService
@@ -122,7 +372,13 @@ type (
 		// requestQueue   []*wire.InvVect
 		knownAddresses map[string]struct{}
 		banScore       connmgr.DynamicBanScore
-		quit           qu.C
+		// headerWork is the work of the block headers the peer delivered, by which the sync peer is chosen.
+		headerWork headerWork
+		// sendQueue holds the messages queued to the peer that wait for earlier ones to be sent.
+		sendQueue sendQueue
+		quit      qu.C
+		// announcements holds the transaction announcements to the peer held back by Config.PeerAnnouncementLimit.
+		announcements announcementLimiter
 		// The following map of subcribers is used to subscribe to messages from the peer. This allows broadcast to
 		// multiple subscribers at once, allowing for multiple queries to be going to multiple peers at any one time.
 		// The mutex is for subscribe/unsubscribe functionality. The sends on these channels WILL NOT block; any
@@ -134,9 +390,14 @@ type (
 	peerState struct {
 		outboundPeers   map[int32]*ServerPeer
 		persistentPeers map[int32]*ServerPeer
-		banned          map[string]time.Time
+		banned          map[string]*BanEntry
 		outboundGroups  map[string]int
 	}
+	// reorgHeader is the header of the tip that a block was rolled back to, along with its height.
+	reorgHeader struct {
+		header *wire.BlockHeader
+		height uint32
+	}
 	// spMsg represents a message over the wire from a specific peer.
 	spMsg struct {
 		sp  *ServerPeer
@@ -162,29 +423,71 @@ type (
 //
 // TODO: Export functional options for these as much as possible so they can be changed call-to-call.
 var (
+	// AddressExhaustionBackoff is how long to wait before asking the address manager for an address again after it
+	// first runs out. The wait doubles each time it runs out in a row, up to MaxAddressExhaustionBackoff.
+	AddressExhaustionBackoff = time.Second * 5
 	// BanDuration is the duration of a ban.
 	BanDuration = time.Hour * 24
-	// BanThreshold is the maximum ban score before a peer is banned.
+	// BanThreshold is the maximum ban score before a peer is banned, unless Config.BanThreshold is set.
 	BanThreshold = uint32(100)
 	// ConnectionRetryInterval is the base amount of time to wait in between retries when connecting to persistent
-	// peers. It is adjusted by the number of retries such that there is a retry backoff.
+	// peers. It is doubled with each retry such that there is a retry backoff.
 	ConnectionRetryInterval = time.Second * 60
+	// ConnectionRetryJitter is the default fraction of the wait between retries of a connection to a persistent peer
+	// that is randomized.
+	ConnectionRetryJitter = 0.25
 	// DefaultBlockCacheSize is the size (in bytes) of blocks neutrino will keep in memory if no size is specified in
 	// the neutrino.Config.
 	DefaultBlockCacheSize uint64 = 4096 * 10 * 1000 // 40 MB
 	// DefaultFilterCacheSize is the size (in bytes) of filters neutrino will keep in memory if no size is specified in
 	// the neutrino.Config.
 	DefaultFilterCacheSize uint64 = 4096 * 1000
+	// DefaultHeaderCacheSize is the number of recently validated block headers the block manager remembers, so that the
+	// same headers announced by other peers are ignored, if no size is specified in the Config.
+	DefaultHeaderCacheSize = 2000
 	// DisableDNSSeed disables getting initial addresses for Bitcoin nodes from DNS.
 	DisableDNSSeed = false
+	// DisableGenesisCheck disables asking new peers for the filter header of the genesis block, so that peers are
+	// accepted without confirming they follow the same chain.
+	DisableGenesisCheck = false
+	// GenesisCheckTimeout is how long a new peer has to answer for the filter header of the genesis block before it is
+	// disconnected.
+	GenesisCheckTimeout = time.Second * 10
+	// HeaderCheckpointInterval is how often the header stores are flushed to disk and the verified tip is recorded
+	// while the ChainService is running. Zero leaves it to the caller and to Stop.
+	HeaderCheckpointInterval = time.Minute * 10
+	// MaxAddressExhaustionBackoff is the longest wait between asking the address manager for an address when it has
+	// run out.
+	MaxAddressExhaustionBackoff = time.Minute * 5
+	// MaxConnectionRetryInterval is the default longest wait between retries of a connection to a persistent peer.
+	MaxConnectionRetryInterval = time.Minute * 30
 	// MaxPeers is the maximum number of connections the client maintains.
 	MaxPeers = 125
+	// MaxReorgHeaders is the maximum number of headers of rolled back blocks that are kept in memory for block
+	// subscribers. When it is exceeded the headers from the lowest heights are dropped first.
+	MaxReorgHeaders = 1000
+	// NotFoundBanScore is the decaying ban score a peer gets each time it answers a request for a block it announced
+	// with notfound.
+	NotFoundBanScore = uint32(20)
+	// PeerDiversityCheckInterval is how often the network groups of the connected peers are checked when
+	// Config.MinPeerDiversity is set.
+	PeerDiversityCheckInterval = time.Minute
+	// ProtocolViolationBanScore is the decaying ban score a peer gets each time it sends a message that breaks the
+	// protocol, so that a peer that only does so now and then isn't disconnected for it.
+	ProtocolViolationBanScore = uint32(25)
+	// ReorgHeaderDepth is the number of blocks below the tip that the header of a rolled back block is kept in memory
+	// for before it is dropped.
+	ReorgHeaderDepth = uint32(100)
 	// RequiredServices describes the services that are required to be supported by outbound peers.
 	RequiredServices = wire.SFNodeNetwork | /* wire.SFNodeWitness |*/ wire.SFNodeCF
-	// Services describes the services that are supported by the server.
+	// Services describes the services that are supported by the server. Compact filters are only advertised with
+	// Config.ServeFilters when Config.AdvertiseServedOnly is set.
 	Services = /*wire.SFNodeWitness |*/ wire.SFNodeCF
 	// TargetOutbound is the number of outbound peers to target.
 	TargetOutbound = 16
+	// ThroughputSampleInterval is how often the byte counters are sampled to find the rates returned by
+	// ChainService.Throughput and passed to Config.OnThroughput. Zero disables sampling.
+	ThroughputSampleInterval = time.Second * 5
 	// UserAgentName is the user agent name and is used to help identify ourselves to other bitcoin peers.
 	UserAgentName = "neutrino"
 	// UserAgentVersion is the user agent version and is used to help identify ourselves to other bitcoin peers.
@@ -210,7 +513,41 @@ func (s *ChainService) AddPeer(sp *ServerPeer) {
 
 // BanPeer bans a peer that has already been connected to the server by ip.
 func (s *ChainService) BanPeer(sp *ServerPeer) {
-	s.banPeers <- sp
+	s.BanPeerFor(sp, BanSourceCaller, "banned by caller")
+}
+
+// BanPeerFor bans a peer that has already been connected to the server by ip, recording the subsystem that banned it
+// and why in its BanEntry.
+func (s *ChainService) BanPeerFor(sp *ServerPeer, source, reason string) {
+	s.banPeers <- banPeerMsg{peer: sp, source: source, reason: reason}
+}
+
+// FilterHeaders returns the filter header store for the given filter type. An error is returned if the ChainService
+// was not configured to sync the filter type.
+func (s *ChainService) FilterHeaders(fType wire.FilterType) (*headerfs.FilterHeaderStore, error) {
+	store, ok := s.filterHeaders[fType]
+	if !ok {
+		return nil, fmt.Errorf("filter type %v is not being synced", fType)
+	}
+	return store, nil
+}
+
+// PruneOrphanHeaders deletes the headers of blocks that aren't on the main chain from the block header store, and
+// returns how many were deleted. It is meant to be called now and then for maintenance, and fails without deleting
+// anything if the tip moves while it runs.
+func (s *ChainService) PruneOrphanHeaders() (int, error) {
+	tip, _, e := s.BlockHeaders.ChainTip()
+	if e != nil {
+		return 0, e
+	}
+	pruned, e := s.BlockHeaders.PruneOrphanHeaders(tip.BlockHash())
+	if e != nil {
+		return 0, e
+	}
+	if pruned > 0 {
+		I.F("pruned %d orphaned block headers", pruned)
+	}
+	return pruned, nil
 }
 
 // BestBlock retrieves the most recent block's height and hash where we have both the header and filter header ready.
@@ -239,11 +576,56 @@ func (s *ChainService) BestBlock() (*waddrmgr.BlockStamp, error) {
 		nil
 }
 
+// WaitForHeight blocks until the best block, for which both the header and filter header are ready, reaches the given
+// height. It returns early with the context's error if the context is done first, or ErrShuttingDown if the service
+// stops.
+func (s *ChainService) WaitForHeight(ctx context.Context, height int32) (e error) {
+	var best *waddrmgr.BlockStamp
+	if best, e = s.BestBlock(); E.Chk(e) {
+		return
+	}
+	if best.Height >= height {
+		return nil
+	}
+	// The subscription delivers the blocks connected since the best block was read, so none are missed.
+	blockConnected := make(chan wire.BlockHeader)
+	quit := qu.T()
+	defer quit.Q()
+	var sub *blockSubscription
+	if sub, e = s.subscribeBlockMsg(uint32(best.Height), blockConnected, nil, quit); E.Chk(e) {
+		return
+	}
+	defer s.unsubscribeBlockMsgs(sub)
+	for {
+		select {
+		case header := <-blockConnected:
+			var connectedHeight uint32
+			blockHash := header.BlockHash()
+			if connectedHeight, e = s.BlockHeaders.HeightFromHash(&blockHash); E.Chk(e) {
+				return
+			}
+			if int32(connectedHeight) >= height {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.quit.Wait():
+			return ErrShuttingDown
+		}
+	}
+}
+
 // ChainParams returns a copy of the ChainService's chaincfg.Params.
 func (s *ChainService) ChainParams() chaincfg.Params {
 	return s.chainParams
 }
 
+// ExportPeers writes the addresses the address manager knows of, other than those it considers bad, to w, so that another
+// client can be seeded with them by ImportPeers rather than only from DNS seeds.
+func (s *ChainService) ExportPeers(w io.Writer) (e error) {
+	return s.addrManager.ExportAddresses(w)
+}
+
 // GetBlockHash returns the block hash at the given height.
 func (s *ChainService) GetBlockHash(height int64) (*chainhash.Hash, error) {
 	header, e := s.BlockHeaders.FetchHeaderByHeight(uint32(height))
@@ -272,9 +654,18 @@ func (s *ChainService) GetBlockHeight(hash *chainhash.Hash) (int32, error) {
 	return int32(height), nil
 }
 
-// IsCurrent lets the caller know whether the chain service's block manager thinks its view of the network is current.
+// ImportPeers adds the addresses written by ExportPeers from r to the address manager, to be connected to as any other
+// address it learned of. It may be called before the service is started, in which case the address manager is started
+// first so that the addresses saved in its peers file are loaded before the imported ones are added.
+func (s *ChainService) ImportPeers(r io.Reader) (e error) {
+	s.addrManager.Start()
+	return s.addrManager.ImportAddresses(r)
+}
+
+// IsCurrent lets the caller know whether the chain service's block manager thinks its view of the network is current,
+// and, when Config.MinAgreeingPeers is set, whether enough peers agree on the tip.
 func (s *ChainService) IsCurrent() bool {
-	return s.blockManager.IsFullySynced()
+	return s.blockManager.IsFullySynced() && s.tipAgreed()
 }
 
 // NetTotals returns the sum of all bytes received and sent across the network for all peers. It is safe for concurrent
@@ -312,18 +703,20 @@ func (s *ChainService) Start() {
 	// Start the peer handler which in turn starts the address and block managers.
 	s.wg.Add(1)
 	go s.peerHandler()
+	if HeaderCheckpointInterval > 0 {
+		s.wg.Add(1)
+		go s.checkpointHandler()
+	}
+	if ThroughputSampleInterval > 0 {
+		s.wg.Add(1)
+		go s.throughputHandler()
+	}
 }
 
-// Stop gracefully shuts down the server by stopping and disconnecting all peers and the main listener.
+// Stop gracefully shuts down the server by stopping and disconnecting all peers and the main listener. It waits for as
+// long as that takes, and StopWithTimeout can be used to give up on goroutines that don't stop.
 func (s *ChainService) Stop() (e error) {
-	// Make sure this only happens once.
-	if atomic.AddInt32(&s.shutdown, 1) != 1 {
-		return nil
-	}
-	// Signal the remaining goroutines to quit.
-	s.quit.Q()
-	s.wg.Wait()
-	return nil
+	return s.StopWithTimeout(0)
 }
 
 // UpdatePeerHeights updates the heights of all peers who have have announced the latest connected main chain block, or
@@ -351,6 +744,19 @@ func (s *ChainService) addrStringToNetAddr(addr string) (net.Addr, error) {
 			return nil, e
 		}
 	}
+	// Tor hidden services can't be resolved to an IP address, so they are left for the proxy of the dialer to reach.
+	if isOnionHost(host) {
+		if e = checkOnionHost(host); e != nil {
+			return nil, e
+		}
+		if !s.proxyDialer {
+			return nil, fmt.Errorf("onion address %s can only be connected to through a proxy Dialer", host)
+		}
+		if _, e = strconv.Atoi(strPort); e != nil {
+			return nil, e
+		}
+		return &onionAddr{addr: net.JoinHostPort(host, strPort)}, nil
+	}
 	// Attempt to look up an IP address associated with the parsed host.
 	ips, e := s.nameResolver(host)
 	if e != nil {
@@ -390,11 +796,11 @@ func (s *ChainService) handleAddPeerMsg(state *peerState, sp *ServerPeer) bool {
 		sp.Disconnect()
 		return false
 	}
-	if banEnd, ok := state.banned[host]; ok {
-		if time.Now().Before(banEnd) {
+	if ban, ok := state.banned[host]; ok {
+		if time.Now().Before(ban.Until) {
 			D.F(
-				"peer %s is banned for another %v - disconnecting %s",
-				host, time.Until(banEnd),
+				"peer %s is banned for another %v (%s) - disconnecting",
+				host, time.Until(ban.Until), ban.Reason,
 			)
 			sp.Disconnect()
 			return false
@@ -405,10 +811,10 @@ func (s *ChainService) handleAddPeerMsg(state *peerState, sp *ServerPeer) bool {
 		delete(state.banned, host)
 	}
 	// TODO: Chk for max peers from a single IP. Limit max number of total peers.
-	if state.Count() >= MaxPeers {
+	if state.Count() >= s.maxPeers {
 		I.F(
 			"max peers reached [%d] - disconnecting peer %s",
-			MaxPeers, sp,
+			s.maxPeers, sp,
 		)
 		sp.Disconnect()
 		// TODO: how to handle permanent peers here? they should be rescheduled.
@@ -416,7 +822,11 @@ func (s *ChainService) handleAddPeerMsg(state *peerState, sp *ServerPeer) bool {
 	}
 	// Add the new peer and start it.
 	D.Ln("new peer", sp)
-	state.outboundGroups[addrmgr.GroupKey(sp.NA())]++
+	state.outboundGroups[s.groupKey(sp.NA())]++
+	// The connection request may have been promoted or demoted since the peer was created.
+	if sp.connReq != nil {
+		sp.persistent = sp.connReq.IsPermanent()
+	}
 	if sp.persistent {
 		state.persistentPeers[sp.ID()] = sp
 	} else {
@@ -425,17 +835,53 @@ func (s *ChainService) handleAddPeerMsg(state *peerState, sp *ServerPeer) bool {
 	return true
 }
 
+// handlePermanenceChange moves the peer of a connection request that was promoted to permanent or demoted to transient
+// to the peers of its kind. It is invoked from the peerHandler goroutine.
+func (s *ChainService) handlePermanenceChange(state *peerState, c *connmgr.ConnReq) {
+	permanent := c.IsPermanent()
+	from, to := state.outboundPeers, state.persistentPeers
+	if !permanent {
+		from, to = to, from
+	}
+	for id, sp := range from {
+		if sp.connReq == c {
+			sp.persistent = permanent
+			delete(from, id)
+			to[id] = sp
+			return
+		}
+	}
+}
+
+// permanenceChanged is invoked by the connection manager when a connection request was promoted to permanent or
+// demoted to transient, and has the peer handler update the peer of the request.
+func (s *ChainService) permanenceChanged(c *connmgr.ConnReq) {
+	select {
+	case s.query <- permanenceChangeMsg{connReq: c}:
+	case <-s.quit.Wait():
+	}
+}
+
 // handleBanPeerMsg deals with banning peers. It is invoked from the peerHandler goroutine.
-func (s *ChainService) handleBanPeerMsg(state *peerState, sp *ServerPeer) {
+func (s *ChainService) handleBanPeerMsg(state *peerState, msg banPeerMsg) {
+	sp := msg.peer
 	var host string
 	var e error
 	host, _, e = net.SplitHostPort(sp.Addr())
 	if e != nil {
-		D.F("can't split ban peer %s: %s %s", sp.Addr(), e)
+		D.F("can't split ban peer %s: %s", sp.Addr(), e)
 		return
 	}
-	I.F("banned peer %s for %v", host, BanDuration)
-	state.banned[host] = time.Now().Add(BanDuration)
+	now := time.Now()
+	I.F("banned peer %s for %v by %s: %s", host, BanDuration, msg.source, msg.reason)
+	state.banned[host] = &BanEntry{
+		Host:     host,
+		Reason:   msg.reason,
+		Source:   msg.source,
+		BanScore: sp.banScore.Int(),
+		BannedAt: now,
+		Until:    now.Add(BanDuration),
+	}
 }
 
 // handleDonePeerMsg deals with peers that have signalled they are done. It is invoked from the peerHandler goroutine.
@@ -448,7 +894,7 @@ func (s *ChainService) handleDonePeerMsg(state *peerState, sp *ServerPeer) {
 	}
 	if _, ok := list[sp.ID()]; ok {
 		if !sp.Inbound() && sp.VersionKnown() {
-			state.outboundGroups[addrmgr.GroupKey(sp.NA())]--
+			state.outboundGroups[s.groupKey(sp.NA())]--
 		}
 		if !sp.Inbound() && sp.connReq != nil {
 			s.connManager.Disconnect(sp.connReq.ID())
@@ -495,11 +941,12 @@ func (s *ChainService) handleUpdatePeerHeights(state *peerState, umsg updatePeer
 // initializes a new outbound server peer instance, associates it with the relevant state such as the connection request
 // instance and the connection itself, and finally notifies the address manager of the attempt.
 func (s *ChainService) outboundPeerConnected(c *connmgr.ConnReq, conn net.Conn) {
-	sp := newServerPeer(s, c.Permanent)
+	sp := newServerPeer(s, c.IsPermanent())
 	p, e := peer.NewOutboundPeer(newPeerConfig(sp), c.Addr.String())
 	if e != nil {
 		D.F("cannot create outbound peer %s: %s %s", c.Addr, e)
 		s.connManager.Disconnect(c.ID())
+		return
 	}
 	sp.Peer = p
 	sp.connReq = c
@@ -535,22 +982,16 @@ func (s *ChainService) peerHandler() {
 	state := &peerState{
 		persistentPeers: make(map[int32]*ServerPeer),
 		outboundPeers:   make(map[int32]*ServerPeer),
-		banned:          make(map[string]time.Time),
+		banned:          make(map[string]*BanEntry),
 		outboundGroups:  make(map[string]int),
 	}
 	if !DisableDNSSeed {
 		// Add peers discovered through DNS to the address manager.
-		connmgr.SeedFromDNS(
-			&s.chainParams, RequiredServices,
-			s.nameResolver, func(addrs []*wire.NetAddress) {
-				// Bitcoind uses a lookup of the dns seeder here. This is rather strange since the values looked up by
-				// the DNS seed lookups will vary quite a lot. to replicate this behaviour we put all addresses as
-				// having come from the first one.
-				s.addrManager.AddAddresses(addrs, addrs[0])
-			},
-		)
+		s.SeedFromDNS()
 	}
 	go s.connManager.Start()
+	diversityTicker := time.NewTicker(PeerDiversityCheckInterval)
+	defer diversityTicker.Stop()
 out:
 	for {
 		select {
@@ -564,10 +1005,12 @@ out:
 		case umsg := <-s.peerHeightsUpdate:
 			s.handleUpdatePeerHeights(state, umsg)
 		// Peer to ban.
-		case p := <-s.banPeers:
-			s.handleBanPeerMsg(state, p)
+		case msg := <-s.banPeers:
+			s.handleBanPeerMsg(state, msg)
 		case qmsg := <-s.query:
 			s.handleQuery(state, qmsg)
+		case <-diversityTicker.C:
+			s.checkPeerDiversity(state)
 		case <-s.quit.Wait():
 			// Disconnect all peers on server shutdown.
 			state.forAllPeers(
@@ -579,19 +1022,7 @@ out:
 			break out
 		}
 	}
-	s.connManager.Stop()
-	e = s.utxoScanner.Stop()
-	if e != nil {
-		D.Ln(e)
-	}
-	e = s.blockManager.Stop()
-	if e != nil {
-		D.Ln(e)
-	}
-	e = s.addrManager.Stop()
-	if e != nil {
-		D.Ln(e)
-	}
+	s.stopComponents()
 	// Drain channels before exiting so nothing is left waiting around to send.
 cleanup:
 	for {
@@ -618,9 +1049,17 @@ func (s *ChainService) rollBackToHeight(height uint32) (*waddrmgr.BlockStamp, er
 		Height: int32(headerHeight),
 		Hash:   header.BlockHash(),
 	}
-	_, regHeight, e := s.RegFilterHeaders.ChainTip()
-	if e != nil {
-		return nil, e
+	filterHeights := make(map[wire.FilterType]uint32, len(s.syncFilterTypes))
+	for _, fType := range s.syncFilterTypes {
+		_, filterHeight, e := s.filterHeaders[fType].ChainTip()
+		if e != nil {
+			return nil, e
+		}
+		filterHeights[fType] = filterHeight
+	}
+	// Headers that are rolled back aren't valid any more, and have to be validated again if they are announced again.
+	if s.blockManager != nil {
+		s.blockManager.forgetValidatedHeaders()
 	}
 	for uint32(bs.Height) > height {
 		header, _, e = s.BlockHeaders.FetchHeader(&bs.Hash)
@@ -629,12 +1068,15 @@ func (s *ChainService) rollBackToHeight(height uint32) (*waddrmgr.BlockStamp, er
 		}
 		newTip := &header.PrevBlock
 		// Only roll back filter headers if they've caught up this far.
-		if uint32(bs.Height) <= regHeight {
-			newFilterTip, e := s.RegFilterHeaders.RollbackLastBlock(newTip)
+		for _, fType := range s.syncFilterTypes {
+			if uint32(bs.Height) > filterHeights[fType] {
+				continue
+			}
+			newFilterTip, e := s.filterHeaders[fType].RollbackLastBlock(newTip)
 			if e != nil {
 				return nil, e
 			}
-			regHeight = uint32(newFilterTip.Height)
+			filterHeights[fType] = uint32(newFilterTip.Height)
 		}
 		bs, e = s.BlockHeaders.RollbackLastBlock()
 		if e != nil {
@@ -650,9 +1092,7 @@ func (s *ChainService) rollBackToHeight(height uint32) (*waddrmgr.BlockStamp, er
 		if e != nil {
 			return nil, e
 		}
-		s.mtxReorgHeader.Lock()
-		s.reorgedBlockHeaders[header.PrevBlock] = lastHeader
-		s.mtxReorgHeader.Unlock()
+		s.addReorgHeader(header.PrevBlock, lastHeader, uint32(bs.Height))
 		// Now we send the block disconnected notifications.
 		s.sendSubscribedMsg(
 			&blockMessage{
@@ -664,6 +1104,36 @@ func (s *ChainService) rollBackToHeight(height uint32) (*waddrmgr.BlockStamp, er
 	return bs, nil
 }
 
+// addReorgHeader stores the header of the new tip after a block is rolled back so block subscribers can read it after
+// it has been deleted from the store. Headers more than ReorgHeaderDepth blocks below the new tip are swept, and if
+// more than MaxReorgHeaders remain the lowest ones are dropped, so a flapping chain can't grow the map without bound.
+func (s *ChainService) addReorgHeader(hash chainhash.Hash, header *wire.BlockHeader, height uint32) {
+	s.mtxReorgHeader.Lock()
+	defer s.mtxReorgHeader.Unlock()
+	s.reorgedBlockHeaders[hash] = reorgHeader{header: header, height: height}
+	for h, rh := range s.reorgedBlockHeaders {
+		if rh.height+ReorgHeaderDepth < height {
+			delete(s.reorgedBlockHeaders, h)
+		}
+	}
+	excess := len(s.reorgedBlockHeaders) - MaxReorgHeaders
+	if excess <= 0 {
+		return
+	}
+	hashes := make([]chainhash.Hash, 0, len(s.reorgedBlockHeaders))
+	for h := range s.reorgedBlockHeaders {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(
+		hashes, func(i, j int) bool {
+			return s.reorgedBlockHeaders[hashes[i]].height < s.reorgedBlockHeaders[hashes[j]].height
+		},
+	)
+	for _, h := range hashes[:excess] {
+		delete(s.reorgedBlockHeaders, h)
+	}
+}
+
 // OnAddr is invoked when a peer receives an addr bitcoin message and is used to notify the server about advertised
 // addresses.
 func (sp *ServerPeer) OnAddr(_ *peer.Peer, msg *wire.MsgAddr) {
@@ -679,11 +1149,10 @@ func (sp *ServerPeer) OnAddr(_ *peer.Peer, msg *wire.MsgAddr) {
 	}
 	// A message that has no addresses is invalid.
 	if len(msg.AddrList) == 0 {
-		E.F(
-			"command [%s] from %s does not contain any addresses",
-			msg.Command(), sp.Addr(),
+		sp.addBanScore(
+			0, ProtocolViolationBanScore, BanSourceProtocol,
+			fmt.Sprintf("command [%s] does not contain any addresses", msg.Command()),
 		)
-		sp.Disconnect()
 		return
 	}
 	for _, na := range msg.AddrList {
@@ -707,19 +1176,25 @@ func (sp *ServerPeer) OnAddr(_ *peer.Peer, msg *wire.MsgAddr) {
 }
 
 // OnFeeFilter is invoked when a peer receives a feefilter bitcoin message and is used by remote peers to request that
-// no transactions which have a fee rate lower than provided value are inventoried to them. The peer will be
-// disconnected if an invalid fee filter value is provided.
+// no transactions which have a fee rate lower than provided value are inventoried to them. The ban score of the peer is
+// raised if an invalid fee filter value is provided.
 func (sp *ServerPeer) OnFeeFilter(_ *peer.Peer, msg *wire.MsgFeeFilter) {
 	// Chk that the passed minimum fee is a valid amount.
 	if msg.MinFee < 0 || msg.MinFee > int64(amt.MaxSatoshi) {
-		D.F(
-			"peer %v sent an invalid feefilter '%v' -- disconnecting %s",
-			sp, amt.Amount(msg.MinFee),
+		sp.addBanScore(
+			0, ProtocolViolationBanScore, BanSourceProtocol,
+			fmt.Sprintf("invalid feefilter '%v'", amt.Amount(msg.MinFee)),
 		)
-		sp.Disconnect()
 		return
 	}
 	atomic.StoreInt64(&sp.feeFilter, msg.MinFee)
+	// Transaction announcements still queued that pay less than the new filter are no longer wanted by the peer.
+	if dropped := sp.dropAnnouncementsBelow(amt.Amount(msg.MinFee)); dropped > 0 {
+		D.F(
+			"dropped %d queued transaction announcements below the fee filter %v of %s",
+			dropped, amt.Amount(msg.MinFee), sp,
+		)
+	}
 }
 
 // OnHeaders is invoked when a peer receives a headers bitcoin message. The message is passed down to the block manager.
@@ -739,19 +1214,15 @@ func (sp *ServerPeer) OnInv(p *peer.Peer, msg *wire.MsgInv) {
 		"got inv with %d items from %s", len(msg.InvList), p.Addr(),
 	)
 	newInv := wire.NewMsgInvSizeHint(uint(len(msg.InvList)))
+	var announcedTxs bool
 	for _, invVect := range msg.InvList {
 		if invVect.Type == wire.InvTypeTx {
+			sp.server.noteBroadcastPeer(&invVect.Hash, sp)
 			T.F(
 				"ignoring tx %s in inv from %v -- SPV mode",
 				invVect.Hash, sp,
 			)
-			if sp.ProtocolVersion() >= wire.BIP0037Version {
-				I.F(
-					"peer %v is announcing transactions -- disconnecting", sp,
-				)
-				sp.Disconnect()
-				return
-			}
+			announcedTxs = true
 			continue
 		}
 		e := newInv.AddInvVect(invVect)
@@ -760,6 +1231,13 @@ func (sp *ServerPeer) OnInv(p *peer.Peer, msg *wire.MsgInv) {
 			break
 		}
 	}
+	// Peers that know the relay flag of the version message shouldn't announce transactions to us.
+	if announcedTxs && sp.ProtocolVersion() >= wire.BIP0037Version {
+		sp.addBanScore(0, ProtocolViolationBanScore, BanSourceProtocol, "announcing transactions to an spv client")
+		if !sp.Connected() {
+			return
+		}
+	}
 	if len(newInv.InvList) > 0 {
 		sp.server.blockManager.QueueInv(newInv, sp)
 	}
@@ -794,6 +1272,19 @@ func (sp *ServerPeer) OnReject(_ *peer.Peer, msg *wire.MsgReject) {
 	// TODO(roaseef): log?
 }
 
+// OnUnknownMessage is invoked when a peer receives a message with a command the client doesn't support, and passes it
+// to the handler set by Config.OnUnknownMessage, unless its payload was too long to be read.
+func (sp *ServerPeer) OnUnknownMessage(_ *peer.Peer, msg *wire.MsgUnknown) {
+	if msg.Oversized() {
+		sp.addBanScore(
+			0, ProtocolViolationBanScore, BanSourceProtocol,
+			fmt.Sprintf("%s message with a %d byte payload", msg.Cmd, msg.Length),
+		)
+		return
+	}
+	sp.server.onUnknownMessage(sp, msg.Cmd, msg.Payload)
+}
+
 // OnVerAck is invoked when a peer receives a verack bitcoin message and is used to send the "sendheaders" command to
 // peers that are of a sufficienty new protocol version.
 func (sp *ServerPeer) OnVerAck(_ *peer.Peer, msg *wire.MsgVerAck) {
@@ -820,6 +1311,16 @@ func (sp *ServerPeer) OnVersion(_ *peer.Peer, msg *wire.MsgVersion) *wire.MsgRej
 		sp.Disconnect()
 		return nil
 	}
+	if DisableGenesisCheck {
+		sp.accept()
+	} else {
+		go sp.verifyGenesis()
+	}
+	return nil
+}
+
+// accept makes a peer that has negotiated its version a sync candidate and adds it to the server.
+func (sp *ServerPeer) accept() {
 	// Signal the block manager this peer is a new sync candidate.
 	sp.server.blockManager.NewPeer(sp)
 	// Update the address manager and request known addresses from the remote peer for outbound connections. This is
@@ -839,7 +1340,6 @@ func (sp *ServerPeer) OnVersion(_ *peer.Peer, msg *wire.MsgVersion) *wire.MsgRej
 	}
 	// Add valid peer to the server.
 	sp.server.AddPeer(sp)
-	return nil
 }
 
 // OnWrite is invoked when a peer sends a message and it is used to update the bytes sent by the server.
@@ -847,42 +1347,46 @@ func (sp *ServerPeer) OnWrite(_ *peer.Peer, bytesWritten int, msg wire.Message,
 	sp.server.AddBytesSent(uint64(bytesWritten))
 }
 
-// // addBanScore increases the persistent and decaying ban score fields by the
-// // values passed as parameters. If the resulting score exceeds half of the ban
-// // threshold, a warning is logged including the reason provided. Further, if
-// // the score is above the ban threshold, the peer will be banned and
-// // disconnected.
-// func (sp *ServerPeer) addBanScore(persistent, transient uint32, reason string) {
-// 	// No warning is logged and no score is calculated if banning is disabled.
-// 	warnThreshold := BanThreshold >> 1
-// 	if transient == 0 && persistent == 0 {
-// 		// The score is not being increased, but a warning message is still
-// 		// logged if the score is above the warn threshold.
-// 		score := sp.banScore.Int()
-// 		if score > warnThreshold {
-// 			WARNF{
-// 				"misbehaving peer %s: %s -- ban score is %d, it was not increased this time",
-// 				sp, reason, score,
-// 			}
-// 		}
-// 		return
-// 	}
-// 	score := sp.banScore.Increase(persistent, transient)
-// 	if score > warnThreshold {
-// 		WARNF{
-// 			"misbehaving peer %s: %s -- ban score increased to %d",
-// 			sp, reason, score,
-// 		}
-// 		if score > BanThreshold {
-// 			WARNF{
-// 				"misbehaving peer %s -- banning and disconnecting",
-// 				sp,
-// 			}
-// 			sp.server.BanPeer(sp)
-// 			sp.Disconnect()
-// 		}
-// 	}
-// }
+// peerBanThreshold returns the ban score above which a peer is banned, which is the package BanThreshold unless
+// Config.BanThreshold was set. It can be called on a nil service.
+func (s *ChainService) peerBanThreshold() uint32 {
+	if s != nil && s.banThreshold > 0 {
+		return s.banThreshold
+	}
+	return BanThreshold
+}
+
+// addBanScore increases the persistent and decaying ban score fields by the values passed as parameters. If the
+// resulting score exceeds half of the ban threshold, a warning is logged including the reason provided. Further, if the
+// score is above the ban threshold, the peer will be banned by the given source and disconnected.
+func (sp *ServerPeer) addBanScore(persistent, transient uint32, source, reason string) {
+	threshold := sp.server.peerBanThreshold()
+	warnThreshold := threshold >> 1
+	score := sp.banScore.Increase(persistent, transient)
+	if score <= warnThreshold {
+		return
+	}
+	W.F("misbehaving peer %s: %s -- ban score increased to %d", sp, reason, score)
+	if score > threshold {
+		W.F("misbehaving peer %s -- banning and disconnecting", sp)
+		sp.server.BanPeerFor(sp, source, reason)
+		sp.Disconnect()
+	}
+}
+
+// handleNotFound raises the ban score of a peer that answered a request for blocks it announced with notfound. Peers
+// may answer notfound for blocks they never announced, which isn't counted against them.
+func (sp *ServerPeer) handleNotFound(msg *wire.MsgNotFound) {
+	for _, iv := range msg.InvList {
+		if iv.Type != wire.InvTypeBlock && iv.Type != wire.InvTypeWitnessBlock {
+			continue
+		}
+		// Blocks are announced with the plain block type whichever type they were requested with.
+		if sp.IsKnownInventory(wire.NewInvVect(wire.InvTypeBlock, &iv.Hash)) {
+			sp.addBanScore(0, NotFoundBanScore, BanSourceNotFound, fmt.Sprintf("notfound for announced block %v", iv.Hash))
+		}
+	}
+}
 
 // addKnownAddresses adds the given addresses to the set of known addresses to the peer to prevent sending duplicate
 // addresses.
@@ -909,16 +1413,22 @@ func (sp *ServerPeer) newestBlock() (*chainhash.Hash, int32, error) {
 	return &bestHash, int32(bestHeight), nil
 }
 
-// pushSendHeadersMsg sends a sendheaders message to the connected peer.
+// pushSendHeadersMsg sends a sendheaders message to the connected peer if its protocol version supports it.
 func (sp *ServerPeer) pushSendHeadersMsg() (e error) {
 	if sp.VersionKnown() {
-		if sp.ProtocolVersion() > wire.SendHeadersVersion {
+		if sp.ProtocolVersion() >= wire.SendHeadersVersion {
 			sp.QueueMessage(wire.NewMsgSendHeaders(), nil)
+			atomic.StoreInt32(&sp.sentSendHeaders, 1)
 		}
 	}
 	return nil
 }
 
+// SentSendHeaders returns whether the peer was asked to announce new blocks with their headers.
+func (sp *ServerPeer) SentSendHeaders() bool {
+	return atomic.LoadInt32(&sp.sentSendHeaders) != 0
+}
+
 // subscribeRecvMsg handles adding OnRead subscriptions to the server peer.
 func (sp *ServerPeer) subscribeRecvMsg(subscription spMsgSubscription) {
 	sp.mtxSubscribers.Lock()
@@ -938,6 +1448,15 @@ func (ps *peerState) Count() int {
 	return len(ps.outboundPeers) + len(ps.persistentPeers)
 }
 
+// targetOutbound returns the number of outbound peers for the connection manager to target, which is TargetOutbound
+// unless the client keeps fewer peers than that.
+func (s *ChainService) targetOutbound() int {
+	if s.maxPeers < TargetOutbound {
+		return s.maxPeers
+	}
+	return TargetOutbound
+}
+
 // forAllOutboundPeers is a helper function that runs closure on all outbound peers known to peerState.
 func (ps *peerState) forAllOutboundPeers(closure func(sp *ServerPeer)) {
 	for _, e := range ps.outboundPeers {
@@ -982,21 +1501,83 @@ func NewChainService(cfg Config) (*ChainService, error) {
 	amgr := addrmgr.New(cfg.DataDir, nameResolver)
 	s := ChainService{
 		chainParams:         cfg.ChainParams,
+		db:                  cfg.Database,
 		addrManager:         amgr,
 		newPeers:            make(chan *ServerPeer, MaxPeers),
 		donePeers:           make(chan *ServerPeer, MaxPeers),
-		banPeers:            make(chan *ServerPeer, MaxPeers),
+		banPeers:            make(chan banPeerMsg, MaxPeers),
 		query:               make(chan interface{}),
 		quit:                qu.T(),
 		peerHeightsUpdate:   make(chan updatePeerHeightsMsg),
-		timeSource:          blockchain.NewMedianTime(),
+		timeSource:          cfg.TimeSource,
 		services:            Services,
 		userAgentName:       UserAgentName,
 		userAgentVersion:    UserAgentVersion,
 		blockSubscribers:    make(map[*blockSubscription]struct{}),
-		reorgedBlockHeaders: make(map[chainhash.Hash]*wire.BlockHeader),
+		reorgedBlockHeaders: make(map[chainhash.Hash]reorgHeader),
 		nameResolver:        nameResolver,
 		dialer:              dialer,
+		onAddressExhaustion: cfg.OnAddressExhaustion,
+		onThroughput:        cfg.OnThroughput,
+		minPeerDiversity:    cfg.MinPeerDiversity,
+		onLowPeerDiversity:  cfg.OnLowPeerDiversity,
+		diversifyPeers:      cfg.DiversifyPeers,
+		addressASN:          cfg.AddressASN,
+	}
+	if cfg.ServeFilters {
+		if cfg.StartHeight > 0 {
+			return nil, fmt.Errorf("filters can't be served with a start height")
+		}
+		s.serveFilters = true
+		s.services |= wire.SFNodeCF
+	} else if cfg.AdvertiseServedOnly {
+		s.services &^= wire.SFNodeCF
+	}
+	s.filterHeaderAgreementPeers = cfg.FilterHeaderAgreementPeers
+	s.minAgreeingPeers = cfg.MinAgreeingPeers
+	s.sendHeaders = cfg.SendHeaders
+	s.peerSendQueueSize = cfg.PeerSendQueueSize
+	s.peerSendQueuePolicy = cfg.PeerSendQueuePolicy
+	s.peerAnnouncementLimit = cfg.PeerAnnouncementLimit
+	s.peerAnnouncementInterval = cfg.PeerAnnouncementInterval
+	s.peerAnnouncementQueueSize = cfg.PeerAnnouncementQueueSize
+	s.assumeValidBelowCheckpoint = cfg.AssumeValidBelowCheckpoint
+	s.onUnknownMessage = cfg.OnUnknownMessage
+	s.blockCachePruneDepth = cfg.BlockCachePruneDepth
+	s.proxyDialer = cfg.Dialer != nil
+	s.banThreshold = BanThreshold
+	if cfg.BanThreshold > 0 {
+		s.banThreshold = cfg.BanThreshold
+	}
+	s.maxPeers = MaxPeers
+	if cfg.MaxPeers > 0 {
+		s.maxPeers = cfg.MaxPeers
+	}
+	s.headerCacheSize = DefaultHeaderCacheSize
+	if cfg.HeaderCacheSize > 0 {
+		s.headerCacheSize = cfg.HeaderCacheSize
+	}
+	if cfg.MaxConcurrentRescans > 0 {
+		s.rescanSlots = make(chan struct{}, cfg.MaxConcurrentRescans)
+	}
+	s.filterRequestTimeout, s.blockRequestTimeout = cfg.RequestTimeout, cfg.RequestTimeout
+	if cfg.FilterRequestTimeout != 0 {
+		s.filterRequestTimeout = cfg.FilterRequestTimeout
+		s.filterQueryTimeout = cfg.FilterRequestTimeout
+	}
+	if cfg.BlockRequestTimeout != 0 {
+		s.blockRequestTimeout = cfg.BlockRequestTimeout
+	}
+	s.filterSlots = make(chan struct{}, 1)
+	if cfg.MaxConcurrentFilterQueries > 0 {
+		s.filterSlots = make(chan struct{}, cfg.MaxConcurrentFilterQueries)
+	}
+	if cfg.MaxConcurrentBlockQueries > 0 {
+		s.blockSlots = make(chan struct{}, cfg.MaxConcurrentBlockQueries)
+	}
+	// If no time source was specified, we'll use a median of the time samples reported by our peers.
+	if s.timeSource == nil {
+		s.timeSource = blockchain.NewMedianTime()
 	}
 	// We set the queryPeers method to point to queryChainServicePeers, passing a reference to the newly created
 	// ChainService.
@@ -1023,6 +1604,9 @@ func NewChainService(cfg Config) (*ChainService, error) {
 	if e != nil {
 		return nil, e
 	}
+	if s.genesisFilterHeader, e = genesisFilterHeader(&s.chainParams); E.Chk(e) {
+		return nil, e
+	}
 	filterCacheSize := DefaultFilterCacheSize
 	if cfg.FilterCacheSize != 0 {
 		filterCacheSize = cfg.FilterCacheSize
@@ -1033,17 +1617,71 @@ func NewChainService(cfg Config) (*ChainService, error) {
 		blockCacheSize = cfg.BlockCacheSize
 	}
 	s.BlockCache = lru.NewCache(blockCacheSize)
-	s.BlockHeaders, e = headerfs.NewBlockHeaderStore(
-		cfg.DataDir, cfg.Database, &cfg.ChainParams,
-	)
-	if e != nil {
+	if e = headerfs.BatchWrites(
+		cfg.Database, cfg.HeaderWriteBatchInterval, cfg.HeaderWriteBatchSize,
+	); E.Chk(e) {
 		return nil, e
 	}
-	s.RegFilterHeaders, e = headerfs.NewFilterHeaderStore(
-		cfg.DataDir, cfg.Database, headerfs.RegularFilter, &cfg.ChainParams,
-	)
-	if e != nil {
-		return nil, e
+	if cfg.StartHeight > 0 {
+		if e = checkStartAnchor(&cfg); E.Chk(e) {
+			return nil, e
+		}
+		s.startHeight = cfg.StartHeight
+		s.BlockHeaders, e = headerfs.NewBlockHeaderStoreFromAnchor(
+			cfg.DataDir, cfg.Database, &cfg.ChainParams, headerfs.BlockHeader{
+				BlockHeader: cfg.StartHeader,
+				Height:      cfg.StartHeight,
+			},
+		)
+		if e != nil {
+			return nil, e
+		}
+		s.RegFilterHeaders, e = headerfs.NewFilterHeaderStoreFromAnchor(
+			cfg.DataDir, cfg.Database, headerfs.RegularFilter, &cfg.ChainParams, headerfs.FilterHeader{
+				HeaderHash: cfg.StartHeader.BlockHash(),
+				FilterHash: *cfg.StartFilterHeader,
+				Height:     cfg.StartHeight,
+			},
+		)
+		if e != nil {
+			return nil, e
+		}
+	} else {
+		s.BlockHeaders, e = headerfs.NewBlockHeaderStore(
+			cfg.DataDir, cfg.Database, &cfg.ChainParams,
+		)
+		if e != nil {
+			return nil, e
+		}
+		s.RegFilterHeaders, e = headerfs.NewFilterHeaderStore(
+			cfg.DataDir, cfg.Database, headerfs.RegularFilter, &cfg.ChainParams,
+		)
+		if e != nil {
+			return nil, e
+		}
+	}
+	// The regular filter headers are always synced, and any other filter types requested in the config get a header
+	// store of their own.
+	s.syncFilterTypes = []wire.FilterType{wire.GCSFilterRegular}
+	s.filterHeaders = map[wire.FilterType]*headerfs.FilterHeaderStore{
+		wire.GCSFilterRegular: s.RegFilterHeaders,
+	}
+	for _, fType := range cfg.FilterTypes {
+		if _, ok := s.filterHeaders[fType]; ok {
+			continue
+		}
+		storeTypes, ok := filterTypes[fType]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter type: %v", fType)
+		}
+		var store *headerfs.FilterHeaderStore
+		if store, e = headerfs.NewFilterHeaderStore(
+			cfg.DataDir, cfg.Database, storeTypes.header, &cfg.ChainParams,
+		); E.Chk(e) {
+			return nil, e
+		}
+		s.syncFilterTypes = append(s.syncFilterTypes, fType)
+		s.filterHeaders[fType] = store
 	}
 	bm, e := newBlockManager(&s)
 	if e != nil {
@@ -1055,47 +1693,32 @@ func NewChainService(cfg Config) (*ChainService, error) {
 	// advertising and connecting to discovered peers in order to prevent it from becoming a public test network.
 	var newAddressFunc func() (net.Addr, error)
 	if s.chainParams.Net != chaincfg.SimNetParams.Net {
-		newAddressFunc = func() (net.Addr, error) {
-			for tries := 0; tries < 100; tries++ {
-				addr := s.addrManager.GetAddress()
-				if addr == nil {
-					break
-				}
-				// Address will not be invalid, local or unroutable because addrmanager rejects those on addition. Just
-				// check that we don't already have an address in the same group so that we are not connecting to the
-				// same network segment at the expense of others.
-				key := addrmgr.GroupKey(addr.NetAddress())
-				if s.OutboundGroupCount(key) != 0 {
-					continue
-				}
-				// only allow recent nodes (10mins) after we failed 30 times
-				if tries < 30 && time.Since(addr.LastAttempt()) < 10*time.Minute {
-					continue
-				}
-				// allow nondefault ports after 50 failed tries.
-				if tries < 50 && fmt.Sprintf("%d", addr.NetAddress().Port) !=
-					s.chainParams.DefaultPort {
-					continue
-				}
-				addrString := addrmgr.NetAddressKey(addr.NetAddress())
-				return s.addrStringToNetAddr(addrString)
-			}
-			return nil, errors.New("no valid connect address")
-		}
+		newAddressFunc = s.newAddress
 	}
 	cmgrCfg := &connmgr.Config{
-		RetryDuration:  ConnectionRetryInterval,
-		TargetOutbound: uint32(TargetOutbound),
-		OnConnection:   s.outboundPeerConnected,
-		Dial:           dialer,
+		RetryDuration:      ConnectionRetryInterval,
+		MaxRetryDuration:   MaxConnectionRetryInterval,
+		ExponentialRetry:   true,
+		RetryJitter:        ConnectionRetryJitter,
+		TargetOutbound:     uint32(s.targetOutbound()),
+		OnConnection:       s.outboundPeerConnected,
+		OnPermanenceChange: s.permanenceChanged,
+		Dial:               dialer,
+		Resolve:            s.addrStringToNetAddr,
+	}
+	if cfg.ConnectionRetryInterval > 0 {
+		cmgrCfg.RetryDuration = cfg.ConnectionRetryInterval
+	}
+	if cfg.MaxConnectionRetryInterval > 0 {
+		cmgrCfg.MaxRetryDuration = cfg.MaxConnectionRetryInterval
+	}
+	if cfg.ConnectionRetryJitter != 0 {
+		cmgrCfg.RetryJitter = cfg.ConnectionRetryJitter
 	}
 	if len(cfg.ConnectPeers) == 0 {
 		cmgrCfg.GetNewAddress = newAddressFunc
 	}
 	// Create a connection manager.
-	if MaxPeers < TargetOutbound {
-		TargetOutbound = MaxPeers
-	}
 	cmgr, e := connmgr.New(cmgrCfg)
 	if e != nil {
 		return nil, e
@@ -1114,6 +1737,7 @@ func NewChainService(cfg Config) (*ChainService, error) {
 		go s.connManager.Connect(
 			&connmgr.ConnReq{
 				Addr:      tcpAddr,
+				Host:      addr,
 				Permanent: true,
 			},
 		)
@@ -1124,11 +1748,35 @@ func NewChainService(cfg Config) (*ChainService, error) {
 			GetBlockHash:       s.GetBlockHash,
 			BlockFilterMatches: s.blockFilterMatches,
 			GetBlock:           s.GetBlock,
+			CheckpointDB:       cfg.Database,
 		},
 	)
 	return &s, nil
 }
 
+// checkStartAnchor validates the anchor header a pruned client is started from. The anchor can't be checked against the
+// chain it has skipped, but it must agree with any checkpoint at its height.
+func checkStartAnchor(cfg *Config) (e error) {
+	if cfg.StartHeader == nil || cfg.StartFilterHeader == nil {
+		return fmt.Errorf("start header and start filter header are required with a start height")
+	}
+	for _, fType := range cfg.FilterTypes {
+		if fType != wire.GCSFilterRegular {
+			return fmt.Errorf("filter type %v can't be synced with a start height", fType)
+		}
+	}
+	hash := cfg.StartHeader.BlockHash()
+	for _, cp := range cfg.ChainParams.Checkpoints {
+		if uint32(cp.Height) == cfg.StartHeight && *cp.Hash != hash {
+			return fmt.Errorf(
+				"start header %v doesn't match checkpoint %v at height %v",
+				hash, cp.Hash, cp.Height,
+			)
+		}
+	}
+	return nil
+}
+
 // disconnectPeer attempts to drop the connection of a tageted peer in the passed peer list. Targets are identified via
 // usage of the passed `compareFunc`, which should return `true` if the passed peer is the target peer. This function
 // returns true on success and false if the peer is unable to be located. If the peer is found, and the passed callback:
@@ -1155,10 +1803,9 @@ func disconnectPeer(
 
 // newPeerConfig returns the configuration for the given ServerPeer.
 func newPeerConfig(sp *ServerPeer) *peer.Config {
-	return &peer.Config{
+	cfg := &peer.Config{
 		Listeners: peer.MessageListeners{
-			OnVersion: sp.OnVersion,
-			// OnVerAck:    sp.OnVerAck, // Don't use sendheaders yet
+			OnVersion:   sp.OnVersion,
 			OnInv:       sp.OnInv,
 			OnHeaders:   sp.OnHeaders,
 			OnReject:    sp.OnReject,
@@ -1180,6 +1827,18 @@ func newPeerConfig(sp *ServerPeer) *peer.Config {
 		ProtocolVersion:  wire.FeeFilterVersion,
 		DisableRelayTx:   true,
 	}
+	if sp.server.sendHeaders {
+		cfg.Listeners.OnVerAck = sp.OnVerAck
+	}
+	if sp.server.onUnknownMessage != nil {
+		cfg.Listeners.OnUnknownMessage = sp.OnUnknownMessage
+	}
+	if sp.server.serveFilters {
+		cfg.Listeners.OnGetCFilters = sp.OnGetCFilters
+		cfg.Listeners.OnGetCFHeaders = sp.OnGetCFHeaders
+		cfg.Listeners.OnGetCFCheckpt = sp.OnGetCFCheckpt
+	}
+	return cfg
 }
 
 // newServerPeer returns a new ServerPeer instance. The peer needs to be set by the caller.
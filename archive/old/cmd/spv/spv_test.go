@@ -0,0 +1,1816 @@
+package spv
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	
+	"github.com/p9c/pod/pkg/util/qu"
+	
+	"github.com/p9c/pod/pkg/addrmgr"
+	"github.com/p9c/pod/pkg/block"
+	"github.com/p9c/pod/pkg/blockchain"
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/chaincfg"
+	"github.com/p9c/pod/pkg/connmgr"
+	"github.com/p9c/pod/pkg/gcs"
+	"github.com/p9c/pod/pkg/gcs/builder"
+	"github.com/p9c/pod/pkg/peer"
+	"github.com/p9c/pod/pkg/rpcclient"
+	"github.com/p9c/pod/pkg/util"
+	"github.com/p9c/pod/pkg/walletdb"
+	_ "github.com/p9c/pod/pkg/walletdb/bdb"
+	"github.com/p9c/pod/pkg/wire"
+	
+	"github.com/p9c/pod/cmd/spv/cache"
+	"github.com/p9c/pod/cmd/spv/cache/lru"
+	"github.com/p9c/pod/cmd/spv/filterdb"
+	"github.com/p9c/pod/cmd/spv/headerfs"
+	"github.com/p9c/pod/cmd/spv/headerlist"
+)
+
+// TestReorgHeadersBounded simulates a flapping chain that repeatedly reorgs a few blocks below a slowly advancing tip
+// and ensures the in-memory reorged headers don't grow without bound.
+func TestReorgHeadersBounded(t *testing.T) {
+	oldMax, oldDepth := MaxReorgHeaders, ReorgHeaderDepth
+	defer func() {
+		MaxReorgHeaders, ReorgHeaderDepth = oldMax, oldDepth
+	}()
+	MaxReorgHeaders = 50
+	ReorgHeaderDepth = 20
+	s := &ChainService{
+		reorgedBlockHeaders: make(map[chainhash.Hash]reorgHeader),
+	}
+	var nonce uint32
+	for tip := uint32(100); tip < 1000; tip++ {
+		// Each round rolls back a shallow reorg of up to three blocks, with each rolled back to tip being a new header
+		// as the competing chains keep changing.
+		for depth := uint32(1); depth <= tip%3+1; depth++ {
+			nonce++
+			header := &wire.BlockHeader{Nonce: nonce}
+			hash := header.BlockHash()
+			s.addReorgHeader(hash, header, tip-depth)
+			if s.getReorgTip(hash) != header {
+				t.Fatalf("header at height %v not found after it was added", tip-depth)
+			}
+		}
+		if len(s.reorgedBlockHeaders) > MaxReorgHeaders {
+			t.Fatalf(
+				"expected at most %v reorged headers, got %v",
+				MaxReorgHeaders, len(s.reorgedBlockHeaders),
+			)
+		}
+		for _, rh := range s.reorgedBlockHeaders {
+			if rh.height+ReorgHeaderDepth+3 < tip {
+				t.Fatalf(
+					"header at height %v retained past depth %v from tip %v",
+					rh.height, ReorgHeaderDepth, tip,
+				)
+			}
+		}
+	}
+	// Reorgs that all land on the same height can't be swept by depth, so the cap must drop the excess.
+	MaxReorgHeaders = 10
+	for i := 0; i < 100; i++ {
+		nonce++
+		header := &wire.BlockHeader{Nonce: nonce}
+		s.addReorgHeader(header.BlockHash(), header, 2000)
+	}
+	if len(s.reorgedBlockHeaders) != MaxReorgHeaders {
+		t.Fatalf(
+			"expected %v reorged headers, got %v", MaxReorgHeaders,
+			len(s.reorgedBlockHeaders),
+		)
+	}
+}
+
+// TestRequestTracker ensures stalled requests are signalled once past their deadline, and that only peers which fail to
+// deliver MaxUndeliveredRequests requests in a row are reported for banning.
+func TestRequestTracker(t *testing.T) {
+	newPeer := func(addr string) *ServerPeer {
+		p, e := peer.NewOutboundPeer(&peer.Config{ChainParams: &chaincfg.SimNetParams}, addr)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return &ServerPeer{Peer: p}
+	}
+	slow, flaky := newPeer("10.0.0.1:11047"), newPeer("10.0.0.2:11047")
+	rt := newRequestTracker()
+	now := time.Now()
+	for i := uint32(0); i < MaxUndeliveredRequests*2; i++ {
+		slowReq := rt.add(slow, time.Second)
+		flakyReq := rt.add(flaky, time.Second)
+		// The flaky peer delivers every other request, which resets its count.
+		if i%2 == 0 {
+			rt.delivered(flakyReq)
+		}
+		if chronic := rt.expire(now); len(chronic) != 0 {
+			t.Fatalf("requests expired before their deadline")
+		}
+		select {
+		case <-slowReq.stalled.Wait():
+			t.Fatalf("request signalled stalled before its deadline")
+		default:
+		}
+		chronic := rt.expire(now.Add(time.Second * 2))
+		select {
+		case <-slowReq.stalled.Wait():
+		default:
+			t.Fatalf("request past its deadline wasn't signalled stalled")
+		}
+		wantChronic := (i+1)%MaxUndeliveredRequests == 0
+		if wantChronic != (len(chronic) == 1) || (wantChronic && chronic[0] != slow) {
+			t.Fatalf("request %d: unexpected chronic peers %v", i, chronic)
+		}
+	}
+	if len(rt.outstanding) != 0 {
+		t.Fatalf("expected no outstanding requests, got %d", len(rt.outstanding))
+	}
+	// A cancelled request doesn't count against the peer.
+	rt.cancel(rt.add(slow, 0))
+	if chronic := rt.expire(now.Add(time.Hour)); len(chronic) != 0 || rt.undelivered[slow.Addr()] != 0 {
+		t.Fatalf("cancelled request was counted against the peer")
+	}
+}
+
+// TestTrackedQueryFindsPeer starts a tracked filter query with no sync peer and checks that it asks a connected peer
+// once the peer timeout ticks, instead of waiting out the connect timeout without asking anyone.
+func TestTrackedQueryFindsPeer(t *testing.T) {
+	s := &ChainService{
+		chainParams: chaincfg.SimNetParams,
+		query:       make(chan interface{}),
+		quit:        qu.T(),
+	}
+	s.blockManager = &blockManager{requests: newRequestTracker(), quit: qu.T()}
+	sp, remote := connectGenesisPeer(t, s, func(*wire.MsgGetCFHeaders) *wire.MsgCFHeaders { return nil })
+	defer remote.Disconnect()
+	defer sp.Disconnect()
+	go func() {
+		for {
+			select {
+			case msg := <-s.query:
+				msg.(getPeersMsg).reply <- []*ServerPeer{sp}
+			case <-s.quit.Wait():
+				return
+			}
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		queryChainServicePeers(
+			s, wire.NewMsgGetCFilters(wire.GCSFilterRegular, 1, &chainhash.Hash{}),
+			func(*ServerPeer, wire.Message, chan<- struct{}) {},
+			Timeout(time.Millisecond*10), PeerConnectTimeout(time.Second*10),
+		)
+		close(done)
+	}()
+	for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(time.Millisecond) {
+		s.blockManager.requests.mtx.Lock()
+		var asked bool
+		for request := range s.blockManager.requests.outstanding {
+			asked = asked || request.peer == sp
+		}
+		s.blockManager.requests.mtx.Unlock()
+		if asked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the query didn't ask the connected peer")
+		}
+	}
+	s.quit.Q()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the query didn't end when the chain service quit")
+	}
+}
+
+// TestPreferPeer checks that a query with PreferPeer asks the preferred peer rather than the sync peer.
+func TestPreferPeer(t *testing.T) {
+	s := &ChainService{
+		chainParams: chaincfg.SimNetParams,
+		query:       make(chan interface{}),
+		quit:        qu.T(),
+	}
+	defer s.quit.Q()
+	s.blockManager = &blockManager{requests: newRequestTracker(), quit: qu.T()}
+	asked := make(chan string, 2)
+	answer := func(addr string) func(*wire.MsgGetCFHeaders) *wire.MsgCFHeaders {
+		return func(msg *wire.MsgGetCFHeaders) *wire.MsgCFHeaders {
+			asked <- addr
+			resp := wire.NewMsgCFHeaders()
+			resp.FilterType = msg.FilterType
+			resp.StopHash = msg.StopHash
+			return resp
+		}
+	}
+	syncPeer, syncRemote := connectCFHeadersPeer(t, s, "10.0.0.2:11047", answer("sync"))
+	defer syncRemote.Disconnect()
+	defer syncPeer.Disconnect()
+	preferred, preferredRemote := connectCFHeadersPeer(t, s, "10.0.0.3:11047", answer("preferred"))
+	defer preferredRemote.Disconnect()
+	defer preferred.Disconnect()
+	s.blockManager.syncPeer = syncPeer
+	go func() {
+		for {
+			select {
+			case msg := <-s.query:
+				msg.(getPeersMsg).reply <- []*ServerPeer{syncPeer, preferred}
+			case <-s.quit.Wait():
+				return
+			}
+		}
+	}()
+	queryChainServicePeers(
+		s, wire.NewMsgGetCFHeaders(wire.GCSFilterRegular, 1, &chainhash.Hash{}),
+		func(_ *ServerPeer, resp wire.Message, quit chan<- struct{}) {
+			if _, ok := resp.(*wire.MsgCFHeaders); ok {
+				close(quit)
+			}
+		},
+		Timeout(time.Second), PreferPeer(preferred.Addr()),
+	)
+	select {
+	case addr := <-asked:
+		if addr != "preferred" {
+			t.Fatalf("the %s peer was asked, want the preferred peer", addr)
+		}
+	default:
+		t.Fatal("no peer was asked")
+	}
+	select {
+	case addr := <-asked:
+		t.Fatalf("the %s peer was also asked", addr)
+	default:
+	}
+}
+
+// TestAddressExhaustion ensures running out of addresses is counted and reported, and that the next attempt waits out a
+// backoff which doubles up to its maximum.
+func TestAddressExhaustion(t *testing.T) {
+	defer func(backoff, max time.Duration) {
+		AddressExhaustionBackoff, MaxAddressExhaustionBackoff = backoff, max
+	}(AddressExhaustionBackoff, MaxAddressExhaustionBackoff)
+	AddressExhaustionBackoff = time.Millisecond * 20
+	MaxAddressExhaustionBackoff = time.Millisecond * 30
+	exhausted := make(chan struct{}, 3)
+	s := &ChainService{
+		addrManager:         addrmgr.New(t.TempDir(), nil),
+		quit:                qu.T(),
+		onAddressExhaustion: func() { exhausted <- struct{}{} },
+	}
+	// The backoff starts when an attempt runs out, so each wait is measured from when the attempt before returned.
+	last := time.Now()
+	for i, wantDelay := range []time.Duration{0, 20, 30} {
+		if _, e := s.newAddress(); e != ErrNoValidAddress {
+			t.Fatalf("attempt %d: got error %v, want %v", i, e, ErrNoValidAddress)
+		}
+		if waited := time.Since(last); waited < wantDelay*time.Millisecond {
+			t.Fatalf("attempt %d: waited %v, want at least %v", i, waited, wantDelay*time.Millisecond)
+		}
+		last = time.Now()
+		select {
+		case <-exhausted:
+		case <-time.After(time.Second):
+			t.Fatalf("attempt %d: exhaustion callback not called", i)
+		}
+	}
+	if n := s.AddressExhaustions(); n != 3 {
+		t.Fatalf("counted %d exhaustions, want 3", n)
+	}
+	// Shutting down ends the wait.
+	s.quit.Q()
+	if _, e := s.newAddress(); e != ErrShuttingDown {
+		t.Fatalf("got error %v after shutdown, want %v", e, ErrShuttingDown)
+	}
+}
+
+// TestGroupKey checks that peers are grouped by the autonomous system AddressASN returns for them, and by their network
+// group when it doesn't know them or isn't set.
+func TestGroupKey(t *testing.T) {
+	na := func(ip string) *wire.NetAddress {
+		return wire.NewNetAddressIPPort(net.ParseIP(ip), 11047, 0)
+	}
+	s := &ChainService{}
+	if got, want := s.groupKey(na("1.2.3.4")), addrmgr.GroupKey(na("1.2.3.4")); got != want {
+		t.Fatalf("got group %q without AddressASN, want %q", got, want)
+	}
+	s.addressASN = func(ip net.IP) (uint32, bool) {
+		if ip.To4()[0] == 1 {
+			return 64500, true
+		}
+		return 0, false
+	}
+	if a, b := s.groupKey(na("1.2.3.4")), s.groupKey(na("1.9.3.4")); a != b || a != "AS64500" {
+		t.Fatalf("got groups %q and %q for addresses in AS64500", a, b)
+	}
+	if got, want := s.groupKey(na("5.6.7.8")), addrmgr.GroupKey(na("5.6.7.8")); got != want {
+		t.Fatalf("got group %q for an address in no known system, want %q", got, want)
+	}
+}
+
+// TestPeerDiversity ensures connected peers from too few network groups are reported once until enough groups are
+// connected again, and that a peer from the commonest group is disconnected when asked to diversify.
+func TestPeerDiversity(t *testing.T) {
+	type report struct{ groups, peers int }
+	reports := make(chan report, 2)
+	s := &ChainService{
+		minPeerDiversity:   3,
+		diversifyPeers:     true,
+		onLowPeerDiversity: func(groups, peers int) { reports <- report{groups, peers} },
+	}
+	state := &peerState{
+		outboundPeers:   make(map[int32]*ServerPeer),
+		persistentPeers: make(map[int32]*ServerPeer),
+		outboundGroups:  make(map[string]int),
+	}
+	addPeer := func(id int32, addr string) {
+		p, e := peer.NewOutboundPeer(&peer.Config{ChainParams: &chaincfg.SimNetParams}, addr)
+		if e != nil {
+			t.Fatal(e)
+		}
+		sp := &ServerPeer{Peer: p}
+		state.outboundPeers[id] = sp
+		state.outboundGroups[addrmgr.GroupKey(sp.NA())]++
+	}
+	removePeer := func(id int32) {
+		state.outboundGroups[addrmgr.GroupKey(state.outboundPeers[id].NA())]--
+		delete(state.outboundPeers, id)
+	}
+	addPeer(1, "1.2.3.4:11047")
+	addPeer(2, "1.2.5.6:11047")
+	addPeer(3, "5.6.7.8:11047")
+	s.checkPeerDiversity(state)
+	select {
+	case r := <-reports:
+		if r.groups != 2 || r.peers != 3 {
+			t.Fatalf("reported %d groups and %d peers, want 2 and 3", r.groups, r.peers)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("low diversity not reported")
+	}
+	// Only one of the peers in the commonest group is disconnected.
+	var disconnected []int32
+	for id, sp := range state.outboundPeers {
+		if isDisconnected(sp) {
+			disconnected = append(disconnected, id)
+		}
+	}
+	if len(disconnected) != 1 || disconnected[0] == 3 {
+		t.Fatalf("disconnected peers %v, want one of 1 and 2", disconnected)
+	}
+	removePeer(disconnected[0])
+	// Diversity is still low, so the next check doesn't report it again, and with one peer in each group none are
+	// disconnected. Once there are enough groups again the next drop is reported anew.
+	s.checkPeerDiversity(state)
+	addPeer(4, "9.10.11.12:11047")
+	s.checkPeerDiversity(state)
+	removePeer(4)
+	s.checkPeerDiversity(state)
+	select {
+	case <-reports:
+	case <-time.After(time.Second):
+		t.Fatal("second drop in diversity not reported")
+	}
+	select {
+	case r := <-reports:
+		t.Fatalf("unexpected report of %d groups", r.groups)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// isDisconnected returns whether the peer is disconnected within a short wait.
+func isDisconnected(sp *ServerPeer) bool {
+	done := make(chan struct{})
+	go func() {
+		sp.WaitForDisconnect()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Millisecond * 100):
+		return false
+	}
+}
+
+// newTestDB returns a database in a temporary directory, and the directory, and closes the database when the test ends.
+func newTestDB(t *testing.T) (walletdb.DB, string) {
+	t.Helper()
+	dir := t.TempDir()
+	db, e := walletdb.Create("bdb", dir+"/headers.db")
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, dir
+}
+
+// newTestChainService returns a service for the params with block and regular filter header stores that hold only the
+// genesis block, in a temporary database. Its quit channel is closed when the test ends.
+func newTestChainService(t *testing.T, params chaincfg.Params) *ChainService {
+	t.Helper()
+	db, dir := newTestDB(t)
+	blockHeaders, e := headerfs.NewBlockHeaderStore(dir, db, &params)
+	if e != nil {
+		t.Fatal(e)
+	}
+	filterHeaders, e := headerfs.NewFilterHeaderStore(dir, db, headerfs.RegularFilter, &params)
+	if e != nil {
+		t.Fatal(e)
+	}
+	s := &ChainService{
+		BlockHeaders:     blockHeaders,
+		RegFilterHeaders: filterHeaders,
+		chainParams:      params,
+		db:               db,
+		syncFilterTypes:  []wire.FilterType{wire.GCSFilterRegular},
+		filterHeaders:    map[wire.FilterType]*headerfs.FilterHeaderStore{wire.GCSFilterRegular: filterHeaders},
+		headerCacheSize:  DefaultHeaderCacheSize,
+		quit:             qu.T(),
+	}
+	t.Cleanup(s.quit.Q)
+	return s
+}
+
+// TestCheckpoint checkpoints header stores whose filter headers lag the block headers and checks that the recorded
+// verified tip is the filter header tip, and that it follows the filter headers once they catch up.
+func TestCheckpoint(t *testing.T) {
+	// The main network's genesis hash is the hash of its genesis header, which the index looks the filter tip up by.
+	params := chaincfg.MainNetParams
+	s := newTestChainService(t, params)
+	blockHeaders, filterHeaders := s.BlockHeaders, s.RegFilterHeaders
+	if tip, e := s.LastCheckpoint(); e != nil || tip != nil {
+		t.Fatalf("got checkpoint %v (%v) before the first one", tip, e)
+	}
+	header := wire.BlockHeader{PrevBlock: *params.GenesisHash, Nonce: 1}
+	if e := blockHeaders.WriteHeaders(headerfs.BlockHeader{BlockHeader: &header, Height: 1}); e != nil {
+		t.Fatal(e)
+	}
+	checkTip := func(height int32, hash chainhash.Hash) {
+		if e := s.Checkpoint(); e != nil {
+			t.Fatal(e)
+		}
+		tip, e := s.LastCheckpoint()
+		if e != nil {
+			t.Fatal(e)
+		}
+		if tip == nil || tip.Height != height || tip.Hash != hash {
+			t.Fatalf("checkpoint is %v, want height %d (%s)", tip, height, hash)
+		}
+	}
+	// Only the genesis block has a filter header so far.
+	checkTip(0, *params.GenesisHash)
+	e := filterHeaders.WriteHeaders(headerfs.FilterHeader{HeaderHash: header.BlockHash(), Height: 1})
+	if e != nil {
+		t.Fatal(e)
+	}
+	checkTip(1, header.BlockHash())
+}
+
+// TestResumeFromCheckpoint checks that header stores that went past the last checkpoint are rolled back to it when the
+// block manager is created, and that a checkpoint of a block no longer in the chain is left alone.
+func TestResumeFromCheckpoint(t *testing.T) {
+	params := chaincfg.MainNetParams
+	s := newTestChainService(t, params)
+	s.reorgedBlockHeaders = make(map[chainhash.Hash]reorgHeader)
+	prev := *params.GenesisHash
+	writeHeaders := func(from, to uint32, nonce uint32) {
+		for height := from; height <= to; height++ {
+			header := wire.BlockHeader{PrevBlock: prev, Nonce: nonce + height}
+			prev = header.BlockHash()
+			if e := s.BlockHeaders.WriteHeaders(headerfs.BlockHeader{BlockHeader: &header, Height: height}); e != nil {
+				t.Fatal(e)
+			}
+			e := s.RegFilterHeaders.WriteHeaders(headerfs.FilterHeader{HeaderHash: prev, Height: height})
+			if e != nil {
+				t.Fatal(e)
+			}
+		}
+	}
+	checkTips := func(want uint32) {
+		bm, e := newBlockManager(s)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if bm.headerTip != want || bm.filterHeaderTip != want {
+			t.Fatalf("tips are at %d and %d, want %d", bm.headerTip, bm.filterHeaderTip, want)
+		}
+	}
+	writeHeaders(1, 2, 0)
+	if e := s.Checkpoint(); e != nil {
+		t.Fatal(e)
+	}
+	checkTips(2)
+	// The headers written after the checkpoint are dropped.
+	writeHeaders(3, 4, 0)
+	checkTips(2)
+	// Headers on another branch replace the checkpointed block, which isn't rolled back to.
+	if _, e := s.rollBackToHeight(1); e != nil {
+		t.Fatal(e)
+	}
+	header, e := s.BlockHeaders.FetchHeaderByHeight(1)
+	if e != nil {
+		t.Fatal(e)
+	}
+	prev = header.BlockHash()
+	writeHeaders(2, 3, 10)
+	checkTips(3)
+}
+
+// TestFilterHeaderAgreement has three peers answer for the filter header at the tip, one of them with another header,
+// and checks that the block handler isn't held up while they answer, that the one that disagreed is disconnected, and
+// that the sync peer is chosen from those that agreed.
+func TestFilterHeaderAgreement(t *testing.T) {
+	s := newTestChainService(t, chaincfg.MainNetParams)
+	s.filterHeaderAgreementPeers = 3
+	s.query = make(chan interface{})
+	s.blockManager = &blockManager{server: s, peerChan: make(chan interface{}, 1), quit: qu.T()}
+	release := make(chan struct{})
+	answerWith := func(hash chainhash.Hash) func(*wire.MsgGetCFHeaders) *wire.MsgCFHeaders {
+		return func(msg *wire.MsgGetCFHeaders) *wire.MsgCFHeaders {
+			<-release
+			resp := wire.NewMsgCFHeaders()
+			resp.FilterType = msg.FilterType
+			resp.StopHash = msg.StopHash
+			if e := resp.AddCFHash(&hash); e != nil {
+				t.Error(e)
+			}
+			return resp
+		}
+	}
+	var peers []*ServerPeer
+	for i, hash := range []chainhash.Hash{{1}, {1}, {2}} {
+		sp, remote := connectCFHeadersPeer(t, s, fmt.Sprintf("10.0.0.%d:11047", i+2), answerWith(hash))
+		defer remote.Disconnect()
+		defer sp.Disconnect()
+		peers = append(peers, sp)
+	}
+	go func() {
+		for {
+			select {
+			case msg := <-s.query:
+				msg.(getPeersMsg).reply <- peers
+			case <-s.quit.Wait():
+				return
+			}
+		}
+	}()
+	candidates := list.New()
+	candidates.PushBack(peers[2])
+	candidates.PushBack(peers[0])
+	returned := make(chan struct{})
+	go func() {
+		s.blockManager.startSync(candidates)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		close(release)
+		t.Fatal("the block handler waited for the peers to answer")
+	}
+	if s.blockManager.SyncPeer() != nil || len(s.blockManager.peerChan) != 0 {
+		t.Fatal("sync started before the peers answered")
+	}
+	close(release)
+	var msg *filterAgreementMsg
+	select {
+	case m := <-s.blockManager.peerChan:
+		msg = m.(*filterAgreementMsg)
+	case <-time.After(time.Second * 5):
+		t.Fatal("the filter header agreement wasn't sent to the block handler")
+	}
+	if len(msg.agreed) != 2 {
+		t.Fatalf("%d peers agreed, want 2", len(msg.agreed))
+	}
+	for _, sp := range peers[:2] {
+		if _, ok := msg.agreed[sp.Addr()]; !ok {
+			t.Fatalf("peer %s agreed but isn't counted", sp)
+		}
+	}
+	if !isDisconnected(peers[2]) {
+		t.Fatal("the peer that disagreed wasn't disconnected")
+	}
+	s.blockManager.handleFilterAgreementMsg(candidates, msg)
+	if sp := s.blockManager.SyncPeer(); sp != peers[0] {
+		t.Fatalf("sync peer is %v, want %v", sp, peers[0])
+	}
+}
+
+// TestFilterHeaderMajority checks which filter header wins a sample of peers and which peers are outliers.
+func TestFilterHeaderMajority(t *testing.T) {
+	a, b, c := chainhash.Hash{1}, chainhash.Hash{2}, chainhash.Hash{3}
+	tests := []struct {
+		name     string
+		headers  map[string]chainhash.Hash
+		majority chainhash.Hash
+		outliers []string
+		ok       bool
+	}{
+		{"unanimous", map[string]chainhash.Hash{"p1": a, "p2": a, "p3": a}, a, nil, true},
+		{"lone outlier", map[string]chainhash.Hash{"p1": a, "p2": b, "p3": a}, a, []string{"p2"}, true},
+		{"split", map[string]chainhash.Hash{"p1": a, "p2": b, "p3": a, "p4": b}, chainhash.Hash{}, nil, false},
+		{"plurality", map[string]chainhash.Hash{"p1": a, "p2": b, "p3": a, "p4": b, "p5": c}, chainhash.Hash{}, nil, false},
+		{"single peer", map[string]chainhash.Hash{"p1": c}, c, nil, true},
+	}
+	for _, test := range tests {
+		majority, outliers, ok := filterHeaderMajority(test.headers)
+		if ok != test.ok || majority != test.majority {
+			t.Errorf("%s: got majority %v (%v), want %v (%v)", test.name, majority, ok, test.majority, test.ok)
+		}
+		if len(outliers) != len(test.outliers) || len(outliers) == 1 && outliers[0] != test.outliers[0] {
+			t.Errorf("%s: got outliers %v, want %v", test.name, outliers, test.outliers)
+		}
+	}
+}
+
+// TestRescanSlots ensures a rescan waits while the maximum number are running, is counted as queued meanwhile, and
+// runs once a slot is freed, and that a queued rescan can quit.
+func TestRescanSlots(t *testing.T) {
+	s := &ChainService{rescanSlots: make(chan struct{}, 1), quit: qu.T()}
+	release, e := s.acquireRescanSlot(nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	acquired := make(chan func())
+	go func() {
+		release, e := s.acquireRescanSlot(nil)
+		if e != nil {
+			t.Error(e)
+		}
+		acquired <- release
+	}()
+	deadline := time.Now().Add(time.Second)
+	for s.QueuedRescans() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d rescans queued, want 1", s.QueuedRescans())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-acquired:
+		t.Fatal("second rescan got a slot while the first was running")
+	case <-time.After(time.Millisecond * 50):
+	}
+	release()
+	select {
+	case release = <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("second rescan didn't get the freed slot")
+	}
+	if s.QueuedRescans() != 0 {
+		t.Fatalf("%d rescans queued after the second started", s.QueuedRescans())
+	}
+	quit := qu.T()
+	quit.Q()
+	if _, e = s.acquireRescanSlot(quit); e != ErrRescanExit {
+		t.Fatalf("queued rescan that quit returned %v, want %v", e, ErrRescanExit)
+	}
+	release()
+}
+
+// TestRescanSlotReleasedAtTip runs a rescan with the only rescan slot and checks that a second rescan, queued behind it,
+// starts once the first has caught up with the tip, while the first keeps running.
+func TestRescanSlotReleasedAtTip(t *testing.T) {
+	s := newTestChainService(t, chaincfg.MainNetParams)
+	s.blockSubscribers = make(map[*blockSubscription]struct{})
+	s.rescanSlots = make(chan struct{}, 1)
+	s.blockManager = &blockManager{quit: qu.T()}
+	s.blockManager.newFilterHeadersSignal = sync.NewCond(&s.blockManager.newFilterHeadersMtx)
+	running := func() int {
+		s.mtxReset.Lock()
+		defer s.mtxReset.Unlock()
+		return s.rescansRunning
+	}
+	waitRunning := func(want int) {
+		for deadline := time.Now().Add(time.Second * 5); running() != want; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d rescans running, want %d", running(), want)
+			}
+		}
+	}
+	var quits []qu.C
+	done := make(chan error, 2)
+	for i := 1; i <= 2; i++ {
+		quit := qu.T()
+		quits = append(quits, quit)
+		go func() { done <- s.rescan(QuitChan(quit)) }()
+		waitRunning(i)
+	}
+	if queued := s.QueuedRescans(); queued != 0 {
+		t.Fatalf("%d rescans queued after the first caught up, want 0", queued)
+	}
+	for _, quit := range quits {
+		quit.Q()
+		select {
+		case e := <-done:
+			if e != ErrRescanExit {
+				t.Fatalf("rescan returned %v, want %v", e, ErrRescanExit)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("rescan didn't quit")
+		}
+	}
+	if len(s.rescanSlots) != 0 {
+		t.Fatalf("%d rescan slots still taken", len(s.rescanSlots))
+	}
+}
+
+// TestBanList bans two peers for different reasons and checks that their ban records hold the reason, source and ban
+// score, oldest first, and that expired bans are left out.
+func TestBanList(t *testing.T) {
+	s := &ChainService{}
+	state := &peerState{banned: make(map[string]*BanEntry)}
+	newPeer := func(addr string) *ServerPeer {
+		p, e := peer.NewOutboundPeer(&peer.Config{ChainParams: &chaincfg.SimNetParams}, addr)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return &ServerPeer{Peer: p}
+	}
+	stalled := newPeer("1.2.3.4:11047")
+	stalled.banScore.Increase(100, 0)
+	s.handleBanPeerMsg(state, banPeerMsg{peer: stalled, source: BanSourceRequests, reason: "undelivered requests"})
+	s.handleBanPeerMsg(state, banPeerMsg{peer: newPeer("5.6.7.8:11047"), source: BanSourceCaller, reason: "test"})
+	bans := state.banList(time.Now())
+	if len(bans) != 2 {
+		t.Fatalf("%d bans listed, want 2", len(bans))
+	}
+	first := bans[0]
+	if first.Host != "1.2.3.4" || first.Source != BanSourceRequests || first.Reason != "undelivered requests" ||
+		first.BanScore != 100 {
+		t.Fatalf("first ban is %+v", first)
+	}
+	if first.Until.Sub(first.BannedAt) != BanDuration {
+		t.Fatalf("ban lasts %v, want %v", first.Until.Sub(first.BannedAt), BanDuration)
+	}
+	if bans[1].Host != "5.6.7.8" || bans[1].Source != BanSourceCaller || bans[1].BanScore != 0 {
+		t.Fatalf("second ban is %+v", bans[1])
+	}
+	if bans = state.banList(time.Now().Add(BanDuration)); len(bans) != 0 {
+		t.Fatalf("%d bans listed after they expired", len(bans))
+	}
+}
+
+// TestSetMaxPeers lowers the max peers below the number connected and checks that only the newest outbound peers are
+// disconnected, and that the connection manager target follows the limit.
+func TestSetMaxPeers(t *testing.T) {
+	s := &ChainService{maxPeers: MaxPeers}
+	state := &peerState{
+		outboundPeers:   make(map[int32]*ServerPeer),
+		persistentPeers: make(map[int32]*ServerPeer),
+	}
+	newPeer := func(addr string) *ServerPeer {
+		p, e := peer.NewOutboundPeer(&peer.Config{ChainParams: &chaincfg.SimNetParams}, addr)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return &ServerPeer{Peer: p}
+	}
+	for id := int32(1); id <= 4; id++ {
+		state.outboundPeers[id] = newPeer(fmt.Sprintf("1.2.3.%d:11047", id))
+	}
+	state.persistentPeers[5] = newPeer("5.6.7.8:11047")
+	s.handleSetMaxPeers(state, 2)
+	for id, sp := range state.outboundPeers {
+		if want := id > 1; isDisconnected(sp) != want {
+			t.Fatalf("peer %d disconnected is %v, want %v", id, !want, want)
+		}
+	}
+	if isDisconnected(state.persistentPeers[5]) {
+		t.Fatal("persistent peer disconnected")
+	}
+	if s.targetOutbound() != 2 {
+		t.Fatalf("target outbound is %d, want 2", s.targetOutbound())
+	}
+}
+
+// TestPermanenceChange checks that the peer of a connection request promoted to permanent or demoted to transient is
+// moved to the peers of its kind, and that other peers stay where they are.
+func TestPermanenceChange(t *testing.T) {
+	s := &ChainService{}
+	state := &peerState{
+		outboundPeers:   make(map[int32]*ServerPeer),
+		persistentPeers: make(map[int32]*ServerPeer),
+	}
+	newPeer := func(permanent bool) *ServerPeer {
+		return &ServerPeer{connReq: &connmgr.ConnReq{Permanent: permanent}, persistent: !permanent}
+	}
+	promoted, demoted, other := newPeer(true), newPeer(false), newPeer(true)
+	state.outboundPeers[1], state.persistentPeers[2], state.outboundPeers[3] = promoted, demoted, other
+	s.handlePermanenceChange(state, promoted.connReq)
+	s.handlePermanenceChange(state, demoted.connReq)
+	if state.persistentPeers[1] != promoted || !promoted.persistent || state.outboundPeers[1] != nil {
+		t.Fatal("promoted peer not moved to the persistent peers")
+	}
+	if state.outboundPeers[2] != demoted || demoted.persistent || state.persistentPeers[2] != nil {
+		t.Fatal("demoted peer not moved to the outbound peers")
+	}
+	if state.outboundPeers[3] != other || other.persistent {
+		t.Fatal("peer of another request moved")
+	}
+}
+
+// TestWatchScripts checks that a transaction paying to a watched raw script is matched and that its output is then
+// watched for spends alongside the inputs given with WatchInputs.
+func TestWatchScripts(t *testing.T) {
+	script := []byte{0x6a, 0x51, 0x52}
+	watchedInput := InputWithScript{OutPoint: wire.OutPoint{Hash: chainhash.Hash{1}}, PkScript: []byte{0x51}}
+	ro := defaultRescanOptions()
+	for _, option := range []RescanOption{WatchScripts(script), WatchInputs(watchedInput)} {
+		option(ro)
+	}
+	other := util.NewTx(&wire.MsgTx{TxOut: []*wire.TxOut{{PkScript: []byte{0x52}}}})
+	if pays, e := ro.paysWatchedAddr(other); e != nil || pays {
+		t.Fatalf("transaction paying to another script matched with error %v", e)
+	}
+	pays := util.NewTx(
+		&wire.MsgTx{
+			TxIn:  []*wire.TxIn{{PreviousOutPoint: watchedInput.OutPoint}},
+			TxOut: []*wire.TxOut{{PkScript: []byte{0x52}}, {PkScript: script}},
+		},
+	)
+	if !ro.spendsWatchedInput(pays) {
+		t.Fatal("transaction spending a watched input didn't match")
+	}
+	if matched, e := ro.paysWatchedAddr(pays); e != nil || !matched {
+		t.Fatalf("transaction paying to a watched script didn't match, error %v", e)
+	}
+	spends := util.NewTx(
+		&wire.MsgTx{TxIn: []*wire.TxIn{{PreviousOutPoint: wire.OutPoint{Hash: *pays.Hash(), Index: 1}}}},
+	)
+	if !ro.spendsWatchedInput(spends) {
+		t.Fatal("transaction spending the output paying to a watched script didn't match")
+	}
+	if len(ro.watchInputs) != 2 {
+		t.Fatalf("%d inputs watched, want the given one and the new output", len(ro.watchInputs))
+	}
+}
+
+// TestMatchReasons checks the reasons given for the transactions relevant to a rescan, and that both handlers of
+// filtered blocks get them.
+func TestMatchReasons(t *testing.T) {
+	script := []byte{0x6a, 0x51, 0x52}
+	watchedInput := InputWithScript{OutPoint: wire.OutPoint{Hash: chainhash.Hash{1}}, PkScript: []byte{0x51}}
+	var connected []*util.Tx
+	var matched []TxMatch
+	ro := defaultRescanOptions()
+	for _, option := range []RescanOption{
+		WatchScripts(script), WatchInputs(watchedInput),
+		NotificationHandlers(
+			rpcclient.NotificationHandlers{
+				OnFilteredBlockConnected: func(_ int32, _ *wire.BlockHeader, txs []*util.Tx) {
+					connected = txs
+				},
+			},
+		),
+		OnFilteredBlockMatches(
+			func(_ int32, _ *wire.BlockHeader, matches []TxMatch) {
+				matched = matches
+			},
+		),
+	} {
+		option(ro)
+	}
+	receive := util.NewTx(&wire.MsgTx{TxOut: []*wire.TxOut{{PkScript: script}}})
+	both := util.NewTx(
+		&wire.MsgTx{
+			TxIn:  []*wire.TxIn{{PreviousOutPoint: watchedInput.OutPoint}},
+			TxOut: []*wire.TxOut{{PkScript: script}},
+		},
+	)
+	spend := util.NewTx(
+		&wire.MsgTx{TxIn: []*wire.TxIn{{PreviousOutPoint: wire.OutPoint{Hash: *receive.Hash()}}}},
+	)
+	other := util.NewTx(&wire.MsgTx{TxOut: []*wire.TxOut{{PkScript: []byte{0x52}}}})
+	for _, test := range []struct {
+		tx   *util.Tx
+		want MatchReason
+	}{
+		{receive, MatchReceive}, {both, MatchSpend | MatchReceive}, {spend, MatchSpend}, {other, 0},
+	} {
+		if reasons, e := ro.matchTx(test.tx); e != nil || reasons != test.want {
+			t.Fatalf("transaction %v matched for %b with error %v, want %b", test.tx.Hash(), reasons, e, test.want)
+		}
+	}
+	ro.notifyFilteredBlock(1, &wire.BlockHeader{}, []TxMatch{{Tx: both, Reasons: MatchSpend | MatchReceive}})
+	if len(connected) != 1 || connected[0] != both || len(matched) != 1 || matched[0].Reasons != MatchSpend|MatchReceive {
+		t.Fatalf("handlers got transactions %v and matches %v", connected, matched)
+	}
+}
+
+// TestStopWithTimeout checks that StopWithTimeout gives up on a goroutine that doesn't quit and names it.
+func TestStopWithTimeout(t *testing.T) {
+	s := &ChainService{quit: qu.T()}
+	release := make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		<-release
+	}()
+	defer close(release)
+	start := time.Now()
+	e := s.StopWithTimeout(time.Millisecond * 50)
+	if e == nil {
+		t.Fatal("stopped with a goroutine still running")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("gave up after %v", elapsed)
+	}
+	if !strings.Contains(e.Error(), "TestStopWithTimeout") {
+		t.Fatalf("error %q doesn't name the goroutine still running", e)
+	}
+	if e = s.StopWithTimeout(time.Millisecond * 50); e != nil {
+		t.Fatalf("second stop returned %v", e)
+	}
+}
+
+// TestValidatedHeaders checks that header messages are only found in the cache of validated headers when all their
+// headers were validated, that the least recently used headers are evicted, and that the hit rate follows.
+func TestValidatedHeaders(t *testing.T) {
+	s := &ChainService{headerCacheSize: 2}
+	b := &blockManager{server: s}
+	s.blockManager = b
+	b.forgetValidatedHeaders()
+	var written []headerfs.BlockHeader
+	for i := uint32(1); i <= 3; i++ {
+		written = append(written, headerfs.BlockHeader{BlockHeader: &wire.BlockHeader{Nonce: i}, Height: i})
+	}
+	b.markHeadersValidated(written...)
+	check := func(want bool, wantHeight int32, headers ...headerfs.BlockHeader) {
+		var msg []*wire.BlockHeader
+		for _, header := range headers {
+			msg = append(msg, header.BlockHeader)
+		}
+		if height, ok := b.headersValidated(msg); ok != want || height != wantHeight {
+			t.Fatalf("headers found %v at height %d, want %v at height %d", ok, height, want, wantHeight)
+		}
+	}
+	check(true, 3, written[1], written[2])
+	// The first header was evicted to make room for the last.
+	check(false, 0, written[0])
+	unknown := headerfs.BlockHeader{BlockHeader: &wire.BlockHeader{Nonce: 4}, Height: 4}
+	check(false, 0, written[2], unknown)
+	b.forgetValidatedHeaders()
+	check(false, 0, written[2])
+	if rate, messages := s.HeaderCacheHitRate(); rate != 0.25 || messages != 4 {
+		t.Fatalf("hit rate is %v over %d messages, want 0.25 over 4", rate, messages)
+	}
+}
+
+// TestAnnouncedHeaders checks that headers announced by a peer that was sent sendheaders, which don't connect to the
+// chain, are followed by a getheaders for the headers up to them, which isn't sent twice for the same header before the
+// peer is disconnected.
+func TestAnnouncedHeaders(t *testing.T) {
+	// Without checkpoints a recent tip is enough for the headers to be synced.
+	params := chaincfg.MainNetParams
+	params.Checkpoints = nil
+	s := newTestChainService(t, params)
+	s.timeSource = blockchain.NewMedianTime()
+	tip := wire.BlockHeader{PrevBlock: *params.GenesisHash, Timestamp: time.Unix(time.Now().Unix(), 0)}
+	e := s.BlockHeaders.WriteHeaders(headerfs.BlockHeader{BlockHeader: &tip, Height: 1})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if s.blockManager, e = newBlockManager(s); e != nil {
+		t.Fatal(e)
+	}
+	getHeaders := make(chan *wire.MsgGetHeaders, 2)
+	sp, remote := connectRemotePeer(
+		t, s, "10.0.0.2:11047", peer.MessageListeners{
+			OnGetHeaders: func(_ *peer.Peer, msg *wire.MsgGetHeaders) { getHeaders <- msg },
+		},
+	)
+	defer remote.Disconnect()
+	atomic.StoreInt32(&sp.sentSendHeaders, 1)
+	announced := wire.BlockHeader{PrevBlock: chainhash.Hash{1}, Timestamp: tip.Timestamp}
+	announce := func() {
+		msg := wire.NewMsgHeaders()
+		if e := msg.AddBlockHeader(&announced); e != nil {
+			t.Fatal(e)
+		}
+		s.blockManager.handleHeadersMsg(&headersMsg{headers: msg, peer: sp})
+	}
+	announce()
+	select {
+	case msg := <-getHeaders:
+		tipHash := tip.BlockHash()
+		if msg.HashStop != announced.BlockHash() || len(msg.BlockLocatorHashes) == 0 ||
+			*msg.BlockLocatorHashes[0] != tipHash {
+			t.Fatalf("getheaders from %v to %v, want from the tip %v to the announced header %v",
+				msg.BlockLocatorHashes, msg.HashStop, tipHash, announced.BlockHash())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no getheaders sent for headers that don't connect")
+	}
+	if isDisconnected(sp) {
+		t.Fatal("peer disconnected for announcing headers that don't connect")
+	}
+	announce()
+	if !isDisconnected(sp) {
+		t.Fatal("peer not disconnected for announcing the same headers that don't connect again")
+	}
+	select {
+	case <-getHeaders:
+		t.Fatal("getheaders sent twice for the same announced header")
+	default:
+	}
+}
+
+// TestWaitForHeight checks that WaitForHeight returns at once for a height already reached, waits for the block
+// connected at the height otherwise, and returns early when its context is done or the service stops.
+func TestWaitForHeight(t *testing.T) {
+	params := chaincfg.MainNetParams
+	s := newTestChainService(t, params)
+	blockHeaders, filterHeaders := s.BlockHeaders, s.RegFilterHeaders
+	// The block headers are ahead of the filter headers, which are only at the first block.
+	prev := *params.GenesisHash
+	var headers []*wire.BlockHeader
+	var e error
+	for height := uint32(1); height <= 3; height++ {
+		header := &wire.BlockHeader{PrevBlock: prev, Nonce: height}
+		prev = header.BlockHash()
+		headers = append(headers, header)
+		if e = blockHeaders.WriteHeaders(headerfs.BlockHeader{BlockHeader: header, Height: height}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e = filterHeaders.WriteHeaders(headerfs.FilterHeader{HeaderHash: headers[0].BlockHash(), Height: 1}); e != nil {
+		t.Fatal(e)
+	}
+	s.blockManager = &blockManager{filterHeaderTip: 1}
+	s.blockSubscribers = make(map[*blockSubscription]struct{})
+	if e = s.WaitForHeight(context.Background(), 1); e != nil {
+		t.Fatalf("waiting for a height reached returned %v", e)
+	}
+	// waitSubscribed waits for the subscription of the next WaitForHeight, so no block is connected before it.
+	waitSubscribed := func() {
+		for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(time.Millisecond) {
+			s.mtxSubscribers.RLock()
+			subscribed := len(s.blockSubscribers) != 0
+			s.mtxSubscribers.RUnlock()
+			if subscribed {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("WaitForHeight didn't subscribe to blocks")
+			}
+		}
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.WaitForHeight(context.Background(), 3) }()
+	waitSubscribed()
+	s.sendSubscribedMsg(&blockMessage{msgType: connectBasic, header: headers[1]})
+	select {
+	case e = <-done:
+		t.Fatalf("waiting for height 3 returned %v at height 2", e)
+	case <-time.After(time.Millisecond * 50):
+	}
+	s.sendSubscribedMsg(&blockMessage{msgType: connectBasic, header: headers[2]})
+	select {
+	case e = <-done:
+		if e != nil {
+			t.Fatalf("waiting for height 3 returned %v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForHeight didn't return once the height was reached")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if e = s.WaitForHeight(ctx, 10); e != context.Canceled {
+		t.Fatalf("waiting with a cancelled context returned %v, want %v", e, context.Canceled)
+	}
+	go func() { done <- s.WaitForHeight(context.Background(), 10) }()
+	waitSubscribed()
+	s.quit.Q()
+	select {
+	case e = <-done:
+		if e != ErrShuttingDown {
+			t.Fatalf("waiting as the service stops returned %v, want %v", e, ErrShuttingDown)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForHeight didn't return when the service stopped")
+	}
+}
+
+// TestResetChainState resets the chain state of header stores holding three blocks to the first, and checks that the
+// stores and the block manager's tips were rolled back, the caches cleared, and that no reset runs with a rescan.
+func TestResetChainState(t *testing.T) {
+	params := chaincfg.MainNetParams
+	s := newTestChainService(t, params)
+	blockHeaders, filterHeaders := s.BlockHeaders, s.RegFilterHeaders
+	prev := *params.GenesisHash
+	var hashes []chainhash.Hash
+	var e error
+	for height := uint32(1); height <= 3; height++ {
+		header := wire.BlockHeader{PrevBlock: prev, Nonce: height}
+		prev = header.BlockHash()
+		hashes = append(hashes, prev)
+		if e = blockHeaders.WriteHeaders(headerfs.BlockHeader{BlockHeader: &header, Height: height}); e != nil {
+			t.Fatal(e)
+		}
+		if e = filterHeaders.WriteHeaders(headerfs.FilterHeader{HeaderHash: prev, Height: height}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	s.BlockCache = lru.NewCache(1000)
+	s.FilterCache = lru.NewCache(1000)
+	s.reorgedBlockHeaders = make(map[chainhash.Hash]reorgHeader)
+	if s.blockManager, e = newBlockManager(s); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.BlockCache.Put("block", validatedHeader(1)); e != nil {
+		t.Fatal(e)
+	}
+	// Stand in for the block handler, which only takes the reset messages here.
+	go func() {
+		for m := range s.blockManager.peerChan {
+			if msg, ok := m.(*resetMsg); ok {
+				msg.reply <- s.blockManager.handleResetMsg(list.New(), msg.height)
+			}
+		}
+	}()
+	defer close(s.blockManager.peerChan)
+	done, e := s.beginRescan()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.ResetChainState(1); e != ErrRescanRunning {
+		t.Fatalf("reset with a rescan running returned %v, want %v", e, ErrRescanRunning)
+	}
+	done()
+	if e = s.ResetChainState(1); e != nil {
+		t.Fatal(e)
+	}
+	if _, height, e := blockHeaders.ChainTip(); e != nil || height != 1 {
+		t.Fatalf("block header tip is at height %d (%v) after the reset, want 1", height, e)
+	}
+	if _, height, e := filterHeaders.ChainTip(); e != nil || height != 1 {
+		t.Fatalf("filter header tip is at height %d (%v) after the reset, want 1", height, e)
+	}
+	b := s.blockManager
+	if b.headerTip != 1 || b.headerTipHash != hashes[0] || b.filterHeaderTip != 1 {
+		t.Fatalf("block manager tips are %d (%s) and %d after the reset", b.headerTip, b.headerTipHash, b.filterHeaderTip)
+	}
+	if s.BlockCache.Len() != 0 {
+		t.Fatalf("%d blocks cached after the reset", s.BlockCache.Len())
+	}
+	if len(s.reorgedBlockHeaders) != 2 {
+		t.Fatalf("%d reorg headers kept, want those of the 2 rolled back blocks", len(s.reorgedBlockHeaders))
+	}
+	// A negative height resets to genesis.
+	if e = s.ResetChainState(-1); e != nil {
+		t.Fatal(e)
+	}
+	if _, height, e := blockHeaders.ChainTip(); e != nil || height != 0 {
+		t.Fatalf("block header tip is at height %d (%v) after resetting to genesis", height, e)
+	}
+}
+
+// TestNotFound checks that a notfound answers a getdata only for the inventory it asked for, and that only the notfound
+// for a block the peer announced counts against it.
+func TestNotFound(t *testing.T) {
+	announced, unknown := chainhash.Hash{1}, chainhash.Hash{2}
+	getData := wire.NewMsgGetData()
+	if e := getData.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessBlock, &announced)); e != nil {
+		t.Fatal(e)
+	}
+	notFound := func(hash chainhash.Hash) *wire.MsgNotFound {
+		msg := wire.NewMsgNotFound()
+		if e := msg.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessBlock, &hash)); e != nil {
+			t.Fatal(e)
+		}
+		return msg
+	}
+	if !notFoundFor(getData, notFound(announced)) {
+		t.Fatal("notfound for the block asked for didn't answer the getdata")
+	}
+	if notFoundFor(getData, notFound(unknown)) || notFoundFor(wire.NewMsgGetCFilters(0, 0, &announced), notFound(announced)) {
+		t.Fatal("notfound answered a query it wasn't for")
+	}
+	p, e := peer.NewOutboundPeer(&peer.Config{ChainParams: &chaincfg.SimNetParams}, "1.2.3.4:11047")
+	if e != nil {
+		t.Fatal(e)
+	}
+	sp := &ServerPeer{Peer: p}
+	p.AddKnownInventory(wire.NewInvVect(wire.InvTypeBlock, &announced))
+	sp.handleNotFound(notFound(unknown))
+	if score := sp.banScore.Int(); score != 0 {
+		t.Fatalf("ban score is %d after notfound for a block that wasn't announced", score)
+	}
+	sp.handleNotFound(notFound(announced))
+	if score := sp.banScore.Int(); score != NotFoundBanScore {
+		t.Fatalf("ban score is %d after notfound for an announced block, want %d", score, NotFoundBanScore)
+	}
+}
+
+// TestAnchoredDifficulty checks that after an anchor the required difficulty is substituted up to the first retarget,
+// that the bits headers claim are kept from there until the next retarget, and that it is worked out again after.
+func TestAnchoredDifficulty(t *testing.T) {
+	params := chaincfg.MainNetParams
+	s := &ChainService{chainParams: params, startHeight: 15}
+	b := &blockManager{server: s, headerList: headerlist.NewBoundedMemoryChain(10), blocksPerRetarget: 10}
+	for height, unknown := range map[int32]bool{15: false, 19: false, 20: true, 29: true, 30: false, 40: false} {
+		if b.anchoredDifficultyUnknown(height) != unknown {
+			t.Fatalf("difficulty at height %d unknown is %v, want %v", height, !unknown, unknown)
+		}
+	}
+	s.startHeight = 20
+	if b.anchoredDifficultyUnknown(20) || b.anchoredDifficultyUnknown(30) {
+		t.Fatal("difficulty unknown after an anchor at a retarget")
+	}
+	s.startHeight = 15
+	b.headerList.ResetHeaderState(headerlist.Node{Header: wire.BlockHeader{Bits: 0x1d00ffff}, Height: 19})
+	maxTimestamp := time.Now().Add(maxTimeOffset)
+	header := params.GenesisBlock.Header
+	_ = b.checkHeaderSanity(&header, maxTimestamp, false, 20)
+	if header.Bits != params.GenesisBlock.Header.Bits {
+		t.Fatalf("header at the first retarget after the anchor has bits %08x, want the claimed %08x", header.Bits,
+			params.GenesisBlock.Header.Bits)
+	}
+	b.headerList.ResetHeaderState(headerlist.Node{Header: wire.BlockHeader{Bits: 0x1d00ffff}, Height: 18})
+	_ = b.checkHeaderSanity(&header, maxTimestamp, false, 19)
+	if header.Bits != 0x1d00ffff {
+		t.Fatalf("header before the first retarget after the anchor has bits %08x, want the anchor's %08x",
+			header.Bits, 0x1d00ffff)
+	}
+}
+
+// TestSyncPeerWork checks that the sync candidate that delivered the most header work is preferred over one advertising
+// a higher tip, and that delivering the same headers again doesn't add to a peer's work.
+func TestSyncPeerWork(t *testing.T) {
+	newPeer := func(addr string) *ServerPeer {
+		p, e := peer.NewOutboundPeer(&peer.Config{ChainParams: &chaincfg.SimNetParams}, addr)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return &ServerPeer{Peer: p}
+	}
+	honest, liar := newPeer("1.2.3.4:11047"), newPeer("5.6.7.8:11047")
+	bits := chaincfg.SimNetParams.PowLimitBits
+	headers := []headerfs.BlockHeader{
+		{BlockHeader: &wire.BlockHeader{Bits: bits}, Height: 1},
+		{BlockHeader: &wire.BlockHeader{Bits: bits}, Height: 2},
+	}
+	honest.headerWork.add(headers...)
+	liar.headerWork.add(headers[0])
+	liar.headerWork.add(headers[0])
+	if honest.HeaderWork().Cmp(liar.HeaderWork()) <= 0 {
+		t.Fatalf("work of two headers %v isn't more than of one sent twice %v", honest.HeaderWork(), liar.HeaderWork())
+	}
+	honest.UpdateLastBlockHeight(2)
+	liar.UpdateLastBlockHeight(1000)
+	if !betterSyncPeer(honest, liar) || betterSyncPeer(liar, honest) {
+		t.Fatal("the peer advertising the higher tip was preferred over the one delivering more work")
+	}
+	liar.headerWork.add(headers[1])
+	if !betterSyncPeer(liar, honest) {
+		t.Fatal("the higher tip wasn't preferred between peers delivering the same work")
+	}
+}
+
+// TestRankPeers checks that peers are ranked by the score of their height, header work, throughput, ping and ban score,
+// and as the sync peer is chosen between peers of the same score.
+func TestRankPeers(t *testing.T) {
+	newPeer := func(addr string, height int32, banScore uint32) *ServerPeer {
+		p, e := peer.NewOutboundPeer(&peer.Config{ChainParams: &chaincfg.SimNetParams}, addr)
+		if e != nil {
+			t.Fatal(e)
+		}
+		sp := &ServerPeer{Peer: p}
+		sp.UpdateLastBlockHeight(height)
+		sp.banScore.Increase(banScore, 0)
+		return sp
+	}
+	worker := newPeer("1.2.3.4:11047", 1, 0)
+	bits := chaincfg.SimNetParams.PowLimitBits
+	worker.headerWork.add(headerfs.BlockHeader{BlockHeader: &wire.BlockHeader{Bits: bits}, Height: 1})
+	peers := []*ServerPeer{
+		newPeer("5.6.7.8:11047", 30, 50),
+		newPeer("9.10.11.12:11047", 10, 0),
+		worker,
+		newPeer("13.14.15.16:11047", 20, 0),
+	}
+	checkRanking := func(infos []PeerInfo, want ...string) {
+		var ranked []string
+		for _, info := range rankPeers(infos, BanThreshold) {
+			ranked = append(ranked, info.Addr)
+		}
+		if strings.Join(ranked, " ") != strings.Join(want, " ") {
+			t.Fatalf("peers ranked %v, want %v", ranked, want)
+		}
+	}
+	// The header work of the first outweighs the height of the others, and half the ban threshold outweighs a third of
+	// the best height.
+	checkRanking(
+		peerInfos(peers, time.Now()), "1.2.3.4:11047", "13.14.15.16:11047", "5.6.7.8:11047", "9.10.11.12:11047",
+	)
+	// A peer a block behind with half the ping and twice the throughput is ranked first, and the peers at the ban
+	// threshold are only scored on their height.
+	noWork := new(big.Int)
+	checkRanking(
+		[]PeerInfo{
+			{Addr: "a", HeaderWork: noWork, LastBlock: 100, PingMicros: 2000, BytesPerSecond: 1000},
+			{Addr: "b", HeaderWork: noWork, LastBlock: 99, PingMicros: 1000, BytesPerSecond: 2000},
+			{Addr: "c", HeaderWork: noWork, LastBlock: 100, BanScore: BanThreshold},
+			{Addr: "d", HeaderWork: noWork, LastBlock: 0, BanScore: BanThreshold},
+		}, "b", "a", "c", "d",
+	)
+}
+
+// TestSyncRate checks that the sync rate is only estimated once enough downloads were sampled, and that it falls when
+// downloads stall.
+func TestSyncRate(t *testing.T) {
+	var r syncRate
+	start := time.Unix(1600000000, 0)
+	for i := 0; i < minSyncRateSamples; i++ {
+		if _, ok := r.perSecond(start); ok {
+			t.Fatalf("rate estimated from %d samples", i)
+		}
+		r.add(start.Add(time.Duration(i)*time.Second), 100)
+		// Downloads within the sample interval are counted without taking another sample.
+		r.add(start.Add(time.Duration(i)*time.Second+time.Millisecond), 100)
+	}
+	now := start.Add(time.Duration(minSyncRateSamples-1) * time.Second)
+	rate, ok := r.perSecond(now)
+	// The headers counted by the oldest sample were downloaded before it, so 500 headers took 2 seconds.
+	if !ok || rate != 250 {
+		t.Fatalf("rate is %v (%v), want 250 headers per second", rate, ok)
+	}
+	if rate, _ = r.perSecond(now.Add(time.Duration(minSyncRateSamples-1) * time.Second)); rate != 125 {
+		t.Fatalf("rate after a stall is %v, want 125 headers per second", rate)
+	}
+	r.reset()
+	if _, ok = r.perSecond(now); ok {
+		t.Fatal("rate estimated after a reset")
+	}
+}
+
+// TestSendHeadersConfig checks that peers are only sent sendheaders when Config.SendHeaders is set.
+func TestSendHeadersConfig(t *testing.T) {
+	for _, sendHeaders := range []bool{false, true} {
+		sp := &ServerPeer{server: &ChainService{sendHeaders: sendHeaders}}
+		cfg := newPeerConfig(sp)
+		if (cfg.Listeners.OnVerAck != nil) != sendHeaders {
+			t.Fatalf("verack listener set is %v with SendHeaders %v", cfg.Listeners.OnVerAck != nil, sendHeaders)
+		}
+		if sp.SentSendHeaders() {
+			t.Fatal("peer was sent sendheaders before its verack")
+		}
+	}
+}
+
+// TestUnknownMessageConfig checks that unknown messages are only read from peers, and passed to the handler with the
+// peer they came from, with Config.OnUnknownMessage set, and that oversized ones raise the ban score instead.
+func TestUnknownMessageConfig(t *testing.T) {
+	sp := &ServerPeer{server: &ChainService{}}
+	if newPeerConfig(sp).Listeners.OnUnknownMessage != nil {
+		t.Fatal("unknown message listener set without OnUnknownMessage")
+	}
+	var got *ServerPeer
+	var gotCmd string
+	sp.server.onUnknownMessage = func(sp *ServerPeer, cmd string, payload []byte) {
+		got, gotCmd = sp, cmd
+	}
+	cfg := newPeerConfig(sp)
+	if cfg.Listeners.OnUnknownMessage == nil {
+		t.Fatal("unknown message listener not set with OnUnknownMessage")
+	}
+	cfg.Listeners.OnUnknownMessage(nil, &wire.MsgUnknown{Cmd: "bogus", Payload: []byte{1}, Length: 1})
+	if got != sp || gotCmd != "bogus" {
+		t.Fatalf("handler called with peer %p and command %q, want %p and bogus", got, gotCmd, sp)
+	}
+	got = nil
+	cfg.Listeners.OnUnknownMessage(nil, &wire.MsgUnknown{Cmd: "huge", Length: wire.MaxUnknownPayload + 1})
+	if got != nil {
+		t.Fatal("handler called with an oversized message")
+	}
+	if score := sp.banScore.Int(); score != ProtocolViolationBanScore {
+		t.Fatalf("ban score is %d after an oversized unknown message, want %d", score, ProtocolViolationBanScore)
+	}
+}
+
+// TestAssumeValid checks that headers are only accepted unchecked up to the last checkpoint, and only with
+// Config.AssumeValidBelowCheckpoint set.
+func TestAssumeValid(t *testing.T) {
+	params := chaincfg.SimNetParams
+	params.Checkpoints = []chaincfg.Checkpoint{{Height: 10, Hash: &chainhash.Hash{1}}, {Height: 20, Hash: &chainhash.Hash{2}}}
+	b := &blockManager{server: &ChainService{chainParams: params}}
+	if b.assumeValid(1) {
+		t.Fatal("header assumed valid without AssumeValidBelowCheckpoint")
+	}
+	b.server.assumeValidBelowCheckpoint = true
+	for height, want := range map[int32]bool{1: true, 15: true, 20: true, 21: false} {
+		if b.assumeValid(height) != want {
+			t.Errorf("header at height %d assumed valid is %v, want %v", height, !want, want)
+		}
+	}
+	b.server.chainParams.Checkpoints = nil
+	if b.assumeValid(1) {
+		t.Fatal("header assumed valid on a network without checkpoints")
+	}
+}
+
+// TestPruneBlockCache checks that blocks below the pruning height are removed from the block cache, other than those a
+// running rescan is yet to pass.
+func TestPruneBlockCache(t *testing.T) {
+	s := &ChainService{BlockCache: lru.NewCache(DefaultBlockCacheSize)}
+	for height := int32(1); height <= 5; height++ {
+		b := block.NewBlock(&wire.Block{Header: wire.BlockHeader{Nonce: uint32(height)}})
+		b.SetHeight(height)
+		if e := s.BlockCache.Put(*wire.NewInvVect(wire.InvTypeBlock, b.Hash()), &cache.CacheableBlock{Block: b}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	ro := &rescanOptions{}
+	s.rescanPositions.set(ro, 2)
+	if pruned := s.PruneBlockCache(4); pruned != 1 {
+		t.Fatalf("pruned %d blocks below a rescan at height 2, want 1", pruned)
+	}
+	s.rescanPositions.remove(ro)
+	if pruned := s.PruneBlockCache(4); pruned != 2 {
+		t.Fatalf("pruned %d blocks below height 4 once the rescan was done, want 2", pruned)
+	}
+	if n := s.BlockCache.Len(); n != 2 {
+		t.Fatalf("%d blocks left in the block cache, want 2", n)
+	}
+}
+
+// TestMerkleProof checks that the merkle proofs of all the transactions of blocks of several sizes verify against the
+// merkle root of the block, and that a proof doesn't verify at the position of its sibling.
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 5; n++ {
+		txs := make([]*util.Tx, n)
+		for i := range txs {
+			txs[i] = util.NewTx(&wire.MsgTx{Version: 1, LockTime: uint32(i)})
+		}
+		tree := blockchain.BuildMerkleTreeStore(txs, false)
+		for i, tx := range txs {
+			proof := &MerkleProof{
+				Header: wire.BlockHeader{MerkleRoot: *tree.GetRoot()},
+				TxHash: *tx.Hash(),
+				Index:  uint32(i),
+				Branch: merkleBranch(tree, i),
+			}
+			if !proof.Verify() {
+				t.Fatalf("proof of transaction %d of %d doesn't verify", i, n)
+			}
+			// A lone last transaction is hashed with itself, so it has no other position to check.
+			if i^1 >= n {
+				continue
+			}
+			proof.Index ^= 1
+			if proof.Verify() {
+				t.Fatalf("proof of transaction %d of %d verifies at index %d", i, n, proof.Index)
+			}
+		}
+	}
+}
+
+// TestBlockFetchesCoalesce checks that concurrent fetches of a block share a single fetch, while fetches that are
+// limited and unlimited are kept apart.
+func TestBlockFetchesCoalesce(t *testing.T) {
+	var f blockFetches
+	hash := chainhash.Hash{1}
+	key := blockFetchKey{inv: *wire.NewInvVect(wire.InvTypeBlock, &hash), limited: true}
+	want := block.NewBlock(&wire.Block{})
+	started, release := make(chan struct{}), make(chan struct{})
+	var fetches int32
+	fetch := func() (*block.Block, error) {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return want, nil
+	}
+	results := make(chan *block.Block, 4)
+	get := func(key blockFetchKey) {
+		b, e := f.do(key, fetch)
+		if e != nil {
+			t.Error(e)
+		}
+		results <- b
+	}
+	go get(key)
+	<-started
+	for i := 0; i < 2; i++ {
+		go get(key)
+	}
+	unlimited := key
+	unlimited.limited = false
+	go get(unlimited)
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	for i := 0; i < 4; i++ {
+		if b := <-results; b != want {
+			t.Fatalf("fetch %d returned %v, want the fetched block", i, b)
+		}
+	}
+	if fetches != 2 {
+		t.Fatalf("block fetched %d times, want 2", fetches)
+	}
+	if len(f.fetches) != 0 {
+		t.Fatalf("%d fetches left in progress", len(f.fetches))
+	}
+}
+
+// TestFetchSlotsQuit checks that filter and block fetches waiting for a slot return once the service stops.
+func TestFetchSlotsQuit(t *testing.T) {
+	s := &ChainService{
+		filterHeaders: map[wire.FilterType]*headerfs.FilterHeaderStore{wire.GCSFilterRegular: nil},
+		filterSlots:   make(chan struct{}, 1),
+		blockSlots:    make(chan struct{}, 1),
+		quit:          qu.T(),
+	}
+	s.filterSlots <- struct{}{}
+	s.blockSlots <- struct{}{}
+	done := make(chan error, 2)
+	go func() {
+		_, e := s.GetCFilter(chainhash.Hash{1}, wire.GCSFilterRegular)
+		done <- e
+	}()
+	go func() {
+		hash := chainhash.Hash{2}
+		_, e := s.fetchBlock(hash, 1, wire.NewInvVect(wire.InvTypeBlock, &hash), true)
+		done <- e
+	}()
+	select {
+	case e := <-done:
+		t.Fatalf("fetch returned %v without a free slot", e)
+	case <-time.After(time.Millisecond * 50):
+	}
+	s.quit.Q()
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-done:
+			if e != ErrShuttingDown {
+				t.Fatalf("fetch waiting for a slot returned %v, want %v", e, ErrShuttingDown)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("fetch waiting for a slot didn't return when the service stopped")
+		}
+	}
+}
+
+// TestProtocolViolationBanScore checks that messages breaking the protocol raise the ban score of the peer rather than
+// disconnecting it.
+func TestProtocolViolationBanScore(t *testing.T) {
+	p, e := peer.NewOutboundPeer(&peer.Config{ChainParams: &chaincfg.SimNetParams}, "1.2.3.4:11047")
+	if e != nil {
+		t.Fatal(e)
+	}
+	sp := &ServerPeer{Peer: p}
+	sp.OnFeeFilter(p, wire.NewMsgFeeFilter(-1))
+	if score := sp.banScore.Int(); score != ProtocolViolationBanScore {
+		t.Fatalf("ban score is %d after an invalid feefilter, want %d", score, ProtocolViolationBanScore)
+	}
+	sp.OnFeeFilter(p, wire.NewMsgFeeFilter(1000))
+	if score := sp.banScore.Int(); score != ProtocolViolationBanScore {
+		t.Fatalf("ban score is %d after a valid feefilter, want %d", score, ProtocolViolationBanScore)
+	}
+	if feeFilter := atomic.LoadInt64(&sp.feeFilter); feeFilter != 1000 {
+		t.Fatalf("fee filter is %d, want 1000", feeFilter)
+	}
+}
+
+// TestOnionAddr checks that valid onion addresses are connected to unresolved through a proxy dialer, and that invalid
+// ones, or any without a proxy dialer, are rejected.
+func TestOnionAddr(t *testing.T) {
+	s := &ChainService{
+		chainParams: chaincfg.SimNetParams,
+		nameResolver: func(host string) ([]net.IP, error) {
+			t.Fatalf("resolved %s", host)
+			return nil, nil
+		},
+		proxyDialer: true,
+	}
+	for addr, want := range map[string]string{
+		"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion:11047": "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion:11047",
+		"expyuzz4wqqyqhjn.onion": "expyuzz4wqqyqhjn.onion:" + chaincfg.SimNetParams.DefaultPort,
+	} {
+		netAddr, e := s.addrStringToNetAddr(addr)
+		if e != nil {
+			t.Fatalf("onion address %s rejected: %v", addr, e)
+		}
+		if netAddr.Network() != "onion" || netAddr.String() != want {
+			t.Fatalf("onion address %s is %s %s, want onion %s", addr, netAddr.Network(), netAddr, want)
+		}
+	}
+	for _, addr := range []string{
+		"expyuzz4wqqyqhj.onion",
+		"expyuzz4wqqyqhj1.onion",
+		"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczae.onion",
+		"expyuzz4wqqyqhjn.onion:port",
+	} {
+		if _, e := s.addrStringToNetAddr(addr); e == nil {
+			t.Fatalf("invalid onion address %s accepted", addr)
+		}
+	}
+	s.proxyDialer = false
+	if _, e := s.addrStringToNetAddr("expyuzz4wqqyqhjn.onion"); e == nil {
+		t.Fatal("onion address accepted without a proxy dialer")
+	}
+}
+
+// TestConnectOnionPeer connects to a v3 onion address given in ConnectPeers and checks that it reaches the dialer and
+// that the outbound peer is created and sends its version without the onion address being resolved.
+func TestConnectOnionPeer(t *testing.T) {
+	db, dir := newTestDB(t)
+	const host = "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion"
+	local, remote := net.Pipe()
+	defer remote.Close()
+	dialed := make(chan net.Addr, 1)
+	s, e := NewChainService(
+		Config{
+			DataDir:      dir,
+			Database:     db,
+			ChainParams:  chaincfg.MainNetParams,
+			ConnectPeers: []string{host + ":11047"},
+			Dialer: func(addr net.Addr) (net.Conn, error) {
+				dialed <- addr
+				return local, nil
+			},
+			NameResolver: func(host string) ([]net.IP, error) {
+				t.Errorf("resolved %s", host)
+				return nil, errors.New("no resolution over tor")
+			},
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.connManager.Start()
+	defer s.connManager.Stop()
+	select {
+	case addr := <-dialed:
+		if addr.Network() != "onion" || addr.String() != host+":11047" {
+			t.Fatalf("dialed %s %s, want onion %s:11047", addr.Network(), addr, host)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("onion peer wasn't dialed")
+	}
+	if e = remote.SetReadDeadline(time.Now().Add(time.Second * 5)); e != nil {
+		t.Fatal(e)
+	}
+	msg, _, e := wire.ReadMessage(remote, wire.ProtocolVersion, chaincfg.MainNetParams.Net)
+	if e != nil {
+		t.Fatalf("no message from the onion peer: %v", e)
+	}
+	if _, ok := msg.(*wire.MsgVersion); !ok {
+		t.Fatalf("onion peer sent %s, want version", msg.Command())
+	}
+}
+
+// TestThroughput checks that the throughput is the rate the byte counters grew at between the last two samples.
+func TestThroughput(t *testing.T) {
+	s := &ChainService{}
+	start := time.Now()
+	s.AddBytesReceived(1000)
+	if recvBps, sendBps := s.sampleThroughput(start); recvBps != 0 || sendBps != 0 {
+		t.Fatalf("first sample should leave the rates at zero, got %v and %v", recvBps, sendBps)
+	}
+	s.AddBytesReceived(4000)
+	s.AddBytesSent(1000)
+	s.sampleThroughput(start.Add(time.Second * 2))
+	if recvBps, sendBps := s.Throughput(); recvBps != 2000 || sendBps != 500 {
+		t.Fatalf("expected rates of 2000 and 500, got %v and %v", recvBps, sendBps)
+	}
+	s.sampleThroughput(start.Add(time.Second * 3))
+	if recvBps, sendBps := s.Throughput(); recvBps != 0 || sendBps != 0 {
+		t.Fatalf("expected rates of zero without traffic, got %v and %v", recvBps, sendBps)
+	}
+}
+
+// TestTipAgreeingPeers checks that only the peers advertising the height of the tip, and the tip itself if they
+// announced a block, are counted as agreeing with it.
+func TestTipAgreeingPeers(t *testing.T) {
+	tipHash, otherHash := chainhash.Hash{1}, chainhash.Hash{2}
+	newPeer := func(addr string, height int32, announced *chainhash.Hash) *ServerPeer {
+		p, e := peer.NewOutboundPeer(&peer.Config{ChainParams: &chaincfg.SimNetParams}, addr)
+		if e != nil {
+			t.Fatal(e)
+		}
+		sp := &ServerPeer{Peer: p}
+		sp.UpdateLastBlockHeight(height)
+		sp.UpdateLastAnnouncedBlock(announced)
+		return sp
+	}
+	peers := []*ServerPeer{
+		newPeer("1.2.3.4:11047", 10, nil),
+		newPeer("5.6.7.8:11047", 10, &tipHash),
+		newPeer("9.10.11.12:11047", 10, &otherHash),
+		newPeer("13.14.15.16:11047", 11, nil),
+		newPeer("17.18.19.20:11047", 9, nil),
+	}
+	if n := tipAgreeingPeers(peers, &tipHash, 10); n != 2 {
+		t.Fatalf("%d peers agree on the tip, want 2", n)
+	}
+	s := &ChainService{}
+	if !s.tipAgreed() {
+		t.Fatal("the tip should be agreed when no agreeing peers are required")
+	}
+}
+
+// TestFilterBatches checks that a rescan collects the filters it persists to write them together, and that the stored
+// filters ahead of it are read into the filter cache up to the first block without one.
+func TestFilterBatches(t *testing.T) {
+	params := chaincfg.MainNetParams
+	s := newTestChainService(t, params)
+	filterDB, e := filterdb.New(s.db, params)
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.FilterDB, s.FilterCache = filterDB, lru.NewCache(1000)
+	prev := *params.GenesisHash
+	var hashes []chainhash.Hash
+	for height := uint32(1); height <= 4; height++ {
+		header := wire.BlockHeader{PrevBlock: prev, Nonce: height}
+		prev = header.BlockHash()
+		hashes = append(hashes, prev)
+		if e = s.BlockHeaders.WriteHeaders(headerfs.BlockHeader{BlockHeader: &header, Height: height}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	ro := &rescanOptions{queryOptions: []QueryOption{PersistToDisk()}}
+	qo := defaultQueryOptions()
+	qo.applyQueryOptions(ro.filterOptions()...)
+	if !qo.persistToDisk || qo.filterBatch != &ro.filterBatch {
+		t.Fatal("the filters a rescan persists are not collected in its batch")
+	}
+	// The filters of the first two blocks are collected as the query would, and there is none stored for the third.
+	for i := range hashes[:2] {
+		filter, e := gcs.BuildGCSFilter(builder.DefaultP, builder.DefaultM, [gcs.KeySize]byte{}, [][]byte{{byte(i)}})
+		if e != nil {
+			t.Fatal(e)
+		}
+		ro.filterBatch = append(
+			ro.filterBatch, &filterdb.FilterData{Filter: filter, BlockHash: &hashes[i], Type: filterdb.RegularFilter},
+		)
+	}
+	if e = s.flushFilters(ro); e != nil {
+		t.Fatal(e)
+	}
+	if len(ro.filterBatch) != 0 {
+		t.Fatalf("%d filters left in the batch after it was written", len(ro.filterBatch))
+	}
+	s.prefetchFilters(ro, 1, 4)
+	if ro.prefetchedTo != 4 {
+		t.Fatalf("filters read ahead up to height %d, want 4", ro.prefetchedTo)
+	}
+	if s.FilterCache.Len() != 2 {
+		t.Fatalf("%d filters read into the cache, want the 2 stored", s.FilterCache.Len())
+	}
+	for i := range hashes[:2] {
+		if filter, e := s.getFilterFromCache(&hashes[i], filterdb.RegularFilter); e != nil || filter == nil {
+			t.Fatalf("the stored filter of block %d isn't cached (%v)", i+1, e)
+		}
+	}
+	// The blocks read ahead already are not read again.
+	s.FilterCache = lru.NewCache(1000)
+	s.prefetchFilters(ro, 3, 4)
+	if s.FilterCache.Len() != 0 {
+		t.Fatal("filters read again for blocks already read ahead")
+	}
+}
+
+// TestAdvertisedServices checks that compact filter service is advertised by default, and with AdvertiseServedOnly only
+// when filters are served.
+func TestAdvertisedServices(t *testing.T) {
+	for _, test := range []struct {
+		serveFilters, servedOnly, advertised bool
+	}{
+		{false, false, true},
+		{false, true, false},
+		{true, true, true},
+	} {
+		db, dir := newTestDB(t)
+		s, e := NewChainService(
+			Config{
+				DataDir:             dir,
+				Database:            db,
+				ChainParams:         chaincfg.MainNetParams,
+				ServeFilters:        test.serveFilters,
+				AdvertiseServedOnly: test.servedOnly,
+			},
+		)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if advertised := s.services&wire.SFNodeCF != 0; advertised != test.advertised {
+			t.Fatalf(
+				"compact filters advertised is %v with ServeFilters %v and AdvertiseServedOnly %v",
+				advertised, test.serveFilters, test.servedOnly,
+			)
+		}
+	}
+}
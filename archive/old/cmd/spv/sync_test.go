@@ -4,6 +4,7 @@ package spv_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"github.com/p9c/pod/pkg/amt"
@@ -921,16 +922,8 @@ func testRandomBlocks(harness *neutrinoHarness, t *testing.T) {
 				)
 				return
 			}
-			calcBytes, e := calcFilter.NBytes()
-			if e != nil {
-				errChan <- fmt.Errorf(
-					"Couldn't get bytes from"+
-						" calculated basic filter for block "+
-						"%d (%s): %s", height, blockHash, err,
-				)
-			}
 			// Chk that the network value matches the calculated value from the block.
-			if !bytes.Equal(haveBytes, calcBytes) {
+			if !calcFilter.Equal(haveFilter) {
 				errChan <- fmt.Errorf(
 					"Basic filter from P2P "+
 						"network/DB doesn't match calculated "+
@@ -1194,6 +1187,23 @@ func waitForSync(
 				"ChainService: %s", err,
 		)
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	if e = svc.WaitForHeight(ctx, knownBestHeight); e != nil {
+		return fmt.Errorf(
+			"Timed out after %v waiting for "+
+				"header synchronization.\n%s", syncTimeout,
+			goroutineDump(),
+		)
+	}
+	haveBest, e = svc.BestBlock()
+	if e != nil {
+		return fmt.Errorf(
+			"Couldn't get best snapshot from "+
+				"ChainService: %s", err,
+		)
+	}
+	// The service may still be on a chain of the same height that is about to be reorganized away.
 	var total time.Duration
 	for haveBest.Hash != *knownBestHash {
 		if total > syncTimeout {
@@ -0,0 +1,104 @@
+package spv
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// syncRateSamples is the number of download progress samples the sync rate is averaged over.
+	syncRateSamples = 30
+	// minSyncRateSamples is the number of samples needed before the sync rate is estimated.
+	minSyncRateSamples = 3
+	// syncRateInterval is the least time between two samples, so that a burst of header messages doesn't fill the
+	// window of samples in an instant.
+	syncRateInterval = time.Second
+)
+
+// syncSample is the number of block and filter headers downloaded in total by a time.
+type syncSample struct {
+	time       time.Time
+	downloaded uint64
+}
+
+// syncRate is a moving average of the rate the block and filter headers of the chain are downloaded at, over the last
+// syncRateSamples samples.
+type syncRate struct {
+	mtx        sync.Mutex
+	downloaded uint64
+	samples    []syncSample
+}
+
+// add counts n headers downloaded at time t.
+func (r *syncRate) add(t time.Time, n uint64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.downloaded += n
+	if len(r.samples) > 0 && t.Sub(r.samples[len(r.samples)-1].time) < syncRateInterval {
+		return
+	}
+	if len(r.samples) == syncRateSamples {
+		r.samples = append(r.samples[:0], r.samples[1:]...)
+	}
+	r.samples = append(r.samples, syncSample{time: t, downloaded: r.downloaded})
+}
+
+// reset forgets the samples, for when the tips were moved back and the rate since is not comparable.
+func (r *syncRate) reset() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.samples = r.samples[:0]
+}
+
+// perSecond returns the headers downloaded per second from the oldest sample to now, so that the rate falls when the
+// downloads stall. It returns false until there are enough samples and any headers were downloaded since the oldest.
+func (r *syncRate) perSecond(now time.Time) (float64, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if len(r.samples) < minSyncRateSamples {
+		return 0, false
+	}
+	oldest := r.samples[0]
+	elapsed := now.Sub(oldest.time).Seconds()
+	if elapsed <= 0 || r.downloaded == oldest.downloaded {
+		return 0, false
+	}
+	return float64(r.downloaded-oldest.downloaded) / elapsed, true
+}
+
+// EstimatedTimeRemaining returns an estimate of how long it will take to download the block and filter headers up to
+// the height advertised by the sync peer, from the recent rate they were downloaded at. It returns false until enough
+// of the download has been sampled to estimate the rate, or when there is no sync peer, and zero once the tips are at
+// the advertised height.
+func (s *ChainService) EstimatedTimeRemaining() (time.Duration, bool) {
+	b := s.blockManager
+	if b == nil {
+		return 0, false
+	}
+	sp := b.SyncPeer()
+	if sp == nil {
+		return 0, false
+	}
+	target := sp.LastBlock()
+	b.newHeadersMtx.RLock()
+	headerTip := int32(b.headerTip)
+	b.newHeadersMtx.RUnlock()
+	b.newFilterHeadersMtx.RLock()
+	filterHeaderTip := int32(b.filterHeaderTip)
+	b.newFilterHeadersMtx.RUnlock()
+	var remaining int64
+	if target > headerTip {
+		remaining += int64(target - headerTip)
+	}
+	if target > filterHeaderTip {
+		remaining += int64(target - filterHeaderTip)
+	}
+	if remaining == 0 {
+		return 0, true
+	}
+	rate, ok := b.syncRate.perSecond(time.Now())
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second)), true
+}
@@ -0,0 +1,71 @@
+package spv
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throughput holds the rates that bytes were received from and sent to peers at over the last sample interval.
+type throughput struct {
+	mtx              sync.RWMutex
+	recvBps, sendBps float64
+	// recv and sent are the byte counters as of the last sample, taken at sampled.
+	recv, sent uint64
+	sampled    time.Time
+}
+
+// sample records the byte counters as of the given time, and returns the rates they grew at since the last sample. The
+// first sample only records the counters, and leaves the rates at zero.
+func (t *throughput) sample(recv, sent uint64, at time.Time) (recvBps, sendBps float64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !t.sampled.IsZero() && at.After(t.sampled) {
+		seconds := at.Sub(t.sampled).Seconds()
+		t.recvBps = float64(recv-t.recv) / seconds
+		t.sendBps = float64(sent-t.sent) / seconds
+	}
+	t.recv, t.sent, t.sampled = recv, sent, at
+	return t.recvBps, t.sendBps
+}
+
+// rates returns the rates found by the last sample.
+func (t *throughput) rates() (recvBps, sendBps float64) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.recvBps, t.sendBps
+}
+
+// Throughput returns the bytes per second received from and sent to all peers over the last
+// ThroughputSampleInterval. The rates are zero until two samples have been taken, and stay zero if
+// ThroughputSampleInterval is zero. It is safe for concurrent access.
+func (s *ChainService) Throughput() (recvBps, sendBps float64) {
+	return s.throughput.rates()
+}
+
+// throughputHandler samples the byte counters every ThroughputSampleInterval until the ChainService quits, calling
+// Config.OnThroughput with the rates if it is set. It must be run as a goroutine.
+func (s *ChainService) throughputHandler() {
+	defer s.wg.Done()
+	s.sampleThroughput(time.Now())
+	ticker := time.NewTicker(ThroughputSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			recvBps, sendBps := s.sampleThroughput(now)
+			if s.onThroughput != nil {
+				s.onThroughput(recvBps, sendBps)
+			}
+		case <-s.quit.Wait():
+			return
+		}
+	}
+}
+
+// sampleThroughput takes a sample of the byte counters at the given time.
+func (s *ChainService) sampleThroughput(now time.Time) (recvBps, sendBps float64) {
+	return s.throughput.sample(
+		atomic.LoadUint64(&s.bytesReceived), atomic.LoadUint64(&s.bytesSent), now,
+	)
+}
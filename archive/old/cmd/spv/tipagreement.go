@@ -0,0 +1,39 @@
+package spv
+
+import (
+	"github.com/p9c/pod/pkg/chainhash"
+)
+
+// tipAgreeingPeers returns the number of peers whose advertised tip is consistent with the tip of the block headers:
+// peers that last advertised the height of the tip, and, if they announced a block, the tip itself.
+func tipAgreeingPeers(peers []*ServerPeer, tipHash *chainhash.Hash, tipHeight int32) (n int) {
+	for _, sp := range peers {
+		if sp.LastBlock() != tipHeight {
+			continue
+		}
+		if announced := sp.LastAnnouncedBlock(); announced != nil && *announced != *tipHash {
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// tipAgreed returns whether at least Config.MinAgreeingPeers connected peers advertise a tip consistent with the tip
+// of the block headers.
+func (s *ChainService) tipAgreed() bool {
+	if s.minAgreeingPeers <= 0 {
+		return true
+	}
+	tip, height, e := s.BlockHeaders.ChainTip()
+	if e != nil {
+		return false
+	}
+	tipHash := tip.BlockHash()
+	agreeing := tipAgreeingPeers(s.Peers(), &tipHash, int32(height))
+	if agreeing < s.minAgreeingPeers {
+		T.F("only %d of the %d peers needed agree on the tip %v", agreeing, s.minAgreeingPeers, tipHash)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package spv
+
+import (
+	"fmt"
+	
+	"github.com/p9c/pod/pkg/blockchain"
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// MerkleProof proves that a transaction is included in a block, with the merkle branch from the transaction to the
+// merkle root of the block header.
+type MerkleProof struct {
+	// Header is the header of the block that includes the transaction.
+	Header wire.BlockHeader
+	// TxHash is the hash of the proven transaction and Index its position in the block.
+	TxHash chainhash.Hash
+	Index  uint32
+	// Branch holds the sibling hashes on the path from the transaction to the merkle root, bottom up.
+	Branch []chainhash.Hash
+}
+
+// Root returns the merkle root the proof hashes up to, which matches the merkle root of Header for a valid proof.
+func (p *MerkleProof) Root() chainhash.Hash {
+	root := p.TxHash
+	index := p.Index
+	for i := range p.Branch {
+		if index&1 == 0 {
+			root = *blockchain.HashMerkleBranches(&root, &p.Branch[i])
+		} else {
+			root = *blockchain.HashMerkleBranches(&p.Branch[i], &root)
+		}
+		index >>= 1
+	}
+	return root
+}
+
+// Verify returns whether the proof shows that the transaction is included in the block of Header. The header itself
+// still has to be checked to be part of the chain.
+func (p *MerkleProof) Verify() bool {
+	return p.Root() == p.Header.MerkleRoot
+}
+
+// GetTxProof returns a merkle proof that the transaction is included in the block, which is fetched with GetBlock.
+// ErrTxNotInBlock is returned if the block doesn't include the transaction.
+func (s *ChainService) GetTxProof(txHash *chainhash.Hash, blockHash *chainhash.Hash) (*MerkleProof, error) {
+	blk, e := s.GetBlock(*blockHash)
+	if e != nil {
+		return nil, e
+	}
+	txs := blk.Transactions()
+	for i, tx := range txs {
+		if *tx.Hash() != *txHash {
+			continue
+		}
+		proof := &MerkleProof{
+			Header: blk.WireBlock().Header,
+			TxHash: *txHash,
+			Index:  uint32(i),
+			Branch: merkleBranch(blockchain.BuildMerkleTreeStore(txs, false), i),
+		}
+		if !proof.Verify() {
+			return nil, fmt.Errorf("merkle proof of transaction %s doesn't match the root of block %s", txHash, blockHash)
+		}
+		return proof, nil
+	}
+	return nil, ErrTxNotInBlock
+}
+
+// merkleBranch returns the sibling hashes on the path from the leaf at index to the root of the merkle tree, as stored
+// by blockchain.BuildMerkleTreeStore. A missing right sibling is the node itself, as a lone left node is hashed with
+// itself.
+func merkleBranch(merkles blockchain.MerkleTree, index int) (branch []chainhash.Hash) {
+	offset := 0
+	for width := (len(merkles) + 1) / 2; width > 1; width /= 2 {
+		sibling := merkles[offset+(index^1)]
+		if sibling == nil {
+			sibling = merkles[offset+index]
+		}
+		branch = append(branch, *sibling)
+		offset += width
+		index /= 2
+	}
+	return branch
+}
@@ -0,0 +1,124 @@
+package spv
+
+import (
+	"encoding/binary"
+	"fmt"
+	
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/walletdb"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+var (
+	// UtxoScanCheckpointInterval is the number of blocks a GetUtxo scan goes through between saving its progress, when
+	// the UtxoScanner has a database to save it in.
+	UtxoScanCheckpointInterval = uint32(1000)
+	// utxoCheckpointBucket is the top level bucket the progress of GetUtxo scans is stored in, keyed by outpoint.
+	utxoCheckpointBucket = []byte("utxo-scan-checkpoints")
+)
+
+// utxoCheckpoint is the progress of a GetUtxo scan for the spend of an outpoint. The scan found the output at
+// birthHeight and it was still unspent in the block with the given height and hash.
+type utxoCheckpoint struct {
+	birthHeight uint32
+	height      uint32
+	hash        chainhash.Hash
+	output      *wire.TxOut
+}
+
+// utxoCheckpointKey returns the key the checkpoint of an outpoint is stored under.
+func utxoCheckpointKey(op *wire.OutPoint) []byte {
+	var key [chainhash.HashSize + 4]byte
+	copy(key[:], op.Hash[:])
+	binary.BigEndian.PutUint32(key[chainhash.HashSize:], op.Index)
+	return key[:]
+}
+
+// utxoCheckpointHeaderSize is the size of a serialized checkpoint without the output's script.
+const utxoCheckpointHeaderSize = 4 + 4 + chainhash.HashSize + 8
+
+// serialize encodes the checkpoint as its birth height, height, block hash, output value and output script.
+func (c *utxoCheckpoint) serialize() []byte {
+	v := make([]byte, utxoCheckpointHeaderSize, utxoCheckpointHeaderSize+len(c.output.PkScript))
+	binary.BigEndian.PutUint32(v[:4], c.birthHeight)
+	binary.BigEndian.PutUint32(v[4:8], c.height)
+	copy(v[8:], c.hash[:])
+	binary.BigEndian.PutUint64(v[8+chainhash.HashSize:], uint64(c.output.Value))
+	return append(v, c.output.PkScript...)
+}
+
+// deserializeUtxoCheckpoint decodes a checkpoint encoded by serialize.
+func deserializeUtxoCheckpoint(v []byte) (*utxoCheckpoint, error) {
+	if len(v) < utxoCheckpointHeaderSize {
+		return nil, fmt.Errorf("utxo scan checkpoint of %d bytes is too short", len(v))
+	}
+	c := &utxoCheckpoint{
+		birthHeight: binary.BigEndian.Uint32(v[:4]),
+		height:      binary.BigEndian.Uint32(v[4:8]),
+		output: wire.NewTxOut(
+			int64(binary.BigEndian.Uint64(v[8+chainhash.HashSize:])),
+			append([]byte(nil), v[utxoCheckpointHeaderSize:]...),
+		),
+	}
+	copy(c.hash[:], v[8:8+chainhash.HashSize])
+	return c, nil
+}
+
+// fetchUtxoCheckpoint returns the stored checkpoint of the outpoint, or nil if there isn't one.
+func fetchUtxoCheckpoint(db walletdb.DB, op *wire.OutPoint) (c *utxoCheckpoint, e error) {
+	e = walletdb.View(
+		db, func(tx walletdb.ReadTx) (e error) {
+			bucket := tx.ReadBucket(utxoCheckpointBucket)
+			if bucket == nil {
+				return nil
+			}
+			v := bucket.Get(utxoCheckpointKey(op))
+			if v == nil {
+				return nil
+			}
+			c, e = deserializeUtxoCheckpoint(v)
+			return e
+		},
+	)
+	return
+}
+
+// updateUtxoCheckpoints stores the given checkpoints and deletes those of the outpoints in remove in one transaction.
+func updateUtxoCheckpoints(
+	db walletdb.DB, checkpoints map[wire.OutPoint]*utxoCheckpoint,
+	remove []wire.OutPoint,
+) (e error) {
+	return walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			bucket := tx.ReadWriteBucket(utxoCheckpointBucket)
+			if bucket == nil {
+				if bucket, e = tx.CreateTopLevelBucket(utxoCheckpointBucket); e != nil {
+					return e
+				}
+			}
+			for i := range remove {
+				if e = bucket.Delete(utxoCheckpointKey(&remove[i])); e != nil {
+					return e
+				}
+			}
+			for op, c := range checkpoints {
+				if e = bucket.Put(utxoCheckpointKey(&op), c.serialize()); e != nil {
+					return e
+				}
+			}
+			return nil
+		},
+	)
+}
+
+// clearUtxoCheckpoints deletes every stored checkpoint.
+func clearUtxoCheckpoints(db walletdb.DB) (e error) {
+	return walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			if tx.ReadBucket(utxoCheckpointBucket) == nil {
+				return nil
+			}
+			return tx.DeleteTopLevelBucket(utxoCheckpointBucket)
+		},
+	)
+}
@@ -11,6 +11,8 @@ import (
 	
 	"github.com/p9c/pod/pkg/chainhash"
 	am "github.com/p9c/pod/pkg/waddrmgr"
+	"github.com/p9c/pod/pkg/walletdb"
+	"github.com/p9c/pod/pkg/wire"
 )
 
 type (
@@ -32,6 +34,10 @@ type (
 		// gets cached in result.
 		mu   sync.Mutex
 		quit qu.C
+		// resumeHeight is the height the scan for this request starts from when it resumes a saved checkpoint, and
+		// initialOutput is the output that scan found at BirthHeight. Both are unset when scanning from BirthHeight.
+		resumeHeight  uint32
+		initialOutput *wire.TxOut
 	}
 	// A GetUtxoRequestPQ implements heap.Interface and holds GetUtxoRequests.
 	// The queue maintains that heap. Pop() will always return the GetUtxo
@@ -66,6 +72,10 @@ type (
 		BlockFilterMatches func(ro *rescanOptions, blockHash *chainhash.Hash) (bool, error)
 		// GetBlock fetches a block from the p2p network.
 		GetBlock func(chainhash.Hash, ...QueryOption) (*block.Block, error)
+		// CheckpointDB is an optional database the progress of scans is saved in every UtxoScanCheckpointInterval
+		// blocks and when they are interrupted, so that a request for the same outpoint and birth height resumes near
+		// where the last scan stopped.
+		CheckpointDB walletdb.DB
 	}
 	// getUtxoResult is a simple pair type holding a spend report and error.
 	getUtxoResult struct {
@@ -105,6 +115,14 @@ func (r *GetUtxoRequest) deliver(report *SpendReport, e error) {
 	}
 }
 
+// startHeight returns the height the scan for the request starts from.
+func (r *GetUtxoRequest) startHeight() uint32 {
+	if r.initialOutput != nil {
+		return r.resumeHeight
+	}
+	return r.BirthHeight
+}
+
 // IsEmpty returns true if the queue has no elements.
 func (pq *GetUtxoRequestPQ) IsEmpty() bool {
 	return pq.Len() == 0
@@ -143,6 +161,9 @@ func (s *UtxoScanner) Enqueue(input *InputWithScript, birthHeight uint32) (*GetU
 		resultChan:  make(chan *getUtxoResult, 1),
 		quit:        s.quit,
 	}
+	if s.cfg.CheckpointDB != nil {
+		s.resumeFromCheckpoint(req)
+	}
 	s.cv.L.Lock()
 	select {
 	case <-s.quit.Wait():
@@ -158,6 +179,81 @@ func (s *UtxoScanner) Enqueue(input *InputWithScript, birthHeight uint32) (*GetU
 	return req, nil
 }
 
+// resumeFromCheckpoint sets the request to continue from the saved checkpoint of an earlier scan for the same outpoint
+// and birth height, if the block the checkpoint was saved at is still in the main chain.
+func (s *UtxoScanner) resumeFromCheckpoint(req *GetUtxoRequest) {
+	c, e := fetchUtxoCheckpoint(s.cfg.CheckpointDB, &req.Input.OutPoint)
+	if E.Chk(e) || c == nil || c.birthHeight != req.BirthHeight {
+		return
+	}
+	hash, e := s.cfg.GetBlockHash(int64(c.height))
+	if e != nil || hash == nil || *hash != c.hash {
+		D.F(
+			"checkpoint for %s at height %d is no longer in the main chain, scanning from %d",
+			req.Input.OutPoint, c.height, req.BirthHeight,
+		)
+		return
+	}
+	// The checkpointed block is scanned again, as the chain may not have grown past it yet.
+	D.F("resuming scan for %s from height %d", req.Input.OutPoint, c.height)
+	req.resumeHeight = c.height
+	req.initialOutput = c.output
+}
+
+// ClearCheckpoints deletes the saved progress of all scans, so that the next request for any outpoint scans from its
+// birth height. A scan that is running saves its progress again at its next checkpoint.
+func (s *UtxoScanner) ClearCheckpoints() (e error) {
+	if s.cfg.CheckpointDB == nil {
+		return nil
+	}
+	return clearUtxoCheckpoints(s.cfg.CheckpointDB)
+}
+
+// saveCheckpoints saves the progress of the scan for every outpoint the reporter is still waiting on the spend of,
+// which were all unspent in the block with the given height and hash, and deletes the checkpoints in saved of the
+// outpoints that are no longer waited on. A nil hash only deletes checkpoints.
+func (s *UtxoScanner) saveCheckpoints(
+	reporter *batchSpendReporter, height uint32,
+	hash *chainhash.Hash, saved map[wire.OutPoint]struct{},
+) {
+	if s.cfg.CheckpointDB == nil {
+		return
+	}
+	checkpoints := make(map[wire.OutPoint]*utxoCheckpoint)
+	if hash != nil {
+		for op, requests := range reporter.requests {
+			report := reporter.initialTxns[op]
+			if report == nil || report.Output == nil {
+				continue
+			}
+			checkpoints[op] = &utxoCheckpoint{
+				birthHeight: requests[0].BirthHeight,
+				height:      height,
+				hash:        *hash,
+				output:      report.Output,
+			}
+		}
+	}
+	var remove []wire.OutPoint
+	for op := range saved {
+		if _, ok := checkpoints[op]; !ok {
+			remove = append(remove, op)
+		}
+	}
+	if len(checkpoints) == 0 && len(remove) == 0 {
+		return
+	}
+	if e := updateUtxoCheckpoints(s.cfg.CheckpointDB, checkpoints, remove); E.Chk(e) {
+		return
+	}
+	for _, op := range remove {
+		delete(saved, op)
+	}
+	for op := range checkpoints {
+		saved[op] = struct{}{}
+	}
+}
+
 // Start begins running scan batches.
 func (s *UtxoScanner) Start() (e error) {
 	if !atomic.CompareAndSwapUint32(&s.started, 0, 1) {
@@ -224,9 +320,9 @@ func (s *UtxoScanner) batchManager() {
 			return
 		default:
 		}
-		// Initiate a scan, starting from the birth height of the least-height
+		// Initiate a scan, starting from the start height of the least-height
 		// request currently in the queue.
-		e := s.scanFromHeight(req.BirthHeight)
+		e := s.scanFromHeight(req.startHeight())
 		if e != nil {
 			E.F(
 				"UXTO scan failed: %v", e,
@@ -242,12 +338,12 @@ func (s *UtxoScanner) dequeueAtHeight(height uint32) []*GetUtxoRequest {
 	defer s.cv.L.Unlock()
 	// Take any requests that are too old to go in this batch and keep them for
 	// the next batch.
-	for !s.pq.IsEmpty() && s.pq.Peek().BirthHeight < height {
+	for !s.pq.IsEmpty() && s.pq.Peek().startHeight() < height {
 		item := heap.Pop(&s.pq).(*GetUtxoRequest)
 		s.nextBatch = append(s.nextBatch, item)
 	}
 	var requests []*GetUtxoRequest
-	for !s.pq.IsEmpty() && s.pq.Peek().BirthHeight == height {
+	for !s.pq.IsEmpty() && s.pq.Peek().startHeight() == height {
 		item := heap.Pop(&s.pq).(*GetUtxoRequest)
 		requests = append(requests, item)
 	}
@@ -273,6 +369,19 @@ func (s *UtxoScanner) scanFromHeight(initHeight uint32) (e error) {
 		endHeight   = uint32(bestStamp.Height)
 	)
 	reporter := newBatchSpendReporter()
+	var (
+		// scannedHeight and scannedHash are of the last block the scan went through, and checkpointHeight is the
+		// height the progress was last saved at. saved holds the outpoints with a saved checkpoint.
+		scannedHeight    = startHeight - 1
+		scannedHash      *chainhash.Hash
+		checkpointHeight = scannedHeight
+		saved            = make(map[wire.OutPoint]struct{})
+	)
+	// fail saves the progress of the scan before failing the remaining requests, so they can be resumed.
+	fail := func(e error) error {
+		s.saveCheckpoints(reporter, scannedHeight, scannedHash, saved)
+		return reporter.FailRemaining(e)
+	}
 scanToEnd:
 	// Scan forward through the blockchain and look for any transactions that
 	// might spend the given UTXOs.
@@ -281,17 +390,28 @@ scanToEnd:
 		// has been signaled to exit.
 		select {
 		case <-s.quit.Wait():
-			return reporter.FailRemaining(ErrShuttingDown)
+			return fail(ErrShuttingDown)
 		default:
 		}
+		if scannedHash != nil && scannedHeight-checkpointHeight >= UtxoScanCheckpointInterval {
+			s.saveCheckpoints(reporter, scannedHeight, scannedHash, saved)
+			checkpointHeight = scannedHeight
+		}
 		hash, e := s.cfg.GetBlockHash(int64(height))
 		if e != nil {
 			E.Ln(e)
-			return reporter.FailRemaining(e)
+			return fail(e)
 		}
 		// If there are any new requests that can safely be added to this batch,
-		// then try and fetch them.
+		// then try and fetch them. Requests resuming a checkpoint already know
+		// their output, so they are watched without fetching the block.
 		newReqs := s.dequeueAtHeight(height)
+		for _, req := range newReqs {
+			if req.initialOutput != nil {
+				saved[req.Input.OutPoint] = struct{}{}
+			}
+		}
+		newReqs = reporter.ResumeRequests(newReqs)
 		// If an outpoint is created in this block, then fetch it regardless.
 		// Otherwise check to see if the filter matches any of our watched
 		// outpoints.
@@ -303,11 +423,12 @@ scanToEnd:
 			match, e := s.cfg.BlockFilterMatches(&options, hash)
 			if e != nil {
 				E.Ln(e)
-				return reporter.FailRemaining(e)
+				return fail(e)
 			}
 			// If still no match is found, we have no reason to fetch this block,
 			// and can continue to next height.
 			if !match {
+				scannedHeight, scannedHash = height, hash
 				continue
 			}
 		}
@@ -319,23 +440,24 @@ scanToEnd:
 		// operation.
 		select {
 		case <-s.quit.Wait():
-			return reporter.FailRemaining(ErrShuttingDown)
+			return fail(ErrShuttingDown)
 		default:
 		}
 		T.F("fetching block height=%d hash=%s %s", height, hash)
 		block, e := s.cfg.GetBlock(*hash)
 		if e != nil {
 			E.Ln(e)
-			return reporter.FailRemaining(e)
+			return fail(e)
 		}
 		// Chk again to see if the utxoscanner has been signaled to exit.
 		select {
 		case <-s.quit.Wait():
-			return reporter.FailRemaining(ErrShuttingDown)
+			return fail(ErrShuttingDown)
 		default:
 		}
 		D.F("processing block height=%d hash=%s %s", height, hash)
 		reporter.ProcessBlock(block.WireBlock(), newReqs, height)
+		scannedHeight, scannedHash = height, hash
 	}
 	// We've scanned up to the end height, now perform a check to see if we still
 	// have any new blocks to process. If this is the first time through, we
@@ -343,7 +465,7 @@ scanToEnd:
 	currStamp, e := s.cfg.BestSnapshot()
 	if e != nil {
 		E.Ln(e)
-		return reporter.FailRemaining(e)
+		return fail(e)
 	}
 	// If the returned height is higher, we still have more blocks to go. Shift
 	// the start and end heights and continue scanning.
@@ -353,13 +475,15 @@ scanToEnd:
 		goto scanToEnd
 	}
 	reporter.NotifyUnspentAndUnfound()
+	// Every request has its result, so none of the checkpoints are needed any more.
+	s.saveCheckpoints(reporter, scannedHeight, nil, saved)
 	return nil
 }
 
-// We want Pop to give us the least BirthHeight.
+// We want Pop to give us the least start height.
 
 func (pq GetUtxoRequestPQ) Len() int           { return len(pq) }
-func (pq GetUtxoRequestPQ) Less(i, j int) bool { return pq[i].BirthHeight < pq[j].BirthHeight }
+func (pq GetUtxoRequestPQ) Less(i, j int) bool { return pq[i].startHeight() < pq[j].startHeight() }
 func (pq GetUtxoRequestPQ) Swap(i, j int)      { pq[i], pq[j] = pq[j], pq[i] }
 
 // NewUtxoScanner creates a new instance of UtxoScanner using the given chain interface.
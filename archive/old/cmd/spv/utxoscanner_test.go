@@ -13,6 +13,8 @@ import (
 	"github.com/p9c/pod/pkg/chainhash"
 	"github.com/p9c/pod/pkg/gcs"
 	"github.com/p9c/pod/pkg/waddrmgr"
+	"github.com/p9c/pod/pkg/walletdb"
+	_ "github.com/p9c/pod/pkg/walletdb/bdb"
 	"github.com/p9c/pod/pkg/wire"
 )
 
@@ -892,3 +894,110 @@ var Block100000 = wire.Block{
 		},
 	},
 }
+
+// TestUtxoScannerResumeCheckpoint ensures an interrupted scan saves its progress, that a new request for the same
+// outpoint resumes from it with the output the first scan found, and that the checkpoint is deleted once the request
+// has its result.
+func TestUtxoScannerResumeCheckpoint(t *testing.T) {
+	db, e := walletdb.Create("bdb", t.TempDir()+"/utxo.db")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+	mockChainClient := NewMockChainClient()
+	block100000Hash := Block100000.BlockHash()
+	mockChainClient.SetBlockHash(100000, &block100000Hash)
+	mockChainClient.SetBlock(&block100000Hash, block2.NewBlock(&Block100000))
+	mockChainClient.SetBestSnapshot(&block100000Hash, 100001)
+	hashErr := errors.New("cannot get block hash")
+	getBlock := mockChainClient.GetBlockFromNetwork
+	filterMatches := true
+	scanner := NewUtxoScanner(
+		&UtxoScannerConfig{
+			GetBlock: func(hash chainhash.Hash, options ...QueryOption) (*block2.Block, error) {
+				return getBlock(hash, options...)
+			},
+			GetBlockHash: func(height int64) (*chainhash.Hash, error) {
+				if hash, e := mockChainClient.GetBlockHash(height); hash != nil {
+					return hash, e
+				}
+				return nil, hashErr
+			},
+			BestSnapshot: mockChainClient.BestSnapshot,
+			BlockFilterMatches: func(*rescanOptions, *chainhash.Hash) (bool, error) {
+				return filterMatches, nil
+			},
+			CheckpointDB: db,
+		},
+	)
+	// This output is created in block 100000 and never spent.
+	hash, _ := chainhash.NewHashFromStr(
+		"e9a66845e05d5abc0ad04ec80f774a7e585c6e8db975962d069a522137b80c1d",
+	)
+	input := &InputWithScript{
+		OutPoint: wire.OutPoint{Hash: *hash, Index: 0},
+		PkScript: []byte("76a91439aa3d569e06a1d7926dc4be1193c99bf2eb9ee08"),
+	}
+	// The scan fails after block 100000 as the next block can't be found, which leaves a checkpoint at 100000.
+	req, e := scanner.Enqueue(input, 100000)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = scanner.scanFromHeight(req.startHeight()); e != hashErr {
+		t.Fatalf("scan returned %v, want %v", e, hashErr)
+	}
+	if _, e = req.Result(nil); e != hashErr {
+		t.Fatalf("request failed with %v, want %v", e, hashErr)
+	}
+	c, e := fetchUtxoCheckpoint(db, &input.OutPoint)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if c == nil || c.birthHeight != 100000 || c.height != 100000 || c.hash != block100000Hash ||
+		c.output.Value != 1000000 {
+		t.Fatalf("unexpected checkpoint %+v", c)
+	}
+	// The next request resumes from the checkpoint, so the block creating the output isn't needed again.
+	mockChainClient.SetBestSnapshot(&block100000Hash, 100000)
+	filterMatches = false
+	getBlock = func(chainhash.Hash, ...QueryOption) (*block2.Block, error) {
+		t.Fatal("block fetched for a resumed scan")
+		return nil, nil
+	}
+	req, e = scanner.Enqueue(input, 100000)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if req.initialOutput == nil || req.startHeight() != 100000 {
+		t.Fatalf("request starts from %d and has output %v", req.startHeight(), req.initialOutput)
+	}
+	if e = scanner.scanFromHeight(req.startHeight()); e != nil {
+		t.Fatal(e)
+	}
+	report, e := req.Result(nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if report == nil || report.SpendingTx != nil || report.Output.Value != 1000000 {
+		t.Fatalf("expected the unspent output, got %+v", report)
+	}
+	if c, e = fetchUtxoCheckpoint(db, &input.OutPoint); e != nil || c != nil {
+		t.Fatalf("checkpoint %+v remains after the result, error %v", c, e)
+	}
+	// A checkpoint is discarded once cleared.
+	c = &utxoCheckpoint{
+		birthHeight: 100000,
+		height:      100000,
+		hash:        block100000Hash,
+		output:      wire.NewTxOut(1000000, input.PkScript),
+	}
+	if e = updateUtxoCheckpoints(db, map[wire.OutPoint]*utxoCheckpoint{input.OutPoint: c}, nil); e != nil {
+		t.Fatal(e)
+	}
+	if e = scanner.ClearCheckpoints(); e != nil {
+		t.Fatal(e)
+	}
+	if c, e = fetchUtxoCheckpoint(db, &input.OutPoint); e != nil || c != nil {
+		t.Fatalf("checkpoint %+v remains after clearing, error %v", c, e)
+	}
+}
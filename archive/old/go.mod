@@ -23,6 +23,7 @@ require (
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0
 	github.com/kkdai/bstream v1.0.0
+	github.com/klauspost/compress v1.15.15
 	github.com/kr/text v0.2.0 // indirect
 	github.com/marusama/semaphore v0.0.0-20190110074507-6952cef993b2
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
@@ -515,6 +515,31 @@ func (a *AddrManager) AddAddresses(addrs []*wire.NetAddress, srcAddr *wire.NetAd
 	}
 }
 
+// SourcedAddress is an address together with the address it was learned from, which decides the new bucket it is
+// placed in.
+type SourcedAddress struct {
+	Addr   *wire.NetAddress
+	Source *wire.NetAddress
+}
+
+// AddSourcedAddresses adds new addresses to the address manager, each attributed to its own source. A nil Source
+// attributes the address to itself, for addresses such as those from DNS seeds that were not learned from a peer.
+//
+// It enforces a max number of addresses and silently ignores duplicate addresses.
+//
+// It is safe for concurrent access.
+func (a *AddrManager) AddSourcedAddresses(addrs []SourcedAddress) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for _, sa := range addrs {
+		srcAddr := sa.Source
+		if srcAddr == nil {
+			srcAddr = sa.Addr
+		}
+		a.updateAddress(sa.Addr, srcAddr)
+	}
+}
+
 // AddAddress adds a new address to the address manager.
 //
 // It enforces a max number of addresses and silently ignores duplicate addresses.
@@ -614,23 +639,28 @@ func (a *AddrManager) reset() {
 
 // HostToNetAddress returns a netaddress given a host address.
 //
-// If the address is a Tor .onion address this will be taken care of.
+// If the address is a Tor .onion address this will be taken care of. Onion addresses are never resolved, and a v3
+// address, which does not fit in an OnionCat IP, is mapped from the first 10 bytes of its key. That mapping cannot be
+// turned back into the onion address and only serves to tell peers apart.
 //
 // Else if the host is not an IP address it will be resolved ( via Tor if required).
 func (a *AddrManager) HostToNetAddress(host string, port uint16, services wire.ServiceFlag) (*wire.NetAddress, error) {
-	// Tor address is 16 char base32 + ".onion"
+	// Tor address is 16 (v2) or 56 (v3) char base32 + ".onion"
 	var ip net.IP
-	if len(host) == 22 && host[16:] == ".onion" {
+	if strings.HasSuffix(strings.ToLower(host), ".onion") {
+		name := host[:len(host)-len(".onion")]
+		if len(name) != 16 && len(name) != 56 {
+			return nil, fmt.Errorf("invalid onion address %s", host)
+		}
 		// go base32 encoding uses capitals (as does the rfc but Tor and bitcoind tend to user lowercase, so we switch
 		// case here.
-		data, e := base32.StdEncoding.DecodeString(
-			strings.ToUpper(host[:16]))
+		data, e := base32.StdEncoding.DecodeString(strings.ToUpper(name))
 		if e != nil  {
 			E.Ln(e)
 			return nil, e
 		}
 		prefix := []byte{0xfd, 0x87, 0xd8, 0x7e, 0xeb, 0x43}
-		ip = append(prefix, data...)
+		ip = append(prefix, data[:10]...)
 	} else if ip = net.ParseIP(host); ip == nil {
 		ips, e := a.lookupFunc(host)
 		if e != nil  {
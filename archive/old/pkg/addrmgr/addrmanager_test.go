@@ -1,10 +1,12 @@
 package addrmgr_test
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 	
@@ -216,6 +218,48 @@ func TestConnected(t *testing.T) {
 		t.Errorf("Address should have a new timestamp, but does not")
 	}
 }
+func TestAddSourcedAddresses(t *testing.T) {
+	n := addrmgr.New("testaddsourcedaddresses", lookupFunc)
+	src := wire.NewNetAddressIPPort(net.ParseIP("12.1.2.3"), 11047, 0)
+	addrs := []addrmgr.SourcedAddress{
+		{Addr: wire.NewNetAddressIPPort(net.ParseIP("173.194.115.66"), 11047, 0), Source: src},
+		{Addr: wire.NewNetAddressIPPort(net.ParseIP("8.8.8.8"), 11047, 0)},
+		{Addr: wire.NewNetAddressIPPort(net.ParseIP("1.1.1.1"), 11047, 0)},
+		// a duplicate from another source is ignored
+		{Addr: wire.NewNetAddressIPPort(net.ParseIP("8.8.8.8"), 11047, 0), Source: src},
+	}
+	n.AddSourcedAddresses(addrs)
+	if got := n.NumAddresses(); got != 3 {
+		t.Fatalf("expected 3 addresses, got %d", got)
+	}
+}
+func TestExportImportAddresses(t *testing.T) {
+	from := addrmgr.New("testexportaddresses", lookupFunc)
+	src := wire.NewNetAddressIPPort(net.ParseIP("12.1.2.3"), 11047, 0)
+	na := wire.NewNetAddressIPPort(net.ParseIP("173.194.115.66"), 11047, wire.SFNodeNetwork|wire.SFNodeCF)
+	from.AddAddress(na, src)
+	from.AddAddress(wire.NewNetAddressIPPort(net.ParseIP("8.8.8.8"), 11047, 0), src)
+	var buf bytes.Buffer
+	if e := from.ExportAddresses(&buf); e != nil {
+		t.Fatal(e)
+	}
+	to := addrmgr.New("testimportaddresses", lookupFunc)
+	if e := to.ImportAddresses(&buf); e != nil {
+		t.Fatal(e)
+	}
+	if got := to.NumAddresses(); got != 2 {
+		t.Fatalf("expected 2 imported addresses, got %d", got)
+	}
+	for _, addr := range to.AddressCache() {
+		if addr.IP.Equal(na.IP) && (addr.Services != na.Services || !addr.Timestamp.Equal(na.Timestamp)) {
+			t.Fatalf("imported address has services %v seen at %v, want %v seen at %v",
+				addr.Services, addr.Timestamp, na.Services, na.Timestamp)
+		}
+	}
+	if e := to.ImportAddresses(strings.NewReader(`{"Version":1,"Addresses":[{"Addr":"nonsense"}]}`)); e == nil {
+		t.Fatal("expected an error importing a malformed address")
+	}
+}
 func TestNeedMoreAddresses(t *testing.T) {
 	n := addrmgr.New("testneedmoreaddresses", lookupFunc)
 	addrsToAdd := 1500
@@ -421,3 +465,41 @@ func TestNetAddressKey(t *testing.T) {
 		}
 	}
 }
+func TestHostToNetAddressOnion(t *testing.T) {
+	n := addrmgr.New("testhosttonetaddressonion", func(host string) ([]net.IP, error) {
+		t.Errorf("unexpected lookup of %s", host)
+		return nil, errors.New("not implemented")
+	})
+	tests := []struct {
+		host  string
+		want  string
+		valid bool
+	}{
+		{"aaaaaaaaaaaaaaaa.onion", "aaaaaaaaaaaaaaaa.onion", true},
+		{"AAAAAAAAAAAAAAAA.Onion", "aaaaaaaaaaaaaaaa.onion", true},
+		{"pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd.onion", "pg6mmjiyjmcrsslv.onion", true},
+		{"PG6MMJIYJMCRSSLVYKFWNNTLARU7P5SVN6Y2YMMJU6NUBXNDF4PSCRYD.ONION", "pg6mmjiyjmcrsslv.onion", true},
+		{"aaaaaaaaaaaaaaa.onion", "", false},
+		{"aaaaaaaaaaaaaaa1.onion", "", false},
+	}
+	for i, test := range tests {
+		na, e := n.HostToNetAddress(test.host, 11047, wire.SFNodeNetwork)
+		if !test.valid {
+			if e == nil {
+				t.Errorf("HostToNetAddress #%d (%s) accepted an invalid address", i, test.host)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("HostToNetAddress #%d (%s): %v", i, test.host, e)
+			continue
+		}
+		if !addrmgr.IsOnionCatTor(na) {
+			t.Errorf("HostToNetAddress #%d (%s) is not an onion address: %v", i, test.host, na.IP)
+			continue
+		}
+		if key := addrmgr.NetAddressKey(na); key != net.JoinHostPort(test.want, "11047") {
+			t.Errorf("HostToNetAddress #%d (%s)\n got: %s want: %s", i, test.host, key, test.want)
+		}
+	}
+}
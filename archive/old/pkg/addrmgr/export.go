@@ -0,0 +1,80 @@
+package addrmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+	
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// exportVersion is the current version of the format addresses are exported in.
+const exportVersion = 1
+
+// exportedAddress is a known address as it is exported. The buckets and attempt counts of the address are only
+// meaningful to the address manager that keeps them, whose key decides the buckets, so only the address, the source it
+// was learned from, its services and when it was last seen are exported.
+type exportedAddress struct {
+	Addr      string
+	Src       string
+	Services  wire.ServiceFlag
+	TimeStamp int64
+}
+type exportedAddresses struct {
+	Version   int
+	Addresses []exportedAddress
+}
+
+// ExportAddresses writes the known addresses that are not considered bad to w as JSON, which another address manager
+// can read back with ImportAddresses.
+//
+// It is safe for concurrent access.
+func (a *AddrManager) ExportAddresses(w io.Writer) (e error) {
+	a.mtx.Lock()
+	ea := exportedAddresses{Version: exportVersion}
+	for k, v := range a.addrIndex {
+		if v.isBad() {
+			continue
+		}
+		ea.Addresses = append(
+			ea.Addresses, exportedAddress{
+				Addr:      k,
+				Src:       NetAddressKey(v.srcAddr),
+				Services:  v.na.Services,
+				TimeStamp: v.na.Timestamp.Unix(),
+			},
+		)
+	}
+	a.mtx.Unlock()
+	return json.NewEncoder(w).Encode(&ea)
+}
+
+// ImportAddresses reads addresses written by ExportAddresses from r and adds them to the address manager as new
+// addresses, attributed to the sources they were exported with. Nothing is added if any of them fail to parse.
+//
+// It enforces a max number of addresses and silently ignores duplicate addresses.
+//
+// It is safe for concurrent access.
+func (a *AddrManager) ImportAddresses(r io.Reader) (e error) {
+	var ea exportedAddresses
+	if e = json.NewDecoder(r).Decode(&ea); E.Chk(e) {
+		return fmt.Errorf("error reading exported addresses: %v", e)
+	}
+	if ea.Version != exportVersion {
+		return fmt.Errorf("unknown version %v of exported addresses", ea.Version)
+	}
+	addrs := make([]SourcedAddress, len(ea.Addresses))
+	for i, v := range ea.Addresses {
+		if addrs[i].Addr, e = a.DeserializeNetAddress(v.Addr); E.Chk(e) {
+			return fmt.Errorf("failed to deserialize netaddress %s: %v", v.Addr, e)
+		}
+		addrs[i].Addr.Services = v.Services
+		addrs[i].Addr.Timestamp = time.Unix(v.TimeStamp, 0)
+		if addrs[i].Source, e = a.DeserializeNetAddress(v.Src); E.Chk(e) {
+			return fmt.Errorf("failed to deserialize netaddress %s: %v", v.Src, e)
+		}
+	}
+	a.AddSourcedAddresses(addrs)
+	return nil
+}
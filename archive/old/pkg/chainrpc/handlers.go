@@ -1444,7 +1444,7 @@ func HandleGetInfo(
 			DifficultySHA256D: dSHA256D,
 			DifficultyScrypt:  dScrypt,
 			TestNet:           (*s.Config.Network)[0] == 't',
-			RelayFee:          s.StateCfg.ActiveMinRelayTxFee.ToDUO(),
+			RelayFee:          s.Cfg.TxMemPool.MinRelayTxFee().ToDUO(),
 		}
 	case 1:
 		foundcount, height := 0, best.Height
@@ -1505,7 +1505,7 @@ func HandleGetInfo(
 			DifficultyStribog:   dStribog,
 			DifficultyX11:       dX11,
 			TestNet:             (*s.Config.Network)[0] == 't',
-			RelayFee:            s.StateCfg.ActiveMinRelayTxFee.ToDUO(),
+			RelayFee:            s.Cfg.TxMemPool.MinRelayTxFee().ToDUO(),
 		}
 	}
 	return ret, nil
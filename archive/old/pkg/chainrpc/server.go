@@ -65,6 +65,17 @@ type (
 		Message      wire.Message
 		ExcludePeers []*NodePeer
 	}
+	// BanSyncPeerMsg asks the peer handler to ban and disconnect a peer the sync manager caught sending a block over
+	// its limits.
+	BanSyncPeerMsg struct {
+		Peer   *peer.Peer
+		Reason string
+	}
+	// PermanenceChangeMsg tells the peer handler that the connection request of an outbound peer was promoted to
+	// permanent or demoted to transient.
+	PermanenceChangeMsg struct {
+		ConnReq *connmgr.ConnReq
+	}
 	// CFHeaderKV is a tuple of a filter header and its associated block hash. The struct is used to cache cfcheckpt
 	// responses.
 	CFHeaderKV struct {
@@ -322,6 +333,44 @@ func (n *Node) AnnounceNewTransactions(txns []*mempool.TxDesc) {
 	}
 }
 
+// banSyncPeer has the peer handler ban a peer the sync manager caught sending a block over its limits. The sync manager
+// calls it from its handler goroutine, so it doesn't wait for the peer handler.
+func (n *Node) banSyncPeer(p *peer.Peer, reason string) {
+	go func() {
+		select {
+		case n.Query <- BanSyncPeerMsg{Peer: p, Reason: reason}:
+		case <-n.Quit.Wait():
+		}
+	}()
+}
+
+// permanenceChanged is invoked by the connection manager when a connection request was promoted to permanent or
+// demoted to transient, and has the peer handler update the peer of the request.
+func (n *Node) permanenceChanged(c *connmgr.ConnReq) {
+	select {
+	case n.Query <- PermanenceChangeMsg{ConnReq: c}:
+	case <-n.Quit.Wait():
+	}
+}
+
+// HandlePermanenceChange moves the peer of a connection request that was promoted to permanent or demoted to transient
+// to the peers of its kind. It is invoked from the peerHandler goroutine.
+func (n *Node) HandlePermanenceChange(state *PeerState, c *connmgr.ConnReq) {
+	permanent := c.IsPermanent()
+	from, to := state.OutboundPeers, state.PersistentPeers
+	if !permanent {
+		from, to = to, from
+	}
+	for id, sp := range from {
+		if sp.ConnReq == c {
+			sp.Persistent = permanent
+			delete(from, id)
+			to[id] = sp
+			return
+		}
+	}
+}
+
 // BanPeer bans a peer that has already been connected to the server by ip.
 func (n *Node) BanPeer(sp *NodePeer) {
 	n.BanPeers <- sp
@@ -626,6 +675,10 @@ func (n *Node) HandleAddPeerMsg(state *PeerState, sp *NodePeer) bool {
 		state.InboundPeers[sp.ID()] = sp
 	} else {
 		state.OutboundGroups[addrmgr.GroupKey(sp.NA())]++
+		// The connection request may have been promoted or demoted since the peer was created.
+		if sp.ConnReq != nil {
+			sp.Persistent = sp.ConnReq.IsPermanent()
+		}
 		if sp.Persistent {
 			state.PersistentPeers[sp.ID()] = sp
 		} else {
@@ -735,6 +788,23 @@ func (n *Node) HandleQuery(state *PeerState, querymsg interface{}) {
 		)
 		// D.Ln(nonces)
 		msg.Reply <- int32(len(nonces))
+	case PermanenceChangeMsg:
+		n.HandlePermanenceChange(state, msg.ConnReq)
+	case BanSyncPeerMsg:
+		for _, peers := range []map[int32]*NodePeer{state.InboundPeers, state.OutboundPeers, state.PersistentPeers} {
+			sp, ok := peers[msg.Peer.ID()]
+			if !ok || sp.Peer != msg.Peer {
+				continue
+			}
+			// The ban is handled here rather than sent to the ban channel, which this goroutine reads.
+			if *n.Config.DisableBanning || sp.IsWhitelisted {
+				D.F("disconnecting peer %s: %s", sp, msg.Reason)
+			} else {
+				W.F("banning peer %s: %s", sp, msg.Reason)
+				n.HandleBanPeerMsg(state, sp)
+			}
+			sp.Disconnect()
+		}
 	case GetPeersMsg:
 		peers := make([]*NodePeer, 0, state.Count())
 		state.ForAllPeers(
@@ -791,6 +861,7 @@ func (n *Node) HandleQuery(state *PeerState, querymsg interface{}) {
 		go n.ConnManager.Connect(
 			&connmgr.ConnReq{
 				Addr:      netAddr,
+				Host:      msg.Addr,
 				Permanent: msg.Permanent,
 			},
 		)
@@ -992,7 +1063,7 @@ func (n *Node) OutboundPeerConnected(c *connmgr.ConnReq, conn net.Conn) {
 	if hh, _, e = net.SplitHostPort(cla); E.Chk(e) {
 	}
 	localIP := net.ParseIP(hh)
-	sp := NewServerPeer(n, localIP, c.Permanent)
+	sp := NewServerPeer(n, localIP, c.IsPermanent())
 	p, e := peer.NewOutboundPeer(NewPeerConfig(sp), c.Addr.String())
 	if e != nil {
 		E.F("cannot create outbound peer %n: %v %n", c.Addr, e)
@@ -2922,6 +2993,8 @@ func NewNode(listenAddrs []string, db database.DB, interruptChan qu.C, cx *Conte
 				DisableCheckpoints: *cx.Config.DisableCheckpoints,
 				MaxPeers:           *cx.Config.MaxPeers,
 				FeeEstimator:       s.FeeEstimator,
+				BlocksOnly:         *cx.Config.BlocksOnly,
+				BanPeer:            s.banSyncPeer,
 			},
 		)
 	if e != nil {
@@ -2999,13 +3072,17 @@ func NewNode(listenAddrs []string, db database.DB, interruptChan qu.C, cx *Conte
 	cMgr, e :=
 		connmgr.New(
 			&connmgr.Config{
-				Listeners:      listeners,
-				OnAccept:       s.InboundPeerConnected,
-				RetryDuration:  ConnectionRetryInterval,
-				TargetOutbound: uint32(targetOutbound),
-				Dial:           Dial(cx.StateCfg),
-				OnConnection:   s.OutboundPeerConnected,
-				GetNewAddress:  newAddressFunc,
+				Listeners:          listeners,
+				OnAccept:           s.InboundPeerConnected,
+				RetryDuration:      ConnectionRetryInterval,
+				TargetOutbound:     uint32(targetOutbound),
+				Dial:               Dial(cx.StateCfg),
+				OnConnection:       s.OutboundPeerConnected,
+				GetNewAddress:      newAddressFunc,
+				OnPermanenceChange: s.permanenceChanged,
+				Resolve: func(host string) (net.Addr, error) {
+					return AddrStringToNetAddr(cx.Config, cx.StateCfg, host)
+				},
 			},
 		)
 	if e != nil {
@@ -3025,6 +3102,7 @@ func NewNode(listenAddrs []string, db database.DB, interruptChan qu.C, cx *Conte
 		go s.ConnManager.Connect(
 			&connmgr.ConnReq{
 				Addr:      netAddr,
+				Host:      addr,
 				Permanent: true,
 			},
 		)
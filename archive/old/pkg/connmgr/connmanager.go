@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/p9c/pod/pkg/logg"
+	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,8 +19,30 @@ import (
 // delayed by the configured retry duration.
 const maxFailedAttempts = 3
 
-// ErrDialNil is used to indicate that Dial cannot be nil in the configuration.
-var ErrDialNil = errors.New("config: Dial cannot be nil")
+// maxFamilyAttempts is the maximum number of addresses drawn for a new
+// connection request while looking for one of the protocol the outbound
+// connections are short of, before the first one drawn is used anyway.
+const maxFamilyAttempts = 5
+
+var (
+	// ErrDialNil is used to indicate that Dial cannot be nil in the configuration.
+	ErrDialNil = errors.New("config: Dial cannot be nil")
+	// ErrManagerStopped is returned when a connection is requested after the
+	// connection manager has been stopped, or it stops while connecting.
+	ErrManagerStopped = errors.New("connection manager stopped")
+	// ErrConnCanceled is returned when a connection request is removed before
+	// the connection is established.
+	ErrConnCanceled = errors.New("connection request canceled")
+	// ErrMaxRetriesExceeded is returned when a permanent connection request has
+	// failed more than Config.MaxRetries times, after which it is not retried.
+	ErrMaxRetriesExceeded = errors.New("max connection retries exceeded")
+	// ErrNoAddresses is returned when GetNewAddresses returns no addresses for a
+	// new connection request.
+	ErrNoAddresses = errors.New("no addresses available")
+	// ErrListenerNotFound is returned by RemoveListener for a listener the
+	// connection manager isn't accepting connections on.
+	ErrListenerNotFound = errors.New("listener not found")
+)
 
 // maxRetryDuration is the max duration of time retrying of a persistent
 // connection is allowed to grow to. This is necessary since the retry logic
@@ -30,6 +54,10 @@ var maxRetryDuration = time.Hour
 // connections.
 var defaultRetryDuration = time.Second * 60
 
+// defaultBytesReportInterval is the default interval between reports of the
+// bytes transferred over each connection.
+var defaultBytesReportInterval = time.Second * 10
+
 // defaultTargetOutbound is the default number of outbound connections to
 // maintain.
 var defaultTargetOutbound = uint32(9)
@@ -60,6 +88,13 @@ type ConnReq struct {
 	state      ConnState
 	stateMtx   sync.RWMutex
 	retryCount uint32
+	// balanced is set while the request counts toward the balance of IPv4 and
+	// IPv6 outbound connections. It is guarded by the manager's familyMtx.
+	balanced bool
+	// Host is the host name and port Addr was resolved from. When it is set and
+	// Config.Resolve is too, a permanent request resolves it again before each
+	// retry, so that a peer whose address changed is retried at the new one.
+	Host string
 }
 
 // updateState updates the state of the connection request.
@@ -69,6 +104,23 @@ func (c *ConnReq) updateState(state ConnState) {
 	c.stateMtx.Unlock()
 }
 
+// updatePermanent changes whether the connection request is permanent. It is guarded by the state mutex, as the
+// request is read by dials that are under way while the connection handler changes it.
+func (c *ConnReq) updatePermanent(permanent bool) {
+	c.stateMtx.Lock()
+	c.Permanent = permanent
+	c.stateMtx.Unlock()
+}
+
+// IsPermanent returns whether the connection request is permanent. Unlike reading Permanent, it is safe to call while
+// ConnManager.SetPermanent may change it.
+func (c *ConnReq) IsPermanent() bool {
+	c.stateMtx.RLock()
+	permanent := c.Permanent
+	c.stateMtx.RUnlock()
+	return permanent
+}
+
 // ID returns a unique identifier for the connection request.
 func (c *ConnReq) ID() uint64 {
 	return atomic.LoadUint64(&c.id)
@@ -121,6 +173,17 @@ type Config struct {
 	// RetryDuration is the duration to wait before retrying connection requests.
 	// Defaults to 5s.
 	RetryDuration time.Duration
+	// MaxRetryDuration is the longest a permanent connection request waits
+	// between retries. Defaults to an hour.
+	MaxRetryDuration time.Duration
+	// ExponentialRetry doubles the wait between retries of a permanent
+	// connection request with each failure, starting from RetryDuration,
+	// instead of growing it by RetryDuration.
+	ExponentialRetry bool
+	// RetryJitter is the fraction, from 0 to 1, of each wait between retries of
+	// a permanent connection request that is cut off at random, so that the
+	// clients that lost the same peer at once don't all retry it at once.
+	RetryJitter float64
 	// OnConnection is a callback that is fired when a new outbound connection is
 	// established.
 	OnConnection func(*ConnReq, net.Conn)
@@ -130,8 +193,78 @@ type Config struct {
 	// GetNewAddress is a way to get an address to make a network connection to. If
 	// nil, no new connections will be made automatically.
 	GetNewAddress func() (net.Addr, error)
+	// GetNewAddresses is a way to get up to n addresses at once to make network
+	// connections to, for address sources that work in batches. When set, it is
+	// used to fill several outbound slots with one call, and in place of
+	// GetNewAddress if that is nil.
+	GetNewAddresses func(n int) ([]net.Addr, error)
 	// Dial connects to the address on the named network. It cannot be nil.
 	Dial func(net.Addr) (net.Conn, error)
+	// OnTargetReached is a callback that is fired when the number of established
+	// automatic connections first reaches TargetOutbound, less ReservedOutbound.
+	// Permanent connections don't count, and it isn't fired when there is no
+	// target. It is fired again the next time the target is reached after the
+	// count has dropped below it.
+	OnTargetReached func()
+	// OnPermanenceChange is a callback that is fired when SetPermanent has
+	// promoted a connection request to permanent or demoted it to transient.
+	// The request's IsPermanent gives what it was changed to.
+	OnPermanenceChange func(*ConnReq)
+	// MaxRetries is the number of times a permanent connection request is
+	// retried after failing to connect before it is given up on. Zero means it
+	// is retried forever.
+	MaxRetries uint32
+	// Resolve resolves the Host of a permanent connection request to the
+	// address it is retried at. If nil, requests are retried at the address
+	// they were made with.
+	Resolve func(host string) (net.Addr, error)
+	// IPv6Ratio is the fraction of the automatic outbound connections, from 0 to
+	// 1, to make to IPv6 addresses. When it is above zero new connection requests
+	// prefer addresses of whichever protocol is short of its share, so that a
+	// dual-stack host doesn't end up with every connection on one protocol.
+	// Permanent requests and addresses that aren't IP addresses are not counted.
+	IPv6Ratio float64
+	// OnBytesTransferred is a callback that is fired every BytesReportInterval
+	// for each established outbound connection, with the number of bytes sent
+	// and received over it since the previous report, so that the slowest
+	// connections can be found and dropped when the manager is at capacity.
+	// Connections are only wrapped to count their bytes when it is set.
+	OnBytesTransferred func(c *ConnReq, sent, recv uint64)
+	// BytesReportInterval is the interval between calls of OnBytesTransferred.
+	// Defaults to 10s.
+	BytesReportInterval time.Duration
+	// ReservedOutbound is the number of the TargetOutbound slots kept for
+	// permanent connection requests. Automatic connections are only made to
+	// fill the rest, so that after a mass disconnect the peers from
+	// GetNewAddress can't crowd out the retries of the permanent peers.
+	ReservedOutbound uint32
+}
+
+// countingConn is a connection that counts the bytes read from and written to
+// it, for Config.OnBytesTransferred.
+type countingConn struct {
+	net.Conn
+	// The following variables must only be used atomically.
+	sent, recv uint64
+}
+
+// Read reads from the connection and counts the bytes received.
+func (c *countingConn) Read(b []byte) (n int, e error) {
+	n, e = c.Conn.Read(b)
+	atomic.AddUint64(&c.recv, uint64(n))
+	return
+}
+
+// Write writes to the connection and counts the bytes sent.
+func (c *countingConn) Write(b []byte) (n int, e error) {
+	n, e = c.Conn.Write(b)
+	atomic.AddUint64(&c.sent, uint64(n))
+	return
+}
+
+// take returns the bytes sent and received since it was last called.
+func (c *countingConn) take() (sent, recv uint64) {
+	return atomic.SwapUint64(&c.sent, 0), atomic.SwapUint64(&c.recv, 0)
 }
 
 // registerPending is used to register a pending connection attempt. By
@@ -161,6 +294,39 @@ type handleFailed struct {
 	e error
 }
 
+// setTargetOutbound is used to change the number of outbound connections to maintain.
+type setTargetOutbound struct {
+	target uint32
+	done   qu.C
+}
+
+// setPermanent is used to promote a connection request to permanent or demote it to transient.
+type setPermanent struct {
+	id        uint64
+	permanent bool
+	done      qu.C
+}
+
+// setAddr is used to retry a connection request at the address its host now resolves to.
+type setAddr struct {
+	c    *ConnReq
+	addr net.Addr
+	done qu.C
+}
+
+// getPending is used to list the pending and established connection requests.
+type getPending struct {
+	reply chan []ConnReqInfo
+}
+
+// ConnReqInfo describes a connection request known to the connection manager.
+type ConnReqInfo struct {
+	ID        uint64
+	Addr      net.Addr
+	Permanent bool
+	State     ConnState
+}
+
 // ConnManager provides a manager to handle network connections.
 type ConnManager struct {
 	// The following variables must only be used atomically.
@@ -172,6 +338,13 @@ type ConnManager struct {
 	failedAttempts uint64
 	requests       chan interface{}
 	quit           qu.C
+	// families counts the IPv4 and IPv6 outbound connection requests that are
+	// balanced according to Config.IPv6Ratio.
+	families  [2]int
+	familyMtx sync.Mutex
+	// listenerMtx protects Cfg.Listeners, which RemoveListener changes while
+	// the connection manager runs.
+	listenerMtx sync.Mutex
 }
 
 // handleFailedConn handles a connection failed due to a disconnect or any other failure.
@@ -185,19 +358,18 @@ func (cm *ConnManager) handleFailedConn(c *ConnReq) {
 	if atomic.LoadInt32(&cm.stop) != 0 {
 		return
 	}
-	if c.Permanent {
-		c.retryCount++
-		d := time.Duration(c.retryCount) * cm.Cfg.RetryDuration
-		if d > maxRetryDuration {
-			d = maxRetryDuration
-		}
+	if c.IsPermanent() {
+		d := cm.retryDelay(atomic.AddUint32(&c.retryCount, 1))
 		T.F("retrying connection to %v in %v", c, d)
 		time.AfterFunc(
 			d, func() {
+				if addr := cm.resolveHost(c); addr != nil && !cm.setAddr(c, addr) {
+					return
+				}
 				cm.Connect(c)
 			},
 		)
-	} else if cm.Cfg.GetNewAddress != nil {
+	} else if cm.hasAddressSource() {
 		cm.failedAttempts++
 		if cm.failedAttempts >= maxFailedAttempts {
 			T.F(
@@ -225,10 +397,23 @@ func (cm *ConnManager) connHandler() {
 		pending = make(map[uint64]*ConnReq)
 		// conns represents the set of all actively connected peers.
 		conns = make(map[uint64]*ConnReq, cm.Cfg.TargetOutbound)
+		// targetReached is set once the OnTargetReached callback has fired, and
+		// cleared when the connection count drops below the target again.
+		targetReached bool
+		// bytesReports ticks when the bytes transferred over each connection
+		// are due to be reported, and is nil if they aren't.
+		bytesReports <-chan time.Time
 	)
+	if cm.Cfg.OnBytesTransferred != nil {
+		ticker := time.NewTicker(cm.Cfg.BytesReportInterval)
+		defer ticker.Stop()
+		bytesReports = ticker.C
+	}
 out:
 	for {
 		select {
+		case <-bytesReports:
+			cm.reportBytes(conns)
 		case req := <-cm.requests:
 			switch msg := req.(type) {
 			case registerPending:
@@ -250,12 +435,13 @@ out:
 				connReq.conn = msg.conn
 				conns[connReq.id] = connReq
 				T.Ln("connected to ", connReq)
-				connReq.retryCount = 0
+				atomic.StoreUint32(&connReq.retryCount, 0)
 				cm.failedAttempts = 0
 				delete(pending, connReq.id)
 				if cm.Cfg.OnConnection != nil {
 					go cm.Cfg.OnConnection(connReq, msg.conn)
 				}
+				targetReached = cm.updateTargetReached(conns, targetReached)
 			case handleDisconnected:
 				connReq, ok := conns[msg.id]
 				if !ok {
@@ -269,11 +455,14 @@ out:
 					connReq.updateState(ConnCanceled)
 					D.Ln("canceling:", connReq)
 					delete(pending, msg.id)
+					cm.releaseFamily(connReq)
 					continue
 				}
 				// An existing connection was located, mark as disconnected and execute disconnection callback.
 				T.Ln("disconnected from", connReq)
 				delete(conns, msg.id)
+				cm.releaseFamily(connReq)
+				targetReached = cm.updateTargetReached(conns, targetReached)
 				if connReq.conn != nil {
 					if e := connReq.conn.Close(); E.Chk(e) {
 					}
@@ -287,14 +476,19 @@ out:
 					connReq.updateState(ConnDisconnected)
 					continue
 				}
-				// Otherwise, we will attempt a reconnection if we do not have enough peers, or if this is a persistent
-				// peer. The connection request is re added to the pending map, so that subsequent processing of
-				// connections and failures do not ignore the request.
-				if uint32(len(conns)) < cm.Cfg.TargetOutbound ||
-					connReq.Permanent {
+				// Otherwise, we will attempt a reconnection if this is a persistent peer. The connection request is re
+				// added to the pending map, so that subsequent processing of connections and failures do not ignore the
+				// request.
+				if connReq.Permanent {
 					connReq.updateState(ConnPending)
 					pending[msg.id] = connReq
 					cm.handleFailedConn(connReq)
+					continue
+				}
+				// A transient request is done with, and a new one takes its place if we do not have enough peers.
+				connReq.updateState(ConnDisconnected)
+				if uint32(len(conns)) < cm.Cfg.TargetOutbound && cm.automaticRoom(pending, conns, 1) == 1 {
+					cm.handleFailedConn(connReq)
 				}
 			case handleFailed:
 				connReq := msg.c
@@ -303,9 +497,84 @@ out:
 					continue
 				}
 				connReq.updateState(ConnFailing)
+				cm.releaseFamily(connReq)
 				// T.F
 				// ("failed to connect to %v: %v", connReq, msg.err)
+				if cm.exceededRetries(connReq) {
+					D.Ln("giving up on", connReq, "--", ErrMaxRetriesExceeded)
+					delete(pending, connReq.id)
+					continue
+				}
 				cm.handleFailedConn(connReq)
+			case setTargetOutbound:
+				cm.Cfg.TargetOutbound = msg.target
+				targetReached = cm.updateTargetReached(conns, targetReached)
+				if have := uint32(len(pending) + len(conns)); have < msg.target {
+					if n := cm.automaticRoom(pending, conns, msg.target-have); n > 0 && cm.hasAddressSource() {
+						go cm.newConnReqs(int(n))
+					}
+				}
+				msg.done.Q()
+			case setPermanent:
+				connReq, ok := conns[msg.id]
+				if !ok {
+					connReq, ok = pending[msg.id]
+				}
+				if !ok || connReq.Permanent == msg.permanent {
+					msg.done.Q()
+					continue
+				}
+				D.Ln("setting permanent", msg.permanent, "for", connReq)
+				connReq.updatePermanent(msg.permanent)
+				if cm.Cfg.OnPermanenceChange != nil {
+					go cm.Cfg.OnPermanenceChange(connReq)
+				}
+				// A connection that changes kind moves in or out of the count of the automatic connections.
+				targetReached = cm.updateTargetReached(conns, targetReached)
+				// The retries are counted afresh from the change, so a promoted request isn't given up on because of
+				// the attempts it made while it was transient.
+				atomic.StoreUint32(&connReq.retryCount, 0)
+				if connReq.State() == ConnFailing {
+					if msg.permanent {
+						// A transient request that failed was replaced and left idle, so it is retried from here on.
+						cm.handleFailedConn(connReq)
+					} else {
+						// A permanent request that is failing is waiting to be retried, which a transient one isn't,
+						// so the retry is canceled and the slot is filled as for any other failed transient request.
+						connReq.updateState(ConnCanceled)
+						delete(pending, connReq.id)
+						cm.releaseFamily(connReq)
+						if uint32(len(pending)+len(conns)) < cm.Cfg.TargetOutbound &&
+							cm.automaticRoom(pending, conns, 1) == 1 && cm.hasAddressSource() {
+							go cm.NewConnReq()
+						}
+					}
+				}
+				msg.done.Q()
+			case setAddr:
+				// The address is only changed here, as the other requests read it from this goroutine.
+				msg.c.Addr = msg.addr
+				msg.done.Q()
+			case getPending:
+				infos := make([]ConnReqInfo, 0, len(pending)+len(conns))
+				for _, reqs := range []map[uint64]*ConnReq{pending, conns} {
+					for _, connReq := range reqs {
+						infos = append(
+							infos, ConnReqInfo{
+								ID:        connReq.id,
+								Addr:      connReq.Addr,
+								Permanent: connReq.Permanent,
+								State:     connReq.State(),
+							},
+						)
+					}
+				}
+				sort.Slice(
+					infos, func(i, j int) bool {
+						return infos[i].ID < infos[j].ID
+					},
+				)
+				msg.reply <- infos
 			}
 		case <-cm.quit.Wait():
 			break out
@@ -314,14 +583,111 @@ out:
 	cm.wg.Done()
 }
 
+// bytesReport is the bytes transferred over a connection since the last report.
+type bytesReport struct {
+	c          *ConnReq
+	sent, recv uint64
+}
+
+// reportBytes takes the bytes transferred over each connection since the last
+// report and passes them to Config.OnBytesTransferred, in order of request id.
+// The callback runs in another goroutine, so it may disconnect the connections
+// it is told about.
+func (cm *ConnManager) reportBytes(conns map[uint64]*ConnReq) {
+	reports := make([]bytesReport, 0, len(conns))
+	for _, connReq := range conns {
+		if conn, ok := connReq.conn.(*countingConn); ok {
+			sent, recv := conn.take()
+			reports = append(reports, bytesReport{connReq, sent, recv})
+		}
+	}
+	sort.Slice(
+		reports, func(i, j int) bool {
+			return reports[i].c.id < reports[j].c.id
+		},
+	)
+	go func() {
+		for _, r := range reports {
+			cm.Cfg.OnBytesTransferred(r.c, r.sent, r.recv)
+		}
+	}()
+}
+
+// resolveHost returns a fresh resolution of the Host of a connection request,
+// when it has one and Config.Resolve is set, or nil if the address it has is to
+// be kept, as when the host can't be resolved or resolves to the same address.
+func (cm *ConnManager) resolveHost(c *ConnReq) net.Addr {
+	if c.Host == "" || cm.Cfg.Resolve == nil {
+		return nil
+	}
+	addr, e := cm.Cfg.Resolve(c.Host)
+	if e != nil {
+		W.F("couldn't resolve %s, retrying %v: %v", c.Host, c.Addr, e)
+		return nil
+	}
+	if c.Addr != nil && addr.String() == c.Addr.String() {
+		return nil
+	}
+	D.F("%s now resolves to %v", c.Host, addr)
+	return addr
+}
+
+// setAddr has the connection handler change the address of a connection request to the one its host resolved to,
+// and returns false if the connection manager stopped first.
+func (cm *ConnManager) setAddr(c *ConnReq, addr net.Addr) bool {
+	done := qu.T()
+	select {
+	case cm.requests <- setAddr{c, addr, done}:
+	case <-cm.quit.Wait():
+		return false
+	}
+	select {
+	case <-done.Wait():
+		return true
+	case <-cm.quit.Wait():
+		return false
+	}
+}
+
+// retryDelay returns how long to wait before the given retry of a permanent
+// connection request, capped at MaxRetryDuration with RetryJitter applied.
+func (cm *ConnManager) retryDelay(retries uint32) time.Duration {
+	max := cm.Cfg.MaxRetryDuration
+	d := cm.Cfg.RetryDuration
+	if cm.Cfg.ExponentialRetry {
+		for i := uint32(1); i < retries && d < max; i++ {
+			d *= 2
+		}
+	} else {
+		d *= time.Duration(retries)
+	}
+	if d > max || d < 0 {
+		d = max
+	}
+	if cm.Cfg.RetryJitter > 0 {
+		d -= time.Duration(rand.Float64() * cm.Cfg.RetryJitter * float64(d))
+	}
+	return d
+}
+
+// exceededRetries returns true if the connection request is permanent and has
+// already been retried the maximum number of times.
+func (cm *ConnManager) exceededRetries(c *ConnReq) bool {
+	return c.IsPermanent() && cm.Cfg.MaxRetries != 0 &&
+		atomic.LoadUint32(&c.retryCount) >= cm.Cfg.MaxRetries
+}
+
 // NewConnReq creates a new connection request and connects to the corresponding address.
-func (cm *ConnManager) NewConnReq() {
+//
+// The errors returned wrap ErrManagerStopped if the connection manager is
+// stopped, or otherwise the error from getting an address or dialing it.
+func (cm *ConnManager) NewConnReq() (e error) {
 	T.Ln("creating new connreq @", logg.Caller("thingy", 1))
 	if atomic.LoadInt32(&cm.stop) != 0 {
-		return
+		return ErrManagerStopped
 	}
-	if cm.Cfg.GetNewAddress == nil {
-		return
+	if !cm.hasAddressSource() {
+		return nil
 	}
 	c := &ConnReq{}
 	atomic.StoreUint64(&c.id, atomic.AddUint64(&cm.connReqCount, 1))
@@ -331,36 +697,232 @@ func (cm *ConnManager) NewConnReq() {
 	select {
 	case cm.requests <- registerPending{c, done}:
 	case <-cm.quit.Wait():
-		return
+		return ErrManagerStopped
 	}
 	// Wait for the registration to successfully add the pending conn req to the conn manager's internal state.
 	select {
 	case <-done.Wait():
 	case <-cm.quit.Wait():
-		return
+		return ErrManagerStopped
 	}
-	addr, e := cm.Cfg.GetNewAddress()
-	if e != nil {
+	if e = cm.setNewAddress(c); e != nil {
 		// T.Ln(e)
 		select {
 		case cm.requests <- handleFailed{c, e}:
 		case <-cm.quit.Wait():
+			return ErrManagerStopped
 		}
+		return fmt.Errorf("getting new address for %v: %w", c, e)
+	}
+	return cm.Connect(c)
+}
+
+// automaticTarget returns the number of automatic connection requests to maintain, which is TargetOutbound less the
+// slots reserved for permanent requests.
+func (cm *ConnManager) automaticTarget() uint32 {
+	if cm.Cfg.ReservedOutbound >= cm.Cfg.TargetOutbound {
+		return 0
+	}
+	return cm.Cfg.TargetOutbound - cm.Cfg.ReservedOutbound
+}
+
+// automaticRoom returns how many of n new automatic connection requests fit in the slots that aren't reserved for
+// permanent requests. Failed requests don't count, as their retries are new ones.
+func (cm *ConnManager) automaticRoom(pending, conns map[uint64]*ConnReq, n uint32) uint32 {
+	if cm.Cfg.ReservedOutbound == 0 {
+		return n
+	}
+	var automatic uint32
+	for _, reqs := range []map[uint64]*ConnReq{pending, conns} {
+		for _, connReq := range reqs {
+			if !connReq.Permanent && connReq.State() != ConnFailing {
+				automatic++
+			}
+		}
+	}
+	target := cm.automaticTarget()
+	if automatic >= target {
+		return 0
+	}
+	if room := target - automatic; room < n {
+		return room
+	}
+	return n
+}
+
+// updateTargetReached returns whether the established automatic connections are at their target, given whether they
+// were, and fires OnTargetReached when they have just reached it. Permanent connections don't count towards the target,
+// and a target of zero is never reached.
+func (cm *ConnManager) updateTargetReached(conns map[uint64]*ConnReq, reached bool) bool {
+	target := cm.automaticTarget()
+	var automatic uint32
+	for _, connReq := range conns {
+		if !connReq.Permanent {
+			automatic++
+		}
+	}
+	if target == 0 || automatic < target {
+		return false
+	}
+	if !reached && cm.Cfg.OnTargetReached != nil {
+		go cm.Cfg.OnTargetReached()
+	}
+	return true
+}
+
+// hasAddressSource returns true if the config has a way to get addresses for new connection requests.
+func (cm *ConnManager) hasAddressSource() bool {
+	return cm.Cfg.GetNewAddress != nil || cm.Cfg.GetNewAddresses != nil
+}
+
+// getNewAddress returns an address for a new connection request from GetNewAddress, or if that is nil, a batch of one
+// from GetNewAddresses.
+func (cm *ConnManager) getNewAddress() (net.Addr, error) {
+	if cm.Cfg.GetNewAddress != nil {
+		return cm.Cfg.GetNewAddress()
+	}
+	addrs, e := cm.Cfg.GetNewAddresses(1)
+	if e != nil {
+		return nil, e
+	}
+	if len(addrs) == 0 {
+		return nil, ErrNoAddresses
+	}
+	return addrs[0], nil
+}
+
+// setNewAddress sets the address of a new connection request. When IPv6Ratio is set, addresses are drawn until one of
+// the protocol that is short of its share turns up, or failing that the first one drawn is used.
+func (cm *ConnManager) setNewAddress(c *ConnReq) (e error) {
+	if cm.Cfg.IPv6Ratio <= 0 {
+		c.Addr, e = cm.getNewAddress()
 		return
 	}
+	var first net.Addr
+	for i := 0; i < maxFamilyAttempts; i++ {
+		var addr net.Addr
+		if addr, e = cm.getNewAddress(); e != nil {
+			if first == nil {
+				return e
+			}
+			break
+		}
+		if cm.claimFamily(c, addr, false) {
+			return nil
+		}
+		if first == nil {
+			first = addr
+		}
+	}
+	cm.claimFamily(c, first, true)
+	return nil
+}
+
+// addrFamily returns 0 for an IPv4 address, 1 for an IPv6 address and -1 for an address that isn't an IP address.
+func addrFamily(addr net.Addr) int {
+	var ip net.IP
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	} else if host, _, e := net.SplitHostPort(addr.String()); e == nil {
+		ip = net.ParseIP(host)
+	}
+	switch {
+	case ip == nil:
+		return -1
+	case ip.To4() != nil:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// claimFamily sets the address of the connection request and counts it toward its protocol if the outbound connections
+// are short of that protocol, or if force is set, and returns whether the address was taken. Addresses that aren't IP
+// addresses are always taken and aren't counted.
+func (cm *ConnManager) claimFamily(c *ConnReq, addr net.Addr, force bool) bool {
+	cm.familyMtx.Lock()
+	defer cm.familyMtx.Unlock()
+	family := addrFamily(addr)
+	if family < 0 {
+		c.Addr = addr
+		return true
+	}
+	// The next connection goes to IPv6 if that brings the number of IPv6 connections closer to their share.
+	ipv4, ipv6 := float64(cm.families[0]), float64(cm.families[1])
+	short := 0
+	if ipv6+0.5 < cm.Cfg.IPv6Ratio*(ipv4+ipv6+1) {
+		short = 1
+	}
+	if !force && family != short {
+		return false
+	}
 	c.Addr = addr
-	cm.Connect(c)
+	c.balanced = true
+	cm.families[family]++
+	return true
+}
+
+// releaseFamily stops counting a connection request that has failed or been disconnected toward its protocol.
+func (cm *ConnManager) releaseFamily(c *ConnReq) {
+	cm.familyMtx.Lock()
+	defer cm.familyMtx.Unlock()
+	if !c.balanced {
+		return
+	}
+	c.balanced = false
+	cm.families[addrFamily(c.Addr)]--
+}
+
+// newConnReqs makes n new connection requests. When GetNewAddresses is set their addresses are fetched with a single
+// call, and any requests it doesn't return an address for are made one at a time with NewConnReq. When IPv6Ratio is
+// set twice as many addresses are fetched, to choose the ones that balance the protocols from.
+func (cm *ConnManager) newConnReqs(n int) {
+	var addrs []net.Addr
+	if cm.Cfg.GetNewAddresses != nil {
+		want := n
+		if cm.Cfg.IPv6Ratio > 0 {
+			want *= 2
+		}
+		var e error
+		if addrs, e = cm.Cfg.GetNewAddresses(want); e != nil {
+			T.Ln("getting", want, "new addresses:", e)
+			addrs = nil
+		}
+	}
+	var made int
+	for _, addr := range addrs {
+		if made == n {
+			break
+		}
+		c := &ConnReq{}
+		if cm.Cfg.IPv6Ratio <= 0 {
+			c.Addr = addr
+		} else if !cm.claimFamily(c, addr, false) {
+			continue
+		}
+		go cm.Connect(c)
+		made++
+	}
+	for ; made < n; made++ {
+		go cm.NewConnReq()
+	}
 }
 
 // Connect assigns an id and dials a connection to the address of the connection request.
-func (cm *ConnManager) Connect(c *ConnReq) {
+//
+// The errors returned wrap ErrManagerStopped if the connection manager is
+// stopped, ErrConnCanceled if the request was removed before it connected,
+// ErrMaxRetriesExceeded if a permanent request has failed for the last time, or
+// otherwise the error from dialing the address.
+func (cm *ConnManager) Connect(c *ConnReq) (e error) {
 	if atomic.LoadInt32(&cm.stop) != 0 {
-		return
+		return ErrManagerStopped
 	}
-	for i := range cm.Cfg.Listeners {
-		if cm.Cfg.Listeners[i].Addr().String() == c.Addr.String() {
+	listeners := cm.listeners()
+	for i := range listeners {
+		if listeners[i].Addr().String() == c.Addr.String() {
 			D.Ln("not making outbound connection to our own listener address")
-			return
+			return nil
 		}
 	}
 	if atomic.LoadUint64(&c.id) == 0 {
@@ -372,35 +934,58 @@ func (cm *ConnManager) Connect(c *ConnReq) {
 		select {
 		case cm.requests <- registerPending{c, done}:
 		case <-cm.quit.Wait():
-			return
+			return ErrManagerStopped
 		}
 		T.Ln("waiting for response")
 		// Wait for the registration to successfully add the pending conn req to the conn manager's internal state.
 		select {
 		case <-done.Wait():
 		case <-cm.quit.Wait():
-			return
+			return ErrManagerStopped
 		}
 	}
+	// A request removed while it was waiting to be retried is not dialed again.
+	if c.State() == ConnCanceled {
+		return fmt.Errorf("%w: %v", ErrConnCanceled, c)
+	}
 	T.Ln("response received")
-	if len(cm.Cfg.Listeners) > 0 {
-		T.F("%s attempting to connect to '%s'", cm.Cfg.Listeners[0].Addr(), c.Addr)
+	if len(listeners) > 0 {
+		T.F("%s attempting to connect to '%s'", listeners[0].Addr(), c.Addr)
 	}
 	// Traces(cm.Cfg.Dial)
 	conn, e := cm.Cfg.Dial(c.Addr)
 	// E.Ln(err, c.Addr)
 	if e != nil {
 		T.Ln(e)
+		// The retry count is checked and the request described before the failure is handled, as handling it counts
+		// another retry and may change the address of the request for the next one.
+		failure := fmt.Errorf("connecting to %v: %w", c, e)
+		if cm.exceededRetries(c) {
+			failure = fmt.Errorf("%w: %v: %v", ErrMaxRetriesExceeded, c, e)
+		}
 		select {
 		case cm.requests <- handleFailed{c, e}:
 		case <-cm.quit.Wait():
+			return ErrManagerStopped
 		}
-		return
+		return failure
+	}
+	if c.State() == ConnCanceled {
+		if e = conn.Close(); E.Chk(e) {
+		}
+		return fmt.Errorf("%w: %v", ErrConnCanceled, c)
+	}
+	if cm.Cfg.OnBytesTransferred != nil {
+		conn = &countingConn{Conn: conn}
 	}
 	select {
 	case cm.requests <- handleConnected{c, conn}:
 	case <-cm.quit.Wait():
+		if e = conn.Close(); E.Chk(e) {
+		}
+		return ErrManagerStopped
 	}
+	return nil
 }
 
 // Disconnect disconnects the connection corresponding to the given connection id. If permanent, the connection will be
@@ -428,6 +1013,65 @@ func (cm *ConnManager) Remove(id uint64) {
 	}
 }
 
+// SetTargetOutbound changes the number of outbound connections to maintain. When it is raised new connection requests
+// are made up to the new target. When it is lowered no connections are closed, but those that drop aren't replaced
+// until the count is below the new target.
+func (cm *ConnManager) SetTargetOutbound(target uint32) {
+	if atomic.LoadInt32(&cm.stop) != 0 {
+		return
+	}
+	done := qu.T()
+	select {
+	case cm.requests <- setTargetOutbound{target, done}:
+	case <-cm.quit.Wait():
+		return
+	}
+	select {
+	case <-done.Wait():
+	case <-cm.quit.Wait():
+	}
+}
+
+// SetPermanent promotes the connection request with the given id to permanent, so it is retried with an increasing
+// backoff whenever it fails or disconnects, or demotes it to transient, so it is dropped instead and its slot is filled
+// from the address source. A demoted request that is waiting to be retried is canceled. Ids that aren't pending or
+// established are ignored.
+func (cm *ConnManager) SetPermanent(id uint64, permanent bool) {
+	if atomic.LoadInt32(&cm.stop) != 0 {
+		return
+	}
+	done := qu.T()
+	select {
+	case cm.requests <- setPermanent{id, permanent, done}:
+	case <-cm.quit.Wait():
+		return
+	}
+	select {
+	case <-done.Wait():
+	case <-cm.quit.Wait():
+	}
+}
+
+// Pending returns the address and state of each connection request that is pending or established, ordered by id. The
+// ids can be passed to Remove to cancel a connection attempt that is stuck.
+func (cm *ConnManager) Pending() []ConnReqInfo {
+	if atomic.LoadInt32(&cm.stop) != 0 {
+		return nil
+	}
+	reply := make(chan []ConnReqInfo, 1)
+	select {
+	case cm.requests <- getPending{reply}:
+	case <-cm.quit.Wait():
+		return nil
+	}
+	select {
+	case infos := <-reply:
+		return infos
+	case <-cm.quit.Wait():
+		return nil
+	}
+}
+
 // listenHandler accepts incoming connections on a given listener.
 //
 // It must be run as a goroutine.
@@ -441,6 +1085,10 @@ func (cm *ConnManager) listenHandler(listener net.Listener) {
 		conn, e := listener.Accept()
 		if e != nil {
 			T.Ln(e)
+			// A listener that was removed is closed, and accepting on it is over.
+			if !cm.hasListener(listener) {
+				break
+			}
 			// Only log the error if not forcibly shutting down.
 			if atomic.LoadInt32(&cm.stop) == 0 {
 				E.Ln("can't accept connection:", e)
@@ -450,11 +1098,49 @@ func (cm *ConnManager) listenHandler(listener net.Listener) {
 		go cm.Cfg.OnAccept(conn)
 	}
 	cm.wg.Done()
-	if e := listener.Close(); E.Chk(e) {
-	}
 	T.Ln(fmt.Sprint("listener handler done for ", listener.Addr()))
 }
 
+// listeners returns the listeners the connection manager accepts connections on.
+func (cm *ConnManager) listeners() []net.Listener {
+	cm.listenerMtx.Lock()
+	defer cm.listenerMtx.Unlock()
+	return cm.Cfg.Listeners
+}
+
+// hasListener returns whether the connection manager accepts connections on the listener.
+func (cm *ConnManager) hasListener(listener net.Listener) bool {
+	for _, l := range cm.listeners() {
+		if l == listener {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveListener stops accepting connections on one of the listeners and closes it, so that its address can be bound
+// again, without affecting the other listeners, the connections already accepted or the outbound connections. It
+// returns ErrListenerNotFound if the connection manager has no such listener, or the error closing it.
+func (cm *ConnManager) RemoveListener(listener net.Listener) (e error) {
+	cm.listenerMtx.Lock()
+	i := 0
+	for i < len(cm.Cfg.Listeners) && cm.Cfg.Listeners[i] != listener {
+		i++
+	}
+	if i == len(cm.Cfg.Listeners) {
+		cm.listenerMtx.Unlock()
+		return ErrListenerNotFound
+	}
+	// A new slice is made rather than removing it in place, as the slice is shared with the config the connection
+	// manager was made with and with the callers of listeners.
+	listeners := make([]net.Listener, 0, len(cm.Cfg.Listeners)-1)
+	listeners = append(listeners, cm.Cfg.Listeners[:i]...)
+	cm.Cfg.Listeners = append(listeners, cm.Cfg.Listeners[i+1:]...)
+	cm.listenerMtx.Unlock()
+	D.Ln("removing listener", listener.Addr())
+	return listener.Close()
+}
+
 // Start launches the connection manager and begins connecting to the network.
 func (cm *ConnManager) Start() {
 	// Already started?
@@ -466,13 +1152,13 @@ func (cm *ConnManager) Start() {
 	// Start all the listeners so long as the caller requested them and provided a callback to be invoked when
 	// connections are accepted.
 	if cm.Cfg.OnAccept != nil {
-		for _, listner := range cm.Cfg.Listeners {
+		for _, listner := range cm.listeners() {
 			cm.wg.Add(1)
 			go cm.listenHandler(listner)
 		}
 	}
-	for i := atomic.LoadUint64(&cm.connReqCount); i < uint64(cm.Cfg.TargetOutbound); i++ {
-		go cm.NewConnReq()
+	if pending := atomic.LoadUint64(&cm.connReqCount); pending < uint64(cm.automaticTarget()) {
+		cm.newConnReqs(int(uint64(cm.automaticTarget()) - pending))
 	}
 }
 
@@ -488,7 +1174,7 @@ func (cm *ConnManager) Stop() {
 		return
 	}
 	// Stop all the listeners. There will not be any listeners if listening is disabled.
-	for _, listener := range cm.Cfg.Listeners {
+	for _, listener := range cm.listeners() {
 		// Ignore the error since this is shutdown and there is no way to recover anyways.
 		_ = listener.Close()
 	}
@@ -505,9 +1191,15 @@ func New(cfg *Config) (*ConnManager, error) {
 	if cfg.RetryDuration <= 1 {
 		cfg.RetryDuration = defaultRetryDuration
 	}
+	if cfg.MaxRetryDuration <= 0 {
+		cfg.MaxRetryDuration = maxRetryDuration
+	}
 	if cfg.TargetOutbound < 1 {
 		cfg.TargetOutbound = defaultTargetOutbound
 	}
+	if cfg.BytesReportInterval <= 0 {
+		cfg.BytesReportInterval = defaultBytesReportInterval
+	}
 	cm := ConnManager{
 		Cfg:      *cfg, // Copy so caller can't mutate
 		requests: make(chan interface{}),
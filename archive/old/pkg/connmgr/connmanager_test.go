@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -205,6 +207,449 @@ func TestTargetOutbound(t *testing.T) {
 	cmgr.Stop()
 }
 
+// TestBytesTransferred tests that the bytes sent and received over a connection are reported, each only once.
+func TestBytesTransferred(t *testing.T) {
+	type report struct {
+		c          *ConnReq
+		sent, recv uint64
+	}
+	reports := make(chan report, 100)
+	cmgr, e := New(&Config{
+		TargetOutbound: 1,
+		Dial: func(addr net.Addr) (net.Conn, error) {
+			return &mockConn{Reader: strings.NewReader("hello"), Writer: ioutil.Discard, rAddr: addr}, nil
+		},
+		GetNewAddress: func() (net.Addr, error) {
+			return &net.TCPAddr{
+				IP:   net.ParseIP("127.0.0.1"),
+				Port: 18555,
+			}, nil
+		},
+		OnConnection: func(c *ConnReq, conn net.Conn) {
+			if _, e := conn.Write([]byte("hey")); e != nil {
+				t.Error(e)
+			}
+			if _, e := ioutil.ReadAll(conn); e != nil {
+				t.Error(e)
+			}
+		},
+		OnBytesTransferred: func(c *ConnReq, sent, recv uint64) {
+			reports <- report{c, sent, recv}
+		},
+		BytesReportInterval: time.Millisecond * 5,
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	cmgr.Start()
+	defer cmgr.Stop()
+	var sent, recv uint64
+	timeout := time.After(time.Second)
+	for sent != 3 || recv != 5 {
+		select {
+		case r := <-reports:
+			if r.c.ID() != 1 {
+				t.Fatalf("bytes reported for connection %d, want 1", r.c.ID())
+			}
+			sent += r.sent
+			recv += r.recv
+			if sent > 3 || recv > 5 {
+				t.Fatalf("%d bytes sent and %d received reported, want 3 and 5", sent, recv)
+			}
+		case <-timeout:
+			t.Fatalf("%d bytes sent and %d received reported after a second, want 3 and 5", sent, recv)
+		}
+	}
+}
+
+// TestSetTargetOutbound tests that raising the target outbound at runtime makes new connections up to the new target.
+func TestSetTargetOutbound(t *testing.T) {
+	connected := make(chan *ConnReq)
+	cmgr, e := New(&Config{
+		TargetOutbound: 2,
+		Dial:           mockDialer,
+		GetNewAddress: func() (net.Addr, error) {
+			return &net.TCPAddr{
+				IP:   net.ParseIP("127.0.0.1"),
+				Port: 18555,
+			}, nil
+		},
+		OnConnection: func(c *ConnReq, conn net.Conn) {
+			connected <- c
+		},
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	cmgr.Start()
+	defer cmgr.Stop()
+	for i := 0; i < 2; i++ {
+		<-connected
+	}
+	cmgr.SetTargetOutbound(5)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-connected:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d connections made after raising the target", 2+i)
+		}
+	}
+	select {
+	case c := <-connected:
+		t.Fatalf("set target outbound: got unexpected connection - %v", c.Addr)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+// TestReservedOutbound tests that automatic connections leave the reserved slots free, and that permanent requests are
+// still connected.
+func TestReservedOutbound(t *testing.T) {
+	connected := make(chan *ConnReq)
+	cmgr, e := New(&Config{
+		TargetOutbound:   4,
+		ReservedOutbound: 2,
+		Dial:             mockDialer,
+		GetNewAddress: func() (net.Addr, error) {
+			return &net.TCPAddr{
+				IP:   net.ParseIP("127.0.0.1"),
+				Port: 18555,
+			}, nil
+		},
+		OnConnection: func(c *ConnReq, conn net.Conn) {
+			connected <- c
+		},
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	cmgr.Start()
+	defer cmgr.Stop()
+	expect := func(n int, permanent bool) {
+		for i := 0; i < n; i++ {
+			select {
+			case c := <-connected:
+				if c.Permanent != permanent {
+					t.Fatalf("got connection %v with permanent %v, want %v", c, c.Permanent, permanent)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("only %d of %d connections made", i, n)
+			}
+		}
+		select {
+		case c := <-connected:
+			t.Fatalf("reserved outbound: got unexpected connection - %v", c.Addr)
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+	expect(2, false)
+	go cmgr.Connect(&ConnReq{
+		Addr: &net.TCPAddr{
+			IP:   net.ParseIP("127.0.0.1"),
+			Port: 18556,
+		},
+		Permanent: true,
+	})
+	expect(1, true)
+	cmgr.SetTargetOutbound(5)
+	expect(1, false)
+}
+
+// TestReservedOutboundDisconnect tests that automatic connections that are disconnected over and over are replaced,
+// as the requests of the disconnected ones don't keep taking up the slots that aren't reserved.
+func TestReservedOutboundDisconnect(t *testing.T) {
+	connected := make(chan *ConnReq)
+	cmgr, e := New(&Config{
+		TargetOutbound:   4,
+		ReservedOutbound: 1,
+		Dial:             mockDialer,
+		GetNewAddress: func() (net.Addr, error) {
+			return &net.TCPAddr{
+				IP:   net.ParseIP("127.0.0.1"),
+				Port: 18555,
+			}, nil
+		},
+		OnConnection: func(c *ConnReq, conn net.Conn) {
+			connected <- c
+		},
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	cmgr.Start()
+	defer cmgr.Stop()
+	expect := func(n int) []*ConnReq {
+		reqs := make([]*ConnReq, 0, n)
+		for i := 0; i < n; i++ {
+			select {
+			case c := <-connected:
+				reqs = append(reqs, c)
+			case <-time.After(time.Second):
+				t.Fatalf("only %d of %d connections made", i, n)
+			}
+		}
+		select {
+		case c := <-connected:
+			t.Fatalf("reserved outbound: got unexpected connection - %v", c.Addr)
+		case <-time.After(time.Millisecond * 50):
+		}
+		return reqs
+	}
+	reqs := expect(3)
+	for round := 0; round < 5; round++ {
+		for _, c := range reqs {
+			cmgr.Disconnect(c.ID())
+		}
+		reqs = expect(3)
+		if pending := cmgr.Pending(); len(pending) != 3 {
+			t.Fatalf("round %d: %d connection requests held, want 3", round, len(pending))
+		}
+	}
+}
+
+// TestGetNewAddresses tests that the outbound slots are filled from a batched address source, with the slots the first
+// batch doesn't cover filled one address at a time.
+func TestGetNewAddresses(t *testing.T) {
+	targetOutbound := uint32(5)
+	connected := make(chan *ConnReq)
+	requested := make(chan int, targetOutbound)
+	cmgr, e := New(&Config{
+		TargetOutbound: targetOutbound,
+		Dial:           mockDialer,
+		GetNewAddresses: func(n int) ([]net.Addr, error) {
+			requested <- n
+			// Return fewer addresses than asked for the first time.
+			if n > 1 {
+				n -= 2
+			}
+			addrs := make([]net.Addr, n)
+			for i := range addrs {
+				addrs[i] = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 18555 + i}
+			}
+			return addrs, nil
+		},
+		OnConnection: func(c *ConnReq, conn net.Conn) {
+			connected <- c
+		},
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	cmgr.Start()
+	for i := uint32(0); i < targetOutbound; i++ {
+		select {
+		case <-connected:
+		case <-time.After(time.Second):
+			t.Fatalf("got %d connections, want %d", i, targetOutbound)
+		}
+	}
+	if n := <-requested; n != int(targetOutbound) {
+		t.Fatalf("first batch requested %d addresses, want %d", n, targetOutbound)
+	}
+	for i := 0; i < 2; i++ {
+		if n := <-requested; n != 1 {
+			t.Fatalf("requested %d addresses for a single slot", n)
+		}
+	}
+	select {
+	case n := <-requested:
+		t.Fatalf("unexpected request for %d more addresses", n)
+	case c := <-connected:
+		t.Fatalf("target outbound: got unexpected connection - %v", c.Addr)
+	case <-time.After(time.Millisecond * 10):
+	}
+	cmgr.Stop()
+}
+
+// TestIPv6Ratio tests that outbound connections are balanced between IPv4 and IPv6 addresses when the address source
+// mostly returns one protocol, and that a disconnected connection no longer counts toward the balance.
+func TestIPv6Ratio(t *testing.T) {
+	targetOutbound := uint32(4)
+	connected := make(chan *ConnReq)
+	var drawn uint32
+	cmgr, e := New(&Config{
+		TargetOutbound: targetOutbound,
+		IPv6Ratio:      0.5,
+		Dial:           mockDialer,
+		// Only every fourth address is an IPv6 address.
+		GetNewAddress: func() (net.Addr, error) {
+			n := atomic.AddUint32(&drawn, 1)
+			if n%4 == 0 {
+				return &net.TCPAddr{IP: net.ParseIP(fmt.Sprintf("2001:db8::%x", n)), Port: 18555}, nil
+			}
+			return &net.TCPAddr{IP: net.IPv4(10, 0, byte(n>>8), byte(n)), Port: 18555}, nil
+		},
+		OnConnection: func(c *ConnReq, conn net.Conn) {
+			connected <- c
+		},
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	cmgr.Start()
+	var ipv6 *ConnReq
+	var families [2]int
+	for i := uint32(0); i < targetOutbound; i++ {
+		select {
+		case c := <-connected:
+			family := addrFamily(c.Addr)
+			families[family]++
+			if family == 1 {
+				ipv6 = c
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %d connections, want %d", i, targetOutbound)
+		}
+	}
+	if families != [2]int{2, 2} {
+		t.Fatalf("got %d IPv4 and %d IPv6 connections, want 2 of each", families[0], families[1])
+	}
+	// The connection replacing a disconnected IPv6 one is to an IPv6 address as well.
+	cmgr.Disconnect(ipv6.ID())
+	select {
+	case c := <-connected:
+		if addrFamily(c.Addr) != 1 {
+			t.Fatalf("replacement connection to %v is not IPv6", c.Addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("disconnected connection was not replaced")
+	}
+	cmgr.Stop()
+}
+
+// TestOnTargetReached tests that the target reached callback fires once when the target number of outbound connections
+// is established, and fires again once the target is recovered after a disconnection.
+func TestOnTargetReached(t *testing.T) {
+	targetOutbound := uint32(3)
+	connected := make(chan *ConnReq, targetOutbound)
+	reached := make(chan struct{}, 2)
+	cmgr, e := New(&Config{
+		TargetOutbound: targetOutbound,
+		Dial:           mockDialer,
+		GetNewAddress: func() (net.Addr, error) {
+			return &net.TCPAddr{
+				IP:   net.ParseIP("127.0.0.1"),
+				Port: 18555,
+			}, nil
+		},
+		OnConnection: func(c *ConnReq, conn net.Conn) {
+			connected <- c
+		},
+		OnTargetReached: func() {
+			reached <- struct{}{}
+		},
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	cmgr.Start()
+	var last *ConnReq
+	for i := uint32(0); i < targetOutbound; i++ {
+		last = <-connected
+	}
+	select {
+	case <-reached:
+	case <-time.After(time.Second):
+		t.Fatalf("target reached: callback not fired")
+	}
+	// Dropping a connection should re-arm the callback, which fires again when the replacement connection is made.
+	cmgr.Disconnect(last.ID())
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatalf("target reached: no replacement connection")
+	}
+	select {
+	case <-reached:
+	case <-time.After(time.Second):
+		t.Fatalf("target reached: callback not fired after recovery")
+	}
+	select {
+	case <-reached:
+		t.Fatalf("target reached: callback fired too many times")
+	case <-time.After(time.Millisecond * 10):
+	}
+	cmgr.Stop()
+}
+
+// TestOnTargetReachedAutomatic tests that permanent connections don't count towards the target of the target reached
+// callback, and that it doesn't fire when all the outbound slots are reserved for permanent connections.
+func TestOnTargetReachedAutomatic(t *testing.T) {
+	connected := make(chan *ConnReq, 3)
+	reached := make(chan struct{}, 1)
+	// The second automatic request waits for its address until the permanent connection is made.
+	release := qu.T()
+	var addrs uint32
+	cmgr, e := New(&Config{
+		TargetOutbound: 2,
+		Dial:           mockDialer,
+		GetNewAddress: func() (net.Addr, error) {
+			if atomic.AddUint32(&addrs, 1) == 2 {
+				<-release.Wait()
+			}
+			return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 18555}, nil
+		},
+		OnConnection: func(c *ConnReq, conn net.Conn) {
+			connected <- c
+		},
+		OnTargetReached: func() {
+			reached <- struct{}{}
+		},
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	cmgr.Start()
+	defer cmgr.Stop()
+	defer release.Q()
+	go cmgr.Connect(&ConnReq{Addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 18556}, Permanent: true})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-connected:
+		case <-time.After(time.Second):
+			t.Fatalf("target reached: connection %d not made", i)
+		}
+	}
+	select {
+	case <-reached:
+		t.Fatalf("target reached: callback fired counting a permanent connection")
+	case <-time.After(time.Millisecond * 50):
+	}
+	release.Q()
+	select {
+	case <-reached:
+	case <-time.After(time.Second):
+		t.Fatalf("target reached: callback not fired for the automatic connections")
+	}
+	// With every slot reserved there is no target for automatic connections to reach.
+	reserved, e := New(&Config{
+		TargetOutbound:   1,
+		ReservedOutbound: 1,
+		Dial:             mockDialer,
+		OnConnection: func(c *ConnReq, conn net.Conn) {
+			connected <- c
+		},
+		OnTargetReached: func() {
+			reached <- struct{}{}
+		},
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	reserved.Start()
+	defer reserved.Stop()
+	go reserved.Connect(&ConnReq{Addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 18557}, Permanent: true})
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatalf("target reached: permanent connection not made")
+	}
+	select {
+	case <-reached:
+		t.Fatalf("target reached: callback fired without a target")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
 // TestRetryPermanent tests that permanent connection requests are retried. We make a permanent connection request using
 // Connect, disconnect it using Disconnect and we wait for it to be connected back.
 func TestRetryPermanent(t *testing.T) {
@@ -282,6 +727,81 @@ func TestRetryPermanent(t *testing.T) {
 	cmgr.Stop()
 }
 
+// TestSetPermanent tests that a transient connection promoted to permanent is retried when it disconnects, and that it
+// isn't once it is demoted again.
+func TestSetPermanent(t *testing.T) {
+	connected := make(chan *ConnReq)
+	disconnected := make(chan *ConnReq)
+	changed := make(chan bool, 2)
+	cmgr, e := New(&Config{
+		RetryDuration:  time.Millisecond,
+		TargetOutbound: 1,
+		Dial:           mockDialer,
+		OnConnection: func(c *ConnReq, conn net.Conn) {
+			connected <- c
+		},
+		OnDisconnection: func(c *ConnReq) {
+			disconnected <- c
+		},
+		OnPermanenceChange: func(c *ConnReq) {
+			changed <- c.IsPermanent()
+		},
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	cmgr.Start()
+	defer cmgr.Stop()
+	cr := &ConnReq{
+		Addr: &net.TCPAddr{
+			IP:   net.ParseIP("127.0.0.1"),
+			Port: 18555,
+		},
+	}
+	go cmgr.Connect(cr)
+	<-connected
+	cmgr.SetPermanent(cr.ID(), true)
+	if infos := cmgr.Pending(); len(infos) != 1 || !infos[0].Permanent {
+		t.Fatalf("set permanent: got %+v, want one permanent request", infos)
+	}
+	select {
+	case permanent := <-changed:
+		if !permanent {
+			t.Fatal("set permanent: change callback saw a transient request")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("set permanent: change callback not fired")
+	}
+	cmgr.Disconnect(cr.ID())
+	<-disconnected
+	select {
+	case c := <-connected:
+		if c.ID() != cr.ID() {
+			t.Fatalf("set permanent: want ID %v, got ID %v", cr.ID(), c.ID())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("set permanent: promoted connection was not retried")
+	}
+	cmgr.SetPermanent(cr.ID(), false)
+	cmgr.Disconnect(cr.ID())
+	<-disconnected
+	select {
+	case c := <-connected:
+		t.Fatalf("set permanent: demoted connection %v was retried", c)
+	case <-time.After(time.Millisecond * 50):
+	}
+	if permanent := <-changed; permanent {
+		t.Fatal("set permanent: change callback saw a permanent request after the demotion")
+	}
+	// Unknown ids are ignored.
+	cmgr.SetPermanent(cr.ID()+1, true)
+	select {
+	case <-changed:
+		t.Fatal("set permanent: change callback fired for an unknown id")
+	case <-time.After(time.Millisecond * 10):
+	}
+}
+
 // TestMaxRetryDuration tests the maximum retry duration. We have a timed dialer which initially returns err but after
 // RetryDuration hits maxRetryDuration returns a mock conn.
 func TestMaxRetryDuration(t *testing.T) {
@@ -328,6 +848,86 @@ func TestMaxRetryDuration(t *testing.T) {
 	}
 }
 
+// TestRetryResolve tests that a permanent connection request made by host name
+// is retried at the address the name resolves to at the time.
+func TestRetryResolve(t *testing.T) {
+	stale := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 18555}
+	fresh := &net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 18555}
+	connected := make(chan *ConnReq)
+	cmgr, e := New(&Config{
+		RetryDuration: time.Millisecond,
+		Dial: func(addr net.Addr) (net.Conn, error) {
+			if addr.String() != fresh.String() {
+				return nil, errors.New("host moved")
+			}
+			return mockDialer(addr)
+		},
+		Resolve: func(host string) (net.Addr, error) {
+			if host != "peer.example:18555" {
+				return nil, fmt.Errorf("unknown host %s", host)
+			}
+			return fresh, nil
+		},
+		OnConnection: func(c *ConnReq, conn net.Conn) {
+			connected <- c
+		},
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	cr := &ConnReq{Addr: stale, Host: "peer.example:18555", Permanent: true}
+	go cmgr.Connect(cr)
+	cmgr.Start()
+	select {
+	case c := <-connected:
+		if c.Addr.String() != fresh.String() {
+			t.Fatalf("connected to %v, want %v", c.Addr, fresh)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("permanent request wasn't retried at the new address")
+	}
+	cmgr.Stop()
+	cmgr.Wait()
+}
+
+// TestRetryDelay tests the waits between retries of a permanent connection
+// request with exponential backoff, the cap and jitter.
+func TestRetryDelay(t *testing.T) {
+	cmgr, e := New(&Config{
+		RetryDuration:    time.Second,
+		MaxRetryDuration: time.Second * 10,
+		ExponentialRetry: true,
+		Dial:             mockDialer,
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	for retries, want := range []time.Duration{1, 1, 2, 4, 8, 10, 10} {
+		if retries == 0 {
+			continue
+		}
+		if d := cmgr.retryDelay(uint32(retries)); d != want*time.Second {
+			t.Fatalf("retry %d waits %v, want %v", retries, d, want*time.Second)
+		}
+	}
+	// The backoff doesn't overflow however many retries there have been.
+	if d := cmgr.retryDelay(1000); d != cmgr.Cfg.MaxRetryDuration {
+		t.Fatalf("retry 1000 waits %v, want %v", d, cmgr.Cfg.MaxRetryDuration)
+	}
+	cmgr.Cfg.RetryJitter = 0.5
+	varied := false
+	for i := 0; i < 100; i++ {
+		d := cmgr.retryDelay(4)
+		if d <= time.Second*4 || d > time.Second*8 {
+			t.Fatalf("jittered retry waits %v, want between 4s and 8s", d)
+		}
+		varied = varied || d != cmgr.retryDelay(4)
+	}
+	if !varied {
+		t.Fatal("jittered retries all wait the same time")
+	}
+}
+
 // TestNetworkFailure tests that the connection manager handles a network failure gracefully.
 func TestNetworkFailure(t *testing.T) {
 	var dials uint32
@@ -440,6 +1040,111 @@ func TestRemovePendingConnection(t *testing.T) {
 	cmgr.Stop()
 }
 
+// TestPendingConnections tests that pending connection requests can be listed and then canceled using the listed id.
+func TestPendingConnections(t *testing.T) {
+	// Create a ConnMgr instance with an instance of a dialer that'll never succeed.
+	wait := qu.T()
+	indefiniteDialer := func(addr net.Addr) (net.Conn, error) {
+		<-wait
+		return nil, fmt.Errorf("error")
+	}
+	cmgr, e := New(&Config{
+		Dial: indefiniteDialer,
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	cmgr.Start()
+	addr := &net.TCPAddr{
+		IP:   net.ParseIP("127.0.0.1"),
+		Port: 18555,
+	}
+	go cmgr.Connect(&ConnReq{Addr: addr, Permanent: true})
+	time.Sleep(10 * time.Millisecond)
+	pending := cmgr.Pending()
+	if len(pending) != 1 {
+		t.Fatalf("expected 1 pending request, got %v", len(pending))
+	}
+	info := pending[0]
+	if info.Addr.String() != addr.String() || !info.Permanent ||
+		info.State != ConnPending {
+		t.Fatalf("unexpected pending request: %+v", info)
+	}
+	// Cancel the stuck dial using the listed id, after which it should no longer be listed.
+	cmgr.Remove(info.ID)
+	time.Sleep(10 * time.Millisecond)
+	if pending = cmgr.Pending(); len(pending) != 0 {
+		t.Fatalf("expected no pending requests, got %v", len(pending))
+	}
+	wait.Q()
+	cmgr.Stop()
+}
+
+// TestConnectErrors tests that the errors returned when connecting can be told apart with errors.Is.
+func TestConnectErrors(t *testing.T) {
+	errRefused := errors.New("connection refused")
+	dials := make(chan struct{}, 10)
+	refusingDialer := func(addr net.Addr) (net.Conn, error) {
+		dials <- struct{}{}
+		return nil, errRefused
+	}
+	cmgr, e := New(&Config{
+		RetryDuration: time.Millisecond,
+		MaxRetries:    2,
+		Dial:          refusingDialer,
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	cmgr.Start()
+	addr := &net.TCPAddr{
+		IP:   net.ParseIP("127.0.0.1"),
+		Port: 18555,
+	}
+	// The first failure is the dialer's, and the request is retried in the background until it has failed MaxRetries
+	// more times.
+	cr := &ConnReq{Addr: addr, Permanent: true}
+	if e = cmgr.Connect(cr); !errors.Is(e, errRefused) || errors.Is(e, ErrMaxRetriesExceeded) {
+		t.Fatalf("expected dialer error, got %v", e)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-dials:
+		case <-time.After(time.Second):
+			t.Fatalf("connection was not retried")
+		}
+	}
+	select {
+	case <-dials:
+		t.Fatalf("connection was retried more than %v times", cmgr.Cfg.MaxRetries)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if pending := cmgr.Pending(); len(pending) != 0 {
+		t.Fatalf("expected request to be given up on, got %v pending", len(pending))
+	}
+	e = cmgr.Connect(cr)
+	if !errors.Is(e, ErrMaxRetriesExceeded) {
+		t.Fatalf("expected ErrMaxRetriesExceeded, got %v", e)
+	}
+	<-dials
+	// A failed request that is removed isn't dialed again.
+	cr = &ConnReq{Addr: addr}
+	cmgr.Connect(cr)
+	<-dials
+	cmgr.Remove(cr.ID())
+	cmgr.Pending()
+	if e = cmgr.Connect(cr); !errors.Is(e, ErrConnCanceled) {
+		t.Fatalf("expected ErrConnCanceled, got %v", e)
+	}
+	cmgr.Stop()
+	if e = cmgr.Connect(&ConnReq{Addr: addr}); !errors.Is(e, ErrManagerStopped) {
+		t.Fatalf("expected ErrManagerStopped from Connect, got %v", e)
+	}
+	if e = cmgr.NewConnReq(); !errors.Is(e, ErrManagerStopped) {
+		t.Fatalf("expected ErrManagerStopped from NewConnReq, got %v", e)
+	}
+}
+
 // TestCancelIgnoreDelayedConnection tests that a canceled connection request will not execute the on connection
 // callback, even if an outstanding retry succeeds.
 func TestCancelIgnoreDelayedConnection(t *testing.T) {
@@ -599,3 +1304,40 @@ out:
 	cmgr.Stop()
 	cmgr.Wait()
 }
+
+// TestRemoveListener ensures a removed listener is closed and no longer accepted on, while the other listeners keep
+// accepting connections.
+func TestRemoveListener(t *testing.T) {
+	receivedConns := make(chan net.Conn)
+	listener1 := newMockListener("127.0.0.1:11047")
+	listener2 := newMockListener("127.0.0.1:9333")
+	cmgr, e := New(&Config{
+		Listeners: []net.Listener{listener1, listener2},
+		OnAccept: func(conn net.Conn) {
+			receivedConns <- conn
+		},
+		Dial: mockDialer,
+	})
+	if e != nil {
+		t.Fatalf("New error: %v", e)
+	}
+	cmgr.Start()
+	if e = cmgr.RemoveListener(listener1); e != nil {
+		t.Fatalf("RemoveListener error: %v", e)
+	}
+	if e = cmgr.RemoveListener(listener1); e != ErrListenerNotFound {
+		t.Fatalf("removing the listener again gave error %v, want %v", e, ErrListenerNotFound)
+	}
+	if _, open := <-listener1.provideConn; open {
+		t.Fatal("removed listener wasn't closed")
+	}
+	go listener2.Connect("127.0.0.1", 10000)
+	select {
+	case <-receivedConns:
+	case <-time.After(time.Millisecond * 50):
+		t.Fatal("timeout waiting for a connection to the remaining listener")
+	}
+	// Stopping closes only the remaining listener, as closing the removed one again would panic.
+	cmgr.Stop()
+	cmgr.Wait()
+}
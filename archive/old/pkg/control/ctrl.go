@@ -617,7 +617,13 @@ func processSolMsg(ctx interface{}, src net.Addr, dst string, b []byte,) (e erro
 			return
 		}
 	}
+	if isOrphan {
+		W.Ln("blk is an orphan")
+		return
+	}
 	I.Ln("the blk was accepted, new height", blk.Height())
+	// Relay the mined block now, as peers aren't told of accepted blocks while the node doesn't think it is current.
+	s.node.SyncManager.RelayBlock(blk)
 	I.C(
 		func() string {
 			bmb := blk.WireBlock()
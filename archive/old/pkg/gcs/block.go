@@ -0,0 +1,39 @@
+package gcs
+
+import (
+	"github.com/p9c/pod/pkg/txscript"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// BuildFilterFromBlock builds the basic filter of a block as specified in BIP158, with the collision probability of
+// `1/(2**P)` and modulus M, keyed by DeriveKey of the block hash. The filter holds every output script created in the
+// block, apart from empty scripts and OP_RETURN data carriers, and prevScripts, the scripts of the outputs the inputs
+// of the block spend. Each distinct script is only added once.
+func BuildFilterFromBlock(block *wire.Block, prevScripts [][]byte, P uint8, M uint64) (*Filter, error) {
+	entries := make(map[string]struct{})
+	for _, tx := range block.Transactions {
+		for _, txOut := range tx.TxOut {
+			if len(txOut.PkScript) == 0 {
+				continue
+			}
+			// In order to allow the filters to later be committed to within an OP_RETURN output, we ignore all
+			// OP_RETURNs to avoid a circular dependency.
+			if txOut.PkScript[0] == txscript.OP_RETURN &&
+				txscript.IsPushOnlyScript(txOut.PkScript[1:]) {
+				continue
+			}
+			entries[string(txOut.PkScript)] = struct{}{}
+		}
+	}
+	for _, prevScript := range prevScripts {
+		if len(prevScript) == 0 {
+			continue
+		}
+		entries[string(prevScript)] = struct{}{}
+	}
+	data := make([][]byte, 0, len(entries))
+	for entry := range entries {
+		data = append(data, []byte(entry))
+	}
+	return BuildGCSFilter(P, M, DeriveKey(block.BlockHash()), data)
+}
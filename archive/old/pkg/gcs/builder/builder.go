@@ -7,7 +7,6 @@ import (
 	
 	"github.com/p9c/pod/pkg/chainhash"
 	"github.com/p9c/pod/pkg/gcs"
-	"github.com/p9c/pod/pkg/txscript"
 	"github.com/p9c/pod/pkg/wire"
 )
 
@@ -44,11 +43,9 @@ func RandomKey() (key [gcs.KeySize]byte, e error) {
 }
 
 // DeriveKey is a utility function that derives a key from a chainhash.Hash by truncating the bytes of the hash to the
-// appopriate key size.
+// appopriate key size. It is a thin wrapper around gcs.DeriveKey.
 func DeriveKey(keyHash *chainhash.Hash) [gcs.KeySize]byte {
-	var key [gcs.KeySize]byte
-	copy(key[:], keyHash.CloneBytes()[:])
-	return key
+	return gcs.DeriveKey(*keyHash)
 }
 
 // Key retrieves the key with which the builder will build a filter. This is useful if the builder is created with a
@@ -250,8 +247,16 @@ func WithRandomKey() *GCS {
 }
 
 // BuildBasicFilter builds a basic GCS filter from a block. A basic GCS filter will contain all the previous output
-// scripts spent by inputs within a block, as well as the data pushes within all the outputs created within a block.
+// scripts spent by inputs within a block, as well as the data pushes within all the outputs created within a block. It
+// is built by gcs.BuildFilterFromBlock with DefaultP and DefaultM.
 func BuildBasicFilter(block *wire.Block, prevOutScripts [][]byte) (*gcs.Filter, error) {
+	return gcs.BuildFilterFromBlock(block, prevOutScripts, DefaultP, DefaultM)
+}
+
+// BuildExtFilter builds an extended GCS filter from a block. An extended filter supplements a regular basic filter by
+// including the hash of every transaction in the block as well as the signature script of every input that isn't the
+// coinbase.
+func BuildExtFilter(block *wire.Block) (*gcs.Filter, error) {
 	blockHash := block.BlockHash()
 	b := WithKeyHash(&blockHash)
 	// If the filter had an issue with the specified key, then we force it to bubble up here by calling the Key()
@@ -260,28 +265,20 @@ func BuildBasicFilter(block *wire.Block, prevOutScripts [][]byte) (*gcs.Filter,
 	if e != nil {
 		return nil, e
 	}
-	// In order to build a basic filter, we'll range over the entire block, adding each whole script itself.
-	for _, tx := range block.Transactions {
-		// For each output in a transaction, we'll add each of the individual data pushes within the script.
-		for _, txOut := range tx.TxOut {
-			if len(txOut.PkScript) == 0 {
-				continue
-			}
-			// In order to allow the filters to later be committed to within an OP_RETURN output, we ignore all
-			// OP_RETURNs to avoid a circular dependency.
-			if txOut.PkScript[0] == txscript.OP_RETURN &&
-				txscript.IsPushOnlyScript(txOut.PkScript[1:]) {
+	for i, tx := range block.Transactions {
+		// First we'll compute the hash of the transaction and add that directly to the filter.
+		txHash := tx.TxHash()
+		b.AddHash(&txHash)
+		// The coinbase has no meaningful signature script so its inputs are skipped.
+		if i == 0 {
+			continue
+		}
+		for _, txIn := range tx.TxIn {
+			if len(txIn.SignatureScript) == 0 {
 				continue
 			}
-			b.AddEntry(txOut.PkScript)
-		}
-	}
-	// In the second pass, we'll also add all the prevOutScripts individually as elements.
-	for _, prevScript := range prevOutScripts {
-		if len(prevScript) == 0 {
-			continue
+			b.AddEntry(txIn.SignatureScript)
 		}
-		b.AddEntry(prevScript)
 	}
 	return b.Build()
 }
@@ -280,3 +280,42 @@ func BuilderTest(
 		t.Fatal("Filter size increased with duplicate items")
 	}
 }
+
+// TestBuildExtFilter checks that an extended filter commits to every transaction hash and to the signature scripts of
+// all non-coinbase inputs.
+func TestBuildExtFilter(t *testing.T) {
+	coinbaseScript := []byte{0x51, 0x52}
+	sigScript := []byte{0x53, 0x54, 0x55}
+	blk := &wire.Block{
+		Transactions: []*wire.MsgTx{
+			{TxIn: []*wire.TxIn{{SignatureScript: coinbaseScript}}},
+			{TxIn: []*wire.TxIn{{SignatureScript: sigScript}}},
+		},
+	}
+	f, e := builder.BuildExtFilter(blk)
+	if e != nil {
+		t.Fatalf("Filter build failed: %s", e.Error())
+	}
+	blockHash := blk.BlockHash()
+	key := builder.DeriveKey(&blockHash)
+	for _, tx := range blk.Transactions {
+		txHash := tx.TxHash()
+		match, e := f.Match(key, txHash[:])
+		if e != nil {
+			t.Fatalf("Filter match failed: %s", e)
+		}
+		if !match {
+			t.Fatalf("Filter didn't match txid %s", txHash)
+		}
+	}
+	match, e := f.Match(key, sigScript)
+	if e != nil {
+		t.Fatalf("Filter match failed: %s", e)
+	}
+	if !match {
+		t.Fatal("Filter didn't match signature script")
+	}
+	if f.N() != 3 {
+		t.Fatalf("Filter has %d entries, expected 3", f.N())
+	}
+}
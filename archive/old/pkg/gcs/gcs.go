@@ -9,6 +9,7 @@ import (
 	"github.com/aead/siphash"
 	"github.com/kkdai/bstream"
 	
+	"github.com/p9c/pod/pkg/chainhash"
 	"github.com/p9c/pod/pkg/wire"
 )
 
@@ -18,6 +19,10 @@ var (
 	ErrNTooBig = fmt.Errorf("N is too big to fit in uint32")
 	// ErrPTooBig signifies that the filter can't handle `1/2**P` collision probability.
 	ErrPTooBig = fmt.Errorf("P is too big to fit in uint32")
+	// ErrFilterTruncated signifies that the filter data is too short to hold the N values it declares.
+	ErrFilterTruncated = fmt.Errorf("filter data is too short for N")
+	// ErrFilterOverlong signifies that the filter data is longer than the N values it declares can take up.
+	ErrFilterOverlong = fmt.Errorf("filter data is too long for N")
 )
 
 const (
@@ -28,6 +33,15 @@ const (
 	varIntProtoVer uint32 = 0
 )
 
+// DeriveKey derives the SipHash key for a block's filter from the block hash as specified in BIP158: the key is the
+// first KeySize bytes of the little-endian block hash. Both filter builders and filter matchers must use the same
+// key, so callers should use this rather than reimplementing the derivation.
+func DeriveKey(blockHash chainhash.Hash) [KeySize]byte {
+	var key [KeySize]byte
+	copy(key[:], blockHash[:KeySize])
+	return key
+}
+
 // fastReduction calculates a mapping that's more ore less equivalent to: x mod
 // N. However, instead of using a mod operation, which using a non-power of two
 // will lead to slowness on many processors due to unnecessary division, we
@@ -99,7 +113,11 @@ func BuildGCSFilter(P uint8, M uint64, key [KeySize]byte, data [][]byte) (*Filte
 	}
 	// Build the filter.
 	values := make(uint64Slice, 0, len(data))
-	b := bstream.NewBStreamWriter(0)
+	// Each value takes P bits for the remainder and, on average, about two and a
+	// half for the quotient in unary, so the stream is sized to fit P+3 bits per
+	// value without growing. NewBStreamWriter can only reserve up to 255 bytes,
+	// but a reader over an empty slice is in the same state as a new writer.
+	b := bstream.NewBStreamReader(make([]byte, 0, (uint64(f.n)*(uint64(f.p)+3)+7)/8))
 	// Insert the hash (fast-ranged over a space of N*P) of each data element into a
 	// slice and txsort the slice. This can be greatly optimized with native 128-bit
 	// multiplication, but we're going to be fully portable for now.
@@ -163,7 +181,8 @@ func FromBytes(N uint32, P uint8, M uint64, d []byte) (*Filter, error) {
 }
 
 // FromNBytes deserializes a GCS filter from a known P, and serialized N and
-// filter as returned by NBytes().
+// filter as returned by NBytes(). As the filter may come from an untrusted
+// peer, the length of the filter data is checked against the N it declares.
 func FromNBytes(P uint8, M uint64, d []byte) (*Filter, error) {
 	buffer := bytes.NewBuffer(d)
 	N, e := wire.ReadVarInt(buffer, varIntProtoVer)
@@ -174,9 +193,37 @@ func FromNBytes(P uint8, M uint64, d []byte) (*Filter, error) {
 	if N >= (1 << 32) {
 		return nil, ErrNTooBig
 	}
+	if P > 32 {
+		return nil, ErrPTooBig
+	}
+	if e = checkFilterSize(N, P, M, buffer.Len()); e != nil {
+		return nil, e
+	}
 	return FromBytes(uint32(N), P, M, buffer.Bytes())
 }
 
+// checkFilterSize checks that size bytes of filter data can hold N values with
+// parameters P and M. Each value takes at least P bits for the remainder and a
+// bit ending the quotient, and as the values are sorted below N*M, their
+// quotients add up to no more than N*M>>P bits in all.
+func checkFilterSize(N uint64, P uint8, M uint64, size int) error {
+	bits := uint64(size) * 8
+	minBits := N * (uint64(P) + 1)
+	if bits < minBits {
+		return ErrFilterTruncated
+	}
+	// A modulus that doesn't fit in 64 bits can't bound the quotients.
+	if M != 0 && N*M/M != N {
+		return nil
+	}
+	// Only the last byte is padded, so the data can't take up a whole byte more
+	// than the values can need.
+	if maxBits := minBits + (N*M)>>P; bits >= maxBits+8 {
+		return ErrFilterOverlong
+	}
+	return nil
+}
+
 // Bytes returns the serialized format of the GCS filter, which does not include
 // N or P (returned by separate methods) or the key used by SipHash.
 func (f *Filter) Bytes() ([]byte, error) {
@@ -245,15 +292,42 @@ func (f *Filter) N() uint32 {
 	return f.n
 }
 
+// Equal reports whether the filter and other have the same N, P and M and the same data, without serializing either.
+// Two nil filters are equal, and a nil filter isn't equal to one that isn't.
+func (f *Filter) Equal(other *Filter) bool {
+	if f == nil || other == nil {
+		return f == other
+	}
+	// The modulus is N*M, so with equal N it only differs when M does.
+	return f.n == other.n && f.p == other.p && f.modulusNP == other.modulusNP &&
+		bytes.Equal(f.filterData, other.filterData)
+}
+
 // Match checks whether a []byte value is likely (within collision probability) to be a member of the set represented by
 // the filter.
 func (f *Filter) Match(key [KeySize]byte, data []byte) (yn bool,e error) {
+	return f.MatchWithScratch(key, data, &MatchScratch{})
+}
+
+// MatchScratch holds the reader of the filter bitstream and the search values that matching needs, so that they are
+// reused across the MatchWithScratch and MatchAnyWithScratch calls of a rescan instead of allocated for each call. The
+// zero value is ready to use. A MatchScratch must not be used by more than one goroutine at a time.
+type MatchScratch struct {
+	stream bstream.BStream
+	values uint64Slice
+}
+
+// reader returns the reader of the scratch, reset to the start of the filter data. The reader only reads the data, so
+// it is read in place rather than copied.
+func (s *MatchScratch) reader(f *Filter) *bstream.BStream {
+	s.stream = *bstream.NewBStreamReader(f.filterData)
+	return &s.stream
+}
+
+// MatchWithScratch is Match using the buffers held by the scratch.
+func (f *Filter) MatchWithScratch(key [KeySize]byte, data []byte, scratch *MatchScratch) (yn bool, e error) {
 	// Create a filter bitstream.
-	var filterData []byte
-	if filterData, e = f.Bytes();E.Chk(e){
-		return false, e
-	}
-	b := bstream.NewBStreamReader(filterData)
+	b := scratch.reader(f)
 	// We take the high and low bits of modulusNP for the multiplication of 2 64-bit integers into a 128-bit integer.
 	nphi := f.modulusNP >> 32
 	nplo := uint64(uint32(f.modulusNP))
@@ -285,19 +359,19 @@ func (f *Filter) Match(key [KeySize]byte, data []byte) (yn bool,e error) {
 // MatchAny returns checks whether any []byte value is likely (within collision probability) to be a member of the set
 // represented by the filter faster than calling Match() for each value individually.
 func (f *Filter) MatchAny(key [KeySize]byte, data [][]byte) (bool, error) {
+	return f.MatchAnyWithScratch(key, data, &MatchScratch{})
+}
+
+// MatchAnyWithScratch is MatchAny using the buffers held by the scratch.
+func (f *Filter) MatchAnyWithScratch(key [KeySize]byte, data [][]byte, scratch *MatchScratch) (bool, error) {
 	// Basic sanity check.
 	if len(data) == 0 {
 		return false, nil
 	}
 	// Create a filter bitstream.
-	filterData, e := f.Bytes()
-	if e != nil  {
-		E.Ln(e)
-		return false, e
-	}
-	b := bstream.NewBStreamReader(filterData)
+	b := scratch.reader(f)
 	// Create an uncompressed filter of the search values.
-	values := make(uint64Slice, 0, len(data))
+	values := scratch.values[:0]
 	// First, we cache the high and low bits of modulusNP for the multiplication of 2 64-bit integers into a 128-bit
 	// integer.
 	nphi := f.modulusNP >> 32
@@ -309,7 +383,9 @@ func (f *Filter) MatchAny(key [KeySize]byte, data [][]byte) (bool, error) {
 		v = fastReduction(v, nphi, nplo)
 		values = append(values, v)
 	}
-	sort.Sort(values)
+	// The values are sorted through the scratch so that they aren't copied into an interface value on the heap.
+	scratch.values = values
+	sort.Sort(&scratch.values)
 	// Zip down the filters, comparing values until we either run out of values to compare in one of the filters or we
 	// reach a matching value.
 	var lastValue1, lastValue2 uint64
@@ -343,6 +419,46 @@ func (f *Filter) MatchAny(key [KeySize]byte, data [][]byte) (bool, error) {
 	return true, nil
 }
 
+// CountMatches returns how many of the []byte values are likely (within collision probability) to be members of the set
+// represented by the filter, counting each value, and each repetition of one, on its own. Queried with values of known
+// membership it measures the false positive rate of the filter's P and M, for calibrating them. Match and MatchAny are
+// faster for answering whether values match.
+func (f *Filter) CountMatches(key [KeySize]byte, data [][]byte) (n int, e error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	var filterData []byte
+	if filterData, e = f.Bytes(); E.Chk(e) {
+		return 0, e
+	}
+	b := bstream.NewBStreamReader(filterData)
+	nphi := f.modulusNP >> 32
+	nplo := uint64(uint32(f.modulusNP))
+	values := make(uint64Slice, 0, len(data))
+	for _, d := range data {
+		values = append(values, fastReduction(siphash.Sum64(d, &key), nphi, nplo))
+	}
+	sort.Sort(values)
+	// Walk the filter values in order, counting the search values equal to each and skipping the ones below it.
+	var filterValue uint64
+	for i := 0; i < len(values); {
+		var delta uint64
+		if delta, e = f.readFullUint64(b); e != nil {
+			if e == io.EOF {
+				return n, nil
+			}
+			return 0, e
+		}
+		filterValue += delta
+		for ; i < len(values) && values[i] <= filterValue; i++ {
+			if values[i] == filterValue {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
 // readFullUint64 reads a value represented by the sum of a unary multiple of the filter's P modulus (`2**P`) and a
 // big-endian P-bit remainder.
 func (f *Filter) readFullUint64(b *bstream.BStream) (rv uint64,e error) {
@@ -6,7 +6,9 @@ import (
 	"math/rand"
 	"testing"
 
+	"github.com/p9c/pod/pkg/chainhash"
 	"github.com/p9c/pod/pkg/gcs"
+	"github.com/p9c/pod/pkg/wire"
 )
 
 var (
@@ -142,6 +144,47 @@ func TestGCSFilterMetadata(t *testing.T) {
 	}
 }
 
+// TestGCSFilterEqual checks that copied filters are equal to the filter they were copied from, and that filters with
+// other parameters or data aren't.
+func TestGCSFilterEqual(t *testing.T) {
+	if !filter.Equal(filter2) || !filter.Equal(filter3) {
+		t.Fatal("copied filters aren't equal")
+	}
+	serialized, e := filter.Bytes()
+	if e != nil {
+		t.Fatalf("Filter Bytes() failed: %v", e)
+	}
+	for _, params := range []struct {
+		n uint32
+		p uint8
+		m uint64
+	}{
+		{filter.N() + 1, P, M},
+		{filter.N(), P + 1, M},
+		{filter.N(), P, M + 1},
+	} {
+		other, e := gcs.FromBytes(params.n, params.p, params.m, serialized)
+		if e != nil {
+			t.Fatalf("Filter copy failed: %v", e)
+		}
+		if filter.Equal(other) {
+			t.Fatalf("filter equal to one with N %d, P %d and M %d", params.n, params.p, params.m)
+		}
+	}
+	serialized[0] ^= 1
+	other, e := gcs.FromBytes(filter.N(), P, M, serialized)
+	if e != nil {
+		t.Fatalf("Filter copy failed: %v", e)
+	}
+	if filter.Equal(other) {
+		t.Fatal("filter equal to one with other data")
+	}
+	var none *gcs.Filter
+	if filter.Equal(none) || none.Equal(filter) || !none.Equal(nil) {
+		t.Fatal("nil filters compared wrongly")
+	}
+}
+
 // TestGCSFilterMatch checks that both the built and copied filters match correctly, logging any false positives without
 // failing on them.
 func TestGCSFilterMatch(t *testing.T) {
@@ -236,3 +279,110 @@ func TestGCSFilterMatchAny(t *testing.T) {
 		t.Fatal("Filter didn't match any when it should have!")
 	}
 }
+
+// TestGCSFilterCountMatches checks that every member of the set is counted as a match, however often it is queried.
+func TestGCSFilterCountMatches(t *testing.T) {
+	f, e := gcs.BuildGCSFilter(P, M, key, contents)
+	if e != nil {
+		t.Fatalf("Filter build failed: %s", e.Error())
+	}
+	others := [][]byte{[]byte("Alice"), []byte("Betty"), []byte("Charmaine")}
+	data := append(append(append([][]byte{}, contents...), contents[0]), others...)
+	n, e := f.CountMatches(key, data)
+	if e != nil {
+		t.Fatalf("Filter count matches failed: %s", e.Error())
+	}
+	if n < len(contents)+1 || n > len(data) {
+		t.Fatalf("Filter counted %d matches, want from %d to %d", n, len(contents)+1, len(data))
+	}
+	if n > len(contents)+1 {
+		t.Logf("%d false positive matches, should be 1 in 2**%d!", n-len(contents)-1, P)
+	}
+	if n, e = f.CountMatches(key, nil); e != nil || n != 0 {
+		t.Fatalf("Filter counted %d matches (%v) of no values", n, e)
+	}
+}
+
+// TestDeriveKey checks that the derived key is the truncated block hash and that a filter built with it matches
+// when queried with a key derived from the same hash.
+func TestDeriveKey(t *testing.T) {
+	var blockHash chainhash.Hash
+	for i := range blockHash {
+		blockHash[i] = byte(i)
+	}
+	derived := gcs.DeriveKey(blockHash)
+	if !bytes.Equal(derived[:], blockHash[:gcs.KeySize]) {
+		t.Fatalf("derived key %x is not the truncated block hash %x", derived, blockHash[:gcs.KeySize])
+	}
+	f, e := gcs.BuildGCSFilter(P, M, derived, contents)
+	if e != nil {
+		t.Fatalf("Filter build failed: %s", e.Error())
+	}
+	match, e := f.Match(gcs.DeriveKey(blockHash), []byte("Nate"))
+	if e != nil {
+		t.Fatalf("Filter match failed: %s", e.Error())
+	}
+	if !match {
+		t.Fatal("Filter didn't match when it should have!")
+	}
+}
+
+// TestBuildFilterFromBlock checks that the filter of a block holds each distinct output and previous output script
+// once, keyed by the block hash, and leaves out empty scripts and OP_RETURN data carriers.
+func TestBuildFilterFromBlock(t *testing.T) {
+	outputScript := []byte{0x76, 0xa9, 0x14}
+	prevScript := []byte{0xa9, 0x14, 0x87}
+	nullData := []byte{0x6a, 0x02, 0x01, 0x02}
+	block := &wire.Block{
+		Transactions: []*wire.MsgTx{
+			{TxOut: []*wire.TxOut{{PkScript: outputScript}, {PkScript: nullData}, {PkScript: nil}}},
+			{TxOut: []*wire.TxOut{{PkScript: outputScript}}},
+		},
+	}
+	f, e := gcs.BuildFilterFromBlock(block, [][]byte{prevScript, outputScript, nil}, P, M)
+	if e != nil {
+		t.Fatalf("Filter build failed: %s", e.Error())
+	}
+	if f.N() != 2 {
+		t.Fatalf("filter holds %d entries, want 2", f.N())
+	}
+	key := gcs.DeriveKey(block.BlockHash())
+	for _, script := range [][]byte{outputScript, prevScript} {
+		match, e := f.Match(key, script)
+		if e != nil {
+			t.Fatalf("Filter match failed: %s", e.Error())
+		}
+		if !match {
+			t.Fatalf("filter doesn't match script %x", script)
+		}
+	}
+	if match, e := f.Match(key, nullData); e != nil || match {
+		t.Fatalf("filter matches the OP_RETURN output, error %v", e)
+	}
+}
+
+// TestFromNBytesMalformed checks that filter data too short or too long for the N it declares is rejected.
+func TestFromNBytesMalformed(t *testing.T) {
+	serialized, e := filter.NBytes()
+	if e != nil {
+		t.Fatal(e)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		e    error
+	}{
+		{"truncated", serialized[:len(serialized)/2], gcs.ErrFilterTruncated},
+		{"over-long", append(append([]byte{}, serialized...), make([]byte, 64)...), gcs.ErrFilterOverlong},
+		{"empty with data", []byte{0, 0}, gcs.ErrFilterOverlong},
+		{"N without data", []byte{0xfd, 0xff, 0xff}, gcs.ErrFilterTruncated},
+	}
+	for _, test := range tests {
+		if _, e := gcs.FromNBytes(P, M, test.data); e != test.e {
+			t.Errorf("%s filter gave error %v, want %v", test.name, e, test.e)
+		}
+	}
+	if _, e = gcs.FromNBytes(P, M, []byte{0}); e != nil {
+		t.Fatalf("empty filter was rejected: %v", e)
+	}
+}
@@ -3,14 +3,17 @@ package gcs_test
 import (
 	"encoding/binary"
 	"math/rand"
+	"sort"
 	"testing"
 
+	"github.com/kkdai/bstream"
+
 	"github.com/p9c/pod/pkg/gcs"
 )
 
 func genRandFilterElements(numElements uint) ([][]byte, error) {
 	testContents := make([][]byte, numElements)
-	for i := range contents {
+	for i := range testContents {
 		randElem := make([]byte, 32)
 		if _, e = rand.Read(randElem); E.Chk(e) {
 			return nil, e
@@ -36,6 +39,7 @@ func BenchmarkGCSFilterBuild50000(b *testing.B) {
 	if e != nil  {
 		b.Fatalf("unable to generate random item: %v", genErr)
 	}
+	b.ReportAllocs()
 	b.StartTimer()
 	var localFilter *gcs.Filter
 	for i := 0; i < b.N; i++ {
@@ -60,6 +64,7 @@ func BenchmarkGCSFilterBuild100000(b *testing.B) {
 	if e != nil  {
 		b.Fatalf("unable to generate random item: %v", genErr)
 	}
+	b.ReportAllocs()
 	b.StartTimer()
 	var localFilter *gcs.Filter
 	for i := 0; i < b.N; i++ {
@@ -73,6 +78,56 @@ func BenchmarkGCSFilterBuild100000(b *testing.B) {
 	generatedFilter = localFilter
 }
 
+// filterStreamDeltas returns the differences between 50000 sorted values spread over the range of a filter of as many
+// elements, as they are Golomb coded into the filter bitstream.
+func filterStreamDeltas() []uint64 {
+	const n = 50000
+	values := make([]uint64, n)
+	for i := range values {
+		values[i] = rand.Uint64() % (n * M)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	deltas := make([]uint64, n)
+	var last uint64
+	for i, v := range values {
+		deltas[i], last = v-last, v
+	}
+	return deltas
+}
+
+// writeFilterStream Golomb codes the deltas into the stream as BuildGCSFilter does.
+func writeFilterStream(stream *bstream.BStream, deltas []uint64) {
+	for _, delta := range deltas {
+		for quotient := delta >> P; quotient > 0; quotient-- {
+			stream.WriteBit(true)
+		}
+		stream.WriteBit(false)
+		stream.WriteBits(delta&((1<<P)-1), int(P))
+	}
+}
+
+// BenchmarkGCSFilterStreamGrow is the baseline for BenchmarkGCSFilterStreamPresized, writing the bitstream of a filter
+// of 50000 elements to a stream that grows as it is written, as BuildGCSFilter did before it sized the stream.
+func BenchmarkGCSFilterStreamGrow(b *testing.B) {
+	deltas := filterStreamDeltas()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writeFilterStream(bstream.NewBStreamWriter(0), deltas)
+	}
+}
+
+// BenchmarkGCSFilterStreamPresized benchmarks writing the bitstream of a filter of 50000 elements to a stream sized
+// for it up front, as BuildGCSFilter does.
+func BenchmarkGCSFilterStreamPresized(b *testing.B) {
+	deltas := filterStreamDeltas()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writeFilterStream(bstream.NewBStreamReader(make([]byte, 0, (uint64(len(deltas))*(uint64(P)+3)+7)/8)), deltas)
+	}
+}
+
 var (
 	match bool
 )
@@ -120,3 +175,57 @@ func BenchmarkGCSFilterMatchAny(b *testing.B) {
 	}
 	match = localMatch
 }
+
+// rescanFilters returns filters of 100 random elements each, and a watch list of 50 random elements, to be matched as
+// a dense rescan would.
+func rescanFilters(b *testing.B) ([]*gcs.Filter, [][]byte) {
+	filters := make([]*gcs.Filter, 100)
+	for i := range filters {
+		elems, e := genRandFilterElements(100)
+		if e != nil {
+			b.Fatalf("unable to generate random item: %v", e)
+		}
+		if filters[i], e = gcs.BuildGCSFilter(P, M, key, elems); e != nil {
+			b.Fatalf("unable to generate filter: %v", e)
+		}
+	}
+	watchList, e := genRandFilterElements(50)
+	if e != nil {
+		b.Fatalf("unable to generate random item: %v", e)
+	}
+	return filters, watchList
+}
+
+// BenchmarkGCSFilterRescan benchmarks matching a watch list against many filters with MatchAny.
+func BenchmarkGCSFilterRescan(b *testing.B) {
+	filters, watchList := rescanFilters(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var localMatch bool
+	for i := 0; i < b.N; i++ {
+		for _, filter := range filters {
+			if localMatch, e = filter.MatchAny(key, watchList); e != nil {
+				b.Fatalf("unable to match filter: %v", e)
+			}
+		}
+	}
+	match = localMatch
+}
+
+// BenchmarkGCSFilterRescanScratch benchmarks matching a watch list against many filters with MatchAnyWithScratch,
+// reusing one scratch for all of them.
+func BenchmarkGCSFilterRescanScratch(b *testing.B) {
+	filters, watchList := rescanFilters(b)
+	var scratch gcs.MatchScratch
+	b.ReportAllocs()
+	b.ResetTimer()
+	var localMatch bool
+	for i := 0; i < b.N; i++ {
+		for _, filter := range filters {
+			if localMatch, e = filter.MatchAnyWithScratch(key, watchList, &scratch); e != nil {
+				b.Fatalf("unable to match filter: %v", e)
+			}
+		}
+	}
+	match = localMatch
+}
@@ -0,0 +1,53 @@
+//go:build go1.18
+// +build go1.18
+
+package gcs_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/p9c/pod/pkg/gcs"
+)
+
+// FuzzFromNBytes checks that any filter FromNBytes accepts serializes back to the same bytes and can be matched
+// against.
+func FuzzFromNBytes(f *testing.F) {
+	for _, n := range []int{0, 1, 17, 200} {
+		var data [][]byte
+		for i := 0; i < n; i++ {
+			data = append(data, []byte{byte(i), byte(i >> 8)})
+		}
+		built, e := gcs.BuildGCSFilter(P, M, key, data)
+		if e != nil {
+			f.Fatal(e)
+		}
+		serialized, e := built.NBytes()
+		if e != nil {
+			f.Fatal(e)
+		}
+		f.Add(serialized)
+		f.Add(serialized[:len(serialized)/2])
+	}
+	f.Fuzz(
+		func(t *testing.T, d []byte) {
+			parsed, e := gcs.FromNBytes(P, M, d)
+			if e != nil {
+				return
+			}
+			serialized, e := parsed.NBytes()
+			if e != nil {
+				t.Fatal(e)
+			}
+			if !bytes.Equal(serialized, d) {
+				t.Fatalf("filter %x serialized as %x", d, serialized)
+			}
+			if _, e = parsed.Match(key, []byte("Alex")); e != nil {
+				t.Fatal(e)
+			}
+			if _, e = parsed.MatchAny(key, contents2); e != nil {
+				t.Fatal(e)
+			}
+		},
+	)
+}
@@ -0,0 +1,61 @@
+package netsync
+
+import (
+	"time"
+)
+
+// BlockProcessTimeBuckets are the upper bounds of the buckets of BlockProcessTimes.Buckets, in increasing order.
+var BlockProcessTimeBuckets = []time.Duration{
+	time.Millisecond,
+	time.Millisecond * 10,
+	time.Millisecond * 100,
+	time.Second,
+	time.Second * 10,
+}
+
+// BlockProcessTimes summarises how long the chain took to process the blocks the SyncManager passed to it, which tells
+// apart a sync held up by validating blocks from one held up by downloading them.
+type BlockProcessTimes struct {
+	// Count is the number of blocks processed.
+	Count uint64
+	// Total and Max are the time taken by all the blocks and by the slowest of them.
+	Total time.Duration
+	Max   time.Duration
+	// Buckets holds the number of blocks that took less than each bound of BlockProcessTimeBuckets and no less than
+	// the one before it, and after them the number that took longer than the last bound.
+	Buckets []uint64
+}
+
+// newBlockProcessTimes returns an empty summary with a bucket for each bound of BlockProcessTimeBuckets.
+func newBlockProcessTimes() *BlockProcessTimes {
+	return &BlockProcessTimes{Buckets: make([]uint64, len(BlockProcessTimeBuckets)+1)}
+}
+
+// add counts a block that took d to process.
+func (t *BlockProcessTimes) add(d time.Duration) {
+	t.Count++
+	t.Total += d
+	if d > t.Max {
+		t.Max = d
+	}
+	i := 0
+	for i < len(BlockProcessTimeBuckets) && d >= BlockProcessTimeBuckets[i] {
+		i++
+	}
+	t.Buckets[i]++
+}
+
+// copy returns a copy of the summary that doesn't share its buckets.
+func (t *BlockProcessTimes) copy() BlockProcessTimes {
+	c := *t
+	c.Buckets = append([]uint64(nil), t.Buckets...)
+	return c
+}
+
+// Mean returns the average time taken to process a block, or zero if none were.
+func (t BlockProcessTimes) Mean() time.Duration {
+	if t.Count == 0 {
+		return 0
+	}
+	return t.Total / time.Duration(t.Count)
+}
@@ -3,5 +3,9 @@
 The SyncManager communicates with connected peers to perform an initial block download, keep the chain and unconfirmed
 transaction pool in sync, and announce new blocks connected to the chain. Currently the sync manager selects a single
 sync peer that it downloads all blocks from until it is up to date with the longest chain the sync peer is aware of.
+
+Blocks are processed in order: every block passed to QueueBlock is handed to the chain by a single block handler
+goroutine, one at a time and in the order it was queued, so blocks are connected, orphans resolved and the sync state
+updated in that order. Within a block, the chain validates the scripts of the transactions in parallel.
 */
 package netsync
@@ -2,6 +2,8 @@ package netsync
 
 import (
 	"github.com/p9c/pod/cmd/node/mempool"
+	"github.com/p9c/pod/pkg/amt"
+	"github.com/p9c/pod/pkg/block"
 	"github.com/p9c/pod/pkg/blockchain"
 	"github.com/p9c/pod/pkg/chaincfg"
 	"github.com/p9c/pod/pkg/chainhash"
@@ -19,6 +21,47 @@ type PeerNotifier interface {
 	TransactionConfirmed(tx *util.Tx)
 }
 
+// chainSource is the part of the block chain used by the SyncManager. It is implemented by *blockchain.BlockChain and
+// lets tests drive the SyncManager with a mock chain.
+type chainSource interface {
+	BestSnapshot() *blockchain.BestState
+	BlockHeightByHash(hash *chainhash.Hash) (int32, error)
+	BlockLocatorFromHash(hash *chainhash.Hash) blockchain.BlockLocator
+	Checkpoints() []chaincfg.Checkpoint
+	FetchUtxoEntry(outpoint wire.OutPoint) (*blockchain.UtxoEntry, error)
+	GetOrphanRoot(hash *chainhash.Hash) *chainhash.Hash
+	HaveBlock(hash *chainhash.Hash) (bool, error)
+	IsCurrent() bool
+	IsKnownOrphan(hash *chainhash.Hash) bool
+	LatestBlockLocator() (blockchain.BlockLocator, error)
+	OrphanCount() int
+	ProcessBlock(
+		workerNumber uint32, candidateBlock *block.Block,
+		flags blockchain.BehaviorFlags, height int32,
+	) (bool, bool, error)
+	Subscribe(callback blockchain.NotificationCallback)
+}
+
+// txSource is the part of the mempool used by the SyncManager. It is implemented by *mempool.TxPool and lets tests
+// drive the SyncManager with a mock mempool.
+type txSource interface {
+	HaveTransaction(hash *chainhash.Hash) bool
+	MinRelayTxFee() amt.Amount
+	MaybeAcceptTransaction(
+		b *blockchain.BlockChain,
+		tx *util.Tx, isNew, rateLimit bool,
+	) ([]*chainhash.Hash, *mempool.TxDesc, error)
+	ProcessOrphans(b *blockchain.BlockChain, acceptedTx *util.Tx) []*mempool.TxDesc
+	ProcessTransaction(
+		b *blockchain.BlockChain, tx *util.Tx,
+		allowOrphan, rateLimit bool, tag mempool.Tag,
+	) ([]*mempool.TxDesc, error)
+	RemoveDoubleSpends(tx *util.Tx)
+	RemoveOrphan(tx *util.Tx)
+	RemoveTransaction(tx *util.Tx, removeRedeemers bool)
+	SetMinRelayTxFee(fee amt.Amount)
+}
+
 // Config is a configuration struct used to initialize a new SyncManager.
 type Config struct {
 	PeerNotifier       PeerNotifier
@@ -28,4 +71,36 @@ type Config struct {
 	DisableCheckpoints bool
 	MaxPeers           int
 	FeeEstimator       *mempool.FeeEstimator
+	// BlocksOnly stops transactions being fetched from peers: tx invs are ignored and transactions peers send
+	// unsolicited are dropped before they reach the mempool. The fee estimator learns from the transactions that enter
+	// the mempool, so only those submitted locally are observed and its estimates are drawn from very few of them, or
+	// are unavailable, while blocks are still registered with it as they are connected.
+	BlocksOnly bool
+	// OnCheckpointVerified is called from the sync handler goroutine, and so must not block, each time a header
+	// downloaded in headers-first mode reaches the height of a checkpoint, with the hash of the header and whether it
+	// matched the checkpoint. The peer that sent a header that didn't match is disconnected.
+	OnCheckpointVerified func(height int32, hash *chainhash.Hash, ok bool)
+	// TrustedBlockSource reports whether the blocks a peer sends are processed with blockchain.BFFastAdd, which skips
+	// the checks of their transactions: finality, the coinbase height, and the script and signature checks of their
+	// inputs. A block from a trusted peer that spends coins it doesn't own, or creates more than the subsidy, is
+	// connected to the chain and its outputs enter the utxo set, and the chain can only be repaired by reindexing. It is
+	// only meant for controlled bulk imports from a node the operator runs, such as over a private channel, and must
+	// never be set for peers reached over the network. When it is nil no peer is trusted.
+	TrustedBlockSource func(p *peer.Peer) bool
+	// WitnessEnabled is set for chains with segregated witness data, which parallelcoin doesn't have. Witness inventory
+	// is then accepted from peers, blocks and transactions are requested with their witness data from peers that
+	// support it, and only such peers are synced from and have their block invs followed. When it is false witness
+	// inventory is ignored and everything is fetched without witness data from any peer.
+	WitnessEnabled bool
+	// MaxBlockSize and MaxBlockTxs are the largest serialized size and the most transactions a block received from a
+	// peer can have before it is rejected, ahead of the full validation of the chain. Zero means the limits the chain
+	// enforces, blockchain.MaxBlockBaseSize for both.
+	MaxBlockSize int
+	MaxBlockTxs  int
+	// BanPeer is called from the sync handler goroutine, and so must not block, to ban a peer that sent a block over
+	// the limits. When it is nil the peer is disconnected.
+	BanPeer func(p *peer.Peer, reason string)
+	// RecordBlockProcessTimes times each block the chain processes, for SyncManager.BlockProcessTimes to summarise.
+	// Blocks aren't timed when it is false.
+	RecordBlockProcessTimes bool
 }
@@ -12,6 +12,7 @@ import (
 	"github.com/p9c/pod/pkg/util/qu"
 	
 	"github.com/p9c/pod/cmd/node/mempool"
+	"github.com/p9c/pod/pkg/amt"
 	"github.com/p9c/pod/pkg/blockchain"
 	"github.com/p9c/pod/pkg/chaincfg"
 	"github.com/p9c/pod/pkg/chainhash"
@@ -31,8 +32,8 @@ type (
 		peerNotifier   PeerNotifier
 		started        int32
 		shutdown       int32
-		chain          *blockchain.BlockChain
-		txMemPool      *mempool.TxPool
+		chain          chainSource
+		txMemPool      txSource
 		chainParams    *chaincfg.Params
 		progressLogger *blockProgressLogger
 		msgChan        chan interface{}
@@ -44,6 +45,13 @@ type (
 		requestedBlocks map[chainhash.Hash]struct{}
 		syncPeer        *peerpkg.Peer
 		peerStates      map[*peerpkg.Peer]*peerSyncState
+		// orphanRoots holds the roots of the orphan chains whose parents were requested from peers.
+		orphanRoots map[chainhash.Hash]struct{}
+		// relayedBlocks holds the hashes of the blocks most recently relayed to peers, which aren't relayed again. It
+		// is guarded by relayedBlocksMtx, as the chain notifications accepted blocks are relayed from also come from
+		// blocks processed outside the blockHandler thread.
+		relayedBlocks    map[chainhash.Hash]struct{}
+		relayedBlocksMtx sync.Mutex
 		// The following fields are used for headers-first mode.
 		headersFirstMode bool
 		headerList       *list.List
@@ -51,6 +59,26 @@ type (
 		nextCheckpoint   *chaincfg.Checkpoint
 		// An optional fee estimator.
 		feeEstimator *mempool.FeeEstimator
+		// blockChain is the concrete chain the mempool checks transactions against. It is nil when the SyncManager is
+		// driven by a mock chain in tests.
+		blockChain *blockchain.BlockChain
+		// blocksOnly is set when transactions aren't fetched from peers.
+		blocksOnly bool
+		// onCheckpointVerified is called with the result of checking each header at a checkpoint height.
+		onCheckpointVerified func(height int32, hash *chainhash.Hash, ok bool)
+		// trustedBlockSource reports whether the blocks of a peer are added without checking their transactions.
+		trustedBlockSource func(p *peerpkg.Peer) bool
+		// witnessEnabled is set when the chain has witness data, which is fetched from peers that support it.
+		witnessEnabled bool
+		// checkpointsDisabled is set when headers aren't synced to and verified against checkpoints.
+		checkpointsDisabled bool
+		// maxBlockSize and maxBlockTxs are the limits of the blocks received from peers, and banPeer bans a peer
+		// that sends a block over them.
+		maxBlockSize int
+		maxBlockTxs  int
+		banPeer      func(p *peerpkg.Peer, reason string)
+		// blockTimes summarises how long the chain took to process each block, and is nil unless it is recorded.
+		blockTimes *BlockProcessTimes
 	}
 	// blockMsg packages a bitcoin block message and the peer it came from together
 	// so the block handler has access to that information.
@@ -63,11 +91,39 @@ type (
 	donePeerMsg struct {
 		peer *peerpkg.Peer
 	}
+	// getCheckpointsMsg is a message type to be sent across the message channel
+	// for retrieving the checkpoints headers are verified against.
+	getCheckpointsMsg struct {
+		reply chan []chaincfg.Checkpoint
+	}
+	// getNextCheckpointMsg is a message type to be sent across the message
+	// channel for retrieving the next checkpoint headers are synced to.
+	getNextCheckpointMsg struct {
+		reply chan *chaincfg.Checkpoint
+	}
 	// getSyncPeerMsg is a message type to be sent across the message channel for
 	// retrieving the current sync peer.
 	getSyncPeerMsg struct {
 		reply chan int32
 	}
+	// getPeerStatsMsg is a message type to be sent across the message channel for
+	// retrieving the download stats of each peer.
+	getPeerStatsMsg struct {
+		reply chan map[int32]PeerSyncStats
+	}
+	// resetPeerStatsMsg is a message type to be sent across the message channel
+	// for zeroing the download stats of each peer.
+	resetPeerStatsMsg struct{}
+	// getOrphanStatsMsg is a message type to be sent across the message channel
+	// for retrieving the orphan blocks being held and the roots being requested.
+	getOrphanStatsMsg struct {
+		reply chan OrphanInfo
+	}
+	// getBlockTimesMsg is a message type to be sent across the message channel
+	// for retrieving the summary of the time taken to process blocks.
+	getBlockTimesMsg struct {
+		reply chan BlockProcessTimes
+	}
 	// headerNode is used as a node in a list of headers that are linked together
 	// between checkpoints.
 	headerNode struct {
@@ -109,6 +165,28 @@ type (
 		requestQueue    []*wire.InvVect
 		requestedTxns   map[chainhash.Hash]struct{}
 		requestedBlocks map[chainhash.Hash]struct{}
+		blocksDelivered uint64
+		bytesDelivered  uint64
+	}
+	// OrphanInfo describes the orphan blocks the chain is holding, for finding out
+	// why the sync isn't progressing.
+	OrphanInfo struct {
+		// Count is the number of orphan blocks in the chain's orphan pool.
+		Count int
+		// Roots are the roots of the orphan chains whose parents are being
+		// requested from peers, in no particular order.
+		Roots []chainhash.Hash
+	}
+	// PeerSyncStats is a snapshot of the blocks a peer has delivered to the
+	// SyncManager since it connected or the stats were last reset.
+	PeerSyncStats struct {
+		// BlocksDelivered is the number of requested blocks the peer delivered.
+		BlocksDelivered uint64
+		// BytesDelivered is the serialized size of the blocks the peer delivered.
+		BytesDelivered uint64
+		// InFlight is the number of blocks requested from the peer that it has not
+		// yet delivered.
+		InFlight int
 	}
 	// processBlockMsg is a message type to be sent across the message channel for
 	// requested a block is processed. Note this call differs from blockMsg above in
@@ -125,6 +203,17 @@ type (
 		isOrphan bool
 		err      error
 	}
+	// relayBlockMsg is a message type to be sent across the message channel for
+	// relaying a locally created block to peers whether or not the chain is
+	// current.
+	relayBlockMsg struct {
+		block *block2.Block
+	}
+	// switchSyncPeerMsg is a message type to be sent across the message channel
+	// for replacing the sync peer with another candidate.
+	switchSyncPeerMsg struct {
+		reply chan bool
+	}
 	// txMsg packages a bitcoin tx message and the peer it came from together so the
 	// block handler has access to that information.
 	txMsg struct {
@@ -147,6 +236,9 @@ const (
 	// maxRequestedTxns is the maximum number of requested transactions hashes to
 	// store in memory.
 	maxRequestedTxns = wire.MaxInvPerMsg
+	// maxRelayedBlocks is the maximum number of relayed block hashes to store in
+	// memory.
+	maxRelayedBlocks = 100
 )
 
 // zeroHash is the zero value hash (all zeros)
@@ -233,6 +325,17 @@ func (sm *SyncManager) QueueInv(inv *wire.MsgInv, peer *peerpkg.Peer) {
 	sm.msgChan <- &invMsg{inv: inv, peer: peer}
 }
 
+// RelayBlock relays the inventory of a locally created block, such as a newly
+// mined one, to peers. Unlike the blocks accepted while syncing, it is relayed
+// whether or not the chain is current. A block that has already been relayed,
+// by either path, is not relayed again.
+func (sm *SyncManager) RelayBlock(block *block2.Block) {
+	if atomic.LoadInt32(&sm.shutdown) != 0 {
+		return
+	}
+	sm.msgChan <- relayBlockMsg{block: block}
+}
+
 // QueueTx adds the passed transaction message and peer to the block handling
 // queue. Responds to the done channel argument after the tx message is
 // processed.
@@ -276,6 +379,88 @@ func (sm *SyncManager) SyncPeerID() int32 {
 	return <-reply
 }
 
+// SwitchSyncPeer stops syncing from the current sync peer and starts syncing
+// from another candidate, returning whether one was found. The old sync peer
+// stays connected for relaying transactions and blocks, and it is kept as the
+// sync peer if there is no other candidate. When there is no sync peer, one is
+// picked among all the candidates.
+func (sm *SyncManager) SwitchSyncPeer() bool {
+	reply := make(chan bool)
+	sm.msgChan <- switchSyncPeerMsg{reply: reply}
+	return <-reply
+}
+
+// Checkpoints returns the checkpoints the headers of the chain are verified
+// against, in order of height, which are none when checkpoints are disabled.
+func (sm *SyncManager) Checkpoints() []chaincfg.Checkpoint {
+	reply := make(chan []chaincfg.Checkpoint)
+	sm.msgChan <- getCheckpointsMsg{reply: reply}
+	return <-reply
+}
+
+// NextCheckpoint returns the next checkpoint the headers-first sync downloads
+// and verifies headers up to, or nil when the chain is past the last
+// checkpoint or checkpoints are disabled.
+func (sm *SyncManager) NextCheckpoint() *chaincfg.Checkpoint {
+	reply := make(chan *chaincfg.Checkpoint)
+	sm.msgChan <- getNextCheckpointMsg{reply: reply}
+	return <-reply
+}
+
+// PeerStats returns the download stats of each connected peer, keyed by peer
+// id.
+func (sm *SyncManager) PeerStats() map[int32]PeerSyncStats {
+	reply := make(chan map[int32]PeerSyncStats)
+	sm.msgChan <- getPeerStatsMsg{reply: reply}
+	return <-reply
+}
+
+// pruneOrphanRoots forgets the requested orphan roots that are no longer
+// orphans, as they have been connected or evicted from the orphan pool.
+func (sm *SyncManager) pruneOrphanRoots() {
+	for root := range sm.orphanRoots {
+		root := root
+		if !sm.chain.IsKnownOrphan(&root) {
+			delete(sm.orphanRoots, root)
+		}
+	}
+}
+
+// OrphanStats returns the number of orphan blocks the chain is holding, and the
+// roots of the orphan chains whose parents are being requested from peers.
+func (sm *SyncManager) OrphanStats() OrphanInfo {
+	reply := make(chan OrphanInfo)
+	sm.msgChan <- getOrphanStatsMsg{reply: reply}
+	return <-reply
+}
+
+// BlockProcessTimes returns a summary of how long the chain took to process
+// each block, from peers or passed to ProcessBlock, since the SyncManager was
+// created. It is empty unless Config.RecordBlockProcessTimes is set.
+func (sm *SyncManager) BlockProcessTimes() BlockProcessTimes {
+	reply := make(chan BlockProcessTimes)
+	sm.msgChan <- getBlockTimesMsg{reply: reply}
+	return <-reply
+}
+
+// ResetPeerStats zeroes the delivered block and byte counts of each peer, so
+// that PeerStats measures what was delivered since the reset.
+func (sm *SyncManager) ResetPeerStats() {
+	sm.msgChan <- resetPeerStatsMsg{}
+}
+
+// MinRelayTxFee returns the minimum transaction fee in DUO/kB the mempool currently requires of the transactions it
+// accepts from peers.
+func (sm *SyncManager) MinRelayTxFee() amt.Amount {
+	return sm.txMemPool.MinRelayTxFee()
+}
+
+// SetMinRelayTxFee changes the minimum transaction fee in DUO/kB the mempool requires of the transactions it accepts
+// from peers, for example to raise it during congestion. It can't be lowered below the mempool's configured policy.
+func (sm *SyncManager) SetMinRelayTxFee(fee amt.Amount) {
+	sm.txMemPool.SetMinRelayTxFee(fee)
+}
+
 // blockHandler is the main handler for the sync manager. It must be run as a
 // goroutine. It processes block and inv messages in a separate goroutine from
 // the peer handlers so the block (Block) messages are handled by a single
@@ -287,78 +472,7 @@ out:
 	for {
 		select {
 		case m := <-sm.msgChan:
-			switch msg := m.(type) {
-			case *newPeerMsg:
-				sm.handleNewPeerMsg(msg.peer)
-			case *txMsg:
-				sm.handleTxMsg(msg)
-				msg.reply <- struct{}{}
-			case *blockMsg:
-				sm.handleBlockMsg(0, msg)
-				msg.reply <- struct{}{}
-			case *invMsg:
-				sm.handleInvMsg(msg)
-			case *headersMsg:
-				sm.handleHeadersMsg(msg)
-			case *donePeerMsg:
-				sm.handleDonePeerMsg(msg.peer)
-			case getSyncPeerMsg:
-				var peerID int32
-				if sm.syncPeer != nil {
-					peerID = sm.syncPeer.ID()
-				}
-				msg.reply <- peerID
-			case processBlockMsg:
-				T.Ln("received processBlockMsg")
-				var heightUpdate int32
-				header := &msg.block.WireBlock().Header
-				T.Ln("checking if have should have serialized block height")
-				if blockchain.ShouldHaveSerializedBlockHeight(header) {
-					T.Ln("reading coinbase transaction")
-					mbt := msg.block.Transactions()
-					if len(mbt) > 0 {
-						coinbaseTx := mbt[len(mbt)-1]
-						T.Ln("extracting coinbase height")
-						var e error
-						var cbHeight int32
-						if cbHeight, e = blockchain.ExtractCoinbaseHeight(coinbaseTx); E.Chk(e) {
-							W.Ln("unable to extract height from coinbase tx:", e)
-						} else {
-							heightUpdate = cbHeight
-						}
-					} else {
-						D.Ln("no transactions in block??")
-					}
-				}
-				T.Ln("passing to chain.ProcessBlock")
-				var isOrphan bool
-				var e error
-				if _, isOrphan, e = sm.chain.ProcessBlock(
-					workerNumber,
-					msg.block,
-					msg.flags,
-					heightUpdate,
-				); D.Chk(e) {
-					D.Ln("error processing new block ", e)
-					msg.reply <- processBlockResponse{
-						isOrphan: false,
-						err:      e,
-					}
-				}
-				T.Ln("sending back message on reply channel")
-				msg.reply <- processBlockResponse{
-					isOrphan: isOrphan,
-					err:      nil,
-				}
-				T.Ln("sent reply")
-			case isCurrentMsg:
-				msg.reply <- sm.current()
-			case pauseMsg:
-				// Wait until the sender unpauses the manager.
-				<-msg.unpause
-			default:
-				T.F("invalid message type in block handler: %Ter", msg)
-			}
+			sm.processMessage(workerNumber, m)
 		case <-sm.quit.Wait():
 			break out
 		}
@@ -366,6 +480,142 @@ out:
 	sm.wg.Done()
 }
 
+// processMessage handles a single message from the message channel. It is called by blockHandler for every message
+// received, and can be called directly by tests to drive the SyncManager deterministically without the goroutine.
+func (sm *SyncManager) processMessage(workerNumber uint32, m interface{}) {
+	switch msg := m.(type) {
+	case *newPeerMsg:
+		sm.handleNewPeerMsg(msg.peer)
+	case *txMsg:
+		sm.handleTxMsg(msg)
+		msg.reply <- struct{}{}
+	case *blockMsg:
+		sm.handleBlockMsg(workerNumber, msg)
+		msg.reply <- struct{}{}
+	case *invMsg:
+		sm.handleInvMsg(msg)
+	case *headersMsg:
+		sm.handleHeadersMsg(msg)
+	case *donePeerMsg:
+		sm.handleDonePeerMsg(msg.peer)
+	case getCheckpointsMsg:
+		var checkpoints []chaincfg.Checkpoint
+		if !sm.checkpointsDisabled {
+			checkpoints = append(checkpoints, sm.chain.Checkpoints()...)
+		}
+		msg.reply <- checkpoints
+	case getNextCheckpointMsg:
+		var next *chaincfg.Checkpoint
+		if sm.nextCheckpoint != nil {
+			checkpoint := *sm.nextCheckpoint
+			next = &checkpoint
+		}
+		msg.reply <- next
+	case getSyncPeerMsg:
+		var peerID int32
+		if sm.syncPeer != nil {
+			peerID = sm.syncPeer.ID()
+		}
+		msg.reply <- peerID
+	case getPeerStatsMsg:
+		stats := make(map[int32]PeerSyncStats, len(sm.peerStates))
+		for peer, state := range sm.peerStates {
+			stats[peer.ID()] = PeerSyncStats{
+				BlocksDelivered: state.blocksDelivered,
+				BytesDelivered:  state.bytesDelivered,
+				InFlight:        len(state.requestedBlocks),
+			}
+		}
+		msg.reply <- stats
+	case getOrphanStatsMsg:
+		sm.pruneOrphanRoots()
+		info := OrphanInfo{Count: sm.chain.OrphanCount()}
+		for root := range sm.orphanRoots {
+			info.Roots = append(info.Roots, root)
+		}
+		msg.reply <- info
+	case getBlockTimesMsg:
+		var times BlockProcessTimes
+		if sm.blockTimes != nil {
+			times = sm.blockTimes.copy()
+		}
+		msg.reply <- times
+	case resetPeerStatsMsg:
+		for _, state := range sm.peerStates {
+			state.blocksDelivered = 0
+			state.bytesDelivered = 0
+		}
+	case processBlockMsg:
+		T.Ln("received processBlockMsg")
+		var heightUpdate int32
+		header := &msg.block.WireBlock().Header
+		T.Ln("checking if have should have serialized block height")
+		if blockchain.ShouldHaveSerializedBlockHeight(header) {
+			T.Ln("reading coinbase transaction")
+			mbt := msg.block.Transactions()
+			if len(mbt) > 0 {
+				coinbaseTx := mbt[len(mbt)-1]
+				T.Ln("extracting coinbase height")
+				var e error
+				var cbHeight int32
+				if cbHeight, e = blockchain.ExtractCoinbaseHeight(coinbaseTx); E.Chk(e) {
+					W.Ln("unable to extract height from coinbase tx:", e)
+				} else {
+					heightUpdate = cbHeight
+				}
+			} else {
+				D.Ln("no transactions in block??")
+			}
+		}
+		T.Ln("passing to chain.ProcessBlock")
+		var isOrphan bool
+		var e error
+		if _, isOrphan, e = sm.processBlock(
+			workerNumber,
+			msg.block,
+			msg.flags,
+			heightUpdate,
+		); D.Chk(e) {
+			D.Ln("error processing new block ", e)
+			msg.reply <- processBlockResponse{
+				isOrphan: false,
+				err:      e,
+			}
+		}
+		T.Ln("sending back message on reply channel")
+		msg.reply <- processBlockResponse{
+			isOrphan: isOrphan,
+			err:      nil,
+		}
+		T.Ln("sent reply")
+	case relayBlockMsg:
+		sm.relayBlock(msg.block)
+	case switchSyncPeerMsg:
+		msg.reply <- sm.switchSyncPeer()
+	case isCurrentMsg:
+		msg.reply <- sm.current()
+	case pauseMsg:
+		// Wait until the sender unpauses the manager.
+		<-msg.unpause
+	default:
+		T.F("invalid message type in block handler: %Ter", msg)
+	}
+}
+
+// processBlock passes the block to the chain to be processed, and times it when block process times are recorded.
+func (sm *SyncManager) processBlock(
+	workerNumber uint32, blk *block2.Block,
+	flags blockchain.BehaviorFlags, height int32,
+) (bool, bool, error) {
+	if sm.blockTimes == nil {
+		return sm.chain.ProcessBlock(workerNumber, blk, flags, height)
+	}
+	start := time.Now()
+	isMainChain, isOrphan, e := sm.chain.ProcessBlock(workerNumber, blk, flags, height)
+	sm.blockTimes.add(time.Since(start))
+	return isMainChain, isOrphan, e
+}
+
 // current returns true if we believe we are synced with our peers, false if we
 // still have blocks to check
 func (sm *SyncManager) current() bool {
@@ -418,9 +668,9 @@ func (sm *SyncManager) fetchHeaderBlocks() {
 			syncPeerState := sm.peerStates[sm.syncPeer]
 			sm.requestedBlocks[*node.hash] = struct{}{}
 			syncPeerState.requestedBlocks[*node.hash] = struct{}{}
-			// If we're fetching from a witness enabled peer post-fork, then ensure that we
-			// receive all the witness data in the blocks.
-			if sm.syncPeer.IsWitnessEnabled() {
+			// If we're fetching from a witness enabled peer on a witness chain, then ensure
+			// that we receive all the witness data in the blocks.
+			if sm.witnessPeer(sm.syncPeer) {
 				iv.Type = wire.InvTypeWitnessBlock
 			}
 			ee = gdmsg.AddInvVect(iv)
@@ -464,6 +714,24 @@ func (sm *SyncManager) findNextHeaderCheckpoint(height int32) *chaincfg.Checkpoi
 	return nextCheckpoint
 }
 
+// blockOverLimits returns why the block is over the configured size or transaction count limits, or an empty string
+// if it is within them.
+func (sm *SyncManager) blockOverLimits(b *block2.Block) string {
+	if n := len(b.WireBlock().Transactions); n > sm.maxBlockTxs {
+		return fmt.Sprintf("has %d transactions, more than the limit of %d", n, sm.maxBlockTxs)
+	}
+	if size := b.WireBlock().SerializeSize(); size > sm.maxBlockSize {
+		return fmt.Sprintf("is %d bytes, more than the limit of %d", size, sm.maxBlockSize)
+	}
+	return ""
+}
+
+// witnessPeer returns whether blocks and transactions are requested from the peer with their witness data, which is
+// only when the chain has witness data and the peer can provide it.
+func (sm *SyncManager) witnessPeer(peer *peerpkg.Peer) bool {
+	return sm.witnessEnabled && peer.IsWitnessEnabled()
+}
+
 // handleBlockMsg handles block messages from all peers.
 func (sm *SyncManager) handleBlockMsg(workerNumber uint32, bmsg *blockMsg) {
 	pp := bmsg.peer
@@ -474,8 +742,21 @@ func (sm *SyncManager) handleBlockMsg(workerNumber uint32, bmsg *blockMsg) {
 		)
 		return
 	}
-	// If we didn't ask for this block then the peer is misbehaving.
 	blockHash := bmsg.block.Hash()
+	// A block over the size limits can't be valid, so the peer is banned without the chain validating it. The block
+	// is no longer requested from the peer so that it can be requested from another.
+	if reason := sm.blockOverLimits(bmsg.block); reason != "" {
+		W.F("block %v from %s %s -- banning", blockHash, pp.Addr(), reason)
+		delete(state.requestedBlocks, *blockHash)
+		delete(sm.requestedBlocks, *blockHash)
+		if sm.banPeer != nil {
+			sm.banPeer(pp, "block "+reason)
+		} else {
+			pp.Disconnect()
+		}
+		return
+	}
+	// If we didn't ask for this block then the peer is misbehaving.
 	if _, exists = state.requestedBlocks[*blockHash]; !exists {
 		// The regression test intentionally sends some blocks twice to test duplicate
 		// block insertion fails. Don't disconnect the peer or ignore the block when
@@ -517,9 +798,17 @@ func (sm *SyncManager) handleBlockMsg(workerNumber uint32, bmsg *blockMsg) {
 			}
 		}
 	}
+	// Blocks from a peer the operator trusts are added without checking their transactions.
+	if sm.trustedBlockSource != nil && sm.trustedBlockSource(pp) {
+		behaviorFlags |= blockchain.BFFastAdd
+	}
 	// Remove block from request maps. Either chain will know about it and so we
 	// shouldn't have any more instances of trying to fetch it, or we will fail the
 	// insert and thus we'll retry next time we get an inv.
+	if _, requested := state.requestedBlocks[*blockHash]; requested {
+		state.blocksDelivered++
+		state.bytesDelivered += uint64(bmsg.block.WireBlock().SerializeSize())
+	}
 	delete(state.requestedBlocks, *blockHash)
 	delete(sm.requestedBlocks, *blockHash)
 	var heightUpdate int32
@@ -539,7 +828,7 @@ func (sm *SyncManager) handleBlockMsg(workerNumber uint32, bmsg *blockMsg) {
 		}
 	}
 	// Process the block to include validation, best chain selection, orphan handling, etc.
-	_, isOrphan, e := sm.chain.ProcessBlock(
+	_, isOrphan, e := sm.processBlock(
 		workerNumber, bmsg.block,
 		behaviorFlags, heightUpdate,
 	)
@@ -574,6 +863,10 @@ func (sm *SyncManager) handleBlockMsg(workerNumber uint32, bmsg *blockMsg) {
 	// have been ignored if we are actively syncing while the chain is not yet
 	// current or who may have lost the lock announcment race. Request the parents
 	// for the orphan block from the peer that sent it.
+	//
+	// Accepting the block may have connected orphans, and holding it may have
+	// evicted others, so the roots that are no longer orphans are forgotten first.
+	sm.pruneOrphanRoots()
 	if isOrphan {
 		// We've just received an orphan block from a peer. In order to update the
 		// height of the peer, we try to extract the block height from the scriptSig of
@@ -602,8 +895,8 @@ func (sm *SyncManager) handleBlockMsg(workerNumber uint32, bmsg *blockMsg) {
 				e,
 			)
 		} else {
-			e := pp.PushGetBlocksMsg(locator, orphanRoot)
-			if e != nil {
+			if e := pp.PushGetBlocksMsg(locator, orphanRoot); e == nil {
+				sm.orphanRoots[*orphanRoot] = struct{}{}
 			}
 		}
 	} else {
@@ -684,6 +977,22 @@ func (sm *SyncManager) handleBlockMsg(workerNumber uint32, bmsg *blockMsg) {
 	}
 }
 
+// relayBlock relays the inventory of the block to peers unless it has already
+// been relayed. It is safe for concurrent access.
+func (sm *SyncManager) relayBlock(block *block2.Block) {
+	sm.relayedBlocksMtx.Lock()
+	if _, ok := sm.relayedBlocks[*block.Hash()]; ok {
+		sm.relayedBlocksMtx.Unlock()
+		return
+	}
+	sm.limitMap(sm.relayedBlocks, maxRelayedBlocks)
+	sm.relayedBlocks[*block.Hash()] = struct{}{}
+	sm.relayedBlocksMtx.Unlock()
+	// Generate the inventory vector and relay it.
+	iv := wire.NewInvVect(wire.InvTypeBlock, block.Hash())
+	sm.peerNotifier.RelayInventory(iv, block.WireBlock().Header)
+}
+
 // handleBlockchainNotification handles notifications from blockchain. It does
 // things such as request orphan block parents and relay accepted blocks to
 // connected peers.
@@ -701,9 +1010,7 @@ func (sm *SyncManager) handleBlockchainNotification(notification *blockchain.Not
 			D.Ln("chain accepted notification is not a block")
 			break
 		}
-		// Generate the inventory vector and relay it.
-		iv := wire.NewInvVect(wire.InvTypeBlock, block.Hash())
-		sm.peerNotifier.RelayInventory(iv, block.WireBlock().Header)
+		sm.relayBlock(block)
 	// A block has been connected to the main block chain.
 	case blockchain.NTBlockConnected:
 		block, ok := notification.Data.(*block2.Block)
@@ -722,7 +1029,7 @@ func (sm *SyncManager) handleBlockchainNotification(notification *blockchain.Not
 			sm.txMemPool.RemoveDoubleSpends(tx)
 			sm.txMemPool.RemoveOrphan(tx)
 			sm.peerNotifier.TransactionConfirmed(tx)
-			acceptedTxs := sm.txMemPool.ProcessOrphans(sm.chain, tx)
+			acceptedTxs := sm.txMemPool.ProcessOrphans(sm.blockChain, tx)
 			sm.peerNotifier.AnnounceNewTransactions(acceptedTxs)
 		}
 		// Register block with the fee estimator, if it exists.
@@ -748,7 +1055,7 @@ func (sm *SyncManager) handleBlockchainNotification(notification *blockchain.Not
 		for _, tx := range block.Transactions()[1:] {
 			var ee error
 			_, _, ee = sm.txMemPool.MaybeAcceptTransaction(
-				sm.chain, tx,
+				sm.blockChain, tx,
 				false, false,
 			)
 			if ee != nil {
@@ -800,6 +1107,11 @@ func (sm *SyncManager) handleDonePeerMsg(peer *peerpkg.Peer) {
 			sm.resetHeaderState(&best.Hash, best.Height)
 		}
 		sm.startSync()
+		// The blocks the lost peer didn't deliver are asked of the new one, as in
+		// switchSyncPeer, unless the new one is fetching blocks by headers.
+		if sm.syncPeer != nil && !sm.headersFirstMode {
+			sm.requestInflightBlocks(peer, state.requestedBlocks)
+		}
 	}
 }
 
@@ -864,7 +1176,11 @@ func (sm *SyncManager) handleHeadersMsg(hmsg *headersMsg) {
 		}
 		// Verify the header at the next checkpoint height matches.
 		if node.height == sm.nextCheckpoint.Height {
-			if node.hash.IsEqual(sm.nextCheckpoint.Hash) {
+			matched := node.hash.IsEqual(sm.nextCheckpoint.Hash)
+			if sm.onCheckpointVerified != nil {
+				sm.onCheckpointVerified(node.height, node.hash, matched)
+			}
+			if matched {
 				receivedCheckpoint = true
 				I.F(
 					"verified downloaded block header against checkpoint at height %d/hash %s",
@@ -958,9 +1274,16 @@ func (sm *SyncManager) handleInvMsg(imsg *invMsg) {
 		// Ignore unsupported inventory types.
 		switch iv.Type {
 		case wire.InvTypeBlock:
-		case wire.InvTypeTx:
 		case wire.InvTypeWitnessBlock:
-		case wire.InvTypeWitnessTx:
+			// Witness inventory is only supported on a witness chain.
+			if !sm.witnessEnabled {
+				continue
+			}
+		case wire.InvTypeTx, wire.InvTypeWitnessTx:
+			// Transactions aren't fetched in blocks-only mode.
+			if sm.blocksOnly || (iv.Type == wire.InvTypeWitnessTx && !sm.witnessEnabled) {
+				continue
+			}
 		default:
 			continue
 		}
@@ -983,12 +1306,12 @@ func (sm *SyncManager) handleInvMsg(imsg *invMsg) {
 					continue
 				}
 			}
-			// Ignore invs block invs from non-witness enabled peers, as after segwit
-			// activation we only want to download from peers that can provide us full
-			// witness data for blocks. PARALLELCOIN HAS NO WITNESS STUFF if
-			// !peer.IsWitnessEnabled() && iv.Type == wire.InvTypeBlock {
-			// 	continue
-			// }
+			// Ignore block invs from non-witness enabled peers on a witness chain, as we
+			// only want to download from peers that can provide us full witness data for
+			// blocks.
+			if sm.witnessEnabled && !peer.IsWitnessEnabled() && iv.Type == wire.InvTypeBlock {
+				continue
+			}
 			// Add it to the request queue.
 			state.requestQueue = append(state.requestQueue, iv)
 			continue
@@ -1009,8 +1332,8 @@ func (sm *SyncManager) handleInvMsg(imsg *invMsg) {
 					E.Ln("failed to get block locator for the latest block:", e)
 					continue
 				}
-				e = peer.PushGetBlocksMsg(locator, orphanRoot)
-				if e != nil {
+				if e = peer.PushGetBlocksMsg(locator, orphanRoot); e == nil {
+					sm.orphanRoots[*orphanRoot] = struct{}{}
 				}
 				continue
 			}
@@ -1045,7 +1368,7 @@ func (sm *SyncManager) handleInvMsg(imsg *invMsg) {
 				sm.requestedBlocks[iv.Hash] = struct{}{}
 				sm.limitMap(sm.requestedBlocks, maxRequestedBlocks)
 				state.requestedBlocks[iv.Hash] = struct{}{}
-				if peer.IsWitnessEnabled() {
+				if sm.witnessPeer(peer) {
 					iv.Type = wire.InvTypeWitnessBlock
 				}
 				e := gdmsg.AddInvVect(iv)
@@ -1061,9 +1384,9 @@ func (sm *SyncManager) handleInvMsg(imsg *invMsg) {
 				sm.requestedTxns[iv.Hash] = struct{}{}
 				sm.limitMap(sm.requestedTxns, maxRequestedTxns)
 				state.requestedTxns[iv.Hash] = struct{}{}
-				// If the peer is capable, request the txn including all witness
-				// data.
-				if peer.IsWitnessEnabled() {
+				// If the peer is capable, on a witness chain, request the txn including
+				// all witness data.
+				if sm.witnessPeer(peer) {
 					iv.Type = wire.InvTypeWitnessTx
 				}
 				e := gdmsg.AddInvVect(iv)
@@ -1118,6 +1441,17 @@ func (sm *SyncManager) handleTxMsg(tmsg *txMsg) {
 		)
 		return
 	}
+	// In blocks-only mode no transactions are requested, so any that arrive are unsolicited and dropped before they
+	// reach the mempool.
+	if sm.blocksOnly {
+		D.C(
+			func() string {
+				return "ignoring unsolicited transaction " + tmsg.tx.Hash().String() +
+					" from " + peer.String() + " in blocks-only mode"
+			},
+		)
+		return
+	}
 	// NOTE: BitcoinJ, and possibly other wallets, don't follow the spec of sending
 	// an inventory message and allowing the remote peer to decide whether or not
 	// they want to request the transaction via a getdata message. Unfortunately,
@@ -1141,7 +1475,7 @@ func (sm *SyncManager) handleTxMsg(tmsg *txMsg) {
 	// Process the transaction to include validation, insertion in the memory pool,
 	// orphan handling, etc.
 	acceptedTxs, e := sm.txMemPool.ProcessTransaction(
-		sm.chain, tmsg.tx,
+		sm.blockChain, tmsg.tx,
 		true, true, mempool.Tag(peer.ID()),
 	)
 	// Remove transaction from request maps. Either the mempool/chain already knows
@@ -1184,6 +1518,10 @@ func (sm *SyncManager) handleTxMsg(tmsg *txMsg) {
 // of the main chain, on a side chain, in the orphan pool, and transactions that
 // are in the memory pool (either the main pool or orphan pool).
 func (sm *SyncManager) haveInventory(invVect *wire.InvVect) (bool, error) {
+	// Witness inventory is an unsupported type when the chain has no witness data.
+	if !sm.witnessEnabled && (invVect.Type == wire.InvTypeWitnessBlock || invVect.Type == wire.InvTypeWitnessTx) {
+		return true, nil
+	}
 	switch invVect.Type {
 	case wire.InvTypeWitnessBlock:
 		fallthrough
@@ -1242,18 +1580,10 @@ func (sm *SyncManager) isSyncCandidate(peer *peerpkg.Peer) bool {
 		if host != "127.0.0.1" && host != "localhost" {
 			return false
 		}
-		// } else {
-		// // The peer is not a candidate for sync if it's not a full node. Additionally, if the segwit soft-fork package
-		// // has activated, then the peer must also be upgraded.
-		// segwitActive, e := sm.chain.IsDeploymentActive(chaincfg.DeploymentSegwit)
-		// if e != nil  {
-		// 			// 	Error("unable to query for segwit soft-fork state:", e)
-		// }
-		// nodeServices := peer.Services()
-		// if nodeServices&wire.SFNodeNetwork != wire.SFNodeNetwork ||
-		// 	(segwitActive && !peer.IsWitnessEnabled()) {
-		// 	return false
-		// }
+	} else if sm.witnessEnabled && !peer.IsWitnessEnabled() {
+		// On a witness chain the peer must be able to provide the witness data of the
+		// blocks to be synced from.
+		return false
 	}
 	// Candidate if all checks passed.
 	return true
@@ -1291,36 +1621,108 @@ func (sm *SyncManager) resetHeaderState(newestHash *chainhash.Hash, newestHeight
 	}
 }
 
+// switchSyncPeer replaces the sync peer with another candidate, returning
+// whether one was found. If there is none, syncing carries on from the old
+// sync peer.
+func (sm *SyncManager) switchSyncPeer() bool {
+	old := sm.syncPeer
+	if old == nil {
+		sm.startSync()
+		return sm.syncPeer != nil
+	}
+	// The headers-first state is reset like when the sync peer leaves, so the new
+	// sync peer downloads headers from the best block.
+	sm.syncPeer = nil
+	if sm.headersFirstMode {
+		best := sm.chain.BestSnapshot()
+		sm.resetHeaderState(&best.Hash, best.Height)
+	}
+	sm.startSyncExcept(old)
+	if sm.syncPeer == nil {
+		D.Ln("no other sync peer candidate than", old)
+		sm.startSync()
+		return false
+	}
+	I.Ln("switched sync peer from", old, "to", sm.syncPeer)
+	// In headers-first mode the new sync peer is asked for every block after the
+	// best one once it has sent the headers, so only the blocks found by inv are
+	// requested again here.
+	if !sm.headersFirstMode {
+		if oldState, exists := sm.peerStates[old]; exists {
+			sm.requestInflightBlocks(old, oldState.requestedBlocks)
+		}
+	}
+	return true
+}
+
+// requestInflightBlocks asks the sync peer for the blocks requested from the old
+// sync peer that haven't arrived, which would otherwise only be requested again
+// if the sync peer happens to announce them. When the sync peer is switched the
+// blocks stay requested from the old peer too, which is still connected and may
+// yet deliver them. The blocks are asked for in as many getdata messages as it
+// takes.
+func (sm *SyncManager) requestInflightBlocks(old *peerpkg.Peer, requested map[chainhash.Hash]struct{}) {
+	if len(requested) == 0 {
+		return
+	}
+	state, exists := sm.peerStates[sm.syncPeer]
+	if !exists {
+		return
+	}
+	gdmsg := wire.NewMsgGetDataSizeHint(uint(len(requested)))
+	var count int
+	for hash := range requested {
+		hash := hash
+		iv := wire.NewInvVect(wire.InvTypeBlock, &hash)
+		if haveInv, e := sm.haveInventory(iv); E.Chk(e) || haveInv {
+			continue
+		}
+		sm.requestedBlocks[hash] = struct{}{}
+		state.requestedBlocks[hash] = struct{}{}
+		if sm.witnessPeer(sm.syncPeer) {
+			iv.Type = wire.InvTypeWitnessBlock
+		}
+		if e := gdmsg.AddInvVect(iv); E.Chk(e) {
+			break
+		}
+		count++
+		if len(gdmsg.InvList) == wire.MaxInvPerMsg {
+			sm.syncPeer.QueueMessage(gdmsg, nil)
+			gdmsg = wire.NewMsgGetData()
+		}
+	}
+	if len(gdmsg.InvList) > 0 {
+		sm.syncPeer.QueueMessage(gdmsg, nil)
+	}
+	if count > 0 {
+		D.Ln("requesting", count, "blocks in flight from", old, "from", sm.syncPeer)
+	}
+}
+
 // startSync will choose the best peer among the available candidate peers to
 // download/sync the blockchain from. When syncing is already running, it simply
 // returns. It also examines the candidates for any which are no longer
 // candidates and removes them as needed.
 func (sm *SyncManager) startSync() {
+	sm.startSyncExcept(nil)
+}
+
+// startSyncExcept is startSync choosing among the candidates other than the
+// except peer.
+func (sm *SyncManager) startSyncExcept(except *peerpkg.Peer) {
 	// Return now if we're already syncing.
 	if sm.syncPeer != nil {
 		return
 	}
-	// Once the segwit soft-fork package has activated, we only want to sync from
-	// peers which are witness enabled to ensure that we fully validate all
-	// blockchain data.
-	// var e error
-	// var segwitActive bool
-	// segwitActive, e = sm.chain.IsDeploymentActive(chaincfg.DeploymentSegwit)
-	// if e != nil  {
-	// 	Error("unable to query for segwit soft-fork state:", e)
-	// 	return
-	// }
 	best := sm.chain.BestSnapshot()
 	var bestPeer *peerpkg.Peer
 	for peer, state := range sm.peerStates {
-		if !state.syncCandidate {
+		if !state.syncCandidate || peer == except {
 			continue
 		}
-		// if segwitActive && !peer.IsWitnessEnabled() {
-		// 	D.Ln("peer", peer, "not witness enabled, skipping")
-		// 	continue
-		// } Remove sync candidate peers that are no longer candidates due to passing
-		// their latest known block.
+		// Remove sync candidate peers that are no longer candidates due to passing
+		// their latest known block. On a witness chain, peers that aren't witness
+		// enabled were never candidates.
 		//
 		// NOTE: The < is intentional as opposed to <=. While technically the peer
 		// doesn't have a later block when it's equal, it will likely have one soon so
@@ -1389,20 +1791,47 @@ func (sm *SyncManager) startSync() {
 // New constructs a new SyncManager. Use Start to begin processing asynchronous
 // block, tx, and inv updates.
 func New(config *Config) (*SyncManager, error) {
+	sm := newSyncManager(config, config.Chain, config.TxMemPool)
+	sm.blockChain = config.Chain
+	return sm, nil
+}
+
+// newSyncManager returns a new SyncManager using the passed chain and mempool in place of those in the config, which
+// allows tests to construct one around mocks and drive it with processMessage.
+func newSyncManager(config *Config, chain chainSource, txMemPool txSource) *SyncManager {
 	sm := SyncManager{
 		peerNotifier:    config.PeerNotifier,
-		chain:           config.Chain,
-		txMemPool:       config.TxMemPool,
+		chain:           chain,
+		txMemPool:       txMemPool,
 		chainParams:     config.ChainParams,
 		rejectedTxns:    make(map[chainhash.Hash]struct{}),
 		requestedTxns:   make(map[chainhash.Hash]struct{}),
 		requestedBlocks: make(map[chainhash.Hash]struct{}),
+		orphanRoots:     make(map[chainhash.Hash]struct{}),
+		relayedBlocks:   make(map[chainhash.Hash]struct{}),
 		peerStates:      make(map[*peerpkg.Peer]*peerSyncState),
 		progressLogger:  newBlockProgressLogger("processed"),
 		msgChan:         make(chan interface{}, config.MaxPeers*3),
 		headerList:      list.New(),
 		quit:            qu.T(),
 		feeEstimator:    config.FeeEstimator,
+		blocksOnly:      config.BlocksOnly,
+	}
+	sm.onCheckpointVerified = config.OnCheckpointVerified
+	sm.trustedBlockSource = config.TrustedBlockSource
+	sm.witnessEnabled = config.WitnessEnabled
+	sm.checkpointsDisabled = config.DisableCheckpoints
+	sm.maxBlockSize = config.MaxBlockSize
+	if sm.maxBlockSize <= 0 {
+		sm.maxBlockSize = blockchain.MaxBlockBaseSize
+	}
+	sm.maxBlockTxs = config.MaxBlockTxs
+	if sm.maxBlockTxs <= 0 {
+		sm.maxBlockTxs = blockchain.MaxBlockBaseSize
+	}
+	sm.banPeer = config.BanPeer
+	if config.RecordBlockProcessTimes {
+		sm.blockTimes = newBlockProcessTimes()
 	}
 	best := sm.chain.BestSnapshot()
 	if !config.DisableCheckpoints {
@@ -1415,5 +1844,5 @@ func New(config *Config) (*SyncManager, error) {
 		I.Ln("checkpoints are disabled")
 	}
 	sm.chain.Subscribe(sm.handleBlockchainNotification)
-	return &sm, nil
+	return &sm
 }
@@ -0,0 +1,795 @@
+package netsync
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	
+	"github.com/p9c/pod/cmd/node/mempool"
+	"github.com/p9c/pod/pkg/amt"
+	"github.com/p9c/pod/pkg/block"
+	"github.com/p9c/pod/pkg/blockchain"
+	"github.com/p9c/pod/pkg/chaincfg"
+	"github.com/p9c/pod/pkg/chainhash"
+	peerpkg "github.com/p9c/pod/pkg/peer"
+	"github.com/p9c/pod/pkg/util"
+	"github.com/p9c/pod/pkg/util/qu"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// mockChain is a chainSource holding only the genesis block, whose blocks are all unknown.
+type mockChain struct {
+	best blockchain.BestState
+}
+
+func (c *mockChain) BestSnapshot() *blockchain.BestState { return &c.best }
+func (c *mockChain) BlockHeightByHash(*chainhash.Hash) (int32, error) {
+	return 0, errors.New("unknown block")
+}
+func (c *mockChain) BlockLocatorFromHash(*chainhash.Hash) blockchain.BlockLocator {
+	return blockchain.BlockLocator{&c.best.Hash}
+}
+func (c *mockChain) Checkpoints() []chaincfg.Checkpoint                          { return nil }
+func (c *mockChain) FetchUtxoEntry(wire.OutPoint) (*blockchain.UtxoEntry, error) { return nil, nil }
+func (c *mockChain) GetOrphanRoot(hash *chainhash.Hash) *chainhash.Hash          { return hash }
+func (c *mockChain) HaveBlock(hash *chainhash.Hash) (bool, error)                { return c.best.Hash == *hash, nil }
+func (c *mockChain) IsCurrent() bool                                             { return false }
+func (c *mockChain) IsKnownOrphan(*chainhash.Hash) bool                          { return false }
+func (c *mockChain) LatestBlockLocator() (blockchain.BlockLocator, error) {
+	return blockchain.BlockLocator{&c.best.Hash}, nil
+}
+func (c *mockChain) OrphanCount() int { return 0 }
+func (c *mockChain) ProcessBlock(uint32, *block.Block, blockchain.BehaviorFlags, int32) (bool, bool, error) {
+	return false, false, nil
+}
+func (c *mockChain) Subscribe(blockchain.NotificationCallback) {}
+
+// mockTxPool is an empty txSource that accepts nothing.
+type mockTxPool struct{}
+
+func (mockTxPool) HaveTransaction(*chainhash.Hash) bool { return false }
+func (mockTxPool) MinRelayTxFee() amt.Amount           { return 0 }
+func (mockTxPool) MaybeAcceptTransaction(
+	*blockchain.BlockChain, *util.Tx, bool, bool,
+) ([]*chainhash.Hash, *mempool.TxDesc, error) {
+	return nil, nil, nil
+}
+func (mockTxPool) ProcessOrphans(*blockchain.BlockChain, *util.Tx) []*mempool.TxDesc { return nil }
+func (mockTxPool) ProcessTransaction(
+	*blockchain.BlockChain, *util.Tx, bool, bool, mempool.Tag,
+) ([]*mempool.TxDesc, error) {
+	return nil, nil
+}
+func (mockTxPool) RemoveDoubleSpends(*util.Tx)      {}
+func (mockTxPool) RemoveOrphan(*util.Tx)            {}
+func (mockTxPool) RemoveTransaction(*util.Tx, bool) {}
+func (mockTxPool) SetMinRelayTxFee(amt.Amount)      {}
+
+// conn mocks a network connection, one end of a pipe between two peers.
+type conn struct {
+	io.Reader
+	io.WriteCloser
+	addr string
+}
+
+func (c conn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c conn) RemoteAddr() net.Addr             { a, _ := net.ResolveTCPAddr("tcp", c.addr); return a }
+func (c conn) SetDeadline(time.Time) error      { return nil }
+func (c conn) SetReadDeadline(time.Time) error  { return nil }
+func (c conn) SetWriteDeadline(time.Time) error { return nil }
+
+// connectPeers returns a local outbound peer connected to a remote inbound peer at the given height that sends every
+// getblocks and getdata message it receives on the returned channel.
+func connectPeers(t *testing.T, remoteHeight int32) (*peerpkg.Peer, *peerpkg.Peer, chan wire.Message) {
+	// Both ends run in this process and so share the nonces used to detect connections to self.
+	peerpkg.AllowSelfConns = true
+	received := make(chan wire.Message, 10)
+	verack := make(chan struct{}, 2)
+	onVerAck := func(*peerpkg.Peer, *wire.MsgVerAck) { verack <- struct{}{} }
+	remoteCfg := &peerpkg.Config{
+		Listeners: peerpkg.MessageListeners{
+			OnVerAck:    onVerAck,
+			OnGetBlocks: func(_ *peerpkg.Peer, msg *wire.MsgGetBlocks) { received <- msg },
+			OnGetData:   func(_ *peerpkg.Peer, msg *wire.MsgGetData) { received <- msg },
+		},
+		NewestBlock: func() (*chainhash.Hash, int32, error) {
+			return &chainhash.Hash{}, remoteHeight, nil
+		},
+		ChainParams:     &chaincfg.SimNetParams,
+		TrickleInterval: time.Second * 10,
+	}
+	localCfg := &peerpkg.Config{
+		Listeners:       peerpkg.MessageListeners{OnVerAck: onVerAck},
+		ChainParams:     &chaincfg.SimNetParams,
+		TrickleInterval: time.Second * 10,
+	}
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	remote := peerpkg.NewInboundPeer(remoteCfg)
+	remote.AssociateConnection(conn{Reader: r1, WriteCloser: w2, addr: "10.0.0.1:11047"})
+	local, e := peerpkg.NewOutboundPeer(localCfg, "10.0.0.2:11047")
+	if e != nil {
+		t.Fatal(e)
+	}
+	local.AssociateConnection(conn{Reader: r2, WriteCloser: w1, addr: "10.0.0.2:11047"})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-verack:
+		case <-time.After(time.Second):
+			t.Fatal("verack timeout")
+		}
+	}
+	return local, remote, received
+}
+
+// expectMessage returns the next message the remote peer received, failing the test if none arrives.
+func expectMessage(t *testing.T, received chan wire.Message) wire.Message {
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for message")
+		return nil
+	}
+}
+
+// TestSyncManagerMessageOrdering replays a new peer, a block announcement and the peer leaving through processMessage
+// and checks the messages sent to the peer and the resulting sync state after each one.
+func TestSyncManagerMessageOrdering(t *testing.T) {
+	chain := &mockChain{best: blockchain.BestState{Hash: *chaincfg.SimNetParams.GenesisHash}}
+	sm := newSyncManager(
+		&Config{ChainParams: &chaincfg.SimNetParams, DisableCheckpoints: true, MaxPeers: 8},
+		chain, mockTxPool{},
+	)
+	local, remote, received := connectPeers(t, 10)
+	defer func() {
+		local.Disconnect()
+		remote.Disconnect()
+	}()
+	// A new peer ahead of the chain becomes the sync peer and is asked for blocks after the best block.
+	sm.processMessage(0, &newPeerMsg{peer: local})
+	if sm.syncPeer != local {
+		t.Fatalf("sync peer is %v, want %v", sm.syncPeer, local)
+	}
+	getBlocks, ok := expectMessage(t, received).(*wire.MsgGetBlocks)
+	if !ok {
+		t.Fatal("expected getblocks after the new peer")
+	}
+	if len(getBlocks.BlockLocatorHashes) != 1 || *getBlocks.BlockLocatorHashes[0] != chain.best.Hash {
+		t.Fatalf("getblocks locator is %v, want the best block", getBlocks.BlockLocatorHashes)
+	}
+	// An announced block that isn't known is requested from the sync peer.
+	blockHash := chainhash.Hash{1}
+	inv := wire.NewMsgInv()
+	if e := inv.AddInvVect(wire.NewInvVect(wire.InvTypeBlock, &blockHash)); e != nil {
+		t.Fatal(e)
+	}
+	sm.processMessage(0, &invMsg{inv: inv, peer: local})
+	getData, ok := expectMessage(t, received).(*wire.MsgGetData)
+	if !ok {
+		t.Fatal("expected getdata after the inv")
+	}
+	if len(getData.InvList) != 1 || getData.InvList[0].Hash != blockHash {
+		t.Fatalf("getdata requested %v, want block %v", getData.InvList, blockHash)
+	}
+	if _, ok := sm.requestedBlocks[blockHash]; !ok {
+		t.Fatal("announced block is not marked as requested")
+	}
+	// The same announcement again is not requested twice.
+	sm.processMessage(0, &invMsg{inv: inv, peer: local})
+	// Once the peer is gone its requests are forgotten and there is no sync peer left.
+	sm.processMessage(0, &donePeerMsg{peer: local})
+	if sm.syncPeer != nil {
+		t.Fatalf("sync peer is %v after it left", sm.syncPeer)
+	}
+	if len(sm.peerStates) != 0 || len(sm.requestedBlocks) != 0 {
+		t.Fatalf(
+			"%d peer states and %d requested blocks remain after the peer left",
+			len(sm.peerStates), len(sm.requestedBlocks),
+		)
+	}
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected %s message", msg.Command())
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// countingTxPool is a txSource that counts the transactions it is asked to process and rejects them all.
+type countingTxPool struct {
+	mockTxPool
+	processed int
+}
+
+func (p *countingTxPool) ProcessTransaction(
+	*blockchain.BlockChain, *util.Tx, bool, bool, mempool.Tag,
+) ([]*mempool.TxDesc, error) {
+	p.processed++
+	return nil, errors.New("rejected")
+}
+
+// TestBlocksOnly checks that in blocks-only mode only the blocks of an inv are requested and that transactions sent
+// by a peer don't reach the mempool.
+func TestBlocksOnly(t *testing.T) {
+	chain := &mockChain{best: blockchain.BestState{Hash: *chaincfg.SimNetParams.GenesisHash}}
+	txPool := &countingTxPool{}
+	sm := newSyncManager(
+		&Config{ChainParams: &chaincfg.SimNetParams, DisableCheckpoints: true, MaxPeers: 8, BlocksOnly: true},
+		chain, txPool,
+	)
+	local, remote, received := connectPeers(t, 10)
+	defer func() {
+		local.Disconnect()
+		remote.Disconnect()
+	}()
+	sm.processMessage(0, &newPeerMsg{peer: local})
+	if _, ok := expectMessage(t, received).(*wire.MsgGetBlocks); !ok {
+		t.Fatal("expected getblocks after the new peer")
+	}
+	blockHash, txHash := chainhash.Hash{1}, chainhash.Hash{2}
+	inv := wire.NewMsgInv()
+	for _, iv := range []*wire.InvVect{
+		wire.NewInvVect(wire.InvTypeTx, &txHash),
+		wire.NewInvVect(wire.InvTypeBlock, &blockHash),
+	} {
+		if e := inv.AddInvVect(iv); e != nil {
+			t.Fatal(e)
+		}
+	}
+	sm.processMessage(0, &invMsg{inv: inv, peer: local})
+	getData, ok := expectMessage(t, received).(*wire.MsgGetData)
+	if !ok {
+		t.Fatal("expected getdata after the inv")
+	}
+	if len(getData.InvList) != 1 || getData.InvList[0].Hash != blockHash {
+		t.Fatalf("getdata requested %v, want only block %v", getData.InvList, blockHash)
+	}
+	if len(sm.requestedTxns) != 0 {
+		t.Fatalf("%d transactions requested in blocks-only mode", len(sm.requestedTxns))
+	}
+	sm.processMessage(0, &txMsg{tx: util.NewTx(&wire.MsgTx{}), peer: local, reply: qu.Ts(1)})
+	if txPool.processed != 0 {
+		t.Fatalf("%d unsolicited transactions reached the mempool", txPool.processed)
+	}
+}
+
+// TestWitnessDisabled checks that without WitnessEnabled witness invs are ignored and blocks are requested without
+// witness data.
+func TestWitnessDisabled(t *testing.T) {
+	chain := &mockChain{best: blockchain.BestState{Hash: *chaincfg.SimNetParams.GenesisHash}}
+	sm := newSyncManager(
+		&Config{ChainParams: &chaincfg.SimNetParams, DisableCheckpoints: true, MaxPeers: 8},
+		chain, mockTxPool{},
+	)
+	local, remote, received := connectPeers(t, 10)
+	defer func() {
+		local.Disconnect()
+		remote.Disconnect()
+	}()
+	sm.processMessage(0, &newPeerMsg{peer: local})
+	if _, ok := expectMessage(t, received).(*wire.MsgGetBlocks); !ok {
+		t.Fatal("expected getblocks after the new peer")
+	}
+	witnessHash, blockHash := chainhash.Hash{1}, chainhash.Hash{2}
+	inv := wire.NewMsgInv()
+	for _, iv := range []*wire.InvVect{
+		wire.NewInvVect(wire.InvTypeWitnessBlock, &witnessHash),
+		wire.NewInvVect(wire.InvTypeBlock, &blockHash),
+	} {
+		if e := inv.AddInvVect(iv); e != nil {
+			t.Fatal(e)
+		}
+	}
+	sm.processMessage(0, &invMsg{inv: inv, peer: local})
+	getData, ok := expectMessage(t, received).(*wire.MsgGetData)
+	if !ok {
+		t.Fatal("expected getdata after the inv")
+	}
+	if len(getData.InvList) != 1 || getData.InvList[0].Hash != blockHash || getData.InvList[0].Type != wire.InvTypeBlock {
+		t.Fatalf("getdata requested %v, want only block %v without witness data", getData.InvList, blockHash)
+	}
+}
+
+// orphanChain is a chainSource holding orphan blocks, each mapped to the root of its orphan chain.
+type orphanChain struct {
+	mockChain
+	orphans map[chainhash.Hash]chainhash.Hash
+}
+
+func (c *orphanChain) GetOrphanRoot(hash *chainhash.Hash) *chainhash.Hash {
+	root := c.orphans[*hash]
+	return &root
+}
+func (c *orphanChain) HaveBlock(hash *chainhash.Hash) (bool, error) {
+	_, ok := c.orphans[*hash]
+	return ok, nil
+}
+func (c *orphanChain) IsKnownOrphan(hash *chainhash.Hash) bool {
+	_, ok := c.orphans[*hash]
+	return ok
+}
+func (c *orphanChain) OrphanCount() int { return len(c.orphans) }
+
+// TestOrphanStats checks that the root of an orphan announced again is reported while its parents are requested, and
+// dropped once it is no longer an orphan when the next block is processed.
+func TestOrphanStats(t *testing.T) {
+	root, child := chainhash.Hash{1}, chainhash.Hash{2}
+	chain := &orphanChain{
+		mockChain: mockChain{best: blockchain.BestState{Hash: *chaincfg.SimNetParams.GenesisHash}},
+		orphans:   map[chainhash.Hash]chainhash.Hash{root: root, child: root},
+	}
+	sm := newSyncManager(
+		&Config{ChainParams: &chaincfg.SimNetParams, DisableCheckpoints: true, MaxPeers: 8},
+		chain, mockTxPool{},
+	)
+	local, remote, received := connectPeers(t, 10)
+	defer func() {
+		local.Disconnect()
+		remote.Disconnect()
+	}()
+	sm.processMessage(0, &newPeerMsg{peer: local})
+	if _, ok := expectMessage(t, received).(*wire.MsgGetBlocks); !ok {
+		t.Fatal("expected getblocks after the new peer")
+	}
+	stats := func() OrphanInfo {
+		reply := make(chan OrphanInfo, 1)
+		sm.processMessage(0, getOrphanStatsMsg{reply: reply})
+		return <-reply
+	}
+	if info := stats(); info.Count != 2 || len(info.Roots) != 0 {
+		t.Fatalf("got %d orphans with roots %v before any were requested", info.Count, info.Roots)
+	}
+	inv := wire.NewMsgInv()
+	if e := inv.AddInvVect(wire.NewInvVect(wire.InvTypeBlock, &child)); e != nil {
+		t.Fatal(e)
+	}
+	sm.processMessage(0, &invMsg{inv: inv, peer: local})
+	getBlocks, ok := expectMessage(t, received).(*wire.MsgGetBlocks)
+	if !ok || getBlocks.HashStop != root {
+		t.Fatalf("expected getblocks up to the orphan root %v, got %v", root, getBlocks)
+	}
+	if info := stats(); info.Count != 2 || len(info.Roots) != 1 || info.Roots[0] != root {
+		t.Fatalf("got %d orphans with roots %v, want 2 with root %v", info.Count, info.Roots, root)
+	}
+	// The root's parent arrived and both blocks were connected, so the root is forgotten as the parent is processed.
+	chain.orphans = nil
+	msgBlock := &wire.Block{Header: wire.BlockHeader{PrevBlock: *chaincfg.SimNetParams.GenesisHash}}
+	msgBlock.AddTransaction(&wire.MsgTx{})
+	b := block.NewBlock(msgBlock)
+	sm.peerStates[local].requestedBlocks[*b.Hash()] = struct{}{}
+	sm.handleBlockMsg(0, &blockMsg{block: b, peer: local})
+	if len(sm.orphanRoots) != 0 {
+		t.Fatalf("%d orphan roots kept after the orphans were connected", len(sm.orphanRoots))
+	}
+	if info := stats(); info.Count != 0 || len(info.Roots) != 0 {
+		t.Fatalf("got %d orphans with roots %v after they were connected", info.Count, info.Roots)
+	}
+}
+
+// checkpointChain is a mockChain with a checkpoint.
+type checkpointChain struct {
+	mockChain
+	checkpoint chaincfg.Checkpoint
+}
+
+func (c *checkpointChain) Checkpoints() []chaincfg.Checkpoint { return []chaincfg.Checkpoint{c.checkpoint} }
+
+// TestCheckpoints checks that the checkpoints and the next checkpoint are reported unless checkpoints are disabled.
+func TestCheckpoints(t *testing.T) {
+	checkpointHash := chainhash.Hash{1}
+	checkpoint := chaincfg.Checkpoint{Height: 10, Hash: &checkpointHash}
+	for _, disabled := range []bool{false, true} {
+		chain := &checkpointChain{
+			mockChain:  mockChain{best: blockchain.BestState{Hash: *chaincfg.SimNetParams.GenesisHash}},
+			checkpoint: checkpoint,
+		}
+		sm := newSyncManager(
+			&Config{ChainParams: &chaincfg.SimNetParams, DisableCheckpoints: disabled, MaxPeers: 8},
+			chain, mockTxPool{},
+		)
+		checkpoints := make(chan []chaincfg.Checkpoint, 1)
+		sm.processMessage(0, getCheckpointsMsg{reply: checkpoints})
+		next := make(chan *chaincfg.Checkpoint, 1)
+		sm.processMessage(0, getNextCheckpointMsg{reply: next})
+		got, gotNext := <-checkpoints, <-next
+		if disabled {
+			if len(got) != 0 || gotNext != nil {
+				t.Fatalf("checkpoints %v and next checkpoint %v reported while disabled", got, gotNext)
+			}
+			continue
+		}
+		if len(got) != 1 || got[0] != checkpoint {
+			t.Fatalf("checkpoints are %v, want %v", got, checkpoint)
+		}
+		if gotNext == nil || *gotNext != checkpoint {
+			t.Fatalf("next checkpoint is %v, want %v", gotNext, checkpoint)
+		}
+	}
+}
+
+// TestCheckpointVerified checks that OnCheckpointVerified is called for a downloaded header at a checkpoint height,
+// both when it matches the checkpoint and when it doesn't.
+func TestCheckpointVerified(t *testing.T) {
+	header := &wire.BlockHeader{PrevBlock: *chaincfg.SimNetParams.GenesisHash, Nonce: 1}
+	headerHash := header.BlockHash()
+	for _, want := range []bool{true, false} {
+		checkpointHash := headerHash
+		if !want {
+			checkpointHash = chainhash.Hash{1}
+		}
+		chain := &checkpointChain{
+			mockChain:  mockChain{best: blockchain.BestState{Hash: *chaincfg.SimNetParams.GenesisHash}},
+			checkpoint: chaincfg.Checkpoint{Height: 1, Hash: &checkpointHash},
+		}
+		type result struct {
+			height int32
+			hash   chainhash.Hash
+			ok     bool
+		}
+		var results []result
+		sm := newSyncManager(
+			&Config{
+				ChainParams: &chaincfg.SimNetParams, MaxPeers: 8,
+				OnCheckpointVerified: func(height int32, hash *chainhash.Hash, ok bool) {
+					results = append(results, result{height, *hash, ok})
+				},
+			},
+			chain, mockTxPool{},
+		)
+		local, remote, _ := connectPeers(t, 10)
+		sm.processMessage(0, &newPeerMsg{peer: local})
+		if !sm.headersFirstMode {
+			t.Fatal("sync didn't start in headers-first mode")
+		}
+		headers := wire.NewMsgHeaders()
+		if e := headers.AddBlockHeader(header); e != nil {
+			t.Fatal(e)
+		}
+		sm.processMessage(0, &headersMsg{headers: headers, peer: local})
+		if len(results) != 1 || results[0] != (result{1, headerHash, want}) {
+			t.Fatalf("checkpoint results %v, want one at height 1 for %v that matched %v", results, headerHash, want)
+		}
+		local.Disconnect()
+		remote.Disconnect()
+	}
+}
+
+// flagsChain is a mockChain that records the behavior flags each block is processed with.
+type flagsChain struct {
+	mockChain
+	flags []blockchain.BehaviorFlags
+}
+
+func (c *flagsChain) ProcessBlock(_ uint32, _ *block.Block, flags blockchain.BehaviorFlags, _ int32) (
+	bool, bool, error,
+) {
+	c.flags = append(c.flags, flags)
+	return false, false, nil
+}
+
+// TestTrustedBlockSource checks that blocks are only added with BFFastAdd when TrustedBlockSource trusts the peer that
+// sent them.
+func TestTrustedBlockSource(t *testing.T) {
+	for _, trusted := range []bool{false, true} {
+		chain := &flagsChain{mockChain: mockChain{best: blockchain.BestState{Hash: *chaincfg.SimNetParams.GenesisHash}}}
+		sm := newSyncManager(
+			&Config{
+				ChainParams: &chaincfg.SimNetParams, DisableCheckpoints: true, MaxPeers: 8,
+				TrustedBlockSource: func(*peerpkg.Peer) bool { return trusted },
+			},
+			chain, mockTxPool{},
+		)
+		local, remote, _ := connectPeers(t, 10)
+		sm.processMessage(0, &newPeerMsg{peer: local})
+		msgBlock := &wire.Block{Header: wire.BlockHeader{PrevBlock: *chaincfg.SimNetParams.GenesisHash}}
+		msgBlock.AddTransaction(&wire.MsgTx{})
+		b := block.NewBlock(msgBlock)
+		sm.peerStates[local].requestedBlocks[*b.Hash()] = struct{}{}
+		sm.handleBlockMsg(0, &blockMsg{block: b, peer: local})
+		if len(chain.flags) != 1 || (chain.flags[0]&blockchain.BFFastAdd == blockchain.BFFastAdd) != trusted {
+			t.Fatalf("block processed with flags %v when the peer is trusted %v", chain.flags, trusted)
+		}
+		local.Disconnect()
+		remote.Disconnect()
+	}
+}
+
+// TestBlockLimits checks that a block with more transactions than the limit is not processed and its peer banned,
+// while a block within the limits is processed.
+func TestBlockLimits(t *testing.T) {
+	for _, txs := range []int{2, 3} {
+		chain := &flagsChain{mockChain: mockChain{best: blockchain.BestState{Hash: *chaincfg.SimNetParams.GenesisHash}}}
+		var banned []string
+		sm := newSyncManager(
+			&Config{
+				ChainParams: &chaincfg.SimNetParams, DisableCheckpoints: true, MaxPeers: 8, MaxBlockTxs: 2,
+				BanPeer: func(_ *peerpkg.Peer, reason string) { banned = append(banned, reason) },
+			},
+			chain, mockTxPool{},
+		)
+		local, remote, _ := connectPeers(t, 10)
+		sm.processMessage(0, &newPeerMsg{peer: local})
+		msgBlock := &wire.Block{Header: wire.BlockHeader{PrevBlock: *chaincfg.SimNetParams.GenesisHash}}
+		for i := 0; i < txs; i++ {
+			msgBlock.AddTransaction(&wire.MsgTx{LockTime: uint32(i)})
+		}
+		b := block.NewBlock(msgBlock)
+		sm.peerStates[local].requestedBlocks[*b.Hash()] = struct{}{}
+		sm.handleBlockMsg(0, &blockMsg{block: b, peer: local})
+		over := txs > 2
+		if (len(chain.flags) == 0) != over || (len(banned) == 1) != over {
+			t.Fatalf("block of %d transactions processed %d times and its peer banned for %v", txs, len(chain.flags), banned)
+		}
+		if _, requested := sm.peerStates[local].requestedBlocks[*b.Hash()]; requested {
+			t.Fatalf("block of %d transactions still requested", txs)
+		}
+		local.Disconnect()
+		remote.Disconnect()
+	}
+}
+
+// relayNotifier is a PeerNotifier that records the inventory relayed to peers.
+type relayNotifier struct {
+	mtx     sync.Mutex
+	relayed []*wire.InvVect
+}
+
+func (n *relayNotifier) AnnounceNewTransactions([]*mempool.TxDesc)               {}
+func (n *relayNotifier) UpdatePeerHeights(*chainhash.Hash, int32, *peerpkg.Peer) {}
+func (n *relayNotifier) RelayInventory(iv *wire.InvVect, _ interface{}) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.relayed = append(n.relayed, iv)
+}
+func (n *relayNotifier) TransactionConfirmed(*util.Tx)                           {}
+
+// currentChain is a mockChain that is current.
+type currentChain struct {
+	mockChain
+}
+
+func (c *currentChain) IsCurrent() bool { return true }
+
+// TestRelayBlock checks that a block is relayed once whether it is accepted by the chain or relayed as a locally
+// created block first, that blocks are relayed on request while the chain isn't current, and that a block accepted
+// outside the blockHandler thread while it relays the block is still relayed once.
+func TestRelayBlock(t *testing.T) {
+	notifier := &relayNotifier{}
+	chain := &currentChain{mockChain{best: blockchain.BestState{Hash: *chaincfg.SimNetParams.GenesisHash}}}
+	sm := newSyncManager(
+		&Config{PeerNotifier: notifier, ChainParams: &chaincfg.SimNetParams, DisableCheckpoints: true, MaxPeers: 8},
+		chain, mockTxPool{},
+	)
+	accepted := block.NewBlock(&wire.Block{Header: wire.BlockHeader{Nonce: 1}})
+	sm.handleBlockchainNotification(&blockchain.Notification{Type: blockchain.NTBlockAccepted, Data: accepted})
+	sm.processMessage(0, relayBlockMsg{block: accepted})
+	if len(notifier.relayed) != 1 || notifier.relayed[0].Hash != *accepted.Hash() {
+		t.Fatalf("relayed %v, want only block %v", notifier.relayed, accepted.Hash())
+	}
+	sm.chain = &mockChain{best: chain.best}
+	mined := block.NewBlock(&wire.Block{Header: wire.BlockHeader{Nonce: 2}})
+	sm.processMessage(0, relayBlockMsg{block: mined})
+	sm.handleBlockchainNotification(&blockchain.Notification{Type: blockchain.NTBlockAccepted, Data: mined})
+	if len(notifier.relayed) != 2 || notifier.relayed[1].Hash != *mined.Hash() {
+		t.Fatalf("relayed %v, want block %v relayed once after %v", notifier.relayed, mined.Hash(), accepted.Hash())
+	}
+	sm.chain = chain
+	submitted := block.NewBlock(&wire.Block{Header: wire.BlockHeader{Nonce: 3}})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			sm.handleBlockchainNotification(&blockchain.Notification{Type: blockchain.NTBlockAccepted, Data: submitted})
+		}()
+		go func() {
+			defer wg.Done()
+			sm.processMessage(0, relayBlockMsg{block: submitted})
+		}()
+	}
+	wg.Wait()
+	if len(notifier.relayed) != 3 || notifier.relayed[2].Hash != *submitted.Hash() {
+		t.Fatalf("relayed %v, want block %v relayed once", notifier.relayed, submitted.Hash())
+	}
+}
+
+// TestSwitchSyncPeer checks that switching the sync peer picks the other candidate while keeping the old one
+// connected, and keeps the sync peer when there is no other candidate.
+func TestSwitchSyncPeer(t *testing.T) {
+	chain := &mockChain{best: blockchain.BestState{Hash: *chaincfg.SimNetParams.GenesisHash}}
+	sm := newSyncManager(
+		&Config{ChainParams: &chaincfg.SimNetParams, DisableCheckpoints: true, MaxPeers: 8},
+		chain, mockTxPool{},
+	)
+	first, firstRemote, firstReceived := connectPeers(t, 10)
+	second, secondRemote, secondReceived := connectPeers(t, 10)
+	defer func() {
+		for _, p := range []*peerpkg.Peer{first, firstRemote, second, secondRemote} {
+			p.Disconnect()
+		}
+	}()
+	sm.processMessage(0, &newPeerMsg{peer: first})
+	if _, ok := expectMessage(t, firstReceived).(*wire.MsgGetBlocks); !ok {
+		t.Fatal("expected getblocks from the first sync peer")
+	}
+	// With no other candidate the sync peer is kept.
+	if sm.switchSyncPeer() {
+		t.Fatal("switched sync peer without another candidate")
+	}
+	if sm.syncPeer != first {
+		t.Fatalf("sync peer is %v, want %v", sm.syncPeer, first)
+	}
+	// Each switch picks the candidate that isn't the sync peer, and a peer that wasn't asked for these blocks yet is
+	// asked for them.
+	sm.processMessage(0, &newPeerMsg{peer: second})
+	for _, want := range []*peerpkg.Peer{second, first} {
+		if !sm.switchSyncPeer() {
+			t.Fatal("no sync peer was switched to")
+		}
+		if sm.syncPeer != want {
+			t.Fatalf("sync peer is %v, want %v", sm.syncPeer, want)
+		}
+		if want == second {
+			if _, ok := expectMessage(t, secondReceived).(*wire.MsgGetBlocks); !ok {
+				t.Fatal("expected getblocks from the new sync peer")
+			}
+		}
+	}
+	if !second.Connected() || len(sm.peerStates) != 2 {
+		t.Fatal("the old sync peer should stay connected")
+	}
+}
+
+// TestSwitchSyncPeerInflightBlocks checks that the blocks in flight from the old sync peer when the sync peer is
+// switched mid-download are requested from the new one, other than those that arrived meanwhile.
+func TestSwitchSyncPeerInflightBlocks(t *testing.T) {
+	chain := &mockChain{best: blockchain.BestState{Hash: *chaincfg.SimNetParams.GenesisHash}}
+	sm := newSyncManager(
+		&Config{ChainParams: &chaincfg.SimNetParams, DisableCheckpoints: true, MaxPeers: 8},
+		chain, mockTxPool{},
+	)
+	first, firstRemote, firstReceived := connectPeers(t, 10)
+	second, secondRemote, secondReceived := connectPeers(t, 10)
+	defer func() {
+		for _, p := range []*peerpkg.Peer{first, firstRemote, second, secondRemote} {
+			p.Disconnect()
+		}
+	}()
+	sm.processMessage(0, &newPeerMsg{peer: first})
+	if _, ok := expectMessage(t, firstReceived).(*wire.MsgGetBlocks); !ok {
+		t.Fatal("expected getblocks from the first sync peer")
+	}
+	// The first sync peer is asked for some blocks, and the last of them is connected before the switch.
+	inflight := []chainhash.Hash{{1}, {2}, {3}}
+	inv := wire.NewMsgInv()
+	for i := range inflight {
+		if e := inv.AddInvVect(wire.NewInvVect(wire.InvTypeBlock, &inflight[i])); e != nil {
+			t.Fatal(e)
+		}
+	}
+	sm.processMessage(0, &invMsg{inv: inv, peer: first})
+	if getData, ok := expectMessage(t, firstReceived).(*wire.MsgGetData); !ok || len(getData.InvList) != 3 {
+		t.Fatal("expected getdata for the blocks from the first sync peer")
+	}
+	chain.best.Hash = inflight[2]
+	sm.processMessage(0, &newPeerMsg{peer: second})
+	if !sm.switchSyncPeer() || sm.syncPeer != second {
+		t.Fatalf("sync peer is %v, want %v", sm.syncPeer, second)
+	}
+	if _, ok := expectMessage(t, secondReceived).(*wire.MsgGetBlocks); !ok {
+		t.Fatal("expected getblocks from the new sync peer")
+	}
+	getData, ok := expectMessage(t, secondReceived).(*wire.MsgGetData)
+	if !ok {
+		t.Fatal("expected getdata for the blocks in flight from the new sync peer")
+	}
+	requested := make(map[chainhash.Hash]struct{})
+	for _, iv := range getData.InvList {
+		requested[iv.Hash] = struct{}{}
+	}
+	if len(requested) != 2 {
+		t.Fatalf("requested %d blocks from the new sync peer, want 2", len(requested))
+	}
+	for _, hash := range inflight[:2] {
+		if _, ok := requested[hash]; !ok {
+			t.Fatalf("block %v in flight was not requested from the new sync peer", hash)
+		}
+		if _, ok := sm.peerStates[second].requestedBlocks[hash]; !ok {
+			t.Fatalf("block %v is not recorded as requested from the new sync peer", hash)
+		}
+	}
+	if !first.Connected() {
+		t.Fatal("the old sync peer should stay connected")
+	}
+}
+
+// TestDonePeerInflightBlocks checks that the blocks in flight from a sync peer that disconnects are requested from the
+// new sync peer, in more than one getdata message when they don't fit in one.
+func TestDonePeerInflightBlocks(t *testing.T) {
+	chain := &mockChain{best: blockchain.BestState{Hash: *chaincfg.SimNetParams.GenesisHash}}
+	sm := newSyncManager(
+		&Config{ChainParams: &chaincfg.SimNetParams, DisableCheckpoints: true, MaxPeers: 8},
+		chain, mockTxPool{},
+	)
+	first, firstRemote, firstReceived := connectPeers(t, 10)
+	second, secondRemote, secondReceived := connectPeers(t, 10)
+	defer func() {
+		for _, p := range []*peerpkg.Peer{first, firstRemote, second, secondRemote} {
+			p.Disconnect()
+		}
+	}()
+	sm.processMessage(0, &newPeerMsg{peer: first})
+	if _, ok := expectMessage(t, firstReceived).(*wire.MsgGetBlocks); !ok {
+		t.Fatal("expected getblocks from the first sync peer")
+	}
+	sm.processMessage(0, &newPeerMsg{peer: second})
+	// More blocks are in flight from the sync peer than fit in one getdata message.
+	for i := 0; i <= wire.MaxInvPerMsg; i++ {
+		var hash chainhash.Hash
+		hash[0], hash[1], hash[2] = byte(i), byte(i>>8), byte(i>>16)
+		sm.requestedBlocks[hash] = struct{}{}
+		sm.peerStates[first].requestedBlocks[hash] = struct{}{}
+	}
+	sm.processMessage(0, &donePeerMsg{peer: first})
+	if sm.syncPeer != second {
+		t.Fatalf("sync peer is %v, want %v", sm.syncPeer, second)
+	}
+	if _, ok := expectMessage(t, secondReceived).(*wire.MsgGetBlocks); !ok {
+		t.Fatal("expected getblocks from the new sync peer")
+	}
+	requested := make(map[chainhash.Hash]struct{})
+	for _, want := range []int{wire.MaxInvPerMsg, 1} {
+		getData, ok := expectMessage(t, secondReceived).(*wire.MsgGetData)
+		if !ok || len(getData.InvList) != want {
+			t.Fatalf("expected getdata for %d blocks in flight from the new sync peer", want)
+		}
+		for _, iv := range getData.InvList {
+			requested[iv.Hash] = struct{}{}
+		}
+	}
+	if len(requested) != wire.MaxInvPerMsg+1 || len(sm.peerStates[second].requestedBlocks) != wire.MaxInvPerMsg+1 {
+		t.Fatalf("requested %d blocks from the new sync peer, want %d", len(requested), wire.MaxInvPerMsg+1)
+	}
+}
+
+// TestBlockProcessTimes checks that blocks are only timed when block process times are recorded, and that each time is
+// counted in the bucket of its bound.
+func TestBlockProcessTimes(t *testing.T) {
+	for _, record := range []bool{false, true} {
+		sm := newSyncManager(
+			&Config{
+				ChainParams: &chaincfg.SimNetParams, DisableCheckpoints: true, MaxPeers: 8,
+				RecordBlockProcessTimes: record,
+			},
+			&mockChain{best: blockchain.BestState{Hash: *chaincfg.SimNetParams.GenesisHash}}, mockTxPool{},
+		)
+		reply := make(chan processBlockResponse, 1)
+		sm.processMessage(0, processBlockMsg{block: block.NewBlock(&wire.Block{}), reply: reply})
+		<-reply
+		times := make(chan BlockProcessTimes, 1)
+		sm.processMessage(0, getBlockTimesMsg{reply: times})
+		got := <-times
+		if record && (got.Count != 1 || len(got.Buckets) != len(BlockProcessTimeBuckets)+1) {
+			t.Fatalf("recorded %d blocks in %d buckets, want 1", got.Count, len(got.Buckets))
+		}
+		if !record && (got.Count != 0 || got.Buckets != nil) {
+			t.Fatalf("recorded %d blocks in %v without recording block process times", got.Count, got.Buckets)
+		}
+	}
+	times := newBlockProcessTimes()
+	for _, d := range []time.Duration{0, time.Millisecond * 5, time.Millisecond * 10, time.Minute} {
+		times.add(d)
+	}
+	want := []uint64{1, 1, 1, 0, 0, 1}
+	for i := range want {
+		if times.Buckets[i] != want[i] {
+			t.Fatalf("got buckets %v, want %v", times.Buckets, want)
+		}
+	}
+	if times.Max != time.Minute || times.Mean() != (time.Minute+time.Millisecond*15)/4 {
+		t.Fatalf("got max %v and mean %v", times.Max, times.Mean())
+	}
+}
@@ -142,6 +142,10 @@ type MessageListeners struct {
 	// OnSendHeaders is invoked when a peer receives a sendheaders bitcoin
 	// message.
 	OnSendHeaders func(p *Peer, msg *wire.MsgSendHeaders)
+	// OnUnknownMessage is invoked when a peer receives a message with a command the wire package doesn't support,
+	// including one whose payload is over wire.MaxUnknownPayload and was discarded. When it is nil such a message can't
+	// be read, and the peer is disconnected.
+	OnUnknownMessage func(p *Peer, msg *wire.MsgUnknown)
 	// OnRead is invoked when a peer receives a bitcoin message.
 	//
 	// It consists of the number of bytes read, the message, and whether or not an error in the read occurred.
@@ -429,6 +433,13 @@ func (p *Peer) AddKnownInventory(invVect *wire.InvVect) {
 	p.knownInventory.Add(invVect)
 }
 
+// IsKnownInventory returns true if the passed inventory is in the cache of known inventory for the peer.
+//
+// This function is safe for concurrent access.
+func (p *Peer) IsKnownInventory(invVect *wire.InvVect) bool {
+	return p.knownInventory.Exists(invVect)
+}
+
 // StatsSnapshot returns a snapshot of the current peer flags and statistics.
 //
 // This function is safe for concurrent access.
@@ -866,7 +877,11 @@ func (p *Peer) handlePongMsg(msg *wire.MsgPong) {
 
 // readMessage reads the next bitcoin message from the peer with logging.
 func (p *Peer) readMessage(encoding wire.MessageEncoding) (wire.Message, []byte, error) {
-	n, msg, buf, e := wire.ReadMessageWithEncodingN(
+	read := wire.ReadMessageWithEncodingN
+	if p.cfg.Listeners.OnUnknownMessage != nil {
+		read = wire.ReadMessageWithUnknownN
+	}
+	n, msg, buf, e := read(
 		p.conn,
 		p.ProtocolVersion(), p.cfg.ChainParams.Net, encoding,
 	)
@@ -1353,6 +1368,10 @@ out:
 			if p.cfg.Listeners.OnSendHeaders != nil {
 				p.cfg.Listeners.OnSendHeaders(p, msg)
 			}
+		case *wire.MsgUnknown:
+			if p.cfg.Listeners.OnUnknownMessage != nil {
+				p.cfg.Listeners.OnUnknownMessage(p, msg)
+			}
 		default:
 			D.F(
 				"Received unhandled message of type %v from %v %s",
@@ -93,22 +93,22 @@ func (w *Wallet) handleChainNotifications() {
 					go sync(w)
 				}
 			case chainclient.BlockConnected:
-				e = walletdb.Update(
-					w.db, func(tx walletdb.ReadWriteTx) (e error) {
+				e = w.updateTxStore(
+					func(tx walletdb.ReadWriteTx) (e error) {
 						return w.connectBlock(tx, tm.BlockMeta(n))
 					},
 				)
 				notificationName = "blockconnected"
 			case chainclient.BlockDisconnected:
-				e = walletdb.Update(
-					w.db, func(tx walletdb.ReadWriteTx) (e error) {
+				e = w.updateTxStore(
+					func(tx walletdb.ReadWriteTx) (e error) {
 						return w.disconnectBlock(tx, tm.BlockMeta(n))
 					},
 				)
 				notificationName = "blockdisconnected"
 			case chainclient.RelevantTx:
-				e = walletdb.Update(
-					w.db, func(tx walletdb.ReadWriteTx) (e error) {
+				e = w.updateTxStore(
+					func(tx walletdb.ReadWriteTx) (e error) {
 						return w.addRelevantTx(tx, n.TxRecord, n.Block)
 					},
 				)
@@ -116,8 +116,8 @@ func (w *Wallet) handleChainNotifications() {
 			case chainclient.FilteredBlockConnected:
 				// Atomically update for the whole block.
 				if len(n.RelevantTxs) > 0 {
-					e = walletdb.Update(
-						w.db, func(
+					e = w.updateTxStore(
+						func(
 							tx walletdb.ReadWriteTx,
 						) (e error) {
 							for _, rec := range n.RelevantTxs {
@@ -194,6 +194,30 @@ func (w *Wallet) connectBlock(dbtx walletdb.ReadWriteTx, b tm.BlockMeta) (e erro
 	return nil
 }
 
+// updateTxStore runs f in a database transaction that may write to the transaction store, and has the store notify
+// the changes of its credit totals once the transaction is committed, or forget them if it was rolled back.
+func (w *Wallet) updateTxStore(f func(tx walletdb.ReadWriteTx) error) (e error) {
+	if e = walletdb.Update(w.db, f); e != nil {
+		w.TxStore.BalanceChangesRolledBack()
+		return e
+	}
+	w.balanceChangesCommitted()
+	return nil
+}
+
+// balanceChangesCommitted has the transaction store notify the changes of its credit totals made by a committed
+// database transaction.
+func (w *Wallet) balanceChangesCommitted() {
+	e := walletdb.View(
+		w.db, func(tx walletdb.ReadTx) error {
+			return w.TxStore.BalanceChangesCommitted(tx.ReadBucket(wtxmgrNamespaceKey))
+		},
+	)
+	if e != nil {
+		E.Ln("failed to notify balance changes:", e)
+	}
+}
+
 // disconnectBlock handles a chain server reorganize by rolling back all block history from the reorged block for a
 // wallet in-sync with the chain server.
 func (w *Wallet) disconnectBlock(dbtx walletdb.ReadWriteTx, b tm.BlockMeta) (e error) {
@@ -406,6 +406,7 @@ func (w *Wallet) syncWithChain() (e error) {
 				e := tx.Rollback()
 				if e != nil {
 				}
+				w.TxStore.BalanceChangesRolledBack()
 				return e
 			}
 			// If we're using the Neutrino backend, we can check if it's current or not. For other backends we'll assume
@@ -427,6 +428,7 @@ func (w *Wallet) syncWithChain() (e error) {
 					e := tx.Rollback()
 					if e != nil {
 					}
+					w.TxStore.BalanceChangesRolledBack()
 					return e
 				}
 			}
@@ -469,6 +471,7 @@ func (w *Wallet) syncWithChain() (e error) {
 				e := tx.Rollback()
 				if e != nil {
 				}
+				w.TxStore.BalanceChangesRolledBack()
 				return e
 			}
 			// If we are in recovery mode, attempt a recovery on blocks that have been added to the recovery manager's
@@ -483,6 +486,7 @@ func (w *Wallet) syncWithChain() (e error) {
 					e := tx.Rollback()
 					if e != nil {
 					}
+					w.TxStore.BalanceChangesRolledBack()
 					return e
 				}
 				// Clear the batch of all processed blocks.
@@ -495,8 +499,10 @@ func (w *Wallet) syncWithChain() (e error) {
 					e := tx.Rollback()
 					if e != nil {
 					}
+					w.TxStore.BalanceChangesRolledBack()
 					return e
 				}
+				w.balanceChangesCommitted()
 				I.Ln(
 					"caught up to height", height,
 				)
@@ -518,6 +524,7 @@ func (w *Wallet) syncWithChain() (e error) {
 				e := tx.Rollback()
 				if e != nil {
 				}
+				w.TxStore.BalanceChangesRolledBack()
 				return e
 			}
 		}
@@ -527,8 +534,10 @@ func (w *Wallet) syncWithChain() (e error) {
 			e := tx.Rollback()
 			if e != nil {
 			}
+			w.TxStore.BalanceChangesRolledBack()
 			return e
 		}
+		w.balanceChangesCommitted()
 		I.Ln("done catching up block hashes")
 		// Since we've spent some time catching up block hashes, we might have new addresses waiting for us that were
 		// requested during initial sync. Make sure we have those before we request a rescan later on.
@@ -546,8 +555,8 @@ func (w *Wallet) syncWithChain() (e error) {
 	// the missing blocks before catching up with the rescan.
 	rollback := false
 	rollbackStamp := w.Manager.SyncedTo()
-	e = walletdb.Update(
-		w.db, func(tx walletdb.ReadWriteTx) (e error) {
+	e = w.updateTxStore(
+		func(tx walletdb.ReadWriteTx) (e error) {
 			addrmgrNs := tx.ReadWriteBucket(waddrmgrNamespaceKey)
 			txmgrNs := tx.ReadWriteBucket(wtxmgrNamespaceKey)
 			for height := rollbackStamp.Height; true; height-- {
@@ -2589,8 +2598,8 @@ func (w *Wallet) resendUnminedTxs() {
 			// we'll keep attempting to rebroadcast this, and we may be computing our balance incorrectly if this tx
 			// credits or debits to us.
 			tt := tx
-			e := walletdb.Update(
-				w.db, func(dbTx walletdb.ReadWriteTx) (e error) {
+			e := w.updateTxStore(
+				func(dbTx walletdb.ReadWriteTx) (e error) {
 					txmgrNs := dbTx.ReadWriteBucket(wtxmgrNamespaceKey)
 					txRec, e := wtxmgr.NewTxRecordFromMsgTx(
 						tt, time.Now(),
@@ -3090,8 +3099,8 @@ func (w *Wallet) publishTransaction(tx *wire.MsgTx) (*chainhash.Hash, error) {
 	if e != nil {
 		return nil, e
 	}
-	e = walletdb.Update(
-		w.db, func(dbTx walletdb.ReadWriteTx) (e error) {
+	e = w.updateTxStore(
+		func(dbTx walletdb.ReadWriteTx) (e error) {
 			return w.addRelevantTx(dbTx, txRec, nil)
 		},
 	)
@@ -3117,8 +3126,8 @@ func (w *Wallet) publishTransaction(tx *wire.MsgTx) (*chainhash.Hash, error) {
 	case strings.Contains(e.Error(), "already in block chain"):
 		// If the transaction was rejected, then we'll remove it from the txstore, as otherwise, we'll attempt to
 		// continually re-broadcast it, and the utxo state of the wallet won't be accurate.
-		dbErr := walletdb.Update(
-			w.db, func(dbTx walletdb.ReadWriteTx) (e error) {
+		dbErr := w.updateTxStore(
+			func(dbTx walletdb.ReadWriteTx) (e error) {
 				txmgrNs := dbTx.ReadWriteBucket(wtxmgrNamespaceKey)
 				return w.TxStore.RemoveUnminedTx(txmgrNs, txRec)
 			},
@@ -287,6 +287,23 @@ func WriteMessageWithEncodingN(
 // message encoding is to to consult when decoding wire messages.
 func ReadMessageWithEncodingN(r io.Reader, pver uint32, btcnet BitcoinNet, enc MessageEncoding) (
 	totalBytes int, msg Message, payload []byte, e error,
+) {
+	return readMessageN(r, pver, btcnet, enc, false)
+}
+
+// ReadMessageWithUnknownN is the same as ReadMessageWithEncodingN except a message with a command that isn't supported
+// is returned as a MsgUnknown holding its payload, once its checksum is verified, rather than being skipped with an
+// error.
+func ReadMessageWithUnknownN(r io.Reader, pver uint32, btcnet BitcoinNet, enc MessageEncoding) (
+	totalBytes int, msg Message, payload []byte, e error,
+) {
+	return readMessageN(r, pver, btcnet, enc, true)
+}
+
+// readMessageN reads the next message from r, returning messages with unsupported commands as a MsgUnknown when
+// unknown is set.
+func readMessageN(r io.Reader, pver uint32, btcnet BitcoinNet, enc MessageEncoding, unknown bool) (
+	totalBytes int, msg Message, payload []byte, e error,
 ) {
 	var hdr *messageHeader
 	var n int
@@ -325,7 +342,9 @@ func ReadMessageWithEncodingN(r io.Reader, pver uint32, btcnet BitcoinNet, enc M
 		return totalBytes, nil, nil, messageError("ReadMessage", str)
 	}
 	// Create struct of appropriate message type based on the command.
-	if msg, e = makeEmptyMessage(command); E.Chk(e) {
+	if msg, e = makeEmptyMessage(command); e != nil && unknown {
+		msg, e = &MsgUnknown{Cmd: command, Length: hdr.length}, nil
+	} else if E.Chk(e) {
 		discardInput(r, hdr.length)
 		return totalBytes, nil, nil, messageError(
 			"ReadMessage",
@@ -337,6 +356,11 @@ func ReadMessageWithEncodingN(r io.Reader, pver uint32, btcnet BitcoinNet, enc M
 	mpl := msg.MaxPayloadLength(pver)
 	if hdr.length > mpl {
 		discardInput(r, hdr.length)
+		// A message with an unsupported command is still returned, without its payload, so that a peer sending one too
+		// long can be told from one sending malformed messages.
+		if msg, ok := msg.(*MsgUnknown); ok {
+			return totalBytes + int(hdr.length), msg, nil, nil
+		}
 		str := fmt.Sprintf(
 			"payload exceeds max length - header "+
 				"indicates %v bytes, but max payload size for "+
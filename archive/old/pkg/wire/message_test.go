@@ -432,3 +432,50 @@ func TestWriteMessageWireErrors(t *testing.T) {
 		}
 	}
 }
+
+// TestReadMessageWithUnknown checks that a message with an unsupported command is only read as a MsgUnknown holding
+// its payload by ReadMessageWithUnknownN, and that its checksum is still verified.
+func TestReadMessageWithUnknown(t *testing.T) {
+	pver := ProtocolVersion
+	btcnet := MainNet
+	payload := []byte{0x01, 0x02, 0x03, 0x04}
+	var buf bytes.Buffer
+	if _, e := WriteMessageN(&buf, &fakeMessage{command: "bogus", payload: payload}, pver, btcnet); e != nil {
+		t.Fatal(e)
+	}
+	msgBytes := buf.Bytes()
+	n, msg, _, e := ReadMessageWithUnknownN(bytes.NewReader(msgBytes), pver, btcnet, BaseEncoding)
+	if e != nil {
+		t.Fatal(e)
+	}
+	unknown, ok := msg.(*MsgUnknown)
+	if !ok || unknown.Command() != "bogus" || !bytes.Equal(unknown.Payload, payload) || n != len(msgBytes) {
+		t.Fatalf("read %d bytes as %v, want %d bytes as an unknown bogus message with payload %x",
+			n, spew.Sdump(msg), len(msgBytes), payload)
+	}
+	if _, _, _, e = ReadMessageWithEncodingN(bytes.NewReader(msgBytes), pver, btcnet, BaseEncoding); e == nil {
+		t.Fatal("expected an error reading an unsupported command without unknown messages")
+	}
+	badChecksum := append([]byte(nil), msgBytes...)
+	badChecksum[len(badChecksum)-1] ^= 0xff
+	if _, _, _, e = ReadMessageWithUnknownN(bytes.NewReader(badChecksum), pver, btcnet, BaseEncoding); e == nil {
+		t.Fatal("expected an error reading an unknown message with a bad checksum")
+	}
+	buf.Reset()
+	oversized := &fakeMessage{command: "bogus", payload: make([]byte, MaxUnknownPayload+1)}
+	if _, e = WriteMessageN(&buf, oversized, pver, btcnet); e != nil {
+		t.Fatal(e)
+	}
+	buf.WriteString("next")
+	r := bytes.NewReader(buf.Bytes())
+	if n, msg, _, e = ReadMessageWithUnknownN(r, pver, btcnet, BaseEncoding); e != nil {
+		t.Fatal(e)
+	}
+	unknown, ok = msg.(*MsgUnknown)
+	if !ok || !unknown.Oversized() || unknown.Payload != nil || n != buf.Len()-len("next") {
+		t.Fatalf("read %d bytes of an oversized unknown message as %v", n, spew.Sdump(msg))
+	}
+	if r.Len() != len("next") {
+		t.Fatalf("%d bytes left after an oversized unknown message, want %d", r.Len(), len("next"))
+	}
+}
@@ -0,0 +1,51 @@
+package wire
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// MaxUnknownPayload is the largest payload of a message with an unsupported command that is read. The payloads of
+// longer ones are discarded unread, as there is no telling what they hold.
+const MaxUnknownPayload = 1024 * 32 // 32k
+
+// MsgUnknown implements the Message interface and holds a message with a command this package doesn't support, as it
+// was received. It is only returned by ReadMessageWithUnknownN, so that callers can observe messages they don't
+// understand rather than failing to read them.
+type MsgUnknown struct {
+	Cmd     string
+	Payload []byte
+	// Length is the payload length given by the message header. When it is over MaxUnknownPayload the payload was
+	// discarded and Payload is nil.
+	Length uint32
+}
+
+// Oversized returns whether the payload of the message was over MaxUnknownPayload and discarded.
+func (msg *MsgUnknown) Oversized() bool {
+	return msg.Length > MaxUnknownPayload
+}
+
+// BtcDecode decodes r using the bitcoin protocol encoding into the receiver. This is part of the Message interface
+// implementation.
+func (msg *MsgUnknown) BtcDecode(r io.Reader, pver uint32, enc MessageEncoding) (e error) {
+	msg.Payload, e = ioutil.ReadAll(r)
+	return
+}
+
+// BtcEncode encodes the receiver to w using the bitcoin protocol encoding. This is part of the Message interface
+// implementation.
+func (msg *MsgUnknown) BtcEncode(w io.Writer, pver uint32, enc MessageEncoding) (e error) {
+	_, e = w.Write(msg.Payload)
+	return
+}
+
+// Command returns the protocol command string for the message. This is part of the Message interface implementation.
+func (msg *MsgUnknown) Command() string {
+	return msg.Cmd
+}
+
+// MaxPayloadLength returns the maximum length the payload can be for the receiver. This is part of the Message
+// interface implementation.
+func (msg *MsgUnknown) MaxPayloadLength(pver uint32) uint32 {
+	return MaxUnknownPayload
+}
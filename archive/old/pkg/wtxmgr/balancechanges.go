@@ -0,0 +1,90 @@
+package wtxmgr
+
+import (
+	"sync"
+	
+	"github.com/p9c/pod/pkg/amt"
+	"github.com/p9c/pod/pkg/walletdb"
+)
+
+// BalanceChange is a change of the credit totals of the store made by a committed database transaction.
+type BalanceChange struct {
+	// Mined is the total of the unspent credits of mined transactions, including immature ones and those spent by
+	// unmined transactions, as the store records it.
+	Mined amt.Amount
+	// Unmined is the total of the credits of unmined transactions.
+	Unmined amt.Amount
+	// MinedDelta and UnminedDelta are the changes of the totals since the last change notified.
+	MinedDelta   amt.Amount
+	UnminedDelta amt.Amount
+}
+
+// balanceTracker holds the credit totals last notified, and whether the store was written to since.
+type balanceTracker struct {
+	mtx            sync.Mutex
+	changed        bool
+	mined, unmined amt.Amount
+}
+
+// balanceChanged marks that the credit totals may have been changed by the database transaction in progress.
+func (s *Store) balanceChanged() {
+	s.balances.mtx.Lock()
+	s.balances.changed = true
+	s.balances.mtx.Unlock()
+}
+
+// BalanceChangesCommitted must be called with the namespace of a new database transaction after a transaction that
+// wrote to the store was committed. If the credit totals changed, NotifyBalanceChange is called with them and their
+// changes, so that the totals are only notified once their changes can't be rolled back.
+func (s *Store) BalanceChangesCommitted(ns walletdb.ReadBucket) (e error) {
+	s.balances.mtx.Lock()
+	if !s.balances.changed {
+		s.balances.mtx.Unlock()
+		return nil
+	}
+	var mined, unmined amt.Amount
+	if mined, unmined, e = balanceTotals(ns); E.Chk(e) {
+		s.balances.mtx.Unlock()
+		return e
+	}
+	change := BalanceChange{
+		Mined:        mined,
+		Unmined:      unmined,
+		MinedDelta:   mined - s.balances.mined,
+		UnminedDelta: unmined - s.balances.unmined,
+	}
+	s.balances.changed = false
+	s.balances.mined, s.balances.unmined = mined, unmined
+	s.balances.mtx.Unlock()
+	if (change.MinedDelta != 0 || change.UnminedDelta != 0) && s.NotifyBalanceChange != nil {
+		s.NotifyBalanceChange(change)
+	}
+	return nil
+}
+
+// BalanceChangesRolledBack must be called after a database transaction that wrote to the store was rolled back, so
+// that its changes of the credit totals are never notified.
+func (s *Store) BalanceChangesRolledBack() {
+	s.balances.mtx.Lock()
+	s.balances.changed = false
+	s.balances.mtx.Unlock()
+}
+
+// balanceTotals returns the total of the unspent mined credits recorded as the mined balance, and the total of the
+// unmined credits.
+func balanceTotals(ns walletdb.ReadBucket) (mined, unmined amt.Amount, e error) {
+	if mined, e = fetchMinedBalance(ns); e != nil {
+		return 0, 0, e
+	}
+	e = ns.NestedReadBucket(bucketUnminedCredits).ForEach(
+		func(k, v []byte) (e error) {
+			var amount amt.Amount
+			if amount, e = fetchRawUnminedCreditAmount(v); e != nil {
+				return e
+			}
+			unmined += amount
+			return nil
+		},
+	)
+	return mined, unmined, e
+}
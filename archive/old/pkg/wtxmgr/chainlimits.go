@@ -0,0 +1,196 @@
+package wtxmgr
+
+import (
+	"fmt"
+	
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/walletdb"
+)
+
+// ChainLimits bound the chains of unmined transactions that spend each other's outputs, as the standard mempool
+// policy does, so that pathological chains of dependent transactions can't pile up in the store. Each transaction
+// counts towards its own ancestors and descendants, and a limit of zero isn't enforced, so the zero value applies no
+// limits.
+type ChainLimits struct {
+	// MaxAncestors is the most unmined transactions a transaction and those it depends on can number.
+	MaxAncestors int
+	// MaxAncestorSize is the most serialized bytes a transaction and those it depends on can add up to.
+	MaxAncestorSize int
+	// MaxDescendants is the most unmined transactions a transaction and those depending on it can number.
+	MaxDescendants int
+	// MaxDescendantSize is the most serialized bytes a transaction and those depending on it can add up to.
+	MaxDescendantSize int
+}
+
+// DefaultChainLimits match the default mempool policy of bitcoin nodes, for callers that want to opt in to them with
+// SetChainLimits. A Store is opened without limits, as the pod mempool has none and would otherwise accept, and mine,
+// transactions the store rejects.
+var DefaultChainLimits = ChainLimits{
+	MaxAncestors:      25,
+	MaxAncestorSize:   101000,
+	MaxDescendants:    25,
+	MaxDescendantSize: 101000,
+}
+
+// SetChainLimits changes the limits on chains of unmined transactions that are applied when unmined transactions are
+// inserted and when a rollback moves transactions back to the unmined set.
+func (s *Store) SetChainLimits(limits ChainLimits) {
+	s.chainLimits = limits
+}
+
+// enabled returns whether any of the limits are enforced.
+func (l ChainLimits) enabled() bool {
+	return l.MaxAncestors > 0 || l.MaxAncestorSize > 0 || l.MaxDescendants > 0 || l.MaxDescendantSize > 0
+}
+
+// chainEntry is an unmined transaction in a chainTracker.
+type chainEntry struct {
+	size           int
+	ancestors      map[chainhash.Hash]struct{}
+	descendants    int
+	descendantSize int
+}
+
+// chainTracker tracks the ancestors and descendants of the unmined transactions added to it, which must be added in
+// dependency order.
+type chainTracker struct {
+	limits  ChainLimits
+	entries map[chainhash.Hash]*chainEntry
+}
+
+// newChainTracker returns an empty chainTracker applying the given limits.
+func newChainTracker(limits ChainLimits) *chainTracker {
+	return &chainTracker{limits: limits, entries: make(map[chainhash.Hash]*chainEntry)}
+}
+
+// check returns the entry of a transaction for the tracker, with an error if adding it would exceed the limits.
+func (c *chainTracker) check(rec *TxRecord) (entry *chainEntry, e error) {
+	entry = &chainEntry{size: rec.MsgTx.SerializeSize(), ancestors: make(map[chainhash.Hash]struct{})}
+	entry.descendants, entry.descendantSize = 1, entry.size
+	for _, input := range rec.MsgTx.TxIn {
+		parent, ok := c.entries[input.PreviousOutPoint.Hash]
+		if !ok {
+			continue
+		}
+		entry.ancestors[input.PreviousOutPoint.Hash] = struct{}{}
+		for ancestor := range parent.ancestors {
+			entry.ancestors[ancestor] = struct{}{}
+		}
+	}
+	ancestorSize := entry.size
+	for ancestor := range entry.ancestors {
+		a := c.entries[ancestor]
+		ancestorSize += a.size
+		if c.limits.MaxDescendants > 0 && a.descendants+1 > c.limits.MaxDescendants {
+			return nil, fmt.Errorf("unmined transaction %v would have more than %d descendants", ancestor,
+				c.limits.MaxDescendants)
+		}
+		if c.limits.MaxDescendantSize > 0 && a.descendantSize+entry.size > c.limits.MaxDescendantSize {
+			return nil, fmt.Errorf("unmined transaction %v would have descendants of more than %d bytes",
+				ancestor, c.limits.MaxDescendantSize)
+		}
+	}
+	if c.limits.MaxAncestors > 0 && len(entry.ancestors)+1 > c.limits.MaxAncestors {
+		return nil, fmt.Errorf("transaction %v has more than %d unmined ancestors", rec.Hash,
+			c.limits.MaxAncestors)
+	}
+	if c.limits.MaxAncestorSize > 0 && ancestorSize > c.limits.MaxAncestorSize {
+		return nil, fmt.Errorf("transaction %v has unmined ancestors of more than %d bytes", rec.Hash,
+			c.limits.MaxAncestorSize)
+	}
+	return entry, nil
+}
+
+// add adds a transaction that was checked to the tracker.
+func (c *chainTracker) add(rec *TxRecord, entry *chainEntry) {
+	for ancestor := range entry.ancestors {
+		a := c.entries[ancestor]
+		a.descendants++
+		a.descendantSize += entry.size
+	}
+	c.entries[rec.Hash] = entry
+}
+
+// unminedChains returns a chainTracker holding every unmined transaction in the store, without checking them against
+// the limits.
+func (s *Store) unminedChains(ns walletdb.ReadBucket) (*chainTracker, error) {
+	recSet, e := s.unminedTxRecords(ns)
+	if e != nil {
+		return nil, e
+	}
+	c := newChainTracker(ChainLimits{})
+	for _, rec := range dependencySort(recSet) {
+		entry, _ := c.check(rec)
+		c.add(rec, entry)
+	}
+	c.limits = s.chainLimits
+	return c, nil
+}
+
+// checkChainLimits returns an ErrChainLimit error if inserting an unmined transaction would make a chain of unmined
+// transactions exceed the chain limits.
+func (s *Store) checkChainLimits(ns walletdb.ReadBucket, rec *TxRecord) (e error) {
+	if !s.chainLimits.enabled() {
+		return nil
+	}
+	c, e := s.unminedChains(ns)
+	if e != nil {
+		return e
+	}
+	if _, e = c.check(rec); e != nil {
+		return storeError(ErrChainLimit, "unmined transaction exceeds the chain limits", e)
+	}
+	return nil
+}
+
+// PruneUnminedChains removes the unmined transactions that make a chain of unmined transactions exceed the chain
+// limits, along with every transaction that spends them, and returns the hashes of those removed. Transactions are
+// kept in dependency order until a limit is reached, so it is the latest transactions of a chain that are removed.
+// Rollback calls it after moving the transactions of the blocks rolled back to the unmined set, and reports the
+// transactions removed through NotifyChainLimitDrop.
+func (s *Store) PruneUnminedChains(ns walletdb.ReadWriteBucket) (dropped []chainhash.Hash, e error) {
+	if !s.chainLimits.enabled() {
+		return nil, nil
+	}
+	recSet, e := s.unminedTxRecords(ns)
+	if e != nil {
+		return nil, e
+	}
+	c := newChainTracker(s.chainLimits)
+	removed := make(map[chainhash.Hash]struct{})
+	for _, rec := range dependencySort(recSet) {
+		if _, ok := removed[rec.Hash]; ok {
+			continue
+		}
+		var entry *chainEntry
+		if entry, e = c.check(rec); e == nil {
+			c.add(rec, entry)
+			continue
+		}
+		W.Ln("removing unmined transaction chain:", e)
+		// RemoveConflict removes the spenders of the transaction as well, which are found the same way here so they
+		// are reported and aren't removed twice.
+		spenders := []chainhash.Hash{rec.Hash}
+		for len(spenders) > 0 {
+			hash := spenders[0]
+			spenders = spenders[1:]
+			if _, ok := removed[hash]; ok {
+				continue
+			}
+			removed[hash] = struct{}{}
+			dropped = append(dropped, hash)
+			for i := range recSet[hash].MsgTx.TxOut {
+				k := canonicalOutPoint(&hash, uint32(i))
+				for _, spender := range fetchUnminedInputSpendTxHashes(ns, k) {
+					if _, ok := recSet[spender]; ok {
+						spenders = append(spenders, spender)
+					}
+				}
+			}
+		}
+		if e = RemoveConflict(ns, rec); E.Chk(e) {
+			return nil, e
+		}
+	}
+	return dropped, nil
+}
@@ -0,0 +1,42 @@
+package wtxmgr
+
+import (
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressTxRecords controls whether the serialized transactions of newly written mined and unmined transaction
+// records are compressed. Records are flagged individually, so records written with either setting can always be read.
+var CompressTxRecords = true
+
+// txRecordCompressed is set in the received time field of a transaction record value when the serialized transaction
+// that follows it is zstd compressed. Received times are stored as unsigned unix seconds and never use the top bit, so
+// records written before compression was supported are never mistaken for compressed ones.
+const txRecordCompressed = 1 << 63
+
+// minCompressTxSize is the size below which serialized transactions are stored as is since they rarely shrink.
+const minCompressTxSize = 512
+
+var (
+	// txEncoder and txDecoder are shared by all stores. Their EncodeAll and DecodeAll methods are safe for concurrent
+	// use.
+	txEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	txDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+)
+
+// compressTx returns the compressed form of a serialized transaction, and whether it is worth storing compressed.
+// Small transactions rarely shrink, in which case they are stored as is.
+func compressTx(serializedTx []byte) ([]byte, bool) {
+	if !CompressTxRecords || len(serializedTx) < minCompressTxSize {
+		return nil, false
+	}
+	compressed := txEncoder.EncodeAll(serializedTx, nil)
+	if len(compressed) >= len(serializedTx) {
+		return nil, false
+	}
+	return compressed, true
+}
+
+// decompressTx returns the serialized transaction held in a compressed transaction record.
+func decompressTx(compressed []byte) ([]byte, error) {
+	return txDecoder.DecodeAll(compressed, nil)
+}
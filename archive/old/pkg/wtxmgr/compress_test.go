@@ -0,0 +1,126 @@
+package wtxmgr
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+	
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// makeTestTx returns a transaction shaped like a typical wallet pay to pubkey hash spend. Signatures, hashes and
+// amounts are random, while the inputs spend outputs of a handful of the wallet's keys as wallets commonly do.
+func makeTestTx(numInputs, numOutputs int) *wire.MsgTx {
+	r := rand.New(rand.NewSource(int64(numInputs*1000 + numOutputs)))
+	pubKeys := make([][]byte, 3)
+	for i := range pubKeys {
+		pubKeys[i] = make([]byte, 33)
+		r.Read(pubKeys[i])
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	for i := 0; i < numInputs; i++ {
+		var prev chainhash.Hash
+		r.Read(prev[:])
+		// OP_DATA_72 <signature> OP_DATA_33 <compressed pubkey>
+		sigScript := make([]byte, 107)
+		r.Read(sigScript[1:73])
+		sigScript[0], sigScript[73] = 72, 33
+		copy(sigScript[74:], pubKeys[i%len(pubKeys)])
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prev, uint32(i%4)), sigScript, nil))
+	}
+	for i := 0; i < numOutputs; i++ {
+		// OP_DUP OP_HASH160 OP_DATA_20 <pubkey hash> OP_EQUALVERIFY OP_CHECKSIG
+		pkScript := make([]byte, 25)
+		r.Read(pkScript)
+		copy(pkScript[:3], []byte{0x76, 0xa9, 0x14})
+		copy(pkScript[23:], []byte{0x88, 0xac})
+		tx.AddTxOut(wire.NewTxOut(int64(r.Intn(1e8)), pkScript))
+	}
+	return tx
+}
+
+func testTxRecord(t testing.TB, tx *wire.MsgTx) *TxRecord {
+	var buf bytes.Buffer
+	if e := tx.Serialize(&buf); e != nil {
+		t.Fatal(e)
+	}
+	rec, e := NewTxRecord(buf.Bytes(), time.Unix(1600000000, 0))
+	if e != nil {
+		t.Fatal(e)
+	}
+	return rec
+}
+
+// TestTxRecordCompression ensures transaction records round trip with and without compression, and that records
+// written before compression was supported still decode.
+func TestTxRecordCompression(t *testing.T) {
+	defer func(compress bool) {
+		CompressTxRecords = compress
+	}(CompressTxRecords)
+	rec := testTxRecord(t, makeTestTx(20, 2))
+	for _, compress := range []bool{true, false} {
+		CompressTxRecords = compress
+		v, e := valueTxRecord(rec)
+		if e != nil {
+			t.Fatal(e)
+		}
+		compressed := byteOrder.Uint64(v)&txRecordCompressed != 0
+		if compressed != compress {
+			t.Fatalf("compress=%v: record compressed flag is %v", compress, compressed)
+		}
+		if compress && len(v) >= 8+len(rec.SerializedTx) {
+			t.Fatalf("compressed record is %d bytes, uncompressed tx is %d bytes", len(v), len(rec.SerializedTx))
+		}
+		var got TxRecord
+		if e = readRawTxRecord(&rec.Hash, v, &got); e != nil {
+			t.Fatalf("compress=%v: %v", compress, e)
+		}
+		if got.MsgTx.TxHash() != rec.Hash || !got.Received.Equal(rec.Received) {
+			t.Fatalf("compress=%v: record didn't round trip", compress)
+		}
+	}
+	// A record in the original format is the received time followed by the raw serialized transaction.
+	v := make([]byte, 8+len(rec.SerializedTx))
+	byteOrder.PutUint64(v, uint64(rec.Received.Unix()))
+	copy(v[8:], rec.SerializedTx)
+	var got TxRecord
+	if e := readRawTxRecord(&rec.Hash, v, &got); e != nil {
+		t.Fatal(e)
+	}
+	if got.MsgTx.TxHash() != rec.Hash || !got.Received.Equal(rec.Received) {
+		t.Fatalf("uncompressed record didn't round trip")
+	}
+}
+
+func benchmarkTxRecord(b *testing.B, numInputs, numOutputs int, compress bool) {
+	defer func(compress bool) {
+		CompressTxRecords = compress
+	}(CompressTxRecords)
+	CompressTxRecords = compress
+	rec := testTxRecord(b, makeTestTx(numInputs, numOutputs))
+	v, e := valueTxRecord(rec)
+	if e != nil {
+		b.Fatal(e)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if v, e = valueTxRecord(rec); e != nil {
+			b.Fatal(e)
+		}
+		var got TxRecord
+		if e = readRawTxRecord(&rec.Hash, v, &got); e != nil {
+			b.Fatal(e)
+		}
+	}
+	b.ReportMetric(float64(len(v))/float64(8+len(rec.SerializedTx)), "size-ratio")
+}
+
+func BenchmarkTxRecord1In2Out(b *testing.B)            { benchmarkTxRecord(b, 1, 2, true) }
+func BenchmarkTxRecord1In2OutNoCompress(b *testing.B)  { benchmarkTxRecord(b, 1, 2, false) }
+func BenchmarkTxRecord3In2Out(b *testing.B)            { benchmarkTxRecord(b, 3, 2, true) }
+func BenchmarkTxRecord3In2OutNoCompress(b *testing.B)  { benchmarkTxRecord(b, 3, 2, false) }
+func BenchmarkTxRecord50In2Out(b *testing.B)           { benchmarkTxRecord(b, 50, 2, true) }
+func BenchmarkTxRecord50In2OutNoCompress(b *testing.B) { benchmarkTxRecord(b, 50, 2, false) }
@@ -7,6 +7,7 @@ import (
 	"github.com/p9c/pod/pkg/amt"
 	"time"
 	
+	"github.com/p9c/pod/pkg/blockchain"
 	"github.com/p9c/pod/pkg/chainhash"
 	"github.com/p9c/pod/pkg/walletdb"
 	"github.com/p9c/pod/pkg/wire"
@@ -45,7 +46,14 @@ var byteOrder = binary.BigEndian
 // Database versions. Versions start at 1 and increment for each database change.
 const (
 	// LatestVersion is the most recent store version.
-	LatestVersion = 1
+	LatestVersion = 4
+	// coinbaseCreditsVersion is the first version that flags the credits of coinbase transactions.
+	coinbaseCreditsVersion = 2
+	// watchOnlyCreditsVersion is the first version that flags the credits of outputs the wallet watches but can't
+	// spend. No credits are watch-only before it, so upgrading to it leaves the credits as they are.
+	watchOnlyCreditsVersion = 3
+	// broadcastsVersion is the first version with the bucket recording the broadcasts of unmined transactions.
+	broadcastsVersion = 4
 )
 
 var (
@@ -62,6 +70,7 @@ var (
 	bucketUnmined        = []byte("m")
 	bucketUnminedCredits = []byte("mc")
 	bucketUnminedInputs  = []byte("mi")
+	bucketBroadcasts     = []byte("bc")
 	// Root (namespace) bucket keys
 	rootCreateDate   = []byte("date")
 	rootVersion      = []byte("vers")
@@ -72,7 +81,7 @@ var (
 // This includes immature outputs, and outputs spent by mempool transactions, which must be considered when returning
 // the actual balance for a given number of block confirmations. The value is the amount serialized as a uint64.
 func fetchMinedBalance(ns walletdb.ReadBucket) (amt.Amount, error) {
-	v := ns.Get(rootMinedBalance)
+	v := storageOf(ns).FetchValue(nil, rootMinedBalance)
 	if len(v) != 8 {
 		str := fmt.Sprintf(
 			"balance: short read (expected 8 bytes, "+
@@ -85,7 +94,7 @@ func fetchMinedBalance(ns walletdb.ReadBucket) (amt.Amount, error) {
 func putMinedBalance(ns walletdb.ReadWriteBucket, amt amt.Amount) (e error) {
 	v := make([]byte, 8)
 	byteOrder.PutUint64(v, uint64(amt))
-	e = ns.Put(rootMinedBalance, v)
+	e = storageOf(ns).PutValue(nil, rootMinedBalance, v)
 	if e != nil {
 		str := "failed to put balance"
 		return storeError(ErrDatabase, str, e)
@@ -156,7 +165,7 @@ func appendRawBlockRecord(v []byte, txHash *chainhash.Hash) ([]byte, error) {
 	return newv, nil
 }
 func putRawBlockRecord(ns walletdb.ReadWriteBucket, k, v []byte) (e error) {
-	e = ns.NestedReadWriteBucket(bucketBlocks).Put(k, v)
+	e = storageOf(ns).PutValue(bucketBlocks, k, v)
 	if e != nil {
 		str := "failed to store block"
 		return storeError(ErrDatabase, str, e)
@@ -170,7 +179,7 @@ func putBlockRecord(ns walletdb.ReadWriteBucket, block *BlockMeta, txHash *chain
 }
 func fetchBlockTime(ns walletdb.ReadBucket, height int32) (time.Time, error) {
 	k := keyBlockRecord(height)
-	v := ns.NestedReadBucket(bucketBlocks).Get(k)
+	v := storageOf(ns).FetchValue(bucketBlocks, k)
 	if len(v) < 44 {
 		str := fmt.Sprintf(
 			"%s: short read (expected %d bytes, read %d)",
@@ -182,7 +191,7 @@ func fetchBlockTime(ns walletdb.ReadBucket, height int32) (time.Time, error) {
 }
 func existsBlockRecord(ns walletdb.ReadBucket, height int32) (k, v []byte) {
 	k = keyBlockRecord(height)
-	v = ns.NestedReadBucket(bucketBlocks).Get(k)
+	v = storageOf(ns).FetchValue(bucketBlocks, k)
 	return
 }
 func readRawBlockRecord(k, v []byte, block *blockRecord) (e error) {
@@ -323,7 +332,7 @@ func (it *blockIterator) reposition(height int32) {
 }
 func deleteBlockRecord(ns walletdb.ReadWriteBucket, height int32) (e error) {
 	k := keyBlockRecord(height)
-	return ns.NestedReadWriteBucket(bucketBlocks).Delete(k)
+	return storageOf(ns).DeleteValue(bucketBlocks, k)
 }
 
 // Transaction records are keyed as such:
@@ -338,7 +347,8 @@ func deleteBlockRecord(ns walletdb.ReadWriteBucket, height int32) (e error) {
 // The record value is serialized as such:
 //
 //   [0:8]   Received time (8 bytes)
-//   [8:]    Serialized transaction (varies)
+//             The top bit is set when the transaction is compressed
+//   [8:]    Serialized transaction, optionally zstd compressed (varies)
 func keyTxRecord(txHash *chainhash.Hash, block *Block) []byte {
 	k := make([]byte, 68)
 	copy(k, txHash[:])
@@ -347,21 +357,25 @@ func keyTxRecord(txHash *chainhash.Hash, block *Block) []byte {
 	return k
 }
 func valueTxRecord(rec *TxRecord) ([]byte, error) {
-	var v []byte
-	if rec.SerializedTx == nil {
-		txSize := rec.MsgTx.SerializeSize()
-		v = make([]byte, 8, 8+txSize)
-		e := rec.MsgTx.Serialize(bytes.NewBuffer(v[8:]))
+	serializedTx := rec.SerializedTx
+	if serializedTx == nil {
+		var buf bytes.Buffer
+		buf.Grow(rec.MsgTx.SerializeSize())
+		e := rec.MsgTx.Serialize(&buf)
 		if e != nil {
 			str := fmt.Sprintf("unable to serialize transaction %v", rec.Hash)
 			return nil, storeError(ErrInput, str, e)
 		}
-		v = v[:cap(v)]
-	} else {
-		v = make([]byte, 8+len(rec.SerializedTx))
-		copy(v[8:], rec.SerializedTx)
+		serializedTx = buf.Bytes()
+	}
+	received := uint64(rec.Received.Unix())
+	if compressed, ok := compressTx(serializedTx); ok {
+		serializedTx = compressed
+		received |= txRecordCompressed
 	}
-	byteOrder.PutUint64(v, uint64(rec.Received.Unix()))
+	v := make([]byte, 8+len(serializedTx))
+	byteOrder.PutUint64(v, received)
+	copy(v[8:], serializedTx)
 	return v, nil
 }
 func putTxRecord(ns walletdb.ReadWriteBucket, rec *TxRecord, block *Block) (e error) {
@@ -370,7 +384,7 @@ func putTxRecord(ns walletdb.ReadWriteBucket, rec *TxRecord, block *Block) (e er
 	if e != nil {
 		return e
 	}
-	e = ns.NestedReadWriteBucket(bucketTxRecords).Put(k, v)
+	e = storageOf(ns).PutValue(bucketTxRecords, k, v)
 	if e != nil {
 		str := fmt.Sprintf("%s: put failed for %v", bucketTxRecords, rec.Hash)
 		return storeError(ErrDatabase, str, e)
@@ -395,8 +409,19 @@ func readRawTxRecord(txHash *chainhash.Hash, v []byte, rec *TxRecord) (e error)
 		return storeError(ErrData, str, nil)
 	}
 	rec.Hash = *txHash
-	rec.Received = time.Unix(int64(byteOrder.Uint64(v)), 0)
-	e = rec.MsgTx.Deserialize(bytes.NewReader(v[8:]))
+	received := byteOrder.Uint64(v)
+	rec.Received = time.Unix(int64(received&^txRecordCompressed), 0)
+	serializedTx := v[8:]
+	if received&txRecordCompressed != 0 {
+		if serializedTx, e = decompressTx(serializedTx); e != nil {
+			str := fmt.Sprintf(
+				"%s: failed to decompress transaction %v",
+				bucketTxRecords, txHash,
+			)
+			return storeError(ErrData, str, e)
+		}
+	}
+	e = rec.MsgTx.Deserialize(bytes.NewReader(serializedTx))
 	if e != nil {
 		str := fmt.Sprintf(
 			"%s: failed to deserialize transaction %v",
@@ -421,7 +446,7 @@ func readRawTxRecordBlock(k []byte, block *Block) (e error) {
 
 func fetchTxRecord(ns walletdb.ReadBucket, txHash *chainhash.Hash, block *Block) (rec *TxRecord,e error) {
 	k := keyTxRecord(txHash, block)
-	v := ns.NestedReadBucket(bucketTxRecords).Get(k)
+	v := storageOf(ns).FetchValue(bucketTxRecords, k)
 	rec = new(TxRecord)
 	e = readRawTxRecord(txHash, v, rec)
 	return rec, e
@@ -444,17 +469,17 @@ func fetchRawTxRecordPkScript(k, v []byte, index uint32) ([]byte, error) {
 }
 func existsTxRecord(ns walletdb.ReadBucket, txHash *chainhash.Hash, block *Block) (k, v []byte) {
 	k = keyTxRecord(txHash, block)
-	v = ns.NestedReadBucket(bucketTxRecords).Get(k)
+	v = storageOf(ns).FetchValue(bucketTxRecords, k)
 	return
 }
 
 func existsRawTxRecord(ns walletdb.ReadBucket, k []byte) (v []byte) {
-	return ns.NestedReadBucket(bucketTxRecords).Get(k)
+	return storageOf(ns).FetchValue(bucketTxRecords, k)
 }
 
 func deleteTxRecord(ns walletdb.ReadWriteBucket, txHash *chainhash.Hash, block *Block) (e error) {
 	k := keyTxRecord(txHash, block)
-	return ns.NestedReadWriteBucket(bucketTxRecords).Delete(k)
+	return storageOf(ns).DeleteValue(bucketTxRecords, k)
 }
 
 // latestTxRecord searches for the newest recorded mined transaction record with a matching hash. In case of a hash
@@ -487,6 +512,8 @@ func latestTxRecord(ns walletdb.ReadBucket, txHash *chainhash.Hash) (k, v []byte
 //   [8]     Flags (1 byte)
 //             0x01: Spent
 //             0x02: Change
+//             0x04: Coinbase (version 2 and later)
+//             0x08: Watch-only (version 3 and later)
 //   [9:81]  OPTIONAL Debit bucket key (72 bytes)
 //             [9:41]  Spender transaction hash (32 bytes)
 //             [41:45] Spender block height (4 bytes)
@@ -512,10 +539,16 @@ func valueUnspentCredit(cred *credit) []byte {
 	if cred.change {
 		v[8] |= 1 << 1
 	}
+	if cred.coinbase {
+		v[8] |= 1 << 2
+	}
+	if cred.watchOnly {
+		v[8] |= 1 << 3
+	}
 	return v
 }
 func putRawCredit(ns walletdb.ReadWriteBucket, k, v []byte) (e error) {
-	e = ns.NestedReadWriteBucket(bucketCredits).Put(k, v)
+	e = storageOf(ns).PutValue(bucketCredits, k, v)
 	if e != nil {
 		str := "failed to put credit"
 		return storeError(ErrDatabase, str, e)
@@ -573,6 +606,23 @@ func fetchRawCreditAmountChange(v []byte) (amt.Amount, bool, error) {
 	return amt.Amount(byteOrder.Uint64(v)), v[8]&(1<<1) != 0, nil
 }
 
+// fetchRawCreditCoinbase returns whether the credit is an output of a coinbase transaction.
+func fetchRawCreditCoinbase(v []byte) bool {
+	return len(v) >= 9 && v[8]&(1<<2) != 0
+}
+
+// fetchRawCreditWatchOnly returns whether the credit is an output the wallet watches but can't spend. Mined and unmined
+// credit values share the flag.
+func fetchRawCreditWatchOnly(v []byte) bool {
+	return len(v) >= 9 && v[8]&(1<<3) != 0
+}
+
+// immatureCoinbase returns whether a coinbase credit mined at height is not yet spendable at a chain height of
+// syncHeight.
+func immatureCoinbase(height, syncHeight int32, coinbaseMaturity uint16) bool {
+	return syncHeight-height+1 < int32(coinbaseMaturity)
+}
+
 // fetchRawCreditUnspentValue returns the unspent value for a raw credit key. This may be used to mark a credit as
 // unspent.
 func fetchRawCreditUnspentValue(k []byte) ([]byte, error) {
@@ -589,7 +639,7 @@ func fetchRawCreditUnspentValue(k []byte) ([]byte, error) {
 // spendRawCredit marks the credit with a given key as mined at some particular block as spent by the input at some
 // transaction incidence. The debited amount is returned.
 func spendCredit(ns walletdb.ReadWriteBucket, k []byte, spender *indexedIncidence) (amt.Amount, error) {
-	v := ns.NestedReadBucket(bucketCredits).Get(k)
+	v := storageOf(ns).FetchValue(bucketCredits, k)
 	newv := make([]byte, 81)
 	copy(newv, v)
 	v = newv
@@ -604,15 +654,15 @@ func spendCredit(ns walletdb.ReadWriteBucket, k []byte, spender *indexedIncidenc
 // unspendRawCredit rewrites the credit for the given key as unspent. The output amount of the credit is returned. It
 // returns without error if no credit exists for the key.
 func unspendRawCredit(ns walletdb.ReadWriteBucket, k []byte) (amt.Amount, error) {
-	b := ns.NestedReadWriteBucket(bucketCredits)
-	v := b.Get(k)
+	s := storageOf(ns)
+	v := s.FetchValue(bucketCredits, k)
 	if v == nil {
 		return 0, nil
 	}
 	newv := make([]byte, 9)
 	copy(newv, v)
 	newv[8] &^= 1 << 0
-	e := b.Put(k, newv)
+	e := s.PutValue(bucketCredits, k, newv)
 	if e != nil {
 		str := "failed to put credit"
 		return 0, storeError(ErrDatabase, str, e)
@@ -622,16 +672,16 @@ func unspendRawCredit(ns walletdb.ReadWriteBucket, k []byte) (amt.Amount, error)
 
 func existsCredit(ns walletdb.ReadBucket, txHash *chainhash.Hash, index uint32, block *Block) (k, v []byte) {
 	k = keyCredit(txHash, index, block)
-	v = ns.NestedReadBucket(bucketCredits).Get(k)
+	v = storageOf(ns).FetchValue(bucketCredits, k)
 	return
 }
 
 func existsRawCredit(ns walletdb.ReadBucket, k []byte) []byte {
-	return ns.NestedReadBucket(bucketCredits).Get(k)
+	return storageOf(ns).FetchValue(bucketCredits, k)
 }
 
 func deleteRawCredit(ns walletdb.ReadWriteBucket, k []byte) (e error) {
-	e = ns.NestedReadWriteBucket(bucketCredits).Delete(k)
+	e = storageOf(ns).DeleteValue(bucketCredits, k)
 	if e != nil {
 		str := "failed to delete credit"
 		return storeError(ErrDatabase, str, e)
@@ -693,6 +743,7 @@ func (it *creditIterator) readElem() (e error) {
 	it.elem.Amount = amt.Amount(byteOrder.Uint64(it.cv))
 	it.elem.Spent = it.cv[8]&(1<<0) != 0
 	it.elem.Change = it.cv[8]&(1<<1) != 0
+	it.elem.WatchOnly = fetchRawCreditWatchOnly(it.cv)
 	return nil
 }
 func (it *creditIterator) next() bool {
@@ -737,7 +788,7 @@ func valueUnspent(block *Block) []byte {
 func putUnspent(ns walletdb.ReadWriteBucket, outPoint *wire.OutPoint, block *Block) (e error) {
 	k := canonicalOutPoint(&outPoint.Hash, outPoint.Index)
 	v := valueUnspent(block)
-	e = ns.NestedReadWriteBucket(bucketUnspent).Put(k, v)
+	e = storageOf(ns).PutValue(bucketUnspent, k, v)
 	if e != nil {
 		str := "cannot put unspent"
 		return storeError(ErrDatabase, str, e)
@@ -745,7 +796,7 @@ func putUnspent(ns walletdb.ReadWriteBucket, outPoint *wire.OutPoint, block *Blo
 	return nil
 }
 func putRawUnspent(ns walletdb.ReadWriteBucket, k, v []byte) (e error) {
-	e = ns.NestedReadWriteBucket(bucketUnspent).Put(k, v)
+	e = storageOf(ns).PutValue(bucketUnspent, k, v)
 	if e != nil {
 		str := "cannot put unspent"
 		return storeError(ErrDatabase, str, e)
@@ -776,7 +827,7 @@ func existsRawUnspent(ns walletdb.ReadBucket, k []byte) (credKey []byte) {
 	if len(k) < 36 {
 		return nil
 	}
-	v := ns.NestedReadBucket(bucketUnspent).Get(k)
+	v := storageOf(ns).FetchValue(bucketUnspent, k)
 	if len(v) < 36 {
 		return nil
 	}
@@ -787,7 +838,7 @@ func existsRawUnspent(ns walletdb.ReadBucket, k []byte) (credKey []byte) {
 	return credKey
 }
 func deleteRawUnspent(ns walletdb.ReadWriteBucket, k []byte) (e error) {
-	e = ns.NestedReadWriteBucket(bucketUnspent).Delete(k)
+	e = storageOf(ns).DeleteValue(bucketUnspent, k)
 	if e != nil {
 		str := "failed to delete unspent"
 		return storeError(ErrDatabase, str, e)
@@ -834,7 +885,7 @@ func putDebit(
 	v := make([]byte, 80)
 	byteOrder.PutUint64(v, uint64(amount))
 	copy(v[8:80], credKey)
-	e = ns.NestedReadWriteBucket(bucketDebits).Put(k, v)
+	e = storageOf(ns).PutValue(bucketDebits, k, v)
 	if e != nil {
 		str := fmt.Sprintf(
 			"failed to update debit %s input %d",
@@ -856,7 +907,7 @@ func existsDebit(ns walletdb.ReadBucket, txHash *chainhash.Hash, index uint32, b
 	e error,
 ) {
 	k = keyDebit(txHash, index, block)
-	v := ns.NestedReadBucket(bucketDebits).Get(k)
+	v := storageOf(ns).FetchValue(bucketDebits, k)
 	if v == nil {
 		return nil, nil, nil
 	}
@@ -871,7 +922,7 @@ func existsDebit(ns walletdb.ReadBucket, txHash *chainhash.Hash, index uint32, b
 }
 
 func deleteRawDebit(ns walletdb.ReadWriteBucket, k []byte) (e error) {
-	e = ns.NestedReadWriteBucket(bucketDebits).Delete(k)
+	e = storageOf(ns).DeleteValue(bucketDebits, k)
 	if e != nil {
 		str := "failed to delete debit"
 		return storeError(ErrDatabase, str, e)
@@ -955,9 +1006,10 @@ func (it *debitIterator) next() bool {
 // mined transaction records:
 //
 //   [0:8]   Received time (8 bytes)
-//   [8:]    Serialized transaction (varies)
+//             The top bit is set when the transaction is compressed
+//   [8:]    Serialized transaction, optionally zstd compressed (varies)
 func putRawUnmined(ns walletdb.ReadWriteBucket, k, v []byte) (e error) {
-	e = ns.NestedReadWriteBucket(bucketUnmined).Put(k, v)
+	e = storageOf(ns).PutValue(bucketUnmined, k, v)
 	if e != nil {
 		str := "failed to put unmined record"
 		return storeError(ErrDatabase, str, e)
@@ -975,11 +1027,11 @@ func readRawUnminedHash(k []byte, txHash *chainhash.Hash) (e error) {
 }
 
 func existsRawUnmined(ns walletdb.ReadBucket, k []byte) (v []byte) {
-	return ns.NestedReadBucket(bucketUnmined).Get(k)
+	return storageOf(ns).FetchValue(bucketUnmined, k)
 }
 
 func deleteRawUnmined(ns walletdb.ReadWriteBucket, k []byte) (e error) {
-	e = ns.NestedReadWriteBucket(bucketUnmined).Delete(k)
+	e = storageOf(ns).DeleteValue(bucketUnmined, k)
 	if e != nil {
 		str := "failed to delete unmined record"
 		return storeError(ErrDatabase, str, e)
@@ -998,16 +1050,20 @@ func deleteRawUnmined(ns walletdb.ReadWriteBucket, k []byte) (e error) {
 //   [0:8]   Amount (8 bytes)
 //   [8]     Flags (1 byte)
 //             0x02: Change
-func valueUnminedCredit(amount amt.Amount, change bool) []byte {
+//             0x08: Watch-only (version 3 and later)
+func valueUnminedCredit(amount amt.Amount, change, watchOnly bool) []byte {
 	v := make([]byte, 9)
 	byteOrder.PutUint64(v, uint64(amount))
 	if change {
-		v[8] = 1 << 1
+		v[8] |= 1 << 1
+	}
+	if watchOnly {
+		v[8] |= 1 << 3
 	}
 	return v
 }
 func putRawUnminedCredit(ns walletdb.ReadWriteBucket, k, v []byte) (e error) {
-	e = ns.NestedReadWriteBucket(bucketUnminedCredits).Put(k, v)
+	e = storageOf(ns).PutValue(bucketUnminedCredits, k, v)
 	if e != nil {
 		str := "cannot put unmined credit"
 		return storeError(ErrDatabase, str, e)
@@ -1038,10 +1094,10 @@ func fetchRawUnminedCreditAmountChange(v []byte) (amt.Amount, bool, error) {
 	return amt, change, nil
 }
 func existsRawUnminedCredit(ns walletdb.ReadBucket, k []byte) []byte {
-	return ns.NestedReadBucket(bucketUnminedCredits).Get(k)
+	return storageOf(ns).FetchValue(bucketUnminedCredits, k)
 }
 func deleteRawUnminedCredit(ns walletdb.ReadWriteBucket, k []byte) (e error) {
-	e = ns.NestedReadWriteBucket(bucketUnminedCredits).Delete(k)
+	e = storageOf(ns).DeleteValue(bucketUnminedCredits, k)
 	if e != nil {
 		str := "failed to delete unmined credit"
 		return storeError(ErrDatabase, str, e)
@@ -1107,6 +1163,7 @@ func (it *unminedCreditIterator) readElem() (e error) {
 	it.elem.Index = index
 	it.elem.Amount = amount
 	it.elem.Change = change
+	it.elem.WatchOnly = fetchRawCreditWatchOnly(it.cv)
 	// Spent intentionally not set
 	return nil
 }
@@ -1160,9 +1217,9 @@ func (it *unminedCreditIterator) next() bool {
 // putRawUnminedInput maintains a list of unmined transaction hashes that have spent an outpoint. Each entry in the
 // bucket is keyed by the outpoint being spent.
 func putRawUnminedInput(ns walletdb.ReadWriteBucket, k, v []byte) (e error) {
-	spendTxHashes := ns.NestedReadBucket(bucketUnminedInputs).Get(k)
+	spendTxHashes := storageOf(ns).FetchValue(bucketUnminedInputs, k)
 	spendTxHashes = append(spendTxHashes, v...)
-	e = ns.NestedReadWriteBucket(bucketUnminedInputs).Put(k, spendTxHashes)
+	e = storageOf(ns).PutValue(bucketUnminedInputs, k, spendTxHashes)
 	if e != nil {
 		str := "failed to put unmined input"
 		return storeError(ErrDatabase, str, e)
@@ -1171,12 +1228,12 @@ func putRawUnminedInput(ns walletdb.ReadWriteBucket, k, v []byte) (e error) {
 }
 
 func existsRawUnminedInput(ns walletdb.ReadBucket, k []byte) (v []byte) {
-	return ns.NestedReadBucket(bucketUnminedInputs).Get(k)
+	return storageOf(ns).FetchValue(bucketUnminedInputs, k)
 }
 
 // fetchUnminedInputSpendTxHashes fetches the list of unmined transactions that spend the serialized outpoint.
 func fetchUnminedInputSpendTxHashes(ns walletdb.ReadBucket, k []byte) []chainhash.Hash {
-	rawSpendTxHashes := ns.NestedReadBucket(bucketUnminedInputs).Get(k)
+	rawSpendTxHashes := storageOf(ns).FetchValue(bucketUnminedInputs, k)
 	if rawSpendTxHashes == nil {
 		return nil
 	}
@@ -1192,7 +1249,7 @@ func fetchUnminedInputSpendTxHashes(ns walletdb.ReadBucket, k []byte) []chainhas
 }
 
 func deleteRawUnminedInput(ns walletdb.ReadWriteBucket, k []byte) (e error) {
-	e = ns.NestedReadWriteBucket(bucketUnminedInputs).Delete(k)
+	e = storageOf(ns).DeleteValue(bucketUnminedInputs, k)
 	if e != nil {
 		str := "failed to delete unmined input"
 		return storeError(ErrDatabase, str, e)
@@ -1200,9 +1257,57 @@ func deleteRawUnminedInput(ns walletdb.ReadWriteBucket, k []byte) (e error) {
 	return nil
 }
 
+// The broadcasts of unmined transactions are saved in the broadcasts bucket keyed by the transaction hash. The value
+// is serialized as such:
+//
+//   [0:8]    First broadcast time (8 bytes)
+//   [8:16]   Last broadcast time (8 bytes)
+//   [16:20]  Number of broadcast attempts (4 bytes)
+
+func valueBroadcast(info *BroadcastInfo) []byte {
+	v := make([]byte, 20)
+	byteOrder.PutUint64(v, uint64(info.FirstBroadcast.Unix()))
+	byteOrder.PutUint64(v[8:16], uint64(info.LastBroadcast.Unix()))
+	byteOrder.PutUint32(v[16:20], info.Attempts)
+	return v
+}
+
+func putRawBroadcast(ns walletdb.ReadWriteBucket, k, v []byte) (e error) {
+	e = storageOf(ns).PutValue(bucketBroadcasts, k, v)
+	if e != nil {
+		str := "failed to put broadcast record"
+		return storeError(ErrDatabase, str, e)
+	}
+	return nil
+}
+
+func existsRawBroadcast(ns walletdb.ReadBucket, k []byte) (v []byte) {
+	return storageOf(ns).FetchValue(bucketBroadcasts, k)
+}
+
+func readRawBroadcast(v []byte, info *BroadcastInfo) (e error) {
+	if len(v) < 20 {
+		str := fmt.Sprintf("%s: short read (expected %d bytes, read %d)", bucketBroadcasts, 20, len(v))
+		return storeError(ErrData, str, nil)
+	}
+	info.FirstBroadcast = time.Unix(int64(byteOrder.Uint64(v)), 0)
+	info.LastBroadcast = time.Unix(int64(byteOrder.Uint64(v[8:16])), 0)
+	info.Attempts = byteOrder.Uint32(v[16:20])
+	return nil
+}
+
+func deleteRawBroadcast(ns walletdb.ReadWriteBucket, k []byte) (e error) {
+	e = storageOf(ns).DeleteValue(bucketBroadcasts, k)
+	if e != nil {
+		str := "failed to delete broadcast record"
+		return storeError(ErrDatabase, str, e)
+	}
+	return nil
+}
+
 // openStore opens an existing transaction store from the passed namespace.
 func openStore(ns walletdb.ReadBucket) (e error) {
-	v := ns.Get(rootVersion)
+	v := storageOf(ns).FetchValue(nil, rootVersion)
 	if len(v) != 4 {
 		str := "no transaction store exists in namespace"
 		return storeError(ErrNoExists, str, nil)
@@ -1223,17 +1328,81 @@ func openStore(ns walletdb.ReadBucket) (e error) {
 		)
 		return storeError(ErrUnknownVersion, str, nil)
 	}
-	// Upgrade the tx store as needed, one version at a time, until LatestVersion is reached. Versions are not skipped
-	// when performing database upgrades, and each upgrade is done in its own transaction.
-	//
-	// No upgrades yet.
-	// if version < LatestVersion {
-	//	e := scopedUpdate(namespace, func(ns walletdb.Bucket) (e error) {
-	//	})
-	//	if e != nil  {
-	//	DB	//		// Handle err
-	//	}
-	// }
+	return nil
+}
+
+// upgradeStore upgrades the tx store in the passed namespace to LatestVersion, one version at a time. Versions are not
+// skipped when performing database upgrades.
+func upgradeStore(ns walletdb.ReadWriteBucket) (e error) {
+	v := storageOf(ns).FetchValue(nil, rootVersion)
+	if len(v) != 4 {
+		str := "no transaction store exists in namespace"
+		return storeError(ErrNoExists, str, nil)
+	}
+	version := byteOrder.Uint32(v)
+	if version >= LatestVersion {
+		return nil
+	}
+	if version < coinbaseCreditsVersion {
+		if e = flagCoinbaseCredits(ns); e != nil {
+			return e
+		}
+	}
+	// Nothing is stored differently for watchOnlyCreditsVersion, which only adds a flag no earlier credit has.
+	if version < broadcastsVersion {
+		if _, e = ns.CreateBucketIfNotExists(bucketBroadcasts); e != nil {
+			str := "failed to create broadcasts bucket"
+			return storeError(ErrDatabase, str, e)
+		}
+	}
+	v = make([]byte, 4)
+	byteOrder.PutUint32(v, LatestVersion)
+	if e = storageOf(ns).PutValue(nil, rootVersion, v); e != nil {
+		str := "failed to store latest database version"
+		return storeError(ErrDatabase, str, e)
+	}
+	return nil
+}
+
+// flagCoinbaseCredits sets the coinbase flag on the existing credits of coinbase transactions, which were written
+// before the flag existed.
+func flagCoinbaseCredits(ns walletdb.ReadWriteBucket) (e error) {
+	credits := ns.NestedReadWriteBucket(bucketCredits)
+	var coinbaseKeys [][]byte
+	e = credits.ForEach(
+		func(k, v []byte) (e error) {
+			recKey := extractRawCreditTxRecordKey(k)
+			recVal := existsRawTxRecord(ns, recKey)
+			if recVal == nil {
+				return nil
+			}
+			var txHash chainhash.Hash
+			copy(txHash[:], recKey[:32])
+			var rec TxRecord
+			if e = readRawTxRecord(&txHash, recVal, &rec); e != nil {
+				return e
+			}
+			if blockchain.IsCoinBaseTx(&rec.MsgTx) {
+				coinbaseKeys = append(coinbaseKeys, append([]byte(nil), k...))
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		if _, ok := e.(TxMgrError); ok {
+			return e
+		}
+		str := "failed iterating credits bucket"
+		return storeError(ErrDatabase, str, e)
+	}
+	for _, k := range coinbaseKeys {
+		v := append([]byte(nil), credits.Get(k)...)
+		v[8] |= 1 << 2
+		if e = putRawCredit(ns, k, v); e != nil {
+			return e
+		}
+	}
+	I.Ln("flagged", len(coinbaseKeys), "coinbase credits")
 	return nil
 }
 
@@ -1249,7 +1418,7 @@ func createStore(ns walletdb.ReadWriteBucket) (e error) {
 	// Write the latest store version.
 	v := make([]byte, 4)
 	byteOrder.PutUint32(v, LatestVersion)
-	e = ns.Put(rootVersion, v)
+	e = storageOf(ns).PutValue(nil, rootVersion, v)
 	if e != nil {
 		str := "failed to store latest database version"
 		return storeError(ErrDatabase, str, e)
@@ -1257,14 +1426,14 @@ func createStore(ns walletdb.ReadWriteBucket) (e error) {
 	// Save the creation date of the store.
 	v = make([]byte, 8)
 	byteOrder.PutUint64(v, uint64(time.Now().Unix()))
-	e = ns.Put(rootCreateDate, v)
+	e = storageOf(ns).PutValue(nil, rootCreateDate, v)
 	if e != nil {
 		str := "failed to store database creation time"
 		return storeError(ErrDatabase, str, e)
 	}
 	// Write a zero balance.
 	v = make([]byte, 8)
-	e = ns.Put(rootMinedBalance, v)
+	e = storageOf(ns).PutValue(nil, rootMinedBalance, v)
 	if e != nil {
 		str := "failed to write zero balance"
 		return storeError(ErrDatabase, str, e)
@@ -1309,6 +1478,11 @@ func createStore(ns walletdb.ReadWriteBucket) (e error) {
 		str := "failed to create unmined inputs bucket"
 		return storeError(ErrDatabase, str, e)
 	}
+	_, e = ns.CreateBucket(bucketBroadcasts)
+	if e != nil {
+		str := "failed to create broadcasts bucket"
+		return storeError(ErrDatabase, str, e)
+	}
 	return nil
 }
 
@@ -0,0 +1,102 @@
+package wtxmgr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	
+	"github.com/p9c/pod/pkg/chaincfg"
+	"github.com/p9c/pod/pkg/chainhash"
+	"github.com/p9c/pod/pkg/walletdb"
+	_ "github.com/p9c/pod/pkg/walletdb/bdb"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// TestUpgradeCoinbaseCredits ensures upgrading a version 1 store flags the credits of coinbase transactions, and only
+// those.
+func TestUpgradeCoinbaseCredits(t *testing.T) {
+	tmpDir, e := ioutil.TempDir("", "wtxmgr_test")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, e := walletdb.Create("bdb", filepath.Join(tmpDir, "db"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+	namespaceKey := []byte("txstore")
+	b100 := BlockMeta{Block: Block{Height: 100}, Time: time.Now()}
+	coinbase := wire.NewMsgTx(wire.TxVersion)
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, ^uint32(0)), nil, nil))
+	coinbase.AddTxOut(wire.NewTxOut(50e8, nil))
+	regular := wire.NewMsgTx(wire.TxVersion)
+	regular.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, 0), nil, nil))
+	regular.AddTxOut(wire.NewTxOut(1e8, nil))
+	var keys [][]byte
+	e = walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			ns, e := tx.CreateTopLevelBucket(namespaceKey)
+			if e != nil {
+				return e
+			}
+			if e = Create(ns); e != nil {
+				return e
+			}
+			s, e := Open(ns, &chaincfg.TestNet3Params)
+			if e != nil {
+				return e
+			}
+			for _, msgTx := range []*wire.MsgTx{coinbase, regular} {
+				rec, e := NewTxRecordFromMsgTx(msgTx, b100.Time)
+				if e != nil {
+					return e
+				}
+				if e = s.InsertTx(ns, rec, &b100); e != nil {
+					return e
+				}
+				if e = s.AddCredit(ns, rec, &b100, 0, false); e != nil {
+					return e
+				}
+				keys = append(keys, keyCredit(&rec.Hash, 0, &b100.Block))
+			}
+			// Rewrite the store as version 1 wrote it, without the coinbase flag.
+			for _, k := range keys {
+				v := append([]byte(nil), existsRawCredit(ns, k)...)
+				v[8] &^= 1 << 2
+				if e = putRawCredit(ns, k, v); e != nil {
+					return e
+				}
+			}
+			v := make([]byte, 4)
+			byteOrder.PutUint32(v, 1)
+			return ns.Put(rootVersion, v)
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = DoUpgrades(db, namespaceKey); e != nil {
+		t.Fatal(e)
+	}
+	e = walletdb.View(
+		db, func(tx walletdb.ReadTx) (e error) {
+			ns := tx.ReadBucket(namespaceKey)
+			if e = openStore(ns); e != nil {
+				return e
+			}
+			if !fetchRawCreditCoinbase(existsRawCredit(ns, keys[0])) {
+				t.Error("coinbase credit was not flagged")
+			}
+			if fetchRawCreditCoinbase(existsRawCredit(ns, keys[1])) {
+				t.Error("regular credit was flagged as coinbase")
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+}
@@ -2,7 +2,8 @@
 // primary purpose is to save transactions with outputs spendable with wallet keys and transactions that are signed by
 // wallet keys in memory, handle spend tracking for unspent outputs and newly-inserted transactions, and report the
 // spendable balance from each unspent transaction output. It uses walletdb as the backend for storing the serialized
-// transaction objects in buckets.
+// transaction objects in buckets, though any implementation of the walletdb bucket interfaces can hold them, such as
+// the in-memory namespace of NewMemoryNamespace.
 //
 // Transaction outputs which are spendable by wallet keys are called credits (because they credit to a wallet's total
 // spendable balance). Transaction inputs which spend previously-inserted credits are called debits (because they debit
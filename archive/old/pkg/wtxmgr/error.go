@@ -31,16 +31,24 @@ const (
 	// ErrUnknownVersion describes an error where the store already exists but the database version is newer than latest
 	// version known to this software. This likely indicates an outdated binary.
 	ErrUnknownVersion
+	// ErrInsufficientFunds describes an error where the spendable outputs in the store don't add up to the amount asked
+	// for.
+	ErrInsufficientFunds
+	// ErrChainLimit describes an error where an unmined transaction can't be inserted because the chain of unmined
+	// transactions it is part of would exceed the chain limits of the store.
+	ErrChainLimit
 )
 
 var errStrs = [...]string{
-	ErrDatabase:       "ErrDatabase",
-	ErrData:           "ErrData",
-	ErrInput:          "ErrInput",
-	ErrAlreadyExists:  "ErrAlreadyExists",
-	ErrNoExists:       "ErrNoExists",
-	ErrNeedsUpgrade:   "ErrNeedsUpgrade",
-	ErrUnknownVersion: "ErrUnknownVersion",
+	ErrDatabase:          "ErrDatabase",
+	ErrData:              "ErrData",
+	ErrInput:             "ErrInput",
+	ErrAlreadyExists:     "ErrAlreadyExists",
+	ErrNoExists:          "ErrNoExists",
+	ErrNeedsUpgrade:      "ErrNeedsUpgrade",
+	ErrUnknownVersion:    "ErrUnknownVersion",
+	ErrInsufficientFunds: "ErrInsufficientFunds",
+	ErrChainLimit:        "ErrChainLimit",
 }
 
 // String returns the ErrorCode as a human-readable name.
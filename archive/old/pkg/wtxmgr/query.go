@@ -1,8 +1,11 @@
 package wtxmgr
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/p9c/pod/pkg/amt"
+	"sort"
 	
 	"github.com/p9c/pod/pkg/chainhash"
 	"github.com/p9c/pod/pkg/walletdb"
@@ -11,10 +14,11 @@ import (
 // CreditRecord contains metadata regarding a transaction credit for a known transaction. Further details may be looked
 // up by indexing a wire.MsgTx.TxOut with the Index field.
 type CreditRecord struct {
-	Amount amt.Amount
-	Index  uint32
-	Spent  bool
-	Change bool
+	Amount    amt.Amount
+	Index     uint32
+	Spent     bool
+	Change    bool
+	WatchOnly bool
 }
 
 // DebitRecord contains metadata regarding a transaction debit for a known transaction. Further details may be looked up
@@ -31,6 +35,9 @@ type TxDetails struct {
 	Block BlockMeta
 	Credits []CreditRecord
 	Debits []DebitRecord
+	// Broadcast records the broadcasts of an unmined transaction. It is nil for mined transactions and those that
+	// were never recorded as broadcast.
+	Broadcast *BroadcastInfo
 }
 
 // minedTxDetails fetches the TxDetails for the mined transaction with hash txHash and the passed tx record key and
@@ -145,6 +152,12 @@ func (s *Store) unminedTxDetails(ns walletdb.ReadBucket, txHash *chainhash.Hash,
 			},
 		)
 	}
+	if v := existsRawBroadcast(ns, txHash[:]); v != nil {
+		details.Broadcast = new(BroadcastInfo)
+		if e = readRawBroadcast(v, details.Broadcast); e != nil {
+			return nil, e
+		}
+	}
 	return &details, nil
 }
 
@@ -226,9 +239,9 @@ func (s *Store) rangeUnminedTransactions(
 
 // rangeBlockTransactions executes the function f with TxDetails for every block between heights begin and end (reverse
 // order when end > begin) until f returns true, or the transactions from block is processed. Returns true iff f
-// executes and returns true.
+// executes and returns true. The context is checked before each block, and its error returned once it is done.
 func (s *Store) rangeBlockTransactions(
-	ns walletdb.ReadBucket, begin, end int32,
+	ctx context.Context, ns walletdb.ReadBucket, begin, end int32,
 	f func([]TxDetails) (bool, error),
 ) (bool, error) {
 	T.Ln("rangeBlockTransactions", begin, end)
@@ -264,6 +277,9 @@ func (s *Store) rangeBlockTransactions(
 	}
 	var details []TxDetails
 	for advance(&blockIter) {
+		if e := ctx.Err(); e != nil {
+			return false, e
+		}
 		block := &blockIter.elem
 		if cap(details) < len(block.transactions) {
 			details = make([]TxDetails, 0, len(block.transactions))
@@ -343,20 +359,35 @@ func (s *Store) rangeBlockTransactions(
 func (s *Store) RangeTransactions(
 	ns walletdb.ReadBucket, begin, end int32,
 	f func([]TxDetails) (bool, error),
+) error {
+	return s.RangeTransactionsContext(context.Background(), ns, begin, end, f)
+}
+
+// RangeTransactionsContext is RangeTransactions which stops early when the context is done, checking it between blocks
+// and before the unmined transactions. The context's error is returned when the range is cut short by it.
+func (s *Store) RangeTransactionsContext(
+	ctx context.Context, ns walletdb.ReadBucket, begin, end int32,
+	f func([]TxDetails) (bool, error),
 ) error {
 	T.Ln("RangeTransactions")
 	var addedUnmined, brk bool
 	var e error
 	if begin < 0 {
+		if e = ctx.Err(); e != nil {
+			return e
+		}
 		brk, e = s.rangeUnminedTransactions(ns, f)
 		if e != nil || brk {
 			return e
 		}
 		addedUnmined = true
 	}
-	if brk, e = s.rangeBlockTransactions(ns, begin, end, f); E.Chk(e) {
+	if brk, e = s.rangeBlockTransactions(ctx, ns, begin, end, f); E.Chk(e) {
 	}
 	if e == nil && !brk && !addedUnmined && end < 0 {
+		if e = ctx.Err(); e != nil {
+			return e
+		}
 		_, e = s.rangeUnminedTransactions(ns, f)
 	}
 	return e
@@ -422,3 +453,179 @@ func (s *Store) PreviousPkScripts(ns walletdb.ReadBucket, rec *TxRecord, block *
 	}
 	return pkScripts, nil
 }
+
+// EarliestTxHeight returns the height of the lowest block holding any mined transaction recorded in the store, which a
+// rescan can start from rather than from an assumed wallet birthday. It returns false when no mined transactions are
+// recorded.
+func (s *Store) EarliestTxHeight(ns walletdb.ReadBucket) (int32, bool, error) {
+	it := makeReadBlockIterator(ns, 0)
+	for it.next() {
+		if len(it.elem.transactions) != 0 {
+			return it.elem.Height, true, nil
+		}
+	}
+	return 0, false, it.err
+}
+
+// SpentCredits calls f with each credit spent by a mined transaction in a block from the begin to the end height,
+// inclusive, along with the height of the block it was spent in. The credits are passed in the order they were spent,
+// by height and then by the order of the spending transactions and their inputs within each block, as found through
+// the debits of the spending transactions, which record the credits they spent. Credits spent by unmined transactions
+// aren't passed. Iteration stops at the first error returned by f, which is returned.
+func (s *Store) SpentCredits(
+	ns walletdb.ReadBucket, begin, end int32,
+	f func(rec CreditRecord, spenderHeight int32) error,
+) (e error) {
+	blockIter := makeReadBlockIterator(ns, begin)
+	for blockIter.next() && blockIter.elem.Height <= end {
+		block := &blockIter.elem
+		for i := range block.transactions {
+			debitIter := makeReadDebitIterator(ns, keyTxRecord(&block.transactions[i], &block.Block))
+			for debitIter.next() {
+				credKey := extractRawDebitCreditKey(debitIter.cv)
+				credVal := existsRawCredit(ns, credKey)
+				if credVal == nil {
+					str := fmt.Sprintf(
+						"missing credit spent by %v input %d", block.transactions[i], debitIter.elem.Index,
+					)
+					return storeError(ErrData, str, nil)
+				}
+				amount, change, e := fetchRawCreditAmountChange(credVal)
+				if e != nil {
+					return e
+				}
+				rec := CreditRecord{
+					Amount:    amount,
+					Index:     extractRawCreditIndex(credKey),
+					Spent:     true,
+					Change:    change,
+					WatchOnly: fetchRawCreditWatchOnly(credVal),
+				}
+				if e = f(rec, block.Height); e != nil {
+					return e
+				}
+			}
+			if debitIter.err != nil {
+				return debitIter.err
+			}
+		}
+	}
+	return blockIter.err
+}
+
+// TransactionsForScript returns the details of every transaction that pays to the output script through a credit, or
+// spends from it through a debit. The mined transactions are returned first, in order of their block heights, followed
+// by the unmined transactions in the order they were received.
+func (s *Store) TransactionsForScript(ns walletdb.ReadBucket, pkScript []byte) ([]TxDetails, error) {
+	var (
+		// mined holds the tx record keys, and unmined the hashes, of the matching transactions.
+		mined   = make(map[string]struct{})
+		unmined = make(map[chainhash.Hash]struct{})
+		// credits holds the keys of the matching mined credits, and outPoints the canonical outpoints of all the
+		// matching credits, which are looked up for spends.
+		credits   = make(map[string]struct{})
+		outPoints [][]byte
+	)
+	// Find the credits paying to the script, mined and then unmined.
+	e := ns.NestedReadBucket(bucketCredits).ForEach(
+		func(k, v []byte) (e error) {
+			if len(k) < 72 {
+				str := fmt.Sprintf("%s: short key (expected %d bytes, read %d)", bucketCredits, 72, len(k))
+				return storeError(ErrData, str, nil)
+			}
+			recKey := extractRawCreditTxRecordKey(k)
+			index := extractRawCreditIndex(k)
+			script, e := fetchRawTxRecordPkScript(recKey, existsRawTxRecord(ns, recKey), index)
+			if e != nil || !bytes.Equal(script, pkScript) {
+				return e
+			}
+			mined[string(recKey)] = struct{}{}
+			credits[string(k)] = struct{}{}
+			var txHash chainhash.Hash
+			copy(txHash[:], recKey)
+			outPoints = append(outPoints, canonicalOutPoint(&txHash, index))
+			return nil
+		},
+	)
+	if e != nil {
+		return nil, e
+	}
+	e = ns.NestedReadBucket(bucketUnminedCredits).ForEach(
+		func(k, v []byte) (e error) {
+			index, e := fetchRawUnminedCreditIndex(k)
+			if e != nil {
+				return e
+			}
+			script, e := fetchRawTxRecordPkScript(k, existsRawUnmined(ns, k[:32]), index)
+			if e != nil || !bytes.Equal(script, pkScript) {
+				return e
+			}
+			var txHash chainhash.Hash
+			copy(txHash[:], k)
+			unmined[txHash] = struct{}{}
+			outPoints = append(outPoints, append([]byte(nil), k...))
+			return nil
+		},
+	)
+	if e != nil {
+		return nil, e
+	}
+	// Mined spends of the credits are recorded as debits, and unmined spends as unmined inputs.
+	e = ns.NestedReadBucket(bucketDebits).ForEach(
+		func(k, v []byte) (e error) {
+			if len(k) < 72 || len(v) < 80 {
+				str := fmt.Sprintf("%s: short debit record", bucketDebits)
+				return storeError(ErrData, str, nil)
+			}
+			if _, ok := credits[string(extractRawDebitCreditKey(v))]; ok {
+				mined[string(k[:68])] = struct{}{}
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		return nil, e
+	}
+	for _, k := range outPoints {
+		for _, txHash := range fetchUnminedInputSpendTxHashes(ns, k) {
+			unmined[txHash] = struct{}{}
+		}
+	}
+	details := make([]TxDetails, 0, len(mined)+len(unmined))
+	for recKey := range mined {
+		var txHash chainhash.Hash
+		copy(txHash[:], recKey)
+		k := []byte(recKey)
+		detail, e := s.minedTxDetails(ns, &txHash, k, existsRawTxRecord(ns, k))
+		if e != nil {
+			return nil, e
+		}
+		details = append(details, *detail)
+	}
+	for txHash := range unmined {
+		txHash := txHash
+		v := existsRawUnmined(ns, txHash[:])
+		if v == nil {
+			continue
+		}
+		detail, e := s.unminedTxDetails(ns, &txHash, v)
+		if e != nil {
+			return nil, e
+		}
+		details = append(details, *detail)
+	}
+	sort.Slice(
+		details, func(i, j int) bool {
+			a, b := &details[i], &details[j]
+			if a.Block.Height != b.Block.Height {
+				// Unmined transactions have the height -1 and go last.
+				return b.Block.Height == -1 || a.Block.Height != -1 && a.Block.Height < b.Block.Height
+			}
+			if !a.Received.Equal(b.Received) {
+				return a.Received.Before(b.Received)
+			}
+			return bytes.Compare(a.Hash[:], b.Hash[:]) < 0
+		},
+	)
+	return details, nil
+}
@@ -3,6 +3,7 @@ package wtxmgr_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -776,3 +777,223 @@ func TestPreviousPkScripts(t *testing.T) {
 		t.Fatal("Failed after inserting tx D")
 	}
 }
+
+// TestTransactionsForScript ensures the transactions paying to a script through a credit and those spending the credits
+// are found, whether they are mined or unmined.
+func TestTransactionsForScript(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	// Invalid scripts but sufficient for testing.
+	var (
+		scriptX = []byte("script X")
+		scriptY = []byte("script Y")
+		scriptZ = []byte("script Z")
+	)
+	newTxRecord := func(prevOut wire.OutPoint, scripts ...[]byte) *TxRecord {
+		tx := &wire.MsgTx{TxIn: []*wire.TxIn{{PreviousOutPoint: prevOut}}}
+		for _, script := range scripts {
+			tx.TxOut = append(tx.TxOut, &wire.TxOut{Value: 1e8, PkScript: script})
+		}
+		rec, e := NewTxRecordFromMsgTx(tx, timeNow())
+		if e != nil {
+			t.Fatal(e)
+		}
+		return rec
+	}
+	// A is mined and pays to X and Y, B is mined and spends the output to X, and C is unmined, spends the output to Y
+	// and pays to X again. The output of B to Z isn't a credit.
+	var (
+		recA = newTxRecord(wire.OutPoint{}, scriptX, scriptY)
+		recB = newTxRecord(wire.OutPoint{Hash: recA.Hash, Index: 0}, scriptZ)
+		recC = newTxRecord(wire.OutPoint{Hash: recA.Hash, Index: 1}, scriptX)
+		b100 = makeBlockMeta(100)
+		b101 = makeBlockMeta(101)
+	)
+	e = walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			ns := tx.ReadWriteBucket(namespaceKey)
+			for _, insert := range []struct {
+				rec     *TxRecord
+				block   *BlockMeta
+				credits []uint32
+			}{
+				{recA, &b100, []uint32{0, 1}},
+				{recB, &b101, nil},
+				{recC, nil, []uint32{0}},
+			} {
+				if e = s.InsertTx(ns, insert.rec, insert.block); e != nil {
+					return e
+				}
+				for _, index := range insert.credits {
+					if e = s.AddCredit(ns, insert.rec, insert.block, index, false); e != nil {
+						return e
+					}
+				}
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+	tests := []struct {
+		script []byte
+		want   []*TxRecord
+	}{
+		{scriptX, []*TxRecord{recA, recB, recC}},
+		{scriptY, []*TxRecord{recA, recC}},
+		{scriptZ, nil},
+	}
+	e = walletdb.View(
+		db, func(tx walletdb.ReadTx) (e error) {
+			ns := tx.ReadBucket(namespaceKey)
+			for _, test := range tests {
+				details, e := s.TransactionsForScript(ns, test.script)
+				if e != nil {
+					return e
+				}
+				if len(details) != len(test.want) {
+					t.Errorf("script '%s': got %d transactions, want %d", test.script, len(details), len(test.want))
+					continue
+				}
+				for i := range details {
+					if details[i].Hash != test.want[i].Hash {
+						t.Errorf(
+							"script '%s' transaction %d: got %v, want %v",
+							test.script, i, details[i].Hash, test.want[i].Hash,
+						)
+					}
+				}
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+// TestRangeTransactionsContext ensures a range stops at the next block once its context is cancelled, and doesn't start
+// when the context is already done.
+func TestRangeTransactionsContext(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	e = walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			ns := tx.ReadWriteBucket(namespaceKey)
+			for height := int32(100); height < 103; height++ {
+				msgTx := &wire.MsgTx{LockTime: uint32(height)}
+				rec, e := NewTxRecordFromMsgTx(msgTx, timeNow())
+				if e != nil {
+					return e
+				}
+				block := makeBlockMeta(height)
+				if e = s.InsertTx(ns, rec, &block); e != nil {
+					return e
+				}
+			}
+			// An unmined transaction, so a range including them has them to visit.
+			rec, e := NewTxRecordFromMsgTx(&wire.MsgTx{LockTime: 1}, timeNow())
+			if e != nil {
+				return e
+			}
+			return s.InsertTx(ns, rec, nil)
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = walletdb.View(
+		db, func(tx walletdb.ReadTx) (e error) {
+			ns := tx.ReadBucket(namespaceKey)
+			ctx, cancel := context.WithCancel(context.Background())
+			var blocks int
+			e = s.RangeTransactionsContext(
+				ctx, ns, 0, -1, func([]TxDetails) (bool, error) {
+					blocks++
+					cancel()
+					return false, nil
+				},
+			)
+			if e != context.Canceled {
+				t.Errorf("cancelled range returned %v, want %v", e, context.Canceled)
+			}
+			if blocks != 1 {
+				t.Errorf("cancelled range visited %d blocks, want 1", blocks)
+			}
+			e = s.RangeTransactionsContext(
+				ctx, ns, -1, 0, func([]TxDetails) (bool, error) {
+					t.Error("range with a done context visited transactions")
+					return false, nil
+				},
+			)
+			if e != context.Canceled {
+				t.Errorf("range with a done context returned %v, want %v", e, context.Canceled)
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+// TestEarliestTxHeight checks that the earliest transaction height is only found once a mined transaction is recorded,
+// and follows a rollback of the block holding it.
+func TestEarliestTxHeight(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	e = walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			ns := tx.ReadWriteBucket(namespaceKey)
+			check := func(wantHeight int32, wantOK bool) {
+				height, ok, e := s.EarliestTxHeight(ns)
+				if e != nil {
+					t.Fatal(e)
+				}
+				if height != wantHeight || ok != wantOK {
+					t.Fatalf("earliest transaction height is %d (%v), want %d (%v)", height, ok, wantHeight, wantOK)
+				}
+			}
+			rec, e := NewTxRecordFromMsgTx(&wire.MsgTx{LockTime: 1}, timeNow())
+			if e != nil {
+				return e
+			}
+			if e = s.InsertTx(ns, rec, nil); e != nil {
+				return e
+			}
+			check(0, false)
+			for _, height := range []int32{120, 100} {
+				rec, e := NewTxRecordFromMsgTx(&wire.MsgTx{LockTime: uint32(height)}, timeNow())
+				if e != nil {
+					return e
+				}
+				block := makeBlockMeta(height)
+				if e = s.InsertTx(ns, rec, &block); e != nil {
+					return e
+				}
+			}
+			check(100, true)
+			if e = s.Rollback(ns, 100); e != nil {
+				return e
+			}
+			check(0, false)
+			return nil
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+}
@@ -0,0 +1,158 @@
+package wtxmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	
+	"github.com/p9c/pod/pkg/walletdb"
+	"github.com/p9c/pod/pkg/wire"
+)
+
+// snapshotMagic starts a snapshot of a store, followed by snapshotVersion, the version of the snapshot format.
+var snapshotMagic = []byte("wtxs")
+
+const snapshotVersion = 1
+
+// snapshotBuckets are the nested buckets of the store in the order they are written to a snapshot.
+var snapshotBuckets = [][]byte{
+	bucketBlocks,
+	bucketTxRecords,
+	bucketCredits,
+	bucketUnspent,
+	bucketDebits,
+	bucketUnmined,
+	bucketUnminedCredits,
+	bucketUnminedInputs,
+	bucketBroadcasts,
+}
+
+// Snapshot writes every record of the store to w, in a format that doesn't depend on the database engine it is kept
+// in, for it to be backed up and rebuilt with Restore. The records are written as they are stored, so the snapshot of
+// a store has its version and is restored as a store of that version.
+//
+// The snapshot holds the values of the root bucket, followed by each of the nested buckets by name. The key and value
+// pairs of each are written in order as variable length byte strings, and end with an empty key, which the store
+// never uses.
+func (s *Store) Snapshot(ns walletdb.ReadBucket, w io.Writer) (e error) {
+	if _, e = w.Write(snapshotMagic); e != nil {
+		return e
+	}
+	if e = binary.Write(w, byteOrder, uint32(snapshotVersion)); e != nil {
+		return e
+	}
+	if e = writeSnapshotBucket(ns, w); e != nil {
+		return e
+	}
+	for _, name := range snapshotBuckets {
+		b := ns.NestedReadBucket(name)
+		if b == nil {
+			str := fmt.Sprintf("missing bucket %q", name)
+			return storeError(ErrData, str, nil)
+		}
+		if e = wire.WriteVarBytes(w, 0, name); e != nil {
+			return e
+		}
+		if e = writeSnapshotBucket(b, w); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// writeSnapshotBucket writes the key and value pairs of the bucket, other than its nested buckets, followed by an empty
+// key.
+func writeSnapshotBucket(b walletdb.ReadBucket, w io.Writer) (e error) {
+	e = b.ForEach(
+		func(k, v []byte) (e error) {
+			// Nested buckets have nil values and are written after the root bucket.
+			if v == nil {
+				return nil
+			}
+			if e = wire.WriteVarBytes(w, 0, k); e != nil {
+				return e
+			}
+			return wire.WriteVarBytes(w, 0, v)
+		},
+	)
+	if e != nil {
+		return e
+	}
+	return wire.WriteVarBytes(w, 0, nil)
+}
+
+// Restore rebuilds a store in the empty namespace from a snapshot written by Store.Snapshot. If the namespace is not
+// empty ErrAlreadyExists is returned. A snapshot of an older version of the store is upgraded when the wallet next
+// runs DoUpgrades.
+func Restore(ns walletdb.ReadWriteBucket, r io.Reader) (e error) {
+	ck, cv := ns.ReadCursor().First()
+	if ck != nil || cv != nil {
+		const str = "namespace is not empty"
+		return storeError(ErrAlreadyExists, str, nil)
+	}
+	magic := make([]byte, len(snapshotMagic))
+	if _, e = io.ReadFull(r, magic); e != nil || !bytes.Equal(magic, snapshotMagic) {
+		str := "not a transaction store snapshot"
+		return storeError(ErrInput, str, e)
+	}
+	var version uint32
+	if e = binary.Read(r, byteOrder, &version); e != nil {
+		str := "failed to read snapshot version"
+		return storeError(ErrInput, str, e)
+	}
+	if version != snapshotVersion {
+		str := fmt.Sprintf("unknown snapshot version %d", version)
+		return storeError(ErrInput, str, nil)
+	}
+	if e = readSnapshotBucket(ns, r); e != nil {
+		return e
+	}
+	if len(ns.Get(rootVersion)) != 4 {
+		str := "snapshot has no store version"
+		return storeError(ErrInput, str, nil)
+	}
+	for _, name := range snapshotBuckets {
+		var got []byte
+		if got, e = wire.ReadVarBytes(r, 0, wire.MaxMessagePayload, "bucket"); e != nil {
+			str := fmt.Sprintf("failed to read snapshot of bucket %q", name)
+			return storeError(ErrInput, str, e)
+		}
+		if !bytes.Equal(got, name) {
+			str := fmt.Sprintf("snapshot has bucket %q in place of %q", got, name)
+			return storeError(ErrInput, str, nil)
+		}
+		var b walletdb.ReadWriteBucket
+		if b, e = ns.CreateBucket(name); e != nil {
+			str := fmt.Sprintf("failed to create bucket %q", name)
+			return storeError(ErrDatabase, str, e)
+		}
+		if e = readSnapshotBucket(b, r); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// readSnapshotBucket puts the key and value pairs read from the snapshot in the bucket, up to the empty key ending
+// them.
+func readSnapshotBucket(b walletdb.ReadWriteBucket, r io.Reader) (e error) {
+	for {
+		var k, v []byte
+		if k, e = wire.ReadVarBytes(r, 0, wire.MaxMessagePayload, "key"); e != nil {
+			str := "failed to read snapshot key"
+			return storeError(ErrInput, str, e)
+		}
+		if len(k) == 0 {
+			return nil
+		}
+		if v, e = wire.ReadVarBytes(r, 0, wire.MaxMessagePayload, "value"); e != nil {
+			str := "failed to read snapshot value"
+			return storeError(ErrInput, str, e)
+		}
+		if e = b.Put(k, v); e != nil {
+			str := "failed to put snapshot record"
+			return storeError(ErrDatabase, str, e)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package wtxmgr
+
+import (
+	"sort"
+	
+	"github.com/p9c/pod/pkg/walletdb"
+)
+
+// The records of the store are only read and written through the walletdb.ReadBucket and walletdb.ReadWriteBucket
+// interfaces of the namespace bucket passed to its methods, which are the storage backend of the store. A walletdb
+// database is the default, and any other key value engine can be used by implementing the two interfaces; the nested
+// buckets, point reads and writes and ordered cursors in them are all the store needs. The point reads and writes of
+// records all go through Storage, which a namespace can implement itself to serve them without the nested buckets.
+
+// Storage is the minimal interface the store reads, writes and deletes single records through. The bucket is the key
+// of one of the nested buckets of the namespace, or nil for the keys of the namespace itself.
+type Storage interface {
+	// FetchValue returns the value of the key in the bucket, or nil if it has none.
+	FetchValue(bucket, key []byte) []byte
+	// PutValue sets the value of the key in the bucket.
+	PutValue(bucket, key, value []byte) error
+	// DeleteValue removes the key from the bucket. Deleting a key that isn't in the bucket is not an error.
+	DeleteValue(bucket, key []byte) error
+}
+
+// storageOf returns the Storage of the namespace, which is the namespace itself when it implements Storage and
+// otherwise the nested buckets of the namespace.
+func storageOf(ns walletdb.ReadBucket) Storage {
+	if s, ok := ns.(Storage); ok {
+		return s
+	}
+	return bucketStorage{ns}
+}
+
+// bucketStorage is the Storage of a namespace that keeps the records in its nested buckets.
+type bucketStorage struct {
+	ns walletdb.ReadBucket
+}
+
+func (s bucketStorage) FetchValue(bucket, key []byte) []byte {
+	if bucket == nil {
+		return s.ns.Get(key)
+	}
+	return s.ns.NestedReadBucket(bucket).Get(key)
+}
+
+func (s bucketStorage) PutValue(bucket, key, value []byte) (e error) {
+	b, e := s.writeBucket(bucket)
+	if e != nil {
+		return e
+	}
+	return b.Put(key, value)
+}
+
+func (s bucketStorage) DeleteValue(bucket, key []byte) (e error) {
+	b, e := s.writeBucket(bucket)
+	if e != nil {
+		return e
+	}
+	return b.Delete(key)
+}
+
+// writeBucket returns the bucket to write to, which the namespace must be writable for.
+func (s bucketStorage) writeBucket(bucket []byte) (walletdb.ReadWriteBucket, error) {
+	ns, ok := s.ns.(walletdb.ReadWriteBucket)
+	if !ok {
+		return nil, walletdb.ErrTxNotWritable
+	}
+	if bucket == nil {
+		return ns, nil
+	}
+	return ns.NestedReadWriteBucket(bucket), nil
+}
+
+// NewMemoryNamespace returns an empty namespace bucket held in memory, which a store can be created in with Create and
+// opened with Open in place of a bucket of a walletdb database. Nothing written to it is persisted and it is not safe
+// for concurrent access, so it suits tests of the queries of the store that don't need a database on disk.
+func NewMemoryNamespace() walletdb.ReadWriteBucket {
+	return newMemBucket()
+}
+
+// memBucket is a walletdb.ReadWriteBucket kept in memory. Its keys are kept sorted for the cursors, and a key holds
+// either a value or a nested bucket.
+type memBucket struct {
+	keys    []string
+	values  map[string][]byte
+	buckets map[string]*memBucket
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{
+		values:  make(map[string][]byte),
+		buckets: make(map[string]*memBucket),
+	}
+}
+
+// NestedReadBucket returns the nested bucket with the given key, or nil if there is none.
+func (b *memBucket) NestedReadBucket(key []byte) walletdb.ReadBucket {
+	if nb, ok := b.buckets[string(key)]; ok {
+		return nb
+	}
+	return nil
+}
+
+// NestedReadWriteBucket returns the nested bucket with the given key, or nil if there is none.
+func (b *memBucket) NestedReadWriteBucket(key []byte) walletdb.ReadWriteBucket {
+	if nb, ok := b.buckets[string(key)]; ok {
+		return nb
+	}
+	return nil
+}
+
+// ForEach invokes fn with every key in the bucket in order, with a nil value for the keys of nested buckets.
+func (b *memBucket) ForEach(fn func(k, v []byte) error) (e error) {
+	for _, k := range append([]string(nil), b.keys...) {
+		if e = fn([]byte(k), b.values[k]); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Get returns the value of the key, or nil if it has none or is a nested bucket.
+func (b *memBucket) Get(key []byte) []byte {
+	return b.values[string(key)]
+}
+
+// CreateBucket creates the nested bucket with the given key, and fails if the key is already in use.
+func (b *memBucket) CreateBucket(key []byte) (walletdb.ReadWriteBucket, error) {
+	k := string(key)
+	if k == "" {
+		return nil, walletdb.ErrBucketNameRequired
+	}
+	if _, ok := b.buckets[k]; ok {
+		return nil, walletdb.ErrBucketExists
+	}
+	if _, ok := b.values[k]; ok {
+		return nil, walletdb.ErrIncompatibleValue
+	}
+	nb := newMemBucket()
+	b.buckets[k] = nb
+	b.insertKey(k)
+	return nb, nil
+}
+
+// CreateBucketIfNotExists returns the nested bucket with the given key, creating it if there is none.
+func (b *memBucket) CreateBucketIfNotExists(key []byte) (walletdb.ReadWriteBucket, error) {
+	if nb, ok := b.buckets[string(key)]; ok {
+		return nb, nil
+	}
+	return b.CreateBucket(key)
+}
+
+// DeleteNestedBucket removes the nested bucket with the given key and everything in it.
+func (b *memBucket) DeleteNestedBucket(key []byte) (e error) {
+	k := string(key)
+	if _, ok := b.buckets[k]; !ok {
+		return walletdb.ErrBucketNotFound
+	}
+	delete(b.buckets, k)
+	b.removeKey(k)
+	return nil
+}
+
+// Put sets the value of the key to a copy of value.
+func (b *memBucket) Put(key, value []byte) (e error) {
+	k := string(key)
+	if k == "" {
+		return walletdb.ErrKeyRequired
+	}
+	if _, ok := b.buckets[k]; ok {
+		return walletdb.ErrIncompatibleValue
+	}
+	if _, ok := b.values[k]; !ok {
+		b.insertKey(k)
+	}
+	b.values[k] = append(make([]byte, 0, len(value)), value...)
+	return nil
+}
+
+// Delete removes the key and its value. Deleting a key that isn't in the bucket is not an error.
+func (b *memBucket) Delete(key []byte) (e error) {
+	k := string(key)
+	if _, ok := b.buckets[k]; ok {
+		return walletdb.ErrIncompatibleValue
+	}
+	if _, ok := b.values[k]; ok {
+		delete(b.values, k)
+		b.removeKey(k)
+	}
+	return nil
+}
+
+// ReadCursor returns a cursor over the keys of the bucket.
+func (b *memBucket) ReadCursor() walletdb.ReadCursor {
+	return &memCursor{bucket: b}
+}
+
+// ReadWriteCursor returns a cursor over the keys of the bucket that can delete the key it is at.
+func (b *memBucket) ReadWriteCursor() walletdb.ReadWriteCursor {
+	return &memCursor{bucket: b}
+}
+
+func (b *memBucket) insertKey(k string) {
+	i := sort.SearchStrings(b.keys, k)
+	b.keys = append(b.keys, "")
+	copy(b.keys[i+1:], b.keys[i:])
+	b.keys[i] = k
+}
+
+func (b *memBucket) removeKey(k string) {
+	i := sort.SearchStrings(b.keys, k)
+	if i < len(b.keys) && b.keys[i] == k {
+		b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	}
+}
+
+// memCursor walks the keys of a memBucket. It remembers the key it is at rather than its index, so that keys written
+// and deleted while it is open don't make it skip or repeat keys.
+type memCursor struct {
+	bucket  *memBucket
+	key     string
+	started bool
+	// valid is set while the cursor is at a key of the bucket, and end when it was moved past the last key, from where
+	// Prev moves back to it.
+	valid, end bool
+}
+
+// at moves the cursor to the key at index i, returning nils when it is out of range.
+func (c *memCursor) at(i int) (key, value []byte) {
+	c.started = true
+	if i < 0 || i >= len(c.bucket.keys) {
+		c.valid, c.end = false, i >= 0
+		return nil, nil
+	}
+	c.valid, c.end = true, false
+	c.key = c.bucket.keys[i]
+	return []byte(c.key), c.bucket.values[c.key]
+}
+
+func (c *memCursor) First() (key, value []byte) {
+	return c.at(0)
+}
+
+func (c *memCursor) Last() (key, value []byte) {
+	return c.at(len(c.bucket.keys) - 1)
+}
+
+func (c *memCursor) Next() (key, value []byte) {
+	if !c.started {
+		return c.First()
+	}
+	if !c.valid {
+		return nil, nil
+	}
+	i := sort.SearchStrings(c.bucket.keys, c.key)
+	if i < len(c.bucket.keys) && c.bucket.keys[i] == c.key {
+		i++
+	}
+	return c.at(i)
+}
+
+func (c *memCursor) Prev() (key, value []byte) {
+	if !c.started || c.end {
+		return c.Last()
+	}
+	if !c.valid {
+		return nil, nil
+	}
+	return c.at(sort.SearchStrings(c.bucket.keys, c.key) - 1)
+}
+
+func (c *memCursor) Seek(seek []byte) (key, value []byte) {
+	return c.at(sort.SearchStrings(c.bucket.keys, string(seek)))
+}
+
+// Delete removes the key the cursor is at.
+func (c *memCursor) Delete() (e error) {
+	if !c.valid {
+		return nil
+	}
+	return c.bucket.Delete([]byte(c.key))
+}
@@ -2,6 +2,8 @@ package wtxmgr
 
 import (
 	"bytes"
+	"fmt"
+	"sort"
 	amount2 "github.com/p9c/pod/pkg/amt"
 	"github.com/p9c/pod/pkg/chaincfg"
 	"time"
@@ -55,8 +57,10 @@ type (
 		outPoint wire.OutPoint
 		block    Block
 		amount   amount2.Amount
-		change   bool
-		spentBy  indexedIncidence // Index == ^uint32(0) if unspent
+		change    bool
+		coinbase  bool
+		watchOnly bool
+		spentBy   indexedIncidence // Index == ^uint32(0) if unspent
 	}
 	// TxRecord represents a transaction managed by the Store.
 	TxRecord struct {
@@ -74,12 +78,24 @@ type (
 		PkScript     []byte
 		Received     time.Time
 		FromCoinBase bool
+		// WatchOnly is set for the outputs of addresses the wallet watches but holds no keys for.
+		WatchOnly bool
 	}
 	// Store implements a transaction store for storing and managing wallet transactions.
 	Store struct {
 		chainParams *chaincfg.Params
+		// chainLimits bound the chains of dependent unmined transactions. None apply until SetChainLimits is called.
+		chainLimits ChainLimits
 		// Event callbacks. These execute in the same goroutine as the wtxmgr caller.
 		NotifyUnspent func(hash *chainhash.Hash, index uint32)
+		// NotifyChainLimitDrop is called with the unmined transactions that a rollback removed because their chains
+		// exceeded the chain limits.
+		NotifyChainLimitDrop func(txHashes []chainhash.Hash)
+		// NotifyBalanceChange is called by BalanceChangesCommitted with the credit totals changed by a committed
+		// database transaction.
+		NotifyBalanceChange func(change BalanceChange)
+		// balances holds the credit totals last notified.
+		balances balanceTracker
 	}
 )
 
@@ -119,8 +135,15 @@ func NewTxRecordFromMsgTx(msgTx *wire.MsgTx, received time.Time) (*TxRecord, err
 // DoUpgrades performs any necessary upgrades to the transaction history contained in the wallet database, namespaced by
 // the top level bucket key namespaceKey.
 func DoUpgrades(db walletdb.DB, namespaceKey []byte) (e error) {
-	// No upgrades
-	return nil
+	return walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			ns := tx.ReadWriteBucket(namespaceKey)
+			if ns == nil {
+				return nil
+			}
+			return upgradeStore(ns)
+		},
+	)
 }
 
 // Open opens the wallet transaction store from a walletdb namespace.
@@ -131,7 +154,10 @@ func Open(ns walletdb.ReadBucket, chainParams *chaincfg.Params) (*Store, error)
 	if e != nil {
 		return nil, e
 	}
-	s := &Store{chainParams, nil} // TODO: set callbacks
+	s := &Store{chainParams: chainParams} // TODO: set callbacks
+	if s.balances.mined, s.balances.unmined, e = balanceTotals(ns); E.Chk(e) {
+		return nil, e
+	}
 	return s, nil
 }
 
@@ -152,6 +178,23 @@ func (s *Store) updateMinedBalance(
 	if e != nil {
 		return e
 	}
+	newMinedBalance, e := s.moveMinedBalance(ns, rec, block, minedBalance)
+	if e != nil {
+		return e
+	}
+	// Update the balance if it has changed.
+	if newMinedBalance != minedBalance {
+		return putMinedBalance(ns, newMinedBalance)
+	}
+	return nil
+}
+
+// moveMinedBalance records the debits and credits of a transaction mined in block, and returns the mined balance
+// changed from minedBalance by them.
+func (s *Store) moveMinedBalance(
+	ns walletdb.ReadWriteBucket, rec *TxRecord,
+	block *BlockMeta, minedBalance amount2.Amount,
+) (amount2.Amount, error) {
 	// Add a debit record for each unspent credit spent by this transaction. The index is set in each iteration below.
 	spender := indexedIncidence{
 		incidence: incidence{
@@ -179,16 +222,16 @@ func (s *Store) updateMinedBalance(
 		spender.index = uint32(i)
 		amt, e := spendCredit(ns, credKey, &spender)
 		if e != nil {
-			return e
+			return 0, e
 		}
 		e = putDebit(
 			ns, &rec.Hash, uint32(i), amt, &block.Block, credKey,
 		)
 		if e != nil {
-			return e
+			return 0, e
 		}
 		if e := deleteRawUnspent(ns, unspentKey); E.Chk(e) {
-			return e
+			return 0, e
 		}
 		newMinedBalance -= amt
 	}
@@ -207,32 +250,29 @@ func (s *Store) updateMinedBalance(
 		//  credits bucket. The key needs a modification to include the block height/hash.
 		index, e := fetchRawUnminedCreditIndex(it.ck)
 		if e != nil {
-			return e
+			return 0, e
 		}
 		amount, change, e := fetchRawUnminedCreditAmountChange(it.cv)
 		if e != nil {
-			return e
+			return 0, e
 		}
 		cred.outPoint.Index = index
 		cred.amount = amount
 		cred.change = change
+		cred.watchOnly = fetchRawCreditWatchOnly(it.cv)
 		if e := putUnspentCredit(ns, &cred); E.Chk(e) {
-			return e
+			return 0, e
 		}
 		e = putUnspent(ns, &cred.outPoint, &block.Block)
 		if e != nil {
-			return e
+			return 0, e
 		}
 		newMinedBalance += amount
 	}
 	if it.err != nil {
-		return it.err
-	}
-	// Update the balance if it has changed.
-	if newMinedBalance != minedBalance {
-		return putMinedBalance(ns, newMinedBalance)
+		return 0, it.err
 	}
-	return nil
+	return newMinedBalance, nil
 }
 
 // deleteUnminedTx deletes an unmined transaction from the store.
@@ -245,12 +285,16 @@ func (s *Store) deleteUnminedTx(ns walletdb.ReadWriteBucket, rec *TxRecord) (e e
 			return e
 		}
 	}
+	if e = deleteRawBroadcast(ns, rec.Hash[:]); E.Chk(e) {
+		return e
+	}
 	return deleteRawUnmined(ns, rec.Hash[:])
 }
 
 // InsertTx records a transaction as belonging to a wallet's transaction history. If block is nil, the transaction is
 // considered unspent, and the transaction's index must be unset.
 func (s *Store) InsertTx(ns walletdb.ReadWriteBucket, rec *TxRecord, block *BlockMeta) (e error) {
+	s.balanceChanged()
 	if block == nil {
 		return s.insertMemPoolTx(ns, rec)
 	}
@@ -262,6 +306,7 @@ func (s *Store) InsertTx(ns walletdb.ReadWriteBucket, rec *TxRecord, block *Bloc
 // This function we remove the conflicting transaction identified by the tx record, and also recursively remove all
 // transactions that depend on it.
 func (s *Store) RemoveUnminedTx(ns walletdb.ReadWriteBucket, rec *TxRecord) (e error) {
+	s.balanceChanged()
 	// As we already have a tx record, we can directly call the RemoveConflict method. This will do the job of
 	// recursively removing this unmined transaction, and any transactions that depend on it.
 	return RemoveConflict(ns, rec)
@@ -314,6 +359,68 @@ func (s *Store) insertMinedTx(
 	return s.removeDoubleSpends(ns, rec)
 }
 
+// MineUnminedTxs moves the unmined transactions with the given hashes into block at once, as when a block connects
+// with several of them. The block record, the moved debits and credits and the mined balance are each written once for
+// all of them, in dependency order so that transactions spending the credits of others in the batch are moved after
+// them, and unmined double spends of each are removed as InsertTx would. It returns the change in the mined balance.
+func (s *Store) MineUnminedTxs(
+	ns walletdb.ReadWriteBucket, txHashes []*chainhash.Hash,
+	block *BlockMeta,
+) (delta amount2.Amount, e error) {
+	unmined := make(map[chainhash.Hash]*TxRecord, len(txHashes))
+	for _, txHash := range txHashes {
+		v := existsRawUnmined(ns, txHash[:])
+		if v == nil {
+			str := fmt.Sprintf("transaction %v is not unmined", txHash)
+			return 0, storeError(ErrInput, str, nil)
+		}
+		rec := &TxRecord{Hash: *txHash}
+		if e = readRawTxRecord(&rec.Hash, v, rec); e != nil {
+			return 0, e
+		}
+		unmined[rec.Hash] = rec
+	}
+	if len(unmined) == 0 {
+		return 0, nil
+	}
+	s.balanceChanged()
+	minedBalance, e := fetchMinedBalance(ns)
+	if e != nil {
+		return 0, e
+	}
+	newMinedBalance := minedBalance
+	blockKey, blockValue := existsBlockRecord(ns, block.Height)
+	for _, rec := range dependencySort(unmined) {
+		if blockValue == nil {
+			blockKey, blockValue = keyBlockRecord(block.Height), valueBlockRecord(block, &rec.Hash)
+		} else if blockValue, e = appendRawBlockRecord(blockValue, &rec.Hash); e != nil {
+			return 0, e
+		}
+		if e = putTxRecord(ns, rec, &block.Block); E.Chk(e) {
+			return 0, e
+		}
+		if newMinedBalance, e = s.moveMinedBalance(ns, rec, block, newMinedBalance); E.Chk(e) {
+			return 0, e
+		}
+		if e = s.deleteUnminedTx(ns, rec); E.Chk(e) {
+			return 0, e
+		}
+		if e = s.removeDoubleSpends(ns, rec); E.Chk(e) {
+			return 0, e
+		}
+	}
+	if e = putRawBlockRecord(ns, blockKey, blockValue); E.Chk(e) {
+		return 0, e
+	}
+	if newMinedBalance != minedBalance {
+		if e = putMinedBalance(ns, newMinedBalance); E.Chk(e) {
+			return 0, e
+		}
+	}
+	I.F("marked %d unconfirmed transactions mined in block %d", len(unmined), block.Height)
+	return newMinedBalance - minedBalance, nil
+}
+
 // AddCredit marks a transaction record as containing a transaction output spendable by wallet. The output is added
 // unspent, and is marked spent when a new transaction spending the output is inserted into the store.
 //
@@ -330,7 +437,29 @@ func (s *Store) AddCredit(
 		str := "transaction output does not exist"
 		return storeError(ErrInput, str, nil)
 	}
-	isNew, e := s.addCredit(ns, rec, block, index, change)
+	s.balanceChanged()
+	isNew, e := s.addCredit(ns, rec, block, index, change, false)
+	if e == nil && isNew && s.NotifyUnspent != nil {
+		s.NotifyUnspent(&rec.Hash, index)
+	}
+	return e
+}
+
+// AddWatchOnlyCredit marks a transaction record as containing a transaction output paying an address the wallet
+// watches but can't spend from. Watch-only credits are tracked like any other, but are left out of Balance,
+// SpendableOutputs and SelectUnspent, and are counted by WatchOnlyBalance instead.
+func (s *Store) AddWatchOnlyCredit(
+	ns walletdb.ReadWriteBucket,
+	rec *TxRecord,
+	block *BlockMeta,
+	index uint32,
+) (e error) {
+	if int(index) >= len(rec.MsgTx.TxOut) {
+		str := "transaction output does not exist"
+		return storeError(ErrInput, str, nil)
+	}
+	s.balanceChanged()
+	isNew, e := s.addCredit(ns, rec, block, index, false, true)
 	if e == nil && isNew && s.NotifyUnspent != nil {
 		s.NotifyUnspent(&rec.Hash, index)
 	}
@@ -345,6 +474,7 @@ func (s *Store) addCredit(
 	block *BlockMeta,
 	index uint32,
 	change bool,
+	watchOnly bool,
 ) (bool, error) {
 	if block == nil {
 		// If the outpoint that we should mark as credit already exists within the store, either as unconfirmed or
@@ -356,7 +486,7 @@ func (s *Store) addCredit(
 		if existsRawUnspent(ns, k) != nil {
 			return false, nil
 		}
-		v := valueUnminedCredit(amount2.Amount(rec.MsgTx.TxOut[index].Value), change)
+		v := valueUnminedCredit(amount2.Amount(rec.MsgTx.TxOut[index].Value), change, watchOnly)
 		return true, putRawUnminedCredit(ns, k, v)
 	}
 	k, v := existsCredit(ns, &rec.Hash, index, &block.Block)
@@ -373,10 +503,12 @@ func (s *Store) addCredit(
 			Hash:  rec.Hash,
 			Index: index,
 		},
-		block:   block.Block,
-		amount:  txOutAmt,
-		change:  change,
-		spentBy: indexedIncidence{index: ^uint32(0)},
+		block:     block.Block,
+		amount:    txOutAmt,
+		change:    change,
+		coinbase:  blockchain.IsCoinBaseTx(&rec.MsgTx),
+		watchOnly: watchOnly,
+		spentBy:   indexedIncidence{index: ^uint32(0)},
 	}
 	v = valueUnspentCredit(&cred)
 	e := putRawCredit(ns, k, v)
@@ -396,6 +528,7 @@ func (s *Store) addCredit(
 
 // Rollback removes all blocks at height onwards, moving any transactions within each block to the unconfirmed pool.
 func (s *Store) Rollback(ns walletdb.ReadWriteBucket, height int32) (e error) {
+	s.balanceChanged()
 	return s.rollback(ns, height)
 }
 func (s *Store) rollback(ns walletdb.ReadWriteBucket, height int32) (e error) {
@@ -533,7 +666,7 @@ func (s *Store) rollback(ns walletdb.ReadWriteBucket, height int32) (e error) {
 					return e
 				}
 				outPointKey := canonicalOutPoint(&rec.Hash, uint32(i))
-				unminedCredVal := valueUnminedCredit(amt, change)
+				unminedCredVal := valueUnminedCredit(amt, change, fetchRawCreditWatchOnly(v))
 				e = putRawUnminedCredit(ns, outPointKey, unminedCredVal)
 				if e != nil {
 					return e
@@ -570,6 +703,14 @@ func (s *Store) rollback(ns walletdb.ReadWriteBucket, height int32) (e error) {
 			return e
 		}
 	}
+	// The transactions moved to the unmined set can form chains that are longer than inserting them would have allowed.
+	dropped, e := s.PruneUnminedChains(ns)
+	if e != nil {
+		return e
+	}
+	if len(dropped) > 0 && s.NotifyChainLimitDrop != nil {
+		s.NotifyChainLimitDrop(dropped)
+	}
 	for _, op := range coinBaseCredits {
 		opKey := canonicalOutPoint(&op.Hash, op.Index)
 		unminedSpendTxHashKeys := fetchUnminedInputSpendTxHashes(ns, opKey)
@@ -635,6 +776,7 @@ func // UnspentOutputs returns all unspent received transaction outputs.
 				return e
 			}
 			txOut := rec.MsgTx.TxOut[op.Index]
+			_, credVal := existsCredit(ns, &op.Hash, op.Index, &block)
 			cred := Credit{
 				OutPoint: op,
 				BlockMeta: BlockMeta{
@@ -645,6 +787,7 @@ func // UnspentOutputs returns all unspent received transaction outputs.
 				PkScript:     txOut.PkScript,
 				Received:     rec.Received,
 				FromCoinBase: blockchain.IsCoinBaseTx(&rec.MsgTx),
+				WatchOnly:    fetchRawCreditWatchOnly(credVal),
 			}
 			unspent = append(unspent, cred)
 			return nil
@@ -686,6 +829,7 @@ func // UnspentOutputs returns all unspent received transaction outputs.
 				PkScript:     txOut.PkScript,
 				Received:     rec.Received,
 				FromCoinBase: blockchain.IsCoinBaseTx(&rec.MsgTx),
+				WatchOnly:    fetchRawCreditWatchOnly(v),
 			}
 			unspent = append(unspent, cred)
 			return nil
@@ -701,10 +845,127 @@ func // UnspentOutputs returns all unspent received transaction outputs.
 	return unspent, nil
 }
 
+// SpendableOutputs returns the unspent outputs with at least minConf confirmations at a chain height of syncHeight.
+// Coinbase outputs are left out until they reach the chain's coinbase maturity, and watch-only outputs are always left
+// out. The order is undefined.
+func (s *Store) SpendableOutputs(ns walletdb.ReadBucket, minConf int32, syncHeight int32) ([]Credit, error) {
+	return s.matureOutputs(ns, minConf, syncHeight, false)
+}
+
+// WatchOnlyBalance returns the total value of the unspent watch-only outputs with at least minConf confirmations at a
+// chain height of syncHeight, counting coinbase outputs once they reach maturity as Balance does.
+func (s *Store) WatchOnlyBalance(ns walletdb.ReadBucket, minConf int32, syncHeight int32) (amount2.Amount, error) {
+	watched, e := s.matureOutputs(ns, minConf, syncHeight, true)
+	if e != nil {
+		return 0, e
+	}
+	var bal amount2.Amount
+	for _, cred := range watched {
+		bal += cred.Amount
+	}
+	return bal, nil
+}
+
+// matureOutputs returns the unspent outputs that are watch-only or not, as asked, and that have at least minConf
+// confirmations at a chain height of syncHeight and are not immature coinbase outputs.
+func (s *Store) matureOutputs(
+	ns walletdb.ReadBucket, minConf int32, syncHeight int32, watchOnly bool,
+) ([]Credit, error) {
+	unspent, e := s.UnspentOutputs(ns)
+	if e != nil {
+		return nil, e
+	}
+	spendable := unspent[:0]
+	for _, cred := range unspent {
+		if cred.WatchOnly != watchOnly {
+			continue
+		}
+		var confs int32
+		if cred.Height != -1 && cred.Height <= syncHeight {
+			confs = syncHeight - cred.Height + 1
+		}
+		if confs < minConf {
+			continue
+		}
+		if cred.FromCoinBase && (cred.Height == -1 ||
+			immatureCoinbase(cred.Height, syncHeight, s.chainParams.CoinbaseMaturity)) {
+			continue
+		}
+		spendable = append(spendable, cred)
+	}
+	return spendable, nil
+}
+
+// SelectUnspent selects spendable outputs with at least minConf confirmations at a chain height of syncHeight that add
+// up to at least target, taking the largest outputs first, and returns them along with their total. An error with the
+// ErrInsufficientFunds code is returned if all the spendable outputs add up to less than target.
+func (s *Store) SelectUnspent(
+	ns walletdb.ReadBucket, target amount2.Amount, minConf int32, syncHeight int32,
+) ([]Credit, amount2.Amount, error) {
+	spendable, e := s.SpendableOutputs(ns, minConf, syncHeight)
+	if e != nil {
+		return nil, 0, e
+	}
+	sort.Slice(
+		spendable, func(i, j int) bool {
+			if spendable[i].Amount != spendable[j].Amount {
+				return spendable[i].Amount > spendable[j].Amount
+			}
+			return bytes.Compare(
+				canonicalOutPoint(&spendable[i].Hash, spendable[i].Index),
+				canonicalOutPoint(&spendable[j].Hash, spendable[j].Index),
+			) < 0
+		},
+	)
+	var total amount2.Amount
+	for i, cred := range spendable {
+		if total >= target {
+			return spendable[:i], total, nil
+		}
+		total += cred.Amount
+	}
+	if total < target {
+		str := fmt.Sprintf("spendable outputs total %v, need %v", total, target)
+		return nil, total, storeError(ErrInsufficientFunds, str, nil)
+	}
+	return spendable, total, nil
+}
+
+// RecomputeMinedBalance totals the mined credits that are not spent by a mined transaction, which is what the mined
+// balance records, and writes the total as the mined balance, repairing it if it had drifted from the credits. The
+// balance is returned.
+func (s *Store) RecomputeMinedBalance(ns walletdb.ReadWriteBucket) (minedBalance amount2.Amount, e error) {
+	e = ns.NestedReadBucket(bucketCredits).ForEach(
+		func(k, v []byte) (e error) {
+			amt, spent, e := fetchRawCreditAmountSpent(v)
+			if e != nil {
+				return e
+			}
+			if !spent {
+				minedBalance += amt
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		if _, ok := e.(TxMgrError); ok {
+			return 0, e
+		}
+		str := "failed iterating credits"
+		return 0, storeError(ErrDatabase, str, e)
+	}
+	s.balanceChanged()
+	if e = putMinedBalance(ns, minedBalance); e != nil {
+		return 0, e
+	}
+	return minedBalance, nil
+}
+
 func // Balance returns the spendable wallet balance (total value of all unspent
 // transaction outputs) given a minimum of minConf confirmations, calculated
 // at a current chain height of curHeight.  Coinbase outputs are only included
-// in the balance if maturity has been reached.
+// in the balance if maturity has been reached, and watch-only outputs are never
+// included.
 //
 // Balance may return unexpected results if syncHeight is lower than the block
 // height of the most recent mined transaction in the store.
@@ -727,9 +988,9 @@ func // Balance returns the spendable wallet balance (total value of all unspent
 			if e != nil {
 				return e
 			}
-			if existsRawUnminedInput(ns, k) != nil {
-				_, v := existsCredit(ns, &op.Hash, op.Index, &block)
-				amt, e := fetchRawCreditAmount(v)
+			_, credVal := existsCredit(ns, &op.Hash, op.Index, &block)
+			if existsRawUnminedInput(ns, k) != nil || fetchRawCreditWatchOnly(credVal) {
+				amt, e := fetchRawCreditAmount(credVal)
 				if e != nil {
 					return e
 				}
@@ -775,7 +1036,9 @@ func // Balance returns the spendable wallet balance (total value of all unspent
 					continue
 				}
 				_, v := existsCredit(ns, txHash, i, &block.Block)
-				if v == nil {
+				// Watch-only credits were already taken out of the balance along with those spent by
+				// unmined transactions.
+				if v == nil || fetchRawCreditWatchOnly(v) {
 					continue
 				}
 				amt, spent, e := fetchRawCreditAmountSpent(v)
@@ -786,8 +1049,8 @@ func // Balance returns the spendable wallet balance (total value of all unspent
 					continue
 				}
 				confs := syncHeight - block.Height + 1
-				if confs < minConf || (blockchain.IsCoinBaseTx(&rec.MsgTx) &&
-					confs < coinbaseMaturity) {
+				if confs < minConf || (fetchRawCreditCoinbase(v) &&
+					immatureCoinbase(block.Height, syncHeight, s.chainParams.CoinbaseMaturity)) {
 					bal -= amt
 				}
 			}
@@ -801,9 +1064,9 @@ func // Balance returns the spendable wallet balance (total value of all unspent
 	if minConf == 0 {
 		e = ns.NestedReadBucket(bucketUnminedCredits).ForEach(
 			func(k, v []byte) (e error) {
-				if existsRawUnminedInput(ns, k) != nil {
-					// Output is spent by an unmined transaction.
-					// Skip to next unmined credit.
+				if existsRawUnminedInput(ns, k) != nil || fetchRawCreditWatchOnly(v) {
+					// Output is spent by an unmined transaction or
+					// watch-only.  Skip to next unmined credit.
 					return nil
 				}
 				amount, e := fetchRawUnminedCreditAmount(v)
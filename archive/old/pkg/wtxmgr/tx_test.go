@@ -3,10 +3,12 @@ package wtxmgr_test
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"github.com/p9c/pod/pkg/amt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 	
@@ -764,6 +766,18 @@ func TestCoinbases(t *testing.T) {
 		if bal != tst.bal {
 			t.Errorf("Balance test %d: Got %v Expected %v", i, bal, tst.bal)
 		}
+		// The spendable outputs must add up to the same balance.
+		spendable, e := s.SpendableOutputs(ns, tst.minConf, tst.height)
+		if e != nil {
+			t.Fatalf("Balance test %d: Store.SpendableOutputs failed: %v", i, e)
+		}
+		var total amt.Amount
+		for _, cred := range spendable {
+			total += cred.Amount
+		}
+		if total != tst.bal {
+			t.Errorf("Balance test %d: spendable outputs total %v Expected %v", i, total, tst.bal)
+		}
 	}
 	if t.Failed() {
 		t.Fatal("Failed balance checks after inserting coinbase")
@@ -1199,6 +1213,104 @@ func TestMoveMultipleToSameBlock(t *testing.T) {
 	}
 }
 
+// TestMineUnminedTxs moves a batch of unmined transactions, one spending a credit of another, into a block at once.
+func TestMineUnminedTxs(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	dbtx, e := db.BeginReadWriteTx()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		e := dbtx.Commit()
+		if e != nil {
+			t.Log(e)
+		}
+	}()
+	ns := dbtx.ReadWriteBucket(namespaceKey)
+	b100 := BlockMeta{Block: Block{Height: 100}, Time: time.Now()}
+	cbRec, e := NewTxRecordFromMsgTx(newCoinBase(20e8, 30e8), b100.Time)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.InsertTx(ns, cbRec, &b100); e != nil {
+		t.Fatal(e)
+	}
+	for i := uint32(0); i < 2; i++ {
+		if e = s.AddCredit(ns, cbRec, &b100, i, false); e != nil {
+			t.Fatal(e)
+		}
+	}
+	// The unmined transactions are the two spenders of the coinbase outputs, and a spender of the first output of the
+	// first of them, which has to be moved after it.
+	spenderARec, e := NewTxRecordFromMsgTx(spendOutput(&cbRec.Hash, 0, 1e8, 2e8), time.Now())
+	if e != nil {
+		t.Fatal(e)
+	}
+	spenderBRec, e := NewTxRecordFromMsgTx(spendOutput(&cbRec.Hash, 1, 4e8, 8e8), time.Now())
+	if e != nil {
+		t.Fatal(e)
+	}
+	spenderCRec, e := NewTxRecordFromMsgTx(spendOutput(&spenderARec.Hash, 0, 5e7), time.Now())
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, rec := range []*TxRecord{spenderARec, spenderBRec, spenderCRec} {
+		if e = s.InsertTx(ns, rec, nil); e != nil {
+			t.Fatal(e)
+		}
+		for i := range rec.MsgTx.TxOut {
+			if e = s.AddCredit(ns, rec, nil, uint32(i), false); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}
+	bMaturity := BlockMeta{
+		Block: Block{Height: b100.Height + int32(chaincfg.TestNet3Params.CoinbaseMaturity)},
+		Time:  time.Now(),
+	}
+	if _, e = s.MineUnminedTxs(ns, []*chainhash.Hash{&chainhash.Hash{1}}, &bMaturity); e == nil {
+		t.Fatal("mined a transaction that isn't in the store")
+	}
+	delta, e := s.MineUnminedTxs(
+		ns, []*chainhash.Hash{&spenderCRec.Hash, &spenderBRec.Hash, &spenderARec.Hash}, &bMaturity,
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+	// The coinbase credits of 50e8 were spent for credits of 15e8, and 1e8 of those for a credit of 5e7.
+	if delta != -355e7 {
+		t.Fatalf("mined balance changed by %v, want %v", delta, amt.Amount(-355e7))
+	}
+	bal, e := s.Balance(ns, 1, bMaturity.Height)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if bal != 145e7 {
+		t.Fatalf("balance is %v, want %v", bal, amt.Amount(145e7))
+	}
+	for _, rec := range []*TxRecord{spenderARec, spenderBRec, spenderCRec} {
+		details, e := s.UniqueTxDetails(ns, &rec.Hash, &bMaturity.Block)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if details == nil {
+			t.Fatalf("no details of transaction %v in the block", rec.Hash)
+		}
+	}
+	unminedTxs, e := s.UnminedTxs(ns)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(unminedTxs) != 0 {
+		t.Fatalf("%d unmined transactions remain", len(unminedTxs))
+	}
+}
+
 // Test the optional-ness of the serialized transaction in a TxRecord.
 // NewTxRecord and NewTxRecordFromMsgTx both save the serialized transaction, so
 // manually strip it out to test this code path.
@@ -1829,3 +1941,915 @@ func TestAddDuplicateCreditAfterConfirm(t *testing.T) {
 		}
 	})
 }
+
+// TestSelectUnspent ensures the largest spendable outputs are selected first until they cover the target, and that a
+// target the spendable outputs can't cover is an ErrInsufficientFunds error.
+func TestSelectUnspent(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	dbtx, e := db.BeginReadWriteTx()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		e := dbtx.Commit()
+		if e != nil {
+			t.Log(e)
+		}
+	}()
+	ns := dbtx.ReadWriteBucket(namespaceKey)
+	b100 := BlockMeta{
+		Block: Block{Height: 100},
+		Time:  time.Now(),
+	}
+	rec, e := NewTxRecordFromMsgTx(spendOutput(&chainhash.Hash{1}, 0, 1e8, 5e8, 3e8, 2e8), b100.Time)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.InsertTx(ns, rec, &b100); e != nil {
+		t.Fatal(e)
+	}
+	for i := uint32(0); i < 4; i++ {
+		if e = s.AddCredit(ns, rec, &b100, i, false); e != nil {
+			t.Fatal(e)
+		}
+	}
+	tests := []struct {
+		target  amt.Amount
+		minConf int32
+		amounts []amt.Amount
+		total   amt.Amount
+	}{
+		{target: 4e8, minConf: 1, amounts: []amt.Amount{5e8}, total: 5e8},
+		{target: 6e8, minConf: 1, amounts: []amt.Amount{5e8, 3e8}, total: 8e8},
+		{target: 11e8, minConf: 1, amounts: []amt.Amount{5e8, 3e8, 2e8, 1e8}, total: 11e8},
+	}
+	for i, tst := range tests {
+		selected, total, e := s.SelectUnspent(ns, tst.target, tst.minConf, b100.Height)
+		if e != nil {
+			t.Fatalf("test %d: SelectUnspent failed: %v", i, e)
+		}
+		if total != tst.total || len(selected) != len(tst.amounts) {
+			t.Fatalf("test %d: selected %d outputs totalling %v, want %d totalling %v",
+				i, len(selected), total, len(tst.amounts), tst.total)
+		}
+		for j, cred := range selected {
+			if cred.Amount != tst.amounts[j] {
+				t.Fatalf("test %d: output %d is %v, want %v", i, j, cred.Amount, tst.amounts[j])
+			}
+		}
+	}
+	// More than there is, and anything at all before the outputs have enough confirmations.
+	for _, tst := range []struct {
+		target  amt.Amount
+		minConf int32
+	}{{12e8, 1}, {1e8, 2}} {
+		_, _, e = s.SelectUnspent(ns, tst.target, tst.minConf, b100.Height)
+		if serr, ok := e.(TxMgrError); !ok || serr.Code != ErrInsufficientFunds {
+			t.Fatalf("selecting %v with %d confirmations: got error %v, want ErrInsufficientFunds",
+				tst.target, tst.minConf, e)
+		}
+	}
+}
+
+// TestWatchOnlyCredits ensures watch-only credits are counted by WatchOnlyBalance and left out of Balance and
+// SpendableOutputs, and that they stay watch-only when a rollback moves them to the unmined pool and back.
+func TestWatchOnlyCredits(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	dbtx, e := db.BeginReadWriteTx()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		e := dbtx.Commit()
+		if e != nil {
+			t.Log(e)
+		}
+	}()
+	ns := dbtx.ReadWriteBucket(namespaceKey)
+	b100 := BlockMeta{
+		Block: Block{Height: 100},
+		Time:  time.Now(),
+	}
+	minedRec, e := NewTxRecordFromMsgTx(spendOutput(&chainhash.Hash{1}, 0, 2e8, 3e8), b100.Time)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.InsertTx(ns, minedRec, &b100); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.AddCredit(ns, minedRec, &b100, 0, false); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.AddWatchOnlyCredit(ns, minedRec, &b100, 1); e != nil {
+		t.Fatal(e)
+	}
+	unminedRec, e := NewTxRecordFromMsgTx(spendOutput(&chainhash.Hash{2}, 0, 4e8), time.Now())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.InsertTx(ns, unminedRec, nil); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.AddWatchOnlyCredit(ns, unminedRec, nil, 0); e != nil {
+		t.Fatal(e)
+	}
+	checkBalances := func(stage string, minConf, height int32, wantBal, wantWatched amt.Amount) {
+		bal, e := s.Balance(ns, minConf, height)
+		if e != nil {
+			t.Fatal(e)
+		}
+		watched, e := s.WatchOnlyBalance(ns, minConf, height)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if bal != wantBal || watched != wantWatched {
+			t.Fatalf("%s: balance %v and watch-only balance %v with %d confirmations, want %v and %v",
+				stage, bal, watched, minConf, wantBal, wantWatched)
+		}
+	}
+	checkBalances("mined", 1, b100.Height, 2e8, 3e8)
+	checkBalances("mined", 0, b100.Height, 2e8, 7e8)
+	spendable, e := s.SpendableOutputs(ns, 0, b100.Height)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(spendable) != 1 || spendable[0].Amount != 2e8 || spendable[0].WatchOnly {
+		t.Fatalf("spendable outputs are %+v, want only the owned credit", spendable)
+	}
+	unspent, e := s.UnspentOutputs(ns)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var watchOnly int
+	for _, cred := range unspent {
+		if cred.WatchOnly {
+			watchOnly++
+		}
+	}
+	if len(unspent) != 3 || watchOnly != 2 {
+		t.Fatalf("%d unspent outputs with %d watch-only, want 3 with 2", len(unspent), watchOnly)
+	}
+	// Roll the mined transaction back into the unmined pool and mine it again in the next block.
+	if e = s.Rollback(ns, b100.Height); e != nil {
+		t.Fatal(e)
+	}
+	checkBalances("rolled back", 0, b100.Height-1, 2e8, 7e8)
+	b101 := BlockMeta{
+		Block: Block{Height: 101},
+		Time:  time.Now(),
+	}
+	if e = s.InsertTx(ns, minedRec, &b101); e != nil {
+		t.Fatal(e)
+	}
+	checkBalances("mined again", 1, b101.Height, 2e8, 3e8)
+}
+
+// TestChainLimits checks that unmined transactions making a chain exceed the chain limits aren't inserted, and that a
+// rollback removes and reports the latest transactions of a chain that is too long.
+func TestChainLimits(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	dbtx, e := db.BeginReadWriteTx()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		e := dbtx.Commit()
+		if e != nil {
+			t.Log(e)
+		}
+	}()
+	ns := dbtx.ReadWriteBucket(namespaceKey)
+	// chain returns a chain of transactions each spending the first output of the one before.
+	chain := func(n int, first chainhash.Hash) (recs []*TxRecord) {
+		prev := first
+		for i := 0; i < n; i++ {
+			rec, e := NewTxRecordFromMsgTx(spendOutput(&prev, 0, 1e8, 1e8), time.Now())
+			if e != nil {
+				t.Fatal(e)
+			}
+			recs = append(recs, rec)
+			prev = rec.Hash
+		}
+		return recs
+	}
+	isChainLimit := func(e error) bool {
+		serr, ok := e.(TxMgrError)
+		return ok && serr.Code == ErrChainLimit
+	}
+	// A store is opened without limits, so a chain longer than the default limits is inserted.
+	unlimited := chain(DefaultChainLimits.MaxAncestors+1, chainhash.Hash{3})
+	for _, rec := range unlimited {
+		if e = s.InsertTx(ns, rec, nil); e != nil {
+			t.Fatalf("transaction of a long chain inserted without limits with error %v", e)
+		}
+	}
+	for i := len(unlimited) - 1; i >= 0; i-- {
+		if e = s.RemoveUnminedTx(ns, unlimited[i]); e != nil {
+			t.Fatal(e)
+		}
+	}
+	s.SetChainLimits(ChainLimits{MaxAncestors: 3})
+	long := chain(4, chainhash.Hash{1})
+	for _, rec := range long[:3] {
+		if e = s.InsertTx(ns, rec, nil); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e = s.InsertTx(ns, long[3], nil); !isChainLimit(e) {
+		t.Fatalf("fourth transaction of a chain inserted with error %v", e)
+	}
+	// A second spend of the first transaction would give it three descendants.
+	s.SetChainLimits(ChainLimits{MaxDescendants: 3})
+	sibling, e := NewTxRecordFromMsgTx(spendOutput(&long[0].Hash, 1, 1e8), time.Now())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.InsertTx(ns, sibling, nil); !isChainLimit(e) {
+		t.Fatalf("transaction exceeding the descendants of its ancestor inserted with error %v", e)
+	}
+	for _, rec := range long[:3] {
+		if e = s.RemoveUnminedTx(ns, rec); e != nil {
+			t.Fatal(e)
+		}
+	}
+	// A chain mined in one block is moved back to the unmined set when the block is rolled back, less the
+	// transactions past the limits.
+	s.SetChainLimits(ChainLimits{})
+	b100 := BlockMeta{Block: Block{Height: 100}, Time: time.Now()}
+	mined := chain(4, chainhash.Hash{2})
+	for _, rec := range mined {
+		if e = s.InsertTx(ns, rec, &b100); e != nil {
+			t.Fatal(e)
+		}
+	}
+	s.SetChainLimits(ChainLimits{MaxAncestors: 2})
+	var dropped []chainhash.Hash
+	s.NotifyChainLimitDrop = func(txHashes []chainhash.Hash) {
+		dropped = append(dropped, txHashes...)
+	}
+	if e = s.Rollback(ns, 100); e != nil {
+		t.Fatal(e)
+	}
+	if len(dropped) != 2 || dropped[0] != mined[2].Hash || dropped[1] != mined[3].Hash {
+		t.Fatalf("rollback dropped %v, want the last two transactions of the chain", dropped)
+	}
+	hashes, e := s.UnminedTxHashes(ns)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(hashes) != 2 {
+		t.Fatalf("%d unmined transactions after the rollback, want 2", len(hashes))
+	}
+	for _, hash := range hashes {
+		if *hash != mined[0].Hash && *hash != mined[1].Hash {
+			t.Fatalf("unmined transaction %v isn't one of the first two of the chain", hash)
+		}
+	}
+}
+
+// TestBroadcastInfo checks that the broadcasts of an unmined transaction are counted and shown in its details, and
+// forgotten once it is mined.
+func TestBroadcastInfo(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	dbtx, e := db.BeginReadWriteTx()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		e := dbtx.Commit()
+		if e != nil {
+			t.Log(e)
+		}
+	}()
+	ns := dbtx.ReadWriteBucket(namespaceKey)
+	rec, e := NewTxRecordFromMsgTx(spendOutput(&chainhash.Hash{1}, 0, 1e8), time.Now())
+	if e != nil {
+		t.Fatal(e)
+	}
+	first := time.Unix(1600000000, 0)
+	if e = s.RecordBroadcastAttempt(ns, &rec.Hash, first); e == nil {
+		t.Fatal("recorded a broadcast of a transaction that isn't in the store")
+	}
+	if e = s.InsertTx(ns, rec, nil); e != nil {
+		t.Fatal(e)
+	}
+	if info, e := s.FetchBroadcastInfo(ns, &rec.Hash); e != nil || info != nil {
+		t.Fatalf("got broadcast info %v (%v) before any broadcast", info, e)
+	}
+	last := first.Add(time.Hour)
+	for _, at := range []time.Time{first, first.Add(time.Minute), last} {
+		if e = s.RecordBroadcastAttempt(ns, &rec.Hash, at); e != nil {
+			t.Fatal(e)
+		}
+	}
+	details, e := s.TxDetails(ns, &rec.Hash)
+	if e != nil {
+		t.Fatal(e)
+	}
+	want := BroadcastInfo{FirstBroadcast: first, LastBroadcast: last, Attempts: 3}
+	if details.Broadcast == nil || *details.Broadcast != want {
+		t.Fatalf("got broadcast info %v, want %v", details.Broadcast, want)
+	}
+	b100 := BlockMeta{Block: Block{Height: 100}, Time: time.Now()}
+	if e = s.InsertTx(ns, rec, &b100); e != nil {
+		t.Fatal(e)
+	}
+	if info, e := s.FetchBroadcastInfo(ns, &rec.Hash); e != nil || info != nil {
+		t.Fatalf("got broadcast info %v (%v) after the transaction was mined", info, e)
+	}
+}
+
+// TestMemoryNamespace runs a store kept in a memory namespace through inserts, credits and a rollback.
+func TestMemoryNamespace(t *testing.T) {
+	t.Parallel()
+	ns := NewMemoryNamespace()
+	if e := Create(ns); e != nil {
+		t.Fatal(e)
+	}
+	s, e := Open(ns, &chaincfg.TestNet3Params)
+	if e != nil {
+		t.Fatal(e)
+	}
+	cb, e := NewTxRecordFromMsgTx(newCoinBase(50e8), timeNow())
+	if e != nil {
+		t.Fatal(e)
+	}
+	b100 := makeBlockMeta(100)
+	if e = s.InsertTx(ns, cb, &b100); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.AddCredit(ns, cb, &b100, 0, false); e != nil {
+		t.Fatal(e)
+	}
+	spend, e := NewTxRecordFromMsgTx(spendOutput(&cb.Hash, 0, 49e8), timeNow())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.InsertTx(ns, spend, nil); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.AddCredit(ns, spend, nil, 0, false); e != nil {
+		t.Fatal(e)
+	}
+	syncHeight := 100 + int32(chaincfg.TestNet3Params.CoinbaseMaturity)
+	credits, e := s.SpendableOutputs(ns, 0, syncHeight)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(credits) != 1 || credits[0].Hash != spend.Hash {
+		t.Fatalf("spendable outputs are %v, want only the output of the unmined spend", credits)
+	}
+	// Rolling back the coinbase removes the unmined transaction spending it.
+	if e = s.Rollback(ns, 100); e != nil {
+		t.Fatal(e)
+	}
+	unmined, e := s.UnminedTxs(ns)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(unmined) != 0 {
+		t.Fatalf("%d unmined transactions after the rollback, want none", len(unmined))
+	}
+	if credits, e = s.SpendableOutputs(ns, 0, syncHeight); e != nil || len(credits) != 0 {
+		t.Fatalf("spendable outputs %v after the rollback (%v), want none", credits, e)
+	}
+}
+
+// countingNamespace is a memory namespace that serves the point reads and writes of records itself, counting them.
+type countingNamespace struct {
+	walletdb.ReadWriteBucket
+	fetches, puts, deletes int
+}
+
+func (ns *countingNamespace) bucket(name []byte) walletdb.ReadWriteBucket {
+	if name == nil {
+		return ns.ReadWriteBucket
+	}
+	return ns.NestedReadWriteBucket(name)
+}
+
+func (ns *countingNamespace) FetchValue(bucket, key []byte) []byte {
+	ns.fetches++
+	return ns.bucket(bucket).Get(key)
+}
+
+func (ns *countingNamespace) PutValue(bucket, key, value []byte) error {
+	ns.puts++
+	return ns.bucket(bucket).Put(key, value)
+}
+
+func (ns *countingNamespace) DeleteValue(bucket, key []byte) error {
+	ns.deletes++
+	return ns.bucket(bucket).Delete(key)
+}
+
+// TestNamespaceStorage checks that the records of a store are read, written and deleted through the Storage of a
+// namespace that implements it.
+func TestNamespaceStorage(t *testing.T) {
+	t.Parallel()
+	ns := &countingNamespace{ReadWriteBucket: NewMemoryNamespace()}
+	if e := Create(ns); e != nil {
+		t.Fatal(e)
+	}
+	s, e := Open(ns, &chaincfg.TestNet3Params)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if ns.puts == 0 || ns.fetches == 0 {
+		t.Fatalf("creating and opening the store made %d puts and %d fetches through the namespace", ns.puts, ns.fetches)
+	}
+	cb, e := NewTxRecordFromMsgTx(newCoinBase(50e8), timeNow())
+	if e != nil {
+		t.Fatal(e)
+	}
+	b100 := makeBlockMeta(100)
+	puts := ns.puts
+	if e = s.InsertTx(ns, cb, &b100); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.AddCredit(ns, cb, &b100, 0, false); e != nil {
+		t.Fatal(e)
+	}
+	if ns.puts == puts {
+		t.Fatal("inserting a credit wasn't written through the namespace")
+	}
+	if details, e := s.TxDetails(ns, &cb.Hash); e != nil || details == nil || len(details.Credits) != 1 {
+		t.Fatalf("got details %v (%v), want the coinbase with its credit", details, e)
+	}
+	if e = s.Rollback(ns, 100); e != nil {
+		t.Fatal(e)
+	}
+	if ns.deletes == 0 {
+		t.Fatal("rolling back the coinbase deleted nothing through the namespace")
+	}
+	if details, e := s.TxDetails(ns, &cb.Hash); e != nil || details != nil {
+		t.Fatalf("got details %v (%v) after the rollback, want none", details, e)
+	}
+}
+
+// TestBalanceChanges checks that changes of the credit totals are notified once the transaction making them is
+// committed, and never for a transaction that was rolled back.
+func TestBalanceChanges(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	var changes []BalanceChange
+	s.NotifyBalanceChange = func(change BalanceChange) {
+		changes = append(changes, change)
+	}
+	committed := func() {
+		if e := walletdb.View(
+			db, func(tx walletdb.ReadTx) error {
+				return s.BalanceChangesCommitted(tx.ReadBucket(namespaceKey))
+			},
+		); e != nil {
+			t.Fatal(e)
+		}
+	}
+	b100 := BlockMeta{Block: Block{Height: 100}, Time: time.Now()}
+	cbRec, e := NewTxRecordFromMsgTx(newCoinBase(20e8, 30e8), b100.Time)
+	if e != nil {
+		t.Fatal(e)
+	}
+	spendRec, e := NewTxRecordFromMsgTx(spendOutput(&cbRec.Hash, 0, 5e8, 14e8), time.Now())
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			ns := tx.ReadWriteBucket(namespaceKey)
+			if e = s.InsertTx(ns, cbRec, &b100); e != nil {
+				return e
+			}
+			if e = s.AddCredit(ns, cbRec, &b100, 0, false); e != nil {
+				return e
+			}
+			if len(changes) != 0 {
+				t.Fatal("balance change notified before the commit")
+			}
+			return s.AddCredit(ns, cbRec, &b100, 1, false)
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+	committed()
+	want := []BalanceChange{{Mined: 50e8, MinedDelta: 50e8}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("balance changes %v, want %v", changes, want)
+	}
+	// A transaction rolled back isn't notified, and a commit that changed nothing isn't either.
+	dbtx, e := db.BeginReadWriteTx()
+	if e != nil {
+		t.Fatal(e)
+	}
+	ns := dbtx.ReadWriteBucket(namespaceKey)
+	if e = s.InsertTx(ns, spendRec, nil); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.AddCredit(ns, spendRec, nil, 1, true); e != nil {
+		t.Fatal(e)
+	}
+	if e = dbtx.Rollback(); e != nil {
+		t.Fatal(e)
+	}
+	s.BalanceChangesRolledBack()
+	committed()
+	if len(changes) != 1 {
+		t.Fatalf("balance changes %v notified for a transaction that was rolled back", changes[1:])
+	}
+	// The unmined spend of the first coinbase output leaves the mined total as it is until it is mined.
+	e = walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			ns := tx.ReadWriteBucket(namespaceKey)
+			if e = s.InsertTx(ns, spendRec, nil); e != nil {
+				return e
+			}
+			return s.AddCredit(ns, spendRec, nil, 1, true)
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+	committed()
+	b101 := BlockMeta{Block: Block{Height: 101}, Time: time.Now()}
+	e = walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) error {
+			return s.InsertTx(tx.ReadWriteBucket(namespaceKey), spendRec, &b101)
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+	committed()
+	want = append(
+		want,
+		BalanceChange{Mined: 50e8, Unmined: 14e8, UnminedDelta: 14e8},
+		BalanceChange{Mined: 44e8, MinedDelta: -6e8, UnminedDelta: -14e8},
+	)
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("balance changes %v, want %v", changes, want)
+	}
+}
+
+// TestRecomputeMinedBalance checks that the mined balance is recomputed from the unspent mined credits, both when it is
+// right and after it was overwritten with a wrong total.
+func TestRecomputeMinedBalance(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	e = walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			ns := tx.ReadWriteBucket(namespaceKey)
+			b100 := BlockMeta{Block: Block{Height: 100}, Time: time.Now()}
+			cbRec, e := NewTxRecordFromMsgTx(newCoinBase(20e8, 30e8), b100.Time)
+			if e != nil {
+				return e
+			}
+			if e = s.InsertTx(ns, cbRec, &b100); e != nil {
+				return e
+			}
+			for i := uint32(0); i < 2; i++ {
+				if e = s.AddCredit(ns, cbRec, &b100, i, false); e != nil {
+					return e
+				}
+			}
+			// The first coinbase output is spent in the next block, for a credit of 5e8.
+			b101 := BlockMeta{Block: Block{Height: 101}, Time: time.Now()}
+			spendRec, e := NewTxRecordFromMsgTx(spendOutput(&cbRec.Hash, 0, 5e8, 14e8), b101.Time)
+			if e != nil {
+				return e
+			}
+			if e = s.InsertTx(ns, spendRec, &b101); e != nil {
+				return e
+			}
+			if e = s.AddCredit(ns, spendRec, &b101, 0, true); e != nil {
+				return e
+			}
+			syncHeight := b100.Height + int32(chaincfg.TestNet3Params.CoinbaseMaturity)
+			for _, corrupt := range []bool{false, true} {
+				if corrupt {
+					// Overwrite the mined balance, which is stored under "bal" in the namespace bucket.
+					if e = ns.Put([]byte("bal"), []byte{1, 0, 0, 0, 0, 0, 0, 0}); e != nil {
+						return e
+					}
+				}
+				minedBalance, e := s.RecomputeMinedBalance(ns)
+				if e != nil {
+					return e
+				}
+				if minedBalance != 35e8 {
+					t.Fatalf("recomputed mined balance is %v, want %v", minedBalance, amt.Amount(35e8))
+				}
+				bal, e := s.Balance(ns, 1, syncHeight)
+				if e != nil {
+					return e
+				}
+				if bal != 35e8 {
+					t.Fatalf("balance after recomputing is %v, want %v", bal, amt.Amount(35e8))
+				}
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+// TestStuckTransactions checks that only the unmined transactions received longer ago than the threshold are returned,
+// the oldest first.
+func TestStuckTransactions(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	e = walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			ns := tx.ReadWriteBucket(namespaceKey)
+			b100 := BlockMeta{Block: Block{Height: 100}, Time: time.Now()}
+			cbRec, e := NewTxRecordFromMsgTx(newCoinBase(1e8, 2e8, 3e8), b100.Time)
+			if e != nil {
+				return e
+			}
+			if e = s.InsertTx(ns, cbRec, &b100); e != nil {
+				return e
+			}
+			var want []chainhash.Hash
+			for i, age := range []time.Duration{time.Hour * 3, time.Hour * 2, 0} {
+				spendRec, e := NewTxRecordFromMsgTx(spendOutput(&cbRec.Hash, uint32(i), 5e7), time.Now().Add(-age))
+				if e != nil {
+					return e
+				}
+				if e = s.InsertTx(ns, spendRec, nil); e != nil {
+					return e
+				}
+				if age > time.Hour {
+					want = append(want, spendRec.Hash)
+				}
+			}
+			stuck, e := s.StuckTransactions(ns, time.Hour)
+			if e != nil {
+				return e
+			}
+			if len(stuck) != len(want) {
+				t.Fatalf("got %d stuck transactions, want %d", len(stuck), len(want))
+			}
+			for i := range stuck {
+				if stuck[i].Hash != want[i] {
+					t.Fatalf("stuck transaction %d is %v, want %v", i, stuck[i].Hash, want[i])
+				}
+			}
+			if stuck, e = s.StuckTransactions(ns, time.Hour*4); e != nil {
+				return e
+			}
+			if len(stuck) != 0 {
+				t.Fatalf("got %d stuck transactions older than the oldest, want none", len(stuck))
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+// TestUnminedSpendsOf checks that all the conflicting unmined spends of an outpoint are returned.
+func TestUnminedSpendsOf(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	e = walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			ns := tx.ReadWriteBucket(namespaceKey)
+			b100 := BlockMeta{Block: Block{Height: 100}, Time: time.Now()}
+			cbRec, e := NewTxRecordFromMsgTx(newCoinBase(1e8, 2e8), b100.Time)
+			if e != nil {
+				return e
+			}
+			if e = s.InsertTx(ns, cbRec, &b100); e != nil {
+				return e
+			}
+			want := make(map[chainhash.Hash]struct{})
+			for _, amount := range []int64{5e7, 6e7} {
+				spendRec, e := NewTxRecordFromMsgTx(spendOutput(&cbRec.Hash, 0, amount), time.Now())
+				if e != nil {
+					return e
+				}
+				if e = s.InsertTx(ns, spendRec, nil); e != nil {
+					return e
+				}
+				want[spendRec.Hash] = struct{}{}
+			}
+			spends, e := s.UnminedSpendsOf(ns, wire.NewOutPoint(&cbRec.Hash, 0))
+			if e != nil {
+				return e
+			}
+			if len(spends) != len(want) {
+				t.Fatalf("got %d unmined spends, want %d", len(spends), len(want))
+			}
+			for _, hash := range spends {
+				if _, ok := want[hash]; !ok {
+					t.Fatalf("unexpected unmined spend %v", hash)
+				}
+			}
+			if spends, e = s.UnminedSpendsOf(ns, wire.NewOutPoint(&cbRec.Hash, 1)); e != nil {
+				return e
+			}
+			if len(spends) != 0 {
+				t.Fatalf("got %d unmined spends of an unspent output, want none", len(spends))
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+// TestSnapshotRestore checks that a store restored from a snapshot holds the same records as the store it was taken of,
+// and that a snapshot isn't restored over an existing store.
+func TestSnapshotRestore(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	var snapshot bytes.Buffer
+	e = walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			ns := tx.ReadWriteBucket(namespaceKey)
+			b100 := BlockMeta{Block: Block{Height: 100}, Time: time.Now()}
+			cbRec, e := NewTxRecordFromMsgTx(newCoinBase(20e8, 30e8), b100.Time)
+			if e != nil {
+				return e
+			}
+			if e = s.InsertTx(ns, cbRec, &b100); e != nil {
+				return e
+			}
+			if e = s.AddCredit(ns, cbRec, &b100, 0, false); e != nil {
+				return e
+			}
+			spendRec, e := NewTxRecordFromMsgTx(spendOutput(&cbRec.Hash, 0, 5e8, 14e8), time.Now())
+			if e != nil {
+				return e
+			}
+			if e = s.InsertTx(ns, spendRec, nil); e != nil {
+				return e
+			}
+			if e = s.AddCredit(ns, spendRec, nil, 0, true); e != nil {
+				return e
+			}
+			if e = s.Snapshot(ns, &snapshot); e != nil {
+				return e
+			}
+			if e = Restore(ns, bytes.NewReader(snapshot.Bytes())); e == nil {
+				t.Fatal("snapshot restored over an existing store")
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+	ns := NewMemoryNamespace()
+	if e = Restore(ns, bytes.NewReader(snapshot.Bytes())); e != nil {
+		t.Fatal(e)
+	}
+	restored, e := Open(ns, &chaincfg.TestNet3Params)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var again bytes.Buffer
+	if e = restored.Snapshot(ns, &again); e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(again.Bytes(), snapshot.Bytes()) {
+		t.Fatal("snapshot of the restored store differs from the snapshot it was restored from")
+	}
+	hashes, e := restored.UnminedTxHashes(ns)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(hashes) != 1 {
+		t.Fatalf("restored store has %d unmined transactions, want 1", len(hashes))
+	}
+	if e = Restore(NewMemoryNamespace(), bytes.NewReader(snapshot.Bytes()[:snapshot.Len()-1])); e == nil {
+		t.Fatal("truncated snapshot restored")
+	}
+}
+
+// TestSpentCredits checks that the credits spent in a range of heights are passed in the order they were spent, with
+// the heights they were spent at.
+func TestSpentCredits(t *testing.T) {
+	t.Parallel()
+	s, db, teardown, e := testStore()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer teardown()
+	e = walletdb.Update(
+		db, func(tx walletdb.ReadWriteTx) (e error) {
+			ns := tx.ReadWriteBucket(namespaceKey)
+			b100 := BlockMeta{Block: Block{Height: 100}, Time: time.Now()}
+			cbRec, e := NewTxRecordFromMsgTx(newCoinBase(1e8, 2e8, 3e8), b100.Time)
+			if e != nil {
+				return e
+			}
+			if e = s.InsertTx(ns, cbRec, &b100); e != nil {
+				return e
+			}
+			for i := uint32(0); i < 3; i++ {
+				if e = s.AddCredit(ns, cbRec, &b100, i, false); e != nil {
+					return e
+				}
+			}
+			// The second output is spent at height 101 and the first at height 102, and the third is left unspent.
+			for i, index := range []uint32{1, 0} {
+				block := BlockMeta{Block: Block{Height: 101 + int32(i)}, Time: time.Now()}
+				spendRec, e := NewTxRecordFromMsgTx(spendOutput(&cbRec.Hash, index, 5e7), block.Time)
+				if e != nil {
+					return e
+				}
+				if e = s.InsertTx(ns, spendRec, &block); e != nil {
+					return e
+				}
+			}
+			type spend struct {
+				index  uint32
+				height int32
+			}
+			spentCredits := func(begin, end int32) (spends []spend) {
+				e := s.SpentCredits(
+					ns, begin, end, func(rec CreditRecord, spenderHeight int32) error {
+						if !rec.Spent || rec.Amount != amt.Amount(rec.Index+1)*1e8 {
+							t.Fatalf("unexpected spent credit %+v", rec)
+						}
+						spends = append(spends, spend{rec.Index, spenderHeight})
+						return nil
+					},
+				)
+				if e != nil {
+					t.Fatal(e)
+				}
+				return spends
+			}
+			if spends := spentCredits(0, 1000); !reflect.DeepEqual(spends, []spend{{1, 101}, {0, 102}}) {
+				t.Fatalf("got spent credits %v", spends)
+			}
+			if spends := spentCredits(102, 102); !reflect.DeepEqual(spends, []spend{{0, 102}}) {
+				t.Fatalf("got spent credits %v at height 102", spends)
+			}
+			if spends := spentCredits(103, 1000); len(spends) != 0 {
+				t.Fatalf("got spent credits %v above the spends", spends)
+			}
+			stop := errors.New("stop")
+			calls := 0
+			e = s.SpentCredits(
+				ns, 0, 1000, func(CreditRecord, int32) error {
+					calls++
+					return stop
+				},
+			)
+			if e != stop || calls != 1 {
+				t.Fatalf("iteration wasn't stopped by the error: %v after %d calls", e, calls)
+			}
+			return nil
+		},
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+}
@@ -1,6 +1,10 @@
 package wtxmgr
 
 import (
+	"fmt"
+	"sort"
+	"time"
+	
 	chainhash "github.com/p9c/pod/pkg/chainhash"
 	"github.com/p9c/pod/pkg/wire"
 	"github.com/p9c/pod/pkg/walletdb"
@@ -24,6 +28,9 @@ func (s *Store) insertMemPoolTx(ns walletdb.ReadWriteBucket, rec *TxRecord) (e e
 			return nil
 		}
 	}
+	if e = s.checkChainLimits(ns, rec); e != nil {
+		return e
+	}
 	I.Ln("inserting unconfirmed transaction", rec.Hash)
 	v, e := valueTxRecord(rec)
 	if e != nil {
@@ -125,6 +132,9 @@ func RemoveConflict(ns walletdb.ReadWriteBucket, rec *TxRecord) (e error) {
 			return e
 		}
 	}
+	if e := deleteRawBroadcast(ns, rec.Hash[:]); E.Chk(e) {
+		return e
+	}
 	return deleteRawUnmined(ns, rec.Hash[:])
 }
 
@@ -182,3 +192,77 @@ func (s *Store) unminedTxHashes(ns walletdb.ReadBucket) (hashes []*chainhash.Has
 	)
 	return hashes, e
 }
+
+// UnminedSpendsOf returns the hashes of the unmined transactions that spend the outpoint. More than one is returned
+// when unmined transactions conflict with each other, of which at most one can be mined.
+func (s *Store) UnminedSpendsOf(ns walletdb.ReadBucket, op *wire.OutPoint) ([]chainhash.Hash, error) {
+	return fetchUnminedInputSpendTxHashes(ns, canonicalOutPoint(&op.Hash, op.Index)), nil
+}
+
+// BroadcastInfo records the broadcasts of an unmined transaction, for deciding whether a transaction that isn't being
+// mined needs its fee bumped.
+type BroadcastInfo struct {
+	// FirstBroadcast is when the transaction was first broadcast.
+	FirstBroadcast time.Time
+	// LastBroadcast is when the transaction was last broadcast.
+	LastBroadcast time.Time
+	// Attempts is the number of times the transaction was broadcast, counting the first.
+	Attempts uint32
+}
+
+// RecordBroadcastAttempt records that the unmined transaction with hash txHash was broadcast, or rebroadcast, at time t.
+// The record is removed when the transaction is mined or removed from the store.
+func (s *Store) RecordBroadcastAttempt(ns walletdb.ReadWriteBucket, txHash *chainhash.Hash, t time.Time) (e error) {
+	if existsRawUnmined(ns, txHash[:]) == nil {
+		str := fmt.Sprintf("transaction %v is not unmined", txHash)
+		return storeError(ErrInput, str, nil)
+	}
+	info := BroadcastInfo{FirstBroadcast: t}
+	if v := existsRawBroadcast(ns, txHash[:]); v != nil {
+		if e = readRawBroadcast(v, &info); e != nil {
+			return e
+		}
+	}
+	info.LastBroadcast = t
+	info.Attempts++
+	return putRawBroadcast(ns, txHash[:], valueBroadcast(&info))
+}
+
+// FetchBroadcastInfo returns the broadcasts recorded for the unmined transaction with hash txHash, or nil if none were.
+func (s *Store) FetchBroadcastInfo(ns walletdb.ReadBucket, txHash *chainhash.Hash) (*BroadcastInfo, error) {
+	v := existsRawBroadcast(ns, txHash[:])
+	if v == nil {
+		return nil, nil
+	}
+	var info BroadcastInfo
+	if e := readRawBroadcast(v, &info); e != nil {
+		return nil, e
+	}
+	return &info, nil
+}
+
+// StuckTransactions returns the details of the unmined transactions that were received longer than olderThan ago, the
+// oldest first, so that they can be rebroadcast or have their fees bumped.
+func (s *Store) StuckTransactions(ns walletdb.ReadBucket, olderThan time.Duration) ([]TxDetails, error) {
+	cutoff := time.Now().Add(-olderThan)
+	var stuck []TxDetails
+	_, e := s.rangeUnminedTransactions(
+		ns, func(details []TxDetails) (bool, error) {
+			for i := range details {
+				if details[i].Received.Before(cutoff) {
+					stuck = append(stuck, details[i])
+				}
+			}
+			return false, nil
+		},
+	)
+	if e != nil {
+		return nil, e
+	}
+	sort.Slice(
+		stuck, func(i, j int) bool {
+			return stuck[i].Received.Before(stuck[j].Received)
+		},
+	)
+	return stuck, nil
+}